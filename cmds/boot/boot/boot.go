@@ -1,441 +1,306 @@
-// Copyright 2012-2017 the u-root Authors. All rights reserved
+// Copyright 2012-2019 the u-root Authors. All rights reserved
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// boot allows to handover a system running linuxboot/u-root
-// to a legacy preinstalled operating system by replacing the traditional
-// bootloader path
-
+// boot finds bootable entries on local disks and the network and lets the
+// user pick one from a menu.
 //
 // Synopsis:
-//	boot [-dev][-v][-dry-run]
+//	boot [-dev GLOB] [-boot NAME] [-net] [-netif REGEX] [-timeout SECONDS] [-v] [-dry-run]
 //
 // Description:
-//	If returns to u-root shell, the code didn't found a local bootable option
-//      -dev glob to use; default is /sys/class/block/*
-//      -v prints messages
-//      -dry-run doesn't really boot
+//	All block devices matching -dev and their partitions are mounted
+//	read-only and searched for GRUB, syslinux and Boot Loader
+//	Specification configurations, unified kernel images and ESXi
+//	installations. With -net, DHCP requests are sent on all interfaces
+//	matching -netif at the same time to find network boot configurations.
+//	All entries found are shown in a menu; unless a key is pressed, the
+//	default entry is booted after the timeout.
 //
-// Notes:
-//	The code is looking for boot/grub/grub.cfg file as to identify the
-//	boot option.
-//	The first bootable device found in the block device tree is the one used
-//	Windows is not supported (that is a work in progress)
+//	-dev      glob of block devices; default is /sys/block/*
+//	-boot     name of the default entry; default is the default entry of
+//	          the first configuration found
+//	-net      also look for network boot configurations
+//	-netif    regular expression of interfaces to use for network boot
+//	-timeout  seconds until the default entry is booted; -1 waits forever
+//	-v        print debug messages
+//	-dry-run  load the chosen entry, but don't kexec it
+//	-remove   comma separated list of kernel parameters to remove
+//	-reuse    comma separated list of kernel parameters to reuse from the
+//	          current kernel
+//	-append   additional kernel parameters
 //
 // Example:
-//	boot -v 	- Start the script in verbose mode for debugging purpose
-
+//	boot -v -timeout 5 - Show the menu for 5 seconds, printing debug messages
 package main
 
 import (
-	"encoding/binary"
-	"errors"
+	"context"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/diskboot"
+	"github.com/u-root/u-root/pkg/boot/esxi"
+	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/boot/netboot"
+	"github.com/u-root/u-root/pkg/boot/uki"
 	"github.com/u-root/u-root/pkg/cmdline"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/termios"
 )
 
-const (
-	bootableMBR     = 0xaa55
-	signatureOffset = 510
-)
-
-type bootEntry struct {
-	kernel  string
-	initrd  string
-	cmdline string
-}
-
 var (
 	devGlob           = flag.String("dev", "/sys/block/*", "Glob for devices")
+	defaultBoot       = flag.String("boot", "default", "Default entry to boot")
+	netBoot           = flag.Bool("net", false, "Look for network boot configurations")
+	netIfaces         = flag.String("netif", "^e.*", "Regular expression of interfaces to use for network boot")
+	timeout           = flag.Int("timeout", 10, "Seconds until the default entry is booted, -1 to wait forever")
 	verbose           = flag.Bool("v", false, "Print debug messages")
 	debug             = func(string, ...interface{}) {}
-	dryRun            = flag.Bool("dry-run", false, "download kernel, but don't kexec it")
-	defaultBoot       = flag.String("boot", "default", "Default entry to boot")
-	uroot             string
+	dryRun            = flag.Bool("dry-run", false, "load the kernel, but don't kexec it")
 	removeCmdlineItem = flag.String("remove", "console", "comma separated list of kernel params value to remove from parsed kernel configuration (default to console)")
 	reuseCmdlineItem  = flag.String("reuse", "console", "comma separated list of kernel params value to reuse from current kernel (default to console)")
 	appendCmdline     = flag.String("append", "", "Additional kernel params")
 )
 
-// updateBootCmdline get the kernel command line parameters and filter it:
-// it removes parameters listed in 'remove' and append extra parameters from
-// the 'append' and 'reuse' flags
-func updateBootCmdline(cl string) string {
-	f := cmdline.NewUpdateFilter(*appendCmdline, strings.Split(*removeCmdlineItem, ","), strings.Split(*reuseCmdlineItem, ","))
-	return f.Update(cl)
-}
+const (
+	dhcpTimeout = 5 * time.Second
+	dhcpTries   = 3
+)
 
-// checkForBootableMBR is looking for bootable MBR signature
-// Current support is limited to Hard disk devices and USB devices
-func checkForBootableMBR(path string) error {
-	var sig uint16
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	if err := binary.Read(io.NewSectionReader(f, signatureOffset, 2), binary.LittleEndian, &sig); err != nil {
-		return err
-	}
-	if sig != bootableMBR {
-		err := fmt.Errorf("%v is not a bootable device", path)
-		return err
-	}
-	return nil
+// source is the result of one discovery method.
+type source struct {
+	images []boot.OSImage
+
+	// defaultEntry is the index of the default entry in images, or -1.
+	defaultEntry int
 }
 
-// getSupportedFilesystem returns all block file system supported by the linuxboot kernel
-func getSupportedFilesystem() ([]string, error) {
-	var err error
-	fs, err := ioutil.ReadFile("/proc/filesystems")
+// blockDevices returns the sysfs directories of the block devices matching
+// glob and of their partitions.
+func blockDevices(glob string) ([]string, error) {
+	sysList, err := filepath.Glob(glob)
 	if err != nil {
 		return nil, err
 	}
-	var returnValue []string
-	for _, f := range strings.Split(string(fs), "\n") {
-		n := strings.Fields(f)
-		if len(n) != 1 {
-			continue
+	var devs []string
+	seen := make(map[string]bool)
+	for _, sys := range sysList {
+		// Partitions of /sys/block/sda are in /sys/block/sda/sda1.
+		parts, _ := filepath.Glob(filepath.Join(sys, filepath.Base(sys)+"*"))
+		for _, d := range append([]string{sys}, parts...) {
+			if !seen[filepath.Base(d)] {
+				seen[filepath.Base(d)] = true
+				devs = append(devs, d)
+			}
 		}
-		returnValue = append(returnValue, n[0])
 	}
-	return returnValue, err
-
+	return devs, nil
 }
 
-// mountEntry tries to mount a specific block device using a list of
-// supported file systems. We have to try to mount the device
-// itself, since devices can be filesystem formatted but not
-// partitioned; and all its partitions.
-func mountEntry(d string, supportedFilesystem []string) error {
-	var err error
-	debug("Try to mount %v", d)
+// localImages mounts all block devices matching glob and their partitions
+// and returns the boot entries found on them, and the mount points that are
+// in use.
+func localImages(glob string) (source, []*mount.MountPoint) {
+	src := source{defaultEntry: -1}
+	var mounts []*mount.MountPoint
 
-	// find or create the mountpoint.
-	m := filepath.Join(uroot, d)
-	if _, err = os.Stat(m); err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(m, 0777)
-	}
+	sysList, err := blockDevices(glob)
 	if err != nil {
-		debug("Can't make %v", m)
-		return err
+		log.Printf("Invalid device glob %q: %v", glob, err)
+		return src, nil
 	}
-	for _, filesystem := range supportedFilesystem {
-		var flags = uintptr(syscall.MS_RDONLY)
-		debug("\twith %v", filesystem)
-		if err := syscall.Mount(d, m, filesystem, flags, ""); err == nil {
-			return err
+	for _, sys := range sysList {
+		dev := filepath.Join("/dev", filepath.Base(sys))
+
+		// ESXi uses fixed partition numbers on the whole disk.
+		if _, err := os.Stat(filepath.Join(sys, "partition")); os.IsNotExist(err) {
+			if imgs, err := esxi.LoadDisk(dev); err == nil {
+				for _, img := range imgs {
+					src.images = append(src.images, img)
+				}
+			} else {
+				debug("No ESXi on %s: %v", dev, err)
+			}
 		}
-	}
-	debug("No mount succeeded")
-	return fmt.Errorf("Unable to mount any partition on %v", d)
-}
-
-func umountEntry(n string) error {
-	return syscall.Unmount(n, syscall.MNT_DETACH)
-}
 
-// loadISOLinux reads an isolinux.cfg file. It further needs to
-// process include directives.
-// The include files are correctly placed in line at the place they
-// were included. Include files can include other files, i.e. this
-// function can recurse.
-// It returns a []string of all the files, the path to the directory
-// contain the boot images (bzImage, initrd, etc.) and the mount point.
-// For now, these are the same, but in, e.g., grub, they are different,
-// and they might in future change here too.
-func loadISOLinux(dir, base string) ([]string, string, string, error) {
-	sol := filepath.Join(dir, base)
-	isolinux, err := ioutil.ReadFile(sol)
-	if err != nil {
-		return nil, "", "", err
-	}
-
-	// it's easier we think to do include processing here.
-	lines := strings.Split(string(isolinux), "\n")
-	var result []string
-	for _, l := range lines {
-		f := strings.Fields(l)
-		if len(f) == 0 {
+		dir, err := ioutil.TempDir("", "boot-")
+		if err != nil {
+			log.Printf("Failed to create mount point: %v", err)
 			continue
 		}
-		switch f[0] {
-		default:
-			result = append(result, l)
-		case "include":
-			i, _, _, err := loadISOLinux(dir, f[1])
-			if err != nil {
-				return nil, "", "", err
-			}
-			result = append(result, i...)
-			// If the string contain include
-			// we must call back as to read the content of the file
+		mp, err := mount.TryMount(dev, dir, mount.MS_RDONLY)
+		if err != nil {
+			debug("Failed to mount %s: %v", dev, err)
+			os.Remove(dir)
+			continue
 		}
-	}
-	return result, dir, dir, nil
-}
-
-// checkBootEntry is looking for grub.cfg file
-// and return absolute path to it. It returns a []string with all the commands,
-// the path to the direction containing files to load for kexec, and the mountpoint.
-func checkBootEntry(mountPoint string) ([]string, string, string, error) {
-	grub, err := ioutil.ReadFile(filepath.Join(mountPoint, "boot/grub/grub.cfg"))
-	if err == nil {
-		return strings.Split(string(grub), "\n"), filepath.Join(mountPoint, "/boot"), mountPoint, nil
-	}
-	return loadISOLinux(filepath.Join(mountPoint, "isolinux"), "isolinux.cfg")
-}
 
-// getFileMenuContent is parsing a grub.cfg file
-// output: bootEntries
-// grub parsing is a good deal messier than it looks.
-// This is a simple parser will fail on anything tricky.
-func getBootEntries(lines []string) (map[string]*bootEntry, map[string]string, error) {
-	// There are two ways to reference a bootEntry: its order in the file and its
-	// name.
-	var (
-		lineno      int
-		line        string
-		err         error
-		curEntry    string
-		numEntry    int
-		bootEntries = make(map[string]*bootEntry)
-		bootVars    = make(map[string]string)
-		f           []string
-		be          *bootEntry
-	)
-	defer func() {
-		switch err := recover().(type) {
-		case nil:
-		case error:
-			log.Fatalf("Bummer: %v, line #%d, line %q, fields %q", err, lineno, line, f)
-		default:
-			log.Fatalf("unexpected panic value: %T(%v)", err, err)
+		var found bool
+		for _, config := range diskboot.FindConfigs(mp.Path) {
+			debug("Found %s", config.ConfigPath)
+			imgs := config.OSImages()
+			if src.defaultEntry < 0 && config.DefaultEntry >= 0 && config.DefaultEntry < len(imgs) {
+				src.defaultEntry = len(src.images) + config.DefaultEntry
+			}
+			src.images = append(src.images, imgs...)
+			found = found || len(imgs) > 0
 		}
-	}()
-
-	debug("getBootEntries: %s", lines)
-	curLabel := ""
-	for _, line = range lines {
-		lineno++
-		f = strings.Fields(line)
-		debug("%d: %q, %q", lineno, line, f)
-		if len(f) == 0 {
-			continue
+		if imgs, err := uki.ScanImages(mp.Path); err != nil {
+			log.Printf("Failed to read unified kernel images on %s: %v", dev, err)
+		} else {
+			src.images = append(src.images, imgs...)
+			found = found || len(imgs) > 0
 		}
-		switch f[0] {
-		default:
-		case "#":
-		case "default":
-			bootVars["default"] = f[1]
-		case "set":
-			vals := strings.SplitN(f[1], "=", 2)
-			if len(vals) == 2 {
-				bootVars[vals[0]] = vals[1]
-			}
-		case "menuentry", "label":
-			debug("Menuentry %v", line)
-			// nasty, but the alternatives are not much better.
-			// grub config language is kind of arbitrary
-			curEntry = fmt.Sprintf("\"%s\"", strconv.Itoa(numEntry))
-			be = &bootEntry{}
-			curLabel = f[1]
-			bootEntries[f[1]] = be
-			bootEntries[curEntry] = be
-			numEntry++
-		case "menu":
-			// keyword default marks this as default
-			if f[1] != "default" {
-				continue
-			}
-			bootVars["default"] = curLabel
-		case "linux", "kernel":
-			debug("linux %v", line)
-			be.kernel = f[1]
-			be.cmdline = strings.Join(f[2:], " ")
-		case "initrd":
-			debug("initrd %v", line)
-			be.initrd = f[1]
-		case "append":
-			// Format is a little bit strange
-			//   append   MENU=/bin/cdrom-checker-menu vga=788 initrd=/install/initrd.gz quiet --
-			var currentParameter int
-			for _, parameter := range f {
-				if currentParameter > 0 {
-					if strings.HasPrefix(parameter, "initrd") {
-						initrd := strings.Split(parameter, "=")
-						bootEntries[curEntry].initrd = bootEntries[curEntry].initrd + initrd[1]
-					} else {
-						if parameter != "--" {
-							bootEntries[curEntry].cmdline = bootEntries[curEntry].cmdline + " " + parameter
-						}
-					}
-				}
-				currentParameter++
+
+		// Keep file systems with boot entries mounted, as their files
+		// are only read when an entry is loaded.
+		if found {
+			mounts = append(mounts, mp)
+		} else {
+			if err := mp.Unmount(mount.MNT_DETACH); err != nil {
+				debug("Failed to unmount %s: %v", mp, err)
 			}
+			os.Remove(dir)
 		}
 	}
-	debug("grub config menu decoded to [%q, %q, %v]", bootEntries, bootVars, err)
-	return bootEntries, bootVars, err
-
+	return src, mounts
 }
 
-// kexecLoad Loads a new kernel and initrd.
-func kexecLoad(grubConfPath string, grub []string, mountPoint string) error {
-	debug("kexecEntry: boot from %v", grubConfPath)
-	b, v, err := getBootEntries(grub)
+// netImages configures all interfaces matching ifaceNames with DHCP and
+// returns the network boot configurations offered.
+func netImages(ifaceNames string) source {
+	src := source{defaultEntry: -1}
+	ifs, err := dhclient.Interfaces(ifaceNames)
 	if err != nil {
-		return err
-	}
-
-	debug("Boot Entries: %q", b)
-	entry, ok := v[*defaultBoot]
-	if !ok {
-		return fmt.Errorf("Entry %v not found in config file", *defaultBoot)
-	}
-	be, ok := b[entry]
-	if !ok {
-		return fmt.Errorf("Entry %v not found in boot entries file", entry)
+		debug("No network interfaces: %v", err)
+		return src
 	}
 
-	debug("Boot params: %q", be)
-	localKernelPath := filepath.Join(mountPoint, be.kernel)
-	localInitrdPath := filepath.Join(mountPoint, be.initrd)
+	ctx, cancel := context.WithTimeout(context.Background(), (1<<dhcpTries)*dhcpTimeout)
+	defer cancel()
 
-	kernelDesc, err := os.OpenFile(localKernelPath, os.O_RDONLY, 0)
-	if err != nil {
-		debug("%v", err)
-		return err
+	c := dhclient.Config{
+		Timeout: dhcpTimeout,
+		Retries: dhcpTries,
 	}
-	defer kernelDesc.Close()
-
-	var ramfs io.ReaderAt
-	if be.initrd != "" {
-		ramfsfile, err := os.OpenFile(localInitrdPath, os.O_RDONLY, 0)
+	if *verbose {
+		c.LogLevel = dhclient.LogSummary
+	}
+	for result := range dhclient.SendRequests(ctx, ifs, true, true, c) {
+		if result.Err != nil {
+			debug("DHCP on %s failed: %v", result.Interface.Attrs().Name, result.Err)
+			continue
+		}
+		if err := result.Lease.Configure(); err != nil {
+			log.Printf("Failed to configure lease %s: %v", result.Lease, err)
+		}
+		img, err := netboot.BootImage(curl.DefaultSchemes, result.Lease)
 		if err != nil {
-			debug("%v", err)
-			return err
+			debug("No network boot configuration in lease %s: %v", result.Lease, err)
+			continue
 		}
-		defer ramfsfile.Close()
-		ramfs = ramfsfile
-	}
-	cl := updateBootCmdline(be.cmdline)
-
-	osImage := &boot.LinuxImage{
-		Cmdline: cl,
-		Kernel:  kernelDesc,
-		Initrd:  ramfs,
+		src.images = append(src.images, img)
 	}
-	log.Printf("%s", osImage)
-
-	if err := osImage.Load(false); err != nil {
-		debug("%v", err)
-		return err
-	}
-
-	return nil
+	return src
 }
 
-// Localboot tries to boot from any local filesystem by parsing grub configuration
-func Localboot() error {
-	fs, err := getSupportedFilesystem()
+// terminal returns the console in raw mode, or stdin and stdout if there is
+// no terminal. Call restore when done.
+func terminal() (in io.Reader, out io.Writer, restore func()) {
+	tty, err := termios.New()
 	if err != nil {
-		return errors.New("No filesystem support found")
+		debug("No terminal: %v", err)
+		return os.Stdin, os.Stdout, func() {}
 	}
-	debug("Supported filesystems: %v", fs)
-	sysList, err := filepath.Glob(*devGlob)
+	t, err := tty.Raw()
 	if err != nil {
-		return errors.New("No available block devices to boot from")
-	}
-	// The Linux /sys file system is a bit, er, awkward. You can't find
-	// the device special in there; just everything else.
-	var blkList []string
-	for _, b := range sysList {
-		blkList = append(blkList, filepath.Join("/dev", filepath.Base(b)))
+		debug("Failed to set raw mode: %v", err)
+		return tty, tty, func() {}
 	}
+	return tty, tty, func() { tty.Set(t) }
+}
 
-	// We must validate if the MBR is bootable or not and keep the
-	// devices which do have such support drive are easy to
-	// detect.  This whole loop is pretty bogus at present, it
-	// assumes the first partiton we find with grub.cfg is the one
-	// we want. It works for now but ...
-	var allparts []string
-	for _, d := range blkList {
-		err := checkForBootableMBR(d)
-		if err != nil {
-			// Not sure it matters; there can be many bogus entries?
-			debug("MBR for %s failed: %v", d, err)
-			continue
-		}
-		debug("Bootable device %v found", d)
-		// You can't just look for numbers to match. Consider names like
-		// mmcblk0, where has parts like mmcblk0p1. Just glob.
-		g := d + "*"
-		all, err := filepath.Glob(g)
-		if err != nil {
-			log.Printf("Glob for all partitions of %s failed: %v", g, err)
-		}
-		allparts = append(allparts, all...)
+func main() {
+	flag.Parse()
+	if *verbose {
+		debug = log.Printf
 	}
-	uroot, err = ioutil.TempDir("", "u-root-boot")
-	if err != nil {
-		return fmt.Errorf("Can't create tmpdir: %v", err)
+
+	var (
+		wg    sync.WaitGroup
+		local source
+		net   source
+	)
+	if *netBoot {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			net = netImages(*netIfaces)
+		}()
 	}
-	debug("Trying to boot from %v", allparts)
-	for _, d := range allparts {
-		if err := mountEntry(d, fs); err != nil {
-			continue
-		}
-		debug("mount succeed")
-		u := filepath.Join(uroot, d)
-		config, fileDir, root, err := checkBootEntry(u)
-		if err != nil {
-			debug("d: %v", d, err)
-			if err := umountEntry(u); err != nil {
-				log.Printf("Can't unmount %v: %v", u, err)
+	local, mounts := localImages(*devGlob)
+	defer func() {
+		for _, mp := range mounts {
+			if err := mp.Unmount(mount.MNT_DETACH); err != nil {
+				debug("Failed to unmount %s: %v", mp, err)
 			}
-			continue
 		}
-		debug("calling basic kexec: content %v, path %v", config, fileDir)
-		if err = kexecLoad(fileDir, config, root); err != nil {
-			log.Printf("kexec on %v failed: %v", u, err)
-		}
-		debug("kexecLoad succeeded")
+	}()
+	wg.Wait()
 
-		if err := umountEntry(u); err != nil {
-			log.Printf("Can't unmount %v: %v", u, err)
-		}
-		if *dryRun {
-			continue
-		}
+	// Network entries have no default, so the local default applies.
+	images := append(local.images, net.images...)
 
-		if err := boot.Execute(); err != nil {
-			log.Printf("boot.Execute of %v failed: %v", u, err)
+	filter := cmdline.NewUpdateFilter(*appendCmdline, strings.Split(*removeCmdlineItem, ","), strings.Split(*reuseCmdlineItem, ","))
+	for _, img := range images {
+		if li, ok := img.(*boot.LinuxImage); ok {
+			li.Cmdline = filter.Update(li.Cmdline)
 		}
-		// TODO: We should probably return a real error.
-		return nil
 	}
-	return fmt.Errorf("Sorry no bootable device found")
-}
 
-func main() {
-	flag.Parse()
-
-	if *verbose {
-		debug = log.Printf
+	def := local.defaultEntry
+	if *defaultBoot != "default" {
+		def = -1
+		for i, img := range images {
+			if img.Label() == *defaultBoot {
+				def = i
+				break
+			}
+		}
+		if def < 0 {
+			log.Printf("Entry %q not found", *defaultBoot)
+		}
 	}
 
-	if err := Localboot(); err != nil {
+	cfg := menu.Config{
+		Title:   "u-root boot menu",
+		Default: def,
+		Timeout: time.Duration(*timeout) * time.Second,
+	}
+	if *timeout < 0 {
+		cfg.Timeout = -1
+	}
+	in, out, restore := terminal()
+	_, err := menu.ChooseAndLoad(in, out, cfg, images, *verbose)
+	restore()
+	if err != nil {
 		log.Fatal(err)
 	}
+	if *dryRun {
+		return
+	}
+	if err := boot.Execute(); err != nil {
+		log.Fatalf("kexec failed: %v", err)
+	}
 }
@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/u-root/u-root/pkg/boot/kexec"
 	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/storage"
 )
 
 var (
@@ -24,7 +26,8 @@ var (
 	dryrun  = flag.Bool("dryrun", false, "Only print out kexec commands")
 
 	devGlob           = flag.String("dev", "/sys/class/block/*", "Device glob")
-	sDeviceIndex      = flag.String("d", "", "Device index")
+	sDeviceIndex      = flag.String("d", "", "Device index, or LABEL=, UUID=, PARTUUID= or PARTLABEL= of the device")
+	deviceTimeout     = flag.Duration("timeout", 0, "How long to wait for a device given to -d by LABEL=, UUID=, PARTUUID= or PARTLABEL= to appear")
 	sConfigIndex      = flag.String("c", "", "Config index")
 	sEntryIndex       = flag.String("n", "", "Entry index")
 	removeCmdlineItem = flag.String("remove", "console", "comma separated list of kernel params value to remove from parsed kernel configuration (default to console)")
@@ -35,7 +38,15 @@ var (
 )
 
 func getDevice() (*diskboot.Device, error) {
-	devices = diskboot.FindDevices(*devGlob)
+	glob := *devGlob
+	if strings.Contains(*sDeviceIndex, "=") {
+		bd, err := storage.WaitForDevice(*sDeviceIndex, *deviceTimeout)
+		if err != nil {
+			return nil, err
+		}
+		glob = filepath.Join("/sys/class/block", bd.Name)
+	}
+	devices = diskboot.FindDevices(glob)
 	if len(devices) == 0 {
 		return nil, errors.New("No devices found")
 	}
@@ -105,7 +116,9 @@ func getEntry(config *diskboot.Config) (*diskboot.Entry, error) {
 func bootEntry(config *diskboot.Config, entry *diskboot.Entry) error {
 	verbose("Booting entry: %v", entry)
 	filter := cmdline.NewUpdateFilter(*appendCmdline, strings.Split(*removeCmdlineItem, ","), strings.Split(*reuseCmdlineItem, ","))
-	err := entry.KexecLoad(config.MountPath, filter, *dryrun)
+	err := entry.KexecLoad(config.MountPath, config.Extracted, filter, *dryrun)
+	// All files are read once the entry is loaded.
+	config.Extracted.Close()
 	if err != nil {
 		return fmt.Errorf("wrror doing kexec load: %v", err)
 	}
@@ -123,6 +136,7 @@ func bootEntry(config *diskboot.Config, entry *diskboot.Entry) error {
 
 func cleanDevices() {
 	for _, device := range devices {
+		device.Extracted.Close()
 		if err := device.Unmount(mount.MNT_FORCE); err != nil {
 			log.Printf("Error unmounting device %s: %v", device, err)
 		}
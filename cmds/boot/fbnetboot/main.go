@@ -5,8 +5,7 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,7 +26,11 @@ import (
 	"github.com/insomniacslk/dhcp/interfaces"
 	"github.com/insomniacslk/dhcp/netboot"
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	unetboot "github.com/u-root/u-root/pkg/boot/netboot"
+	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/crypto"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/dhclient"
 )
 
 var (
@@ -44,6 +47,7 @@ var (
 	caCertFile         = flag.String("cacerts", "/etc/cacerts.pem", "CA cert file")
 	skipCertVerify     = flag.Bool("skip-cert-verify", false, "Don't authenticate https certs")
 	doFix              = flag.Bool("fix", false, "Try to run fixmynetboot if netboot fails")
+	httpBoot           = flag.Bool("http-boot", false, "Send UEFI HTTP Boot requests. ISO images are loop mounted and booted from their grub or syslinux config")
 )
 
 const (
@@ -243,6 +247,10 @@ func boot(ifname string, dhcp dhcpFunc) error {
 	}
 	debug("DHCP: saved boot file to %s", filename)
 
+	if *httpBoot && unetboot.IsISO(bytes.NewReader(body)) {
+		return bootISO(filename, body)
+	}
+
 	cmdline := strings.Join(bootconf.BootfileParam, " ")
 	if !*dryRun {
 		log.Printf("DHCP: kexec'ing into %s (with arguments: \"%s\")", filename, cmdline)
@@ -262,6 +270,26 @@ func boot(ifname string, dhcp dhcpFunc) error {
 	return nil
 }
 
+// bootISO boots the default entry of the boot config on an ISO image.
+func bootISO(filename string, body []byte) error {
+	img, err := unetboot.ISOImage(bytes.NewReader(body), filename)
+	if err != nil {
+		return fmt.Errorf("HTTP Boot: %v", err)
+	}
+	if *dryRun {
+		log.Printf("HTTP Boot: I would've kexec'd %s now unless the dry mode", img)
+		return nil
+	}
+	log.Printf("HTTP Boot: kexec'ing into %s", img)
+	if err := img.Load(false); err != nil {
+		return fmt.Errorf("HTTP Boot: loading %s failed: %v", img, err)
+	}
+	if err := kexec.Reboot(); err != nil {
+		return fmt.Errorf("HTTP Boot: kexec.Reboot failed: %v", err)
+	}
+	return nil
+}
+
 func getScheme(urlstring string) (string, error) {
 	u, err := url.Parse(urlstring)
 	if err != nil {
@@ -274,28 +302,26 @@ func getScheme(urlstring string) (string, error) {
 	return scheme, nil
 }
 
-func loadCaCerts() (*x509.CertPool, error) {
-	rootCAs, err := x509.SystemCertPool()
+// tlsConfig returns the TLS configuration of the kernel command line, see
+// curl.TLSConfigFromCmdline, with the CA certificates and verification
+// given by flags. The -cacerts file is only used if it exists and
+// certificates are verified.
+func tlsConfig() (*curl.TLSConfig, error) {
+	config, err := curl.TLSConfigFromCmdline(cmdline.NewCmdLine().AsMap)
 	if err != nil {
 		return nil, err
 	}
-	if rootCAs == nil {
-		debug("certs: rootCAs == nil")
-		rootCAs = x509.NewCertPool()
-	}
-	caCerts, err := ioutil.ReadFile(*caCertFile)
-	if err != nil {
-		return nil, fmt.Errorf("could not find cert file '%v' - %v", *caCertFile, err)
+	if *skipCertVerify {
+		config.InsecureSkipVerify = true
 	}
-	// TODO: Decide if this should also support compressed certs
-	// Might be better to have a generic compressed config API
-	if ok := rootCAs.AppendCertsFromPEM(caCerts); !ok {
-		debug("Failed to append CA Certs from %s, using system certs only", *caCertFile)
-	} else {
-		debug("CA certs appended from PEM")
+	if *caCertFile != "" && !config.InsecureSkipVerify {
+		if _, err := os.Stat(*caCertFile); err == nil {
+			config.CACerts = append(config.CACerts, *caCertFile)
+		} else {
+			debug("Not using CA certs %s: %v", *caCertFile, err)
+		}
 	}
-	return rootCAs, nil
-
+	return config, nil
 }
 
 func getClientForBootfile(bootfile string) (*http.Client, error) {
@@ -307,24 +333,15 @@ func getClientForBootfile(bootfile string) (*http.Client, error) {
 
 	switch scheme {
 	case "https":
-		var config *tls.Config
-		if *skipCertVerify {
-			config = &tls.Config{
-				InsecureSkipVerify: true,
-			}
-		} else if *caCertFile != "" {
-			rootCAs, err := loadCaCerts()
-			if err != nil {
-				return nil, err
-			}
-			config = &tls.Config{
-				RootCAs: rootCAs,
-			}
+		config, err := tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if client, err = config.HTTPClient(); err != nil {
+			return nil, err
 		}
-		tr := &http.Transport{TLSClientConfig: config}
-		client = &http.Client{Transport: tr}
-		debug("https client setup (use certs from VPD: %t, skipCertVerify %t)",
-			*skipCertVerify, *caCertFile != "")
+		debug("https client setup (CA certs %v, skipCertVerify %t, client cert %q, pins %v)",
+			config.CACerts, config.InsecureSkipVerify, config.ClientCert, config.Pins)
 	case "http":
 		client = &http.Client{}
 		debug("http client setup")
@@ -344,6 +361,9 @@ func dhcp6(ifname string) (*netboot.BootConf, error) {
 	if *userClass != "" {
 		modifiers = append(modifiers, dhcpv6.WithUserClass([]byte(*userClass)))
 	}
+	if *httpBoot {
+		modifiers = append(modifiers, dhclient.WithHTTPBoot6)
+	}
 	conversation, err := netboot.RequestNetbootv6(ifname, time.Duration(*readTimeout)*time.Second, *dhcpRetries, modifiers...)
 	for _, m := range conversation {
 		debug(m.Summary())
@@ -360,6 +380,9 @@ func dhcp4(ifname string) (*netboot.BootConf, error) {
 	if *userClass != "" {
 		modifiers = append(modifiers, dhcpv4.WithUserClass(*userClass, false))
 	}
+	if *httpBoot {
+		modifiers = append(modifiers, dhclient.WithHTTPBoot4)
+	}
 	conversation, err := netboot.RequestNetbootv4(ifname, time.Duration(*readTimeout)*time.Second, *dhcpRetries, modifiers...)
 	for _, m := range conversation {
 		debug(m.Summary())
@@ -0,0 +1,50 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/boot/bls"
+	"github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/bootconfig"
+)
+
+// ScanBLSEntries returns a boot configuration for every Boot Loader
+// Specification entry on the partition mounted at basedir, in boot menu
+// order.
+func ScanBLSEntries(basedir string) []bootconfig.BootConfig {
+	entries, err := bls.FindEntries(basedir)
+	if err != nil {
+		log.Printf("Failed to read BLS entries in %s: %v", basedir, err)
+		return nil
+	}
+
+	// Fedora's entries use $kernelopts from the GRUB environment.
+	vars := grub.FindEnvBlock(basedir)
+	path := func(p string) string {
+		return filepath.Join(basedir, filepath.Clean("/"+p))
+	}
+
+	var bootconfigs []bootconfig.BootConfig
+	for _, e := range entries {
+		cfg := bootconfig.BootConfig{
+			Name:       e.Name(),
+			Kernel:     path(e.Linux),
+			KernelArgs: e.ExpandOptions(vars),
+		}
+		var initrds []string
+		for _, i := range e.Initrds {
+			initrds = append(initrds, path(i))
+		}
+		cfg.Initramfs = initramfs(initrds)
+		if len(e.DeviceTree) > 0 {
+			cfg.DeviceTree = path(e.DeviceTree)
+		}
+		bootconfigs = append(bootconfigs, cfg)
+	}
+	return bootconfigs
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot/diskboot"
+	"github.com/u-root/u-root/pkg/bootconfig"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/storage"
+)
+
+// extracted are the file systems mountDevice read in userspace.
+var extracted []*diskboot.Extracted
+
+// mountDevice mounts dev read-only at mountpath.
+//
+// If the kernel cannot mount dev, e.g. because it was built without ext4,
+// and dev has an ext2, ext3 or ext4 file system, its boot configurations
+// and the GrubSearchDirectories are extracted to a tmpfs mounted at
+// mountpath instead, see diskboot.ExtractDevice.
+func mountDevice(dev storage.BlockDev, mountpath string) (*mount.MountPoint, error) {
+	mp, err := dev.Mount(mountpath, mount.MS_RDONLY)
+	if err == nil {
+		return mp, nil
+	}
+	// ScanGrubConfigs also looks for grub.cfg in the root directory.
+	names := append([]string{"grub.cfg", "grub2.cfg"}, GrubSearchDirectories...)
+	mp, ex, eerr := diskboot.ExtractDevice(dev.DevicePath(), mountpath, names...)
+	if eerr != nil {
+		debug("Failed to read the file system of %s in userspace: %v", dev.Name, eerr)
+		return nil, err
+	}
+	extracted = append(extracted, ex)
+	debug("Failed to mount %s (%v), read its file system in userspace", dev.Name, err)
+	return mp, nil
+}
+
+// fetchBootFiles extracts the kernel, initrds, device tree and multiboot
+// modules of cfg if they are on a file system mountDevice read in userspace.
+func fetchBootFiles(cfg bootconfig.BootConfig) {
+	paths := []string{cfg.Kernel, cfg.Initramfs, cfg.DeviceTree, cfg.Multiboot}
+	paths = append(paths, catInitrds[cfg.Initramfs]...)
+	for _, m := range cfg.Modules {
+		// Modules are followed by their command line.
+		if f := strings.Fields(m); len(f) > 0 {
+			paths = append(paths, f[0])
+		}
+	}
+	for _, ex := range extracted {
+		ex.Fetch(paths...)
+	}
+}
+
+// closeExtracted closes the file systems mountDevice read in userspace.
+func closeExtracted() {
+	for _, ex := range extracted {
+		if err := ex.Close(); err != nil {
+			debug("Failed to close %s: %v", ex.Dir, err)
+		}
+	}
+	extracted = nil
+}
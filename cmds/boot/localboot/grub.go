@@ -5,8 +5,6 @@
 package main
 
 import (
-	"encoding/hex"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -17,6 +15,7 @@ import (
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 
+	"github.com/u-root/u-root/pkg/boot/grub"
 	"github.com/u-root/u-root/pkg/bootconfig"
 	"github.com/u-root/u-root/pkg/storage"
 )
@@ -39,13 +38,6 @@ var (
 // at /boot/efi/EFI/distro/ , 4 might be a good choice.
 const searchDepth = 4
 
-type grubVersion int
-
-var (
-	grubV1 grubVersion = 1
-	grubV2 grubVersion = 2
-)
-
 func isGrubSearchDir(dirname string) bool {
 	for _, dir := range GrubSearchDirectories {
 		if dirname == dir {
@@ -55,134 +47,51 @@ func isGrubSearchDir(dirname string) bool {
 	return false
 }
 
-// ParseGrubCfg parses the content of a grub.cfg and returns a list of
-// BootConfig structures, one for each menuentry, in the same order as they
-// appear in grub.cfg. All opened kernel and initrd files are relative to
-// basedir.
-func ParseGrubCfg(ver grubVersion, devices []storage.BlockDev, grubcfg string, basedir string) []bootconfig.BootConfig {
-	// This parser sucks. It's not even a parser, it just looks for lines
-	// starting with menuentry, linux or initrd.
-	// TODO use a parser, e.g. https://github.com/alecthomas/participle
-	if ver != grubV1 && ver != grubV2 {
-		log.Printf("Warning: invalid GRUB version: %d", ver)
-		return nil
+// ParseGrubCfg evaluates the grub.cfg at cfgpath, relative to the mountpoint
+// basedir, and returns a list of BootConfig structures, one for each bootable
+// menuentry, in the same order as they appear in the menu.
+//
+// Partitions found through grub's search command are expected to be mounted
+// next to basedir, in a directory named after the device.
+func ParseGrubCfg(devices []storage.BlockDev, basedir, cfgpath string) ([]bootconfig.BootConfig, error) {
+	var grubDevices []grub.Device
+	for _, dev := range devices {
+		grubDevices = append(grubDevices, grub.Device{
+			Name:   dev.Name,
+			Dir:    path.Join(path.Dir(basedir), dev.Name),
+			FSUUID: dev.FsUUID,
+		})
 	}
-	kernelBasedir := basedir
-	bootconfigs := make([]bootconfig.BootConfig, 0)
-	inMenuEntry := false
-	var cfg *bootconfig.BootConfig
-	for _, line := range strings.Split(grubcfg, "\n") {
-		// remove all leading spaces as they are not relevant for the config
-		// line
-		line = strings.TrimLeft(line, " ")
-		sline := strings.Fields(line)
-		if len(sline) == 0 {
-			continue
+	root := grub.Device{Name: path.Base(basedir), Dir: basedir}
+	config, err := grub.ParseConfigFile(root, cfgpath, grubDevices)
+	if err != nil {
+		return nil, err
+	}
+
+	bootconfigs := make([]bootconfig.BootConfig, 0, len(config.Entries))
+	for _, e := range config.Entries {
+		cfg := bootconfig.BootConfig{
+			Name:       e.Name(),
+			DeviceTree: e.DeviceTree,
 		}
-		if sline[0] == "menuentry" {
-			// if a "menuentry", start a new boot config
-			if cfg != nil {
-				// save the previous boot config, if any
-				if cfg.IsValid() {
-					// only consider valid boot configs, i.e. the ones that have
-					// both kernel and initramfs
-					bootconfigs = append(bootconfigs, *cfg)
-				}
-				// reset kernelBaseDir
-				kernelBasedir = basedir
-			}
-			inMenuEntry = true
-			cfg = new(bootconfig.BootConfig)
-			name := ""
-			if len(sline) > 1 {
-				name = strings.Join(sline[1:], " ")
-				name = unquoteGrubString(name)
-				name = strings.Split(name, "--")[0]
-			}
-			cfg.Name = name
-		} else if inMenuEntry {
-			// check if location of kernel is at an other partition
-			// see https://www.gnu.org/software/grub/manual/grub/html_node/search.html
-			if sline[0] == "search" {
-				for _, str1 := range sline {
-					if str1 == "--set=root" {
-						log.Printf("Kernel seems to be on an other partitioin then the grub.cfg file")
-						for _, str2 := range sline {
-							if isValidFsUUID(str2) {
-								kernelFsUUID := str2
-								log.Printf("fs-uuid: %s", kernelFsUUID)
-								partitions := storage.PartitionsByFsUUID(devices, kernelFsUUID)
-								if len(partitions) == 0 {
-									log.Printf("WARNING: No partition found with filesystem UUID:'%s' to load kernel from!", kernelFsUUID) // TODO throw error ?
-									continue
-								}
-								if len(partitions) > 1 {
-									log.Printf("WARNING: more than one partition found with the given filesystem UUID. Using the first one")
-								}
-								dev := partitions[0]
-								kernelBasedir = path.Dir(kernelBasedir)
-								kernelBasedir = path.Join(kernelBasedir, dev.Name)
-								log.Printf("Kernel is on: %s", dev.Name)
-							}
-						}
-					}
-				}
-			}
-			// otherwise look for kernel and initramfs configuration
-			if len(sline) < 2 {
-				// surely not a valid linux or initrd directive, skip it
-				continue
-			}
-			if sline[0] == "linux" || sline[0] == "linux16" || sline[0] == "linuxefi" {
-				kernel := sline[1]
-				cmdline := strings.Join(sline[2:], " ")
-				cmdline = unquoteGrubString(cmdline)
-				cfg.Kernel = path.Join(kernelBasedir, kernel)
-				cfg.KernelArgs = cmdline
-			} else if sline[0] == "initrd" || sline[0] == "initrd16" || sline[0] == "initrdefi" {
-				initrd := sline[1]
-				cfg.Initramfs = path.Join(kernelBasedir, initrd)
-			} else if sline[0] == "multiboot" || sline[0] == "multiboot2" {
-				multiboot := sline[1]
-				cmdline := strings.Join(sline[2:], " ")
-				cmdline = unquoteGrubString(cmdline)
-				cfg.Multiboot = path.Join(kernelBasedir, multiboot)
-				cfg.MultibootArgs = cmdline
-			} else if sline[0] == "module" || sline[0] == "module2" {
-				module := sline[1]
-				cmdline := strings.Join(sline[2:], " ")
-				cmdline = unquoteGrubString(cmdline)
-				module = path.Join(kernelBasedir, module)
-				if cmdline != "" {
-					module = module + " " + cmdline
+		if e.Multiboot != "" {
+			cfg.Multiboot = e.Multiboot
+			cfg.MultibootArgs = e.Cmdline
+			for _, m := range e.Modules {
+				module := m.Path
+				if m.Cmdline != "" {
+					module = module + " " + m.Cmdline
 				}
 				cfg.Modules = append(cfg.Modules, module)
 			}
+		} else {
+			cfg.Kernel = e.Kernel
+			cfg.KernelArgs = e.Cmdline
+			cfg.Initramfs = initramfs(e.Initrds)
 		}
+		bootconfigs = append(bootconfigs, cfg)
 	}
-
-	// append last kernel config if it wasn't already
-	if inMenuEntry && cfg.IsValid() {
-		bootconfigs = append(bootconfigs, *cfg)
-	}
-	return bootconfigs
-}
-
-func isValidFsUUID(uuid string) bool {
-	for _, h := range strings.Split(uuid, "-") {
-		if _, err := hex.DecodeString(h); err != nil {
-			return false
-		}
-	}
-	return true
-}
-
-func unquoteGrubString(text string) string {
-	// unquote the string to prevent special characters used by GRUB
-	// from being passed thru kexec
-	// https://www.gnu.org/software/grub/manual/grub/grub.html#Quoting
-	// TODO unquote everything, not just \$
-	return strings.Replace(text, `\$`, "$", -1)
+	return bootconfigs, nil
 }
 
 func isMn(r rune) bool {
@@ -219,22 +128,21 @@ func ScanGrubConfigs(devices []storage.BlockDev, basedir string) []bootconfig.Bo
 			// continue
 			return nil
 		}
-		cfgname := info.Name()
-		var ver grubVersion
-		switch cfgname {
-		case "grub.cfg":
-			ver = grubV1
-		case "grub2.cfg":
-			ver = grubV2
+		switch info.Name() {
+		case "grub.cfg", "grub2.cfg":
 		default:
 			return nil
 		}
 		log.Printf("Parsing %s", currentPath)
-		data, err := ioutil.ReadFile(currentPath)
+		cfgpath, err := filepath.Rel(basedir, currentPath)
 		if err != nil {
 			return err
 		}
-		cfgs := ParseGrubCfg(ver, devices, string(data), basedir)
+		cfgs, err := ParseGrubCfg(devices, basedir, cfgpath)
+		if err != nil {
+			log.Printf("Failed to parse %s: %v", currentPath, err)
+			return nil
+		}
 		bootconfigs = append(bootconfigs, cfgs...)
 		return nil
 	})
@@ -0,0 +1,71 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/bootconfig"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// catInitrds are the initrds of boot configurations with more than one, by
+// the path of the file they are concatenated to before booting.
+var catInitrds = map[string][]string{}
+
+// initramfs returns the Initramfs of a boot configuration with initrds.
+//
+// Linux unpacks concatenated initramfs archives in order, so several
+// initrds, like a microcode update and the initramfs, are concatenated to
+// one file. This is only done when the configuration is booted, see
+// writeInitramfs, so that scanning does not copy every initrd.
+func initramfs(initrds []string) string {
+	switch len(initrds) {
+	case 0:
+		return ""
+	case 1:
+		return initrds[0]
+	}
+	p := filepath.Join(os.TempDir(), fmt.Sprintf("localboot-initrd-%d-%d", os.Getpid(), len(catInitrds)))
+	catInitrds[p] = initrds
+	return p
+}
+
+// writeInitramfs concatenates the initrds of cfg to its Initramfs, if it
+// has more than one.
+func writeInitramfs(cfg bootconfig.BootConfig) error {
+	initrds, ok := catInitrds[cfg.Initramfs]
+	if !ok {
+		return nil
+	}
+	var rs []io.ReaderAt
+	for _, p := range initrds {
+		r := uio.NewLazyFile(p)
+		defer r.Close()
+		rs = append(rs, r)
+	}
+	f, err := os.OpenFile(cfg.Initramfs, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, uio.Reader(boot.CatInitrds(rs...))); err != nil {
+		f.Close()
+		return fmt.Errorf("concatenating initrds %v: %v", initrds, err)
+	}
+	return f.Close()
+}
+
+// bootConfig boots cfg after getting its files ready.
+func bootConfig(cfg bootconfig.BootConfig) error {
+	fetchBootFiles(cfg)
+	if err := writeInitramfs(cfg); err != nil {
+		return err
+	}
+	return cfg.Boot()
+}
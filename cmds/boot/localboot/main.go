@@ -11,6 +11,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/u-root/u-root/pkg/bootconfig"
 	"github.com/u-root/u-root/pkg/mount"
@@ -18,7 +20,6 @@ import (
 )
 
 // TODO backward compatibility for BIOS mode with partition type 0xee
-// TODO use a proper parser for grub config (see grub.go)
 
 var (
 	flagBaseMountPoint = flag.String("m", "/mnt", "Base mount point where to mount partitions")
@@ -29,7 +30,8 @@ var (
 	flagKernelPath     = flag.String("kernel", "", "Specify the path of the kernel to execute. If using -grub, this argument is ignored")
 	flagInitramfsPath  = flag.String("initramfs", "", "Specify the path of the initramfs to load. If using -grub, this argument is ignored")
 	flagKernelCmdline  = flag.String("cmdline", "", "Specify the kernel command line. If using -grub, this argument is ignored")
-	flagDeviceGUID     = flag.String("guid", "", "GUID of the device where the kernel (and optionally initramfs) are located. Ignored if -grub is set or if -kernel is not specified")
+	flagDeviceGUID     = flag.String("guid", "", "GUID of the device where the kernel (and optionally initramfs) are located, or its LABEL=, UUID=, PARTUUID= or PARTLABEL=. Ignored if -grub is set or if -kernel is not specified")
+	flagDeviceTimeout  = flag.Duration("timeout", 10*time.Second, "How long to wait for a device given by LABEL=, UUID=, PARTUUID= or PARTLABEL= to appear")
 )
 
 var debug = func(string, ...interface{}) {}
@@ -39,8 +41,20 @@ var debug = func(string, ...interface{}) {}
 // same name of the device (e.g. /your/base/mountpoint/sda1).
 // If more than one partition is found with the given GUID, the first that is
 // found is used.
+// A guid like LABEL=, UUID=, PARTUUID= or PARTLABEL= is resolved instead,
+// waiting for the device to appear if it is not among devices yet.
 // This function returns a storage.Mountpoint object, or an error if any.
 func mountByGUID(devices []storage.BlockDev, guid, baseMountpoint string) (*mount.MountPoint, error) {
+	if strings.Contains(guid, "=") {
+		log.Printf("Looking for partition %s", guid)
+		dev, err := storage.ResolveDevice(devices, guid)
+		if err != nil {
+			if dev, err = storage.WaitForDevice(guid, *flagDeviceTimeout); err != nil {
+				return nil, err
+			}
+		}
+		return mountDevice(*dev, filepath.Join(baseMountpoint, dev.Name))
+	}
 	log.Printf("Looking for partition with GUID %s", guid)
 	partitions, err := storage.PartitionsByGUID(devices, guid)
 	if err != nil || len(partitions) == 0 {
@@ -52,14 +66,16 @@ func mountByGUID(devices []storage.BlockDev, guid, baseMountpoint string) (*moun
 	}
 
 	mountpath := filepath.Join(baseMountpoint, partitions[0].Name)
-	return partitions[0].Mount(mountpath, mount.MS_RDONLY)
+	return mountDevice(partitions[0], mountpath)
 }
 
 // BootGrubMode tries to boot a kernel in GRUB mode. GRUB mode means:
 // * look for the partition with the specified GUID, and mount it
 // * if no GUID is specified, mount all of the specified devices
 // * try to mount the device(s) using any of the kernel-supported filesystems
+// * if that fails, read ext2, ext3 or ext4 file systems in userspace
 // * look for a GRUB configuration in various well-known locations
+// * if there is none, look for Boot Loader Specification entries
 // * build a list of valid boot configurations from the found GRUB configuration files
 // * try to boot every valid boot configuration until one succeeds
 //
@@ -80,7 +96,7 @@ func BootGrubMode(devices []storage.BlockDev, baseMountpoint string, guid string
 		debug("trying to mount all the available block devices with all the supported file system types")
 		for _, dev := range devices {
 			mountpath := filepath.Join(baseMountpoint, dev.Name)
-			if mountpoint, err := dev.Mount(mountpath, mount.MS_RDONLY); err != nil {
+			if mountpoint, err := mountDevice(dev, mountpath); err != nil {
 				debug("Failed to mount %s on %s: %v", dev, mountpath, err)
 			} else {
 				mounted = append(mounted, mountpoint)
@@ -97,6 +113,7 @@ func BootGrubMode(devices []storage.BlockDev, baseMountpoint string, guid string
 	log.Printf("mounted: %+v", mounted)
 	defer func() {
 		// clean up
+		closeExtracted()
 		for _, mountpoint := range mounted {
 			if err := mountpoint.Unmount(mount.MNT_DETACH); err != nil {
 				debug("Failed to unmount %v: %v", mountpoint, err)
@@ -107,7 +124,13 @@ func BootGrubMode(devices []storage.BlockDev, baseMountpoint string, guid string
 	// search for a valid grub config and extracts the boot configuration
 	bootconfigs := make([]bootconfig.BootConfig, 0)
 	for _, mountpoint := range mounted {
-		bootconfigs = append(bootconfigs, ScanGrubConfigs(devices, mountpoint.Path)...)
+		cfgs := ScanGrubConfigs(devices, mountpoint.Path)
+		// GRUB configurations on systems using BLS entries include
+		// them with blscfg.
+		if len(cfgs) == 0 {
+			cfgs = ScanBLSEntries(mountpoint.Path)
+		}
+		bootconfigs = append(bootconfigs, cfgs...)
 	}
 	if len(bootconfigs) == 0 {
 		return fmt.Errorf("No boot configuration found")
@@ -127,7 +150,7 @@ func BootGrubMode(devices []storage.BlockDev, baseMountpoint string, guid string
 					debug("Boot configuration: %+v", cfg)
 					return nil
 				}
-				if err := cfg.Boot(); err != nil {
+				if err := bootConfig(cfg); err != nil {
 					log.Printf("Failed to boot kernel %s: %v", cfg.Kernel, err)
 				}
 			}
@@ -145,7 +168,7 @@ func BootGrubMode(devices []storage.BlockDev, baseMountpoint string, guid string
 	// try to kexec into every boot config kernel until one succeeds
 	for _, cfg := range bootconfigs {
 		debug("Trying boot configuration %+v", cfg)
-		if err := cfg.Boot(); err != nil {
+		if err := bootConfig(cfg); err != nil {
 			log.Printf("Failed to boot kernel %s: %v", cfg.Kernel, err)
 		}
 	}
@@ -172,6 +195,7 @@ func BootPathMode(devices []storage.BlockDev, baseMountpoint string, guid string
 	if err != nil {
 		return err
 	}
+	defer closeExtracted()
 
 	fullKernelPath := path.Join(mount.Path, *flagKernelPath)
 	fullInitramfsPath := path.Join(mount.Path, *flagInitramfsPath)
@@ -184,7 +208,7 @@ func BootPathMode(devices []storage.BlockDev, baseMountpoint string, guid string
 	if dryrun {
 		log.Printf("Dry-run, will not actually boot")
 	} else {
-		if err := cfg.Boot(); err != nil {
+		if err := bootConfig(cfg); err != nil {
 			return fmt.Errorf("Failed to boot kernel %s: %v", cfg.Kernel, err)
 		}
 	}
@@ -17,6 +17,9 @@
 //
 // - a pxelinux.0, in which case we will ignore the pxelinux and try to parse
 //   pxelinux.cfg/<files>
+//
+// With -http-boot, pxeboot asks for a UEFI HTTP Boot URL, which may also point
+// to an ISO image that is loop mounted to boot its grub or syslinux config.
 package main
 
 import (
@@ -33,10 +36,11 @@ import (
 )
 
 var (
-	ifName  = "^e.*"
-	noLoad  = flag.Bool("no-load", false, "get DHCP response, but don't load the kernel")
-	dryRun  = flag.Bool("dry-run", false, "download kernel, but don't kexec it")
-	verbose = flag.Bool("v", false, "Verbose output")
+	ifName   = "^e.*"
+	noLoad   = flag.Bool("no-load", false, "get DHCP response, but don't load the kernel")
+	dryRun   = flag.Bool("dry-run", false, "download kernel, but don't kexec it")
+	verbose  = flag.Bool("v", false, "Verbose output")
+	httpBoot = flag.Bool("http-boot", false, "send UEFI HTTP Boot requests, to boot kernels or ISO images from HTTP(S) URLs")
 )
 
 const (
@@ -55,8 +59,9 @@ func Netboot(ifaceNames string) error {
 	defer cancel()
 
 	c := dhclient.Config{
-		Timeout: dhcpTimeout,
-		Retries: dhcpTries,
+		Timeout:  dhcpTimeout,
+		Retries:  dhcpTries,
+		HTTPBoot: *httpBoot,
 	}
 	if *verbose {
 		c.LogLevel = dhclient.LogSummary
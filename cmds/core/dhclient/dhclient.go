@@ -8,9 +8,12 @@
 //     dhclient [OPTIONS...]
 //
 // Options:
-//     -timeout:  lease timeout in seconds
-//     -renewals: number of DHCP renewals before exiting
-//     -verbose:  verbose output
+//     -timeout:   lease timeout in seconds
+//     -renewals:  number of DHCP renewals before exiting
+//     -verbose:   verbose output
+//     -daemon:    keep renewing leases and reconfigure interfaces as they change
+//     -lease-dir: directory to save leases to in daemon mode
+//     -pd:        ask for a delegated IPv6 prefix in daemon mode
 package main
 
 import (
@@ -39,6 +42,10 @@ var (
 	v6Server = flag.String("v6-server", "ff02::1:2", "DHCPv6 server address to send to (multicast or unicast)")
 
 	v4Port = flag.Int("v4-port", dhcpv4.ServerPort, "DHCPv4 server port to send to")
+
+	daemon   = flag.Bool("daemon", false, "Keep running, renewing leases and reconfiguring interfaces as leases change")
+	leaseDir = flag.String("lease-dir", "", "Directory to save leases to, and to restore them from, in daemon mode")
+	pd       = flag.Bool("pd", false, "Ask DHCPv6 servers to delegate a prefix in daemon mode")
 )
 
 func main() {
@@ -80,6 +87,10 @@ func configureAll(ifs []netlink.Link) {
 	if *vverbose {
 		c.LogLevel = dhclient.LogDebug
 	}
+	if *daemon {
+		runDaemon(ifs, c)
+		return
+	}
 	r := dhclient.SendRequests(context.Background(), ifs, *ipv4, *ipv6, c)
 
 	for result := range r {
@@ -93,3 +104,21 @@ func configureAll(ifs []netlink.Link) {
 	}
 	log.Printf("Finished trying to configure all interfaces.")
 }
+
+func runDaemon(ifs []netlink.Link, c dhclient.Config) {
+	events := dhclient.RunDaemon(context.Background(), ifs, dhclient.DaemonConfig{
+		Config:           c,
+		IPv4:             *ipv4,
+		IPv6:             *ipv6,
+		PrefixDelegation: *pd,
+		LeaseDir:         *leaseDir,
+	})
+	for e := range events {
+		log.Print(e)
+		if p, ok := e.Lease.(*dhclient.Packet6); ok && e.Type != dhclient.LeaseLost {
+			for _, prefix := range p.DelegatedPrefixes() {
+				log.Printf("Delegated prefix %s on %s", prefix, e.Interface.Attrs().Name)
+			}
+		}
+	}
+}
@@ -6,28 +6,51 @@
 //
 // Synopsis:
 //     gpt [-w] file
+//     gpt [-a blocks] file verb [arg] [verb [arg]]...
 //
 // Description:
 //     For -w, it reads a JSON formatted GPT from stdin, and writes 'file'
 //     which is usually a device. It writes both primary and secondary headers.
 //
+//     With verbs, it edits the partition table of 'file' in the order of the
+//     verbs, like sgdisk does, writes both headers and has the kernel reread
+//     the partition table. Partitions are numbered from 1. The verbs are:
+//         new                  create an empty GPT
+//         repair               rebuild a corrupt primary or backup GPT
+//         add n:start:end      add a partition; 0 is the default
+//         delete n             delete a partition
+//         resize n:end         move the end of a partition; 0 is the maximum
+//         type n:type          set the type GUID or sgdisk code, like ef00
+//         name n:name          set the name
+//         attr n:attributes    set the attribute bits
+//     Starts and ends are block numbers or sizes with a K, M, G or T suffix.
+//     An end of +size is relative to the start.
+//
 //     Otherwise it just writes the headers to stdout in JSON format.
+//
+// Options:
+//     -a: alignment of default partition starts in blocks
+//     -w: write a JSON formatted GPT from stdin
 package main
 
 import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/u-root/u-root/pkg/gpt"
 )
 
-const cmd = "gpt [options] file"
+const cmd = "gpt [options] file [verb [arg]]..."
 
 var (
 	write = flag.Bool("w", false, "Write GPT to file")
+	align = flag.Uint64("a", gpt.DefaultAlign, "Alignment of default partition starts in blocks")
 )
 
 func init() {
@@ -39,14 +62,175 @@ func init() {
 	}
 }
 
+// parseBlock parses a block number, or a size in bytes with a K, M, G or T
+// suffix, into blocks.
+func parseBlock(s string) (uint64, error) {
+	var shift uint
+	if i := strings.IndexAny(s, "KMGTkmgt"); i >= 0 && i == len(s)-1 {
+		shift = 10 * uint(strings.IndexByte("KMGT", strings.ToUpper(s)[i])+1)
+		s = s[:i]
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if shift > 0 {
+		return n << shift / gpt.BlockSize, nil
+	}
+	return n, nil
+}
+
+// parseEnd parses the end of a partition starting at first. An end of +size
+// is the last block of a partition of that size.
+func parseEnd(s string, first uint64) (uint64, error) {
+	if !strings.HasPrefix(s, "+") {
+		return parseBlock(s)
+	}
+	n, err := parseBlock(s[1:])
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return first + n - 1, nil
+}
+
+// partArg splits the argument of a verb into the partition number and the
+// want remaining colon separated fields.
+func partArg(arg string, want int) (int, []string, error) {
+	f := strings.SplitN(arg, ":", want+1)
+	if len(f) != want+1 {
+		return 0, nil, fmt.Errorf("%q: want %d colon separated fields", arg, want+1)
+	}
+	n, err := strconv.Atoi(f[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("%q: invalid partition number: %v", arg, err)
+	}
+	return n, f[1:], nil
+}
+
+// edit applies the verbs to the partition table of f, which has blocks
+// blocks, and returns the result.
+func edit(f io.ReaderAt, blocks uint64, verbs []string) (*gpt.PartitionTable, error) {
+	var p *gpt.PartitionTable
+	var err error
+	for len(verbs) > 0 {
+		verb, arg := verbs[0], ""
+		verbs = verbs[1:]
+		switch verb {
+		case "new":
+			if p, err = gpt.Create(blocks); err != nil {
+				return nil, err
+			}
+			continue
+		case "repair":
+			if p, err = gpt.Repair(f, blocks); err != nil {
+				return nil, err
+			}
+			continue
+		case "add", "delete", "resize", "type", "name", "attr":
+			if len(verbs) == 0 {
+				return nil, fmt.Errorf("%s: missing argument", verb)
+			}
+			arg, verbs = verbs[0], verbs[1:]
+		default:
+			return nil, fmt.Errorf("unknown verb %q", verb)
+		}
+
+		if p == nil {
+			if p, err = gpt.New(f); err != nil {
+				return nil, fmt.Errorf("reading GPT: %v (try repair or new)", err)
+			}
+		}
+		switch verb {
+		case "add":
+			n, a, err := partArg(arg, 2)
+			if err != nil {
+				return nil, err
+			}
+			first, err := parseBlock(a[0])
+			if err != nil {
+				return nil, fmt.Errorf("add %s: %v", arg, err)
+			}
+			if first == 0 && strings.HasPrefix(a[1], "+") {
+				if first, err = p.FirstFree(*align); err != nil {
+					return nil, fmt.Errorf("add %s: %v", arg, err)
+				}
+			}
+			last, err := parseEnd(a[1], first)
+			if err != nil {
+				return nil, fmt.Errorf("add %s: %v", arg, err)
+			}
+			if _, err := p.AddPart(n, first, last, *align); err != nil {
+				return nil, fmt.Errorf("add %s: %v", arg, err)
+			}
+		case "delete":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("delete %s: %v", arg, err)
+			}
+			if err := p.DeletePart(n); err != nil {
+				return nil, fmt.Errorf("delete %s: %v", arg, err)
+			}
+		case "resize":
+			n, a, err := partArg(arg, 1)
+			if err != nil {
+				return nil, err
+			}
+			var first uint64
+			if n >= 1 && n <= len(p.Primary.Parts) {
+				first = p.Primary.Parts[n-1].FirstLBA
+			}
+			last, err := parseEnd(a[0], first)
+			if err != nil {
+				return nil, fmt.Errorf("resize %s: %v", arg, err)
+			}
+			if err := p.ResizePart(n, last); err != nil {
+				return nil, fmt.Errorf("resize %s: %v", arg, err)
+			}
+		case "type":
+			n, a, err := partArg(arg, 1)
+			if err != nil {
+				return nil, err
+			}
+			typ, err := gpt.ParseType(a[0])
+			if err != nil {
+				return nil, fmt.Errorf("type %s: %v", arg, err)
+			}
+			if err := p.SetType(n, typ); err != nil {
+				return nil, fmt.Errorf("type %s: %v", arg, err)
+			}
+		case "name":
+			n, a, err := partArg(arg, 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.SetName(n, a[0]); err != nil {
+				return nil, fmt.Errorf("name %s: %v", arg, err)
+			}
+		case "attr":
+			n, a, err := partArg(arg, 1)
+			if err != nil {
+				return nil, err
+			}
+			attr, err := strconv.ParseUint(a[0], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("attr %s: %v", arg, err)
+			}
+			if err := p.SetAttr(n, gpt.PartAttr(attr)); err != nil {
+				return nil, fmt.Errorf("attr %s: %v", arg, err)
+			}
+		}
+	}
+	return p, nil
+}
+
 func main() {
 	flag.Parse()
-	if flag.NArg() != 1 {
+	if flag.NArg() < 1 || (*write && flag.NArg() != 1) {
 		flag.Usage()
 	}
 
 	m := os.O_RDONLY
-	if *write {
+	if *write || flag.NArg() > 1 {
 		m = os.O_RDWR
 	}
 
@@ -56,8 +240,8 @@ func main() {
 		log.Fatal(err)
 	}
 
-	switch *write {
-	case true:
+	switch {
+	case *write:
 		var p = &gpt.PartitionTable{}
 		if err := json.NewDecoder(os.Stdin).Decode(&p); err != nil {
 			log.Fatalf("Reading in JSON: %v", err)
@@ -65,6 +249,23 @@ func main() {
 		if err := gpt.Write(f, p); err != nil {
 			log.Fatalf("Writing %v: %v", n, err)
 		}
+	case flag.NArg() > 1:
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := edit(f, uint64(size)/gpt.BlockSize, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("%v: %v", n, err)
+		}
+		if err := gpt.Write(f, p); err != nil {
+			log.Fatalf("Writing %v: %v", n, err)
+		}
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeDevice != 0 {
+			if err := gpt.Reread(f); err != nil {
+				log.Printf("The kernel did not reread the partition table of %v: %v", n, err)
+			}
+		}
 	default:
 		// We might get one back, we might get both.
 		// In the event of an error, we show what we can
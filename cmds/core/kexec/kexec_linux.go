@@ -16,6 +16,12 @@
 //     --i=FILE or --initrd=FILE:     Use file as the kernel's initial ramdisk
 //     -l or --load:                  Load the new kernel into the current kernel
 //     -e or --exec:                  Execute a currently loaded kernel
+//     --kexec-syscall:               Load Linux kernels with kexec_load rather than kexec_file_load
+//     --dtb=FILE:                    Use file as the device tree, implies --kexec-syscall
+//     --fit-config=NAME:             Boot the named configuration of a FIT image
+//
+// FIT images are loaded with kexec_load using the kernel, ramdisk and device
+// tree of the default or the given configuration.
 package main
 
 import (
@@ -26,7 +32,9 @@ import (
 	flag "github.com/spf13/pflag"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/fit"
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/linux"
 	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/uio"
@@ -39,6 +47,9 @@ type options struct {
 	load         bool
 	exec         bool
 	debug        bool
+	kexecSyscall bool
+	dtb          string
+	fitConfig    string
 	modules      []string
 }
 
@@ -50,6 +61,9 @@ func registerFlags() *options {
 	flag.BoolVarP(&o.load, "load", "l", false, "Load the new kernel into the current kernel")
 	flag.BoolVarP(&o.exec, "exec", "e", false, "Execute a currently loaded kernel")
 	flag.BoolVarP(&o.debug, "debug", "d", false, "Print debug info")
+	flag.BoolVar(&o.kexecSyscall, "kexec-syscall", false, "Load Linux kernels with kexec_load rather than kexec_file_load")
+	flag.StringVar(&o.dtb, "dtb", "", "Use file as the device tree, implies --kexec-syscall")
+	flag.StringVar(&o.fitConfig, "fit-config", "", "Boot the named configuration of a FIT image")
 	flag.StringArrayVar(&o.modules, "module", nil, `Load module with command line args (e.g --module="mod arg1")`)
 	return o
 }
@@ -68,6 +82,11 @@ func main() {
 		log.Fatalf("--reuse-cmdline and other command line options are mutually exclusive")
 	}
 
+	if opts.debug {
+		linux.Debug = log.Printf
+		fit.Debug = log.Printf
+	}
+
 	if !opts.load && !opts.exec {
 		opts.load = true
 		opts.exec = true
@@ -97,15 +116,28 @@ func main() {
 				Kernel:  mbkernel,
 				Cmdline: newCmdline,
 			}
+		} else if _, err := fit.Parse(mbkernel); err == nil {
+			image = &fit.Image{
+				Name:    kernelpath,
+				File:    mbkernel,
+				Config:  opts.fitConfig,
+				Cmdline: newCmdline,
+			}
 		} else {
 			var i io.ReaderAt
 			if opts.initramfs != "" {
 				i = uio.NewLazyFile(opts.initramfs)
 			}
+			var dtb io.ReaderAt
+			if opts.dtb != "" {
+				dtb = uio.NewLazyFile(opts.dtb)
+			}
 			image = &boot.LinuxImage{
-				Kernel:  uio.NewLazyFile(kernelpath),
-				Initrd:  i,
-				Cmdline: newCmdline,
+				Kernel:      uio.NewLazyFile(kernelpath),
+				Initrd:      i,
+				Cmdline:     newCmdline,
+				DTB:         dtb,
+				LoadSyscall: opts.kexecSyscall || dtb != nil,
 			}
 		}
 		if err := image.Load(opts.debug); err != nil {
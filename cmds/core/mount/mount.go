@@ -7,6 +7,11 @@
 // Synopsis:
 //     mount [-r] [-o options] [-t FSTYPE] DEV PATH
 //
+// Description:
+//     DEV is a device path or a LABEL=, UUID=, PARTUUID= or PARTLABEL=
+//     specifier. The file system type of a device found by specifier
+//     defaults to the one probed on it.
+//
 // Options:
 //     -r: read only
 package main
@@ -20,6 +25,7 @@ import (
 
 	"github.com/u-root/u-root/pkg/loop"
 	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/storage"
 	"golang.org/x/sys/unix"
 )
 
@@ -105,6 +111,16 @@ func main() {
 	var flags uintptr
 	var data []string
 	var err error
+	if strings.Contains(dev, "=") {
+		bd, err := storage.WaitForDevice(dev, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dev = bd.DevicePath()
+		if *fsType == "" {
+			*fsType = bd.FSType
+		}
+	}
 	for _, option := range options {
 		switch option {
 		case "loop":
@@ -0,0 +1,185 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// iscsi logs into an iSCSI target and serves one of its LUNs as a network
+// block device until interrupted.
+//
+// With -multiboot, the LUN is not attached. Instead, the multiboot kernel is
+// booted with an iBFT that tells it to use the LUN as its boot disk.
+//
+// Synopsis:
+//     iscsi [-initiator NAME] [-chap-name NAME -chap-secret SECRET]
+//           [-reverse-chap-name NAME -reverse-chap-secret SECRET] [-timeout DURATION]
+//           [-lun N] [-nbd DEVICE | -multiboot KERNEL [-cmdline ARGS] [-module "FILE ARGS"]...]
+//           ADDRESS[:PORT] TARGET
+//
+// Example:
+//     iscsi 192.168.1.1 iqn.2019-10.org.example:disk &
+//     mount /dev/nbd0p1 /mnt
+//
+//     iscsi -multiboot mboot.c32 -module "vmkboot.gz" 192.168.1.1 iqn.2019-10.org.example:esxi
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/iscsi"
+	"github.com/u-root/u-root/pkg/nbd"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	initiator  = flag.String("initiator", "iqn.2019-10.org.u-root:initiator", "iSCSI qualified name of this initiator")
+	chapName   = flag.String("chap-name", "", "CHAP user name, defaults to the initiator name")
+	chapSecret = flag.String("chap-secret", "", "CHAP secret")
+	rchapName  = flag.String("reverse-chap-name", "", "CHAP user name of the target for mutual CHAP")
+	rchapSec   = flag.String("reverse-chap-secret", "", "CHAP secret of the target for mutual CHAP")
+	timeout    = flag.Duration("timeout", 30*time.Second, "timeout for connecting and each request, 0 for none")
+	lun        = flag.Uint("lun", 0, "logical unit number")
+	device     = flag.String("nbd", "/dev/nbd0", "network block device to attach the LUN to")
+	readOnly   = flag.Bool("ro", false, "attach the LUN read-only")
+	mbKernel   = flag.String("multiboot", "", "boot this multiboot kernel from the LUN with an iBFT instead of attaching it")
+	mbCmdline  = flag.String("cmdline", "", "command line of the multiboot kernel")
+	verbose    = flag.Bool("v", false, "log iSCSI PDUs")
+
+	modules moduleList
+)
+
+func init() {
+	flag.Var(&modules, "module", `multiboot module with arguments, e.g. -module="mod arg1"; may be repeated`)
+}
+
+// moduleList is a repeatable flag.
+type moduleList []string
+
+func (m *moduleList) String() string {
+	return strings.Join(*m, ", ")
+}
+
+func (m *moduleList) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
+// bootNIC returns the iBFT description of the interface that reaches target.
+func bootNIC(target net.IP) (ibft.NIC, error) {
+	routes, err := netlink.RouteGet(target)
+	if err != nil {
+		return ibft.NIC{}, err
+	}
+	if len(routes) == 0 {
+		return ibft.NIC{}, errors.New("no route to target")
+	}
+	r := routes[0]
+	link, err := netlink.LinkByIndex(r.LinkIndex)
+	if err != nil {
+		return ibft.NIC{}, err
+	}
+	nic := ibft.NIC{
+		Valid:      true,
+		Boot:       true,
+		Global:     true,
+		Gateway:    r.Gw,
+		MACAddress: link.Attrs().HardwareAddr,
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return ibft.NIC{}, err
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(r.Src) {
+			nic.IPNet = a.IPNet
+			break
+		}
+	}
+	return nic, nil
+}
+
+// bootMultiboot loads the -multiboot kernel with an iBFT for d and boots it.
+func bootMultiboot(s *iscsi.Session, d *iscsi.Disk) error {
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("target address is not a TCP address")
+	}
+	nic, err := bootNIC(addr.IP)
+	if err != nil {
+		return err
+	}
+	img := &boot.MultibootImage{
+		Kernel:  uio.NewLazyFile(*mbKernel),
+		Cmdline: *mbCmdline,
+		Modules: multiboot.LazyOpenModules(modules),
+		IBFT:    d.IBFT(nic),
+	}
+	if err := img.Load(*verbose); err != nil {
+		return err
+	}
+	// The booted OS logs in on its own.
+	if err := s.Close(); err != nil {
+		log.Print(err)
+	}
+	return kexec.Reboot()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *verbose {
+		iscsi.Debug = log.Printf
+	}
+
+	s, err := iscsi.Dial(flag.Arg(0), &iscsi.Config{
+		InitiatorName: *initiator,
+		TargetName:    flag.Arg(1),
+		CHAPName:      *chapName,
+		CHAPSecret:    *chapSecret,
+
+		ReverseCHAPName:   *rchapName,
+		ReverseCHAPSecret: *rchapSec,
+		Timeout:           *timeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	d, err := s.Disk(uint16(*lun))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*mbKernel) > 0 {
+		if err := bootMultiboot(s, d); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	dev, err := nbd.Attach(*device, d, d.Size(), d.BlockSize(), *readOnly)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s: LUN %d of %s, %d bytes", dev.Path, d.LUN(), flag.Arg(1), d.Size())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	if err := dev.Detach(); err != nil {
+		log.Print(err)
+	}
+}
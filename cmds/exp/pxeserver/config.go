@@ -0,0 +1,143 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Config is the file given by -config:
+//
+//	{
+//	  "bootfiles": {"0": "pxelinux.0", "7": "ipxe.efi", "16": "http://192.168.0.1/ipxe.efi"},
+//	  "ipxe": "http://192.168.0.1/boot.ipxe",
+//	  "hosts": [
+//	    {"mac": "00:11:22:33:44:55", "ip": "192.168.0.10", "ip6": "fec0::10", "hostname": "node1"}
+//	  ]
+//	}
+type Config struct {
+	// BootFiles are the boot files for client system architectures,
+	// as sent in DHCPv4 option 93 and DHCPv6 option 61: "0" for BIOS,
+	// "7" for x64 UEFI, "16" for x64 UEFI HTTP boot, etc.
+	BootFiles map[string]string `json:"bootfiles"`
+
+	// IPXEScript is the boot file for iPXE clients.
+	//
+	// iPXE asks for a boot file again after it was booted, and must be
+	// given something else than itself to not loop forever.
+	IPXEScript string `json:"ipxe"`
+
+	// Hosts are per-MAC reservations and settings.
+	Hosts []*Host `json:"hosts"`
+
+	hosts map[string]*Host
+}
+
+// Host is the configuration of one client.
+type Host struct {
+	MAC        string `json:"mac"`
+	IP         net.IP `json:"ip"`
+	IP6        net.IP `json:"ip6"`
+	Hostname   string `json:"hostname"`
+	BootFile   string `json:"bootfile"`
+	IPXEScript string `json:"ipxe"`
+	RootPath   string `json:"rootpath"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.index(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// index checks the hosts and indexes them by MAC.
+func (c *Config) index() error {
+	c.hosts = make(map[string]*Host)
+	ips := make(map[string]bool)
+	for _, h := range c.Hosts {
+		mac, err := net.ParseMAC(h.MAC)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.hosts[mac.String()]; ok {
+			return fmt.Errorf("host %s is configured twice", mac)
+		}
+		c.hosts[mac.String()] = h
+		for _, ip := range []net.IP{h.IP, h.IP6} {
+			if ip == nil {
+				continue
+			}
+			if ips[ip.String()] {
+				return fmt.Errorf("address %s is reserved twice", ip)
+			}
+			ips[ip.String()] = true
+		}
+	}
+	return nil
+}
+
+// host returns the configuration of mac. It is never nil.
+func (c *Config) host(mac net.HardwareAddr) *Host {
+	if h, ok := c.hosts[mac.String()]; ok {
+		return h
+	}
+	return &Host{}
+}
+
+// bootFile returns the boot file for a client, or def.
+func (c *Config) bootFile(mac net.HardwareAddr, archs []iana.Arch, isIPXE bool, def string) string {
+	h := c.host(mac)
+	if isIPXE {
+		if len(h.IPXEScript) > 0 {
+			return h.IPXEScript
+		}
+		if len(c.IPXEScript) > 0 {
+			return c.IPXEScript
+		}
+	}
+	if len(h.BootFile) > 0 {
+		return h.BootFile
+	}
+	for _, a := range archs {
+		if f, ok := c.BootFiles[strconv.Itoa(int(a))]; ok {
+			return f
+		}
+	}
+	return def
+}
+
+// Client system architectures of UEFI HTTP boot, from the IANA Processor
+// Architecture Types registry.
+var httpBootArchs = map[iana.Arch]bool{
+	15: true, // x86 UEFI HTTP
+	16: true, // x64 UEFI HTTP
+	17: true, // EBC HTTP
+	18: true, // ARM 32-bit UEFI HTTP
+	19: true, // ARM 64-bit UEFI HTTP
+}
+
+func isHTTPBoot(archs []iana.Arch) bool {
+	for _, a := range archs {
+		if httpBootArchs[a] {
+			return true
+		}
+	}
+	return false
+}
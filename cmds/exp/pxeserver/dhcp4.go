@@ -0,0 +1,179 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionIPXE is the iPXE encapsulated options, only sent by iPXE.
+const optionIPXE = dhcpv4.GenericOptionCode(175)
+
+type dserver4 struct {
+	mac          net.HardwareAddr
+	self         net.IP
+	submask      net.IPMask
+	pool         *pool
+	config       *Config
+	leaseTime    time.Duration
+	bootfilename string
+	rootpath     string
+}
+
+// isIPXE4 reports whether the request comes from iPXE.
+func isIPXE4(m *dhcpv4.DHCPv4) bool {
+	for _, uc := range m.UserClass() {
+		if uc == "iPXE" {
+			return true
+		}
+	}
+	return m.Options.Has(optionIPXE)
+}
+
+func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	log.Printf("Handling request %v for peer %v", m, peer)
+
+	reply := s.reply(m)
+	if reply == nil {
+		return
+	}
+
+	// Experimentally determined. You can't just blindly send a broadcast packet
+	// with the broadcast address. You can, however, send a broadcast packet
+	// to a subnet for an interface. That actually makes some sense.
+	// This fixes the observed problem that OSX just swallows these
+	// packets if the peer is 255.255.255.255.
+	// I chose this way of doing it instead of files with build constraints
+	// because this is not that expensive and it's just a tiny bit easier to
+	// follow IMHO.
+	if runtime.GOOS == "darwin" {
+		p := &net.UDPAddr{IP: s.self.Mask(s.submask), Port: 68}
+		log.Printf("Changing %v to %v", peer, p)
+		peer = p
+	}
+
+	log.Printf("Sending %v to %v", reply.Summary(), peer)
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Could not write %v: %v", reply, err)
+	}
+}
+
+// reply returns the reply to m, or nil if there is none.
+func (s *dserver4) reply(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	if s.mac != nil && !bytes.Equal(m.ClientHWAddr, s.mac) {
+		log.Printf("Not responding to DHCP request for mac %s, which does not match %s", m.ClientHWAddr, s.mac)
+		return nil
+	}
+	client := m.ClientHWAddr.String()
+
+	var (
+		replyType dhcpv4.MessageType
+		lease     *Lease
+		err       error
+	)
+	switch mt := m.MessageType(); mt {
+	case dhcpv4.MessageTypeDiscover:
+		replyType = dhcpv4.MessageTypeOffer
+		lease, err = s.pool.allocate(client, client, m.RequestedIPAddress(), s.leaseTime, false)
+
+	case dhcpv4.MessageTypeRequest:
+		if sid := m.ServerIdentifier(); sid != nil && !sid.Equal(s.self) {
+			log.Printf("Client %s chose server %s", client, sid)
+			s.pool.release(client)
+			return nil
+		}
+		// The requested address is in the Requested IP Address option
+		// in SELECTING and INIT-REBOOT state, and in ciaddr when renewing
+		// or rebinding, RFC 2131, Section 4.3.2.
+		requested := m.RequestedIPAddress()
+		if requested == nil || requested.IsUnspecified() {
+			requested = m.ClientIPAddr
+		}
+		replyType = dhcpv4.MessageTypeAck
+		lease, err = s.pool.allocate(client, client, requested, s.leaseTime, true)
+		if err != nil {
+			log.Printf("Refusing %s to %s: %v", requested, client, err)
+			return s.nak(m)
+		}
+
+	case dhcpv4.MessageTypeRelease:
+		log.Printf("Client %s released its address", client)
+		s.pool.release(client)
+		return nil
+
+	case dhcpv4.MessageTypeDecline:
+		log.Printf("Client %s declined %s, it is in use", client, m.RequestedIPAddress())
+		if ip := m.RequestedIPAddress(); ip != nil {
+			s.pool.decline(ip, s.leaseTime)
+		}
+		return nil
+
+	default:
+		log.Printf("Can't handle type %v", mt)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Could not give an address to %s: %v", client, err)
+		return nil
+	}
+
+	host := s.config.host(m.ClientHWAddr)
+	reply, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(replyType),
+		dhcpv4.WithServerIP(s.self),
+		dhcpv4.WithRouter(s.self),
+		dhcpv4.WithNetmask(s.submask),
+		dhcpv4.WithYourIP(lease.IP),
+		// RFC 2131, Section 4.3.1. Server Identifier: MUST
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
+		// RFC 2131, Section 4.3.1. IP lease time: MUST
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(s.leaseTime)),
+	)
+	if err != nil {
+		log.Printf("Could not create reply for %v: %v", m, err)
+		return nil
+	}
+	// RFC 6842, MUST include Client Identifier if client specified one.
+	if val := m.Options.Get(dhcpv4.OptionClientIdentifier); len(val) > 0 {
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, val))
+	}
+	if len(host.Hostname) > 0 {
+		reply.UpdateOption(dhcpv4.OptHostName(host.Hostname))
+	}
+
+	archs := m.ClientArch()
+	if f := s.config.bootFile(m.ClientHWAddr, archs, isIPXE4(m), s.bootfilename); len(f) > 0 {
+		reply.BootFileName = f
+	}
+	// UEFI HTTP boot clients ignore offers without this class, UEFI
+	// 2.8, Section 24.7.2.
+	if isHTTPBoot(archs) {
+		reply.UpdateOption(dhcpv4.OptClassIdentifier("HTTPClient"))
+	}
+	if len(host.RootPath) > 0 {
+		reply.UpdateOption(dhcpv4.OptRootPath(host.RootPath))
+	} else if len(s.rootpath) > 0 {
+		reply.UpdateOption(dhcpv4.OptRootPath(s.rootpath))
+	}
+	return reply
+}
+
+func (s *dserver4) nak(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	reply, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
+	)
+	if err != nil {
+		log.Printf("Could not create NAK for %v: %v", m, err)
+		return nil
+	}
+	return reply
+}
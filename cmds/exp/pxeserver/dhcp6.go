@@ -0,0 +1,190 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+type dserver6 struct {
+	mac       net.HardwareAddr
+	serverID  dhcpv6.Duid
+	pool      *pool
+	config    *Config
+	leaseTime time.Duration
+}
+
+// isIPXE6 reports whether the request comes from iPXE.
+func isIPXE6(m *dhcpv6.Message) bool {
+	if uc, ok := m.GetOneOption(dhcpv6.OptionUserClass).(*dhcpv6.OptUserClass); ok {
+		for _, c := range uc.UserClasses {
+			if string(c) == "iPXE" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *dserver6) dhcpHandler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	log.Printf("Handling DHCPv6 request %v sent by %v", m.Summary(), peer.String())
+
+	if m.IsRelay() {
+		log.Printf("Relayed requests are not supported")
+		return
+	}
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		log.Printf("Could not find unpacked message: %v", err)
+		return
+	}
+	reply := s.reply(msg)
+	if reply == nil {
+		return
+	}
+
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Failed to send response %v: %v", reply, err)
+		return
+	}
+	log.Printf("DHCPv6 request successfully handled, reply: %v", reply.Summary())
+}
+
+// reply returns the reply to msg, or nil if there is none.
+func (s *dserver6) reply(msg *dhcpv6.Message) *dhcpv6.Message {
+	// The MAC is only known from DUID-LL and DUID-LLT client IDs.
+	mac, _ := dhcpv6.ExtractMAC(msg)
+	if s.mac != nil && !bytes.Equal(s.mac, mac) {
+		log.Printf("MAC address %s doesn't match expected MAC %s", mac, s.mac)
+		return nil
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok && msg.MessageType != dhcpv6.MessageTypeInformationRequest {
+		log.Printf("No client ID in %s", msg.MessageType)
+		return nil
+	}
+	if sid, ok := msg.GetOneOption(dhcpv6.OptionServerID).(*dhcpv6.OptServerId); ok && !sid.Sid.Equal(s.serverID) {
+		log.Printf("%s is for server %s", msg.MessageType, sid.Sid.String())
+		return nil
+	}
+
+	var (
+		reply *dhcpv6.Message
+		err   error
+	)
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit:
+		// From RFC 3315, section 17.1.4, If the client includes a Rapid
+		// Commit option in the Solicit message, it will expect a Reply
+		// message that includes a Rapid Commit option in response.
+		bind := msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil
+		if bind {
+			reply, err = dhcpv6.NewReplyFromMessage(msg)
+		} else {
+			reply, err = dhcpv6.NewAdvertiseFromSolicit(msg)
+		}
+		if err == nil {
+			s.addresses(reply, msg, &cid.Cid, mac, bind)
+		}
+
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		if reply, err = dhcpv6.NewReplyFromMessage(msg); err == nil {
+			s.addresses(reply, msg, &cid.Cid, mac, true)
+		}
+
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		for _, opt := range msg.Options.Get(dhcpv6.OptionIANA) {
+			ia := opt.(*dhcpv6.OptIANA)
+			if msg.MessageType == dhcpv6.MessageTypeRelease {
+				s.pool.release(client6(&cid.Cid, ia))
+				continue
+			}
+			for _, a := range ia.Options.Get(dhcpv6.OptionIAAddr) {
+				s.pool.decline(a.(*dhcpv6.OptIAAddress).IPv6Addr, s.leaseTime)
+			}
+		}
+		if reply, err = dhcpv6.NewReplyFromMessage(msg); err == nil {
+			reply.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess})
+		}
+
+	case dhcpv6.MessageTypeInformationRequest:
+		reply, err = dhcpv6.NewReplyFromMessage(msg)
+
+	default:
+		log.Printf("Can't handle type %v", msg.MessageType)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to create reply for %v: %v", msg, err)
+		return nil
+	}
+	reply.AddOption(&dhcpv6.OptServerId{Sid: s.serverID})
+
+	// DHCPv6 boot files are URLs, RFC 5970, Section 3.1.
+	var archs []iana.Arch
+	if at, ok := msg.GetOneOption(dhcpv6.OptionClientArchType).(*dhcpv6.OptClientArchType); ok {
+		archs = at.ArchTypes
+	}
+	if f := s.config.bootFile(mac, archs, isIPXE6(msg), ""); strings.Contains(f, "://") {
+		reply.AddOption(dhcpv6.OptBootFileURL(f))
+	}
+	return reply
+}
+
+// client6 identifies an IA_NA of a client in the pool.
+func client6(duid *dhcpv6.Duid, ia *dhcpv6.OptIANA) string {
+	return fmt.Sprintf("%x/%x", duid.ToBytes(), ia.IaId)
+}
+
+// addresses adds an IA_NA with an address to reply for each IA_NA of msg.
+func (s *dserver6) addresses(reply, msg *dhcpv6.Message, duid *dhcpv6.Duid, mac net.HardwareAddr, bind bool) {
+	var macs string
+	if mac != nil {
+		macs = mac.String()
+	}
+	for _, opt := range msg.Options.Get(dhcpv6.OptionIANA) {
+		ia := opt.(*dhcpv6.OptIANA)
+		var hint net.IP
+		if a, ok := ia.Options.GetOne(dhcpv6.OptionIAAddr).(*dhcpv6.OptIAAddress); ok {
+			hint = a.IPv6Addr
+		}
+
+		// Clients keep their address when they ask for it, but a hint
+		// for another one is no reason to refuse them.
+		lease, err := s.pool.allocate(client6(duid, ia), macs, hint, s.leaseTime, bind)
+		if err == errNotAvailable {
+			lease, err = s.pool.allocate(client6(duid, ia), macs, nil, s.leaseTime, bind)
+		}
+		resp := &dhcpv6.OptIANA{IaId: ia.IaId}
+		if err != nil {
+			log.Printf("Could not give an address to %s: %v", duid.String(), err)
+			resp.Options = append(resp.Options, &dhcpv6.OptStatusCode{
+				StatusCode:    iana.StatusNoAddrsAvail,
+				StatusMessage: []byte(err.Error()),
+			})
+			reply.AddOption(resp)
+			continue
+		}
+		resp.T1, resp.T2 = s.leaseTime/2, s.leaseTime*4/5
+		resp.Options = append(resp.Options, &dhcpv6.OptIAAddress{
+			IPv6Addr:          lease.IP,
+			PreferredLifetime: s.leaseTime,
+			ValidLifetime:     s.leaseTime,
+		})
+		// Tell clients renewing another address to stop using it.
+		if bind && hint != nil && !hint.Equal(lease.IP) {
+			resp.Options = append(resp.Options, &dhcpv6.OptIAAddress{IPv6Addr: hint})
+		}
+		reply.AddOption(resp)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func testConfig(t *testing.T) *Config {
+	c := &Config{
+		BootFiles:  map[string]string{"7": "ipxe.efi", "16": "http://192.168.0.1/ipxe.efi"},
+		IPXEScript: "http://192.168.0.1/boot.ipxe",
+		Hosts: []*Host{
+			{MAC: "00:00:00:00:00:01", IP: net.IPv4(192, 168, 0, 10), IP6: net.ParseIP("fec0::10"), Hostname: "node1", BootFile: "node1.0"},
+		},
+	}
+	if err := c.index(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServer4(t *testing.T) {
+	config := testConfig(t)
+	self := net.IPv4(192, 168, 0, 1)
+	s := &dserver4{
+		self:         self,
+		submask:      net.CIDRMask(24, 32),
+		pool:         newPool(net.IPv4(192, 168, 0, 2), 10, self),
+		config:       config,
+		leaseTime:    time.Hour,
+		bootfilename: "pxelinux.0",
+	}
+	s.pool.reserve("00:00:00:00:00:01", net.IPv4(192, 168, 0, 10))
+
+	for _, tt := range []struct {
+		name     string
+		mac      string
+		mods     []dhcpv4.Modifier
+		ip       net.IP
+		bootfile string
+		class    string
+	}{
+		{
+			name:     "bios",
+			mac:      "00:00:00:00:00:02",
+			ip:       net.IPv4(192, 168, 0, 2),
+			bootfile: "pxelinux.0",
+		},
+		{
+			name:     "uefi",
+			mac:      "00:00:00:00:00:03",
+			mods:     []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_BC))},
+			ip:       net.IPv4(192, 168, 0, 3),
+			bootfile: "ipxe.efi",
+		},
+		{
+			name:     "uefi http",
+			mac:      "00:00:00:00:00:04",
+			mods:     []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClientArch(16))},
+			ip:       net.IPv4(192, 168, 0, 4),
+			bootfile: "http://192.168.0.1/ipxe.efi",
+			class:    "HTTPClient",
+		},
+		{
+			name: "ipxe",
+			mac:  "00:00:00:00:00:03",
+			mods: []dhcpv4.Modifier{
+				dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_BC)),
+				dhcpv4.WithUserClass("iPXE", false),
+			},
+			ip:       net.IPv4(192, 168, 0, 3),
+			bootfile: "http://192.168.0.1/boot.ipxe",
+		},
+		{
+			name:     "reservation",
+			mac:      "00:00:00:00:00:01",
+			ip:       net.IPv4(192, 168, 0, 10),
+			bootfile: "node1.0",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, _ := net.ParseMAC(tt.mac)
+			discover, err := dhcpv4.NewDiscovery(mac, tt.mods...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offer := s.reply(discover)
+			if offer == nil || offer.MessageType() != dhcpv4.MessageTypeOffer {
+				t.Fatalf("reply(%v) = %v, want offer", discover, offer)
+			}
+			request, err := dhcpv4.NewRequestFromOffer(offer, tt.mods...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ack := s.reply(request)
+			if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+				t.Fatalf("reply(%v) = %v, want ack", request, ack)
+			}
+			if !ack.YourIPAddr.Equal(tt.ip) {
+				t.Errorf("got address %v, want %v", ack.YourIPAddr, tt.ip)
+			}
+			if ack.BootFileName != tt.bootfile {
+				t.Errorf("got boot file %q, want %q", ack.BootFileName, tt.bootfile)
+			}
+			if got := ack.ClassIdentifier(); got != tt.class {
+				t.Errorf("got class identifier %q, want %q", got, tt.class)
+			}
+		})
+	}
+
+	// Requests for another client's address are refused.
+	mac, _ := net.ParseMAC("00:00:00:00:00:05")
+	request, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 168, 0, 2))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nak := s.reply(request); nak == nil || nak.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("reply(%v) = %v, want NAK", request, nak)
+	}
+}
+
+func TestServer6(t *testing.T) {
+	serverID := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0xff},
+	}
+	s := &dserver6{
+		serverID:  serverID,
+		pool:      newPool(net.ParseIP("fec0::2"), 10),
+		config:    testConfig(t),
+		leaseTime: time.Hour,
+	}
+	s.pool.reserve("00:00:00:00:00:01", net.ParseIP("fec0::10"))
+
+	for _, tt := range []struct {
+		mac  string
+		mods []dhcpv6.Modifier
+		ip   net.IP
+		url  string
+	}{
+		{mac: "00:00:00:00:00:02", ip: net.ParseIP("fec0::2")},
+		{mac: "00:00:00:00:00:03", mods: []dhcpv6.Modifier{dhcpv6.WithArchType(16)}, ip: net.ParseIP("fec0::3"), url: "http://192.168.0.1/ipxe.efi"},
+		{mac: "00:00:00:00:00:01", ip: net.ParseIP("fec0::10")},
+	} {
+		t.Run(tt.mac, func(t *testing.T) {
+			mac, _ := net.ParseMAC(tt.mac)
+			solicit, err := dhcpv6.NewSolicit(mac, tt.mods...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			adv := s.reply(solicit)
+			if adv == nil || adv.MessageType != dhcpv6.MessageTypeAdvertise {
+				t.Fatalf("reply(%v) = %v, want advertise", solicit, adv)
+			}
+			request, err := dhcpv6.NewRequestFromAdvertise(adv, tt.mods...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := s.reply(request)
+			if reply == nil || reply.MessageType != dhcpv6.MessageTypeReply {
+				t.Fatalf("reply(%v) = %v, want reply", request, reply)
+			}
+			ia, ok := reply.GetOneOption(dhcpv6.OptionIANA).(*dhcpv6.OptIANA)
+			if !ok {
+				t.Fatalf("no IA_NA in %v", reply)
+			}
+			addr, ok := ia.Options.GetOne(dhcpv6.OptionIAAddr).(*dhcpv6.OptIAAddress)
+			if !ok || !addr.IPv6Addr.Equal(tt.ip) {
+				t.Errorf("IA_NA = %v, want address %v", ia, tt.ip)
+			}
+			var url string
+			if u, ok := reply.GetOneOption(dhcpv6.OptionBootfileURL).(dhcpv6.OptBootFileURL); ok {
+				url = string(u)
+			}
+			if url != tt.url {
+				t.Errorf("boot file URL = %q, want %q", url, tt.url)
+			}
+		})
+	}
+}
@@ -2,20 +2,27 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// pxeserver is a test & lab PXE server that supports TFTP, HTTP, and DHCPv4.
+// pxeserver is a test & lab PXE server that supports TFTP, HTTP, DHCPv4 and
+// DHCPv6.
 //
-// pxeserver can either respond to *all* DHCP requests, or a DHCP request from
-// a specific MAC. In either case, it will supply the same IP in all answers.
+// pxeserver hands out addresses from a pool with leases, or the addresses
+// reserved for MACs in the config file, and can either respond to *all* DHCP
+// requests or only to the requests of a specific MAC.
+//
+// The boot file is chosen by client system architecture (DHCP option 93 and
+// DHCPv6 option 61) and per MAC in the config file, see Config. iPXE clients
+// are given an iPXE script instead, so that they do not chain-load iPXE again.
+//
+// The current leases are served as JSON at /status of the -status address.
 package main
 
 import (
-	"bytes"
+	"encoding/binary"
 	"flag"
 	"log"
-	"math"
 	"net"
 	"net/http"
-	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,162 +30,65 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
 	"pack.ag/tftp"
 )
 
 var (
-	mac = flag.String("mac", "", "MAC address to respond to. Responds to all requests if unspecified.")
+	mac        = flag.String("mac", "", "MAC address to respond to. Responds to all requests if unspecified.")
+	configFile = flag.String("config", "", "JSON file with per-MAC reservations and boot files")
+	leaseTime  = flag.Duration("lease-time", time.Hour, "Lease time of addresses")
+	poolSize   = flag.Uint64("pool-size", 0, "Number of addresses in the pools. 0 means up to the end of the subnet.")
+	statusAddr = flag.String("status", "", "Address to serve the JSON lease status on, e.g. :8080")
+	inf        = flag.String("interface", "eth0", "Interface to serve DHCP on")
 
 	// DHCPv4-specific
 	ipv4         = flag.Bool("4", true, "IPv4 DHCP server")
 	selfIP       = flag.String("ip", "192.168.0.1", "DHCPv4 IP of self")
-	yourIP       = flag.String("your-ip", "192.168.0.2/24", "The one and only CIDR to give to all DHCPv4 clients")
+	yourIP       = flag.String("your-ip", "192.168.0.2/24", "First address and netmask of the DHCPv4 address pool")
 	rootpath     = flag.String("rootpath", "", "RootPath option to serve via DHCPv4")
 	bootfilename = flag.String("bootfilename", "pxelinux.0", "Boot file to serve via DHCPv4")
-	inf          = flag.String("interface", "eth0", "Interface to serve DHCPv4 on")
 
 	// DHCPv6-specific
 	ipv6    = flag.Bool("6", false, "DHCPv6 server")
-	yourIP6 = flag.String("your-ip6", "fec0::3", "IPv6 to hand to all clients")
+	yourIP6 = flag.String("your-ip6", "fec0::3/64", "First address and prefix of the DHCPv6 address pool")
 
 	// File serving
 	tftpDir = flag.String("tftp-dir", "", "Directory to serve over TFTP")
 	httpDir = flag.String("http-dir", "", "Directory to serve over HTTP")
 )
 
-type dserver4 struct {
-	mac          net.HardwareAddr
-	yourIP       net.IP
-	submask      net.IPMask
-	self         net.IP
-	bootfilename string
-	rootpath     string
-}
-
-func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
-	log.Printf("Handling request %v for peer %v", m, peer)
-
-	var replyType dhcpv4.MessageType
-	switch mt := m.MessageType(); mt {
-	case dhcpv4.MessageTypeDiscover:
-		replyType = dhcpv4.MessageTypeOffer
-	case dhcpv4.MessageTypeRequest:
-		replyType = dhcpv4.MessageTypeAck
-	default:
-		log.Printf("Can't handle type %v", mt)
-		return
-	}
-	if s.mac != nil && !bytes.Equal(m.ClientHWAddr, s.mac) {
-		log.Printf("Not responding to DHCP request for mac %s, which does not match %s", m.ClientHWAddr, s.mac)
-		return
-	}
-
-	reply, err := dhcpv4.NewReplyFromRequest(m,
-		dhcpv4.WithMessageType(replyType),
-		dhcpv4.WithServerIP(s.self),
-		dhcpv4.WithRouter(s.self),
-		dhcpv4.WithNetmask(s.submask),
-		dhcpv4.WithYourIP(s.yourIP),
-		// RFC 2131, Section 4.3.1. Server Identifier: MUST
-		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
-		// RFC 2131, Section 4.3.1. IP lease time: MUST
-		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Duration(math.MaxUint32)*time.Second)),
-	)
-	// RFC 6842, MUST include Client Identifier if client specified one.
-	if val := m.Options.Get(dhcpv4.OptionClientIdentifier); len(val) > 0 {
-		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, val))
-	}
-	if len(s.bootfilename) > 0 {
-		reply.BootFileName = s.bootfilename
-	}
-	if len(s.rootpath) > 0 {
-		reply.UpdateOption(dhcpv4.OptRootPath(s.rootpath))
-	}
-	if err != nil {
-		log.Printf("Could not create reply for %v: %v", m, err)
-		return
-	}
-
-	// Experimentally determined. You can't just blindly send a broadcast packet
-	// with the broadcast address. You can, however, send a broadcast packet
-	// to a subnet for an interface. That actually makes some sense.
-	// This fixes the observed problem that OSX just swallows these
-	// packets if the peer is 255.255.255.255.
-	// I chose this way of doing it instead of files with build constraints
-	// because this is not that expensive and it's just a tiny bit easier to
-	// follow IMHO.
-	if runtime.GOOS == "darwin" {
-		p := &net.UDPAddr{IP: s.yourIP.Mask(s.submask), Port: 68}
-		log.Printf("Changing %v to %v", peer, p)
-		peer = p
-	}
+// maxPool6 is the default size of DHCPv6 pools.
+const maxPool6 = 1 << 16
 
-	log.Printf("Sending %v to %v", reply.Summary(), peer)
-	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
-		log.Printf("Could not write %v: %v", reply, err)
+// newPool4 returns a pool from first to the last address before the
+// broadcast address of its subnet.
+func newPool4(first net.IP, subnet *net.IPNet, self net.IP) *pool {
+	ones, bits := subnet.Mask.Size()
+	offset := uint64(binary.BigEndian.Uint32(first.To4()) - binary.BigEndian.Uint32(subnet.IP.To4()))
+	size := uint64(1)<<uint(bits-ones) - offset - 1
+	if *poolSize > 0 && *poolSize < size {
+		size = *poolSize
 	}
+	return newPool(first.To4(), size, self)
 }
 
-type dserver6 struct {
-	mac    net.HardwareAddr
-	yourIP net.IP
-}
-
-func (s *dserver6) dhcpHandler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
-	log.Printf("Handling DHCPv6 request %v sent by %v", m.Summary(), peer.String())
-
-	msg, err := m.GetInnerMessage()
-	if err != nil {
-		log.Printf("Could not find unpacked message: %v", err)
-		return
-	}
-
-	if msg.MessageType != dhcpv6.MessageTypeSolicit {
-		log.Printf("Only accept SOLICIT message type, this is a %s", msg.MessageType)
-		return
-	}
-	if msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
-		log.Printf("Only accept requests with rapid commit option.")
-		return
-	}
-	if mac, err := dhcpv6.ExtractMAC(msg); err != nil {
-		log.Printf("No MAC address in request: %v", err)
-		return
-	} else if s.mac != nil && !bytes.Equal(s.mac, mac) {
-		log.Printf("MAC address %s doesn't match expected MAC %s", mac, s.mac)
-		return
-	}
-
-	// From RFC 3315, section 17.1.4, If the client includes a Rapid Commit
-	// option in the Solicit message, it will expect a Reply message that
-	// includes a Rapid Commit option in response.
-	reply, err := dhcpv6.NewReplyFromMessage(msg)
-	if err != nil {
-		log.Printf("Failed to create reply for %v: %v", m, err)
-		return
-	}
-
-	ianaOpt := msg.GetOneOption(dhcpv6.OptionIANA)
-	iana, ok := ianaOpt.(*dhcpv6.OptIANA)
-	if ok {
-		reply.AddOption(&dhcpv6.OptIANA{
-			IaId: iana.IaId,
-			Options: []dhcpv6.Option{
-				&dhcpv6.OptIAAddress{
-					IPv6Addr:          s.yourIP,
-					PreferredLifetime: math.MaxUint32,
-					ValidLifetime:     math.MaxUint32,
-				},
-			},
-		})
-	}
-
-	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
-		log.Printf("Failed to send response %v: %v", reply, err)
-		return
+// newPool6 returns a pool from first to the end of its prefix, of at most
+// maxPool6 addresses unless -pool-size says otherwise.
+func newPool6(first net.IP, prefix *net.IPNet) *pool {
+	ones, bits := prefix.Mask.Size()
+	size := uint64(maxPool6)
+	if *poolSize > 0 {
+		size = *poolSize
+	}
+	if bits-ones < 64 {
+		last := addIP(prefix.IP, 1<<uint(bits-ones)-1)
+		remaining := binary.BigEndian.Uint64(last[8:]) - binary.BigEndian.Uint64(first.To16()[8:]) + 1
+		if remaining < size {
+			size = remaining
+		}
 	}
-
-	log.Printf("DHCPv6 request successfully handled, reply: %v", reply.Summary())
+	return newPool(first, size)
 }
 
 func main() {
@@ -192,10 +102,46 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+
+	config := &Config{}
+	if len(*configFile) > 0 {
+		var err error
+		if config, err = loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := config.index(); err != nil {
+		log.Fatal(err)
+	}
+
+	var pool4, pool6 *pool
+	self := net.ParseIP(*selfIP)
 	yourIP, yourNet, err := net.ParseCIDR(*yourIP)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *ipv4 {
+		pool4 = newPool4(yourIP, yourNet, self)
+	}
+	if *ipv6 {
+		// Bare addresses are accepted for compatibility.
+		if !strings.Contains(*yourIP6, "/") {
+			*yourIP6 += "/64"
+		}
+		first, prefix, err := net.ParseCIDR(*yourIP6)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool6 = newPool6(first, prefix)
+	}
+	for _, h := range config.Hosts {
+		m, _ := net.ParseMAC(h.MAC)
+		if h.IP != nil && pool4 != nil {
+			pool4.reserve(m.String(), h.IP)
+		}
+		if h.IP6 != nil && pool6 != nil {
+			pool6.reserve(m.String(), h.IP6)
+		}
+	}
 
 	var wg sync.WaitGroup
 	if len(*tftpDir) != 0 {
@@ -220,6 +166,15 @@ func main() {
 			log.Fatal(http.ListenAndServe(":80", nil))
 		}()
 	}
+	if len(*statusAddr) != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mux := http.NewServeMux()
+			mux.Handle("/status", &statusHandler{pool4: pool4, pool6: pool6})
+			log.Fatal(http.ListenAndServe(*statusAddr, mux))
+		}()
+	}
 
 	if *ipv4 {
 		wg.Add(1)
@@ -227,9 +182,11 @@ func main() {
 			defer wg.Done()
 			s := &dserver4{
 				mac:          maca,
-				self:         net.ParseIP(*selfIP),
-				yourIP:       yourIP,
+				self:         self,
 				submask:      yourNet.Mask,
+				pool:         pool4,
+				config:       config,
+				leaseTime:    *leaseTime,
 				bootfilename: *bootfilename,
 				rootpath:     *rootpath,
 			}
@@ -250,15 +207,26 @@ func main() {
 		go func() {
 			defer wg.Done()
 
+			iface, err := net.InterfaceByName(*inf)
+			if err != nil {
+				log.Fatal(err)
+			}
 			s := &dserver6{
-				mac:    maca,
-				yourIP: net.ParseIP(*yourIP6),
+				mac: maca,
+				serverID: dhcpv6.Duid{
+					Type:          dhcpv6.DUID_LL,
+					HwType:        iana.HWTypeEthernet,
+					LinkLayerAddr: iface.HardwareAddr,
+				},
+				pool:      pool6,
+				config:    config,
+				leaseTime: *leaseTime,
 			}
 			laddr := &net.UDPAddr{
 				IP:   net.IPv6unspecified,
 				Port: dhcpv6.DefaultServerPort,
 			}
-			server, err := server6.NewServer("eth0", laddr, s.dhcpHandler)
+			server, err := server6.NewServer(*inf, laddr, s.dhcpHandler)
 			if err != nil {
 				log.Fatal(err)
 			}
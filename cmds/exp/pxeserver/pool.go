@@ -0,0 +1,227 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errPoolExhausted = errors.New("no free address in pool")
+	errNotAvailable  = errors.New("requested address is not available")
+
+	// now is time.Now, replaced in tests.
+	now = time.Now
+)
+
+// offerTimeout is how long an offered address stays reserved for a client
+// that has not requested it yet.
+const offerTimeout = time.Minute
+
+// Lease is an address given to a client.
+type Lease struct {
+	IP     net.IP    `json:"ip"`
+	Client string    `json:"client"`
+	MAC    string    `json:"mac,omitempty"`
+	Expiry time.Time `json:"expiry"`
+	// Bound is false for offered addresses not requested yet.
+	Bound bool `json:"bound"`
+	// Static is true for addresses reserved in the config file.
+	Static bool `json:"static,omitempty"`
+}
+
+func (l *Lease) expired() bool {
+	return !l.Static && now().After(l.Expiry)
+}
+
+// pool hands out the addresses start, start+1, ..., start+size-1 and
+// addresses reserved for MACs. Clients are identified by their MAC address
+// for DHCPv4 and by their DUID and IAID for DHCPv6.
+type pool struct {
+	mu      sync.Mutex
+	start   net.IP
+	size    uint64
+	next    uint64
+	exclude map[string]bool
+	// static maps MACs to reserved addresses.
+	static map[string]net.IP
+	// leases is indexed by client, byIP by address.
+	leases map[string]*Lease
+	byIP   map[string]*Lease
+}
+
+func newPool(start net.IP, size uint64, exclude ...net.IP) *pool {
+	p := &pool{
+		start:   start,
+		size:    size,
+		exclude: make(map[string]bool),
+		static:  make(map[string]net.IP),
+		leases:  make(map[string]*Lease),
+		byIP:    make(map[string]*Lease),
+	}
+	for _, ip := range exclude {
+		p.exclude[ip.String()] = true
+	}
+	return p
+}
+
+// addIP returns ip+n.
+func addIP(ip net.IP, n uint64) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		r := make(net.IP, 4)
+		binary.BigEndian.PutUint32(r, binary.BigEndian.Uint32(v4)+uint32(n))
+		return r
+	}
+	r := make(net.IP, 16)
+	hi, lo := binary.BigEndian.Uint64(ip.To16()), binary.BigEndian.Uint64(ip.To16()[8:])
+	if lo+n < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(r, hi)
+	binary.BigEndian.PutUint64(r[8:], lo+n)
+	return r
+}
+
+// reserve reserves ip for mac.
+func (p *pool) reserve(mac string, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.static[mac] = ip
+	p.exclude[ip.String()] = true
+}
+
+// free reports whether ip can be given to client.
+func (p *pool) free(client string, ip net.IP) bool {
+	if p.exclude[ip.String()] {
+		return false
+	}
+	l, ok := p.byIP[ip.String()]
+	return !ok || l.Client == client || l.expired()
+}
+
+// inPool reports whether ip is one of the dynamic addresses.
+func (p *pool) inPool(ip net.IP) bool {
+	a, b := p.start.To16(), ip.To16()
+	if b == nil || (p.start.To4() == nil) != (ip.To4() == nil) {
+		return false
+	}
+	if binary.BigEndian.Uint64(a) != binary.BigEndian.Uint64(b) {
+		return false
+	}
+	first, lo := binary.BigEndian.Uint64(a[8:]), binary.BigEndian.Uint64(b[8:])
+	return lo >= first && lo-first < p.size
+}
+
+// prune removes expired leases, including declined addresses.
+func (p *pool) prune() {
+	for client, l := range p.leases {
+		if l.expired() {
+			delete(p.leases, client)
+			if p.byIP[l.IP.String()] == l {
+				delete(p.byIP, l.IP.String())
+			}
+		}
+	}
+}
+
+// allocate gives client an address for d, or offers it for offerTimeout if
+// bind is false.
+//
+// Clients keep the address reserved for their MAC or their current
+// address. Otherwise they get requested if it is free, or the next free
+// address of the pool.
+func (p *pool) allocate(client, mac string, requested net.IP, d time.Duration, bind bool) (*Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune()
+
+	l := &Lease{Client: client, MAC: mac, Bound: bind}
+	if bind {
+		l.Expiry = now().Add(d)
+	} else {
+		l.Expiry = now().Add(offerTimeout)
+	}
+	if ip, ok := p.static[mac]; ok && len(mac) > 0 {
+		l.IP, l.Static = ip, true
+	} else if old, ok := p.leases[client]; ok && !old.expired() {
+		l.IP = old.IP
+	} else if requested != nil && p.inPool(requested) && p.free(client, requested) {
+		l.IP = requested
+	} else {
+		for i := uint64(0); i < p.size; i++ {
+			ip := addIP(p.start, (p.next+i)%p.size)
+			if p.free(client, ip) {
+				l.IP = ip
+				p.next = (p.next + i + 1) % p.size
+				break
+			}
+		}
+		if l.IP == nil {
+			return nil, errPoolExhausted
+		}
+	}
+	if requested != nil && bind && !requested.Equal(l.IP) {
+		return nil, errNotAvailable
+	}
+
+	// An offer does not shorten a bound lease.
+	if old, ok := p.leases[client]; ok && old.IP.Equal(l.IP) && old.Bound && !bind {
+		return old, nil
+	}
+	if old, ok := p.leases[client]; ok {
+		delete(p.byIP, old.IP.String())
+	}
+	if other, ok := p.byIP[l.IP.String()]; ok {
+		delete(p.leases, other.Client)
+	}
+	p.leases[client] = l
+	p.byIP[l.IP.String()] = l
+	return l, nil
+}
+
+// release frees client's address.
+func (p *pool) release(client string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.leases[client]; ok {
+		delete(p.leases, client)
+		delete(p.byIP, l.IP.String())
+	}
+}
+
+// decline takes ip, which is in use by an unknown host, out of the pool
+// for d.
+func (p *pool) decline(ip net.IP, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune()
+	if l, ok := p.byIP[ip.String()]; ok {
+		delete(p.leases, l.Client)
+	}
+	l := &Lease{IP: ip, Client: "declined " + ip.String(), Expiry: now().Add(d)}
+	p.leases[l.Client] = l
+	p.byIP[ip.String()] = l
+}
+
+// list returns the current leases sorted by address.
+func (p *pool) list() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ls []Lease
+	for _, l := range p.leases {
+		if !l.expired() {
+			ls = append(ls, *l)
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return string(ls[i].IP.To16()) < string(ls[j].IP.To16())
+	})
+	return ls
+}
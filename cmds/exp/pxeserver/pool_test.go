@@ -0,0 +1,96 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// setNow makes now return t and returns a func to restore it.
+func setNow(t *time.Time) func() {
+	old := now
+	now = func() time.Time { return *t }
+	return func() { now = old }
+}
+
+func TestPool(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	defer setNow(&clock)()
+
+	p := newPool(net.IPv4(192, 168, 0, 2), 3, net.IPv4(192, 168, 0, 3))
+	p.reserve("static", net.IPv4(192, 168, 0, 100))
+
+	allocate := func(client string, requested net.IP, bind bool) net.IP {
+		t.Helper()
+		l, err := p.allocate(client, client, requested, time.Hour, bind)
+		if err != nil {
+			t.Fatalf("allocate(%s, %v) = %v", client, requested, err)
+		}
+		return l.IP
+	}
+	want := func(got, want net.IP) {
+		t.Helper()
+		if !got.Equal(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Excluded addresses are skipped, offers and bound leases stick.
+	want(allocate("a", nil, false), net.IPv4(192, 168, 0, 2))
+	want(allocate("a", net.IPv4(192, 168, 0, 2), true), net.IPv4(192, 168, 0, 2))
+	want(allocate("b", nil, false), net.IPv4(192, 168, 0, 4))
+	want(allocate("static", nil, true), net.IPv4(192, 168, 0, 100))
+	want(allocate("a", nil, false), net.IPv4(192, 168, 0, 2))
+
+	// The pool is exhausted until offers time out.
+	if _, err := p.allocate("c", "c", nil, time.Hour, false); err != errPoolExhausted {
+		t.Errorf("allocate(c) = %v, want %v", err, errPoolExhausted)
+	}
+	clock = clock.Add(2 * offerTimeout)
+	want(allocate("c", nil, true), net.IPv4(192, 168, 0, 4))
+
+	// Requesting someone else's address is refused.
+	if _, err := p.allocate("c", "c", net.IPv4(192, 168, 0, 2), time.Hour, true); err != errNotAvailable {
+		t.Errorf("allocate(c, 192.168.0.2) = %v, want %v", err, errNotAvailable)
+	}
+
+	// Released and expired addresses are given out again.
+	p.release("c")
+	want(allocate("d", net.IPv4(192, 168, 0, 4), true), net.IPv4(192, 168, 0, 4))
+	clock = clock.Add(2 * time.Hour)
+	want(allocate("e", net.IPv4(192, 168, 0, 2), false), net.IPv4(192, 168, 0, 2))
+
+	// Declined addresses are not.
+	p.decline(net.IPv4(192, 168, 0, 4), time.Hour)
+	if _, err := p.allocate("d", "d", nil, time.Hour, true); err != errPoolExhausted {
+		t.Errorf("allocate(d) = %v, want %v", err, errPoolExhausted)
+	}
+
+	if got := len(p.list()); got != 3 {
+		t.Errorf("list() has %d leases, want 3", got)
+	}
+
+	// Expired leases and declined addresses are removed.
+	clock = clock.Add(2 * time.Hour)
+	want(allocate("f", nil, false), net.IPv4(192, 168, 0, 2))
+	if len(p.leases) != 2 || len(p.byIP) != 2 {
+		t.Errorf("pool has %d leases and %d addresses, want 2 and 2", len(p.leases), len(p.byIP))
+	}
+}
+
+func TestPool6(t *testing.T) {
+	p := newPool(net.ParseIP("fec0::ffff:ffff:ffff:fffe"), 4)
+	for _, want := range []string{"fec0::ffff:ffff:ffff:fffe", "fec0::ffff:ffff:ffff:ffff", "fec0:0:0:1::", "fec0:0:0:1::1"} {
+		l, err := p.allocate(want, "", nil, time.Hour, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.IP.String() != want {
+			t.Errorf("allocate() = %v, want %v", l.IP, want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// status is the JSON document served by the status endpoint.
+type status struct {
+	Leases4 []Lease `json:"leases4"`
+	Leases6 []Lease `json:"leases6"`
+}
+
+// statusHandler serves the current leases of the pools, which may be nil.
+type statusHandler struct {
+	pool4, pool6 *pool
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := status{Leases4: []Lease{}, Leases6: []Lease{}}
+	if h.pool4 != nil {
+		s.Leases4 = append(s.Leases4, h.pool4.list()...)
+	}
+	if h.pool6 != nil {
+		s.Leases6 = append(s.Leases6, h.pool6.list()...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		log.Printf("Could not write status: %v", err)
+	}
+}
@@ -1,16 +1,33 @@
-// Copyright 2014-2017 the u-root Authors. All rights reserved
+// Copyright 2014-2019 the u-root Authors. All rights reserved
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
 // Serve files on the network.
 //
 // Synopsis:
-//     srvfiles [--h=HOST] [--p=PORT] [--d=DIR]
+//     srvfiles [--h=HOST] [--p=PORT] [--d=DIR] [--tls [--cert=FILE --key=FILE]]
+//              [--users=USER:PASSWORD,...] [--tokens=TOKEN,...]
+//              [--upload [--max-upload=BYTES]]
+//
+// Description:
+//     Directories are listed as JSON when asked for with "?format=json" or
+//     an "Accept: application/json" header. With --upload, files are
+//     created or replaced with PUT requests.
+//
+//     Without --cert and --key, --tls uses a new self-signed certificate
+//     and logs its public key pin for clients to check.
 //
 // Options:
-//     --h: hostname (default: 127.0.0.1)
-//     --p: port number (default: 8080)
-//     --d: directory to serve (default: .)
+//     --h:          hostname (default: 127.0.0.1)
+//     --p:          port number (default: 8080)
+//     --d:          directory to serve (default: .)
+//     --tls:        serve HTTPS
+//     --cert:       PEM file with the TLS certificate
+//     --key:        PEM file with the TLS key
+//     --users:      users allowed with basic authentication
+//     --tokens:     allowed bearer tokens
+//     --upload:     allow PUT uploads
+//     --max-upload: maximum upload size in bytes, 0 for no limit
 package main
 
 import (
@@ -18,37 +35,61 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/fileserver"
 )
 
 var (
-	host = flag.String("h", "127.0.0.1", "hostname")
-	port = flag.String("p", "8080", "port number")
-	dir  = flag.String("d", ".", "directory to serve")
+	host      = flag.String("h", "127.0.0.1", "hostname")
+	port      = flag.String("p", "8080", "port number")
+	dir       = flag.String("d", ".", "directory to serve")
+	useTLS    = flag.Bool("tls", false, "serve HTTPS")
+	certFile  = flag.String("cert", "", "PEM file with the TLS certificate, self-signed if unset")
+	keyFile   = flag.String("key", "", "PEM file with the TLS key")
+	users     = flag.String("users", "", "comma-separated user:password pairs for basic authentication")
+	tokens    = flag.String("tokens", "", "comma-separated bearer tokens")
+	upload    = flag.Bool("upload", false, "allow PUT uploads")
+	maxUpload = flag.Int64("max-upload", 0, "maximum upload size in bytes, 0 for no limit")
 )
 
-var cacheHeaders = []string{
-	"ETag",
-	"If-Modified-Since",
-	"If-None-Match",
-	"If-Range",
-	"If-Unmodified-Since",
-}
-
-func maxAgeHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func main() {
+	flag.Parse()
 
-		for _, v := range cacheHeaders {
-			if r.Header.Get(v) != "" {
-				r.Header.Del(v)
+	s := &fileserver.Server{
+		Dir:           *dir,
+		Upload:        *upload,
+		MaxUploadSize: *maxUpload,
+		Users:         make(map[string]string),
+	}
+	if len(*users) > 0 {
+		for _, u := range strings.Split(*users, ",") {
+			i := strings.Index(u, ":")
+			if i < 0 {
+				log.Fatalf("User %q has no password, want USER:PASSWORD", u)
 			}
+			s.Users[u[:i]] = u[i+1:]
 		}
+	}
+	if len(*tokens) > 0 {
+		s.Tokens = strings.Split(*tokens, ",")
+	}
 
-		h.ServeHTTP(w, r)
-	})
-}
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(*host, *port),
+		Handler: s,
+	}
+	if !*useTLS {
+		log.Fatal(srv.ListenAndServe())
+	}
 
-func main() {
-	flag.Parse()
-	http.Handle("/", maxAgeHandler(http.FileServer(http.Dir(*dir))))
-	log.Fatal(http.ListenAndServe(net.JoinHostPort(*host, *port), nil))
+	config, err := fileserver.TLSConfig(*certFile, *keyFile, []string{*host, "localhost"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*certFile) == 0 {
+		log.Printf("Self-signed certificate public key pin: %s", fileserver.Pin(config.Certificates[0].Leaf))
+	}
+	srv.TLSConfig = config
+	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,327 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bls parses Boot Loader Specification Type #1 entries.
+//
+// Entries are drop-in files in /loader/entries/*.conf on the boot partition,
+// as written by systemd's kernel-install and used by systemd-boot and by
+// Fedora's GRUB blscfg command.
+//
+// See https://systemd.io/BOOT_LOADER_SPECIFICATION for the specification.
+package bls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// EntriesDirs are the directories, relative to a partition's root, that are
+// searched for entries.
+//
+// /boot/loader/entries is used when /boot is not a separate partition.
+var EntriesDirs = []string{
+	"loader/entries",
+	"boot/loader/entries",
+}
+
+// Entry is a single boot entry.
+//
+// Paths are as written in the entry, i.e. relative to the root of the
+// partition that holds the entry.
+type Entry struct {
+	// ID is the entry's file name without the .conf suffix.
+	ID string
+
+	// File is the entry's location on the host. It is set by
+	// ReadEntries.
+	File string
+
+	Title     string
+	Version   string
+	MachineID string
+	SortKey   string
+
+	Linux   string
+	Initrds []string
+
+	// Options is the kernel command line. Multiple options keys are
+	// joined with spaces.
+	Options string
+
+	DeviceTree string
+
+	// Architecture is the EFI architecture name the entry is for, e.g.
+	// x64 or aa64. Empty means any architecture.
+	Architecture string
+
+	// EFI is an EFI program to boot instead of Linux.
+	EFI string
+}
+
+// Name returns the title, falling back to the version and the ID.
+func (e *Entry) Name() string {
+	if len(e.Title) > 0 {
+		return e.Title
+	}
+	if len(e.Version) > 0 {
+		return e.Version
+	}
+	return e.ID
+}
+
+// ParseEntry parses the entry in r. id is the entry's file name without the
+// .conf suffix.
+func ParseEntry(r io.Reader, id string) (*Entry, error) {
+	e := &Entry{ID: id}
+	var options []string
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i > 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch key {
+		case "title":
+			e.Title = value
+		case "version":
+			e.Version = value
+		case "machine-id":
+			e.MachineID = value
+		case "sort-key":
+			e.SortKey = value
+		case "linux":
+			e.Linux = value
+		case "initrd":
+			e.Initrds = append(e.Initrds, value)
+		case "options":
+			options = append(options, value)
+		case "devicetree":
+			e.DeviceTree = value
+		case "architecture":
+			e.Architecture = strings.ToLower(value)
+		case "efi":
+			e.EFI = value
+		default:
+			// Fedora adds grub_users, grub_class and others that
+			// only make sense to GRUB.
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	e.Options = strings.Join(options, " ")
+	return e, nil
+}
+
+// ReadEntries parses all *.conf files in dir and returns them in boot menu
+// order.
+func ReadEntries(dir string) ([]*Entry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		e, err := ParseEntry(f, strings.TrimSuffix(filepath.Base(file), ".conf"))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		e.File = file
+		entries = append(entries, e)
+	}
+	Sort(entries)
+	return entries, nil
+}
+
+// Sort sorts entries in boot menu order.
+//
+// Entries with a sort-key come first, ordered by sort-key, then machine-id,
+// then newest version first. Remaining ties and entries without a sort-key
+// are ordered by ID, newest first.
+func Sort(entries []*Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (len(a.SortKey) > 0) != (len(b.SortKey) > 0) {
+			return len(a.SortKey) > 0
+		}
+		if len(a.SortKey) > 0 {
+			if c := VersionCompare(a.SortKey, b.SortKey); c != 0 {
+				return c < 0
+			}
+			if c := strings.Compare(a.MachineID, b.MachineID); c != 0 {
+				return c < 0
+			}
+			if c := VersionCompare(a.Version, b.Version); c != 0 {
+				return c > 0
+			}
+		}
+		return VersionCompare(a.ID, b.ID) > 0
+	})
+}
+
+// VersionCompare compares version strings like strverscmp(3): runs of
+// digits compare numerically, everything else byte-wise.
+func VersionCompare(a, b string) int {
+	for len(a) > 0 && len(b) > 0 {
+		da, db := isDigit(a[0]), isDigit(b[0])
+		if da != db {
+			// A number sorts after anything else.
+			if da {
+				return 1
+			}
+			return -1
+		}
+		var pa, pb string
+		if da {
+			pa, a = span(a, isDigit)
+			pb, b = span(b, isDigit)
+			pa, pb = strings.TrimLeft(pa, "0"), strings.TrimLeft(pb, "0")
+			if len(pa) != len(pb) {
+				if len(pa) < len(pb) {
+					return -1
+				}
+				return 1
+			}
+		} else {
+			notDigit := func(c byte) bool { return !isDigit(c) }
+			pa, a = span(a, notDigit)
+			pb, b = span(b, notDigit)
+		}
+		if c := strings.Compare(pa, pb); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// span splits s after the longest prefix for which f holds.
+func span(s string, f func(byte) bool) (string, string) {
+	i := 0
+	for i < len(s) && f(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// efiArch returns the architecture name of the running system as used in
+// entries.
+func efiArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "ia32"
+	case "arm64":
+		return "aa64"
+	case "arm":
+		return "arm"
+	}
+	return runtime.GOARCH
+}
+
+// Bootable returns whether the entry can be booted by kexec on this
+// architecture.
+func (e *Entry) Bootable() bool {
+	if len(e.Linux) == 0 {
+		return false
+	}
+	return len(e.Architecture) == 0 || e.Architecture == efiArch()
+}
+
+// ExpandOptions replaces $var and ${var} in the options with values from
+// vars, like GRUB does with $kernelopts. Unknown variables expand to the
+// empty string.
+func (e *Entry) ExpandOptions(vars map[string]string) string {
+	return strings.Join(strings.Fields(os.Expand(e.Options, func(v string) string {
+		return vars[v]
+	})), " ")
+}
+
+// OSImage returns a boot.OSImage for the entry. fsRoot is the directory at
+// which the entry's partition is mounted. vars are used to expand variables
+// in the options.
+//
+// Files are opened lazily, when the image is loaded.
+func (e *Entry) OSImage(fsRoot string, vars map[string]string) *boot.LinuxImage {
+	path := func(p string) string {
+		return filepath.Join(fsRoot, filepath.Clean("/"+p))
+	}
+
+	li := &boot.LinuxImage{
+		Name:    e.Name(),
+		Kernel:  uio.NewLazyFile(path(e.Linux)),
+		Cmdline: e.ExpandOptions(vars),
+	}
+	var initrds []io.ReaderAt
+	for _, i := range e.Initrds {
+		initrds = append(initrds, uio.NewLazyFile(path(i)))
+	}
+	if len(initrds) > 0 {
+		li.Initrd = boot.CatInitrds(initrds...)
+	}
+	if len(e.DeviceTree) > 0 {
+		li.DTB = uio.NewLazyFile(path(e.DeviceTree))
+	}
+	return li
+}
+
+// FindEntries returns the bootable entries on the partition mounted at
+// fsRoot, in boot menu order.
+func FindEntries(fsRoot string) ([]*Entry, error) {
+	var entries []*Entry
+	for _, dir := range EntriesDirs {
+		es, err := ReadEntries(filepath.Join(fsRoot, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			if e.Bootable() {
+				entries = append(entries, e)
+			}
+		}
+		if len(es) > 0 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// ScanEntries returns an OSImage for every bootable entry on the
+// partition mounted at fsRoot. vars are used to expand variables such as
+// $kernelopts in options, and may be nil.
+func ScanEntries(fsRoot string, vars map[string]string) ([]boot.OSImage, error) {
+	entries, err := FindEntries(fsRoot)
+	if err != nil {
+		return nil, err
+	}
+	var imgs []boot.OSImage
+	for _, e := range entries {
+		imgs = append(imgs, e.OSImage(fsRoot, vars))
+	}
+	return imgs, nil
+}
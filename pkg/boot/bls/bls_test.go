@@ -0,0 +1,178 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestParseEntry(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want *Entry
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: &Entry{ID: "id"},
+		},
+		{
+			name: "all keys",
+			in: `# comment
+title      Fedora 31
+version    5.3.7
+machine-id abc
+sort-key   fedora
+linux      /vmlinuz
+initrd     /ucode.img
+initrd     /initramfs.img
+options    root=/dev/sda1
+options    ro  quiet
+devicetree /board.dtb
+architecture X64
+efi        /EFI/fedora/shimx64.efi
+grub_users $grub_users
+`,
+			want: &Entry{
+				ID:           "id",
+				Title:        "Fedora 31",
+				Version:      "5.3.7",
+				MachineID:    "abc",
+				SortKey:      "fedora",
+				Linux:        "/vmlinuz",
+				Initrds:      []string{"/ucode.img", "/initramfs.img"},
+				Options:      "root=/dev/sda1 ro  quiet",
+				DeviceTree:   "/board.dtb",
+				Architecture: "x64",
+				EFI:          "/EFI/fedora/shimx64.efi",
+			},
+		},
+		{
+			name: "tabs and no value",
+			in:   "title\tT\nlinux\t\t/k\noptions\n",
+			want: &Entry{ID: "id", Title: "T", Linux: "/k"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEntry(strings.NewReader(tt.in), "id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"5.3.7", "5.3.7", 0},
+		{"5.10.0", "5.4.0", 1},
+		{"5.4.0", "5.10.0", -1},
+		{"5.4.0", "5.4", 1},
+		{"5.4.010", "5.4.9", 1},
+		{"a", "b", -1},
+		{"0-rescue", "5.3.7", -1},
+		{"5.3.7-301.fc31", "5.3.7-200.fc31", 1},
+		{"1a", "1.", 1},
+	} {
+		got := VersionCompare(tt.a, tt.b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("VersionCompare(%q, %q) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFindEntries(t *testing.T) {
+	for _, tt := range []struct {
+		root string
+		want []string
+	}{
+		{
+			root: "testdata/esp",
+			want: []string{
+				"6a9857a393724b7a981ebb5b8495b9ea-5.10.0-1",
+				"6a9857a393724b7a981ebb5b8495b9ea-5.4.0-1",
+				"arch",
+			},
+		},
+		{
+			root: "testdata/rootfs",
+			want: []string{"fedora-5.3.7"},
+		},
+		{
+			root: "testdata/doesnotexist",
+		},
+	} {
+		entries, err := FindEntries(tt.root)
+		if err != nil {
+			t.Fatalf("FindEntries(%s) = %v", tt.root, err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.ID)
+		}
+		if diff := deep.Equal(got, tt.want); diff != nil {
+			t.Errorf("FindEntries(%s): %v", tt.root, diff)
+		}
+	}
+}
+
+func TestScanEntries(t *testing.T) {
+	imgs, err := ScanEntries("testdata/esp", map[string]string{"extra": "console=ttyS0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const dir = "testdata/esp/6a9857a393724b7a981ebb5b8495b9ea"
+	want := []boot.OSImage{
+		&boot.LinuxImage{
+			Name:    "Debian GNU/Linux bullseye",
+			Kernel:  uio.NewLazyFile(dir + "/5.10.0-1/linux"),
+			Initrd:  boot.CatInitrds(uio.NewLazyFile(dir + "/5.10.0-1/initrd")),
+			Cmdline: "root=/dev/sda2",
+			DTB:     uio.NewLazyFile(dir + "/5.10.0-1/board.dtb"),
+		},
+		&boot.LinuxImage{
+			Name:    "Debian GNU/Linux bullseye",
+			Kernel:  uio.NewLazyFile(dir + "/5.4.0-1/linux"),
+			Initrd:  boot.CatInitrds(uio.NewLazyFile(dir + "/5.4.0-1/initrd")),
+			Cmdline: "root=/dev/sda2 console=ttyS0",
+		},
+		&boot.LinuxImage{
+			Name:   "Arch Linux",
+			Kernel: uio.NewLazyFile("testdata/esp/vmlinuz-linux"),
+			Initrd: boot.CatInitrds(
+				uio.NewLazyFile("testdata/esp/intel-ucode.img"),
+				uio.NewLazyFile("testdata/esp/initramfs-linux.img"),
+			),
+			Cmdline: "root=PARTUUID=4f68bce3-e8cd-4db1-96e7-fbcaf984b709 rw quiet",
+		},
+	}
+
+	if len(imgs) != len(want) {
+		t.Fatalf("ScanEntries() = %d images, want %d", len(imgs), len(want))
+	}
+	for i := range imgs {
+		if got, want := imgs[i].String(), want[i].String(); got != want {
+			t.Errorf("image %d = %s, want %s", i, got, want)
+		}
+	}
+	if dtb := imgs[0].(*boot.LinuxImage).DTB; dtb == nil || dtb.(fmt.Stringer).String() != dir+"/5.10.0-1/board.dtb" {
+		t.Errorf("image 0 DTB = %v, want %s", dtb, dir+"/5.10.0-1/board.dtb")
+	}
+}
@@ -6,14 +6,18 @@ package diskboot
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/bls"
+	grubscript "github.com/u-root/u-root/pkg/boot/grub"
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/cmdline"
 )
 
@@ -24,6 +28,10 @@ type Config struct {
 	ConfigPath   string
 	Entries      []Entry
 	DefaultEntry int
+
+	// Extracted is the file system the files in MountPath are fetched
+	// from, if it was read in userspace.
+	Extracted *Extracted
 }
 
 // EntryType dictates the method by which kexec should use to load
@@ -60,26 +68,45 @@ type Entry struct {
 	Name    string
 	Type    EntryType
 	Modules []Module
+
+	// DeviceTree is the path of the device tree of an Elf entry,
+	// relative to the mount path.
+	DeviceTree string
 }
 
 // KexecLoad calls the appropriate kexec load routines based on the
-// type of Entry
-func (e *Entry) KexecLoad(mountPath string, filterCmdline cmdline.Filter, dryrun bool) error {
+// type of Entry. Files are fetched from ex first, if it is not nil.
+func (e *Entry) KexecLoad(mountPath string, ex *Extracted, filterCmdline cmdline.Filter, dryrun bool) error {
 	switch e.Type {
 	case Multiboot:
-		// TODO: implement using kexec_load syscall
-		return syscall.ENOSYS
+		// e.Modules[0].Path is the multiboot kernel, e.g. Xen
+		// e.Modules[0].Params is its command line
+		// e.Modules[1:] are the modules, e.g. the dom0 kernel and initrd
+		if len(e.Modules) < 1 {
+			return fmt.Errorf("missing kernel")
+		}
+		entry := *e
+		entry.Modules = append([]Module{}, e.Modules...)
+		if filterCmdline != nil {
+			entry.Modules[0].Params = filterCmdline.Update(entry.Modules[0].Params)
+		}
+		img := entry.multibootImage(mountPath, ex)
+		log.Printf("Multiboot image: %s", img)
+		if !dryrun {
+			return img.Load(false)
+		}
 	case Elf:
 		// TODO: implement using kexec_file_load syscall
 		// e.Module[0].Path is kernel
 		// e.Module[0].Params is kernel parameters
-		// e.Module[1].Path is initrd
+		// e.Module[1:].Path are initrds
 		if len(e.Modules) < 1 {
 			return fmt.Errorf("missing kernel")
 		}
 		var ramfs *os.File
 		kernelPath := filepath.Join(mountPath, e.Modules[0].Path)
 		log.Print("Kernel Path:", kernelPath)
+		ex.Fetch(kernelPath)
 		kernel, err := os.OpenFile(kernelPath, os.O_RDONLY, 0)
 		commandline := e.Modules[0].Params
 		if filterCmdline != nil {
@@ -90,21 +117,152 @@ func (e *Entry) KexecLoad(mountPath string, filterCmdline cmdline.Filter, dryrun
 		if err != nil {
 			return fmt.Errorf("failed to load kernel: %v", err)
 		}
-		if len(e.Modules) > 1 {
-			ramfsPath := filepath.Join(mountPath, e.Modules[1].Path)
-			log.Print("Ramfs Path:", ramfsPath)
-			ramfs, err = os.OpenFile(ramfsPath, os.O_RDONLY, 0)
-			if err != nil {
-				return fmt.Errorf("failed to load ramfs: %v", err)
+		var dtb *os.File
+		if len(e.DeviceTree) > 0 {
+			dtbPath := filepath.Join(mountPath, e.DeviceTree)
+			log.Print("Device Tree Path:", dtbPath)
+			ex.Fetch(dtbPath)
+			if dtb, err = os.Open(dtbPath); err != nil {
+				return fmt.Errorf("failed to load device tree: %v", err)
 			}
 		}
-		if !dryrun {
-			return kexec.FileLoad(kernel, ramfs, commandline)
+		var ramfsPaths []string
+		for _, m := range e.Modules[1:] {
+			ramfsPath := filepath.Join(mountPath, m.Path)
+			log.Print("Ramfs Path:", ramfsPath)
+			ramfsPaths = append(ramfsPaths, ramfsPath)
+		}
+		ex.Fetch(ramfsPaths...)
+		if len(ramfsPaths) == 1 {
+			ramfs, err = os.OpenFile(ramfsPaths[0], os.O_RDONLY, 0)
+		} else if len(ramfsPaths) > 1 {
+			ramfs, err = concatFiles(ramfsPaths)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load ramfs: %v", err)
+		}
+		if dryrun {
+			return nil
 		}
+		if dtb != nil {
+			// kexec_file_load cannot pass a device tree.
+			li := &boot.LinuxImage{
+				Kernel:      kernel,
+				Cmdline:     commandline,
+				DTB:         dtb,
+				LoadSyscall: true,
+			}
+			if ramfs != nil {
+				li.Initrd = ramfs
+			}
+			return li.Load(false)
+		}
+		return kexec.FileLoad(kernel, ramfs, commandline)
 	}
 	return nil
 }
 
+// concatFiles copies files into a single temporary file. Linux unpacks
+// concatenated initramfs archives in order.
+func concatFiles(paths []string) (*os.File, error) {
+	f, err := ioutil.TempFile("", "diskboot-initrd")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		in, err := os.Open(p)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		_, err = io.Copy(f, in)
+		in.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	// kexec_file_load fails on files that are open for writing.
+	return os.Open(f.Name())
+}
+
+// multibootCmdline returns the command line of a multiboot kernel or module.
+//
+// Like syslinux's mboot.c32, command lines start with the file name. Xen
+// expects this from all boot loaders but GRUB 2, and strips it from its own
+// and the dom0 command line.
+func multibootCmdline(m Module) string {
+	if len(m.Params) == 0 {
+		return m.Path
+	}
+	return m.Path + " " + m.Params
+}
+
+// multibootImage returns a MultibootImage for a Multiboot entry, e.g. Xen with
+// the dom0 kernel and initrd as modules, with paths resolved against
+// mountPath and fetched from ex.
+func (e *Entry) multibootImage(mountPath string, ex *Extracted) *boot.MultibootImage {
+	var mods []multiboot.Module
+	for _, m := range e.Modules[1:] {
+		mods = append(mods, multiboot.Module{
+			Name:    m.Path,
+			CmdLine: multibootCmdline(m),
+			Module:  lazyFile(ex, filepath.Join(mountPath, m.Path)),
+		})
+	}
+	return &boot.MultibootImage{
+		Name:    e.Name,
+		Kernel:  lazyFile(ex, filepath.Join(mountPath, e.Modules[0].Path)),
+		Cmdline: multibootCmdline(e.Modules[0]),
+		Modules: mods,
+	}
+}
+
+// OSImages returns an OSImage for every entry, with paths resolved against
+// the mount path.
+//
+// Files are opened lazily, when the image is loaded. Files of devices read
+// in userspace are only extracted then, see Extracted.
+func (c *Config) OSImages() []boot.OSImage {
+	var imgs []boot.OSImage
+	for _, e := range c.Entries {
+		if len(e.Modules) == 0 {
+			continue
+		}
+		path := func(m Module) string {
+			return filepath.Join(c.MountPath, m.Path)
+		}
+
+		switch e.Type {
+		case Multiboot:
+			imgs = append(imgs, e.multibootImage(c.MountPath, c.Extracted))
+
+		case Elf:
+			li := &boot.LinuxImage{
+				Name:    e.Name,
+				Kernel:  lazyFile(c.Extracted, path(e.Modules[0])),
+				Cmdline: e.Modules[0].Params,
+			}
+			var initrds []io.ReaderAt
+			for _, m := range e.Modules[1:] {
+				initrds = append(initrds, lazyFile(c.Extracted, path(m)))
+			}
+			if len(initrds) > 0 {
+				li.Initrd = boot.CatInitrds(initrds...)
+			}
+			if len(e.DeviceTree) > 0 {
+				li.DTB = lazyFile(c.Extracted, filepath.Join(c.MountPath, e.DeviceTree))
+				li.LoadSyscall = true
+			}
+			imgs = append(imgs, li)
+		}
+	}
+	return imgs
+}
+
 type location struct {
 	Path string
 	Type parserState
@@ -130,8 +288,12 @@ var (
 
 // FindConfigs searching the path for valid boot configuration files
 // and returns a Config for each valid instance found.
-func FindConfigs(mountPath string) []*Config {
+//
+// devices are the mounted file systems that GRUB configurations may search
+// for, e.g. with search --fs-uuid.
+func FindConfigs(mountPath string, devices ...grubscript.Device) []*Config {
 	var configs []*Config
+	foundGrub := false
 
 	for _, location := range locations {
 		configPath := filepath.Join(mountPath, location.Path)
@@ -141,19 +303,120 @@ func FindConfigs(mountPath string) []*Config {
 			continue
 		}
 
-		var lines []string
-		if location.Type == syslinux {
-			lines = loadSyslinuxLines(configPath, contents)
-		} else {
-			lines = strings.Split(string(contents), "\n")
+		if location.Type == grub {
+			config, err := parseGrubConfig(mountPath, location.Path, devices)
+			if err != nil {
+				log.Printf("Failed to parse %s: %v", configPath, err)
+				continue
+			}
+			configs = append(configs, config)
+			foundGrub = true
+			continue
 		}
 
+		lines := loadSyslinuxLines(configPath, contents)
 		configs = append(configs, ParseConfig(mountPath, configPath, lines))
 	}
 
+	// GRUB configurations on systems using BLS entries include them
+	// with blscfg.
+	if !foundGrub {
+		config, err := parseBLSEntries(mountPath)
+		if err != nil {
+			log.Printf("Failed to read BLS entries in %s: %v", mountPath, err)
+		} else if config != nil {
+			configs = append(configs, config)
+		}
+	}
+
 	return configs
 }
 
+// parseBLSEntries converts the Boot Loader Specification entries in
+// mountPath into a Config. It returns nil if there are none.
+func parseBLSEntries(mountPath string) (*Config, error) {
+	entries, err := bls.FindEntries(mountPath)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	// Fedora's entries use $kernelopts from the GRUB environment.
+	vars := grubscript.FindEnvBlock(mountPath)
+	config := &Config{
+		MountPath:  mountPath,
+		ConfigPath: filepath.Dir(entries[0].File),
+	}
+	for _, e := range entries {
+		entry := Entry{
+			Name: e.Name(),
+			Type: Elf,
+			Modules: []Module{
+				{Path: e.Linux, Params: e.ExpandOptions(vars)},
+			},
+		}
+		for _, i := range e.Initrds {
+			entry.Modules = append(entry.Modules, Module{Path: i})
+		}
+		config.Entries = append(config.Entries, entry)
+	}
+	return config, nil
+}
+
+// parseGrubConfig evaluates the GRUB script at configPath relative to
+// mountPath, which may search devices, and converts its menu entries.
+func parseGrubConfig(mountPath, configPath string, devices []grubscript.Device) (*Config, error) {
+	root := grubscript.Device{Dir: mountPath}
+	for _, d := range devices {
+		if d.Dir == mountPath {
+			root = d
+		}
+	}
+	gc, err := grubscript.ParseConfigFile(root, configPath, devices)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entry paths are host paths, while diskboot modules are relative to
+	// the mount path. Files on other devices are reached through "..".
+	rel := func(p string) string {
+		r, err := filepath.Rel(mountPath, p)
+		if err != nil {
+			return p
+		}
+		if r == ".." || strings.HasPrefix(r, "../") {
+			return r
+		}
+		return filepath.Join("/", r)
+	}
+
+	config := &Config{
+		MountPath:    mountPath,
+		ConfigPath:   filepath.Join(mountPath, configPath),
+		DefaultEntry: gc.DefaultEntry,
+	}
+	for _, e := range gc.Entries {
+		entry := Entry{Name: e.Name()}
+		if len(e.Multiboot) > 0 {
+			entry.Type = Multiboot
+			entry.Modules = append(entry.Modules, Module{Path: rel(e.Multiboot), Params: e.Cmdline})
+			for _, m := range e.Modules {
+				entry.Modules = append(entry.Modules, Module{Path: rel(m.Path), Params: m.Cmdline})
+			}
+		} else {
+			entry.Type = Elf
+			entry.Modules = append(entry.Modules, Module{Path: rel(e.Kernel), Params: e.Cmdline})
+			for _, i := range e.Initrds {
+				entry.Modules = append(entry.Modules, Module{Path: rel(i)})
+			}
+			if len(e.DeviceTree) > 0 {
+				entry.DeviceTree = rel(e.DeviceTree)
+			}
+		}
+		config.Entries = append(config.Entries, entry)
+	}
+	return config, nil
+}
+
 func loadSyslinuxLines(configPath string, contents []byte) []string {
 	// TODO: just parse includes inline with syslinux specific parser
 	var newLines, includeLines []string
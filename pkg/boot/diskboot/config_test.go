@@ -7,11 +7,15 @@ package diskboot
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot"
+	grubscript "github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/uio"
 )
 
 func TestParseEmpty(t *testing.T) {
@@ -51,3 +55,98 @@ func TestConfigs(t *testing.T) {
 		}
 	}
 }
+
+func TestOSImages(t *testing.T) {
+	configs := FindConfigs("testdata/fedora-31-boot")
+	if len(configs) != 1 {
+		t.Fatalf("FindConfigs() = %d configs, want 1", len(configs))
+	}
+	imgs := configs[0].OSImages()
+	if len(imgs) != 3 {
+		t.Fatalf("OSImages() = %d images, want 3", len(imgs))
+	}
+	li, ok := imgs[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("OSImages()[0] = %T, want *boot.LinuxImage", imgs[0])
+	}
+	want := &boot.LinuxImage{
+		Name:   "Fedora (5.4.13-201.fc31.x86_64) 31 (Thirty One)",
+		Kernel: uio.NewLazyFile("testdata/fedora-31-boot/vmlinuz-5.4.13-201.fc31.x86_64"),
+		Initrd: boot.CatInitrds(
+			uio.NewLazyFile("testdata/fedora-31-boot/intel-ucode.img"),
+			uio.NewLazyFile("testdata/fedora-31-boot/initramfs-5.4.13-201.fc31.x86_64.img"),
+		),
+		Cmdline: configs[0].Entries[0].Modules[0].Params,
+	}
+	if li.String() != want.String() {
+		t.Errorf("OSImages()[0] = %s, want %s", li, want)
+	}
+}
+
+func TestGrubSearchDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The GRUB configuration on sda1 boots the kernel on sda2.
+	esp, root := filepath.Join(dir, "sda1"), filepath.Join(dir, "sda2")
+	if err := os.MkdirAll(filepath.Join(esp, "boot/grub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := "search --fs-uuid --set=root 1234-abcd\nmenuentry Linux {\n\tlinux /vmlinuz quiet\n\tdevicetree /board.dtb\n}\n"
+	if err := ioutil.WriteFile(filepath.Join(esp, "boot/grub/grub.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := FindConfigs(esp,
+		grubscript.Device{Name: "sda1", Dir: esp},
+		grubscript.Device{Name: "sda2", Dir: root, FSUUID: "1234-abcd"})
+	if len(configs) != 1 || len(configs[0].Entries) != 1 {
+		t.Fatalf("FindConfigs() = %v, want 1 config with 1 entry", configs)
+	}
+	e := configs[0].Entries[0]
+	if want := (Module{Path: "../sda2/vmlinuz", Params: "quiet"}); len(e.Modules) != 1 || e.Modules[0] != want {
+		t.Errorf("Modules = %v, want [%v]", e.Modules, want)
+	}
+	if want := "../sda2/board.dtb"; e.DeviceTree != want {
+		t.Errorf("DeviceTree = %q, want %q", e.DeviceTree, want)
+	}
+
+	li, ok := configs[0].OSImages()[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("OSImages()[0] = %T, want *boot.LinuxImage", configs[0].OSImages()[0])
+	}
+	if got, want := li.Kernel.(*uio.LazyOpenerAt).String(), filepath.Join(root, "vmlinuz"); got != want {
+		t.Errorf("Kernel = %s, want %s", got, want)
+	}
+	if li.DTB == nil || !li.LoadSyscall {
+		t.Errorf("DTB = %v, LoadSyscall = %v, want a device tree loaded with kexec_load", li.DTB, li.LoadSyscall)
+	}
+}
+
+func TestMultibootImage(t *testing.T) {
+	e := &Entry{
+		Name: "Xen",
+		Type: Multiboot,
+		Modules: []Module{
+			{Path: "/xen.gz", Params: "dom0_mem=1G"},
+			{Path: "/vmlinuz", Params: "console=hvc0"},
+			{Path: "/initrd.img"},
+		},
+	}
+	mi := e.multibootImage("/mnt", nil)
+	if want := "/xen.gz dom0_mem=1G"; mi.Cmdline != want {
+		t.Errorf("Cmdline = %q, want %q", mi.Cmdline, want)
+	}
+	var got []string
+	for _, m := range mi.Modules {
+		got = append(got, m.CmdLine)
+	}
+	if diff := deep.Equal(got, []string{"/vmlinuz console=hvc0", "/initrd.img"}); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -7,8 +7,11 @@ package diskboot
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 
+	grubscript "github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/fsprobe"
 	"github.com/u-root/u-root/pkg/mount"
 )
 
@@ -16,6 +19,11 @@ import (
 type Device struct {
 	*mount.MountPoint
 	Configs []*Config
+
+	// Extracted is the file system read in userspace, if the device
+	// could not be mounted. It must be closed when the device is no
+	// longer used.
+	Extracted *Extracted
 }
 
 // fstypes returns all block file system supported by the linuxboot kernel
@@ -27,36 +35,41 @@ type Device struct {
  * which mounts the device as read only.
  */
 func FindDevicesRW(devicesGlob string) (devices []*Device) {
-	sysList, err := filepath.Glob(devicesGlob)
-	if err != nil {
-		return nil
-	}
-	// The Linux /sys file system is a bit, er, awkward. You can't find
-	// the device special in there; just everything else.
-	for _, sys := range sysList {
-		blk := filepath.Join("/dev", filepath.Base(sys))
-
-		dev, _ := FindDevice(blk, 0)
-		if dev != nil && len(dev.Configs) > 0 {
-			devices = append(devices, dev)
-		}
-	}
-	return devices
+	return findDevices(devicesGlob, 0)
 }
 
 // FindDevices searches for devices with bootable configs
 func FindDevices(devicesGlob string) (devices []*Device) {
+	return findDevices(devicesGlob, mount.MS_RDONLY)
+}
+
+// findDevices mounts all devices matching devicesGlob and returns those with
+// bootable configs. GRUB configurations may search all of them.
+func findDevices(devicesGlob string, flags uintptr) (devices []*Device) {
 	sysList, err := filepath.Glob(devicesGlob)
 	if err != nil {
 		return nil
 	}
+	var (
+		mounted     []*Device
+		grubDevices []grubscript.Device
+	)
 	// The Linux /sys file system is a bit, er, awkward. You can't find
 	// the device special in there; just everything else.
 	for _, sys := range sysList {
 		blk := filepath.Join("/dev", filepath.Base(sys))
 
-		dev, _ := FindDevice(blk, mount.MS_RDONLY)
-		if dev != nil && len(dev.Configs) > 0 {
+		dev, err := mountDevice(blk, flags)
+		if err != nil {
+			continue
+		}
+		mounted = append(mounted, dev)
+		grubDevices = append(grubDevices, grubDevice(blk, dev.Path))
+	}
+	for _, dev := range mounted {
+		// Devices without configs stay mounted, as other devices'
+		// configs may boot files from them.
+		if dev.findConfigs(grubDevices...) {
 			devices = append(devices, dev)
 		}
 	}
@@ -65,21 +78,62 @@ func FindDevices(devicesGlob string) (devices []*Device) {
 
 // FindDevice attempts to construct a boot device at the given path
 func FindDevice(devPath string, flags uintptr) (*Device, error) {
+	dev, err := mountDevice(devPath, flags)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.findConfigs() {
+		return nil, fmt.Errorf("no configs on %s", devPath)
+	}
+	return dev, nil
+}
+
+// mountDevice mounts devPath in a new directory, or extracts its boot
+// configurations there if it cannot be mounted.
+func mountDevice(devPath string, flags uintptr) (*Device, error) {
 	mountPath, err := ioutil.TempDir("/tmp", "boot-")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tmp mount directory: %v", err)
 	}
+	var ex *Extracted
 	mp, err := mount.TryMount(devPath, mountPath, flags)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find a valid boot device: %v", err)
+		// Without a kernel driver, ext4 boot files are read in
+		// userspace.
+		var eerr error
+		if mp, ex, eerr = ExtractDevice(devPath, mountPath); eerr != nil {
+			return nil, fmt.Errorf("failed to find a valid boot device: %v", err)
+		}
 	}
-	configs := FindConfigs(mountPath)
-	if len(configs) == 0 {
-		return nil, fmt.Errorf("no configs on %s", devPath)
+	return &Device{MountPoint: mp, Extracted: ex}, nil
+}
+
+// findConfigs sets the configs of d, whose GRUB configurations may search
+// devices. If there are none, it closes d.Extracted and returns false.
+func (d *Device) findConfigs(devices ...grubscript.Device) bool {
+	d.Configs = FindConfigs(d.Path, devices...)
+	if len(d.Configs) == 0 {
+		d.Extracted.Close()
+		return false
+	}
+	for _, c := range d.Configs {
+		c.Extracted = d.Extracted
 	}
+	return true
+}
 
-	return &Device{
-		MountPoint: mp,
-		Configs:    configs,
-	}, nil
+// grubDevice describes the device at devPath, mounted at dir, for GRUB's
+// search command.
+func grubDevice(devPath, dir string) grubscript.Device {
+	d := grubscript.Device{Name: filepath.Base(devPath), Dir: dir}
+	f, err := os.Open(devPath)
+	if err != nil {
+		return d
+	}
+	defer f.Close()
+	if info, err := fsprobe.Probe(f); err == nil {
+		d.FSUUID = info.UUID
+		d.Label = info.Label
+	}
+	return d
 }
@@ -0,0 +1,156 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskboot
+
+import (
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/u-root/u-root/pkg/boot/bls"
+	grubscript "github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/ext4"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// MaxConfigSize is the size above which files are not extracted with boot
+// configurations, e.g. GRUB fonts, kernels and initrds.
+const MaxConfigSize = 1 << 20
+
+// Extracted is a file system read in userspace by ExtractDevice.
+//
+// Its device stays open so that Fetch can copy the files that are booted,
+// until Close is called once they are loaded or no longer wanted. A nil
+// *Extracted fetches nothing.
+type Extracted struct {
+	// Dir is the directory the files are extracted to.
+	Dir string
+
+	mu   sync.Mutex
+	fsys *ext4.FS
+	dev  io.Closer
+}
+
+// ExtractDevice mounts a tmpfs at mountPath and copies the boot
+// configurations on the ext2, ext3 or ext4 file system on devPath to it,
+// see ExtractConfigs. Fetch on the returned Extracted copies the files they
+// boot.
+//
+// It is for kernels that cannot mount the file system, like LinuxBoot
+// kernels built without ext4.
+func ExtractDevice(devPath, mountPath string, names ...string) (*mount.MountPoint, *Extracted, error) {
+	f, err := os.Open(devPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsys, err := ext4.Open(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	mp, err := mount.Mount(devPath, mountPath, "tmpfs", "", 0)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	ExtractConfigs(fsys, mountPath, names...)
+	return mp, &Extracted{Dir: mountPath, fsys: fsys, dev: f}, nil
+}
+
+// Fetch copies the files at paths that are in e.Dir, like kernels and
+// initrds, from the file system. Other paths are ignored, as are all paths
+// after Close.
+func (e *Extracted) Fetch(paths ...string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fsys == nil {
+		return
+	}
+	for _, p := range paths {
+		rel, err := filepath.Rel(e.Dir, p)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if err := e.fsys.Extract(e.Dir, rel, 0); err != nil {
+			log.Printf("Failed to extract %s: %v", p, err)
+		}
+	}
+}
+
+// Close closes the device. The files extracted so far stay in e.Dir.
+func (e *Extracted) Close() error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dev == nil {
+		return nil
+	}
+	err := e.dev.Close()
+	e.fsys, e.dev = nil, nil
+	return err
+}
+
+// ExtractConfigs copies the files FindConfigs reads from fsys to dir: GRUB
+// and syslinux configurations with the files next to them, BLS entries and
+// GRUB environment blocks. The files or trees names are copied too. Files
+// larger than MaxConfigSize are skipped.
+func ExtractConfigs(fsys *ext4.FS, dir string, names ...string) {
+	extract := func(name string) {
+		if err := fsys.Extract(dir, name, MaxConfigSize); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to extract %s: %v", name, err)
+		}
+	}
+	// extractFiles extracts the files, but not the directories, in
+	// the directory name. GRUB and syslinux configurations include
+	// files next to them.
+	extractFiles := func(name string) {
+		fis, err := fsys.ReadDir(name)
+		if err != nil {
+			return
+		}
+		for _, fi := range fis {
+			n := path.Join(name, fi.Name())
+			if fi, err := fsys.Stat(n); err == nil && !fi.IsDir() {
+				extract(n)
+			}
+		}
+	}
+
+	for _, l := range locations {
+		if d := path.Dir(l.Path); d != "." {
+			extractFiles(d)
+		} else {
+			extract(l.Path)
+		}
+	}
+	for _, d := range bls.EntriesDirs {
+		extractFiles(d)
+	}
+	for _, l := range grubscript.EnvBlockLocations {
+		extract(l)
+	}
+	for _, name := range names {
+		extract(name)
+	}
+}
+
+// lazyFile returns a lazy ReaderAt opened from path, which is fetched from
+// e first.
+func lazyFile(e *Extracted, path string) *uio.LazyOpenerAt {
+	return uio.NewLazyOpenerAt(path, func() (io.ReaderAt, error) {
+		e.Fetch(path)
+		return os.Open(path)
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/ext4"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestExtractConfigs(t *testing.T) {
+	// ext4-boot.img has boot/grub/grub.cfg, the kernel and initrd of its
+	// entry, a 2MiB boot/grub/unicode.pf2 and an unused boot/other.
+	f, err := os.Open("testdata/ext4-boot.img.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := ext4.Open(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "diskboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ExtractConfigs(fsys, dir)
+	ex := &Extracted{Dir: dir, fsys: fsys, dev: ioutil.NopCloser(nil)}
+
+	exists := func(names ...string) {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Extracted %s: got %v, want nil", name, err)
+			}
+		}
+	}
+	notExists := func(names ...string) {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("Extracted %s: got %v, want not to exist", name, err)
+			}
+		}
+	}
+	exists("boot/grub/grub.cfg")
+	notExists("boot/grub/unicode.pf2", "boot/vmlinuz", "boot/initrd.img", "boot/other")
+
+	configs := FindConfigs(dir)
+	if len(configs) != 1 || len(configs[0].Entries) != 1 {
+		t.Fatalf("FindConfigs() = %v, want 1 config with 1 entry", configs)
+	}
+	want := []Module{
+		{Path: "/boot/vmlinuz", Params: "console=ttyS0"},
+		{Path: "/boot/initrd.img"},
+	}
+	if got := configs[0].Entries[0].Modules; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Modules = %v, want %v", got, want)
+	}
+
+	// The kernel and initrd are only extracted when they are read.
+	configs[0].Extracted = ex
+	li, ok := configs[0].OSImages()[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("OSImages()[0] = %T, want *boot.LinuxImage", configs[0].OSImages()[0])
+	}
+	notExists("boot/vmlinuz", "boot/initrd.img")
+	for _, r := range []io.ReaderAt{li.Kernel, li.Initrd} {
+		if _, err := ioutil.ReadAll(uio.Reader(r)); err != nil {
+			t.Errorf("Reading %v: got %v, want nil", r, err)
+		}
+	}
+	exists("boot/vmlinuz", "boot/initrd.img")
+	notExists("boot/other")
+
+	// Nothing is fetched once the file system is closed.
+	if err := ex.Close(); err != nil {
+		t.Errorf("Close() = %v, want nil", err)
+	}
+	ex.Fetch(filepath.Join(dir, "boot/other"))
+	notExists("boot/other")
+}
@@ -0,0 +1,421 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fit boots U-Boot Flattened Image Tree (FIT) images.
+//
+// A FIT image is a device tree with the kernel, ramdisks and device trees as
+// subnodes of /images, and /configurations selecting which of them to boot
+// together. Image data is either embedded in a data property or stored after
+// the device tree and referenced with data-offset or data-position.
+//
+// Hashes of the images are verified before they are used. Signatures are
+// not.
+//
+// See https://gitlab.denx.de/u-boot/u-boot/-/blob/master/doc/uImage.FIT/source_file_format.txt.
+package fit
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/dt"
+)
+
+// FIT is a parsed FIT image.
+type FIT struct {
+	fdt *dt.FDT
+
+	// r is the whole file, for external data.
+	r io.ReaderAt
+}
+
+// Config is one entry of /configurations.
+type Config struct {
+	Name        string
+	Description string
+
+	// Kernel, Ramdisk and FDT name the images used, Ramdisk and FDT may
+	// be empty.
+	Kernel  string
+	Ramdisk string
+	FDT     string
+}
+
+// Parse parses the FIT image in r.
+func Parse(r io.ReaderAt) (*FIT, error) {
+	fdt, err := dt.ReadFDT(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fdt.RootNode.Child("images"); !ok {
+		return nil, errors.New("not a FIT image: no /images node")
+	}
+	return &FIT{fdt: fdt, r: r}, nil
+}
+
+func stringProperty(n *dt.Node, name string) string {
+	p, ok := n.LookProperty(name)
+	if !ok {
+		return ""
+	}
+	s, err := p.AsString()
+	if err != nil {
+		// Lists like fdt = "base", "overlay" keep their first entry
+		// here, see Config.
+		if l, err := p.AsStringList(); err == nil && len(l) > 0 {
+			return l[0]
+		}
+	}
+	return s
+}
+
+// Description returns the description of the FIT image.
+func (f *FIT) Description() string {
+	return stringProperty(f.fdt.RootNode, "description")
+}
+
+// DefaultConfig returns the name of the default configuration.
+func (f *FIT) DefaultConfig() string {
+	n, ok := f.fdt.RootNode.Child("configurations")
+	if !ok {
+		return ""
+	}
+	return stringProperty(n, "default")
+}
+
+// Configs returns the names of all configurations.
+func (f *FIT) Configs() []string {
+	n, ok := f.fdt.RootNode.Child("configurations")
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, c := range n.Children {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// Config returns the named configuration, or the default one if name is
+// empty.
+func (f *FIT) Config(name string) (*Config, error) {
+	if len(name) == 0 {
+		if name = f.DefaultConfig(); len(name) == 0 {
+			// Without a default, U-Boot uses the first one.
+			configs := f.Configs()
+			if len(configs) == 0 {
+				return nil, errors.New("no configurations")
+			}
+			name = configs[0]
+		}
+	}
+	n, ok := f.fdt.RootNode.Lookup("/configurations/" + name)
+	if !ok {
+		return nil, fmt.Errorf("no configuration %q", name)
+	}
+	if p, ok := n.LookProperty("fdt"); ok {
+		if l, err := p.AsStringList(); err == nil && len(l) > 1 {
+			return nil, fmt.Errorf("configuration %q: device tree overlays are not supported", name)
+		}
+	}
+	c := &Config{
+		Name:        name,
+		Description: stringProperty(n, "description"),
+		Kernel:      stringProperty(n, "kernel"),
+		Ramdisk:     stringProperty(n, "ramdisk"),
+		FDT:         stringProperty(n, "fdt"),
+	}
+	if len(c.Kernel) == 0 {
+		return nil, fmt.Errorf("configuration %q has no kernel", name)
+	}
+	return c, nil
+}
+
+// image returns the /images subnode with the given name.
+func (f *FIT) image(name string) (*dt.Node, error) {
+	n, ok := f.fdt.RootNode.Lookup("/images/" + name)
+	if !ok {
+		return nil, fmt.Errorf("no image %q", name)
+	}
+	return n, nil
+}
+
+func u32Property(n *dt.Node, name string) (uint32, bool, error) {
+	p, ok := n.LookProperty(name)
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := p.AsU32()
+	return v, true, err
+}
+
+// rawData returns the data of image n as stored in the FIT.
+func (f *FIT) rawData(n *dt.Node) ([]byte, error) {
+	if p, ok := n.LookProperty("data"); ok {
+		return p.Value, nil
+	}
+
+	size, ok, err := u32Property(n, "data-size")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("no data")
+	}
+	var off int64
+	if pos, ok, err := u32Property(n, "data-position"); err != nil {
+		return nil, err
+	} else if ok {
+		off = int64(pos)
+	} else if o, ok, err := u32Property(n, "data-offset"); err != nil {
+		return nil, err
+	} else if ok {
+		// data-offset is relative to the end of the device tree,
+		// aligned to 4 bytes.
+		off = int64((f.fdt.Header.TotalSize+3)&^3) + int64(o)
+	} else {
+		return nil, errors.New("data-size without data-offset or data-position")
+	}
+
+	// size comes from the image, so check the FIT is that large before
+	// allocating it.
+	if size > 0 {
+		if _, err := f.r.ReadAt(make([]byte, 1), off+int64(size)-1); err != nil {
+			return nil, fmt.Errorf("external data of %d bytes at %d is past the end of the image", size, off)
+		}
+	}
+	d := make([]byte, size)
+	if _, err := f.r.ReadAt(d, off); err != nil {
+		return nil, fmt.Errorf("reading external data: %v", err)
+	}
+	return d, nil
+}
+
+var hashes = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// verify checks d against all hash subnodes of image n.
+func verify(n *dt.Node, d []byte) error {
+	for _, h := range n.Children {
+		if !strings.HasPrefix(h.Name, "hash") {
+			continue
+		}
+		algo := stringProperty(h, "algo")
+		newHash, ok := hashes[algo]
+		if !ok {
+			return fmt.Errorf("%s: unsupported hash algorithm %q", h.Name, algo)
+		}
+		want, ok := h.LookProperty("value")
+		if !ok {
+			return fmt.Errorf("%s: no value", h.Name)
+		}
+		hh := newHash()
+		hh.Write(d)
+		if got := hh.Sum(nil); !bytes.Equal(got, want.Value) {
+			return fmt.Errorf("%s: %s is %x, want %x", h.Name, algo, got, want.Value)
+		}
+	}
+	return nil
+}
+
+// decompress returns d uncompressed according to the compression property of
+// image n.
+func decompress(n *dt.Node, d []byte) ([]byte, error) {
+	var r io.Reader
+	switch c := stringProperty(n, "compression"); c {
+	case "", "none":
+		return d, nil
+	case "gzip":
+		z, err := gzip.NewReader(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		r = z
+	case "bzip2":
+		r = bzip2.NewReader(bytes.NewReader(d))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// ImageData returns the verified and uncompressed data of the named image.
+func (f *FIT) ImageData(name string) ([]byte, error) {
+	n, err := f.image(name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := f.rawData(n)
+	if err != nil {
+		return nil, fmt.Errorf("image %q: %v", name, err)
+	}
+	if err := verify(n, d); err != nil {
+		return nil, fmt.Errorf("image %q: %v", name, err)
+	}
+	if d, err = decompress(n, d); err != nil {
+		return nil, fmt.Errorf("image %q: %v", name, err)
+	}
+	return d, nil
+}
+
+// ImageType returns the type property of the named image, e.g. "kernel",
+// "ramdisk" or "flat_dt".
+func (f *FIT) ImageType(name string) string {
+	n, err := f.image(name)
+	if err != nil {
+		return ""
+	}
+	return stringProperty(n, "type")
+}
+
+// LinuxImage returns a LinuxImage for the kernel, ramdisk and device tree of
+// configuration c, loaded with kexec_load so that the device tree is used.
+func (f *FIT) LinuxImage(c *Config) (*boot.LinuxImage, error) {
+	switch typ := f.ImageType(c.Kernel); typ {
+	case "kernel", "kernel_noload":
+	default:
+		return nil, fmt.Errorf("image %q has type %q, want kernel", c.Kernel, typ)
+	}
+	kernel, err := f.ImageData(c.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	li := &boot.LinuxImage{
+		Name:        c.Description,
+		Kernel:      bytes.NewReader(kernel),
+		LoadSyscall: true,
+	}
+	if len(c.Ramdisk) > 0 {
+		ramdisk, err := f.ImageData(c.Ramdisk)
+		if err != nil {
+			return nil, err
+		}
+		li.Initrd = bytes.NewReader(ramdisk)
+	}
+	if len(c.FDT) > 0 {
+		fdt, err := f.ImageData(c.FDT)
+		if err != nil {
+			return nil, err
+		}
+		li.DTB = bytes.NewReader(fdt)
+	}
+	return li, nil
+}
+
+// Image is a FIT image OSImage.
+type Image struct {
+	// Name is the menu label.
+	Name string
+
+	// File is the FIT image.
+	File io.ReaderAt
+
+	// Config is the configuration to boot. If empty, the default
+	// configuration is booted.
+	Config string
+
+	// Cmdline is the kernel command line.
+	Cmdline string
+}
+
+var _ boot.OSImage = &Image{}
+
+// Label returns either the Name or a short description.
+func (i *Image) Label() string {
+	if len(i.Name) > 0 {
+		return i.Name
+	}
+	if len(i.Config) > 0 {
+		return fmt.Sprintf("FIT(%s, config=%s)", i.File, i.Config)
+	}
+	return fmt.Sprintf("FIT(%s)", i.File)
+}
+
+// String implements fmt.Stringer.
+func (i *Image) String() string {
+	return fmt.Sprintf("FIT(\n  Name: %s\n  File: %s\n  Config: %s\n  Cmdline: %s\n)\n", i.Name, i.File, i.Config, i.Cmdline)
+}
+
+// LinuxImage returns a LinuxImage for the configuration.
+func (i *Image) LinuxImage() (*boot.LinuxImage, error) {
+	f, err := Parse(i.File)
+	if err != nil {
+		return nil, err
+	}
+	c, err := f.Config(i.Config)
+	if err != nil {
+		return nil, err
+	}
+	li, err := f.LinuxImage(c)
+	if err != nil {
+		return nil, err
+	}
+	li.Name = i.Label()
+	li.Cmdline = i.Cmdline
+	return li, nil
+}
+
+// Load implements OSImage.Load.
+func (i *Image) Load(verbose bool) error {
+	li, err := i.LinuxImage()
+	if err != nil {
+		return fmt.Errorf("%s: %v", i.File, err)
+	}
+	return li.Load(verbose)
+}
+
+// Images returns an Image for every configuration of the FIT image in r,
+// named by their descriptions. The default configuration comes first.
+func Images(r io.ReaderAt) ([]*Image, error) {
+	f, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	def := f.DefaultConfig()
+	var imgs []*Image
+	for _, name := range f.Configs() {
+		c, err := f.Config(name)
+		if err != nil {
+			Debug("Skipping configuration %q: %v", name, err)
+			continue
+		}
+		img := &Image{
+			Name:   c.Description,
+			File:   r,
+			Config: name,
+		}
+		if len(img.Name) == 0 {
+			img.Name = fmt.Sprintf("%s (%s)", f.Description(), name)
+		}
+		if name == def {
+			imgs = append([]*Image{img}, imgs...)
+		} else {
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+// Debug logs configurations that are skipped.
+var Debug = func(string, ...interface{}) {}
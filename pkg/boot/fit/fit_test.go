@@ -0,0 +1,303 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/dt"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+var (
+	kernelData  = []byte("arm64 kernel")
+	ramdiskData = []byte("070701 cpio")
+	fdtData     = []byte("device tree")
+)
+
+func node(name string, props []dt.Property, children ...*dt.Node) *dt.Node {
+	return &dt.Node{Name: name, Properties: props, Children: children}
+}
+
+func sha256Node(d []byte) *dt.Node {
+	sum := sha256.Sum256(d)
+	return node("hash-1", []dt.Property{
+		dt.PropertyString("algo", "sha256"),
+		{Name: "value", Value: sum[:]},
+	})
+}
+
+func crc32Node(d []byte) *dt.Node {
+	return node("hash-2", []dt.Property{
+		dt.PropertyString("algo", "crc32"),
+		dt.PropertyU32("value", crc32.ChecksumIEEE(d)),
+	})
+}
+
+func gzipped(b []byte) []byte {
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	w.Write(b)
+	w.Close()
+	return z.Bytes()
+}
+
+// buildFIT returns a FIT image with the given images and configurations, and
+// external appended after the device tree.
+func buildFIT(t *testing.T, images, configs *dt.Node, external []byte) []byte {
+	t.Helper()
+	fdt := &dt.FDT{
+		Header: dt.Header{
+			Magic:           dt.Magic,
+			Version:         17,
+			LastCompVersion: 16,
+		},
+		RootNode: node("", []dt.Property{
+			dt.PropertyString("description", "test FIT"),
+		}, images, configs),
+	}
+	var b bytes.Buffer
+	if _, err := fdt.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+	b.Write(external)
+	return b.Bytes()
+}
+
+func testImages() *dt.Node {
+	z := gzipped(kernelData)
+	return node("images", nil,
+		node("kernel-1", []dt.Property{
+			dt.PropertyString("type", "kernel"),
+			dt.PropertyString("arch", "arm64"),
+			dt.PropertyString("compression", "gzip"),
+			{Name: "data", Value: z},
+		}, sha256Node(z), crc32Node(z)),
+		node("ramdisk-1", []dt.Property{
+			dt.PropertyString("type", "ramdisk"),
+			dt.PropertyString("compression", "none"),
+			dt.PropertyU32("data-size", uint32(len(ramdiskData))),
+			dt.PropertyU32("data-offset", 0),
+		}, sha256Node(ramdiskData)),
+		node("fdt-1", []dt.Property{
+			dt.PropertyString("type", "flat_dt"),
+			dt.PropertyU32("data-size", uint32(len(fdtData))),
+			dt.PropertyU32("data-offset", uint32(len(ramdiskData))),
+		}, crc32Node(fdtData)),
+		node("fdt-bad", []dt.Property{
+			dt.PropertyString("type", "flat_dt"),
+			{Name: "data", Value: fdtData},
+		}, crc32Node([]byte("something else"))),
+	)
+}
+
+func testConfigs() *dt.Node {
+	return node("configurations", []dt.Property{
+		dt.PropertyString("default", "conf-2"),
+	},
+		node("conf-1", []dt.Property{
+			dt.PropertyString("kernel", "kernel-1"),
+		}),
+		node("conf-2", []dt.Property{
+			dt.PropertyString("description", "Linux with ramdisk"),
+			dt.PropertyString("kernel", "kernel-1"),
+			dt.PropertyString("ramdisk", "ramdisk-1"),
+			dt.PropertyString("fdt", "fdt-1"),
+		}),
+		node("conf-bad-hash", []dt.Property{
+			dt.PropertyString("kernel", "kernel-1"),
+			dt.PropertyString("fdt", "fdt-bad"),
+		}),
+		node("conf-overlay", []dt.Property{
+			dt.PropertyString("kernel", "kernel-1"),
+			{Name: "fdt", Value: []byte("fdt-1\x00overlay-1\x00")},
+		}),
+		node("conf-ramdisk-kernel", []dt.Property{
+			dt.PropertyString("kernel", "ramdisk-1"),
+		}),
+	)
+}
+
+func readAll(t *testing.T, r interface{}) []byte {
+	t.Helper()
+	if r == nil {
+		return nil
+	}
+	d, err := ioutil.ReadAll(uio.Reader(r.(interface {
+		ReadAt([]byte, int64) (int, error)
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestLinuxImage(t *testing.T) {
+	fit := bytes.NewReader(buildFIT(t, testImages(), testConfigs(), append(ramdiskData, fdtData...)))
+
+	for _, tt := range []struct {
+		config  string
+		name    string
+		ramdisk []byte
+		fdt     []byte
+		err     string
+	}{
+		{
+			config:  "",
+			name:    "Linux with ramdisk",
+			ramdisk: ramdiskData,
+			fdt:     fdtData,
+		},
+		{
+			config: "conf-1",
+			name:   "kernel only",
+		},
+		{
+			config: "conf-bad-hash",
+			err:    `image "fdt-bad": hash-2: crc32 is`,
+		},
+		{
+			config: "conf-overlay",
+			err:    "overlays are not supported",
+		},
+		{
+			config: "conf-ramdisk-kernel",
+			err:    `image "ramdisk-1" has type "ramdisk", want kernel`,
+		},
+		{
+			config: "conf-missing",
+			err:    `no configuration "conf-missing"`,
+		},
+	} {
+		t.Run(tt.config, func(t *testing.T) {
+			img := &Image{
+				Name:    tt.name,
+				File:    fit,
+				Config:  tt.config,
+				Cmdline: "console=ttyAMA0",
+			}
+			li, err := img.LinuxImage()
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("LinuxImage() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LinuxImage() = %v", err)
+			}
+			if li.Name != tt.name || li.Cmdline != "console=ttyAMA0" || !li.LoadSyscall {
+				t.Errorf("LinuxImage() = %v, want name %q, cmdline console=ttyAMA0 and LoadSyscall", li, tt.name)
+			}
+			if got := readAll(t, li.Kernel); !bytes.Equal(got, kernelData) {
+				t.Errorf("kernel = %q, want %q", got, kernelData)
+			}
+			if li.Initrd == nil && tt.ramdisk != nil {
+				t.Errorf("no initrd, want %q", tt.ramdisk)
+			} else if li.Initrd != nil {
+				if got := readAll(t, li.Initrd); !bytes.Equal(got, tt.ramdisk) {
+					t.Errorf("initrd = %q, want %q", got, tt.ramdisk)
+				}
+			}
+			if li.DTB == nil && tt.fdt != nil {
+				t.Errorf("no device tree, want %q", tt.fdt)
+			} else if li.DTB != nil {
+				if got := readAll(t, li.DTB); !bytes.Equal(got, tt.fdt) {
+					t.Errorf("device tree = %q, want %q", got, tt.fdt)
+				}
+			}
+		})
+	}
+}
+
+func TestDataPosition(t *testing.T) {
+	external := append([]byte("padding"), ramdiskData...)
+	images := node("images", nil,
+		node("kernel", []dt.Property{
+			dt.PropertyString("type", "kernel"),
+			{Name: "data", Value: kernelData},
+		}),
+		node("ramdisk", []dt.Property{
+			dt.PropertyString("type", "ramdisk"),
+			dt.PropertyU32("data-size", uint32(len(ramdiskData))),
+			// Patched below, once the size is known.
+			dt.PropertyU32("data-position", 0),
+		}, sha256Node(ramdiskData)),
+	)
+	configs := node("configurations", nil,
+		node("conf", []dt.Property{
+			dt.PropertyString("kernel", "kernel"),
+			dt.PropertyString("ramdisk", "ramdisk"),
+		}),
+	)
+	size := len(buildFIT(t, images, configs, nil))
+	ramdisk, _ := images.Child("ramdisk")
+	ramdisk.UpdateProperty(dt.PropertyU32("data-position", uint32(size+len("padding"))))
+
+	f, err := Parse(bytes.NewReader(buildFIT(t, images, configs, external)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.ImageData("ramdisk")
+	if err != nil {
+		t.Fatalf("ImageData(ramdisk) = %v", err)
+	}
+	if !bytes.Equal(got, ramdiskData) {
+		t.Errorf("ImageData(ramdisk) = %q, want %q", got, ramdiskData)
+	}
+}
+
+func TestDataSizeTooLarge(t *testing.T) {
+	images := node("images", nil,
+		node("kernel", []dt.Property{
+			dt.PropertyString("type", "kernel"),
+			dt.PropertyU32("data-size", math.MaxUint32),
+			dt.PropertyU32("data-position", 0),
+		}),
+	)
+	f, err := Parse(bytes.NewReader(buildFIT(t, images, node("configurations", nil), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ImageData("kernel"); err == nil {
+		t.Errorf("ImageData(kernel) = nil, want error")
+	}
+}
+
+func TestImages(t *testing.T) {
+	fit := bytes.NewReader(buildFIT(t, testImages(), testConfigs(), append(ramdiskData, fdtData...)))
+	imgs, err := Images(fit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, img := range imgs {
+		got = append(got, img.Label()+" "+img.Config)
+	}
+	want := []string{
+		"Linux with ramdisk conf-2",
+		"test FIT (conf-1) conf-1",
+		"test FIT (conf-bad-hash) conf-bad-hash",
+		"test FIT (conf-ramdisk-kernel) conf-ramdisk-kernel",
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+
+	if _, err := Parse(bytes.NewReader(buildFIT(t, node("other", nil), testConfigs(), nil))); err == nil {
+		t.Errorf("Parse() of a device tree without /images succeeded")
+	}
+}
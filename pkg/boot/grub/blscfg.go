@@ -0,0 +1,76 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot/bls"
+)
+
+// blscfgCmd implements the blscfg command of Fedora's GRUB, which adds a menu
+// entry for every Boot Loader Specification entry.
+//
+// Entries are read from $blsdir, or from /loader/entries or
+// /boot/loader/entries on $root. Options are evaluated when the entry is, so
+// that $kernelopts from the environment block is expanded.
+func blscfgCmd(in *interp, args []string) error {
+	dirs := bls.EntriesDirs
+	if d := in.vars["blsdir"]; len(d) > 0 {
+		dirs = []string{d}
+	}
+
+	var entries []*bls.Entry
+	for _, dir := range dirs {
+		es, err := bls.ReadEntries(in.resolve(dir))
+		if err != nil {
+			return fmt.Errorf("blscfg: %v", err)
+		}
+		if len(es) > 0 {
+			entries = es
+			break
+		}
+	}
+
+	for _, e := range entries {
+		if !e.Bootable() {
+			Debug("blscfg: skipping %s", e.ID)
+			continue
+		}
+		nodes, err := parse(blsMenuEntry(e))
+		if err != nil {
+			return fmt.Errorf("blscfg: %s: %v", e.ID, err)
+		}
+		if err := in.run(nodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blsMenuEntry returns the menuentry script for e.
+func blsMenuEntry(e *bls.Entry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "menuentry %s --id %s {\n", quote(e.Name()), quote(e.ID))
+	fmt.Fprintf(&b, "linux %s %s\n", quote(e.Linux), e.Options)
+	if len(e.Initrds) > 0 {
+		b.WriteString("initrd")
+		for _, i := range e.Initrds {
+			b.WriteString(" " + quote(i))
+		}
+		b.WriteString("\n")
+	}
+	if len(e.DeviceTree) > 0 {
+		fmt.Fprintf(&b, "devicetree %s\n", quote(e.DeviceTree))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// quote single-quotes s for a GRUB script.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,485 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type commandFunc func(in *interp, args []string) error
+
+var commands map[string]commandFunc
+
+func init() {
+	// Initialized in init, since source and friends refer back to the
+	// table through the interpreter.
+	commands = map[string]commandFunc{
+		"[":          testCmd,
+		"test":       testCmd,
+		"true":       func(*interp, []string) error { return nil },
+		"false":      func(*interp, []string) error { return errFalse },
+		"set":        setCmd,
+		"unset":      unsetCmd,
+		"export":     func(*interp, []string) error { return nil },
+		"setparams":  setparamsCmd,
+		"shift":      shiftCmd,
+		"return":     returnCmd,
+		"break":      breakCmd,
+		"source":     sourceCmd,
+		".":          sourceCmd,
+		"configfile": configfileCmd,
+		"load_env":   loadEnvCmd,
+		"search":     searchCmd,
+		"probe":      probeCmd,
+
+		"search.file":     searchAlias("--file"),
+		"search.fs_label": searchAlias("--label"),
+		"search.fs_uuid":  searchAlias("--fs-uuid"),
+		"search_file":     searchAlias("--file"),
+		"search_label":    searchAlias("--label"),
+		"search_fs_uuid":  searchAlias("--fs-uuid"),
+
+		"linux":      linuxCmd,
+		"linux16":    linuxCmd,
+		"linuxefi":   linuxCmd,
+		"initrd":     initrdCmd,
+		"initrd16":   initrdCmd,
+		"initrdefi":  initrdCmd,
+		"multiboot":  multibootCmd,
+		"multiboot2": multibootCmd,
+		"module":     moduleCmd,
+		"module2":    moduleCmd,
+		"devicetree": devicetreeCmd,
+		"blscfg":     blscfgCmd,
+	}
+}
+
+// ignoredCommands only affect GRUB's own state, such as its modules, fonts
+// and terminals. They always succeed.
+var ignoredCommands = map[string]bool{
+	"background_color": true,
+	"background_image": true,
+	"boot":             true,
+	"clear":            true,
+	"echo":             true,
+	"insmod":           true,
+	"loadfont":         true,
+	"play":             true,
+	"rmmod":            true,
+	"save_env":         true,
+	"serial":           true,
+	"set_background":   true,
+	"sleep":            true,
+	"terminal":         true,
+	"terminal_input":   true,
+	"terminal_output":  true,
+	"terminfo":         true,
+}
+
+func setCmd(in *interp, args []string) error {
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			// Without a value, set prints the variable.
+			continue
+		}
+		in.vars[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func unsetCmd(in *interp, args []string) error {
+	for _, a := range args {
+		delete(in.vars, a)
+	}
+	return nil
+}
+
+func setparamsCmd(in *interp, args []string) error {
+	in.params = args
+	return nil
+}
+
+func shiftCmd(in *interp, args []string) error {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			return err
+		}
+	}
+	if n > len(in.params) {
+		return errors.New("shift count out of range")
+	}
+	in.params = in.params[n:]
+	return nil
+}
+
+func exitStatus(args []string) error {
+	if len(args) > 0 && args[0] != "0" {
+		return errFalse
+	}
+	return nil
+}
+
+func returnCmd(in *interp, args []string) error {
+	status := in.status
+	if len(args) > 0 {
+		status = exitStatus(args)
+	}
+	return &control{isReturn: true, status: status}
+}
+
+func breakCmd(in *interp, args []string) error {
+	return &control{}
+}
+
+func sourceCmd(in *interp, args []string) error {
+	if len(args) != 1 {
+		return errors.New("filename expected")
+	}
+	return in.source(in.resolve(args[0]))
+}
+
+// configfileCmd loads a configuration file.
+//
+// GRUB replaces the current menu with the file's menu. Entries are instead
+// added to the current menu, which is what callers looking for bootable
+// entries want.
+func configfileCmd(in *interp, args []string) error {
+	if len(args) != 1 {
+		return errors.New("filename expected")
+	}
+	in.vars["config_file"] = args[0]
+	in.vars["config_directory"] = path.Dir(args[0])
+	return in.source(in.resolve(args[0]))
+}
+
+// loadEnvCmd loads variables from a GRUB environment block.
+//
+// Usage: load_env [-f file] [-s] [whitelisted_variable_name]...
+func loadEnvCmd(in *interp, args []string) error {
+	file := in.vars["prefix"] + "/grubenv"
+	var whitelist []string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-f" || a == "--file":
+			if i+1 >= len(args) {
+				return errors.New("-f requires a file name")
+			}
+			i++
+			file = args[i]
+		case strings.HasPrefix(a, "--file="):
+			file = strings.TrimPrefix(a, "--file=")
+		case a == "-s" || a == "--skip-sig":
+		default:
+			whitelist = append(whitelist, a)
+		}
+	}
+
+	b, err := ioutil.ReadFile(in.resolve(file))
+	if err != nil {
+		return err
+	}
+	env := ParseEnvBlock(b)
+	if len(whitelist) == 0 {
+		for k, v := range env {
+			in.vars[k] = v
+		}
+		return nil
+	}
+	for _, k := range whitelist {
+		if v, ok := env[k]; ok {
+			in.vars[k] = v
+		}
+	}
+	return nil
+}
+
+// EnvBlockLocations are where grub-mkconfig installations keep the
+// environment block, relative to the root of a partition.
+var EnvBlockLocations = []string{
+	"grub2/grubenv",
+	"grub/grubenv",
+	"boot/grub2/grubenv",
+	"boot/grub/grubenv",
+}
+
+// FindEnvBlock parses the first environment block in EnvBlockLocations
+// under dir. It returns nil if there is none.
+func FindEnvBlock(dir string) map[string]string {
+	for _, l := range EnvBlockLocations {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, l)); err == nil {
+			return ParseEnvBlock(b)
+		}
+	}
+	return nil
+}
+
+// ParseEnvBlock parses a GRUB environment block, usually called grubenv,
+// into a map of variables.
+func ParseEnvBlock(b []byte) map[string]string {
+	env := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		env[kv[0]] = unescapeEnv(kv[1])
+	}
+	return env
+}
+
+// unescapeEnv removes the backslash escapes grub-editenv adds to values.
+func unescapeEnv(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// searchCmd finds a device by file, label or file system UUID.
+//
+// Usage: search [--file|--label|--fs-uuid] [--set[=var]] [--no-floppy] [--hint=...] name
+func searchCmd(in *interp, args []string) error {
+	var (
+		mode    = "--file"
+		varName string
+		names   []string
+	)
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-f" || a == "--file":
+			mode = "--file"
+		case a == "-l" || a == "--label":
+			mode = "--label"
+		case a == "-u" || a == "--fs-uuid":
+			mode = "--fs-uuid"
+		case a == "-s" || a == "--set":
+			varName = "root"
+		case strings.HasPrefix(a, "--set="):
+			varName = strings.TrimPrefix(a, "--set=")
+		case a == "-h" || ((a == "--hint" || strings.HasPrefix(a, "--hint-")) && !strings.Contains(a, "=")):
+			// Hints take an argument, which we skip.
+			i++
+		case strings.HasPrefix(a, "-"):
+			// --no-floppy, --efidisk-only and hints.
+		default:
+			names = append(names, a)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("search: one argument expected")
+	}
+
+	for _, d := range in.allDevices() {
+		if !matchDevice(d, mode, names[0]) {
+			continue
+		}
+		if len(varName) > 0 {
+			in.vars[varName] = d.Name
+		}
+		return nil
+	}
+	Debug("search %s %q: no such device", mode, names[0])
+	return fmt.Errorf("no such device: %s", names[0])
+}
+
+func matchDevice(d Device, mode, name string) bool {
+	switch mode {
+	case "--fs-uuid":
+		return len(d.FSUUID) > 0 && strings.EqualFold(d.FSUUID, name)
+	case "--label":
+		return len(d.Label) > 0 && d.Label == name
+	default:
+		_, err := os.Stat(filepath.Join(d.Dir, filepath.Clean("/"+name)))
+		return err == nil
+	}
+}
+
+// searchAlias implements the search.* shortcuts, which take the variable to
+// set as an optional second argument.
+func searchAlias(mode string) commandFunc {
+	return func(in *interp, args []string) error {
+		a := []string{mode}
+		if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+			a = append(a, "--set="+args[1], args[0])
+			a = append(a, args[2:]...)
+		} else {
+			a = append(a, args...)
+		}
+		return searchCmd(in, a)
+	}
+}
+
+// probeCmd retrieves device information.
+//
+// Usage: probe [--set var] (--fs-uuid|--label|--fs) device
+func probeCmd(in *interp, args []string) error {
+	var varName, what, dev string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-s" || a == "--set":
+			if i+1 < len(args) {
+				i++
+				varName = args[i]
+			}
+		case strings.HasPrefix(a, "--set="):
+			varName = strings.TrimPrefix(a, "--set=")
+		case a == "-u" || a == "--fs-uuid":
+			what = "uuid"
+		case a == "-l" || a == "--label":
+			what = "label"
+		case strings.HasPrefix(a, "-"):
+			// Other properties, such as --fs and --driver, are
+			// not known.
+			return fmt.Errorf("probe: unsupported option %q", a)
+		default:
+			dev = a
+		}
+	}
+
+	d := in.device(dev)
+	var v string
+	switch what {
+	case "uuid":
+		v = d.FSUUID
+	case "label":
+		v = d.Label
+	default:
+		return errors.New("probe: no property requested")
+	}
+	if len(v) == 0 {
+		return fmt.Errorf("probe: %s of %s unknown", what, dev)
+	}
+	if len(varName) > 0 {
+		in.vars[varName] = v
+	}
+	return nil
+}
+
+// stripOptions removes leading --options from args.
+func stripOptions(args []string) []string {
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		args = args[1:]
+	}
+	return args
+}
+
+// joinCmdline builds a kernel command line from arguments the way GRUB
+// does, quoting arguments that contain spaces.
+func joinCmdline(args []string) string {
+	var s []string
+	for _, a := range args {
+		if len(a) == 0 {
+			continue
+		}
+		if strings.ContainsAny(a, " \t") {
+			a = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a) + `"`
+		}
+		s = append(s, a)
+	}
+	return strings.Join(s, " ")
+}
+
+func (in *interp) checkEntry(cmd string) error {
+	if in.entry == nil {
+		return fmt.Errorf("%s: not in a menu entry", cmd)
+	}
+	return nil
+}
+
+func linuxCmd(in *interp, args []string) error {
+	if err := in.checkEntry("linux"); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("linux: filename expected")
+	}
+	in.entry.Kernel = in.resolve(args[0])
+	in.entry.Cmdline = joinCmdline(args[1:])
+	in.entry.Multiboot = ""
+	return nil
+}
+
+func initrdCmd(in *interp, args []string) error {
+	if err := in.checkEntry("initrd"); err != nil {
+		return err
+	}
+	args = stripOptions(args)
+	if len(args) == 0 {
+		return errors.New("initrd: filename expected")
+	}
+	in.entry.Initrds = nil
+	for _, a := range args {
+		in.entry.Initrds = append(in.entry.Initrds, in.resolve(a))
+	}
+	return nil
+}
+
+func multibootCmd(in *interp, args []string) error {
+	if err := in.checkEntry("multiboot"); err != nil {
+		return err
+	}
+	args = stripOptions(args)
+	if len(args) == 0 {
+		return errors.New("multiboot: filename expected")
+	}
+	in.entry.Multiboot = in.resolve(args[0])
+	in.entry.Cmdline = joinCmdline(args[1:])
+	in.entry.Modules = nil
+	return nil
+}
+
+func moduleCmd(in *interp, args []string) error {
+	if err := in.checkEntry("module"); err != nil {
+		return err
+	}
+	args = stripOptions(args)
+	if len(args) == 0 {
+		return errors.New("module: filename expected")
+	}
+	in.entry.Modules = append(in.entry.Modules, Module{
+		Path:    in.resolve(args[0]),
+		Cmdline: joinCmdline(args[1:]),
+	})
+	return nil
+}
+
+func devicetreeCmd(in *interp, args []string) error {
+	if err := in.checkEntry("devicetree"); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("devicetree: filename expected")
+	}
+	in.entry.DeviceTree = in.resolve(args[0])
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// testCmd implements the test and [ commands.
+//
+// Supported are the string comparisons =, == and !=, the integer comparisons
+// -eq, -ne, -lt, -le, -gt and -ge, the file tests -e, -f, -d and -s, the
+// string tests -n and -z, negation with !, -a, -o and parentheses.
+func testCmd(in *interp, args []string) error {
+	if len(args) > 0 && args[len(args)-1] == "]" {
+		args = args[:len(args)-1]
+	}
+	e := &testExpr{in: in, args: args}
+	if len(args) == 0 {
+		return errFalse
+	}
+	ok, err := e.or()
+	if err != nil {
+		return err
+	}
+	if e.pos != len(e.args) {
+		return fmt.Errorf("test: unexpected argument %q", e.args[e.pos])
+	}
+	if !ok {
+		return errFalse
+	}
+	return nil
+}
+
+type testExpr struct {
+	in   *interp
+	args []string
+	pos  int
+}
+
+func (e *testExpr) peek(off int) (string, bool) {
+	if e.pos+off >= len(e.args) {
+		return "", false
+	}
+	return e.args[e.pos+off], true
+}
+
+func (e *testExpr) next() (string, error) {
+	if e.pos >= len(e.args) {
+		return "", errors.New("test: argument expected")
+	}
+	e.pos++
+	return e.args[e.pos-1], nil
+}
+
+func (e *testExpr) or() (bool, error) {
+	l, err := e.and()
+	if err != nil {
+		return false, err
+	}
+	for {
+		if op, _ := e.peek(0); op != "-o" {
+			return l, nil
+		}
+		e.pos++
+		r, err := e.and()
+		if err != nil {
+			return false, err
+		}
+		l = l || r
+	}
+}
+
+func (e *testExpr) and() (bool, error) {
+	l, err := e.not()
+	if err != nil {
+		return false, err
+	}
+	for {
+		if op, _ := e.peek(0); op != "-a" {
+			return l, nil
+		}
+		e.pos++
+		r, err := e.not()
+		if err != nil {
+			return false, err
+		}
+		l = l && r
+	}
+}
+
+func (e *testExpr) not() (bool, error) {
+	// A lone "!" is a non-empty string rather than a negation.
+	if a, _ := e.peek(0); a == "!" && e.pos+1 < len(e.args) {
+		e.pos++
+		v, err := e.not()
+		return !v, err
+	}
+	return e.primary()
+}
+
+func (e *testExpr) primary() (bool, error) {
+	a, err := e.next()
+	if err != nil {
+		return false, err
+	}
+
+	if a == "(" {
+		v, err := e.or()
+		if err != nil {
+			return false, err
+		}
+		if c, _ := e.next(); c != ")" {
+			return false, errors.New("test: ) expected")
+		}
+		return v, nil
+	}
+
+	// Binary operators take precedence, so that [ "-n" = "-n" ] works.
+	if op, ok := e.peek(0); ok {
+		if _, ok := e.peek(1); ok && isBinaryOp(op) {
+			e.pos++
+			b, _ := e.next()
+			return binaryTest(op, a, b)
+		}
+	}
+
+	if isUnaryOp(a) {
+		if b, ok := e.peek(0); ok {
+			e.pos++
+			return e.unaryTest(a, b), nil
+		}
+	}
+
+	// A single string is true if it is non-empty.
+	return len(a) > 0, nil
+}
+
+func isBinaryOp(op string) bool {
+	switch op {
+	case "=", "==", "!=", "<", ">", "-eq", "-ne", "-lt", "-le", "-gt", "-ge":
+		return true
+	}
+	return false
+}
+
+func isUnaryOp(op string) bool {
+	switch op {
+	case "-e", "-f", "-d", "-s", "-n", "-z":
+		return true
+	}
+	return false
+}
+
+func binaryTest(op, a, b string) (bool, error) {
+	switch op {
+	case "=", "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "<":
+		return a < b, nil
+	case ">":
+		return a > b, nil
+	}
+
+	x, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("test: integer expected, got %q", a)
+	}
+	y, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("test: integer expected, got %q", b)
+	}
+	switch op {
+	case "-eq":
+		return x == y, nil
+	case "-ne":
+		return x != y, nil
+	case "-lt":
+		return x < y, nil
+	case "-le":
+		return x <= y, nil
+	case "-gt":
+		return x > y, nil
+	default: // -ge
+		return x >= y, nil
+	}
+}
+
+func (e *testExpr) unaryTest(op, a string) bool {
+	switch op {
+	case "-n":
+		return len(a) > 0
+	case "-z":
+		return len(a) == 0
+	}
+
+	fi, err := os.Stat(e.in.resolve(a))
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "-f":
+		return fi.Mode().IsRegular()
+	case "-d":
+		return fi.IsDir()
+	case "-s":
+		return fi.Size() > 0
+	default: // -e
+		return true
+	}
+}
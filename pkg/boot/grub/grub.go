@@ -0,0 +1,237 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package grub implements an interpreter for GRUB2 configuration scripts.
+//
+// Distribution grub.cfg files are shell-like scripts rather than simple lists
+// of menu entries. They set and test variables, define functions, load
+// environment blocks, search for file systems by UUID or label, source other
+// scripts, and nest menu entries in submenus. This package lexes, parses and
+// evaluates those scripts the way GRUB would, and collects the resulting
+// menu entries as bootable OS images.
+//
+// Commands that only matter to GRUB's own environment (insmod, loadfont,
+// terminal_output, ...) are accepted and ignored. Entries that cannot be
+// booted with kexec, such as chainloader entries, are dropped.
+//
+// See https://www.gnu.org/software/grub/manual/grub/grub.html#Shell_002dlike-scripting
+// for the scripting language.
+package grub
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Device is a mounted file system that a GRUB script may refer to.
+type Device struct {
+	// Name is the GRUB device name without parentheses, e.g. "hd0,gpt2".
+	//
+	// The names of devices found with the search command are assigned to
+	// $root, and paths of the form (name)/file refer to them. Device names
+	// that are not known are resolved to the device holding the
+	// configuration file, since GRUB's BIOS disk numbering cannot be
+	// reproduced from Linux.
+	Name string
+
+	// Dir is the directory at which the file system is mounted.
+	Dir string
+
+	// FSUUID and Label identify the file system for search --fs-uuid
+	// and search --label.
+	FSUUID string
+	Label  string
+}
+
+// Module is a multiboot module loaded by a menu entry.
+type Module struct {
+	// Path is the module's location on the host.
+	Path string
+
+	// Cmdline are the module's arguments.
+	Cmdline string
+}
+
+// Entry is a bootable menu entry.
+//
+// All paths are locations on the host, resolved against the mount point of
+// the device GRUB would have read them from.
+type Entry struct {
+	// Title is the menu entry title.
+	Title string
+
+	// ID is the entry's --id, if any.
+	ID string
+
+	// Submenus are the titles of the enclosing submenus, outermost first.
+	Submenus []string
+
+	Kernel     string
+	Initrds    []string
+	Cmdline    string
+	DeviceTree string
+
+	// Multiboot is the multiboot kernel. If it is set, Kernel and
+	// Initrds are not used.
+	Multiboot string
+	Modules   []Module
+}
+
+// Name returns the entry title including the titles of enclosing submenus,
+// separated by ">" as in GRUB's default variable.
+func (e *Entry) Name() string {
+	return strings.Join(append(append([]string{}, e.Submenus...), e.Title), ">")
+}
+
+// multibootCmdline returns the command line of a multiboot kernel or module
+// at path.
+//
+// GRUB 2 leaves out the file name, but Xen only expects that from GRUB 2 and
+// otherwise strips the first word of its own and the dom0 command line. So
+// like syslinux's mboot.c32, start with the file name.
+func multibootCmdline(path, args string) string {
+	if len(args) == 0 {
+		return path
+	}
+	return path + " " + args
+}
+
+// OSImage returns a boot.OSImage for the entry.
+//
+// Files are opened lazily, when the image is loaded.
+func (e *Entry) OSImage() boot.OSImage {
+	if len(e.Multiboot) > 0 {
+		var mods []multiboot.Module
+		for _, m := range e.Modules {
+			mods = append(mods, multiboot.Module{
+				Name:    m.Path,
+				CmdLine: multibootCmdline(m.Path, m.Cmdline),
+				Module:  uio.NewLazyFile(m.Path),
+			})
+		}
+		return &boot.MultibootImage{
+			Name:    e.Name(),
+			Kernel:  uio.NewLazyFile(e.Multiboot),
+			Cmdline: multibootCmdline(e.Multiboot, e.Cmdline),
+			Modules: mods,
+		}
+	}
+
+	var initrds []io.ReaderAt
+	for _, i := range e.Initrds {
+		initrds = append(initrds, uio.NewLazyFile(i))
+	}
+	li := &boot.LinuxImage{
+		Name:    e.Name(),
+		Kernel:  uio.NewLazyFile(e.Kernel),
+		Cmdline: e.Cmdline,
+	}
+	if len(initrds) > 0 {
+		li.Initrd = boot.CatInitrds(initrds...)
+	}
+	if len(e.DeviceTree) > 0 {
+		li.DTB = uio.NewLazyFile(e.DeviceTree)
+	}
+	return li
+}
+
+// Config is the result of evaluating a GRUB configuration.
+type Config struct {
+	// Entries are the bootable menu entries, in menu order. Entries of a
+	// submenu appear in place of the submenu.
+	Entries []*Entry
+
+	// DefaultEntry is the index of the default entry in Entries, or -1 if
+	// the default entry is not bootable or does not exist.
+	DefaultEntry int
+
+	// Timeout is the menu timeout in seconds, or -1 to wait forever.
+	Timeout int
+}
+
+// OSImages returns an OSImage for every entry.
+func (c *Config) OSImages() []boot.OSImage {
+	imgs := make([]boot.OSImage, 0, len(c.Entries))
+	for _, e := range c.Entries {
+		imgs = append(imgs, e.OSImage())
+	}
+	return imgs
+}
+
+// devicePath returns the GRUB path of p on the named device.
+func devicePath(device, p string) string {
+	if len(device) == 0 {
+		return p
+	}
+	return fmt.Sprintf("(%s)%s", device, p)
+}
+
+// ParseConfigFile evaluates the GRUB configuration at configPath on root.
+//
+// configPath is relative to root.Dir and is used to initialize $prefix.
+// devices are the file systems that search may find. root does not need to
+// be part of devices, and root.Name may be empty if the configuration is not
+// expected to refer to other devices.
+func ParseConfigFile(root Device, configPath string, devices []Device) (*Config, error) {
+	in := newInterp(root, devices)
+	configPath = filepath.Clean("/" + configPath)
+	prefix := devicePath(root.Name, filepath.Dir(configPath))
+	in.vars["prefix"] = prefix
+	in.vars["config_directory"] = prefix
+	in.vars["config_file"] = devicePath(root.Name, configPath)
+
+	if err := in.source(filepath.Join(root.Dir, configPath)); err != nil {
+		return nil, err
+	}
+	return in.config(), nil
+}
+
+// ParseConfig evaluates the GRUB configuration script in config.
+//
+// Paths are resolved against root, and $prefix is set to root's /boot/grub.
+func ParseConfig(root Device, config string, devices []Device) (*Config, error) {
+	in := newInterp(root, devices)
+	prefix := devicePath(root.Name, "/boot/grub")
+	in.vars["prefix"] = prefix
+	in.vars["config_directory"] = prefix
+
+	nodes, err := parse(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := in.run(nodes); err != nil {
+		return nil, err
+	}
+	return in.config(), nil
+}
+
+// config builds a Config from the collected menu.
+func (in *interp) config() *Config {
+	c := &Config{
+		DefaultEntry: -1,
+		Timeout:      -1,
+	}
+	if t, err := parseInt(in.vars["timeout"]); err == nil {
+		c.Timeout = t
+	}
+
+	in.evalMenu(in.menu, nil)
+	def := in.menu.find(in.vars["default"])
+	for _, item := range in.menu.flatten() {
+		if item == def {
+			c.DefaultEntry = len(c.Entries)
+		}
+		c.Entries = append(c.Entries, item.entry)
+	}
+	return c
+}
+
+// Debug logs ignored commands and failed lookups.
+var Debug = func(string, ...interface{}) {}
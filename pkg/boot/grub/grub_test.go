@@ -0,0 +1,416 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+var root = Device{Name: "hd0,gpt1", Dir: "/mnt"}
+
+func TestParseConfig(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		config  string
+		devices []Device
+		want    *Config
+	}{
+		{
+			desc: "simple entry",
+			config: `set timeout=5
+			menuentry 'Linux' {
+				linux /vmlinuz root=/dev/sda1 ro
+				initrd /initrd.img
+			}`,
+			want: &Config{
+				Entries: []*Entry{
+					{
+						Title:   "Linux",
+						Kernel:  "/mnt/vmlinuz",
+						Cmdline: "root=/dev/sda1 ro",
+						Initrds: []string{"/mnt/initrd.img"},
+					},
+				},
+				DefaultEntry: 0,
+				Timeout:      5,
+			},
+		},
+		{
+			desc: "variables are expanded when the entry runs",
+			config: `menuentry "Linux" {
+				linux ${prefix}/../vmlinuz $args "quoted $args"
+			}
+			set args="a=1 b=2"`,
+			want: &Config{
+				Entries: []*Entry{
+					{
+						Title:   "Linux",
+						Kernel:  "/mnt/boot/vmlinuz",
+						Cmdline: `a=1 b=2 "quoted a=1 b=2"`,
+					},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "if elif else",
+			config: `set a=2
+			if [ "$a" = 1 ]; then
+				set k=one
+			elif [ $a -eq 2 -a -n "$a" ]; then
+				set k=two
+			else
+				set k=three
+			fi
+			if [ ! -z "$a" ]; then set k=${k}x; fi
+			menuentry "$k" { linux /$k }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "twox", Kernel: "/mnt/twox"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "functions and positional parameters",
+			config: `function kernel {
+				linux /vmlinuz-$1 $2
+				if [ "$#" = 3 ]; then initrd /initrd-$1; fi
+				return
+				linux /never
+			}
+			menuentry 'A' { kernel 5.0 quiet x }
+			menuentry 'B' { kernel 4.0 "" }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "A", Kernel: "/mnt/vmlinuz-5.0", Cmdline: "quiet", Initrds: []string{"/mnt/initrd-5.0"}},
+					{Title: "B", Kernel: "/mnt/vmlinuz-4.0"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "default by title through submenu",
+			config: `set default="Advanced>Old"
+			menuentry 'New' { linux /new }
+			submenu 'Advanced' {
+				menuentry 'New' --id new { linux /new }
+				menuentry 'Old' { linux /old }
+			}`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "New", Kernel: "/mnt/new"},
+					{Title: "New", ID: "new", Submenus: []string{"Advanced"}, Kernel: "/mnt/new"},
+					{Title: "Old", Submenus: []string{"Advanced"}, Kernel: "/mnt/old"},
+				},
+				DefaultEntry: 2,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "default by index and unbootable entries",
+			config: `set default=1
+			menuentry 'Windows' { chainloader +1 }
+			menuentry 'Linux' { linux /vmlinuz }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "Linux", Kernel: "/mnt/vmlinuz"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "search sets root",
+			config: `search --no-floppy --fs-uuid --set=root --hint hd1,gpt1 1234-ABCD
+			menuentry 'Linux' {
+				linux /vmlinuz
+				initrd (hd0,gpt1)/a.img ($root)/b.img
+			}
+			menuentry 'Label' {
+				search -l data -s
+				linux ($root)/vmlinuz
+			}`,
+			devices: []Device{
+				{Name: "hd1,gpt1", Dir: "/mnt/other", FSUUID: "1234-abcd"},
+				{Name: "hd1,gpt2", Dir: "/mnt/data", Label: "data"},
+			},
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "Linux", Kernel: "/mnt/other/vmlinuz", Initrds: []string{"/mnt/a.img", "/mnt/other/b.img"}},
+					{Title: "Label", Kernel: "/mnt/data/vmlinuz"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "multiboot",
+			config: `menuentry 'Xen' {
+				multiboot --quirk-bad-kludge /xen.gz dom0_mem=1G
+				module /vmlinuz root=/dev/sda1
+				module --nounzip /initrd.img
+			}`,
+			want: &Config{
+				Entries: []*Entry{
+					{
+						Title:     "Xen",
+						Multiboot: "/mnt/xen.gz",
+						Cmdline:   "dom0_mem=1G",
+						Modules: []Module{
+							{Path: "/mnt/vmlinuz", Cmdline: "root=/dev/sda1"},
+							{Path: "/mnt/initrd.img"},
+						},
+					},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "loops",
+			config: `for k in a b c; do
+				if [ $k = c ]; then break; fi
+				menuentry $k { linux /$chosen }
+			done
+			set n=x
+			while [ $n != xxx ]; do set n=x$n; done
+			menuentry $n { linux /$n }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "a", Kernel: "/mnt/a"},
+					{Title: "b", Kernel: "/mnt/b"},
+					{Title: "xxx", Kernel: "/mnt/xxx"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "unknown commands fail and are ignored",
+			config: `if hwmatch foo; then set a=1; else set a=2; fi
+			frobnicate
+			menuentry $a { linux /$a }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "2", Kernel: "/mnt/2"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+		{
+			desc: "assignments are not field split",
+			config: `args="root=/dev/sda1 ro"
+			opts=$args
+			both=$opts"  quiet"
+			menuentry 'Linux' { linux /vmlinuz $both }`,
+			want: &Config{
+				Entries: []*Entry{
+					{Title: "Linux", Kernel: "/mnt/vmlinuz", Cmdline: "root=/dev/sda1 ro quiet"},
+				},
+				DefaultEntry: 0,
+				Timeout:      -1,
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := ParseConfig(root, tt.config, tt.devices)
+			if err != nil {
+				t.Fatalf("ParseConfig() = %v", err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		`menuentry 'a' {`,
+		`if true; then`,
+		`}`,
+		`echo "unterminated`,
+		`for x a b; do done`,
+		`function { }`,
+	} {
+		if _, err := ParseConfig(root, config, nil); err == nil {
+			t.Errorf("ParseConfig(%q) = nil, want error", config)
+		}
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	config := `function f { f; }
+	f
+	while true; do true; done
+	menuentry 'ok' { linux /ok }`
+	c, err := ParseConfig(root, config, nil)
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+	if len(c.Entries) != 1 {
+		t.Errorf("got %d entries, want 1", len(c.Entries))
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	ubuntu := Device{Name: "hd0,gpt2", Dir: "testdata/ubuntu", FSUUID: "0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1"}
+	esp := Device{Name: "hd0,gpt1", Dir: "testdata/esp"}
+
+	want := &Config{
+		Entries: []*Entry{
+			{
+				Title:   "Ubuntu",
+				ID:      "gnulinux-simple-0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1",
+				Kernel:  "testdata/ubuntu/boot/vmlinuz-5.4.0-42-generic",
+				Initrds: []string{"testdata/ubuntu/boot/initrd.img-5.4.0-42-generic"},
+				Cmdline: "root=UUID=0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1 ro quiet splash vt.handoff=7",
+			},
+			{
+				Title:    "Ubuntu, with Linux 5.4.0-42-generic",
+				ID:       "gnulinux-5.4.0-42-generic-advanced-0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1",
+				Submenus: []string{"Advanced options for Ubuntu"},
+				Kernel:   "testdata/ubuntu/boot/vmlinuz-5.4.0-42-generic",
+				Initrds:  []string{"testdata/ubuntu/boot/initrd.img-5.4.0-42-generic"},
+				Cmdline:  "root=UUID=0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1 ro quiet splash vt.handoff=7",
+			},
+			{
+				Title:    "Ubuntu, with Linux 5.4.0-42-generic (recovery mode)",
+				ID:       "gnulinux-5.4.0-42-generic-recovery-0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1",
+				Submenus: []string{"Advanced options for Ubuntu"},
+				Kernel:   "testdata/ubuntu/boot/vmlinuz-5.4.0-42-generic",
+				Initrds:  []string{"testdata/ubuntu/boot/initrd.img-5.4.0-42-generic"},
+				Cmdline:  "root=UUID=0d6aa5a4-ec3b-4b2b-a6d2-9ef4e9b4c8e1 ro recovery nomodeset dis_ucode_ldr",
+			},
+			{
+				Title:     "Xen",
+				Multiboot: "testdata/ubuntu/xen.gz",
+				Cmdline:   "dom0_mem=1024M",
+				Modules: []Module{
+					{Path: "testdata/ubuntu/vmlinuz-xen", Cmdline: "root=/dev/sda1 console=hvc0"},
+					{Path: "testdata/ubuntu/initrd-xen"},
+				},
+			},
+		},
+		// From saved_entry in grubenv.
+		DefaultEntry: 2,
+		Timeout:      10,
+	}
+
+	for _, tt := range []struct {
+		root    Device
+		path    string
+		devices []Device
+	}{
+		{ubuntu, "boot/grub/grub.cfg", nil},
+		// The ESP config finds the root file system by UUID.
+		{esp, "EFI/ubuntu/grub.cfg", []Device{esp, ubuntu}},
+	} {
+		got, err := ParseConfigFile(tt.root, tt.path, tt.devices)
+		if err != nil {
+			t.Fatalf("ParseConfigFile(%s) = %v", tt.path, err)
+		}
+		if diff := deep.Equal(got, want); diff != nil {
+			t.Errorf("ParseConfigFile(%s): %v", tt.path, diff)
+		}
+	}
+}
+
+func TestBLSCfg(t *testing.T) {
+	fedora := Device{Name: "hd0,gpt2", Dir: "testdata/fedora", FSUUID: "5cd0a5ba-0f0b-4a4c-b9b4-2b5a1e1c8c71"}
+	const (
+		machineID  = "8a3b1ab6b9b84e8e9d1e0b2c4e0f6d21"
+		kernelopts = "root=/dev/mapper/fedora-root ro resume=/dev/mapper/fedora-swap rd.lvm.lv=fedora/root rd.lvm.lv=fedora/swap rhgb quiet"
+	)
+
+	want := &Config{
+		Entries: []*Entry{
+			{
+				Title:   "Fedora (5.4.13-201.fc31.x86_64) 31 (Thirty One)",
+				ID:      machineID + "-5.4.13-201.fc31.x86_64",
+				Kernel:  "testdata/fedora/vmlinuz-5.4.13-201.fc31.x86_64",
+				Initrds: []string{"testdata/fedora/intel-ucode.img", "testdata/fedora/initramfs-5.4.13-201.fc31.x86_64.img"},
+				Cmdline: kernelopts,
+			},
+			{
+				Title:   "Fedora (5.3.7-301.fc31.x86_64) 31 (Thirty One)",
+				ID:      machineID + "-5.3.7-301.fc31.x86_64",
+				Kernel:  "testdata/fedora/vmlinuz-5.3.7-301.fc31.x86_64",
+				Initrds: []string{"testdata/fedora/initramfs-5.3.7-301.fc31.x86_64.img"},
+				Cmdline: kernelopts,
+			},
+			{
+				Title:   "Fedora (0-rescue-" + machineID + ") 31 (Thirty One)",
+				ID:      machineID + "-0-rescue",
+				Kernel:  "testdata/fedora/vmlinuz-0-rescue-" + machineID,
+				Initrds: []string{"testdata/fedora/initramfs-0-rescue-" + machineID + ".img"},
+				Cmdline: kernelopts,
+			},
+		},
+		// saved_entry in grubenv is a BLS entry ID.
+		DefaultEntry: 1,
+		Timeout:      5,
+	}
+
+	got, err := ParseConfigFile(fedora, "grub2/grub.cfg", []Device{fedora})
+	if err != nil {
+		t.Fatalf("ParseConfigFile() = %v", err)
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOSImages(t *testing.T) {
+	c := &Config{
+		Entries: []*Entry{
+			{Title: "Linux", Submenus: []string{"Sub"}, Kernel: "/vmlinuz", Cmdline: "quiet"},
+			{Title: "Xen", Multiboot: "/xen", Cmdline: "dom0_mem=1G", Modules: []Module{{Path: "/dom0", Cmdline: "console=hvc0"}}},
+		},
+	}
+	imgs := c.OSImages()
+	if len(imgs) != 2 {
+		t.Fatalf("got %d images, want 2", len(imgs))
+	}
+
+	li, ok := imgs[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("got %T, want *boot.LinuxImage", imgs[0])
+	}
+	if li.Name != "Sub>Linux" || li.Cmdline != "quiet" || li.Initrd != nil {
+		t.Errorf("got %v", li)
+	}
+
+	mi, ok := imgs[1].(*boot.MultibootImage)
+	if !ok {
+		t.Fatalf("got %T, want *boot.MultibootImage", imgs[1])
+	}
+	if got, want := mi.Cmdline, "/xen dom0_mem=1G"; got != want {
+		t.Errorf("kernel cmdline = %q, want %q", got, want)
+	}
+	if got, want := mi.Modules[0].CmdLine, "/dom0 console=hvc0"; got != want {
+		t.Errorf("module cmdline = %q, want %q", got, want)
+	}
+}
+
+func TestParseEnvBlock(t *testing.T) {
+	env := "# GRUB Environment Block\nsaved_entry=a\\\\b\nkernelopts=root=/dev/sda1 ro\n###########"
+	want := map[string]string{
+		"saved_entry": `a\b`,
+		"kernelopts":  "root=/dev/sda1 ro",
+	}
+	if got := ParseEnvBlock([]byte(env)); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseEnvBlock() = %v, want %v", got, want)
+	}
+}
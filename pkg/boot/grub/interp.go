@@ -0,0 +1,432 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxDepth limits nesting of function calls and sourced files.
+	maxDepth = 32
+
+	// maxIterations limits the total number of loop iterations.
+	maxIterations = 10000
+)
+
+var (
+	errFalse      = errors.New("false")
+	errTooDeep    = errors.New("maximum nesting depth exceeded")
+	errTooManyRun = errors.New("maximum number of loop iterations exceeded")
+)
+
+// control is returned by return and break to unwind the interpreter.
+type control struct {
+	// isReturn is true for return and false for break.
+	isReturn bool
+
+	// status is the resulting exit status.
+	status error
+}
+
+func (c *control) Error() string {
+	if c.isReturn {
+		return "return outside of function"
+	}
+	return "break outside of loop"
+}
+
+// features are the GRUB feature flags grub-mkconfig scripts test for.
+var features = []string{
+	"feature_200_final",
+	"feature_all_video_module",
+	"feature_chainloader_bpb",
+	"feature_default_font_path",
+	"feature_menuentry_id",
+	"feature_menuentry_options",
+	"feature_nativedisk_cmd",
+	"feature_ntldr",
+	"feature_platform_search_hint",
+	"feature_timeout_style",
+}
+
+// interp evaluates parsed GRUB scripts.
+type interp struct {
+	root    Device
+	devices []Device
+
+	vars  map[string]string
+	funcs map[string]*functionNode
+
+	// params are the positional parameters $1, $2, ...
+	params []string
+
+	// status is the result of the last command, $?.
+	status error
+
+	// menu collects menuentry and submenu definitions.
+	menu *menu
+
+	// entry is the entry whose body is being evaluated. It is nil when
+	// not evaluating a menuentry.
+	entry *Entry
+
+	depth      int
+	iterations *int
+}
+
+func newInterp(root Device, devices []Device) *interp {
+	in := &interp{
+		root:       root,
+		devices:    devices,
+		vars:       make(map[string]string),
+		funcs:      make(map[string]*functionNode),
+		menu:       &menu{},
+		iterations: new(int),
+	}
+	for _, f := range features {
+		in.vars[f] = "y"
+	}
+	in.vars["root"] = root.Name
+	in.vars["grub_cpu"] = grubCPU()
+	in.vars["grub_platform"] = "pc"
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		in.vars["grub_platform"] = "efi"
+	}
+	return in
+}
+
+func grubCPU() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	}
+	return runtime.GOARCH
+}
+
+// child returns an interpreter with a copy of in's variables.
+func (in *interp) child() *interp {
+	c := *in
+	c.vars = make(map[string]string, len(in.vars))
+	for k, v := range in.vars {
+		c.vars[k] = v
+	}
+	return &c
+}
+
+// device looks up a device by name, falling back to the root device.
+func (in *interp) device(name string) Device {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "("), ")")
+	if name == in.root.Name {
+		return in.root
+	}
+	for _, d := range in.devices {
+		if d.Name == name {
+			return d
+		}
+	}
+	Debug("unknown device %q, using %q", name, in.root.Name)
+	return in.root
+}
+
+// allDevices returns the root device followed by all other devices.
+func (in *interp) allDevices() []Device {
+	devs := []Device{in.root}
+	for _, d := range in.devices {
+		if d.Name != in.root.Name {
+			devs = append(devs, d)
+		}
+	}
+	return devs
+}
+
+// resolve translates a GRUB path, optionally prefixed by a (device), to a
+// host path.
+func (in *interp) resolve(p string) string {
+	dev := in.vars["root"]
+	if strings.HasPrefix(p, "(") {
+		if end := strings.IndexByte(p, ')'); end > 0 {
+			dev, p = p[1:end], p[end+1:]
+		}
+	}
+	return filepath.Join(in.device(dev).Dir, filepath.Clean("/"+p))
+}
+
+// source evaluates the script at host path file in the current context.
+func (in *interp) source(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	nodes, err := parse(string(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if in.depth >= maxDepth {
+		return errTooDeep
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	return in.run(nodes)
+}
+
+// lookup returns the value of a variable or special parameter.
+func (in *interp) lookup(name string) string {
+	switch name {
+	case "#":
+		return strconv.Itoa(len(in.params))
+	case "@", "*":
+		return strings.Join(in.params, " ")
+	case "?":
+		if in.status != nil {
+			return "1"
+		}
+		return "0"
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n >= 1 && n <= len(in.params) {
+			return in.params[n-1]
+		}
+		return ""
+	}
+	return in.vars[name]
+}
+
+// expand expands variables in w, splitting unquoted variable values into
+// separate fields.
+func (in *interp) expand(w word) []string {
+	var (
+		fields []string
+		cur    strings.Builder
+		// have is true if cur holds a field, even an empty one.
+		have bool
+	)
+	for _, p := range w {
+		if !p.variable {
+			cur.WriteString(p.text)
+			have = have || len(p.text) > 0 || p.quoted
+			continue
+		}
+
+		v := in.lookup(p.text)
+		if p.quoted {
+			cur.WriteString(v)
+			have = true
+			continue
+		}
+
+		fs := strings.Fields(v)
+		for i, f := range fs {
+			if i > 0 {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+			cur.WriteString(f)
+			have = true
+		}
+	}
+	if have {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// expandString expands variables in w without field splitting, as in
+// assignments.
+func (in *interp) expandString(w word) string {
+	var b strings.Builder
+	for _, p := range w {
+		if p.variable {
+			b.WriteString(in.lookup(p.text))
+		} else {
+			b.WriteString(p.text)
+		}
+	}
+	return b.String()
+}
+
+func (in *interp) expandAll(words []word) []string {
+	var args []string
+	for _, w := range words {
+		args = append(args, in.expand(w)...)
+	}
+	return args
+}
+
+// run executes nodes and returns the status of the last one.
+func (in *interp) run(nodes []node) error {
+	var err error
+	for _, n := range nodes {
+		err = in.exec(n)
+		in.status = err
+		if _, ok := err.(*control); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// cond runs a condition list and reports whether it succeeded.
+func (in *interp) cond(nodes []node) (bool, error) {
+	err := in.run(nodes)
+	if _, ok := err.(*control); ok {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+func (in *interp) loop() error {
+	*in.iterations++
+	if *in.iterations > maxIterations {
+		return errTooManyRun
+	}
+	return nil
+}
+
+func (in *interp) exec(n node) error {
+	switch n := n.(type) {
+	case *command:
+		if len(n.words) > 0 {
+			if name, value, ok := isAssignment(n.words[0]); ok {
+				in.vars[name] = in.expandString(value)
+				return nil
+			}
+		}
+		return in.command(in.expandAll(n.words))
+
+	case *ifNode:
+		for _, c := range n.clauses {
+			ok, err := in.cond(c.cond)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return in.run(c.body)
+			}
+		}
+		return in.run(n.elseBody)
+
+	case *forNode:
+		var err error
+		for _, item := range in.expandAll(n.items) {
+			if lerr := in.loop(); lerr != nil {
+				return lerr
+			}
+			in.vars[n.name] = item
+			err = in.run(n.body)
+			if c, ok := err.(*control); ok {
+				if c.isReturn {
+					return c
+				}
+				return c.status
+			}
+		}
+		return err
+
+	case *whileNode:
+		var err error
+		for {
+			if lerr := in.loop(); lerr != nil {
+				return lerr
+			}
+			ok, cerr := in.cond(n.cond)
+			if cerr != nil {
+				return cerr
+			}
+			if ok == n.until {
+				return err
+			}
+			err = in.run(n.body)
+			if c, ok := err.(*control); ok {
+				if c.isReturn {
+					return c
+				}
+				return c.status
+			}
+		}
+
+	case *functionNode:
+		in.funcs[n.name] = n
+		return nil
+
+	case *menuNode:
+		item := newMenuItem(n, in.expandAll(n.args))
+		in.menu.items = append(in.menu.items, item)
+		return nil
+	}
+	return fmt.Errorf("unknown node %T", n)
+}
+
+// isAssignment reports whether the first word of a command is a variable
+// assignment of the form name=value, and returns the name and the
+// unexpanded value.
+func isAssignment(w word) (string, word, bool) {
+	if len(w) == 0 || w[0].variable || w[0].quoted {
+		return "", nil, false
+	}
+	i := strings.IndexByte(w[0].text, '=')
+	if i <= 0 {
+		return "", nil, false
+	}
+	name := w[0].text[:i]
+	for j := 0; j < len(name); j++ {
+		if !isVarChar(name[j]) {
+			return "", nil, false
+		}
+	}
+	value := append(word{{text: w[0].text[i+1:]}}, w[1:]...)
+	return name, value, true
+}
+
+// command executes a simple command with expanded arguments args.
+func (in *interp) command(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	if f, ok := in.funcs[args[0]]; ok {
+		return in.call(f, args[1:])
+	}
+	if c, ok := commands[args[0]]; ok {
+		return c(in, args[1:])
+	}
+	if ignoredCommands[args[0]] {
+		return nil
+	}
+	Debug("unsupported command %q", args)
+	return fmt.Errorf("can't find command %q", args[0])
+}
+
+func (in *interp) call(f *functionNode, args []string) error {
+	if in.depth >= maxDepth {
+		return errTooDeep
+	}
+	in.depth++
+	params := in.params
+	in.params = args
+	defer func() {
+		in.params = params
+		in.depth--
+	}()
+
+	err := in.run(f.body)
+	if c, ok := err.(*control); ok && c.isReturn {
+		return c.status
+	}
+	return err
+}
+
+func parseInt(s string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(s))
+}
@@ -0,0 +1,326 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	// tokSep is a command separator: a newline or a semicolon.
+	tokSep
+	tokLBrace
+	tokRBrace
+	tokEOF
+)
+
+// wordPart is a piece of a word as written in the script.
+//
+// Variable expansion is deferred until the command is executed, since GRUB
+// evaluates variables at runtime.
+type wordPart struct {
+	// text is either a literal or the name of a variable.
+	text string
+
+	// variable is true if text names a variable to be expanded.
+	variable bool
+
+	// quoted is true if the part appeared in single or double quotes.
+	// Unquoted variables are subject to field splitting.
+	quoted bool
+}
+
+// word is one shell word, made up of literal and variable parts.
+type word []wordPart
+
+// keyword returns the word's text if it consists of a single unquoted
+// literal, which is the only form in which reserved words are recognized.
+func (w word) keyword() string {
+	if len(w) != 1 || w[0].variable || w[0].quoted {
+		return ""
+	}
+	return w[0].text
+}
+
+// String returns the word roughly as it was written.
+func (w word) String() string {
+	var s strings.Builder
+	for _, p := range w {
+		if p.variable {
+			fmt.Fprintf(&s, "${%s}", p.text)
+		} else {
+			s.WriteString(p.text)
+		}
+	}
+	return s.String()
+}
+
+type token struct {
+	kind tokenKind
+	word word
+	line int
+}
+
+// SyntaxError is returned for scripts that cannot be tokenized or parsed.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type lexer struct {
+	in   string
+	pos  int
+	line int
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// isWordEnd returns true for characters that end an unquoted word.
+func isWordEnd(c byte) bool {
+	return isSpace(c) || c == '\n' || c == ';'
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lex splits a GRUB script into tokens.
+func lex(in string) ([]token, error) {
+	l := &lexer{in: in, line: 1}
+	var toks []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) peek(off int) byte {
+	if l.pos+off >= len(l.in) {
+		return 0
+	}
+	return l.in[l.pos+off]
+}
+
+// skipBlanks skips blanks, line continuations and comments.
+func (l *lexer) skipBlanks() {
+	for l.pos < len(l.in) {
+		c := l.in[l.pos]
+		switch {
+		case isSpace(c):
+			l.pos++
+		case c == '\\' && l.peek(1) == '\n':
+			l.pos += 2
+			l.line++
+		case c == '#':
+			for l.pos < len(l.in) && l.in[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipBlanks()
+	if l.pos >= len(l.in) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	switch c := l.in[l.pos]; c {
+	case '\n':
+		l.pos++
+		l.line++
+		return token{kind: tokSep, line: line}, nil
+	case ';':
+		l.pos++
+		return token{kind: tokSep, line: line}, nil
+	case '{', '}':
+		if n := l.peek(1); n == 0 || isWordEnd(n) {
+			l.pos++
+			if c == '{' {
+				return token{kind: tokLBrace, line: line}, nil
+			}
+			return token{kind: tokRBrace, line: line}, nil
+		}
+	}
+
+	w, err := l.word()
+	if err != nil {
+		return token{}, err
+	}
+	return token{kind: tokWord, word: w, line: line}, nil
+}
+
+// word reads one word, stopping at unquoted blanks and separators.
+func (l *lexer) word() (word, error) {
+	var w word
+	add := func(p wordPart) {
+		// Merge adjacent literals for easier keyword detection.
+		if n := len(w); n > 0 && !p.variable && !w[n-1].variable && w[n-1].quoted == p.quoted {
+			w[n-1].text += p.text
+			return
+		}
+		w = append(w, p)
+	}
+
+	for l.pos < len(l.in) {
+		c := l.in[l.pos]
+		switch {
+		case isWordEnd(c):
+			return w, nil
+
+		case c == '\\':
+			l.pos++
+			if l.pos >= len(l.in) {
+				return w, nil
+			}
+			if l.in[l.pos] == '\n' {
+				l.line++
+			} else {
+				add(wordPart{text: string(l.in[l.pos])})
+			}
+			l.pos++
+
+		case c == '\'':
+			end := strings.IndexByte(l.in[l.pos+1:], '\'')
+			if end < 0 {
+				return nil, &SyntaxError{Line: l.line, Msg: "unterminated single quote"}
+			}
+			s := l.in[l.pos+1 : l.pos+1+end]
+			l.line += strings.Count(s, "\n")
+			// Mark the part as quoted even if empty, so that '' is
+			// preserved as an empty argument.
+			add(wordPart{text: s, quoted: true})
+			l.pos += end + 2
+
+		case c == '"':
+			if err := l.doubleQuoted(add); err != nil {
+				return nil, err
+			}
+
+		case c == '$':
+			p, ok := l.variable()
+			if !ok {
+				add(wordPart{text: "$"})
+				l.pos++
+				continue
+			}
+			add(p)
+
+		default:
+			add(wordPart{text: string(c)})
+			l.pos++
+		}
+	}
+	return w, nil
+}
+
+func (l *lexer) doubleQuoted(add func(wordPart)) error {
+	start := l.line
+	// Always add an empty quoted part, so that "" is preserved as an empty
+	// argument.
+	add(wordPart{quoted: true})
+	l.pos++
+	for l.pos < len(l.in) {
+		c := l.in[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return nil
+
+		case '\\':
+			switch n := l.peek(1); n {
+			case '$', '"', '\\':
+				add(wordPart{text: string(n), quoted: true})
+				l.pos += 2
+			case '\n':
+				l.line++
+				l.pos += 2
+			default:
+				add(wordPart{text: "\\", quoted: true})
+				l.pos++
+			}
+
+		case '$':
+			p, ok := l.variable()
+			if !ok {
+				add(wordPart{text: "$", quoted: true})
+				l.pos++
+				continue
+			}
+			p.quoted = true
+			add(p)
+
+		default:
+			if c == '\n' {
+				l.line++
+			}
+			add(wordPart{text: string(c), quoted: true})
+			l.pos++
+		}
+	}
+	return &SyntaxError{Line: start, Msg: "unterminated double quote"}
+}
+
+// variable reads a variable reference at l.pos, which points at a '$'.
+//
+// Supported forms are $name, ${name}, $1 and the special parameters $#, $@,
+// $* and $?.
+func (l *lexer) variable() (wordPart, bool) {
+	n := l.peek(1)
+	switch {
+	case n == '{':
+		end := strings.IndexByte(l.in[l.pos+2:], '}')
+		if end < 0 {
+			return wordPart{}, false
+		}
+		name := l.in[l.pos+2 : l.pos+2+end]
+		l.pos += end + 3
+		return wordPart{text: name, variable: true}, true
+
+	case n == '#' || n == '@' || n == '*' || n == '?':
+		l.pos += 2
+		return wordPart{text: string(n), variable: true}, true
+
+	case isDigit(n):
+		start := l.pos + 1
+		l.pos++
+		for l.pos < len(l.in) && isDigit(l.in[l.pos]) {
+			l.pos++
+		}
+		return wordPart{text: l.in[start:l.pos], variable: true}, true
+
+	case isVarChar(n):
+		start := l.pos + 1
+		l.pos++
+		for l.pos < len(l.in) && isVarChar(l.in[l.pos]) {
+			l.pos++
+		}
+		return wordPart{text: l.in[start:l.pos], variable: true}, true
+	}
+	return wordPart{}, false
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	in := newInterp(root, nil)
+	in.vars["a"] = "x y"
+	in.vars["empty"] = ""
+	in.params = []string{"p1", "p2"}
+
+	for _, tt := range []struct {
+		script string
+		want   []string
+	}{
+		{`cmd plain`, []string{"cmd", "plain"}},
+		{`cmd $a`, []string{"cmd", "x", "y"}},
+		{`cmd "$a"`, []string{"cmd", "x y"}},
+		{`cmd '$a'`, []string{"cmd", "$a"}},
+		{`cmd pre${a}post`, []string{"cmd", "prex", "ypost"}},
+		{`cmd $empty`, []string{"cmd"}},
+		{`cmd "$empty" ''`, []string{"cmd", "", ""}},
+		{`cmd x"${a}"y`, []string{"cmd", "xx yy"}},
+		{`cmd \$a \"`, []string{"cmd", "$a", `"`}},
+		{`cmd "a\"b\$c\d"`, []string{"cmd", `a"b$c\d`}},
+		{`cmd $1 $2 $3 $# "$@"`, []string{"cmd", "p1", "p2", "2", "p1 p2"}},
+		{`cmd a\` + "\n" + `b # comment`, []string{"cmd", "ab"}},
+		{`cmd $ ${unterminated`, []string{"cmd", "$", "${unterminated"}},
+	} {
+		toks, err := lex(tt.script)
+		if err != nil {
+			t.Errorf("lex(%q) = %v", tt.script, err)
+			continue
+		}
+		var got []string
+		for _, tok := range toks {
+			if tok.kind == tokWord {
+				got = append(got, in.expand(tok.word)...)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand(%q) = %q, want %q", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestLexTokens(t *testing.T) {
+	toks, err := lex("menuentry 'a b' {\n\tlinux /k; }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []tokenKind
+	for _, tok := range toks {
+		kinds = append(kinds, tok.kind)
+	}
+	want := []tokenKind{tokWord, tokWord, tokLBrace, tokSep, tokWord, tokWord, tokSep, tokRBrace, tokSep, tokEOF}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("lex() kinds = %v, want %v", kinds, want)
+	}
+	if got := toks[4].line; got != 2 {
+		t.Errorf("linux token on line %d, want 2", got)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"strconv"
+	"strings"
+)
+
+// menuItem is a menuentry or submenu as defined by a script.
+type menuItem struct {
+	title string
+	id    string
+
+	// args are the positional parameters passed to the body.
+	args []string
+	node *menuNode
+
+	// entry is set once a menuentry body has been evaluated, and only if
+	// the entry is bootable.
+	entry *Entry
+
+	// sub is set once a submenu body has been evaluated.
+	sub *menu
+}
+
+type menu struct {
+	items []*menuItem
+}
+
+// newMenuItem interprets the expanded menuentry arguments.
+//
+// See grub-core/commands/menuentry.c for the options.
+func newMenuItem(n *menuNode, args []string) *menuItem {
+	item := &menuItem{node: n}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		opt, val, hasVal := a, "", false
+		if j := strings.IndexByte(a, '='); strings.HasPrefix(a, "--") && j > 0 {
+			opt, val, hasVal = a[:j], a[j+1:], true
+		}
+
+		switch opt {
+		case "--class", "--users", "--hotkey", "--id", "--source":
+			if !hasVal && i+1 < len(args) {
+				i++
+				val = args[i]
+			}
+			if opt == "--id" {
+				item.id = val
+			}
+		case "--unrestricted":
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) > 0 {
+		item.title = positional[0]
+		item.args = positional[1:]
+	}
+	return item
+}
+
+// lookup finds an item by index, ID or title, in that order.
+func (m *menu) lookup(spec string) *menuItem {
+	if i, err := strconv.Atoi(spec); err == nil {
+		if i >= 0 && i < len(m.items) {
+			return m.items[i]
+		}
+		return nil
+	}
+	for _, item := range m.items {
+		if len(item.id) > 0 && item.id == spec {
+			return item
+		}
+	}
+	for _, item := range m.items {
+		if item.title == spec {
+			return item
+		}
+	}
+	return nil
+}
+
+// find resolves a value of GRUB's default variable to a menu item.
+//
+// spec is a ">"-separated path through submenus, each element being an index,
+// ID or title. An empty spec refers to the first item.
+func (m *menu) find(spec string) *menuItem {
+	if len(spec) == 0 {
+		spec = "0"
+	}
+	cur := m
+	var item *menuItem
+	for _, p := range strings.Split(spec, ">") {
+		if cur == nil {
+			return nil
+		}
+		if item = cur.lookup(p); item == nil {
+			return nil
+		}
+		cur = item.sub
+	}
+	return item
+}
+
+// flatten returns all bootable entries, descending into submenus.
+func (m *menu) flatten() []*menuItem {
+	var items []*menuItem
+	for _, item := range m.items {
+		if item.sub != nil {
+			items = append(items, item.sub.flatten()...)
+		} else if item.entry != nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// evalMenu evaluates the bodies of all items of m.
+//
+// GRUB only runs the body of a menuentry when it is selected, with the
+// variables as they were at the end of the configuration. Each body is hence
+// run in a copy of the current variables so entries don't affect each other.
+func (in *interp) evalMenu(m *menu, parents []string) {
+	for _, item := range m.items {
+		child := in.child()
+		child.params = item.args
+		child.vars["chosen"] = item.title
+
+		if item.node.submenu {
+			child.menu = &menu{}
+			if err := child.run(item.node.body); err != nil {
+				Debug("submenu %q: %v", item.title, err)
+			}
+			child.evalMenu(child.menu, append(append([]string{}, parents...), item.title))
+			item.sub = child.menu
+			continue
+		}
+
+		e := &Entry{
+			Title:    item.title,
+			ID:       item.id,
+			Submenus: parents,
+		}
+		child.entry = e
+		if err := child.run(item.node.body); err != nil {
+			Debug("menuentry %q: %v", item.title, err)
+		}
+		if len(e.Kernel) > 0 || len(e.Multiboot) > 0 {
+			item.entry = e
+		} else {
+			Debug("menuentry %q is not bootable", item.title)
+		}
+	}
+}
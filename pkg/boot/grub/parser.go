@@ -0,0 +1,270 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"fmt"
+)
+
+// node is a statement in a GRUB script.
+type node interface{}
+
+// command is a simple command: a command name and its arguments.
+type command struct {
+	words []word
+	line  int
+}
+
+type ifClause struct {
+	cond []node
+	body []node
+}
+
+// ifNode is an if/elif/else/fi statement.
+type ifNode struct {
+	clauses  []ifClause
+	elseBody []node
+}
+
+// forNode is a for/in/do/done loop.
+type forNode struct {
+	name  string
+	items []word
+	body  []node
+}
+
+// whileNode is a while/do/done or until/do/done loop.
+type whileNode struct {
+	until bool
+	cond  []node
+	body  []node
+}
+
+// functionNode defines a function.
+type functionNode struct {
+	name string
+	body []node
+}
+
+// menuNode is a menuentry or a submenu.
+type menuNode struct {
+	submenu bool
+	args    []word
+	body    []node
+	line    int
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parse lexes and parses a GRUB script.
+func parse(script string) ([]node, error) {
+	toks, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	nodes, _, err := p.list()
+	return nodes, err
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) advance() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) skipSeps() {
+	for p.peek().kind == tokSep {
+		p.advance()
+	}
+}
+
+func (p *parser) errorf(format string, v ...interface{}) error {
+	return &SyntaxError{Line: p.peek().line, Msg: fmt.Sprintf(format, v...)}
+}
+
+// list parses statements until one of the given terminators is found at
+// the start of a command. The terminator is consumed and returned.
+//
+// "}" terminates on a closing brace. Without terminators, list parses until
+// the end of the script.
+func (p *parser) list(terminators ...string) ([]node, string, error) {
+	isTerm := func(s string) bool {
+		for _, t := range terminators {
+			if t == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	var nodes []node
+	for {
+		p.skipSeps()
+		t := p.peek()
+		switch t.kind {
+		case tokEOF:
+			if len(terminators) > 0 {
+				return nil, "", p.errorf("unexpected end of script, expected %q", terminators)
+			}
+			return nodes, "", nil
+
+		case tokRBrace:
+			if !isTerm("}") {
+				return nil, "", p.errorf("unexpected }")
+			}
+			p.advance()
+			return nodes, "}", nil
+
+		case tokLBrace:
+			return nil, "", p.errorf("unexpected {")
+		}
+
+		kw := t.word.keyword()
+		if isTerm(kw) {
+			p.advance()
+			return nodes, kw, nil
+		}
+
+		n, err := p.statement()
+		if err != nil {
+			return nil, "", err
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+func (p *parser) statement() (node, error) {
+	t := p.peek()
+	switch t.word.keyword() {
+	case "if":
+		p.advance()
+		return p.ifStatement()
+
+	case "for":
+		p.advance()
+		return p.forStatement()
+
+	case "while", "until":
+		p.advance()
+		cond, _, err := p.list("do")
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := p.list("done")
+		if err != nil {
+			return nil, err
+		}
+		return &whileNode{until: t.word.keyword() == "until", cond: cond, body: body}, nil
+
+	case "function":
+		p.advance()
+		name := p.advance()
+		if name.kind != tokWord || name.word.keyword() == "" {
+			return nil, p.errorf("invalid function name")
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &functionNode{name: name.word.keyword(), body: body}, nil
+
+	case "menuentry", "submenu":
+		p.advance()
+		var args []word
+		for p.peek().kind == tokWord {
+			args = append(args, p.advance().word)
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &menuNode{
+			submenu: t.word.keyword() == "submenu",
+			args:    args,
+			body:    body,
+			line:    t.line,
+		}, nil
+
+	case "then", "elif", "else", "fi", "do", "done", "in":
+		return nil, p.errorf("unexpected %q", t.word.keyword())
+	}
+
+	c := &command{line: t.line}
+	for p.peek().kind == tokWord {
+		c.words = append(c.words, p.advance().word)
+	}
+	return c, nil
+}
+
+// block parses a brace-delimited list of statements.
+func (p *parser) block() ([]node, error) {
+	p.skipSeps()
+	if p.peek().kind != tokLBrace {
+		return nil, p.errorf("expected {")
+	}
+	p.advance()
+	body, _, err := p.list("}")
+	return body, err
+}
+
+func (p *parser) ifStatement() (node, error) {
+	n := &ifNode{}
+	for {
+		cond, _, err := p.list("then")
+		if err != nil {
+			return nil, err
+		}
+		body, term, err := p.list("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		n.clauses = append(n.clauses, ifClause{cond: cond, body: body})
+
+		switch term {
+		case "fi":
+			return n, nil
+		case "else":
+			n.elseBody, _, err = p.list("fi")
+			if err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) forStatement() (node, error) {
+	name := p.advance()
+	if name.kind != tokWord || name.word.keyword() == "" {
+		return nil, p.errorf("invalid for loop variable")
+	}
+	if in := p.advance(); in.word.keyword() != "in" {
+		return nil, p.errorf("expected \"in\"")
+	}
+	n := &forNode{name: name.word.keyword()}
+	for p.peek().kind == tokWord {
+		n.items = append(n.items, p.advance().word)
+	}
+	p.skipSeps()
+	if do := p.advance(); do.word.keyword() != "do" {
+		return nil, p.errorf("expected \"do\"")
+	}
+	body, _, err := p.list("done")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	return n, nil
+}
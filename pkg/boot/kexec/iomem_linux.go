@@ -0,0 +1,85 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var iomemPath = "/proc/iomem"
+
+// ParseIOMem reads the memory map from /proc/iomem.
+//
+// Architectures without /sys/firmware/memmap, such as arm64, only describe
+// RAM there. The returned map contains System RAM minus any range marked
+// reserved, and the reserved ranges.
+func ParseIOMem() (MemoryMap, error) {
+	f, err := os.Open(iomemPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIOMem(f)
+}
+
+// parseIOMem parses lines like
+//
+//	40000000-bfffffff : System RAM
+//	  40080000-4116ffff : Kernel code
+//	  bbf00000-bbffffff : reserved
+func parseIOMem(r io.Reader) (MemoryMap, error) {
+	var ram, reserved Ranges
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.Index(line, " : ")
+		if i < 0 {
+			continue
+		}
+		nested := strings.HasPrefix(line, " ")
+		addrs, name := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+3:])
+		j := strings.IndexByte(addrs, '-')
+		if j < 0 {
+			return nil, fmt.Errorf("invalid iomem line %q", line)
+		}
+		start, err := strconv.ParseUint(addrs[:j], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid iomem line %q: %v", line, err)
+		}
+		end, err := strconv.ParseUint(addrs[j+1:], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid iomem line %q: %v", line, err)
+		}
+		// The end address is inclusive.
+		rg := RangeFromInterval(uintptr(start), uintptr(end)+1)
+
+		switch sysfsToRangeType[name] {
+		case RangeRAM:
+			if !nested {
+				ram = append(ram, rg)
+			}
+		case RangeReserved:
+			reserved = append(reserved, rg)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	// Insert removes the reserved ranges from RAM.
+	var m MemoryMap
+	for _, rg := range ram {
+		m.Insert(TypedRange{Range: rg, Type: RangeRAM})
+	}
+	for _, rg := range reserved {
+		m.Insert(TypedRange{Range: rg, Type: RangeReserved})
+	}
+	return m, nil
+}
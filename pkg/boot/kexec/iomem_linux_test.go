@@ -0,0 +1,35 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIOMem(t *testing.T) {
+	const iomem = `09000000-09000fff : pl011@9000000
+  09000000-09000fff : pl011@9000000
+40000000-bfffffff : System RAM
+  40080000-4116ffff : Kernel code
+  411e0000-4156ffff : Kernel data
+  bbf00000-bbffffff : reserved
+c0000000-c0000fff : reserved
+`
+	got, err := parseIOMem(strings.NewReader(iomem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MemoryMap{
+		{Range: RangeFromInterval(0x40000000, 0xbbf00000), Type: RangeRAM},
+		{Range: RangeFromInterval(0xbbf00000, 0xbc000000), Type: RangeReserved},
+		{Range: RangeFromInterval(0xbc000000, 0xc0000000), Type: RangeRAM},
+		{Range: RangeFromInterval(0xc0000000, 0xc0001000), Type: RangeReserved},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIOMem() = %v, want %v", got, want)
+	}
+}
@@ -5,14 +5,17 @@
 package boot
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/linux"
 	"github.com/u-root/u-root/pkg/uio"
 )
 
@@ -23,6 +26,15 @@ type LinuxImage struct {
 	Kernel  io.ReaderAt
 	Initrd  io.ReaderAt
 	Cmdline string
+
+	// DTB is an optional device tree blob to pass to the kernel. It is
+	// only passed with LoadSyscall.
+	DTB io.ReaderAt
+
+	// LoadSyscall loads the kernel with kexec_load rather than
+	// kexec_file_load, for kernels without KEXEC_FILE support or with
+	// signature enforcement.
+	LoadSyscall bool
 }
 
 var _ OSImage = &LinuxImage{}
@@ -40,6 +52,27 @@ func (li *LinuxImage) String() string {
 	return fmt.Sprintf("LinuxImage(\n  Name: %s\n  Kernel: %s\n  Initrd: %s\n  Cmdline: %s\n)\n", li.Name, li.Kernel, li.Initrd, li.Cmdline)
 }
 
+// CatInitrds concatenates initrds on first ReadAt call from a buffer.
+//
+// Linux unpacks concatenated initramfs archives in order, so GRUB-style
+// "initrd a b" lines and multiple BLS initrd keys can be combined into the
+// single LinuxImage.Initrd.
+func CatInitrds(initrds ...io.ReaderAt) io.ReaderAt {
+	var names []string
+	for _, initrd := range initrds {
+		names = append(names, fmt.Sprintf("%v", initrd))
+	}
+	return uio.NewLazyOpenerAt(strings.Join(names, ","), func() (io.ReaderAt, error) {
+		var buf bytes.Buffer
+		for _, i := range initrds {
+			if _, err := io.Copy(&buf, uio.Reader(i)); err != nil {
+				return nil, err
+			}
+		}
+		return bytes.NewReader(buf.Bytes()), nil
+	})
+}
+
 func copyToFile(r io.Reader) (*os.File, error) {
 	f, err := ioutil.TempFile("", "nerf-netboot")
 	if err != nil {
@@ -60,7 +93,8 @@ func copyToFile(r io.Reader) (*os.File, error) {
 	return readOnlyF, nil
 }
 
-// Load implements OSImage.Load and kexec_load's the kernel with its initramfs.
+// Load implements OSImage.Load and kexec_file_load's the kernel with its
+// initramfs, or kexec_load's it if LoadSyscall is set.
 func (li *LinuxImage) Load(verbose bool) error {
 	if li.Kernel == nil {
 		return errors.New("LinuxImage.Kernel must be non-nil")
@@ -108,5 +142,12 @@ func (li *LinuxImage) Load(verbose bool) error {
 		log.Printf("Initrd: %s", i.Name())
 	}
 	log.Printf("Command line: %s", li.Cmdline)
+	if li.LoadSyscall {
+		return linux.KexecLoad(k, i, li.Cmdline, li.DTB)
+	}
+	if li.DTB != nil {
+		// kexec_file_load always passes the current device tree.
+		log.Printf("Warning: ignoring device tree %s, set LoadSyscall to use it", li.DTB)
+	}
 	return kexec.FileLoad(k, i, li.Cmdline)
 }
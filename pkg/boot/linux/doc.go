@@ -0,0 +1,15 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linux loads Linux kernels with the kexec_load syscall.
+//
+// Unlike kexec_file_load, kexec_load leaves it to user space to lay out the
+// kernel in physical memory and to prepare the machine state the kernel
+// expects. This works on kernels built without KEXEC_FILE and on kernels
+// that enforce signatures for kexec_file_load.
+//
+// x86_64 bzImages are booted with the 64-bit boot protocol described in
+// Documentation/x86/boot.rst, arm64 Images as described in
+// Documentation/arm64/booting.rst.
+package linux
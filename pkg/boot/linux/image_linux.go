@@ -0,0 +1,172 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/dt"
+)
+
+// arm64 Image constants from Documentation/arm64/booting.rst.
+const (
+	arm64Magic = 0x644d5241 // "ARM\x64"
+
+	// arm64OldTextOffset is the text offset of kernels older than 3.17,
+	// which have an image_size of 0.
+	arm64OldTextOffset = 0x80000
+
+	arm64Alignment = 2 << 20
+
+	// arm64DTBWindow is how far after the kernel start older kernels
+	// look for the device tree.
+	arm64DTBWindow = 512 << 20
+	arm64DTBMax    = 2 << 20
+)
+
+// arm64Header is the header at the start of an arm64 Image.
+type arm64Header struct {
+	Code0      uint32
+	Code1      uint32
+	TextOffset uint64
+	ImageSize  uint64
+	Flags      uint64
+	Res2       uint64
+	Res3       uint64
+	Res4       uint64
+	Magic      uint32
+	Res5       uint32
+}
+
+// arm64Purgatory jumps to the kernel entry with x0 pointing to the device
+// tree and x1-x3 zero, as kexec_load leaves x0 undefined:
+//
+//	ldr	x17, entry
+//	ldr	x0, dtb
+//	mov	x1, xzr
+//	mov	x2, xzr
+//	mov	x3, xzr
+//	br	x17
+//	entry:	.quad 0
+//	dtb:	.quad 0
+var arm64Purgatory = []uint32{
+	0x580000d1,
+	0x580000e0,
+	0xaa1f03e1,
+	0xaa1f03e2,
+	0xaa1f03e3,
+	0xd61f0220,
+}
+
+// Offsets of the literals in arm64Purgatory.
+const (
+	arm64EntryLiteral = 0x18
+	arm64DTBLiteral   = 0x20
+)
+
+// arm64PurgatoryPage returns the purgatory jumping to entry with the device
+// tree at dtb.
+func arm64PurgatoryPage(entry, dtb uintptr) []byte {
+	p := make([]byte, arm64DTBLiteral+8)
+	for i, insn := range arm64Purgatory {
+		binary.LittleEndian.PutUint32(p[4*i:], insn)
+	}
+	binary.LittleEndian.PutUint64(p[arm64EntryLiteral:], uint64(entry))
+	binary.LittleEndian.PutUint64(p[arm64DTBLiteral:], uint64(dtb))
+	return p
+}
+
+// arm64Image returns the header and contents of an arm64 Image, which may be
+// gzip compressed.
+func arm64Image(kernel []byte) (arm64Header, []byte, error) {
+	if len(kernel) >= 2 && kernel[0] == 0x1f && kernel[1] == 0x8b {
+		z, err := gzip.NewReader(bytes.NewReader(kernel))
+		if err != nil {
+			return arm64Header{}, nil, err
+		}
+		if kernel, err = ioutil.ReadAll(z); err != nil {
+			return arm64Header{}, nil, fmt.Errorf("decompressing kernel: %v", err)
+		}
+	}
+	var hdr arm64Header
+	if err := binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &hdr); err != nil {
+		return arm64Header{}, nil, fmt.Errorf("reading Image header: %v", err)
+	}
+	if hdr.Magic != arm64Magic {
+		return arm64Header{}, nil, errors.New("not an arm64 Image")
+	}
+	if hdr.ImageSize == 0 {
+		hdr.TextOffset = arm64OldTextOffset
+	}
+	return hdr, kernel, nil
+}
+
+// loadImage adds segments for the arm64 Image kernel, ramfs, the device tree
+// fdt with /chosen updated, and the purgatory to mem, and returns the entry
+// point. An empty cmdline keeps the bootargs of fdt.
+func loadImage(mem *kexec.Memory, kernel, ramfs []byte, cmdline string, fdt *dt.FDT) (uintptr, error) {
+	hdr, kernel, err := arm64Image(kernel)
+	if err != nil {
+		return 0, err
+	}
+
+	// The Image is placed text_offset bytes after a 2MiB aligned base,
+	// as low as possible in RAM for kernels that need it.
+	size := uint(hdr.ImageSize)
+	if size < uint(len(kernel)) {
+		size = uint(len(kernel))
+	}
+	base, err := findAligned(mem.AvailableRAM(), uint(hdr.TextOffset)+size, arm64Alignment, kexec.RangeFromInterval(0, kexec.MaxAddr))
+	if err != nil {
+		return 0, fmt.Errorf("no space for kernel: %v", err)
+	}
+	kernelRange := kexec.Range{Start: base.Start + uintptr(hdr.TextOffset), Size: size}
+	mem.Segments.Insert(kexec.NewSegment(kernel, kernelRange))
+
+	chosen, ok := fdt.RootNode.Child("chosen")
+	if !ok {
+		chosen = &dt.Node{Name: "chosen"}
+		fdt.RootNode.Children = append(fdt.RootNode.Children, chosen)
+	}
+	if len(cmdline) > 0 {
+		chosen.UpdateProperty(dt.PropertyString("bootargs", cmdline))
+	}
+	if len(ramfs) > 0 {
+		r, err := addSegment(mem, ramfs, kexec.RangeFromInterval(kernelRange.End(), kexec.MaxAddr))
+		if err != nil {
+			return 0, fmt.Errorf("no space for initramfs: %v", err)
+		}
+		chosen.UpdateProperty(dt.PropertyU64("linux,initrd-start", uint64(r.Start)))
+		chosen.UpdateProperty(dt.PropertyU64("linux,initrd-end", uint64(r.End())))
+	} else {
+		chosen.RemoveProperty("linux,initrd-start")
+		chosen.RemoveProperty("linux,initrd-end")
+	}
+
+	var b bytes.Buffer
+	if _, err := fdt.Write(&b); err != nil {
+		return 0, fmt.Errorf("writing device tree: %v", err)
+	}
+	if b.Len() > arm64DTBMax {
+		return 0, fmt.Errorf("device tree is %d bytes, at most %d are supported", b.Len(), arm64DTBMax)
+	}
+	dtbRange, err := addSegment(mem, b.Bytes(), kexec.Range{Start: kernelRange.Start, Size: arm64DTBWindow})
+	if err != nil {
+		return 0, fmt.Errorf("no space for device tree: %v", err)
+	}
+
+	purg := arm64PurgatoryPage(kernelRange.Start, dtbRange.Start)
+	purgRange, err := addSegment(mem, purg, kexec.RangeFromInterval(0, kexec.MaxAddr))
+	if err != nil {
+		return 0, fmt.Errorf("no space for purgatory: %v", err)
+	}
+	return purgRange.Start, nil
+}
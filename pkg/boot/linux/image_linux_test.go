@@ -0,0 +1,186 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/dt"
+)
+
+func testImage(textOffset, imageSize uint64, codeSize int) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, arm64Header{
+		TextOffset: textOffset,
+		ImageSize:  imageSize,
+		Flags:      0xa,
+		Magic:      arm64Magic,
+	})
+	b.Write(bytes.Repeat([]byte{0x1f, 0x20, 0x03, 0xd5}, (codeSize-b.Len())/4))
+	return b.Bytes()
+}
+
+func gzipped(b []byte) []byte {
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	w.Write(b)
+	w.Close()
+	return z.Bytes()
+}
+
+func testFDT() *dt.FDT {
+	return &dt.FDT{
+		Header: dt.Header{
+			Magic:           dt.Magic,
+			Version:         17,
+			LastCompVersion: 16,
+		},
+		RootNode: &dt.Node{
+			Properties: []dt.Property{
+				dt.PropertyString("model", "u-root test"),
+			},
+			Children: []*dt.Node{
+				{
+					Name: "chosen",
+					Properties: []dt.Property{
+						dt.PropertyString("bootargs", "console=ttyAMA0"),
+						dt.PropertyU32("linux,initrd-start", 0x44000000),
+						dt.PropertyU32("linux,initrd-end", 0x44cb8fc4),
+					},
+				},
+			},
+		},
+	}
+}
+
+var testARMPhys = kexec.MemoryMap{
+	{Range: kexec.RangeFromInterval(0x40000000, 0x40100000), Type: kexec.RangeRAM},
+	{Range: kexec.RangeFromInterval(0x40100000, 0x40200000), Type: kexec.RangeReserved},
+	{Range: kexec.RangeFromInterval(0x40200000, 0x80000000), Type: kexec.RangeRAM},
+}
+
+func TestLoadImage(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		kernel []byte
+		ramfs  int
+
+		// want are the physical ranges of kernel, initramfs (if any),
+		// device tree and purgatory.
+		want []kexec.Range
+
+		// chosen are the expected /chosen properties.
+		chosen []dt.Property
+		err    string
+	}{
+		{
+			name:   "Image",
+			kernel: testImage(0, 0x300000, 0x1000),
+			ramfs:  0x2000,
+			want: []kexec.Range{
+				// The first 2M aligned address has a
+				// reserved range.
+				{Start: 0x40200000, Size: 0x300000},
+				{Start: 0x40500000, Size: 0x2000},
+				{Start: 0x40502000},
+				{Start: 0x40000000, Size: 0x28},
+			},
+			chosen: []dt.Property{
+				dt.PropertyString("bootargs", "console=ttyS0"),
+				dt.PropertyU64("linux,initrd-start", 0x40500000),
+				dt.PropertyU64("linux,initrd-end", 0x40502000),
+			},
+		},
+		{
+			name:   "gzip compressed old Image",
+			kernel: gzipped(testImage(0, 0, 0x1000)),
+			want: []kexec.Range{
+				{Start: 0x40280000, Size: 0x1000},
+				{Start: 0x40281000},
+				{Start: 0x40000000, Size: 0x28},
+			},
+			chosen: []dt.Property{
+				dt.PropertyString("bootargs", "console=ttyS0"),
+			},
+		},
+		{
+			name:   "not an Image",
+			kernel: make([]byte, 0x1000),
+			err:    "not an arm64 Image",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fdt := testFDT()
+			mem := kexec.Memory{Phys: testARMPhys}
+			entry, err := loadImage(&mem, tt.kernel, make([]byte, tt.ramfs), "console=ttyS0", fdt)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("loadImage() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadImage() = %v", err)
+			}
+
+			chosen, _ := fdt.RootNode.Lookup("/chosen")
+			if diff := deep.Equal(chosen.Properties, tt.chosen); diff != nil {
+				t.Errorf("/chosen: %v", diff)
+			}
+
+			// The device tree size depends on the encoding.
+			var b bytes.Buffer
+			if _, err := fdt.Write(&b); err != nil {
+				t.Fatal(err)
+			}
+			tt.want[len(tt.want)-2].Size = uint(b.Len())
+
+			var got []kexec.Range
+			for _, s := range mem.Segments {
+				got = append(got, s.Phys)
+			}
+			if diff := deep.Equal(sortRanges(got), sortRanges(tt.want)); diff != nil {
+				t.Errorf("segments: %v", diff)
+			}
+			if purg := tt.want[len(tt.want)-1]; entry != purg.Start {
+				t.Errorf("entry point = %#x, want %#x", entry, purg.Start)
+			}
+		})
+	}
+}
+
+func sortRanges(rs []kexec.Range) kexec.Ranges {
+	r := kexec.Ranges(append([]kexec.Range(nil), rs...))
+	r.Sort()
+	return r
+}
+
+func TestARM64Purgatory(t *testing.T) {
+	p := arm64PurgatoryPage(0x40280000, 0x40281000)
+
+	// LDR (literal) offsets are in words, relative to the instruction.
+	literal := func(insn int) int {
+		w := binary.LittleEndian.Uint32(p[4*insn:])
+		return 4*insn + 4*int((w>>5)&0x7ffff)
+	}
+	if got := literal(0); got != arm64EntryLiteral {
+		t.Errorf("ldr x17 loads %#x, want %#x", got, arm64EntryLiteral)
+	}
+	if got := literal(1); got != arm64DTBLiteral {
+		t.Errorf("ldr x0 loads %#x, want %#x", got, arm64DTBLiteral)
+	}
+	if got := binary.LittleEndian.Uint64(p[arm64EntryLiteral:]); got != 0x40280000 {
+		t.Errorf("entry = %#x, want 0x40280000", got)
+	}
+	if got := binary.LittleEndian.Uint64(p[arm64DTBLiteral:]); got != 0x40281000 {
+		t.Errorf("dtb = %#x, want 0x40281000", got)
+	}
+}
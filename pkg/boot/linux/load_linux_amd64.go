@@ -0,0 +1,278 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/u-root/u-root/pkg/boot/acpi"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/bzimage"
+)
+
+// Boot protocol constants from Documentation/x86/boot.rst.
+const (
+	// minProtocol is the first version with xloadflags.
+	minProtocol = 0x20c
+
+	// rsdpProtocol is the first version with acpi_rsdp_addr.
+	rsdpProtocol = 0x20e
+
+	// setupDTB is the setup_data type of a device tree.
+	setupDTB = 2
+
+	xlfKernel64     = 1 << 0
+	xlfCanLoadAbove = 1 << 1
+
+	// loaderUndefined is the type_of_loader of boot loaders without an
+	// assigned ID.
+	loaderUndefined = 0xff
+
+	// entry64 is the offset of the 64-bit entry point in the
+	// protected-mode kernel.
+	entry64 = 0x200
+
+	bootParamsSize  = 0x1000
+	acpiRSDPAddrOff = 0x070
+	e820EntriesOff  = 0x1e8
+)
+
+// Placement limits.
+const (
+	// kernelMin keeps relocatable kernels at the address the kernel is
+	// usually linked at and out of the way of low memory.
+	kernelMin = 16 << 20
+
+	// defaultAlignment is used for kernels that don't specify one.
+	defaultAlignment = 2 << 20
+
+	max32 = 1 << 32
+)
+
+var e820Types = map[kexec.RangeType]bzimage.E820Entry{
+	kexec.RangeRAM:  {MemType: bzimage.Ram},
+	kexec.RangeACPI: {MemType: bzimage.ACPI},
+	kexec.RangeNVS:  {MemType: bzimage.NVS},
+}
+
+// KexecLoad loads the bzImage kernel with the given ramfs, cmdline and
+// device tree using the kexec_load syscall. ramfs and dtb may be nil.
+//
+// The kernel is entered through its 64-bit entry point with an e820 memory
+// map from /sys/firmware/memmap. EFI runtime services are not passed on, so
+// the new kernel only finds ACPI through the RSDP address in boot_params.
+// The device tree is passed as setup_data.
+func KexecLoad(kernel, ramfs *os.File, cmdline string, dtb io.ReaderAt) error {
+	k, err := ioutil.ReadAll(kernel)
+	if err != nil {
+		return err
+	}
+	var i []byte
+	if ramfs != nil {
+		if i, err = ioutil.ReadAll(ramfs); err != nil {
+			return err
+		}
+	}
+
+	var d []byte
+	if dtb != nil {
+		if d, err = ioutil.ReadAll(io.NewSectionReader(dtb, 0, math.MaxInt64)); err != nil {
+			return err
+		}
+	}
+
+	var mem kexec.Memory
+	if err := mem.ParseMemoryMap(); err != nil {
+		return fmt.Errorf("parse memory map: %v", err)
+	}
+	var rsdp uint64
+	if r, err := acpi.GetRSDP(); err != nil {
+		Debug("No ACPI RSDP: %v", err)
+	} else {
+		rsdp = r.RSDPAddr()
+	}
+
+	entry, err := loadBzImage(&mem, k, i, cmdline, d, rsdp)
+	if err != nil {
+		return err
+	}
+	Debug("Entry point %#x, segments %v", entry, mem.Segments)
+	return kexec.Load(entry, mem.Segments, 0)
+}
+
+// loadBzImage adds segments for kernel, ramfs, cmdline, dtb, boot_params and
+// the purgatory to mem, and returns the entry point.
+func loadBzImage(mem *kexec.Memory, kernel, ramfs []byte, cmdline string, dtb []byte, rsdp uint64) (uintptr, error) {
+	var hdr bzimage.LinuxHeader
+	if err := binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &hdr); err != nil {
+		return 0, fmt.Errorf("reading bzImage header: %v", err)
+	}
+	if hdr.HeaderMagic != bzimage.HeaderMagic {
+		return 0, errors.New("not a bzImage")
+	}
+	if hdr.Protocolversion < minProtocol {
+		return 0, fmt.Errorf("boot protocol %#x is too old, need %#x", hdr.Protocolversion, minProtocol)
+	}
+	if hdr.XLoadFlags&xlfKernel64 == 0 {
+		return 0, errors.New("kernel has no 64-bit entry point")
+	}
+	if hdr.CmdLineSize != 0 && uint32(len(cmdline)) >= hdr.CmdLineSize {
+		return 0, fmt.Errorf("command line is %d bytes, kernel accepts %d", len(cmdline), hdr.CmdLineSize-1)
+	}
+
+	// The e820 map is the firmware's, before any segments are placed.
+	e820, err := e820Map(mem.Phys)
+	if err != nil {
+		return 0, err
+	}
+
+	// Everything after the real-mode setup code is the protected-mode
+	// kernel, which decompresses itself within init_size bytes.
+	setupSects := int(hdr.SetupSects)
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	setupSize := (setupSects + 1) * 512
+	if len(kernel) <= setupSize {
+		return 0, fmt.Errorf("bzImage is %d bytes, setup code alone is %d", len(kernel), setupSize)
+	}
+	code := kernel[setupSize:]
+	size := uint(hdr.InitSize)
+	if size < uint(len(code)) {
+		size = uint(len(code))
+	}
+
+	var kernelRange kexec.Range
+	if hdr.RelocatableKernel != 0 {
+		align := uintptr(hdr.Kernelalignment)
+		if align == 0 {
+			align = defaultAlignment
+		}
+		kernelRange, err = findAligned(mem.AvailableRAM(), size, align, kexec.RangeFromInterval(kernelMin, kexec.MaxAddr))
+	} else {
+		kernelRange, err = mem.AvailableRAM().FindSpaceIn(size, kexec.Range{Start: uintptr(hdr.PrefAddress), Size: size})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("no space for kernel: %v", err)
+	}
+	mem.Segments.Insert(kexec.NewSegment(code, kernelRange))
+
+	hdr.TypeOfLoader = loaderUndefined
+	hdr.Code32Start = uint32(kernelRange.Start)
+
+	if len(ramfs) > 0 {
+		end := uintptr(hdr.InitrdAddrMax) + 1
+		if hdr.XLoadFlags&xlfCanLoadAbove != 0 {
+			end = kexec.MaxAddr
+		}
+		r, err := addSegment(mem, ramfs, kexec.RangeFromInterval(kexec.M1, end))
+		if err != nil {
+			return 0, fmt.Errorf("no space for initramfs: %v", err)
+		}
+		hdr.RamDiskImage, hdr.ExtRamdiskImage = split(uint64(r.Start))
+		hdr.RamDiskSize, hdr.ExtRamdiskSize = split(uint64(len(ramfs)))
+	} else {
+		hdr.RamDiskImage, hdr.ExtRamdiskImage = 0, 0
+		hdr.RamDiskSize, hdr.ExtRamdiskSize = 0, 0
+	}
+
+	low := kexec.RangeFromInterval(kexec.M1, max32)
+	r, err := addSegment(mem, append([]byte(cmdline), 0), low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for command line: %v", err)
+	}
+	hdr.Cmdlineptr, hdr.ExtCmdlinePtr = split(uint64(r.Start))
+
+	hdr.SetupData = 0
+	if len(dtb) > 0 {
+		r, err := addSegment(mem, setupData(setupDTB, dtb), low)
+		if err != nil {
+			return 0, fmt.Errorf("no space for device tree: %v", err)
+		}
+		hdr.SetupData = uint64(r.Start)
+	}
+
+	params, err := bootParams(hdr, e820, rsdp)
+	if err != nil {
+		return 0, err
+	}
+	paramsRange, err := addSegment(mem, params, low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for boot_params: %v", err)
+	}
+
+	// The purgatory's address must be known to build it.
+	purgRange, err := mem.AvailableRAM().FindSpaceIn(purgatorySize, low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for purgatory: %v", err)
+	}
+	mem.Segments.Insert(kexec.NewSegment(purgatory(purgRange.Start, paramsRange.Start, kernelRange.Start+entry64), purgRange))
+	return purgRange.Start, nil
+}
+
+// bootParams returns the zero page with hdr as its setup header.
+func bootParams(hdr bzimage.LinuxHeader, e820 []bzimage.E820Entry, rsdp uint64) ([]byte, error) {
+	// The parts of the header struct before the setup header are
+	// boot_params fields filled in by the boot loader.
+	hdr.MBRCode = [len(hdr.MBRCode)]uint8{}
+	hdr.O = [len(hdr.O)]uint8{}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, make([]byte, bzimage.E820Map-b.Len())); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, e820); err != nil {
+		return nil, err
+	}
+	params := make([]byte, bootParamsSize)
+	copy(params, b.Bytes())
+	params[e820EntriesOff] = uint8(len(e820))
+	if hdr.Protocolversion >= rsdpProtocol {
+		binary.LittleEndian.PutUint64(params[acpiRSDPAddrOff:], rsdp)
+	}
+	return params, nil
+}
+
+// setupData returns a single setup_data entry.
+func setupData(typ uint32, data []byte) []byte {
+	b := make([]byte, 16+len(data))
+	binary.LittleEndian.PutUint32(b[8:], typ)
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(data)))
+	copy(b[16:], data)
+	return b
+}
+
+// e820Map converts the firmware memory map to e820 entries.
+func e820Map(phys kexec.MemoryMap) ([]bzimage.E820Entry, error) {
+	if len(phys) > bzimage.E820Max {
+		return nil, fmt.Errorf("memory map has %d entries, boot_params holds %d", len(phys), bzimage.E820Max)
+	}
+	var e820 []bzimage.E820Entry
+	for _, r := range phys {
+		e, ok := e820Types[r.Type]
+		if !ok {
+			e.MemType = bzimage.Reserved
+		}
+		e.Addr = uint64(r.Start)
+		e.Size = uint64(r.Size)
+		e820 = append(e820, e)
+	}
+	return e820, nil
+}
+
+// split splits v into its low and high 32 bits.
+func split(v uint64) (uint32, uint32) {
+	return uint32(v), uint32(v >> 32)
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/bzimage"
+)
+
+// testHeader returns the header of a relocatable 64-bit bzImage.
+func testHeader() bzimage.LinuxHeader {
+	return bzimage.LinuxHeader{
+		SetupSects:        1,
+		Bootsectormagic:   0xaa55,
+		HeaderMagic:       bzimage.HeaderMagic,
+		Protocolversion:   0x20f,
+		InitrdAddrMax:     0x7fffffff,
+		Kernelalignment:   0x200000,
+		RelocatableKernel: 1,
+		XLoadFlags:        xlfKernel64,
+		CmdLineSize:       2048,
+		PrefAddress:       0x1000000,
+		InitSize:          0x800000,
+	}
+}
+
+// testKernel returns a bzImage with hdr, one setup sector and a
+// protected-mode kernel of codeSize bytes.
+func testKernel(hdr bzimage.LinuxHeader, codeSize int) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	b.Write(make([]byte, 2*512-b.Len()))
+	b.Write(bytes.Repeat([]byte{0xcc}, codeSize))
+	return b.Bytes()
+}
+
+var testPhys = kexec.MemoryMap{
+	{Range: kexec.RangeFromInterval(0, 0x9f000), Type: kexec.RangeRAM},
+	{Range: kexec.RangeFromInterval(0xf0000, 0x100000), Type: kexec.RangeReserved},
+	{Range: kexec.RangeFromInterval(0x100000, 0x1100000), Type: kexec.RangeRAM},
+	{Range: kexec.RangeFromInterval(0x1100000, 0x1200000), Type: kexec.RangeACPI},
+	{Range: kexec.RangeFromInterval(0x1200000, 0x8000000), Type: kexec.RangeRAM},
+	{Range: kexec.RangeFromInterval(0x100000000, 0x200000000), Type: kexec.RangeRAM},
+}
+
+func TestLoadBzImage(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		modify  func(*bzimage.LinuxHeader)
+		ramfs   int
+		cmdline string
+		dtb     []byte
+
+		// want are the physical ranges of kernel, initramfs and
+		// device tree (if any), command line, boot_params and
+		// purgatory.
+		want []kexec.Range
+		err  string
+	}{
+		{
+			name:    "relocatable",
+			ramfs:   0x3000,
+			cmdline: "console=ttyS0",
+			want: []kexec.Range{
+				// Aligned above 16M, skipping the ACPI tables.
+				{Start: 0x1200000, Size: 0x800000},
+				{Start: 0x100000, Size: 0x3000},
+				{Start: 0x103000, Size: 14},
+				{Start: 0x104000, Size: 0x1000},
+				{Start: 0x105000, Size: 0x1000},
+			},
+		},
+		{
+			name: "device tree",
+			dtb:  make([]byte, 0x100),
+			want: []kexec.Range{
+				{Start: 0x1200000, Size: 0x800000},
+				{Start: 0x100000, Size: 1},
+				{Start: 0x101000, Size: 0x110},
+				{Start: 0x102000, Size: 0x1000},
+				{Start: 0x103000, Size: 0x1000},
+			},
+		},
+		{
+			name: "fixed address",
+			modify: func(h *bzimage.LinuxHeader) {
+				h.RelocatableKernel = 0
+				h.PrefAddress = 0x2000000
+			},
+			want: []kexec.Range{
+				{Start: 0x2000000, Size: 0x800000},
+				{Start: 0x100000, Size: 1},
+				{Start: 0x101000, Size: 0x1000},
+				{Start: 0x102000, Size: 0x1000},
+			},
+		},
+		{
+			name: "fixed address unavailable",
+			modify: func(h *bzimage.LinuxHeader) {
+				h.RelocatableKernel = 0
+				h.PrefAddress = 0x1000000
+			},
+			err: "no space for kernel",
+		},
+		{
+			name: "initramfs above initrd_addr_max",
+			modify: func(h *bzimage.LinuxHeader) {
+				h.InitrdAddrMax = 0x101fff
+			},
+			ramfs: 0x3000,
+			err:   "no space for initramfs",
+		},
+		{
+			name:   "old protocol",
+			modify: func(h *bzimage.LinuxHeader) { h.Protocolversion = 0x20a },
+			err:    "too old",
+		},
+		{
+			name:   "32-bit only",
+			modify: func(h *bzimage.LinuxHeader) { h.XLoadFlags = 0 },
+			err:    "no 64-bit entry point",
+		},
+		{
+			name:   "not a bzImage",
+			modify: func(h *bzimage.LinuxHeader) { h.HeaderMagic = [4]uint8{} },
+			err:    "not a bzImage",
+		},
+		{
+			name:    "command line too long",
+			modify:  func(h *bzimage.LinuxHeader) { h.CmdLineSize = 8 },
+			cmdline: "console=ttyS0",
+			err:     "command line is 13 bytes",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader()
+			if tt.modify != nil {
+				tt.modify(&hdr)
+			}
+			mem := kexec.Memory{Phys: testPhys}
+			entry, err := loadBzImage(&mem, testKernel(hdr, 0x1000), make([]byte, tt.ramfs), tt.cmdline, tt.dtb, 0)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("loadBzImage() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadBzImage() = %v", err)
+			}
+
+			var got []kexec.Range
+			for _, s := range mem.Segments {
+				got = append(got, s.Phys)
+			}
+			if diff := deep.Equal(sortRanges(got), sortRanges(tt.want)); diff != nil {
+				t.Errorf("segments: %v", diff)
+			}
+			if purg := tt.want[len(tt.want)-1]; entry != purg.Start {
+				t.Errorf("entry point = %#x, want %#x", entry, purg.Start)
+			}
+		})
+	}
+}
+
+func TestBootParams(t *testing.T) {
+	hdr := testHeader()
+	hdr.MBRCode[0] = 0xeb
+	hdr.RamDiskImage, hdr.ExtRamdiskImage = split(0x123456789)
+	hdr.Cmdlineptr = 0x100000
+	e820, err := e820Map(testPhys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := bootParams(hdr, e820, 0xf5a40)
+	if err != nil {
+		t.Fatalf("bootParams() = %v", err)
+	}
+	if len(p) != bootParamsSize {
+		t.Fatalf("boot_params is %d bytes, want %d", len(p), bootParamsSize)
+	}
+	le := binary.LittleEndian
+	for _, f := range []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{"screen_info", uint64(p[0]), 0},
+		{"acpi_rsdp_addr", le.Uint64(p[0x70:]), 0xf5a40},
+		{"ext_ramdisk_image", uint64(le.Uint32(p[0xc0:])), 0x1},
+		{"e820_entries", uint64(p[0x1e8]), uint64(len(testPhys))},
+		{"boot_flag", uint64(le.Uint16(p[0x1fe:])), 0xaa55},
+		{"version", uint64(le.Uint16(p[0x206:])), 0x20f},
+		{"ramdisk_image", uint64(le.Uint32(p[0x218:])), 0x23456789},
+		{"cmd_line_ptr", uint64(le.Uint32(p[0x228:])), 0x100000},
+		{"e820_table[3].addr", le.Uint64(p[0x2d0+3*20:]), 0x1100000},
+		{"e820_table[3].size", le.Uint64(p[0x2d0+3*20+8:]), 0x100000},
+		{"e820_table[3].type", uint64(le.Uint32(p[0x2d0+3*20+16:])), uint64(bzimage.ACPI)},
+		{"e820_table[1].type", uint64(le.Uint32(p[0x2d0+1*20+16:])), uint64(bzimage.Reserved)},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s = %#x, want %#x", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestPurgatory(t *testing.T) {
+	const (
+		addr       = 0x105000
+		bootParams = 0x104000
+		entry      = 0x1200200
+	)
+	p := purgatory(addr, bootParams, entry)
+	le := binary.LittleEndian
+
+	// RIP-relative targets are relative to the next instruction.
+	target := func(off int) int {
+		return off + 4 + int(int32(le.Uint32(p[off:])))
+	}
+	if got := target(gdtrRel); got != purgatoryGDTR {
+		t.Errorf("lgdt operand = %#x, want %#x", got, purgatoryGDTR)
+	}
+	if got := target(stackRel); got != purgatorySize {
+		t.Errorf("stack = %#x, want %#x", got, purgatorySize)
+	}
+	if got := target(farReturnRel); got != farReturnDest {
+		t.Errorf("far return to %#x, want %#x", got, farReturnDest)
+	}
+	if got := le.Uint64(p[bootParamsImm:]); got != bootParams {
+		t.Errorf("rsi = %#x, want %#x", got, bootParams)
+	}
+	if got := le.Uint64(p[entryImm:]); got != entry {
+		t.Errorf("entry = %#x, want %#x", got, entry)
+	}
+	if got, want := le.Uint16(p[purgatoryGDTR:]), uint16(len(gdt)*8-1); got != want {
+		t.Errorf("GDT limit = %#x, want %#x", got, want)
+	}
+	if got := le.Uint64(p[purgatoryGDTR+2:]); got != addr+purgatoryGDT {
+		t.Errorf("GDT base = %#x, want %#x", got, addr+purgatoryGDT)
+	}
+	// __BOOT_CS and __BOOT_DS.
+	if got := le.Uint64(p[purgatoryGDT+0x10:]); got != gdt[2] {
+		t.Errorf("GDT[0x10] = %#x, want %#x", got, gdt[2])
+	}
+	if got := le.Uint64(p[purgatoryGDT+0x18:]); got != gdt[3] {
+		t.Errorf("GDT[0x18] = %#x, want %#x", got, gdt[3])
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/dt"
+)
+
+// currentDTB is the device tree the running kernel was booted with.
+const currentDTB = "/sys/firmware/fdt"
+
+// KexecLoad loads the arm64 Image kernel with the given ramfs, cmdline and
+// device tree using the kexec_load syscall. ramfs and dtb may be nil.
+//
+// If dtb is nil, the device tree of the running kernel is used. The /chosen
+// node of the device tree is updated with the command line and initramfs.
+func KexecLoad(kernel, ramfs *os.File, cmdline string, dtb io.ReaderAt) error {
+	k, err := ioutil.ReadAll(kernel)
+	if err != nil {
+		return err
+	}
+	var i []byte
+	if ramfs != nil {
+		if i, err = ioutil.ReadAll(ramfs); err != nil {
+			return err
+		}
+	}
+
+	if dtb == nil {
+		f, err := os.Open(currentDTB)
+		if err != nil {
+			return fmt.Errorf("no device tree given and %v", err)
+		}
+		defer f.Close()
+		dtb = f
+	}
+	fdt, err := dt.ReadFDT(io.NewSectionReader(dtb, 0, math.MaxInt64))
+	if err != nil {
+		return fmt.Errorf("reading device tree: %v", err)
+	}
+
+	phys, err := kexec.ParseIOMem()
+	if err != nil {
+		return fmt.Errorf("parse memory map: %v", err)
+	}
+	mem := kexec.Memory{Phys: phys}
+
+	entry, err := loadImage(&mem, k, i, cmdline, fdt)
+	if err != nil {
+		return err
+	}
+	Debug("Entry point %#x, segments %v", entry, mem.Segments)
+	return kexec.Load(entry, mem.Segments, 0)
+}
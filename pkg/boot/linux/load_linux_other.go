@@ -0,0 +1,18 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,!amd64,!arm64
+
+package linux
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// KexecLoad is not implemented on this architecture.
+func KexecLoad(kernel, ramfs *os.File, cmdline string, dtb io.ReaderAt) error {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// Debug prints the memory layout of the loaded kernel.
+var Debug = func(string, ...interface{}) {}
+
+// addSegment adds a segment with d to mem within limit.
+func addSegment(mem *kexec.Memory, d []byte, limit kexec.Range) (kexec.Range, error) {
+	r, err := mem.AvailableRAM().FindSpaceIn(uint(len(d)), limit)
+	if err != nil {
+		return kexec.Range{}, err
+	}
+	mem.Segments.Insert(kexec.NewSegment(d, r))
+	return r, nil
+}
+
+// findAligned finds sz bytes in rs within limit that start at a multiple of
+// align.
+func findAligned(rs kexec.Ranges, sz uint, align uintptr, limit kexec.Range) (kexec.Range, error) {
+	for _, r := range rs {
+		overlap := r.Intersect(limit)
+		if overlap == nil {
+			continue
+		}
+		start := (overlap.Start + align - 1) &^ (align - 1)
+		if start >= overlap.Start && start < overlap.End() && uint(overlap.End()-start) >= sz {
+			return kexec.Range{Start: start, Size: sz}, nil
+		}
+	}
+	return kexec.Range{}, kexec.ErrNotEnoughSpace{Size: sz}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"encoding/binary"
+)
+
+// After kexec_load's relocate_kernel, the CPU is in 64-bit mode with an
+// identity mapping of memory, but the GDT and stack belong to the old
+// kernel and may have been overwritten by the new segments. The purgatory
+// sets up the machine state the 64-bit boot protocol expects and jumps to
+// the kernel:
+//
+//	cli
+//	lgdt	gdtr(%rip)
+//	movl	$0x18, %eax
+//	movl	%eax, %ds
+//	movl	%eax, %es
+//	movl	%eax, %ss
+//	movl	%eax, %fs
+//	movl	%eax, %gs
+//	leaq	stack(%rip), %rsp
+//	pushq	$0x10
+//	leaq	1f(%rip), %rax
+//	pushq	%rax
+//	lretq
+//	1:
+//	movabsq	$bootParams, %rsi
+//	movabsq	$entry, %rax
+//	xorl	%ebp, %ebp
+//	xorl	%edi, %edi
+//	xorl	%ebx, %ebx
+//	jmpq	*%rax
+var purgatoryCode = []byte{
+	0xfa,
+	0x0f, 0x01, 0x15, 0, 0, 0, 0,
+	0xb8, 0x18, 0x00, 0x00, 0x00,
+	0x8e, 0xd8,
+	0x8e, 0xc0,
+	0x8e, 0xd0,
+	0x8e, 0xe0,
+	0x8e, 0xe8,
+	0x48, 0x8d, 0x25, 0, 0, 0, 0,
+	0x6a, 0x10,
+	0x48, 0x8d, 0x05, 0, 0, 0, 0,
+	0x50,
+	0x48, 0xcb,
+	0x48, 0xbe, 0, 0, 0, 0, 0, 0, 0, 0,
+	0x48, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0,
+	0x31, 0xed,
+	0x31, 0xff,
+	0x31, 0xdb,
+	0xff, 0xe0,
+}
+
+// Offsets of the operands in purgatoryCode.
+const (
+	gdtrRel       = 0x04
+	stackRel      = 0x1a
+	farReturnRel  = 0x23
+	farReturnDest = 0x2a
+	bootParamsImm = 0x2c
+	entryImm      = 0x36
+)
+
+// Layout of the purgatory page.
+const (
+	purgatoryGDT  = 0x80
+	purgatoryGDTR = 0xa0
+	purgatorySize = 0x1000
+)
+
+// gdt has the __BOOT_CS and __BOOT_DS flat segments of the boot protocol
+// at selectors 0x10 and 0x18.
+var gdt = []uint64{
+	0,
+	0,
+	0x00af9a000000ffff, // 64-bit code
+	0x00cf92000000ffff, // data
+}
+
+// purgatory returns the purgatory page to be loaded at addr, which jumps to
+// entry with boot_params at bootParams.
+func purgatory(addr, bootParams, entry uintptr) []byte {
+	p := make([]byte, purgatorySize)
+	copy(p, purgatoryCode)
+
+	// RIP-relative operands are the last 4 bytes of their instruction.
+	rel := func(off, target int) {
+		binary.LittleEndian.PutUint32(p[off:], uint32(int32(target-(off+4))))
+	}
+	rel(gdtrRel, purgatoryGDTR)
+	rel(stackRel, purgatorySize)
+	rel(farReturnRel, farReturnDest)
+	binary.LittleEndian.PutUint64(p[bootParamsImm:], uint64(bootParams))
+	binary.LittleEndian.PutUint64(p[entryImm:], uint64(entry))
+
+	for i, d := range gdt {
+		binary.LittleEndian.PutUint64(p[purgatoryGDT+8*i:], d)
+	}
+	binary.LittleEndian.PutUint16(p[purgatoryGDTR:], uint16(8*len(gdt)-1))
+	binary.LittleEndian.PutUint64(p[purgatoryGDTR+2:], uint64(addr+purgatoryGDT))
+	return p
+}
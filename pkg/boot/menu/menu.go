@@ -0,0 +1,408 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package menu implements an interactive console boot menu.
+//
+// The menu lists OSImages from any source. Entries are selected with the
+// arrow keys or by typing their number, and booted with Enter. Pressing e
+// edits the kernel command line of the selected entry before booting it.
+// Unless a key is pressed, the default entry is chosen when the timeout
+// expires.
+//
+// The terminal is expected to be in raw mode, see termios.TTY.Raw.
+package menu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// ErrNoImages is returned by Choose when there is nothing to choose from.
+var ErrNoImages = errors.New("no bootable images")
+
+// Config configures a menu.
+type Config struct {
+	// Title is displayed above the entries.
+	Title string
+
+	// Default is the index of the entry chosen when the timeout expires.
+	Default int
+
+	// Timeout is how long to wait for a key press before choosing the
+	// default entry. Zero chooses the default entry without displaying
+	// the menu, and a negative timeout waits forever.
+	Timeout time.Duration
+}
+
+// Keys as decoded from terminal input.
+const (
+	keyNone = iota
+	keyUp
+	keyDown
+	keyEnter
+	keyBackspace
+	keyEscape
+	keyInterrupt
+	keyKillLine
+	keyRune
+)
+
+type key struct {
+	kind int
+	r    byte
+}
+
+// escapeDelay is how long to wait for the rest of an escape sequence before
+// treating ESC as a key of its own.
+const escapeDelay = 50 * time.Millisecond
+
+// keyReader decodes terminal input into keys.
+type keyReader struct {
+	bytes <-chan byte
+
+	// eof is set once the input is exhausted.
+	eof bool
+}
+
+func newKeyReader(in io.Reader) *keyReader {
+	c := make(chan byte)
+	go func() {
+		defer close(c)
+		b := make([]byte, 1)
+		for {
+			if _, err := in.Read(b); err != nil {
+				return
+			}
+			c <- b[0]
+		}
+	}()
+	return &keyReader{bytes: c}
+}
+
+// next returns the next key, or keyNone when the timer fires or input ends.
+// A nil timer never fires.
+func (kr *keyReader) next(timer <-chan time.Time) key {
+	if kr.eof {
+		if timer != nil {
+			<-timer
+		}
+		return key{}
+	}
+	var b byte
+	select {
+	case <-timer:
+		return key{}
+	case c, ok := <-kr.bytes:
+		if !ok {
+			kr.eof = true
+			return key{}
+		}
+		b = c
+	}
+
+	switch b {
+	case '\r', '\n':
+		return key{kind: keyEnter}
+	case 0x7f, 0x08:
+		return key{kind: keyBackspace}
+	case 0x03:
+		return key{kind: keyInterrupt}
+	case 0x15:
+		return key{kind: keyKillLine}
+	case 0x1b:
+		return kr.escape()
+	}
+	return key{kind: keyRune, r: b}
+}
+
+// escape decodes the VT100 arrow key sequences ESC [ A and ESC O A.
+func (kr *keyReader) escape() key {
+	var seq []byte
+	for len(seq) < 2 {
+		select {
+		case c, ok := <-kr.bytes:
+			if !ok {
+				kr.eof = true
+				return key{kind: keyEscape}
+			}
+			seq = append(seq, c)
+		case <-time.After(escapeDelay):
+			return key{kind: keyEscape}
+		}
+		if seq[0] != '[' && seq[0] != 'O' {
+			return key{kind: keyEscape}
+		}
+	}
+	switch seq[1] {
+	case 'A':
+		return key{kind: keyUp}
+	case 'B':
+		return key{kind: keyDown}
+	}
+	return key{}
+}
+
+type menu struct {
+	cfg    Config
+	images []boot.OSImage
+	keys   *keyReader
+	out    io.Writer
+
+	selected int
+
+	// number are the digits typed so far.
+	number string
+
+	// message is displayed below the entries.
+	message string
+}
+
+// Choose displays images on out and returns the one chosen with the input
+// from in.
+//
+// If the user edited the command line, a modified copy of the image is
+// returned. If in reaches EOF and the timeout is negative, the default entry
+// is chosen rather than waiting forever.
+func Choose(in io.Reader, out io.Writer, cfg Config, images []boot.OSImage) (boot.OSImage, error) {
+	if len(images) == 0 {
+		return nil, ErrNoImages
+	}
+	if cfg.Default < 0 || cfg.Default >= len(images) {
+		cfg.Default = 0
+	}
+	if cfg.Timeout == 0 {
+		return images[cfg.Default], nil
+	}
+
+	return newMenu(in, out, cfg, images).run()
+}
+
+// ChooseAndLoad is like Choose, but also loads the chosen image. If loading
+// fails, the error is displayed and the menu is shown again without timeout.
+//
+// ChooseAndLoad returns the loaded image. Call boot.Execute to boot it.
+func ChooseAndLoad(in io.Reader, out io.Writer, cfg Config, images []boot.OSImage, verbose bool) (boot.OSImage, error) {
+	if len(images) == 0 {
+		return nil, ErrNoImages
+	}
+	if cfg.Default < 0 || cfg.Default >= len(images) {
+		cfg.Default = 0
+	}
+
+	var m *menu
+	for {
+		var img boot.OSImage
+		if cfg.Timeout == 0 && m == nil {
+			img = images[cfg.Default]
+		} else {
+			if m == nil {
+				m = newMenu(in, out, cfg, images)
+			}
+			var err error
+			if img, err = m.run(); err != nil {
+				return nil, err
+			}
+		}
+
+		fmt.Fprintf(out, "Loading %s\r\n", img.Label())
+		err := img.Load(verbose)
+		if err == nil {
+			return img, nil
+		}
+		if m == nil {
+			m = newMenu(in, out, cfg, images)
+		}
+		m.message = fmt.Sprintf("Failed to load %s: %v", img.Label(), err)
+		// Don't try the same entry again automatically.
+		m.cfg.Timeout = -1
+		if m.keys.eof {
+			return nil, err
+		}
+	}
+}
+
+func newMenu(in io.Reader, out io.Writer, cfg Config, images []boot.OSImage) *menu {
+	return &menu{
+		cfg:      cfg,
+		images:   images,
+		keys:     newKeyReader(in),
+		out:      out,
+		selected: cfg.Default,
+	}
+}
+
+func (m *menu) printf(format string, args ...interface{}) {
+	fmt.Fprintf(m.out, format, args...)
+}
+
+// draw clears the screen and displays the entries. Raw mode terminals do not
+// translate \n, hence the explicit \r.
+func (m *menu) draw() {
+	m.printf("\033[H\033[2J")
+	if len(m.cfg.Title) > 0 {
+		m.printf("%s\r\n\r\n", m.cfg.Title)
+	}
+	for i, img := range m.images {
+		marker := " "
+		if i == m.selected {
+			marker = ">"
+		}
+		m.printf(" %s %2d. %s\r\n", marker, i+1, img.Label())
+	}
+	m.printf("\r\nUse the arrow keys or type a number to select an entry, Enter to boot it,\r\n")
+	m.printf("or e to edit its command line.\r\n")
+	if len(m.message) > 0 {
+		m.printf("\r\n%s\r\n", m.message)
+	}
+	if len(m.number) > 0 {
+		m.printf("Entry: %s", m.number)
+	}
+}
+
+// countdown displays the remaining time on the last line.
+func (m *menu) countdown(remaining time.Duration) {
+	m.printf("\r\033[KBooting %q in %ds.", m.images[m.cfg.Default].Label(), int((remaining+time.Second-1)/time.Second))
+}
+
+func (m *menu) run() (boot.OSImage, error) {
+	m.draw()
+
+	// Count down until the first key press.
+	if m.cfg.Timeout > 0 {
+		deadline := time.Now().Add(m.cfg.Timeout)
+		for {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				m.printf("\r\n")
+				return m.images[m.cfg.Default], nil
+			}
+			m.countdown(remaining)
+			tick := remaining % time.Second
+			if tick == 0 {
+				tick = time.Second
+			}
+			k := m.keys.next(time.After(tick))
+			if k.kind != keyNone {
+				if img, done := m.handle(k); done {
+					return img, nil
+				}
+				break
+			}
+		}
+	}
+
+	for {
+		k := m.keys.next(nil)
+		if k.kind == keyNone && m.keys.eof {
+			m.printf("\r\n")
+			return m.images[m.selected], nil
+		}
+		if img, done := m.handle(k); done {
+			return img, nil
+		}
+	}
+}
+
+// handle processes a key press in the menu. It returns true once an image
+// has been chosen.
+func (m *menu) handle(k key) (boot.OSImage, bool) {
+	switch k.kind {
+	case keyUp:
+		m.number = ""
+		if m.selected > 0 {
+			m.selected--
+		}
+	case keyDown:
+		m.number = ""
+		if m.selected < len(m.images)-1 {
+			m.selected++
+		}
+	case keyEnter:
+		m.number = ""
+		m.printf("\r\n")
+		return m.images[m.selected], true
+	case keyBackspace:
+		if len(m.number) > 0 {
+			m.number = m.number[:len(m.number)-1]
+			m.selectNumber()
+		}
+	case keyRune:
+		switch {
+		case k.r >= '0' && k.r <= '9':
+			m.number += string(k.r)
+			m.selectNumber()
+		case k.r == 'e':
+			if img, ok := m.edit(m.images[m.selected]); ok {
+				return img, true
+			}
+		}
+	}
+	m.draw()
+	return nil, false
+}
+
+// selectNumber selects the entry typed so far, if it exists.
+func (m *menu) selectNumber() {
+	n, err := strconv.Atoi(m.number)
+	if err != nil || n < 1 || n > len(m.images) {
+		return
+	}
+	m.selected = n - 1
+}
+
+// edit lets the user change the command line of img. It returns a copy of
+// img with the new command line, or false if editing was cancelled or img
+// has no command line.
+func (m *menu) edit(img boot.OSImage) (boot.OSImage, bool) {
+	var (
+		cmdline *string
+		edited  boot.OSImage
+	)
+	switch i := img.(type) {
+	case *boot.LinuxImage:
+		c := *i
+		cmdline, edited = &c.Cmdline, &c
+	case *boot.MultibootImage:
+		c := *i
+		cmdline, edited = &c.Cmdline, &c
+	default:
+		return nil, false
+	}
+
+	m.printf("\033[H\033[2J")
+	m.printf("Editing the command line of %q.\r\n", img.Label())
+	m.printf("Press Enter to boot, Esc or Ctrl-C to cancel.\r\n\r\n")
+	line := []byte(*cmdline)
+	for {
+		m.printf("\r\033[K> %s", line)
+		k := m.keys.next(nil)
+		switch k.kind {
+		case keyNone:
+			if m.keys.eof {
+				return nil, false
+			}
+		case keyEnter:
+			m.printf("\r\n")
+			*cmdline = string(line)
+			return edited, true
+		case keyEscape, keyInterrupt:
+			return nil, false
+		case keyBackspace:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case keyKillLine:
+			line = line[:0]
+		case keyRune:
+			if k.r >= ' ' {
+				line = append(line, k.r)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package menu
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+func TestChoose(t *testing.T) {
+	images := []boot.OSImage{
+		&boot.LinuxImage{Name: "one", Cmdline: "root=/dev/sda1"},
+		&boot.LinuxImage{Name: "two", Cmdline: "root=/dev/sda2"},
+		&boot.LinuxImage{Name: "three", Cmdline: "root=/dev/sda3"},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		input       string
+		cfg         Config
+		want        string
+		wantCmdline string
+	}{
+		{
+			name:  "no timeout",
+			input: "\r",
+			cfg:   Config{Default: 1},
+			want:  "two",
+		},
+		{
+			name: "timeout expires",
+			cfg:  Config{Default: 2, Timeout: 20 * time.Millisecond},
+			want: "three",
+		},
+		{
+			name: "invalid default",
+			cfg:  Config{Default: 3, Timeout: 20 * time.Millisecond},
+			want: "one",
+		},
+		{
+			name:  "enter",
+			input: "\r",
+			cfg:   Config{Default: 1, Timeout: time.Hour},
+			want:  "two",
+		},
+		{
+			name:  "arrows",
+			input: "\033[B\033[B\033[B\033OA\n",
+			cfg:   Config{Timeout: time.Hour},
+			want:  "two",
+		},
+		{
+			name:  "number",
+			input: "3\r",
+			cfg:   Config{Timeout: -1},
+			want:  "three",
+		},
+		{
+			name:  "number with backspace",
+			input: "32\x7f\r",
+			cfg:   Config{Timeout: -1},
+			want:  "three",
+		},
+		{
+			name:  "out of range number",
+			input: "9\r",
+			cfg:   Config{Default: 1, Timeout: -1},
+			want:  "two",
+		},
+		{
+			name:  "eof chooses the selection",
+			input: "\033[A",
+			cfg:   Config{Default: 1, Timeout: -1},
+			want:  "one",
+		},
+		{
+			name:        "edit",
+			input:       "2e\x7f3 quiet\r",
+			cfg:         Config{Timeout: -1},
+			want:        "two",
+			wantCmdline: "root=/dev/sda3 quiet",
+		},
+		{
+			name:        "edit kill line",
+			input:       "3e\x15console=ttyS0\r",
+			cfg:         Config{Timeout: -1},
+			want:        "three",
+			wantCmdline: "console=ttyS0",
+		},
+		{
+			name:  "edit cancelled",
+			input: "e\x03\033[B\r",
+			cfg:   Config{Timeout: -1},
+			want:  "two",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			got, err := Choose(strings.NewReader(tt.input), &out, tt.cfg, images)
+			if err != nil {
+				t.Fatalf("Choose() = %v", err)
+			}
+			if got.Label() != tt.want {
+				t.Errorf("Choose() = %s, want %s", got.Label(), tt.want)
+			}
+
+			if len(tt.wantCmdline) > 0 {
+				if cmdline := got.(*boot.LinuxImage).Cmdline; cmdline != tt.wantCmdline {
+					t.Errorf("Cmdline = %q, want %q", cmdline, tt.wantCmdline)
+				}
+				for _, img := range images {
+					if img == got {
+						t.Errorf("edited image was modified in place")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChooseNoImages(t *testing.T) {
+	if _, err := Choose(strings.NewReader(""), ioutil.Discard, Config{}, nil); err != ErrNoImages {
+		t.Errorf("Choose() = %v, want %v", err, ErrNoImages)
+	}
+}
+
+func TestDraw(t *testing.T) {
+	var out bytes.Buffer
+	images := []boot.OSImage{
+		&boot.LinuxImage{Name: "one"},
+		&boot.LinuxImage{Name: "two"},
+	}
+	if _, err := Choose(strings.NewReader("\033[B\r"), &out, Config{Title: "Boot menu", Timeout: time.Hour}, images); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Boot menu\r\n", " >  1. one\r\n", " >  2. two\r\n", `Booting "one" in 3600s.`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+type fakeImage struct {
+	name   string
+	err    error
+	loaded bool
+}
+
+func (f *fakeImage) Label() string  { return f.name }
+func (f *fakeImage) String() string { return f.name }
+func (f *fakeImage) Load(bool) error {
+	f.loaded = true
+	return f.err
+}
+
+func TestChooseAndLoad(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		input   string
+		cfg     Config
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			cfg:  Config{Default: 0},
+			want: "good",
+		},
+		{
+			name:  "retry after failure",
+			input: "2\r1\r",
+			cfg:   Config{Timeout: time.Hour},
+			want:  "good",
+		},
+		{
+			name:  "failure without timeout",
+			input: "1\r",
+			cfg:   Config{Default: 1},
+			want:  "good",
+		},
+		{
+			name:    "failure at eof",
+			cfg:     Config{Default: 1, Timeout: time.Millisecond},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := &fakeImage{name: "bad", err: errors.New("broken")}
+			images := []boot.OSImage{&fakeImage{name: "good"}, bad}
+
+			var out bytes.Buffer
+			got, err := ChooseAndLoad(strings.NewReader(tt.input), &out, tt.cfg, images, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ChooseAndLoad() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Label() != tt.want || !got.(*fakeImage).loaded {
+				t.Errorf("ChooseAndLoad() = %s (loaded %t), want %s", got.Label(), got.(*fakeImage).loaded, tt.want)
+			}
+			if bad.loaded && !strings.Contains(out.String(), "Failed to load bad: broken") {
+				t.Errorf("output %q does not contain the load error", out.String())
+			}
+		})
+	}
+}
@@ -15,6 +15,9 @@ import (
 
 // MultibootImage is a multiboot-formated OSImage, such as ESXi, Xen, Akaros,
 // tboot.
+//
+// Kernels with a Multiboot2 header are loaded with Multiboot2, others with
+// Multiboot v1.
 type MultibootImage struct {
 	Name string
 
@@ -0,0 +1,101 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	_FBIOGET_VSCREENINFO = 0x4600
+	_FBIOGET_FSCREENINFO = 0x4602
+
+	_FB_VISUAL_TRUECOLOR = 2
+)
+
+// fbBitfield is struct fb_bitfield from linux/fb.h.
+type fbBitfield struct {
+	Offset   uint32
+	Length   uint32
+	MSBRight uint32
+}
+
+// fbVarScreenInfo is struct fb_var_screeninfo from linux/fb.h.
+type fbVarScreenInfo struct {
+	XRes, YRes               uint32
+	XResVirtual, YResVirtual uint32
+	XOffset, YOffset         uint32
+	BitsPerPixel             uint32
+	Grayscale                uint32
+	Red, Green, Blue, Transp fbBitfield
+	NonStd                   uint32
+	Activate                 uint32
+	Height, Width            uint32
+	AccelFlags               uint32
+	Timings                  [13]uint32
+	Colorspace               uint32
+	Reserved                 [4]uint32
+}
+
+// fbFixScreenInfo is struct fb_fix_screeninfo from linux/fb.h.
+type fbFixScreenInfo struct {
+	ID           [16]byte
+	SMemStart    uintptr
+	SMemLen      uint32
+	Type         uint32
+	TypeAux      uint32
+	Visual       uint32
+	XPanStep     uint16
+	YPanStep     uint16
+	YWrapStep    uint16
+	LineLength   uint32
+	MMIOStart    uintptr
+	MMIOLen      uint32
+	Accel        uint32
+	Capabilities uint16
+	Reserved     [2]uint16
+}
+
+// framebufferDevice is the Linux framebuffer passed on to Multiboot2 kernels.
+var framebufferDevice = "/dev/fb0"
+
+// currentFramebuffer returns the linear framebuffer Linux is using, so that
+// the kernel can keep using it without setting a video mode.
+func currentFramebuffer() (*Framebuffer, error) {
+	f, err := os.Open(framebufferDevice)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fix fbFixScreenInfo
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), _FBIOGET_FSCREENINFO, uintptr(unsafe.Pointer(&fix))); errno != 0 {
+		return nil, fmt.Errorf("FBIOGET_FSCREENINFO: %v", errno)
+	}
+	var v fbVarScreenInfo
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), _FBIOGET_VSCREENINFO, uintptr(unsafe.Pointer(&v))); errno != 0 {
+		return nil, fmt.Errorf("FBIOGET_VSCREENINFO: %v", errno)
+	}
+	if fix.Visual != _FB_VISUAL_TRUECOLOR {
+		return nil, fmt.Errorf("%s is not a true color framebuffer", framebufferDevice)
+	}
+	return &Framebuffer{
+		Addr:          uint64(fix.SMemStart),
+		Pitch:         fix.LineLength,
+		Width:         v.XRes,
+		Height:        v.YRes,
+		BPP:           uint8(v.BitsPerPixel),
+		RedPosition:   uint8(v.Red.Offset),
+		RedMaskSize:   uint8(v.Red.Length),
+		GreenPosition: uint8(v.Green.Offset),
+		GreenMaskSize: uint8(v.Green.Length),
+		BluePosition:  uint8(v.Blue.Offset),
+		BlueMaskSize:  uint8(v.Blue.Length),
+	}, nil
+}
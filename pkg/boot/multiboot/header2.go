@@ -0,0 +1,201 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/u-root/u-root/pkg/ubinary"
+)
+
+const (
+	header2Magic = 0xE85250D6
+
+	// header2Search is how far into the OS image the Multiboot2 header
+	// may start.
+	header2Search = 32768
+
+	// archI386 is the 32-bit (protected mode) i386 architecture.
+	archI386 = 0
+)
+
+// Multiboot2 header tag types, see
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#Header-tags.
+const (
+	headerTagEnd                = 0
+	headerTagInformationRequest = 1
+	headerTagAddress            = 2
+	headerTagEntryAddress       = 3
+	headerTagConsoleFlags       = 4
+	headerTagFramebuffer        = 5
+	headerTagModuleAlign        = 6
+	headerTagEFIBS              = 7
+	headerTagEntryAddressEFI32  = 8
+	headerTagEntryAddressEFI64  = 9
+	headerTagRelocatable        = 10
+
+	// headerTagOptional is the header tag flag marking tags the boot
+	// loader may ignore.
+	headerTagOptional = 1
+
+	sizeofHeaderTag = 8
+
+	// tagAlignment is the alignment of both header and info tags.
+	tagAlignment = 8
+)
+
+// mandatory2 is the fixed part of the Multiboot2 header.
+type mandatory2 struct {
+	Magic        uint32
+	Architecture uint32
+	HeaderLength uint32
+	Checksum     uint32
+}
+
+// headerTag is the common part of all Multiboot2 header tags.
+type headerTag struct {
+	Type  uint16
+	Flags uint16
+	Size  uint32
+}
+
+// addressTag is the body of the address header tag, used to load non-ELF
+// kernels.
+type addressTag struct {
+	HeaderAddr  uint32
+	LoadAddr    uint32
+	LoadEndAddr uint32
+	BSSEndAddr  uint32
+}
+
+// header2 represents a Multiboot2 header loaded from the file.
+type header2 struct {
+	mandatory2
+
+	// offset is the file offset of the header.
+	offset int
+
+	// infoRequests are the boot information tag types the kernel asks
+	// for. If infoRequired is set, the kernel cannot boot without them.
+	infoRequests []uint32
+	infoRequired bool
+
+	// address is set if the kernel gave an address tag.
+	address *addressTag
+
+	// entry is the entry address tag value, if hasEntry.
+	entry    uint32
+	hasEntry bool
+
+	// framebuffer is set if the kernel prefers a graphics console.
+	framebuffer bool
+}
+
+// parseHeader2 parses the Multiboot2 header as defined in
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#OS-image-format
+func parseHeader2(r io.Reader) (*header2, error) {
+	sizeofMandatory := binary.Size(mandatory2{})
+	buf := make([]byte, header2Search)
+	n, err := io.ReadAtLeast(r, buf, sizeofMandatory)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	// The Multiboot2 header must be 64-bit aligned.
+	for off := 0; off+sizeofMandatory <= len(buf); off += 8 {
+		var m mandatory2
+		if err := binary.Read(bytes.NewReader(buf[off:]), ubinary.NativeEndian, &m); err != nil {
+			return nil, err
+		}
+		if m.Magic != header2Magic || m.Magic+m.Architecture+m.HeaderLength+m.Checksum != 0 {
+			continue
+		}
+		if m.Architecture != archI386 {
+			return nil, fmt.Errorf("multiboot2: unsupported architecture %d", m.Architecture)
+		}
+		end := off + int(m.HeaderLength)
+		if end > len(buf) || int(m.HeaderLength) < sizeofMandatory {
+			return nil, fmt.Errorf("multiboot2: header length %d out of bounds", m.HeaderLength)
+		}
+		h := &header2{mandatory2: m, offset: off}
+		if err := h.parseTags(buf[off+sizeofMandatory : end]); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	return nil, ErrHeaderNotFound
+}
+
+// parseTags parses the tags following the fixed part of the header.
+func (h *header2) parseTags(b []byte) error {
+	for len(b) >= sizeofHeaderTag {
+		var tag headerTag
+		if err := binary.Read(bytes.NewReader(b), ubinary.NativeEndian, &tag); err != nil {
+			return err
+		}
+		if tag.Type == headerTagEnd {
+			return nil
+		}
+		if int(tag.Size) < sizeofHeaderTag || int(tag.Size) > len(b) {
+			return fmt.Errorf("multiboot2: header tag %d has invalid size %d", tag.Type, tag.Size)
+		}
+		body := bytes.NewReader(b[sizeofHeaderTag:tag.Size])
+		optional := tag.Flags&headerTagOptional != 0
+
+		switch tag.Type {
+		case headerTagInformationRequest:
+			h.infoRequests = make([]uint32, body.Len()/4)
+			if err := binary.Read(body, ubinary.NativeEndian, h.infoRequests); err != nil {
+				return err
+			}
+			h.infoRequired = !optional
+
+		case headerTagAddress:
+			h.address = &addressTag{}
+			if err := binary.Read(body, ubinary.NativeEndian, h.address); err != nil {
+				return fmt.Errorf("multiboot2: address tag: %v", err)
+			}
+
+		case headerTagEntryAddress:
+			if err := binary.Read(body, ubinary.NativeEndian, &h.entry); err != nil {
+				return fmt.Errorf("multiboot2: entry address tag: %v", err)
+			}
+			h.hasEntry = true
+
+		case headerTagFramebuffer:
+			h.framebuffer = true
+
+		case headerTagConsoleFlags, headerTagModuleAlign, headerTagRelocatable:
+			// Modules are always page aligned, and the kernel is
+			// always loaded at its preferred address, which every
+			// relocatable kernel accepts. Console flags only matter
+			// for EGA text mode, which we never set up.
+
+		default:
+			// EFI boot services and EFI entry points are not
+			// available after kexec.
+			if !optional {
+				return fmt.Errorf("multiboot2: unsupported header tag %d", tag.Type)
+			}
+		}
+
+		next := alignUp8(int(tag.Size))
+		if next > len(b) {
+			next = len(b)
+		}
+		b = b[next:]
+	}
+	return fmt.Errorf("multiboot2: header has no end tag")
+}
+
+// alignUp8 aligns x to the 8 byte alignment of Multiboot2 tags.
+func alignUp8(x int) int {
+	const mask = tagAlignment - 1
+	return (x + mask) &^ mask
+}
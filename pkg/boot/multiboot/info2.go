@@ -0,0 +1,204 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/u-root/u-root/pkg/ubinary"
+)
+
+// Multiboot2 boot information tag types, see
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#Boot-information-format.
+const (
+	infoTagEnd            = 0
+	infoTagCmdLine        = 1
+	infoTagBootLoaderName = 2
+	infoTagModule         = 3
+	infoTagBasicMemory    = 4
+	infoTagMmap           = 6
+	infoTagFramebuffer    = 8
+	infoTagACPIOld        = 14
+	infoTagACPINew        = 15
+)
+
+// mmapEntry2 is a Multiboot2 memory map entry.
+type mmapEntry2 struct {
+	BaseAddr uint64
+	Length   uint64
+	Type     uint32
+	Reserved uint32
+}
+
+var sizeofMmapEntry2 = uint32(binary.Size(mmapEntry2{}))
+
+// framebufferTypeRGB is the framebuffer type of direct RGB color.
+const framebufferTypeRGB = 1
+
+// Framebuffer describes a linear framebuffer passed to Multiboot2 kernels.
+type Framebuffer struct {
+	Addr   uint64
+	Pitch  uint32
+	Width  uint32
+	Height uint32
+	BPP    uint8
+
+	// RGB field positions and mask sizes in bits.
+	RedPosition   uint8
+	RedMaskSize   uint8
+	GreenPosition uint8
+	GreenMaskSize uint8
+	BluePosition  uint8
+	BlueMaskSize  uint8
+}
+
+// info2 is the Multiboot2 boot information, marshaled as a list of tags.
+type info2 struct {
+	tags bytes.Buffer
+}
+
+// addTag appends a tag with a fixed size body and trailing data.
+func (i *info2) addTag(typ uint32, body interface{}, data []byte) error {
+	var b bytes.Buffer
+	if body != nil {
+		if err := binary.Write(&b, ubinary.NativeEndian, body); err != nil {
+			return err
+		}
+	}
+	b.Write(data)
+
+	hdr := struct {
+		Type uint32
+		Size uint32
+	}{typ, uint32(8 + b.Len())}
+	if err := binary.Write(&i.tags, ubinary.NativeEndian, hdr); err != nil {
+		return err
+	}
+	i.tags.Write(b.Bytes())
+	i.tags.Write(make([]byte, alignUp8(i.tags.Len())-i.tags.Len()))
+	return nil
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func (i *info2) addString(typ uint32, s string) error {
+	return i.addTag(typ, nil, cString(s))
+}
+
+func (i *info2) addModule(mod module, cmdline string) error {
+	return i.addTag(infoTagModule, struct {
+		Start uint32
+		End   uint32
+	}{mod.Start, mod.End}, cString(cmdline))
+}
+
+func (i *info2) addBasicMemory(lower, upper uint32) error {
+	return i.addTag(infoTagBasicMemory, struct {
+		Lower uint32
+		Upper uint32
+	}{lower, upper}, nil)
+}
+
+func (i *info2) addMmap(mmap memoryMaps) error {
+	entries := make([]mmapEntry2, 0, len(mmap))
+	for _, m := range mmap {
+		entries = append(entries, mmapEntry2{
+			BaseAddr: m.BaseAddr,
+			Length:   m.Length,
+			Type:     m.Type,
+		})
+	}
+	var b bytes.Buffer
+	if err := binary.Write(&b, ubinary.NativeEndian, entries); err != nil {
+		return err
+	}
+	return i.addTag(infoTagMmap, struct {
+		EntrySize    uint32
+		EntryVersion uint32
+	}{sizeofMmapEntry2, 0}, b.Bytes())
+}
+
+func (i *info2) addFramebuffer(fb *Framebuffer) error {
+	return i.addTag(infoTagFramebuffer, struct {
+		Addr     uint64
+		Pitch    uint32
+		Width    uint32
+		Height   uint32
+		BPP      uint8
+		Type     uint8
+		Reserved uint16
+
+		RedPosition   uint8
+		RedMaskSize   uint8
+		GreenPosition uint8
+		GreenMaskSize uint8
+		BluePosition  uint8
+		BlueMaskSize  uint8
+	}{
+		Addr:          fb.Addr,
+		Pitch:         fb.Pitch,
+		Width:         fb.Width,
+		Height:        fb.Height,
+		BPP:           fb.BPP,
+		Type:          framebufferTypeRGB,
+		RedPosition:   fb.RedPosition,
+		RedMaskSize:   fb.RedMaskSize,
+		GreenPosition: fb.GreenPosition,
+		GreenMaskSize: fb.GreenMaskSize,
+		BluePosition:  fb.BluePosition,
+		BlueMaskSize:  fb.BlueMaskSize,
+	}, nil)
+}
+
+// addRSDP adds a copy of the ACPI RSDP, and returns whether it was an ACPI
+// 2.0 RSDP. ACPI 1.0 RSDPs are 20 bytes long, later revisions have a length
+// field.
+func (i *info2) addRSDP(rsdp []byte) (bool, error) {
+	const (
+		revisionOff = 15
+		lengthOff   = 20
+		sizeofRSDP1 = 20
+	)
+	if len(rsdp) < sizeofRSDP1 {
+		return false, fmt.Errorf("RSDP is %d bytes, want at least %d", len(rsdp), sizeofRSDP1)
+	}
+	if err := i.addTag(infoTagACPIOld, nil, rsdp[:sizeofRSDP1]); err != nil {
+		return false, err
+	}
+	if rsdp[revisionOff] < 2 || len(rsdp) < lengthOff+4 {
+		return false, nil
+	}
+	l := int(ubinary.NativeEndian.Uint32(rsdp[lengthOff:]))
+	if l > len(rsdp) || l < sizeofRSDP1 {
+		l = len(rsdp)
+	}
+	return true, i.addTag(infoTagACPINew, nil, rsdp[:l])
+}
+
+// marshal returns the boot information: its total size, a reserved field
+// and the tags, terminated by an end tag.
+func (i *info2) marshal() ([]byte, error) {
+	var b bytes.Buffer
+	hdr := struct {
+		TotalSize uint32
+		Reserved  uint32
+	}{uint32(8 + i.tags.Len() + 8), 0}
+	if err := binary.Write(&b, ubinary.NativeEndian, hdr); err != nil {
+		return nil, err
+	}
+	b.Write(i.tags.Bytes())
+	end := struct {
+		Type uint32
+		Size uint32
+	}{infoTagEnd, 8}
+	if err := binary.Write(&b, ubinary.NativeEndian, end); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
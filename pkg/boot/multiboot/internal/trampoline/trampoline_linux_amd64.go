@@ -3,9 +3,10 @@
 // license that can be found in the LICENSE file.
 
 // Package trampoline sets machine to a specific state defined by multiboot v1
-// spec and jumps to the intended kernel.
+// and v2 specs and jumps to the intended kernel.
 //
 // https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Machine-state.
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#Machine-state.
 package trampoline
 
 import (
@@ -21,6 +22,7 @@ import (
 const (
 	trampolineEntry = "u-root-entry-long"
 	trampolineInfo  = "u-root-info-long"
+	trampolineMagic = "u-root-magic-long"
 )
 
 func start()
@@ -38,14 +40,14 @@ func alignUp(x int) int {
 	return (x + mask) & ^mask
 }
 
-// Setup scans file for trampoline code and sets
-// values for multiboot info address and kernel entry point.
-func Setup(path string, infoAddr, entryPoint uintptr) ([]byte, error) {
+// Setup scans file for trampoline code and sets values for the boot loader
+// magic passed in EAX, multiboot info address and kernel entry point.
+func Setup(path string, magic, infoAddr, entryPoint uintptr) ([]byte, error) {
 	d, err := extract(path)
 	if err != nil {
 		return nil, err
 	}
-	return patch(d, infoAddr, entryPoint)
+	return patch(d, magic, infoAddr, entryPoint)
 }
 
 // extract extracts trampoline segment from file.
@@ -81,9 +83,10 @@ func ptrToSlice(ptr uintptr, size int) []byte {
 }
 
 // patch patches the trampoline code to store value for multiboot info address
-// after "u-root-header-long" byte sequence + padding and value
-// for kernel entry point, after "u-root-entry-long" byte sequence + padding.
-func patch(trampoline []byte, infoAddr, entryPoint uintptr) ([]byte, error) {
+// after "u-root-header-long" byte sequence + padding, value
+// for kernel entry point, after "u-root-entry-long" byte sequence + padding,
+// and the boot loader magic after "u-root-magic-long" byte sequence + padding.
+func patch(trampoline []byte, magic, infoAddr, entryPoint uintptr) ([]byte, error) {
 	replace := func(d, label []byte, val uint32) error {
 		buf := make([]byte, 4)
 		ubinary.NativeEndian.PutUint32(buf, val)
@@ -106,5 +109,8 @@ func patch(trampoline []byte, infoAddr, entryPoint uintptr) ([]byte, error) {
 	if err := replace(trampoline, []byte(trampolineEntry), uint32(entryPoint)); err != nil {
 		return nil, err
 	}
+	if err := replace(trampoline, []byte(trampolineMagic), uint32(magic)); err != nil {
+		return nil, err
+	}
 	return trampoline, nil
 }
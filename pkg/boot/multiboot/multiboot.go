@@ -3,7 +3,11 @@
 // license that can be found in the LICENSE file.
 
 // Package multiboot implements bootloading multiboot kernels as defined by
-// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html.
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html and
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html.
+//
+// Kernels with a Multiboot2 header are booted with Multiboot2, others with
+// Multiboot v1.
 //
 // Package multiboot crafts kexec segments that can be used with the kexec_load
 // system call.
@@ -56,6 +60,9 @@ type multiboot struct {
 
 	header header
 
+	// header2 is set for Multiboot2 kernels.
+	header2 *header2
+
 	// infoAddr is a pointer to multiboot info.
 	infoAddr uintptr
 	// kernelEntry is a pointer to entry point of kernel.
@@ -107,9 +114,12 @@ func (m memoryMaps) String() string {
 	return strings.Join(s, "\n")
 }
 
-// Probe checks if `kernel` is multiboot v1 kernel.
+// Probe checks if `kernel` is multiboot v1 or v2 kernel.
 func Probe(kernel io.ReaderAt) error {
 	r := tryGzipFilter(kernel)
+	if _, err := parseHeader2(uio.Reader(r)); err == nil {
+		return nil
+	}
 	_, err := parseHeader(uio.Reader(r))
 	return err
 }
@@ -219,20 +229,38 @@ func (m Modules) Close() error {
 func (m *multiboot) load(debug bool, ibft *ibft.IBFT) error {
 	var err error
 	log.Println("Parsing multiboot header")
-	if m.header, err = parseHeader(uio.Reader(m.kernel)); err != nil {
-		return fmt.Errorf("error parsing headers: %v", err)
+	// Kernels with both headers, like Xen, get the Multiboot2 info. If
+	// the Multiboot2 header asks for something unsupported, try v1.
+	if m.header2, err = parseHeader2(uio.Reader(m.kernel)); err != nil {
+		err2 := err
+		if m.header, err = parseHeader(uio.Reader(m.kernel)); err != nil {
+			if err2 != ErrHeaderNotFound {
+				return fmt.Errorf("error parsing Multiboot2 header: %v", err2)
+			}
+			return fmt.Errorf("error parsing headers: %v", err)
+		}
+		if err2 != ErrHeaderNotFound {
+			log.Printf("Booting with Multiboot v1: %v", err2)
+		}
 	}
 
-	log.Printf("Getting kernel entry point")
-	if m.kernelEntry, err = getEntryPoint(m.kernel); err != nil {
-		return fmt.Errorf("error getting kernel entry point: %v", err)
-	}
-	log.Printf("Kernel entry point at %#x", m.kernelEntry)
+	if m.header2 != nil {
+		log.Printf("Loading Multiboot2 kernel")
+		if m.kernelEntry, err = m.loadKernel2(); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Getting kernel entry point")
+		if m.kernelEntry, err = getEntryPoint(m.kernel); err != nil {
+			return fmt.Errorf("error getting kernel entry point: %v", err)
+		}
 
-	log.Printf("Parsing ELF segments")
-	if err := m.mem.LoadElfSegments(m.kernel); err != nil {
-		return fmt.Errorf("error loading ELF segments: %v", err)
+		log.Printf("Parsing ELF segments")
+		if err := m.mem.LoadElfSegments(m.kernel); err != nil {
+			return fmt.Errorf("error loading ELF segments: %v", err)
+		}
 	}
+	log.Printf("Kernel entry point at %#x", m.kernelEntry)
 
 	log.Printf("Parsing memory map")
 	if err := m.mem.ParseMemoryMap(); err != nil {
@@ -259,7 +287,12 @@ func (m *multiboot) load(debug bool, ibft *ibft.IBFT) error {
 	}
 
 	log.Printf("Preparing multiboot info")
-	if m.infoAddr, err = m.addInfo(); err != nil {
+	if m.header2 != nil {
+		m.infoAddr, err = m.addInfo2()
+	} else {
+		m.infoAddr, err = m.addInfo()
+	}
+	if err != nil {
 		return fmt.Errorf("error preparing multiboot info: %v", err)
 	}
 
@@ -424,7 +457,11 @@ func (m memoryMaps) marshal() ([]byte, error) {
 func (m *multiboot) addTrampoline() (entry uintptr, err error) {
 	// Trampoline setups the machine registers to desired state
 	// and executes the loaded kernel.
-	d, err := trampoline.Setup(m.trampoline, m.infoAddr, m.kernelEntry)
+	magic := uintptr(bootloaderMagic)
+	if m.header2 != nil {
+		magic = bootloaderMagic2
+	}
+	d, err := trampoline.Setup(m.trampoline, magic, m.infoAddr, m.kernelEntry)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,193 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/u-root/u-root/pkg/boot/acpi"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Boot loader magic values passed to the kernel in EAX.
+const (
+	bootloaderMagic  = 0x2BADB002
+	bootloaderMagic2 = 0x36D76289
+)
+
+// getRSDP and getFramebuffer can be replaced for testing.
+var (
+	getRSDP = func() ([]byte, error) {
+		r, err := acpi.GetRSDP()
+		if err != nil {
+			return nil, err
+		}
+		return r.AllData(), nil
+	}
+	getFramebuffer = currentFramebuffer
+)
+
+// requests returns whether the kernel asked for the boot information tag typ.
+func (h *header2) requests(typ uint32) bool {
+	for _, t := range h.infoRequests {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKernel2 adds segments for a Multiboot2 kernel and returns its entry
+// point.
+func (m *multiboot) loadKernel2() (uintptr, error) {
+	h := m.header2
+	if h.address == nil {
+		entry, err := getEntryPoint(m.kernel)
+		if err != nil {
+			return 0, fmt.Errorf("error getting kernel entry point: %v", err)
+		}
+		if err := m.mem.LoadElfSegments(m.kernel); err != nil {
+			return 0, fmt.Errorf("error loading ELF segments: %v", err)
+		}
+		if h.hasEntry {
+			entry = uintptr(h.entry)
+		}
+		return entry, nil
+	}
+
+	// The address tag describes where the kernel file is loaded, relative
+	// to the location of the header in the file.
+	a := h.address
+	if !h.hasEntry {
+		return 0, errors.New("multiboot2: address tag without entry address tag")
+	}
+	if a.LoadAddr > a.HeaderAddr || uint32(h.offset) < a.HeaderAddr-a.LoadAddr {
+		return 0, fmt.Errorf("multiboot2: load address %#x does not fit header address %#x", a.LoadAddr, a.HeaderAddr)
+	}
+	d, err := uio.ReadAll(m.kernel)
+	if err != nil {
+		return 0, err
+	}
+	d = d[uint32(h.offset)-(a.HeaderAddr-a.LoadAddr):]
+	if a.LoadEndAddr != 0 {
+		if a.LoadEndAddr < a.LoadAddr || a.LoadEndAddr-a.LoadAddr > uint32(len(d)) {
+			return 0, fmt.Errorf("multiboot2: load end address %#x out of bounds", a.LoadEndAddr)
+		}
+		d = d[:a.LoadEndAddr-a.LoadAddr]
+	}
+	size := uint(len(d))
+	if a.BSSEndAddr > a.LoadAddr && uint(a.BSSEndAddr-a.LoadAddr) > size {
+		size = uint(a.BSSEndAddr - a.LoadAddr)
+	}
+	m.mem.Segments.Insert(kexec.NewSegment(d, kexec.Range{
+		Start: uintptr(a.LoadAddr),
+		Size:  size,
+	}))
+	return uintptr(h.entry), nil
+}
+
+// addInfo2 adds the Multiboot2 boot information and returns its address.
+func (m *multiboot) addInfo2() (uintptr, error) {
+	rsdp, err := getRSDP()
+	if err != nil {
+		log.Printf("Not passing ACPI RSDP: %v", err)
+	}
+
+	var fb *Framebuffer
+	if m.header2.framebuffer || m.header2.requests(infoTagFramebuffer) {
+		if fb, err = getFramebuffer(); err != nil {
+			log.Printf("Not passing framebuffer: %v", err)
+		}
+	}
+
+	inf, err := m.newMultiboot2Info(rsdp, fb)
+	if err != nil {
+		return 0, err
+	}
+	d, err := inf.marshal()
+	if err != nil {
+		return 0, err
+	}
+	r, err := m.mem.AddKexecSegment(d)
+	if err != nil {
+		return 0, err
+	}
+	return r.Start, nil
+}
+
+// newMultiboot2Info returns the boot information tags with the optional ACPI
+// rsdp and framebuffer fb, and adds segments for the modules.
+func (m *multiboot) newMultiboot2Info(rsdp []byte, fb *Framebuffer) (*info2, error) {
+	inf := &info2{}
+	provided := map[uint32]bool{
+		infoTagCmdLine:        true,
+		infoTagBootLoaderName: true,
+		infoTagModule:         true,
+		infoTagBasicMemory:    true,
+		infoTagMmap:           true,
+	}
+
+	if err := inf.addString(infoTagCmdLine, m.cmdLine); err != nil {
+		return nil, err
+	}
+	if err := inf.addString(infoTagBootLoaderName, m.bootloader); err != nil {
+		return nil, err
+	}
+
+	if len(m.modules) > 0 {
+		loaded, data, err := loadModules(m.modules)
+		if err != nil {
+			return nil, err
+		}
+		r, err := m.mem.AddKexecSegment(data)
+		if err != nil {
+			return nil, err
+		}
+		loaded.fix(uint32(r.Start))
+		m.loadedModules = loaded
+		for i, mod := range loaded {
+			if err := inf.addModule(mod, m.modules[i].CmdLine); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	lower, upper := m.memoryBoundaries()
+	if err := inf.addBasicMemory(lower>>10, upper>>10); err != nil {
+		return nil, err
+	}
+	mmap := m.memoryMap()
+	log.Printf("Memory map:\n%s", mmap)
+	if err := inf.addMmap(mmap); err != nil {
+		return nil, err
+	}
+
+	if fb != nil {
+		if err := inf.addFramebuffer(fb); err != nil {
+			return nil, err
+		}
+		provided[infoTagFramebuffer] = true
+	}
+	if rsdp != nil {
+		acpi2, err := inf.addRSDP(rsdp)
+		if err != nil {
+			return nil, err
+		}
+		provided[infoTagACPIOld] = true
+		provided[infoTagACPINew] = acpi2
+	}
+
+	if m.header2.infoRequired {
+		for _, typ := range m.header2.infoRequests {
+			if !provided[typ] {
+				return nil, fmt.Errorf("multiboot2: kernel requires unsupported boot information tag %d", typ)
+			}
+		}
+	}
+	return inf, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+type testTag struct {
+	typ   uint16
+	flags uint16
+	body  []uint32
+}
+
+// createHeader2 returns a Multiboot2 header with the given tags.
+func createHeader2(arch uint32, tags ...testTag) []byte {
+	var t bytes.Buffer
+	for _, tag := range append(tags, testTag{typ: headerTagEnd}) {
+		binary.Write(&t, binary.LittleEndian, headerTag{
+			Type:  tag.typ,
+			Flags: tag.flags,
+			Size:  uint32(sizeofHeaderTag + 4*len(tag.body)),
+		})
+		binary.Write(&t, binary.LittleEndian, tag.body)
+		t.Write(make([]byte, alignUp8(t.Len())-t.Len()))
+	}
+	length := uint32(binary.Size(mandatory2{}) + t.Len())
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, mandatory2{
+		Magic:        header2Magic,
+		Architecture: arch,
+		HeaderLength: length,
+		Checksum:     -(header2Magic + arch + length),
+	})
+	b.Write(t.Bytes())
+	return b.Bytes()
+}
+
+func TestParseHeader2(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		offset int
+		header []byte
+		want   *header2
+		err    string
+	}{
+		{
+			name:   "tags",
+			offset: 8,
+			header: createHeader2(archI386,
+				testTag{typ: headerTagInformationRequest, body: []uint32{infoTagCmdLine, infoTagMmap, infoTagACPINew}},
+				testTag{typ: headerTagAddress, body: []uint32{0x100000, 0x100000, 0, 0x200000}},
+				testTag{typ: headerTagEntryAddress, body: []uint32{0x100040}},
+				testTag{typ: headerTagFramebuffer, flags: headerTagOptional, body: []uint32{1024, 768, 32}},
+				testTag{typ: headerTagEntryAddressEFI64, flags: headerTagOptional, body: []uint32{0x100080}},
+			),
+			want: &header2{
+				offset:       8,
+				infoRequests: []uint32{infoTagCmdLine, infoTagMmap, infoTagACPINew},
+				infoRequired: true,
+				address: &addressTag{
+					HeaderAddr: 0x100000,
+					LoadAddr:   0x100000,
+					BSSEndAddr: 0x200000,
+				},
+				entry:       0x100040,
+				hasEntry:    true,
+				framebuffer: true,
+			},
+		},
+		{
+			name:   "end of search area",
+			offset: header2Search - 24,
+			header: createHeader2(archI386),
+			want:   &header2{offset: header2Search - 24},
+		},
+		{
+			name:   "misaligned",
+			offset: 4,
+			header: createHeader2(archI386),
+			err:    ErrHeaderNotFound.Error(),
+		},
+		{
+			name:   "beyond search area",
+			offset: header2Search,
+			header: createHeader2(archI386),
+			err:    ErrHeaderNotFound.Error(),
+		},
+		{
+			name:   "MIPS",
+			header: createHeader2(4),
+			err:    "unsupported architecture 4",
+		},
+		{
+			name:   "required EFI boot services",
+			header: createHeader2(archI386, testTag{typ: headerTagEFIBS}),
+			err:    "unsupported header tag 7",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kernel := make([]byte, header2Search+64)
+			copy(kernel[tt.offset:], tt.header)
+
+			got, err := parseHeader2(bytes.NewReader(kernel))
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseHeader2() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHeader2() = %v", err)
+			}
+			tt.want.mandatory2 = got.mandatory2
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHeader2() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// tag is a parsed Multiboot2 boot information tag.
+type tag struct {
+	Type uint32
+	Data []byte
+}
+
+func parseInfo2(t *testing.T, b []byte) []tag {
+	t.Helper()
+	if got := binary.LittleEndian.Uint32(b); int(got) != len(b) {
+		t.Fatalf("total size is %d, want %d", got, len(b))
+	}
+	var tags []tag
+	for off := 8; off < len(b); {
+		typ := binary.LittleEndian.Uint32(b[off:])
+		size := int(binary.LittleEndian.Uint32(b[off+4:]))
+		tags = append(tags, tag{typ, b[off+8 : off+size]})
+		off += alignUp8(size)
+	}
+	return tags
+}
+
+func TestNewMultiboot2Info(t *testing.T) {
+	rsdp2 := make([]byte, 36)
+	copy(rsdp2, "RSDP PTR OEMID \x02")
+	binary.LittleEndian.PutUint32(rsdp2[20:], 36)
+	rsdp1 := append([]byte(nil), rsdp2[:20]...)
+	rsdp1[15] = 0
+
+	fb := &Framebuffer{
+		Addr:          0xfd000000,
+		Pitch:         4096,
+		Width:         1024,
+		Height:        768,
+		BPP:           32,
+		RedPosition:   16,
+		RedMaskSize:   8,
+		GreenPosition: 8,
+		GreenMaskSize: 8,
+		BlueMaskSize:  8,
+	}
+	fbTag := []byte{
+		0, 0, 0, 0xfd, 0, 0, 0, 0, // addr
+		0, 0x10, 0, 0, // pitch
+		0, 4, 0, 0, // width
+		0, 3, 0, 0, // height
+		32, framebufferTypeRGB, 0, 0,
+		16, 8, 8, 8, 0, 8,
+	}
+
+	mmapTag := []byte{
+		24, 0, 0, 0, 0, 0, 0, 0,
+		// [0, 0x9f000) RAM
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0xf0, 0x9, 0, 0, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 0, 0,
+		// [1M, 64M) RAM
+		0, 0, 0x10, 0, 0, 0, 0, 0,
+		0, 0, 0xf0, 0x3, 0, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 0, 0,
+		// [64M, 65M) ACPI
+		0, 0, 0, 0x4, 0, 0, 0, 0,
+		0, 0, 0x10, 0, 0, 0, 0, 0,
+		3, 0, 0, 0, 0, 0, 0, 0,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		requests []uint32
+		required bool
+		modules  []Module
+		rsdp     []byte
+		fb       *Framebuffer
+		want     []tag
+		err      string
+	}{
+		{
+			name: "basic",
+			want: []tag{
+				{infoTagCmdLine, []byte("console=ttyS0\x00")},
+				{infoTagBootLoaderName, []byte("u-root kexec\x00")},
+				{infoTagBasicMemory, []byte{0x7c, 2, 0, 0, 0, 0xfc, 0, 0}},
+				{infoTagMmap, mmapTag},
+			},
+		},
+		{
+			name: "modules, RSDP and framebuffer",
+			modules: []Module{
+				{Module: bytes.NewReader([]byte("module")), Name: "mod", CmdLine: "mod arg"},
+			},
+			rsdp: rsdp2,
+			fb:   fb,
+			want: []tag{
+				{infoTagCmdLine, []byte("console=ttyS0\x00")},
+				{infoTagBootLoaderName, []byte("u-root kexec\x00")},
+				// The module command lines come first, the module
+				// starts on the next page.
+				{infoTagModule, []byte{0, 0x10, 0x10, 0, 6, 0x10, 0x10, 0, 'm', 'o', 'd', ' ', 'a', 'r', 'g', 0}},
+				{infoTagBasicMemory, []byte{0x7c, 2, 0, 0, 0, 0xfc, 0, 0}},
+				{infoTagMmap, mmapTag},
+				{infoTagFramebuffer, fbTag},
+				{infoTagACPIOld, rsdp2[:20]},
+				{infoTagACPINew, rsdp2},
+			},
+		},
+		{
+			name:     "required ACPI 2.0 with ACPI 1.0",
+			requests: []uint32{infoTagMmap, infoTagACPINew},
+			required: true,
+			rsdp:     rsdp1,
+			err:      "requires unsupported boot information tag 15",
+		},
+		{
+			name:     "optional framebuffer",
+			requests: []uint32{infoTagFramebuffer},
+			rsdp:     rsdp1,
+			want: []tag{
+				{infoTagCmdLine, []byte("console=ttyS0\x00")},
+				{infoTagBootLoaderName, []byte("u-root kexec\x00")},
+				{infoTagBasicMemory, []byte{0x7c, 2, 0, 0, 0, 0xfc, 0, 0}},
+				{infoTagMmap, mmapTag},
+				{infoTagACPIOld, rsdp1},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &multiboot{
+				cmdLine:    "console=ttyS0",
+				bootloader: bootloader,
+				modules:    tt.modules,
+				header2: &header2{
+					infoRequests: tt.requests,
+					infoRequired: tt.required,
+				},
+				mem: kexec.Memory{
+					Phys: kexec.MemoryMap{
+						{Range: kexec.RangeFromInterval(0, 0x9f000), Type: kexec.RangeRAM},
+						{Range: kexec.RangeFromInterval(0x100000, 0x4000000), Type: kexec.RangeRAM},
+						{Range: kexec.RangeFromInterval(0x4000000, 0x4100000), Type: kexec.RangeACPI},
+					},
+				},
+			}
+			inf, err := m.newMultiboot2Info(tt.rsdp, tt.fb)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("newMultiboot2Info() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newMultiboot2Info() = %v", err)
+			}
+			b, err := inf.marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(tt.want, tag{Type: infoTagEnd, Data: []byte{}})
+			if diff := deep.Equal(parseInfo2(t, b), want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLoadKernel2Address(t *testing.T) {
+	// The header is 0x40 bytes into the file, which is loaded at 0x200000.
+	kernel := make([]byte, 0x2000)
+	copy(kernel[0x40:], createHeader2(archI386,
+		testTag{typ: headerTagAddress, body: []uint32{0x200040, 0x200000, 0x201000, 0x208000}},
+		testTag{typ: headerTagEntryAddress, body: []uint32{0x200100}},
+	))
+	h, err := parseHeader2(bytes.NewReader(kernel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &multiboot{kernel: bytes.NewReader(kernel), header2: h}
+	entry, err := m.loadKernel2()
+	if err != nil {
+		t.Fatalf("loadKernel2() = %v", err)
+	}
+	if entry != 0x200100 {
+		t.Errorf("loadKernel2() = %#x, want 0x200100", entry)
+	}
+	if len(m.mem.Segments) != 1 {
+		t.Fatalf("got segments %v, want 1", m.mem.Segments)
+	}
+	s := m.mem.Segments[0]
+	if want := kexec.RangeFromInterval(0x200000, 0x208000); s.Phys != want || s.Buf.Size != 0x1000 {
+		t.Errorf("got segment %v, want 0x1000 bytes at %v", s, want)
+	}
+}
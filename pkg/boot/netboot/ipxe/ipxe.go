@@ -2,7 +2,20 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package ipxe implements a trivial IPXE config file parser.
+// Package ipxe implements an iPXE script interpreter.
+//
+// Scripts are evaluated against iPXE settings, see SettingsFromLease, and the
+// boot command yields the selected image as a boot.OSImage. Kernels given
+// modules with module or imgfetch become multiboot images if they have a
+// multiboot header.
+//
+// The supported commands are set, clear, echo, goto, isset, iseq, prompt,
+// sleep, exit, chain, kernel, imgfetch, module, initrd, imgargs, imgselect,
+// imgfree and boot, as well as the && and || operators. dhcp, ifopen and
+// ifconf succeed without doing anything, as the network is already
+// configured. Other commands are ignored.
+//
+// See https://ipxe.org/scripting and https://ipxe.org/cmd.
 package ipxe
 
 import (
@@ -11,9 +24,13 @@ import (
 	"io"
 	"log"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/uio"
 )
@@ -22,22 +39,63 @@ var (
 	// ErrNotIpxeScript is returned when the config file is not an
 	// ipxe script.
 	ErrNotIpxeScript = errors.New("config file is not ipxe as it does not start with #!ipxe")
+
+	// ErrNoImage is returned when a script boots or ends without
+	// selecting an image.
+	ErrNoImage = errors.New("no image to boot")
+
+	// errBoot and errExit end a script.
+	errBoot = errors.New("boot")
+	errExit = errors.New("ipxe: script exited without booting")
+
+	// sleep can be replaced for testing.
+	sleep = time.Sleep
 )
 
-// parser encapsulates a parsed ipxe configuration file.
-//
-// We currently only support kernel and initrd commands.
+// maxSteps bounds the number of lines a script may execute, so that
+// ":retry ... || goto retry" loops cannot spin forever.
+const maxSteps = 10000
+
+// gotoLabel is returned by goto to jump to a label.
+type gotoLabel string
+
+func (g gotoLabel) Error() string {
+	return fmt.Sprintf("goto %s", string(g))
+}
+
+// image is an image fetched by kernel, imgfetch, module or initrd.
+type image struct {
+	name string
+	r    io.ReaderAt
+	args []string
+
+	// initrd is set for images fetched with initrd, which are never
+	// multiboot modules.
+	initrd bool
+}
+
+// parser encapsulates the state of an iPXE script.
 type parser struct {
-	bootImage *boot.LinuxImage
+	schemes  curl.Schemes
+	settings Settings
+
+	// images are the fetched images, selected is the kernel.
+	images   []*image
+	selected *image
+
+	// bootImage is set by the boot command.
+	bootImage boot.OSImage
 
-	schemes curl.Schemes
+	// base is the URL of the script, relative URLs are resolved against.
+	base  *url.URL
+	steps int
 }
 
 // ParseConfig returns a new  configuration with the file at URL and default
 // schemes.
 //
 // See ParseConfigWithSchemes for more details.
-func ParseConfig(configURL *url.URL) (*boot.LinuxImage, error) {
+func ParseConfig(configURL *url.URL) (boot.OSImage, error) {
 	return ParseConfigWithSchemes(configURL, curl.DefaultSchemes)
 }
 
@@ -45,14 +103,30 @@ func ParseConfig(configURL *url.URL) (*boot.LinuxImage, error) {
 // and schemes `s`.
 //
 // `s` is used to get files referred to by URLs in the configuration.
-func ParseConfigWithSchemes(configURL *url.URL, s curl.Schemes) (*boot.LinuxImage, error) {
+func ParseConfigWithSchemes(configURL *url.URL, s curl.Schemes) (boot.OSImage, error) {
+	return ParseConfigWithSettings(configURL, s, nil)
+}
+
+// ParseConfigWithSettings runs the script at configURL with the settings,
+// e.g. from SettingsFromLease, and returns the image it boots.
+//
+// If the script ends without booting, the selected image is returned. It is
+// an error for the script to exit.
+func ParseConfigWithSettings(configURL *url.URL, s curl.Schemes, settings Settings) (boot.OSImage, error) {
 	c := &parser{
-		schemes: s,
+		schemes:  s,
+		settings: Settings{},
+	}
+	for k, v := range settings {
+		c.settings[k] = v
 	}
-	if err := c.getAndParseFile(configURL); err != nil {
+	if err := c.getAndParseFile(configURL); err != nil && err != errBoot {
 		return nil, err
 	}
-	return c.bootImage, nil
+	if c.bootImage != nil {
+		return c.bootImage, nil
+	}
+	return c.image(c.selected)
 }
 
 // getAndParse parses the config file downloaded from `url` and fills in `c`.
@@ -70,62 +144,376 @@ func (c *parser) getAndParseFile(u *url.URL) error {
 		return ErrNotIpxeScript
 	}
 	log.Printf("Got ipxe config file %s:\n%s\n", r, config)
-	return c.parseIpxe(config)
+	return c.run(config, u)
 }
 
-// getFile parses `surl` and returns an io.Reader for the requested url.
-func (c *parser) getFile(surl string) (io.ReaderAt, error) {
+// resolve parses `surl` relative to the script's URL.
+func (c *parser) resolve(surl string) (*url.URL, error) {
 	u, err := url.Parse(surl)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse URL %q: %v", surl, err)
 	}
-	return c.schemes.LazyFetch(u)
+	if c.base != nil {
+		u = c.base.ResolveReference(u)
+	}
+	return u, nil
 }
 
-// parseIpxe parses `config` and constructs a BootImage for `c`.
-func (c *parser) parseIpxe(config string) error {
-	// A trivial ipxe script parser.
-	// Currently only supports kernel and initrd commands.
-	c.bootImage = &boot.LinuxImage{}
+// run executes the script config, fetched from u.
+//
+// It returns errBoot or errExit if the script booted or exited, and nil if
+// it ran to the end.
+func (c *parser) run(config string, u *url.URL) error {
+	base := c.base
+	c.base = u
+	defer func() { c.base = base }()
 
-	for _, line := range strings.Split(config, "\n") {
-		// Skip blank lines and comment lines.
+	lines := strings.Split(config, "\n")
+	labels := make(map[string]int)
+	for i, line := range lines {
 		line = strings.TrimSpace(line)
-		if line == "" || line[0] == '#' {
+		if strings.HasPrefix(line, ":") {
+			labels[line[1:]] = i
+		}
+	}
+
+	for pc := 0; pc < len(lines); pc++ {
+		if c.steps++; c.steps > maxSteps {
+			return fmt.Errorf("ipxe: script executed more than %d lines", maxSteps)
+		}
+		err := c.line(lines[pc])
+		if g, ok := err.(gotoLabel); ok {
+			l, ok := labels[string(g)]
+			if !ok {
+				return fmt.Errorf("ipxe: no label %q", string(g))
+			}
+			pc = l
 			continue
 		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		args := strings.Fields(line)
-		if len(args) <= 1 {
-			log.Printf("Ignoring unsupported ipxe cmd: %s", line)
+// line executes a line of commands separated by && and ||.
+//
+// Like iPXE, the script ends if the last command that ran failed.
+func (c *parser) line(line string) error {
+	// Skip blank lines, comment lines and labels.
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == ':' {
+		return nil
+	}
+
+	var (
+		cmd    []string
+		status error
+		op     string
+	)
+	exec := func() {
+		switch {
+		case len(cmd) == 0:
+			// "command ||" ignores failures.
+			if op == "||" {
+				status = nil
+			}
+		case op == "&&" && status != nil, op == "||" && status == nil:
+			// Skipped.
+		default:
+			status = c.exec(cmd)
+		}
+		cmd = nil
+	}
+	for _, f := range strings.Fields(line) {
+		if f == "&&" || f == "||" {
+			if exec(); isControl(status) {
+				return status
+			}
+			op = f
 			continue
 		}
-		cmd := strings.ToLower(args[0])
+		cmd = append(cmd, f)
+	}
+	if exec(); status != nil && !isControl(status) {
+		return fmt.Errorf("ipxe: %q failed: %v", line, status)
+	}
+	return status
+}
+
+// isControl returns whether err changes the control flow of the script.
+func isControl(err error) bool {
+	_, ok := err.(gotoLabel)
+	return ok || err == errBoot || err == errExit
+}
+
+// exec executes a single command and returns nil if it succeeded.
+func (c *parser) exec(args []string) error {
+	for i := range args {
+		args[i] = c.settings.expand(args[i])
+	}
+	switch cmd := strings.ToLower(args[0]); cmd {
+	case "set":
+		if len(args) < 2 {
+			return errors.New("set: missing setting name")
+		}
+		if len(args) == 2 {
+			delete(c.settings, args[1])
+		} else {
+			c.settings[args[1]] = strings.Join(args[2:], " ")
+		}
+
+	case "clear":
+		if len(args) < 2 {
+			return errors.New("clear: missing setting name")
+		}
+		delete(c.settings, args[1])
+
+	case "echo":
+		log.Print(strings.Join(args[1:], " "))
+
+	case "goto":
+		if len(args) < 2 {
+			return errors.New("goto: missing label")
+		}
+		return gotoLabel(args[1])
+
+	case "isset":
+		if len(args) < 2 || len(args[1]) == 0 {
+			return errors.New("not set")
+		}
+
+	case "iseq":
+		var a, b string
+		if len(args) > 1 {
+			a = args[1]
+		}
+		if len(args) > 2 {
+			b = args[2]
+		}
+		if a != b {
+			return errors.New("not equal")
+		}
+
+	case "prompt":
+		// There is no one to press a key.
+		return errors.New("prompt: no key pressed")
+
+	case "sleep":
+		if len(args) < 2 {
+			return errors.New("sleep: missing duration")
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("sleep: %v", err)
+		}
+		sleep(time.Duration(secs) * time.Second)
 
-		switch cmd {
-		case "kernel":
-			k, err := c.getFile(args[1])
+	case "exit":
+		return errExit
+
+	case "dhcp", "ifopen", "ifconf":
+		// The network is configured before the script runs.
+
+	case "kernel", "chain", "imgfetch", "module", "initrd":
+		return c.fetch(cmd, args[1:])
+
+	case "imgargs":
+		img, err := c.find(args[1:])
+		if err != nil {
+			return err
+		}
+		img.args = args[2:]
+
+	case "imgselect":
+		img, err := c.find(args[1:])
+		if err != nil {
+			return err
+		}
+		c.selected = img
+
+	case "imgfree":
+		c.images, c.selected = nil, nil
+
+	case "boot", "imgexec":
+		if len(args) > 1 {
+			img, err := c.find(args[1:])
 			if err != nil {
 				return err
 			}
-			c.bootImage.Kernel = k
+			c.selected = img
+		}
+		return c.boot()
+
+	default:
+		log.Printf("Ignoring unsupported ipxe cmd: %s", strings.Join(args, " "))
+	}
+	return nil
+}
 
-			// Add cmdline if there are any.
-			if len(args) > 2 {
-				c.bootImage.Cmdline = strings.Join(args[2:], " ")
+// fetch implements the image fetching commands.
+func (c *parser) fetch(cmd string, args []string) error {
+	var name string
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		opt := args[0]
+		args = args[1:]
+		switch {
+		case opt == "-n" || opt == "--name":
+			if len(args) == 0 {
+				return fmt.Errorf("%s: missing name", cmd)
+			}
+			name, args = args[0], args[1:]
+		case strings.HasPrefix(opt, "--name="):
+			name = strings.TrimPrefix(opt, "--name=")
+		case opt == "-t" || opt == "--timeout":
+			if len(args) > 0 {
+				args = args[1:]
 			}
+		}
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s: missing URL", cmd)
+	}
+	u, err := c.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	r, err := c.schemes.LazyFetch(u)
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		name = path.Base(u.Path)
+	}
+	img := &image{
+		name:   name,
+		r:      r,
+		args:   args[1:],
+		initrd: cmd == "initrd",
+	}
 
-		case "initrd":
-			i, err := c.getFile(args[1])
+	if cmd == "chain" {
+		// Chained iPXE scripts run with the current settings, anything
+		// else is booted.
+		script, err := isScript(r)
+		if err != nil {
+			return err
+		}
+		if script {
+			data, err := uio.ReadAll(r)
 			if err != nil {
 				return err
 			}
-			c.bootImage.Initrd = i
-
-		default:
-			log.Printf("Ignoring unsupported ipxe cmd: %s", line)
+			log.Printf("Chaining ipxe script %s", u)
+			if err := c.run(string(data), u); err != errExit {
+				return err
+			}
+			return nil
 		}
+		c.images = append(c.images, img)
+		c.selected = img
+		return c.boot()
 	}
 
+	c.images = append(c.images, img)
+	if cmd == "kernel" {
+		c.selected = img
+	}
 	return nil
 }
+
+// isScript returns whether r is an iPXE script. It fails if r cannot be
+// fetched.
+func isScript(r io.ReaderAt) (bool, error) {
+	magic := make([]byte, len("#!ipxe"))
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return string(magic[:n]) == "#!ipxe", nil
+}
+
+// find returns the image named args[0], or the selected image.
+func (c *parser) find(args []string) (*image, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		if c.selected == nil {
+			return nil, ErrNoImage
+		}
+		return c.selected, nil
+	}
+	for _, img := range c.images {
+		if img.name == args[0] {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("no image %q", args[0])
+}
+
+// boot ends the script, booting the selected image.
+func (c *parser) boot() error {
+	if c.selected == nil {
+		return ErrNoImage
+	}
+	img, err := c.image(c.selected)
+	if err != nil {
+		return err
+	}
+	c.bootImage = img
+	return errBoot
+}
+
+// image returns the OSImage for booting kernel with all other fetched
+// images.
+//
+// The other images are multiboot modules if the kernel is a multiboot
+// kernel, and initrds otherwise.
+func (c *parser) image(kernel *image) (boot.OSImage, error) {
+	if kernel == nil {
+		return nil, ErrNoImage
+	}
+
+	var others, modules []*image
+	for _, img := range c.images {
+		if img == kernel {
+			continue
+		}
+		others = append(others, img)
+		if !img.initrd {
+			modules = append(modules, img)
+		}
+	}
+
+	if len(modules) > 0 && multiboot.Probe(kernel.r) == nil {
+		mi := &boot.MultibootImage{
+			Kernel: kernel.r,
+			// Like iPXE, command lines start with the image name.
+			Cmdline: strings.Join(append([]string{kernel.name}, kernel.args...), " "),
+		}
+		for _, m := range modules {
+			mi.Modules = append(mi.Modules, multiboot.Module{
+				Module:  m.r,
+				Name:    m.name,
+				CmdLine: strings.Join(append([]string{m.name}, m.args...), " "),
+			})
+		}
+		return mi, nil
+	}
+
+	li := &boot.LinuxImage{
+		Kernel:  kernel.r,
+		Cmdline: strings.Join(kernel.args, " "),
+	}
+	switch len(others) {
+	case 0:
+	case 1:
+		li.Initrd = others[0].r
+	default:
+		var rs []io.ReaderAt
+		for _, i := range others {
+			rs = append(rs, i.r)
+		}
+		li.Initrd = boot.CatInitrds(rs...)
+	}
+	return li, nil
+}
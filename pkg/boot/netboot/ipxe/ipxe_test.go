@@ -7,14 +7,19 @@ package ipxe
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/dhclient"
 	"github.com/u-root/u-root/pkg/uio"
+	"github.com/vishvananda/netlink"
 )
 
 func mustReadAll(r io.ReaderAt) string {
@@ -201,7 +206,7 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{},
+			err: ErrNoImage,
 		},
 		{
 			desc: "valid config with kernel cmdline args",
@@ -284,13 +289,17 @@ func TestIpxeConfig(t *testing.T) {
 		},
 	} {
 		t.Run(fmt.Sprintf("Test [%02d] %s", i, tt.desc), func(t *testing.T) {
-			got, err := ParseConfigWithSchemes(tt.curl, tt.schemeFunc())
+			img, err := ParseConfigWithSchemes(tt.curl, tt.schemeFunc())
 			if !reflect.DeepEqual(err, tt.err) {
 				t.Errorf("NewConfigWithSchemes() got %v, want %v", err, tt.err)
 				return
 			} else if err != nil {
 				return
 			}
+			got, ok := img.(*boot.LinuxImage)
+			if !ok {
+				t.Fatalf("got %T, want *boot.LinuxImage", img)
+			}
 			want := tt.want
 
 			// Same kernel?
@@ -308,3 +317,265 @@ func TestIpxeConfig(t *testing.T) {
 		})
 	}
 }
+
+// multibootKernel is a kernel with just a Multiboot header.
+var multibootKernel = string([]byte{
+	0x02, 0xb0, 0xad, 0x1b, // magic
+	0, 0, 0, 0, // flags
+	0xfe, 0x4f, 0x52, 0xe4, // checksum
+})
+
+func TestScript(t *testing.T) {
+	fs := curl.NewMockScheme("http")
+	fs.Add("boot.example", "/kernel", "kernel")
+	fs.Add("boot.example", "/initrd", "initrd")
+	fs.Add("boot.example", "/aa-bb-cc-dd-ee-ff/kernel", "per-host kernel")
+	fs.Add("boot.example", "/xen.gz", multibootKernel)
+	fs.Add("boot.example", "/chained.ipxe", `#!ipxe
+	set chained yes
+	exit
+	`)
+	fs.Add("boot.example", "/boot.ipxe", `#!ipxe
+	kernel kernel ${greeting}
+	boot
+	`)
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+	settings := Settings{
+		"net0/mac": "aa:bb:cc:dd:ee:ff",
+		"ip":       "192.168.1.10",
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		script string
+		want   boot.OSImage
+		err    string
+	}{
+		{
+			desc: "settings",
+			script: `#!ipxe
+			set base http://boot.example
+			set args ip=${ip} mac=${net0/mac:hexhyp}
+			kernel ${base}/${net0/mac:hexhyp}/kernel ${args}
+			initrd initrd
+			boot`,
+			want: &boot.LinuxImage{
+				Kernel:  strings.NewReader("per-host kernel"),
+				Initrd:  strings.NewReader("initrd"),
+				Cmdline: "ip=192.168.1.10 mac=aa-bb-cc-dd-ee-ff",
+			},
+		},
+		{
+			desc: "goto and conditionals",
+			script: `#!ipxe
+			isset ${missing} && goto wrong || goto check
+			:wrong
+			kernel wrong
+			boot
+			:check
+			iseq ${ip} 192.168.1.10 || goto wrong
+			kernel kernel
+			imgargs kernel console=ttyS0
+			boot`,
+			want: &boot.LinuxImage{
+				Kernel:  strings.NewReader("kernel"),
+				Cmdline: "console=ttyS0",
+			},
+		},
+		{
+			desc: "retry",
+			script: `#!ipxe
+			set n 0
+			:retry
+			iseq ${n} 1 && goto done ||
+			set n 1
+			chain missing || goto retry
+			:done
+			kernel kernel done
+			boot`,
+			want: &boot.LinuxImage{
+				Kernel:  strings.NewReader("kernel"),
+				Cmdline: "done",
+			},
+		},
+		{
+			desc: "chained scripts",
+			script: `#!ipxe
+			chain chained.ipxe
+			isset ${chained} || exit
+			set greeting hello
+			chain boot.ipxe
+			kernel wrong`,
+			want: &boot.LinuxImage{
+				Kernel:  strings.NewReader("kernel"),
+				Cmdline: "hello",
+			},
+		},
+		{
+			desc: "chain kernel",
+			script: `#!ipxe
+			imgfetch --name rd initrd
+			chain kernel console=ttyS0`,
+			want: &boot.LinuxImage{
+				Kernel:  strings.NewReader("kernel"),
+				Initrd:  strings.NewReader("initrd"),
+				Cmdline: "console=ttyS0",
+			},
+		},
+		{
+			desc: "multiboot",
+			script: `#!ipxe
+			kernel xen.gz dom0_mem=1G
+			module kernel console=hvc0
+			module initrd
+			boot`,
+			want: &boot.MultibootImage{
+				Kernel:  strings.NewReader(multibootKernel),
+				Cmdline: "xen.gz dom0_mem=1G",
+				Modules: []multiboot.Module{
+					{Module: strings.NewReader("kernel"), Name: "kernel", CmdLine: "kernel console=hvc0"},
+					{Module: strings.NewReader("initrd"), Name: "initrd", CmdLine: "initrd"},
+				},
+			},
+		},
+		{
+			desc: "exit",
+			script: `#!ipxe
+			kernel kernel
+			exit`,
+			err: "exited without booting",
+		},
+		{
+			desc: "failed command",
+			script: `#!ipxe
+			iseq a b
+			kernel kernel`,
+			err: `"iseq a b" failed`,
+		},
+		{
+			desc: "missing label",
+			script: `#!ipxe
+			goto nowhere`,
+			err: `no label "nowhere"`,
+		},
+		{
+			desc: "boot without kernel",
+			script: `#!ipxe
+			boot`,
+			err: ErrNoImage.Error(),
+		},
+		{
+			desc: "endless loop",
+			script: `#!ipxe
+			:loop
+			goto loop`,
+			err: "more than",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs.Add("boot.example", "/script.ipxe", tt.script)
+			u := &url.URL{Scheme: "http", Host: "boot.example", Path: "/script.ipxe"}
+			img, err := ParseConfigWithSettings(u, s, settings)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseConfigWithSettings() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfigWithSettings() = %v", err)
+			}
+
+			switch want := tt.want.(type) {
+			case *boot.LinuxImage:
+				got, ok := img.(*boot.LinuxImage)
+				if !ok {
+					t.Fatalf("got %T, want *boot.LinuxImage", img)
+				}
+				if g, w := mustReadAll(got.Kernel), mustReadAll(want.Kernel); g != w {
+					t.Errorf("got kernel %q, want %q", g, w)
+				}
+				if g, w := mustReadAll(got.Initrd), mustReadAll(want.Initrd); g != w {
+					t.Errorf("got initrd %q, want %q", g, w)
+				}
+				if got.Cmdline != want.Cmdline {
+					t.Errorf("got cmdline %q, want %q", got.Cmdline, want.Cmdline)
+				}
+
+			case *boot.MultibootImage:
+				got, ok := img.(*boot.MultibootImage)
+				if !ok {
+					t.Fatalf("got %T, want *boot.MultibootImage", img)
+				}
+				if g, w := mustReadAll(got.Kernel), mustReadAll(want.Kernel); g != w {
+					t.Errorf("got kernel %q, want %q", g, w)
+				}
+				if got.Cmdline != want.Cmdline {
+					t.Errorf("got cmdline %q, want %q", got.Cmdline, want.Cmdline)
+				}
+				if len(got.Modules) != len(want.Modules) {
+					t.Fatalf("got %d modules, want %d", len(got.Modules), len(want.Modules))
+				}
+				for i, m := range got.Modules {
+					w := want.Modules[i]
+					if mustReadAll(m.Module) != mustReadAll(w.Module) || m.Name != w.Name || m.CmdLine != w.CmdLine {
+						t.Errorf("got module %d %q %q %q, want %q %q %q", i, mustReadAll(m.Module), m.Name, m.CmdLine, mustReadAll(w.Module), w.Name, w.CmdLine)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	s := Settings{
+		"net0/mac": "aa:bb:cc:dd:ee:ff",
+		"filename": "boot file.ipxe",
+	}
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"${net0/mac}", "aa:bb:cc:dd:ee:ff"},
+		{"mac-${net0/mac:hexhyp}.cfg", "mac-aa-bb-cc-dd-ee-ff.cfg"},
+		{"${net0/mac:hexraw}", "aabbccddeeff"},
+		{"/${filename:uristring}", "/boot%20file.ipxe"},
+		{"${unset}x", "x"},
+		{"${unterminated", "${unterminated"},
+	} {
+		if got := s.expand(tt.in); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsFromLease(t *testing.T) {
+	p, err := dhcpv4.New(
+		dhcpv4.WithYourIP(net.IP{192, 168, 1, 10}),
+		dhcpv4.WithServerIP(net.IP{192, 168, 1, 1}),
+		dhcpv4.WithNetmask(net.IPMask{255, 255, 255, 0}),
+		dhcpv4.WithRouter(net.IP{192, 168, 1, 254}),
+		dhcpv4.WithOption(dhcpv4.OptHostName("node1")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+		HardwareAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}}
+	s := SettingsFromLease(dhclient.NewPacket4(link, p))
+	for name, want := range map[string]string{
+		"net0/mac":    "aa:bb:cc:dd:ee:ff",
+		"ip":          "192.168.1.10",
+		"net0/ip":     "192.168.1.10",
+		"netmask":     "255.255.255.0",
+		"gateway":     "192.168.1.254",
+		"next-server": "192.168.1.1",
+		"hostname":    "node1",
+	} {
+		if got := s[name]; got != want {
+			t.Errorf("${%s} = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipxe
+
+import (
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/dhclient"
+)
+
+// Settings are iPXE settings, such as "ip" or "net0/mac", which scripts
+// refer to as ${ip} or ${net0/mac}.
+type Settings map[string]string
+
+// netDevice is the name iPXE gives the network device that was booted from.
+const netDevice = "net0"
+
+// buildArch maps GOARCH to iPXE's ${buildarch}.
+var buildArch = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "arm32",
+	"arm64":   "arm64",
+	"riscv64": "riscv64",
+}
+
+// SettingsFromLease returns the settings iPXE would have after configuring
+// the network with the DHCP lease.
+//
+// Network settings are set both unqualified, e.g. ${ip}, and for the boot
+// device, e.g. ${net0/ip}.
+func SettingsFromLease(lease dhclient.Lease) Settings {
+	s := Settings{}
+	if arch, ok := buildArch[runtime.GOARCH]; ok {
+		s["buildarch"] = arch
+	}
+	if lease == nil {
+		return s
+	}
+
+	set := func(name, value string) {
+		if len(value) == 0 {
+			return
+		}
+		s[name] = value
+		s[netDevice+"/"+name] = value
+	}
+	ip := func(name string, ip net.IP) {
+		if ip != nil && !ip.IsUnspecified() {
+			set(name, ip.String())
+		}
+	}
+
+	if l := lease.Link(); l != nil {
+		set("mac", l.Attrs().HardwareAddr.String())
+	}
+	if p4, ok := lease.(*dhclient.Packet4); ok {
+		ipnet := p4.Lease()
+		ip("ip", ipnet.IP)
+		ip("netmask", net.IP(ipnet.Mask))
+		if r := p4.P.Router(); len(r) > 0 {
+			ip("gateway", r[0])
+		}
+		if dns := p4.P.DNS(); len(dns) > 0 {
+			ip("dns", dns[0])
+		}
+		ip("next-server", p4.P.ServerIPAddr)
+		set("domain", p4.P.DomainName())
+		set("hostname", p4.P.HostName())
+		set("root-path", p4.P.RootPath())
+		if u, err := p4.Boot(); err == nil {
+			set("filename", u.String())
+		}
+	}
+	return s
+}
+
+// lookup returns the value of the setting name, formatted as "name:type"
+// asks for.
+func (s Settings) lookup(name string) string {
+	var typ string
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, typ = name[:i], name[i+1:]
+	}
+	v := s[name]
+
+	switch typ {
+	case "hexhyp":
+		return strings.Replace(v, ":", "-", -1)
+	case "hexraw":
+		return strings.Replace(v, ":", "", -1)
+	case "uristring":
+		return url.PathEscape(v)
+	default:
+		return v
+	}
+}
+
+// expand replaces ${name} and ${name:type} in str with their settings.
+// Unknown settings expand to the empty string.
+func (s Settings) expand(str string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(str, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(str[i:], "}")
+		if j < 0 {
+			break
+		}
+		b.WriteString(str[:i])
+		b.WriteString(s.lookup(str[i+2 : i+j]))
+		str = str[i+j+1:]
+	}
+	b.WriteString(str)
+	return b.String()
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/fit"
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/dhclient"
+)
+
+// initiatorPrefix is the iSCSI qualified name prefix of initiators, which
+// are named after their host name or MAC address.
+const initiatorPrefix = "iqn.2019-10.org.u-root:"
+
+// originDHCP is the iBFT NIC origin of DHCP addresses, see the
+// NL_PREFIX_ORIGIN enumeration of the Windows IP Helper API.
+const originDHCP = 3
+
+// addISCSI tells img to boot from the LUN of the iSCSI target and volume.
+//
+// Linux kernels get a dracut netroot= argument, unless their command line
+// already has one. Multiboot kernels get an iBFT describing the lease.
+func addISCSI(img boot.OSImage, lease dhclient.Lease, target *net.TCPAddr, lun uint64, volume string) {
+	switch i := img.(type) {
+	case *boot.LinuxImage:
+		i.Cmdline = iscsiCmdline(i.Cmdline, target, lun, volume)
+	case *fit.Image:
+		i.Cmdline = iscsiCmdline(i.Cmdline, target, lun, volume)
+	case *boot.MultibootImage:
+		if i.IBFT == nil {
+			i.IBFT = leaseIBFT(lease, target, lun, volume)
+		}
+	default:
+		log.Printf("Cannot pass iSCSI root to %s", img.Label())
+	}
+}
+
+// iscsiCmdline adds dracut's netroot=iscsi:<server>::<port>:<LUN>:<target>
+// and ip=dhcp to cmdline. LUN 0 is left out, like in the DHCP root path.
+func iscsiCmdline(cmdline string, target *net.TCPAddr, lun uint64, volume string) string {
+	args := strings.Fields(cmdline)
+	has := func(prefix string) bool {
+		for _, a := range args {
+			if strings.HasPrefix(a, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	if has("netroot=") {
+		return cmdline
+	}
+
+	server := target.IP.String()
+	if target.IP.To4() == nil {
+		server = "[" + server + "]"
+	}
+	var l string
+	if lun != 0 {
+		l = fmt.Sprintf("%x", lun)
+	}
+	args = append(args, fmt.Sprintf("netroot=iscsi:%s::%d:%s:%s", server, target.Port, l, volume))
+	if !has("ip=") {
+		args = append(args, "ip=dhcp")
+	}
+	return strings.Join(args, " ")
+}
+
+// leaseIBFT returns an iBFT for booting from the LUN of the iSCSI target and
+// volume with the network configuration of the lease.
+func leaseIBFT(lease dhclient.Lease, target *net.TCPAddr, lun uint64, volume string) *ibft.IBFT {
+	mac := lease.Link().Attrs().HardwareAddr
+	nic := ibft.NIC{
+		Valid:      true,
+		Boot:       true,
+		Global:     true,
+		Origin:     originDHCP,
+		MACAddress: mac,
+	}
+	if p4, ok := lease.(*dhclient.Packet4); ok {
+		nic.IPNet = p4.Lease()
+		if r := p4.P.Router(); len(r) > 0 {
+			nic.Gateway = r[0]
+		}
+		if dns := p4.P.DNS(); len(dns) > 0 {
+			nic.PrimaryDNS = dns[0]
+			if len(dns) > 1 {
+				nic.SecondaryDNS = dns[1]
+			}
+		}
+		nic.DHCPServer = p4.P.ServerIdentifier()
+		nic.HostName = p4.P.HostName()
+	}
+
+	name := nic.HostName
+	if len(name) == 0 {
+		name = strings.Replace(mac.String(), ":", "", -1)
+	}
+	return &ibft.IBFT{
+		Initiator: ibft.Initiator{
+			Name:  initiatorPrefix + name,
+			Valid: true,
+			Boot:  true,
+		},
+		NIC0: nic,
+		Target0: ibft.Target{
+			Valid:      true,
+			Boot:       true,
+			Target:     target,
+			BootLUN:    lun,
+			TargetName: volume,
+		},
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/diskboot"
+	"github.com/u-root/u-root/pkg/loop"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
+)
+
+// isoMagicOff is the offset of the standard identifier of the first ISO
+// 9660 volume descriptor, which follows 16 2 KiB system area sectors.
+const isoMagicOff = 0x8001
+
+// IsISO returns whether r is an ISO 9660 image.
+func IsISO(r io.ReaderAt) bool {
+	magic := make([]byte, 5)
+	n, _ := r.ReadAt(magic, isoMagicOff)
+	return n == len(magic) && string(magic) == "CD001"
+}
+
+// mountISO copies the ISO image r to a file, loop mounts it read-only and
+// returns the mount point and a function that unmounts and removes it.
+//
+// The image stays mounted until then, as boot images open their files when
+// they are loaded.
+var mountISO = func(r io.ReaderAt) (string, func(), error) {
+	f, err := ioutil.TempFile("", "netboot-*.iso")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(f, uio.Reader(r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "netboot-iso")
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	l, err := loop.New(f.Name(), "iso9660", "")
+	if err != nil {
+		os.Remove(dir)
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	mp, err := l.Mount(dir, unix.MS_RDONLY)
+	if err != nil {
+		l.Free()
+		os.Remove(dir)
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return dir, func() {
+		mp.Unmount(0)
+		l.Free()
+		os.Remove(dir)
+		os.Remove(f.Name())
+	}, nil
+}
+
+// ISOImage mounts the ISO image r and returns the default entry of the
+// first boot configuration found on it, see diskboot.FindConfigs.
+func ISOImage(r io.ReaderAt, name string) (boot.OSImage, error) {
+	dir, cleanup, err := mountISO(r)
+	if err != nil {
+		return nil, fmt.Errorf("mounting %s: %v", name, err)
+	}
+	for _, c := range diskboot.FindConfigs(dir) {
+		imgs := c.OSImages()
+		if len(imgs) == 0 {
+			continue
+		}
+		log.Printf("Using %s on %s", c.ConfigPath, name)
+
+		// OSImages skips entries without modules.
+		def := 0
+		if c.DefaultEntry >= 0 && c.DefaultEntry < len(c.Entries) && len(c.Entries[c.DefaultEntry].Modules) > 0 {
+			for _, e := range c.Entries[:c.DefaultEntry] {
+				if len(e.Modules) > 0 {
+					def++
+				}
+			}
+		}
+		return imgs[def], nil
+	}
+	cleanup()
+	return nil, fmt.Errorf("no boot configuration found on %s", name)
+}
@@ -4,41 +4,53 @@
 
 // Package netboot provides a one-stop shop for netboot parsing needs.
 //
-// netboot can take a URL from a DHCP lease and try to detect iPXE scripts and
-// PXE scripts.
-//
-// TODO: detect multiboot and Linux kernels without configuration (URL points
-// to a single kernel file).
-//
-// TODO: detect iSCSI root paths.
+// netboot can take a URL from a DHCP lease and try to detect iPXE scripts,
+// PXE scripts, kernels without configuration and ISO images. iSCSI root
+// paths in the lease are passed on to the booted kernel.
 package netboot
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/url"
 	"path"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/fit"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/boot/netboot/ipxe"
 	"github.com/u-root/u-root/pkg/boot/netboot/pxe"
+	"github.com/u-root/u-root/pkg/boot/syslinux"
+	"github.com/u-root/u-root/pkg/bzimage"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/dt"
+	"github.com/u-root/u-root/pkg/uio"
 )
 
 // BootImage figures out the image to boot from the given DHCP lease.
 //
 // Tries, in order:
 //
-// - to detect an iPXE script beginning with #!ipxe,
+// - to detect and run an iPXE script beginning with #!ipxe,
+//
+// - to detect a FIT image, a multiboot kernel, or a bzImage, arm64 Image or
+//   ELF Linux kernel, which is booted without configuration,
+//
+// - to detect an ISO image, as UEFI HTTP Boot servers hand out, which is
+//   loop mounted to boot its grub or syslinux configuration,
 //
 // - to detect a pxelinux.0, in which case we will ignore the pxelinux and try
 //   to parse pxelinux.cfg/<files>.
 //
-// TODO: detect straight up multiboot and bzImage Linux kernel files rather
-// than just configuration scripts.
-func BootImage(s curl.Schemes, lease dhclient.Lease) (*boot.LinuxImage, error) {
+// If the lease has an iSCSI root path, see dhclient.Lease.ISCSIBoot, the image
+// is told to boot from the iSCSI target.
+func BootImage(s curl.Schemes, lease dhclient.Lease) (boot.OSImage, error) {
 	uri, err := lease.Boot()
 	if err != nil {
 		return nil, err
@@ -47,21 +59,39 @@ func BootImage(s curl.Schemes, lease dhclient.Lease) (*boot.LinuxImage, error) {
 
 	// IP only makes sense for v4 anyway, because the PXE probing of files
 	// uses a MAC address and an IPv4 address to look at files.
-	var ip net.IP
+	n := &syslinux.Network{MAC: lease.Link().Attrs().HardwareAddr}
 	if p4, ok := lease.(*dhclient.Packet4); ok {
-		ip = p4.Lease().IP
+		ipnet := p4.Lease()
+		n.IP, n.Netmask = ipnet.IP, ipnet.Mask
+		n.Server = p4.P.ServerIdentifier()
+		if n.Server == nil && !p4.P.ServerIPAddr.Equal(net.IPv4zero) {
+			n.Server = p4.P.ServerIPAddr
+		}
+		if r := p4.P.Router(); len(r) > 0 {
+			n.Gateway = r[0]
+		}
+	}
+	img, err := getBootImage(s, uri, ipxe.SettingsFromLease(lease), n)
+	if err != nil {
+		return nil, err
+	}
+	if target, lun, volume, err := lease.ISCSIBoot(); err == nil {
+		log.Printf("iSCSI root: target %s, LUN %x, volume %s", target, lun, volume)
+		addISCSI(img, lease, target, lun, volume)
 	}
-	return getBootImage(s, uri, lease.Link().Attrs().HardwareAddr, ip)
+	return img, nil
 }
 
-// getBootImage attempts to parse the file at uri as an ipxe config and returns
-// the ipxe boot image. Otherwise falls back to pxe and uses the uri directory,
-// ip, and mac address to search for pxe configs.
-func getBootImage(schemes curl.Schemes, uri *url.URL, mac net.HardwareAddr, ip net.IP) (*boot.LinuxImage, error) {
-	// Attempt to read the given boot path as an ipxe config file.
-	ipc, err := ipxe.ParseConfigWithSchemes(uri, schemes)
+// getBootImage attempts to run the file at uri as an ipxe script with the
+// settings and returns the ipxe boot image, or to boot it as a kernel.
+// Otherwise falls back to pxe and uses the uri directory and the lease n to
+// search for pxe configs.
+func getBootImage(schemes curl.Schemes, uri *url.URL, settings ipxe.Settings, n *syslinux.Network) (boot.OSImage, error) {
+	// Attempt to read the given boot path as an ipxe config file or a
+	// kernel.
+	img, err := bootFileImage(schemes, uri, settings)
 	if err == nil {
-		return ipc, nil
+		return img, nil
 	}
 	log.Printf("Falling back to pxe boot: %v", err)
 
@@ -71,14 +101,82 @@ func getBootImage(schemes curl.Schemes, uri *url.URL, mac net.HardwareAddr, ip n
 		Host:   uri.Host,
 		Path:   path.Dir(uri.Path),
 	}
-	pc, err := pxe.ParseConfigWithSchemes(wd, mac, ip, schemes)
+	pc, err := pxe.ParseConfigWithNetwork(wd, n, schemes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse pxelinux config: %v", err)
 	}
+	for _, msg := range pc.Say {
+		log.Print(msg)
+	}
+
+	imgs := pc.Images()
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("no labels in pxelinux config")
+	}
+	return imgs[pc.MenuConfig().Default], nil
+}
+
+// sniffSize is how much of the boot file is read to detect its type. The
+// arm64 Image header is the furthest into the file.
+const sniffSize = 64
+
+// bootFileImage runs the boot file at uri if it is an ipxe script, and
+// returns an image booting it if it is a kernel or an ISO image.
+func bootFileImage(schemes curl.Schemes, uri *url.URL, settings ipxe.Settings) (boot.OSImage, error) {
+	r, err := schemes.LazyFetch(uri)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, sniffSize)
+	n, err := r.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	hdr = hdr[:n]
+
+	if bytes.HasPrefix(hdr, []byte("#!ipxe")) {
+		return ipxe.ParseConfigWithSettings(uri, schemes, settings)
+	}
+
+	name := path.Base(uri.Path)
+	switch {
+	case isFIT(hdr, r):
+		return &fit.Image{Name: name, File: r}, nil
+
+	case multiboot.Probe(r) == nil:
+		// Like mboot.c32, the command line starts with the file name.
+		return &boot.MultibootImage{Name: name, Kernel: r, Cmdline: name}, nil
+
+	case isBzImage(r), isARM64Image(hdr), bytes.HasPrefix(hdr, []byte(elf.ELFMAG)):
+		return &boot.LinuxImage{Name: name, Kernel: r}, nil
+
+	case IsISO(r):
+		return ISOImage(r, name)
+	}
+	return nil, fmt.Errorf("%s is neither an ipxe script, a kernel nor an ISO image", uri)
+}
+
+// isFIT returns whether r is a FIT image, a device tree with images.
+func isFIT(hdr []byte, r io.ReaderAt) bool {
+	if len(hdr) < 4 || binary.BigEndian.Uint32(hdr) != dt.Magic {
+		return false
+	}
+	_, err := fit.Parse(r)
+	return err == nil
+}
 
-	label, ok := pc.Entries[pc.DefaultEntry]
-	if !ok {
-		return nil, fmt.Errorf("Could not find %q from entries %v", pc.DefaultEntry, pc.Entries)
+// isBzImage returns whether r is an x86 bzImage.
+func isBzImage(r io.ReaderAt) bool {
+	var h bzimage.LinuxHeader
+	if err := binary.Read(uio.Reader(r), binary.LittleEndian, &h); err != nil {
+		return false
 	}
-	return label, nil
+	return h.HeaderMagic == bzimage.HeaderMagic
+}
+
+// isARM64Image returns whether hdr starts an arm64 Image, as described in
+// Documentation/arm64/booting.rst.
+func isARM64Image(hdr []byte) bool {
+	const magicOff = 56
+	return len(hdr) >= magicOff+4 && string(hdr[magicOff:magicOff+4]) == "ARM\x64"
 }
@@ -0,0 +1,178 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/syslinux"
+	"github.com/u-root/u-root/pkg/curl"
+)
+
+func kernelWith(off int, magic string) string {
+	n := 0x1000
+	if off+len(magic) > n {
+		n = off + 0x1000
+	}
+	b := make([]byte, n)
+	copy(b[off:], magic)
+	return string(b)
+}
+
+func TestGetBootImage(t *testing.T) {
+	multiboot := kernelWith(0, "\x02\xb0\xad\x1b\x00\x00\x00\x00\xfe\x4f\x52\xe4")
+
+	// Instead of loop mounting ISOs, pretend they contain a grub config.
+	isoDir, err := ioutil.TempDir("", "netboot-iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(isoDir)
+	if err := os.MkdirAll(filepath.Join(isoDir, "boot/grub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	grubCfg := "set default=1\nmenuentry 'install' {\n linux /vmlinuz\n}\nmenuentry 'live' {\n linux /vmlinuz boot=live\n initrd /initrd\n}\n"
+	if err := ioutil.WriteFile(filepath.Join(isoDir, "boot/grub/grub.cfg"), []byte(grubCfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func(io.ReaderAt) (string, func(), error)) { mountISO = old }(mountISO)
+	mountISO = func(io.ReaderAt) (string, func(), error) {
+		return isoDir, func() {}, nil
+	}
+
+	for _, tt := range []struct {
+		file    string
+		content string
+		want    string
+	}{
+		{
+			file:    "bzImage",
+			content: kernelWith(0x202, "HdrS"),
+			want:    "*boot.LinuxImage bzImage",
+		},
+		{
+			file:    "Image",
+			content: kernelWith(56, "ARM\x64"),
+			want:    "*boot.LinuxImage Image",
+		},
+		{
+			file:    "vmlinux",
+			content: kernelWith(0, "\x7fELF"),
+			want:    "*boot.LinuxImage vmlinux",
+		},
+		{
+			file:    "xen.gz",
+			content: multiboot,
+			want:    "*boot.MultibootImage xen.gz",
+		},
+		{
+			file:    "boot.iso",
+			content: kernelWith(0x8001, "CD001"),
+			want:    "*boot.LinuxImage live",
+		},
+		{
+			file:    "boot.ipxe",
+			content: "#!ipxe\nkernel bzImage\nboot\n",
+			want:    "*boot.LinuxImage ",
+		},
+		{
+			file:    "pxelinux.0",
+			content: "not a kernel",
+			want:    "*boot.LinuxImage pxe",
+		},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			fs := curl.NewMockScheme("tftp")
+			fs.Add("1.2.3.4", "/boot/"+tt.file, tt.content)
+			fs.Add("1.2.3.4", "/boot/bzImage", kernelWith(0x202, "HdrS"))
+			fs.Add("1.2.3.4", "/boot/pxelinux.cfg/default", "default pxe\nlabel pxe\nkernel bzImage\n")
+			s := make(curl.Schemes)
+			s.Register(fs.Scheme, fs)
+
+			uri := &url.URL{Scheme: "tftp", Host: "1.2.3.4", Path: "/boot/" + tt.file}
+			n := &syslinux.Network{MAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}
+			img, err := getBootImage(s, uri, nil, n)
+			if err != nil {
+				t.Fatalf("getBootImage() = %v", err)
+			}
+			var name string
+			switch i := img.(type) {
+			case *boot.LinuxImage:
+				name = i.Name
+			case *boot.MultibootImage:
+				name = i.Name
+			}
+			if got := fmt.Sprintf("%T %s", img, name); got != tt.want {
+				t.Errorf("getBootImage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestISOImageNoConfig(t *testing.T) {
+	isoDir, err := ioutil.TempDir("", "netboot-iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(isoDir)
+	var cleaned bool
+	defer func(old func(io.ReaderAt) (string, func(), error)) { mountISO = old }(mountISO)
+	mountISO = func(io.ReaderAt) (string, func(), error) {
+		return isoDir, func() { cleaned = true }, nil
+	}
+
+	if _, err := ISOImage(strings.NewReader(kernelWith(0x8001, "CD001")), "boot.iso"); err == nil {
+		t.Errorf("ISOImage() = nil, want error")
+	}
+	if !cleaned {
+		t.Errorf("ISO unmounted: got false, want true")
+	}
+}
+
+func TestISCSICmdline(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IP{192, 168, 1, 1}, Port: 3260}
+	v6 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 3260}
+	for _, tt := range []struct {
+		cmdline string
+		target  *net.TCPAddr
+		lun     uint64
+		want    string
+	}{
+		{
+			cmdline: "console=ttyS0",
+			target:  v4,
+			want:    "console=ttyS0 netroot=iscsi:192.168.1.1::3260::iqn.2019-10.example:disk ip=dhcp",
+		},
+		{
+			cmdline: "ip=eth0:dhcp",
+			target:  v6,
+			want:    "ip=eth0:dhcp netroot=iscsi:[fe80::1]::3260::iqn.2019-10.example:disk",
+		},
+		{
+			cmdline: "console=ttyS0",
+			target:  v4,
+			lun:     0x1a,
+			want:    "console=ttyS0 netroot=iscsi:192.168.1.1::3260:1a:iqn.2019-10.example:disk ip=dhcp",
+		},
+		{
+			cmdline: "netroot=iscsi:10.0.0.1::::iqn.other",
+			target:  v4,
+			want:    "netroot=iscsi:10.0.0.1::::iqn.other",
+		},
+	} {
+		if got := iscsiCmdline(tt.cmdline, tt.target, tt.lun, "iqn.2019-10.example:disk"); got != tt.want {
+			t.Errorf("iscsiCmdline(%q) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
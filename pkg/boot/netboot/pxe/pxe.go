@@ -27,8 +27,14 @@ func ParseConfig(workingDir *url.URL, mac net.HardwareAddr, ip net.IP) (*syslinu
 // ParseConfigWithSchemes probes for config files based on the Mac and IP given
 // and uses s to fetch files.
 func ParseConfigWithSchemes(workingDir *url.URL, mac net.HardwareAddr, ip net.IP, s curl.Schemes) (*syslinux.Config, error) {
-	for _, relname := range probeFiles(mac, ip) {
-		c, err := syslinux.ParseConfigFileWithSchemes(s, path.Join("pxelinux.cfg", relname), workingDir)
+	return ParseConfigWithNetwork(workingDir, &syslinux.Network{MAC: mac, IP: ip}, s)
+}
+
+// ParseConfigWithNetwork probes for config files based on the DHCP lease n,
+// which is also passed to kernels by IPAPPEND, and uses s to fetch files.
+func ParseConfigWithNetwork(workingDir *url.URL, n *syslinux.Network, s curl.Schemes) (*syslinux.Config, error) {
+	for _, relname := range probeFiles(n.MAC, n.IP) {
+		c, err := syslinux.ParseConfigFileWithNetwork(s, path.Join("pxelinux.cfg", relname), workingDir, n)
 		if curl.IsURLError(err) {
 			// We didn't find the file.
 			// TODO(hugelgupf): log this.
@@ -7,20 +7,32 @@
 // See http://www.syslinux.org/wiki/index.php?title=Config for general syslinux
 // config features.
 //
-// Currently, only the APPEND, INCLUDE, KERNEL, LABEL, DEFAULT, and INITRD
-// directives are partially supported.
+// The APPEND, CONFIG, DEFAULT, FDT, FDTDIR, INCLUDE, INITRD, IPAPPEND,
+// KERNEL, LABEL, LINUX, LOCALBOOT, ONTIMEOUT, PROMPT, SAY and TIMEOUT
+// directives are supported, as are MENU LABEL, MENU DEFAULT and MENU TITLE.
+//
+// Entries using mboot.c32, e.g. to boot Xen with a dom0 kernel and initrd,
+// become multiboot images. Other COM32 modules are not supported.
 package syslinux
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/uio"
 )
@@ -29,6 +41,25 @@ var (
 	// ErrDefaultEntryNotFound is returned when the configuration file
 	// names a default label that is not part of the configuration.
 	ErrDefaultEntryNotFound = errors.New("default label not found in configuration")
+
+	// ErrLocalBoot is returned when loading a LOCALBOOT entry. Callers
+	// should continue with the next boot device.
+	ErrLocalBoot = errors.New("LOCALBOOT: boot from the next boot device")
+
+	errNoMbootKernel = errors.New("mboot.c32: no kernel given")
+
+	// errConfigSwitched stops parsing the current file after a CONFIG
+	// directive loaded another one.
+	errConfigSwitched = errors.New("switched to another configuration file")
+)
+
+// IPAPPEND flags.
+const (
+	// ipAppendIP adds ip=<client>:<server>:<gateway>:<netmask>.
+	ipAppendIP = 1 << iota
+
+	// ipAppendBootIf adds BOOTIF=01-<MAC address>.
+	ipAppendBootIf
 )
 
 // Config encapsulates a parsed Syslinux configuration file.
@@ -36,21 +67,145 @@ var (
 // See http://www.syslinux.org/wiki/index.php?title=Config for the
 // configuration file specification.
 type Config struct {
-	// Entries is a map of label name -> label configuration.
-	Entries map[string]*boot.LinuxImage
+	// Entries is a map of label name -> label configuration, either a
+	// *boot.LinuxImage, a *boot.MultibootImage for mboot.c32 labels, or
+	// a *LocalBoot. Their Name is the MENU LABEL, if any, or the label
+	// name.
+	Entries map[string]boot.OSImage
+
+	// Labels are the label names in the order they appear in the
+	// configuration.
+	Labels []string
 
 	// DefaultEntry is the default label key to use.
 	//
 	// If DefaultEntry is non-empty, the label is guaranteed to exist in
 	// `Entries`.
 	DefaultEntry string
+
+	// OnTimeout is the label to boot when the timeout expires, if it is
+	// different from DefaultEntry.
+	//
+	// If OnTimeout is non-empty, the label is guaranteed to exist in
+	// `Entries`.
+	OnTimeout string
+
+	// Timeout is how long to wait for the user before booting. Zero
+	// means no timeout was given.
+	Timeout time.Duration
+
+	// Prompt is set if the boot prompt is always displayed, rather than
+	// only when the timeout is non-zero.
+	Prompt bool
+
+	// Title is the MENU TITLE.
+	Title string
+
+	// Say are the messages of SAY directives, to be displayed before
+	// booting.
+	Say []string
+}
+
+// Images returns the entries in configuration file order.
+func (c *Config) Images() []boot.OSImage {
+	imgs := make([]boot.OSImage, 0, len(c.Labels))
+	for _, label := range c.Labels {
+		imgs = append(imgs, c.Entries[label])
+	}
+	return imgs
+}
+
+// MenuConfig returns the menu configuration for Images.
+//
+// The menu defaults to OnTimeout, then DefaultEntry, then the first entry.
+// Without TIMEOUT, the menu waits forever if PROMPT is set and boots the
+// default entry right away otherwise.
+func (c *Config) MenuConfig() menu.Config {
+	cfg := menu.Config{
+		Title:   c.Title,
+		Timeout: c.Timeout,
+	}
+	if cfg.Timeout == 0 && c.Prompt {
+		cfg.Timeout = -1
+	}
+	def := c.OnTimeout
+	if len(def) == 0 {
+		def = c.DefaultEntry
+	}
+	for i, label := range c.Labels {
+		if label == def {
+			cfg.Default = i
+			break
+		}
+	}
+	return cfg
+}
+
+// LocalBoot is the OSImage of a LOCALBOOT label, which boots from the next
+// boot device rather than a kernel.
+type LocalBoot struct {
+	Name string
+
+	// Type is the LOCALBOOT argument.
+	Type int
+}
+
+var _ boot.OSImage = &LocalBoot{}
+
+// Label implements boot.OSImage.Label.
+func (lb *LocalBoot) Label() string {
+	if len(lb.Name) > 0 {
+		return lb.Name
+	}
+	return "Local boot"
+}
+
+// String implements fmt.Stringer.
+func (lb *LocalBoot) String() string {
+	return fmt.Sprintf("LocalBoot(%s, type %d)", lb.Name, lb.Type)
+}
+
+// Load implements boot.OSImage.Load and always returns ErrLocalBoot.
+func (lb *LocalBoot) Load(verbose bool) error {
+	return ErrLocalBoot
+}
+
+// Network is the DHCP lease of a PXE boot, used by IPAPPEND.
+type Network struct {
+	MAC     net.HardwareAddr
+	IP      net.IP
+	Netmask net.IPMask
+	Server  net.IP
+	Gateway net.IP
+}
+
+// ipAppend returns the kernel arguments for the IPAPPEND flags.
+func (n *Network) ipAppend(flags int) []string {
+	var args []string
+	if flags&ipAppendIP != 0 && n.IP != nil {
+		ip := func(ip net.IP) string {
+			if ip == nil {
+				return ""
+			}
+			return ip.String()
+		}
+		var mask string
+		if n.Netmask != nil {
+			mask = net.IP(n.Netmask).String()
+		}
+		args = append(args, fmt.Sprintf("ip=%s:%s:%s:%s", ip(n.IP), ip(n.Server), ip(n.Gateway), mask))
+	}
+	if flags&ipAppendBootIf != 0 && n.MAC != nil {
+		// 01 is the ARP hardware type of Ethernet.
+		args = append(args, "BOOTIF=01-"+strings.Replace(n.MAC.String(), ":", "-", -1))
+	}
+	return args
 }
 
 // ParseConfigFile parses a Syslinux configuration as specified in
 // http://www.syslinux.org/wiki/index.php?title=Config
 //
-// Currently, only the APPEND, INCLUDE, KERNEL, LABEL, DEFAULT, and INITRD
-// directives are partially supported.
+// See the package documentation for the supported directives.
 //
 // curl.DefaultSchemes is used to fetch any files that must be parsed or
 // provided.
@@ -66,10 +221,18 @@ func ParseConfigFile(url string, wd *url.URL) (*Config, error) {
 // ParseConfigFileWithSchemes is like ParseConfigFile, but uses the given
 // schemes explicitly.
 func ParseConfigFileWithSchemes(s curl.Schemes, url string, wd *url.URL) (*Config, error) {
+	return ParseConfigFileWithNetwork(s, url, wd, nil)
+}
+
+// ParseConfigFileWithNetwork is like ParseConfigFileWithSchemes, and adds
+// the DHCP lease n to the command lines of labels with IPAPPEND.
+func ParseConfigFileWithNetwork(s curl.Schemes, url string, wd *url.URL, n *Network) (*Config, error) {
 	p := newParserWithSchemes(wd, s)
-	if err := p.appendFile(url); err != nil {
+	p.network = n
+	if err := p.appendFile(url); err != nil && err != errConfigSwitched {
 		return nil, err
 	}
+	p.finish()
 	return p.config, nil
 }
 
@@ -77,11 +240,16 @@ type parser struct {
 	config *Config
 
 	// parser internals.
-	globalAppend string
-	scope        scope
-	curEntry     string
-	wd           *url.URL
-	schemes      curl.Schemes
+	globalAppend   string
+	globalIPAppend int
+	scope          scope
+	curEntry       string
+	wd             *url.URL
+	schemes        curl.Schemes
+	network        *Network
+
+	// ipAppend are the IPAPPEND flags of each label.
+	ipAppend map[string]int
 }
 
 type scope uint8
@@ -102,11 +270,12 @@ const (
 func newParserWithSchemes(wd *url.URL, s curl.Schemes) *parser {
 	return &parser{
 		config: &Config{
-			Entries: make(map[string]*boot.LinuxImage),
+			Entries: make(map[string]boot.OSImage),
 		},
-		scope:   scopeGlobal,
-		wd:      wd,
-		schemes: s,
+		scope:    scopeGlobal,
+		wd:       wd,
+		schemes:  s,
+		ipAppend: make(map[string]int),
 	}
 }
 
@@ -157,6 +326,25 @@ func (c *parser) appendFile(url string) error {
 	return c.append(string(config))
 }
 
+// switchConfig implements CONFIG: it discards everything parsed so far and
+// parses url instead, with dir as the new working directory if given.
+func (c *parser) switchConfig(url, dir string) error {
+	wd := c.wd
+	if len(dir) > 0 {
+		var err error
+		if wd, err = parseURL(dir, c.wd); err != nil {
+			return err
+		}
+	}
+	n := newParserWithSchemes(wd, c.schemes)
+	n.network = c.network
+	if err := n.appendFile(url); err != nil && err != errConfigSwitched {
+		return err
+	}
+	*c = *n
+	return errConfigSwitched
+}
+
 // Append parses `config` and adds the respective configuration to `c`.
 func (c *parser) append(config string) error {
 	// Here's a shitty parser.
@@ -176,8 +364,36 @@ func (c *parser) append(config string) error {
 
 		switch directive {
 		case "default":
+			// Older configurations name the menu module, e.g.
+			// vesamenu.c32, rather than a label.
+			if strings.HasSuffix(strings.ToLower(kv[1]), ".c32") {
+				continue
+			}
 			c.config.DefaultEntry = arg
 
+		case "ontimeout":
+			c.config.OnTimeout = arg
+
+		case "timeout":
+			// The timeout is in units of 1/10 s.
+			t, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid TIMEOUT %q: %v", arg, err)
+			}
+			c.config.Timeout = time.Duration(t) * time.Second / 10
+
+		case "prompt":
+			c.config.Prompt = arg != "0"
+
+		case "say":
+			// SAY prints the rest of the line verbatim.
+			msg := strings.TrimSpace(line)
+			msg = strings.TrimSpace(msg[len(kv[0]):])
+			c.config.Say = append(c.config.Say, msg)
+
+		case "menu":
+			c.menu(strings.ToLower(kv[1]), strings.Join(kv[2:], " "))
+
 		case "include":
 			if err := c.appendFile(arg); curl.IsURLError(err) {
 				// Means we didn't find the file. Just ignore
@@ -188,26 +404,111 @@ func (c *parser) append(config string) error {
 				return err
 			}
 
+		case "config":
+			var dir string
+			if len(kv) > 2 {
+				dir = kv[2]
+			}
+			return c.switchConfig(kv[1], dir)
+
 		case "label":
 			// We forever enter label scope.
 			c.scope = scopeEntry
 			c.curEntry = arg
-			c.config.Entries[c.curEntry] = &boot.LinuxImage{}
-			c.config.Entries[c.curEntry].Cmdline = c.globalAppend
+			if _, ok := c.config.Entries[c.curEntry]; !ok {
+				c.config.Labels = append(c.config.Labels, c.curEntry)
+			}
+			c.config.Entries[c.curEntry] = &boot.LinuxImage{
+				Name:    c.curEntry,
+				Cmdline: c.globalAppend,
+			}
+			c.ipAppend[c.curEntry] = c.globalIPAppend
 
-		case "kernel":
+		case "kernel", "linux", "com32":
+			if c.scope != scopeEntry {
+				continue
+			}
+			if directive != "linux" && isMboot(kv[1]) {
+				mi := &boot.MultibootImage{
+					Name: c.config.Entries[c.curEntry].Label(),
+				}
+				c.config.Entries[c.curEntry] = mi
+				// COM32 takes the module arguments on the same
+				// line, KERNEL on the APPEND line.
+				if directive == "com32" && len(kv) > 2 {
+					if err := c.appendMultiboot(mi, kv[2:]); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if directive == "com32" {
+				log.Printf("syslinux: label %q: COM32 module %s is not supported", c.curEntry, arg)
+				continue
+			}
 			k, err := c.getFile(arg)
 			if err != nil {
 				return err
 			}
-			c.config.Entries[c.curEntry].Kernel = k
+			c.linuxEntry().Kernel = k
+
+		case "localboot":
+			if c.scope != scopeEntry {
+				continue
+			}
+			t, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid LOCALBOOT %q: %v", arg, err)
+			}
+			c.config.Entries[c.curEntry] = &LocalBoot{
+				Name: c.config.Entries[c.curEntry].Label(),
+				Type: t,
+			}
 
 		case "initrd":
+			if c.scope != scopeEntry {
+				continue
+			}
 			i, err := c.getFile(arg)
 			if err != nil {
 				return err
 			}
-			c.config.Entries[c.curEntry].Initrd = i
+			c.linuxEntry().Initrd = i
+
+		case "fdt", "devicetree":
+			if c.scope != scopeEntry {
+				continue
+			}
+			dtb, err := c.getFile(arg)
+			if err != nil {
+				return err
+			}
+			li := c.linuxEntry()
+			li.DTB = dtb
+			li.LoadSyscall = true
+
+		case "fdtdir", "devicetreedir":
+			if c.scope != scopeEntry {
+				continue
+			}
+			li := c.linuxEntry()
+			// An explicit FDT takes precedence.
+			if li.DTB == nil {
+				li.DTB = c.fdtDir(arg)
+				li.LoadSyscall = true
+			}
+
+		case "ipappend":
+			flags, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid IPAPPEND %q: %v", arg, err)
+			}
+			switch c.scope {
+			case scopeGlobal:
+				c.globalIPAppend = flags
+			case scopeEntry:
+				c.ipAppend[c.curEntry] = flags
+			}
 
 		case "append":
 			switch c.scope {
@@ -215,17 +516,29 @@ func (c *parser) append(config string) error {
 				c.globalAppend = arg
 
 			case scopeEntry:
-				if arg == "-" {
-					c.config.Entries[c.curEntry].Cmdline = ""
-				} else {
-					c.config.Entries[c.curEntry].Cmdline = arg
+				switch e := c.config.Entries[c.curEntry].(type) {
+				case *boot.MultibootImage:
+					if err := c.appendMultiboot(e, kv[1:]); err != nil {
+						return err
+					}
+				case *boot.LinuxImage:
+					if arg == "-" {
+						e.Cmdline = ""
+					} else {
+						e.Cmdline = arg
+					}
 				}
 			}
 		}
 	}
 
 	// Go through all labels and download the initrds.
-	for _, label := range c.config.Entries {
+	for _, e := range c.config.Entries {
+		label, ok := e.(*boot.LinuxImage)
+		if !ok {
+			continue
+		}
+
 		// If the initrd was set via the INITRD directive, don't
 		// overwrite that.
 		//
@@ -256,6 +569,165 @@ func (c *parser) append(config string) error {
 			return ErrDefaultEntryNotFound
 		}
 	}
+	if len(c.config.OnTimeout) > 0 {
+		if _, ok := c.config.Entries[c.config.OnTimeout]; !ok {
+			return ErrDefaultEntryNotFound
+		}
+	}
 	return nil
 
 }
+
+// menu handles the MENU directives.
+func (c *parser) menu(directive, arg string) {
+	switch directive {
+	case "title":
+		c.config.Title = arg
+
+	case "label":
+		if c.scope != scopeEntry {
+			return
+		}
+		// ^ marks the hotkey of the label.
+		name := strings.Replace(arg, "^", "", -1)
+		switch e := c.config.Entries[c.curEntry].(type) {
+		case *boot.LinuxImage:
+			e.Name = name
+		case *boot.MultibootImage:
+			e.Name = name
+		case *LocalBoot:
+			e.Name = name
+		}
+
+	case "default":
+		if c.scope == scopeEntry {
+			c.config.DefaultEntry = c.curEntry
+		}
+	}
+}
+
+// finish adds the IPAPPEND arguments to the Linux labels, once all files
+// are parsed.
+func (c *parser) finish() {
+	if c.network == nil {
+		return
+	}
+	for label, flags := range c.ipAppend {
+		li, ok := c.config.Entries[label].(*boot.LinuxImage)
+		if !ok || flags == 0 {
+			continue
+		}
+		args := append([]string{li.Cmdline}, c.network.ipAppend(flags)...)
+		li.Cmdline = strings.TrimSpace(strings.Join(args, " "))
+	}
+}
+
+// compatible can be replaced for testing.
+var compatible = currentCompatible
+
+// currentCompatible returns the compatible strings of the running system's
+// device tree.
+func currentCompatible() ([]string, error) {
+	b, err := ioutil.ReadFile("/sys/firmware/devicetree/base/compatible")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bytes.TrimRight(b, "\x00")), "\x00"), nil
+}
+
+// fdtDir returns the device tree for this machine from the FDTDIR dir.
+//
+// Like U-Boot without an fdtfile variable, the file is named after the
+// machine: for each compatible string "vendor,board", most specific first,
+// dir/vendor/board.dtb and dir/board.dtb are tried on first read.
+func (c *parser) fdtDir(dir string) io.ReaderAt {
+	return uio.NewLazyOpenerAt(dir, func() (io.ReaderAt, error) {
+		compat, err := compatible()
+		if err != nil {
+			return nil, fmt.Errorf("FDTDIR %s: %v", dir, err)
+		}
+		for _, cs := range compat {
+			vendor, board := "", cs
+			if i := strings.Index(cs, ","); i >= 0 {
+				vendor, board = cs[:i], cs[i+1:]
+			}
+			for _, name := range []string{path.Join(dir, vendor, board+".dtb"), path.Join(dir, board+".dtb")} {
+				u, err := parseURL(name, c.wd)
+				if err != nil {
+					return nil, err
+				}
+				if dtb, err := c.schemes.Fetch(u); err == nil {
+					return dtb, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("FDTDIR %s: no device tree for %v", dir, compat)
+	})
+}
+
+// isMboot returns whether kernel is syslinux's multiboot loader.
+func isMboot(kernel string) bool {
+	return strings.ToLower(path.Base(kernel)) == "mboot.c32"
+}
+
+// linuxEntry returns the current label as a LinuxImage. A KERNEL directive
+// after mboot.c32 turns the label back into a Linux label.
+func (c *parser) linuxEntry() *boot.LinuxImage {
+	if li, ok := c.config.Entries[c.curEntry].(*boot.LinuxImage); ok {
+		return li
+	}
+	li := &boot.LinuxImage{
+		Name:    c.config.Entries[c.curEntry].Label(),
+		Cmdline: c.globalAppend,
+	}
+	c.config.Entries[c.curEntry] = li
+	return li
+}
+
+// appendMultiboot adds the kernel and modules of an mboot.c32 APPEND line to
+// mi. The kernel and modules, each followed by its arguments, are separated
+// by "---", e.g.
+//
+//	APPEND xen.gz dom0_mem=1G --- vmlinuz console=hvc0 --- initrd.img
+//
+// Like mboot.c32, each command line starts with the file name.
+func (c *parser) appendMultiboot(mi *boot.MultibootImage, args []string) error {
+	var cmds [][]string
+	cmd := []string{}
+	for _, a := range args {
+		if a == "---" {
+			cmds = append(cmds, cmd)
+			cmd = []string{}
+		} else {
+			cmd = append(cmd, a)
+		}
+	}
+	cmds = append(cmds, cmd)
+
+	if len(cmds[0]) == 0 {
+		return errNoMbootKernel
+	}
+	k, err := c.getFile(cmds[0][0])
+	if err != nil {
+		return err
+	}
+	mi.Kernel = k
+	mi.Cmdline = strings.Join(cmds[0], " ")
+	mi.Modules = nil
+
+	for _, cmd := range cmds[1:] {
+		if len(cmd) == 0 {
+			continue
+		}
+		m, err := c.getFile(cmd[0])
+		if err != nil {
+			return err
+		}
+		mi.Modules = append(mi.Modules, multiboot.Module{
+			Module:  m,
+			Name:    cmd[0],
+			CmdLine: strings.Join(cmd, " "),
+		})
+	}
+	return nil
+}
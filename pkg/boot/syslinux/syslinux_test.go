@@ -7,12 +7,16 @@ package syslinux
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/uio"
 )
@@ -74,8 +78,8 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content1),
 						Initrd:  strings.NewReader(content2),
 						Cmdline: "initrd=./pxefiles/initrd",
@@ -108,8 +112,8 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content1),
 						Initrd:  strings.NewReader(content2),
 						Cmdline: "foo=bar",
@@ -139,8 +143,8 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content1),
 						Initrd:  nil,
 						Cmdline: "",
@@ -169,8 +173,8 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel: errorReader{&curl.URLError{
 							URL: &url.URL{
 								Scheme: "tftp",
@@ -256,12 +260,12 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content1),
 						Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
 					},
-					"bar": {
+					"bar": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content2),
 						Cmdline: "console=ttyS0",
 					},
@@ -301,18 +305,18 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "foo",
-				Entries: map[string]*boot.LinuxImage{
-					"foo": {
+				Entries: map[string]boot.OSImage{
+					"foo": &boot.LinuxImage{
 						Kernel: strings.NewReader(content1),
 						// Does not contain global APPEND.
 						Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
 					},
-					"bar": {
+					"bar": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 						// Contains only global APPEND.
 						Cmdline: "foo=bar",
 					},
-					"baz": {
+					"baz": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 						// "APPEND -" means ignore global APPEND.
 						Cmdline: "",
@@ -360,24 +364,24 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "mcnulty",
-				Entries: map[string]*boot.LinuxImage{
-					"mcnulty": {
+				Entries: map[string]boot.OSImage{
+					"mcnulty": &boot.LinuxImage{
 						Kernel: strings.NewReader(content1),
 						// Does not contain global APPEND.
 						Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
 					},
-					"lester": {
+					"lester": &boot.LinuxImage{
 						Kernel: strings.NewReader(content1),
 						Initrd: strings.NewReader(content3),
 						// Contains only global APPEND.
 						Cmdline: "initrd=./pxefiles/normal_person",
 					},
-					"omar": {
+					"omar": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 						// "APPEND -" means ignore global APPEND.
 						Cmdline: "",
 					},
-					"stringer": {
+					"stringer": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 						// See TODO in pxe.go initrd handling.
 						Initrd:  strings.NewReader(content4),
@@ -438,8 +442,8 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "sheeeit",
-				Entries: map[string]*boot.LinuxImage{
-					"sheeeit": {
+				Entries: map[string]boot.OSImage{
+					"sheeeit": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 						Initrd: strings.NewReader(content3),
 					},
@@ -489,17 +493,89 @@ func TestAppendFile(t *testing.T) {
 			},
 			want: &Config{
 				DefaultEntry: "mcnulty",
-				Entries: map[string]*boot.LinuxImage{
-					"mcnulty": {
+				Entries: map[string]boot.OSImage{
+					"mcnulty": &boot.LinuxImage{
 						Kernel:  strings.NewReader(content1),
 						Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
 					},
-					"omar": {
+					"omar": &boot.LinuxImage{
 						Kernel: strings.NewReader(content2),
 					},
 				},
 			},
 		},
+		{
+			desc:          "mboot.c32 with Xen, dom0 kernel and initrd",
+			configFileURI: "pxelinux.cfg/default",
+			schemeFunc: func() curl.Schemes {
+				s := make(curl.Schemes)
+				fs := curl.NewMockScheme("tftp")
+				conf := `default xen
+				label xen
+				kernel mboot.c32
+				append xen.gz dom0_mem=1G --- vmlinuz console=hvc0 --- initrd.img
+
+				label linux
+				kernel vmlinuz
+				append console=ttyS0`
+				fs.Add("1.2.3.4", "/foobar/pxelinux.cfg/default", conf)
+				fs.Add("1.2.3.4", "/foobar/xen.gz", content1)
+				fs.Add("1.2.3.4", "/foobar/vmlinuz", content2)
+				fs.Add("1.2.3.4", "/foobar/initrd.img", content3)
+				s.Register(fs.Scheme, fs)
+				return s
+			},
+			wd: &url.URL{
+				Scheme: "tftp",
+				Host:   "1.2.3.4",
+				Path:   "/foobar",
+			},
+			want: &Config{
+				DefaultEntry: "xen",
+				Entries: map[string]boot.OSImage{
+					"xen": &boot.MultibootImage{
+						Kernel:  strings.NewReader(content1),
+						Cmdline: "xen.gz dom0_mem=1G",
+						Modules: []multiboot.Module{
+							{
+								Module:  strings.NewReader(content2),
+								Name:    "vmlinuz",
+								CmdLine: "vmlinuz console=hvc0",
+							},
+							{
+								Module:  strings.NewReader(content3),
+								Name:    "initrd.img",
+								CmdLine: "initrd.img",
+							},
+						},
+					},
+					"linux": &boot.LinuxImage{
+						Kernel:  strings.NewReader(content2),
+						Cmdline: "console=ttyS0",
+					},
+				},
+			},
+		},
+		{
+			desc:          "mboot.c32 without kernel",
+			configFileURI: "pxelinux.cfg/default",
+			schemeFunc: func() curl.Schemes {
+				s := make(curl.Schemes)
+				fs := curl.NewMockScheme("tftp")
+				conf := `label xen
+				kernel mboot.c32
+				append --- vmlinuz`
+				fs.Add("1.2.3.4", "/foobar/pxelinux.cfg/default", conf)
+				s.Register(fs.Scheme, fs)
+				return s
+			},
+			wd: &url.URL{
+				Scheme: "tftp",
+				Host:   "1.2.3.4",
+				Path:   "/foobar",
+			},
+			err: errNoMbootKernel,
+		},
 	} {
 		t.Run(fmt.Sprintf("Test [%02d] %s", i, tt.desc), func(t *testing.T) {
 			s := tt.schemeFunc()
@@ -518,11 +594,24 @@ func TestAppendFile(t *testing.T) {
 
 			for labelName, want := range tt.want.Entries {
 				t.Run(fmt.Sprintf("label %s", labelName), func(t *testing.T) {
-					got, ok := c.Entries[labelName]
+					e, ok := c.Entries[labelName]
 					if !ok {
 						t.Errorf("Config label %v does not exist", labelName)
 						return
 					}
+					if want, ok := want.(*boot.MultibootImage); ok {
+						got, ok := e.(*boot.MultibootImage)
+						if !ok {
+							t.Fatalf("got %T, want *boot.MultibootImage", e)
+						}
+						checkMultiboot(t, got, want)
+						return
+					}
+					got, ok := e.(*boot.LinuxImage)
+					if !ok {
+						t.Fatalf("got %T, want *boot.LinuxImage", e)
+					}
+					want := want.(*boot.LinuxImage)
 
 					// Same kernel?
 					if !uio.ReaderAtEqual(got.Kernel, want.Kernel) {
@@ -551,6 +640,207 @@ func TestAppendFile(t *testing.T) {
 	}
 }
 
+func checkMultiboot(t *testing.T, got, want *boot.MultibootImage) {
+	t.Helper()
+	if !uio.ReaderAtEqual(got.Kernel, want.Kernel) {
+		t.Errorf("got kernel %s, want %s", mustReadAll(got.Kernel), mustReadAll(want.Kernel))
+	}
+	if got.Cmdline != want.Cmdline {
+		t.Errorf("got cmdline %s, want %s", got.Cmdline, want.Cmdline)
+	}
+	if len(got.Modules) != len(want.Modules) {
+		t.Fatalf("got %d modules, want %d", len(got.Modules), len(want.Modules))
+	}
+	for i, m := range got.Modules {
+		if !uio.ReaderAtEqual(m.Module, want.Modules[i].Module) {
+			t.Errorf("got module %d %s, want %s", i, mustReadAll(m.Module), mustReadAll(want.Modules[i].Module))
+		}
+		if m.Name != want.Modules[i].Name || m.CmdLine != want.Modules[i].CmdLine {
+			t.Errorf("got module %d name %q cmdline %q, want %q and %q", i, m.Name, m.CmdLine, want.Modules[i].Name, want.Modules[i].CmdLine)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	conf := `say Booting from the network
+	menu title PXE boot
+	timeout 50
+	ontimeout local
+	prompt 1
+	ipappend 2
+	append quiet
+
+	label install
+	menu label ^Install
+	linux vmlinuz
+	initrd initrd.img
+	fdt board.dtb
+	ipappend 3
+
+	label rescue
+	menu default
+	kernel vmlinuz
+	append -
+
+	label xen
+	com32 mboot.c32 xen.gz --- vmlinuz console=hvc0
+
+	label local
+	menu label Boot from ^disk
+	localboot 0
+	`
+	fs := curl.NewMockScheme("tftp")
+	fs.Add("1.2.3.4", "/foobar/pxelinux.cfg/default", conf)
+	fs.Add("1.2.3.4", "/foobar/vmlinuz", "kernel")
+	fs.Add("1.2.3.4", "/foobar/initrd.img", "initrd")
+	fs.Add("1.2.3.4", "/foobar/board.dtb", "dtb")
+	fs.Add("1.2.3.4", "/foobar/xen.gz", "xen")
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+	wd := &url.URL{
+		Scheme: "tftp",
+		Host:   "1.2.3.4",
+		Path:   "/foobar",
+	}
+	n := &Network{
+		MAC:     []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		IP:      net.IP{192, 168, 1, 10},
+		Netmask: net.IPMask{255, 255, 255, 0},
+		Server:  net.IP{192, 168, 1, 1},
+		Gateway: net.IP{192, 168, 1, 254},
+	}
+
+	c, err := ParseConfigFileWithNetwork(s, "pxelinux.cfg/default", wd, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"install", "rescue", "xen", "local"}; !reflect.DeepEqual(c.Labels, want) {
+		t.Errorf("Labels = %v, want %v", c.Labels, want)
+	}
+	if c.DefaultEntry != "rescue" || c.OnTimeout != "local" {
+		t.Errorf("DefaultEntry, OnTimeout = %q, %q, want rescue, local", c.DefaultEntry, c.OnTimeout)
+	}
+	if c.Timeout != 5*time.Second || !c.Prompt || c.Title != "PXE boot" {
+		t.Errorf("Timeout, Prompt, Title = %v, %v, %q, want 5s, true, PXE boot", c.Timeout, c.Prompt, c.Title)
+	}
+	if want := []string{"Booting from the network"}; !reflect.DeepEqual(c.Say, want) {
+		t.Errorf("Say = %q, want %q", c.Say, want)
+	}
+	if got, want := c.MenuConfig(), (menu.Config{Title: "PXE boot", Default: 3, Timeout: 5 * time.Second}); got != want {
+		t.Errorf("MenuConfig() = %+v, want %+v", got, want)
+	}
+
+	var labels []string
+	for _, img := range c.Images() {
+		labels = append(labels, img.Label())
+	}
+	if want := []string{"Install", "rescue", "xen", "Boot from disk"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("image labels = %v, want %v", labels, want)
+	}
+
+	install := c.Entries["install"].(*boot.LinuxImage)
+	if want := "quiet ip=192.168.1.10:192.168.1.1:192.168.1.254:255.255.255.0 BOOTIF=01-aa-bb-cc-dd-ee-ff"; install.Cmdline != want {
+		t.Errorf("install cmdline = %q, want %q", install.Cmdline, want)
+	}
+	if got := mustReadAll(install.DTB); got != "dtb" || !install.LoadSyscall {
+		t.Errorf("install DTB = %q, LoadSyscall = %v, want dtb and LoadSyscall", got, install.LoadSyscall)
+	}
+	if got := mustReadAll(install.Initrd); got != "initrd" {
+		t.Errorf("install initrd = %q, want initrd", got)
+	}
+
+	// The global IPAPPEND applies, even without APPEND.
+	rescue := c.Entries["rescue"].(*boot.LinuxImage)
+	if want := "BOOTIF=01-aa-bb-cc-dd-ee-ff"; rescue.Cmdline != want {
+		t.Errorf("rescue cmdline = %q, want %q", rescue.Cmdline, want)
+	}
+
+	checkMultiboot(t, c.Entries["xen"].(*boot.MultibootImage), &boot.MultibootImage{
+		Kernel:  strings.NewReader("xen"),
+		Cmdline: "xen.gz",
+		Modules: []multiboot.Module{
+			{
+				Module:  strings.NewReader("kernel"),
+				Name:    "vmlinuz",
+				CmdLine: "vmlinuz console=hvc0",
+			},
+		},
+	})
+
+	if err := c.Entries["local"].(*LocalBoot).Load(false); err != ErrLocalBoot {
+		t.Errorf("local Load() = %v, want %v", err, ErrLocalBoot)
+	}
+}
+
+func TestConfigDirective(t *testing.T) {
+	fs := curl.NewMockScheme("tftp")
+	fs.Add("1.2.3.4", "/foobar/pxelinux.cfg/default", `
+	label old
+	kernel vmlinuz
+	include other.cfg
+	label ignored
+	kernel vmlinuz
+	`)
+	fs.Add("1.2.3.4", "/foobar/other.cfg", `config new.cfg new
+	label ignored2
+	`)
+	fs.Add("1.2.3.4", "/foobar/new/new.cfg", `default new
+	label new
+	kernel vmlinuz
+	`)
+	fs.Add("1.2.3.4", "/foobar/vmlinuz", "old kernel")
+	fs.Add("1.2.3.4", "/foobar/new/vmlinuz", "new kernel")
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+	wd := &url.URL{
+		Scheme: "tftp",
+		Host:   "1.2.3.4",
+		Path:   "/foobar",
+	}
+
+	c, err := ParseConfigFileWithSchemes(s, "pxelinux.cfg/default", wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new"}; !reflect.DeepEqual(c.Labels, want) || c.DefaultEntry != "new" {
+		t.Fatalf("Labels = %v, DefaultEntry = %q, want %v and new", c.Labels, c.DefaultEntry, want)
+	}
+	if got := mustReadAll(c.Entries["new"].(*boot.LinuxImage).Kernel); got != "new kernel" {
+		t.Errorf("kernel = %q, want new kernel", got)
+	}
+}
+
+func TestFDTDir(t *testing.T) {
+	compatible = func() ([]string, error) {
+		return []string{"pine64,rockpro64", "rockchip,rk3399"}, nil
+	}
+	defer func() { compatible = currentCompatible }()
+
+	fs := curl.NewMockScheme("tftp")
+	fs.Add("1.2.3.4", "/foobar/pxelinux.cfg/default", `
+	label linux
+	kernel vmlinuz
+	fdtdir dtbs
+	`)
+	fs.Add("1.2.3.4", "/foobar/vmlinuz", "kernel")
+	fs.Add("1.2.3.4", "/foobar/dtbs/rockchip/rk3399.dtb", "rk3399")
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+	wd := &url.URL{
+		Scheme: "tftp",
+		Host:   "1.2.3.4",
+		Path:   "/foobar",
+	}
+
+	c, err := ParseConfigFileWithSchemes(s, "pxelinux.cfg/default", wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustReadAll(c.Entries["linux"].(*boot.LinuxImage).DTB); got != "rk3399" {
+		t.Errorf("DTB = %q, want rk3399", got)
+	}
+}
+
 func TestParseURL(t *testing.T) {
 	for i, tt := range []struct {
 		url  string
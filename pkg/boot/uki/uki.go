@@ -0,0 +1,291 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package uki boots unified kernel images.
+//
+// A unified kernel image is an EFI stub executable with the kernel, initramfs,
+// command line and os-release embedded as the PE sections .linux, .initrd,
+// .cmdline and .osrel. They are Type #2 entries of the Boot Loader
+// Specification and live in /EFI/Linux on the ESP.
+//
+// See https://systemd.io/BOOT_LOADER_SPECIFICATION/#type-2-efi-unified-kernel-images.
+package uki
+
+import (
+	"bufio"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/bls"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// Dir is where unified kernel images are found, relative to the root of the
+// ESP.
+const Dir = "EFI/Linux"
+
+// Image is a unified kernel image OSImage.
+type Image struct {
+	// Name is the menu label. If empty, Label returns a name derived
+	// from the embedded os-release.
+	Name string
+
+	// File is the EFI executable.
+	File io.ReaderAt
+
+	// Cmdline, if non-empty, replaces the embedded command line.
+	Cmdline string
+}
+
+var _ boot.OSImage = &Image{}
+
+// Label returns either the Name or the pretty name of the embedded OS.
+func (i *Image) Label() string {
+	if len(i.Name) > 0 {
+		return i.Name
+	}
+	if osrel, err := i.OSRelease(); err == nil {
+		if name := prettyName(osrel); len(name) > 0 {
+			return name
+		}
+	}
+	return fmt.Sprintf("UKI(%s)", i.File)
+}
+
+// String implements fmt.Stringer.
+func (i *Image) String() string {
+	return fmt.Sprintf("UKI(\n  Name: %s\n  File: %s\n  Cmdline: %s\n)\n", i.Name, i.File, i.Cmdline)
+}
+
+// section returns a reader for the named section, limited to its virtual
+// size since the raw data is padded to the file alignment.
+func section(f *pe.File, r io.ReaderAt, name string) *io.SectionReader {
+	s := f.Section(name)
+	if s == nil {
+		return nil
+	}
+	size := s.Size
+	if s.VirtualSize > 0 && s.VirtualSize < size {
+		size = s.VirtualSize
+	}
+	return io.NewSectionReader(r, int64(s.Offset), int64(size))
+}
+
+// sectionString returns the contents of the named section without trailing
+// NUL bytes and whitespace.
+func sectionString(f *pe.File, r io.ReaderAt, name string) (string, error) {
+	s := section(f, r, name)
+	if s == nil {
+		return "", nil
+	}
+	b, err := ioutil.ReadAll(s)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\x00 \t\r\n"), nil
+}
+
+// OSRelease returns the fields of the embedded os-release.
+func (i *Image) OSRelease() (map[string]string, error) {
+	f, err := pe.NewFile(i.File)
+	if err != nil {
+		return nil, err
+	}
+	s, err := sectionString(f, i.File, ".osrel")
+	if err != nil {
+		return nil, err
+	}
+	return ParseOSRelease(s), nil
+}
+
+// LinuxImage returns a LinuxImage for the kernel, initramfs, command line
+// and device tree embedded in the image.
+func (i *Image) LinuxImage() (*boot.LinuxImage, error) {
+	f, err := pe.NewFile(i.File)
+	if err != nil {
+		return nil, err
+	}
+	kernel := section(f, i.File, ".linux")
+	if kernel == nil {
+		return nil, errors.New("no .linux section")
+	}
+	cmdline := i.Cmdline
+	if len(cmdline) == 0 {
+		if cmdline, err = sectionString(f, i.File, ".cmdline"); err != nil {
+			return nil, err
+		}
+	}
+
+	li := &boot.LinuxImage{
+		Name:    i.Label(),
+		Kernel:  kernel,
+		Cmdline: cmdline,
+	}
+	// Assigning a nil *io.SectionReader would make the interfaces
+	// non-nil.
+	if initrd := section(f, i.File, ".initrd"); initrd != nil {
+		li.Initrd = initrd
+	}
+	if dtb := section(f, i.File, ".dtb"); dtb != nil {
+		li.DTB = dtb
+	}
+	return li, nil
+}
+
+// Load implements OSImage.Load.
+func (i *Image) Load(verbose bool) error {
+	li, err := i.LinuxImage()
+	if err != nil {
+		return fmt.Errorf("%s: %v", i.File, err)
+	}
+	return li.Load(verbose)
+}
+
+// ParseOSRelease parses os-release(5) formatted content.
+func ParseOSRelease(s string) map[string]string {
+	osrel := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if v, err := strconv.Unquote(value); err == nil {
+					value = v
+				} else {
+					value = value[1 : len(value)-1]
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		osrel[key] = value
+	}
+	return osrel
+}
+
+func prettyName(osrel map[string]string) string {
+	for _, k := range []string{"PRETTY_NAME", "NAME", "ID"} {
+		if v := osrel[k]; len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+func version(osrel map[string]string) string {
+	for _, k := range []string{"IMAGE_VERSION", "VERSION_ID", "BUILD_ID"} {
+		if v := osrel[k]; len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// readOSRelease returns the os-release of the image at path, or an error if
+// it is not a unified kernel image.
+func readOSRelease(path string) (map[string]string, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Section(".linux") == nil {
+		return nil, errors.New("no .linux section")
+	}
+	osrel, err := sectionString(f, r, ".osrel")
+	if err != nil {
+		return nil, err
+	}
+	return ParseOSRelease(osrel), nil
+}
+
+// Find returns the unified kernel images in /EFI/Linux of the ESP mounted at
+// espRoot, in boot menu order.
+//
+// Files without a .linux section are skipped. Only the headers and the
+// os-release are read by Find; images are reopened when they are loaded.
+func Find(espRoot string) ([]*Image, error) {
+	files, err := ioutil.ReadDir(filepath.Join(espRoot, Dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Order images like Type #1 entries, by their os-release.
+	var entries []*bls.Entry
+	images := make(map[*bls.Entry]*Image)
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(name), ".efi") {
+			continue
+		}
+		path := filepath.Join(espRoot, Dir, name)
+		o, err := readOSRelease(path)
+		if err != nil {
+			Debug("%s is not a unified kernel image: %v", path, err)
+			continue
+		}
+
+		e := &bls.Entry{
+			ID:      strings.TrimSuffix(name, filepath.Ext(name)),
+			File:    path,
+			Title:   prettyName(o),
+			Version: version(o),
+		}
+		// systemd-boot uses IMAGE_ID or ID as the sort key.
+		if e.SortKey = o["IMAGE_ID"]; len(e.SortKey) == 0 {
+			e.SortKey = o["ID"]
+		}
+		entries = append(entries, e)
+		images[e] = &Image{
+			Name: e.Name(),
+			File: uio.NewLazyFile(path),
+		}
+	}
+	bls.Sort(entries)
+
+	var imgs []*Image
+	for _, e := range entries {
+		imgs = append(imgs, images[e])
+	}
+	return imgs, nil
+}
+
+// ScanImages returns an OSImage for every unified kernel image on the ESP
+// mounted at espRoot.
+func ScanImages(espRoot string) ([]boot.OSImage, error) {
+	imgs, err := Find(espRoot)
+	if err != nil {
+		return nil, err
+	}
+	var osImages []boot.OSImage
+	for _, img := range imgs {
+		osImages = append(osImages, img)
+	}
+	return osImages, nil
+}
+
+// Debug logs files that are skipped.
+var Debug = func(string, ...interface{}) {}
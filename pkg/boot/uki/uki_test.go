@@ -0,0 +1,206 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+type testSection struct {
+	name string
+	data string
+}
+
+// buildPE returns a minimal PE file with the given sections. Raw section
+// data is padded to 512 bytes like a linker would.
+func buildPE(t *testing.T, sections []testSection) []byte {
+	const (
+		peOffset   = 0x40
+		fileAlign  = 512
+		headerSize = peOffset + 4 + 20
+	)
+	var buf bytes.Buffer
+	dos := make([]byte, peOffset)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], peOffset)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:          pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections: uint16(len(sections)),
+	})
+
+	offset := uint32(fileAlign)
+	for _, s := range sections {
+		var h pe.SectionHeader32
+		copy(h.Name[:], s.name)
+		h.VirtualSize = uint32(len(s.data))
+		h.SizeOfRawData = (uint32(len(s.data)) + fileAlign - 1) / fileAlign * fileAlign
+		h.PointerToRawData = offset
+		offset += h.SizeOfRawData
+		binary.Write(&buf, binary.LittleEndian, h)
+	}
+	if buf.Len() > fileAlign {
+		t.Fatalf("too many sections")
+	}
+	buf.Write(make([]byte, fileAlign-buf.Len()))
+	for _, s := range sections {
+		data := make([]byte, (len(s.data)+fileAlign-1)/fileAlign*fileAlign)
+		copy(data, s.data)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestLinuxImage(t *testing.T) {
+	b := buildPE(t, []testSection{
+		{".osrel", "ID=fedora\nPRETTY_NAME=\"Fedora Linux 36\"\n"},
+		{".cmdline", "root=/dev/sda1 quiet\x00"},
+		{".linux", "kernel"},
+		{".initrd", "initrd"},
+	})
+
+	for _, tt := range []struct {
+		name        string
+		img         *Image
+		wantName    string
+		wantCmdline string
+	}{
+		{
+			name:        "embedded",
+			img:         &Image{File: bytes.NewReader(b)},
+			wantName:    "Fedora Linux 36",
+			wantCmdline: "root=/dev/sda1 quiet",
+		},
+		{
+			name:        "override",
+			img:         &Image{Name: "foo", File: bytes.NewReader(b), Cmdline: "console=ttyS0"},
+			wantName:    "foo",
+			wantCmdline: "console=ttyS0",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			li, err := tt.img.LinuxImage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if li.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", li.Name, tt.wantName)
+			}
+			if li.Cmdline != tt.wantCmdline {
+				t.Errorf("Cmdline = %q, want %q", li.Cmdline, tt.wantCmdline)
+			}
+			for _, f := range []struct {
+				name string
+				got  []byte
+				want string
+			}{
+				{"kernel", readAll(t, li.Kernel), "kernel"},
+				{"initrd", readAll(t, li.Initrd), "initrd"},
+			} {
+				if string(f.got) != f.want {
+					t.Errorf("%s = %q, want %q", f.name, f.got, f.want)
+				}
+			}
+			if li.DTB != nil {
+				t.Errorf("DTB = %v, want nil", li.DTB)
+			}
+		})
+	}
+
+	noLinux := &Image{File: bytes.NewReader(buildPE(t, []testSection{{".osrel", "ID=x"}}))}
+	if _, err := noLinux.LinuxImage(); err == nil {
+		t.Errorf("LinuxImage() without .linux succeeded")
+	}
+}
+
+func readAll(t *testing.T, r io.ReaderAt) []byte {
+	b, err := ioutil.ReadAll(uio.Reader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseOSRelease(t *testing.T) {
+	got := ParseOSRelease(`# comment
+NAME=Fedora
+PRETTY_NAME="Fedora 31 (Thirty One)"
+VERSION_ID='31'
+ESCAPED="a \"b\""
+BROKEN
+`)
+	want := map[string]string{
+		"NAME":        "Fedora",
+		"PRETTY_NAME": "Fedora 31 (Thirty One)",
+		"VERSION_ID":  "31",
+		"ESCAPED":     `a "b"`,
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if imgs, err := Find(dir); err != nil || len(imgs) != 0 {
+		t.Fatalf("Find(empty) = %v, %v, want none", imgs, err)
+	}
+
+	linuxDir := filepath.Join(dir, Dir)
+	if err := os.MkdirAll(linuxDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"fedora-5.3.7.efi": buildPE(t, []testSection{
+			{".osrel", "ID=fedora\nPRETTY_NAME=\"Fedora 31\"\nVERSION_ID=31"},
+			{".linux", "k"},
+		}),
+		"fedora-5.10.0.EFI": buildPE(t, []testSection{
+			{".osrel", "ID=fedora\nPRETTY_NAME=\"Fedora 33\"\nVERSION_ID=33"},
+			{".linux", "k"},
+		}),
+		"arch.efi": buildPE(t, []testSection{
+			{".osrel", "ID=arch\nNAME=Arch"},
+			{".linux", "k"},
+		}),
+		"shell.efi":  buildPE(t, []testSection{{".text", "code"}}),
+		"notpe.efi":  []byte("garbage"),
+		"readme.txt": []byte("hi"),
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(linuxDir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	imgs, err := Find(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, img := range imgs {
+		got = append(got, img.Label())
+	}
+	want := []string{"Arch", "Fedora 33", "Fedora 31"}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/linux"
 	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/crypto"
 )
@@ -139,7 +140,8 @@ func (bc *BootConfig) bytestream() []byte {
 }
 
 // Boot tries to boot the kernel with optional initramfs and command line
-// options. If a device-tree is specified, that will be used too
+// options. If a device-tree is specified, that will be used too, loading the
+// kernel with kexec_load.
 func (bc *BootConfig) Boot() error {
 	crypto.TryMeasureData(crypto.BootConfigPCR, bc.bytestream(), "bootconfig")
 	crypto.TryMeasureFiles(bc.FileNames()...)
@@ -168,7 +170,18 @@ func (bc *BootConfig) Boot() error {
 				}
 			}
 		}()
-		if err := kexec.FileLoad(kernel, initramfs, bc.KernelArgs); err != nil {
+		if bc.DeviceTree != "" {
+			// kexec_file_load cannot pass a device tree, so lay out
+			// the kernel ourselves.
+			dtb, err := os.Open(bc.DeviceTree)
+			if err != nil {
+				return fmt.Errorf("can't open device tree file: %v", err)
+			}
+			defer dtb.Close()
+			if err := linux.KexecLoad(kernel, initramfs, bc.KernelArgs, dtb); err != nil {
+				return fmt.Errorf("linux.KexecLoad() failed: %v", err)
+			}
+		} else if err := kexec.FileLoad(kernel, initramfs, bc.KernelArgs); err != nil {
 			return fmt.Errorf("kexec.FileLoad() failed: %v", err)
 		}
 	} else if bc.Multiboot != "" {
@@ -150,6 +150,25 @@ func Flag(flag string) (string, bool) {
 	return value, present
 }
 
+// FlagValues returns all values of a flag that may be given more than once,
+// such as dracut's ip= or nameserver=, in command line order.
+func FlagValues(flag string) []string {
+	once.Do(cmdLineOpener)
+	return procCmdLine.Values(flag)
+}
+
+// Values returns all values of flag in c, in command line order.
+func (c CmdLine) Values(flag string) []string {
+	canonicalFlag := strings.Replace(flag, "-", "_", -1)
+	var values []string
+	doParse(c.Raw, func(_, _, canonicalKey, _, trimmedValue string) {
+		if canonicalKey == canonicalFlag {
+			values = append(values, trimmedValue)
+		}
+	})
+	return values
+}
+
 // getFlagMap gets specified flags as a map
 func getFlagMap(flagName string) map[string]string {
 	return parseToMap(flagName)
@@ -101,3 +101,22 @@ func TestCmdlineModules(t *testing.T) {
 		t.Errorf("my_module flags got: %v, want opt1=world opt_2=22-22 ", flags)
 	}
 }
+
+func TestCmdlineValues(t *testing.T) {
+	c := parse(strings.NewReader(`ro ip=eth0:dhcp nameserver=10.0.0.1 ip=eth1:dhcp6 ` +
+		`rd.net-timeout=5 nameserver=10.0.0.2 ip="eth2:off"`))
+
+	for _, tt := range []struct {
+		flag string
+		want []string
+	}{
+		{flag: "ip", want: []string{"eth0:dhcp", "eth1:dhcp6", "eth2:off"}},
+		{flag: "nameserver", want: []string{"10.0.0.1", "10.0.0.2"}},
+		{flag: "rd.net_timeout", want: []string{"5"}},
+		{flag: "bond", want: nil},
+	} {
+		if got := c.Values(tt.flag); strings.Join(got, " ") != strings.Join(tt.want, " ") || len(got) != len(tt.want) {
+			t.Errorf("Values(%q) = %q, want %q", tt.flag, got, tt.want)
+		}
+	}
+}
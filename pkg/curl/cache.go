@@ -0,0 +1,63 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cache is a directory on a local disk of verified files, named by their
+// digest.
+type Cache struct {
+	Dir string
+}
+
+// path returns the file name of the file with digest d.
+func (c *Cache) path(d *Digest) string {
+	name := strings.Replace(d.String(), ":", "-", 1)
+	return filepath.Join(c.Dir, name)
+}
+
+// Open opens the cached file with digest d.
+func (c *Cache) Open(d *Digest) (*os.File, error) {
+	return os.Open(c.path(d))
+}
+
+// Remove removes the cached file with digest d.
+func (c *Cache) Remove(d *Digest) error {
+	return os.Remove(c.path(d))
+}
+
+// store copies r to the cache if it has digest d, and opens the cached
+// file.
+//
+// Files are only renamed into place once verified, so the cache never has
+// partial or corrupt files.
+func (c *Cache) store(d *Digest, r io.Reader) (*os.File, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(c.Dir, "."+hex.EncodeToString(d.Sum[:8])+"-*")
+	if err != nil {
+		return nil, err
+	}
+	err = d.check(io.TeeReader(r, f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(d))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return c.Open(d)
+}
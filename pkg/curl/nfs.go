@@ -0,0 +1,223 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// MOUNT version 3 and NFS version 3, RFC 1813.
+const (
+	mountProgram = 100005
+	mountVersion = 3
+	mountMnt     = 1
+
+	nfsProgram = 100003
+	nfsVersion = 3
+	nfsLookup  = 3
+	nfsRead    = 6
+
+	nfsOK         = 0
+	nfsErrNoEnt   = 2
+	nfsErrAccess  = 13
+	nfsErrNotDir  = 20
+	nfsErrIsDir   = 21
+	defaultNFSTCP = 2049
+
+	// nfsReadSize is the most bytes asked for by one READ call.
+	nfsReadSize = 64 * 1024
+)
+
+// NFSError is an error status of an NFS or MOUNT call.
+type NFSError struct {
+	Op     string
+	Status uint32
+}
+
+// Error implements error.Error.
+func (e *NFSError) Error() string {
+	var s string
+	switch e.Status {
+	case nfsErrNoEnt:
+		s = "no such file or directory"
+	case nfsErrAccess:
+		s = "permission denied"
+	case nfsErrNotDir:
+		s = "not a directory"
+	case nfsErrIsDir:
+		s = "is a directory"
+	default:
+		s = "status " + strconv.Itoa(int(e.Status))
+	}
+	return fmt.Sprintf("NFS %s: %s", e.Op, s)
+}
+
+// NFSClient implements FileScheme for NFSv3 files over TCP, as in
+// RFC 2224 URLs: nfs://server[:port]/export/path/file.
+//
+// The client runs in userspace and needs no kernel NFS support. The export
+// is not given by the URL, so the longest directory of the path the server
+// lets us mount is used.
+type NFSClient struct{}
+
+// Fetch implements FileScheme.Fetch.
+func (NFSClient) Fetch(u *url.URL) (io.ReaderAt, error) {
+	host := u.Hostname()
+	p := path.Clean("/" + u.Path)
+	if p == "/" {
+		return nil, errors.New("NFS URL has no file path")
+	}
+
+	root, rest, err := nfsMount(host, p)
+	if err != nil {
+		return nil, err
+	}
+
+	nfsPort := defaultNFSTCP
+	if port := u.Port(); len(port) > 0 {
+		if nfsPort, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+	} else if port, err := getPort(host, nfsProgram, nfsVersion); err == nil {
+		nfsPort = port
+	}
+	c, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(nfsPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	fh := root
+	for _, name := range rest {
+		if fh, err = nfsLookupName(c, fh, name); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return uio.NewCachingReader(&nfsFile{c: c, fh: fh}), nil
+}
+
+// nfsMount mounts the longest directory of p that the server allows. It
+// returns the directory's file handle and the path names below it.
+func nfsMount(host, p string) ([]byte, []string, error) {
+	port, err := getPort(host, mountProgram, mountVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finding NFS mount service: %v", err)
+	}
+	c, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	// NFSv3 file handles do not depend on the mount, so we do not bother
+	// to unmount it again.
+	names := strings.Split(p[1:], "/")
+	var mntErr error
+	for i := len(names) - 1; i >= 0; i-- {
+		dir := "/" + strings.Join(names[:i], "/")
+		var args xdrWriter
+		args.string(dir)
+		r, err := c.call(mountProgram, mountVersion, mountMnt, args.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		if status := r.uint32(); r.err != nil {
+			return nil, nil, r.err
+		} else if status != nfsOK {
+			if mntErr == nil {
+				mntErr = &NFSError{Op: "mount " + dir, Status: status}
+			}
+			continue
+		}
+		fh := r.opaque()
+		return fh, names[i:], r.err
+	}
+	return nil, nil, mntErr
+}
+
+// nfsLookupName looks up name in the directory dir.
+func nfsLookupName(c *rpcClient, dir []byte, name string) ([]byte, error) {
+	var args xdrWriter
+	args.opaque(dir)
+	args.string(name)
+	r, err := c.call(nfsProgram, nfsVersion, nfsLookup, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if status := r.uint32(); r.err == nil && status != nfsOK {
+		return nil, &NFSError{Op: "lookup " + name, Status: status}
+	}
+	fh := r.opaque()
+	return fh, r.err
+}
+
+// nfsFile reads an NFS file sequentially and closes the connection at its
+// end or at the first error.
+type nfsFile struct {
+	c   *rpcClient
+	fh  []byte
+	off uint64
+	err error
+}
+
+// Read implements io.Reader.
+func (f *nfsFile) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(p) > nfsReadSize {
+		p = p[:nfsReadSize]
+	}
+	var args xdrWriter
+	args.opaque(f.fh)
+	args.uint64(f.off)
+	args.uint32(uint32(len(p)))
+	r, err := f.c.call(nfsProgram, nfsVersion, nfsRead, args.Bytes())
+	if err != nil {
+		return 0, f.close(err)
+	}
+	if status := r.uint32(); r.err == nil && status != nfsOK {
+		return 0, f.close(&NFSError{Op: "read", Status: status})
+	}
+	skipPostOpAttr(r)
+	r.uint32() // count
+	eof := r.bool()
+	data := r.opaque()
+	if r.err != nil {
+		return 0, f.close(r.err)
+	}
+	if len(data) > len(p) {
+		return 0, f.close(fmt.Errorf("NFS read returned %d bytes, asked for %d", len(data), len(p)))
+	}
+	n := copy(p, data)
+	f.off += uint64(n)
+	if eof || n == 0 {
+		f.close(io.EOF)
+	}
+	return n, nil
+}
+
+func (f *nfsFile) close(err error) error {
+	f.err = err
+	f.c.Close()
+	return err
+}
+
+// skipPostOpAttr skips a post_op_attr.
+func skipPostOpAttr(r *xdrReader) {
+	if r.bool() {
+		// fattr3 is 21 XDR units.
+		r.skip(84)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// fakeNFSServer serves the portmapper, MOUNT and NFS programs on one port.
+type fakeNFSServer struct {
+	l      net.Listener
+	export string
+	files  map[string]string
+}
+
+func newFakeNFSServer(t *testing.T, export string, files map[string]string) *fakeNFSServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNFSServer{l: l, export: export, files: files}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNFSServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeNFSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &rpcClient{conn: conn}
+	for {
+		record, err := c.readRecord()
+		if err != nil {
+			return
+		}
+		r := &xdrReader{b: record}
+		xid := r.uint32()
+		r.uint32() // CALL
+		r.uint32() // RPC version
+		prog := r.uint32()
+		r.uint32() // program version
+		proc := r.uint32()
+		r.uint32() // cred
+		r.opaque()
+		r.uint32() // verf
+		r.opaque()
+
+		var w xdrWriter
+		w.uint32(0)
+		w.uint32(xid)
+		w.uint32(rpcReply)
+		w.uint32(rpcMsgAccepted)
+		w.uint32(authNone)
+		w.opaque(nil)
+		w.uint32(rpcSuccess)
+		s.handle(prog, proc, r, &w)
+		b := w.Bytes()
+		binary.BigEndian.PutUint32(b, lastFragment|uint32(len(b)-4))
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeNFSServer) handle(prog, proc uint32, r *xdrReader, w *xdrWriter) {
+	switch {
+	case prog == pmapProgram && proc == pmapGetPort:
+		w.uint32(uint32(s.port()))
+
+	case prog == mountProgram && proc == mountMnt:
+		if dir := string(r.opaque()); dir != s.export {
+			w.uint32(nfsErrAccess)
+			return
+		}
+		w.uint32(nfsOK)
+		w.opaque([]byte(s.export))
+		w.uint32(0) // auth flavors
+
+	case prog == nfsProgram && proc == nfsLookup:
+		name := string(r.opaque()) + "/" + string(r.opaque())
+		if _, ok := s.files[name]; !ok && !s.isDir(name) {
+			w.uint32(nfsErrNoEnt)
+			w.uint32(0) // dir attributes
+			return
+		}
+		w.uint32(nfsOK)
+		w.opaque([]byte(name))
+		w.uint32(0) // obj attributes
+		w.uint32(0) // dir attributes
+
+	case prog == nfsProgram && proc == nfsRead:
+		content, ok := s.files[string(r.opaque())]
+		off, count := int(r.uint64()), int(r.uint32())
+		if !ok {
+			w.uint32(nfsErrIsDir)
+			w.uint32(0)
+			return
+		}
+		data := content[off:]
+		if len(data) > count {
+			data = data[:count]
+		}
+		w.uint32(nfsOK)
+		w.uint32(1) // file attributes
+		w.Write(make([]byte, 84))
+		w.uint32(uint32(len(data)))
+		if off+len(data) == len(content) {
+			w.uint32(1)
+		} else {
+			w.uint32(0)
+		}
+		w.opaque([]byte(data))
+	}
+}
+
+func (s *fakeNFSServer) isDir(name string) bool {
+	for f := range s.files {
+		if strings.HasPrefix(f, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNFSClient(t *testing.T) {
+	kernel := strings.Repeat("0123456789", 20000)
+	s := newFakeNFSServer(t, "/export", map[string]string{
+		"/export/boot/kernel": kernel,
+		"/export/empty":       "",
+	})
+	defer s.l.Close()
+	defer func(p int) { pmapPort = p }(pmapPort)
+	pmapPort = s.port()
+
+	for _, tt := range []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{path: "/export/boot/kernel", want: kernel},
+		{path: "/export/empty", want: ""},
+		{path: "/export/boot/initrd", err: true},
+		{path: "/export/boot", err: true},
+		{path: "/other/kernel", err: true},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			u := &url.URL{Scheme: "nfs", Host: "127.0.0.1", Path: tt.path}
+			r, err := NFSClient{}.Fetch(u)
+			if err == nil {
+				var got []byte
+				got, err = ioutil.ReadAll(uio.Reader(r))
+				if err == nil && !bytes.Equal(got, []byte(tt.want)) {
+					t.Errorf("Fetch(%s) got %d bytes, want %d", u, len(got), len(tt.want))
+				}
+			}
+			if (err != nil) != tt.err {
+				t.Errorf("Fetch(%s) = %v, want error %t", u, err, tt.err)
+			}
+		})
+	}
+}
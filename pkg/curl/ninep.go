@@ -0,0 +1,358 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// 9P2000 message types. The .L variant replaces Topen and Rerror with
+// Tlopen and Rlerror.
+const (
+	p9Tlopen   = 12
+	p9Rlerror  = 7
+	p9Tversion = 100
+	p9Tattach  = 104
+	p9Rerror   = 107
+	p9Twalk    = 110
+	p9Topen    = 112
+	p9Tread    = 116
+	p9Tclunk   = 120
+
+	p9NoTag = 0xffff
+	p9NoFid = 0xffffffff
+
+	// p9MaxWalk is the most names walked by one Twalk.
+	p9MaxWalk = 16
+
+	// p9IOHeader is the size of the Rread header, the overhead of reads.
+	p9IOHeader = 24
+
+	p9MaxSize       = 64 * 1024
+	defaultNinePTCP = "564"
+)
+
+// NinePClient implements FileScheme for files on 9P2000 and 9P2000.L
+// servers over TCP, such as the ones used by cpu:
+//
+//	ninep://[user@]server[:port]/path/file[?aname=/export]
+//
+// ("9p" is not a valid URL scheme, as schemes start with a letter.)
+//
+// The user defaults to root and the attach name to the empty string.
+type NinePClient struct{}
+
+// Fetch implements FileScheme.Fetch.
+func (NinePClient) Fetch(u *url.URL) (io.ReaderAt, error) {
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr = net.JoinHostPort(u.Hostname(), defaultNinePTCP)
+	}
+	conn, err := net.DialTimeout("tcp", addr, rpcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ninepConn{conn: conn}
+
+	uname := "root"
+	if u.User != nil && len(u.User.Username()) > 0 {
+		uname = u.User.Username()
+	}
+	f, err := c.open(uname, u.Query().Get("aname"), path.Clean("/"+u.Path))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return uio.NewCachingReader(f), nil
+}
+
+// ninepConn is a 9P client connection.
+type ninepConn struct {
+	conn  net.Conn
+	msize uint32
+	// dotL is whether the server speaks 9P2000.L, dotU whether 9P2000.u.
+	dotL, dotU bool
+}
+
+// ninepWriter encodes 9P messages.
+type ninepWriter struct {
+	bytes.Buffer
+}
+
+func (w *ninepWriter) uint16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *ninepWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *ninepWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *ninepWriter) string(s string) {
+	w.uint16(uint16(len(s)))
+	w.WriteString(s)
+}
+
+// ninepReader decodes 9P messages. The first error sticks.
+type ninepReader struct {
+	b   []byte
+	err error
+}
+
+var errShort9P = errors.New("9P message too short")
+
+func (r *ninepReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errShort9P
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *ninepReader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *ninepReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *ninepReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+// rpc sends a T-message of type t with the given body and returns the body
+// of the R-message.
+func (c *ninepConn) rpc(t uint8, body []byte) (*ninepReader, error) {
+	tag := uint16(1)
+	if t == p9Tversion {
+		tag = p9NoTag
+	}
+	var w ninepWriter
+	w.uint32(uint32(7 + len(body)))
+	w.WriteByte(t)
+	w.uint16(tag)
+	w.Write(body)
+
+	c.conn.SetDeadline(time.Now().Add(rpcTimeout))
+	if _, err := c.conn.Write(w.Bytes()); err != nil {
+		return nil, err
+	}
+	var hdr [7]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	max := c.msize
+	if max == 0 {
+		max = p9MaxSize
+	}
+	if size < 7 || size > max {
+		return nil, fmt.Errorf("invalid 9P message size %d", size)
+	}
+	b := make([]byte, size-7)
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return nil, err
+	}
+	r := &ninepReader{b: b}
+	if rtag := binary.LittleEndian.Uint16(hdr[5:]); rtag != tag {
+		return nil, fmt.Errorf("9P reply has tag %d, want %d", rtag, tag)
+	}
+	switch rt := hdr[4]; rt {
+	case t + 1:
+		return r, nil
+	case p9Rlerror:
+		errno := r.uint32()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, syscall.Errno(errno)
+	case p9Rerror:
+		ename := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, errors.New(ename)
+	default:
+		return nil, fmt.Errorf("9P reply type %d, want %d", rt, t+1)
+	}
+}
+
+// open negotiates the protocol version, attaches to aname and opens the
+// file at p for reading.
+func (c *ninepConn) open(uname, aname, p string) (*ninepFile, error) {
+	var w ninepWriter
+	w.uint32(p9MaxSize)
+	w.string("9P2000.L")
+	r, err := c.rpc(p9Tversion, w.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("9P version: %v", err)
+	}
+	c.msize = r.uint32()
+	version := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	switch version {
+	case "9P2000.L":
+		c.dotL = true
+	case "9P2000.u":
+		c.dotU = true
+	case "9P2000":
+	default:
+		return nil, fmt.Errorf("unsupported 9P version %q", version)
+	}
+	if c.msize <= p9IOHeader || c.msize > p9MaxSize {
+		return nil, fmt.Errorf("invalid 9P msize %d", c.msize)
+	}
+
+	const root, file = 0, 1
+	w.Reset()
+	w.uint32(root)
+	w.uint32(p9NoFid)
+	w.string(uname)
+	w.string(aname)
+	if c.dotL || c.dotU {
+		// n_uname: the server uses it rather than uname if set.
+		uid := uint32(p9NoFid)
+		if uname == "root" {
+			uid = 0
+		}
+		w.uint32(uid)
+	}
+	if _, err := c.rpc(p9Tattach, w.Bytes()); err != nil {
+		return nil, fmt.Errorf("9P attach to %q: %v", aname, err)
+	}
+
+	var names []string
+	if p != "/" {
+		names = strings.Split(p[1:], "/")
+	}
+	from := uint32(root)
+	for {
+		n := len(names)
+		if n > p9MaxWalk {
+			n = p9MaxWalk
+		}
+		w.Reset()
+		w.uint32(from)
+		w.uint32(file)
+		w.uint16(uint16(n))
+		for _, name := range names[:n] {
+			w.string(name)
+		}
+		r, err := c.rpc(p9Twalk, w.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("9P walk to %s: %v", p, err)
+		}
+		if nwqid := r.uint16(); r.err != nil {
+			return nil, r.err
+		} else if int(nwqid) != n {
+			return nil, fmt.Errorf("9P walk to %s: %v", p, syscall.ENOENT)
+		}
+		names, from = names[n:], file
+		if len(names) == 0 {
+			break
+		}
+	}
+
+	w.Reset()
+	w.uint32(file)
+	t := uint8(p9Topen)
+	if c.dotL {
+		t = p9Tlopen
+		w.uint32(0) // O_RDONLY
+	} else {
+		w.WriteByte(0) // OREAD
+	}
+	if r, err = c.rpc(t, w.Bytes()); err != nil {
+		return nil, fmt.Errorf("9P open %s: %v", p, err)
+	}
+	r.next(13) // qid
+	iounit := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if iounit == 0 || iounit > c.msize-p9IOHeader {
+		iounit = c.msize - p9IOHeader
+	}
+	return &ninepFile{c: c, fid: file, iounit: iounit}, nil
+}
+
+// ninepFile reads a 9P file sequentially and closes the connection at its
+// end or at the first error.
+type ninepFile struct {
+	c      *ninepConn
+	fid    uint32
+	iounit uint32
+	off    uint64
+	err    error
+}
+
+// Read implements io.Reader.
+func (f *ninepFile) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(p) > int(f.iounit) {
+		p = p[:f.iounit]
+	}
+	var w ninepWriter
+	w.uint32(f.fid)
+	w.uint64(f.off)
+	w.uint32(uint32(len(p)))
+	r, err := f.c.rpc(p9Tread, w.Bytes())
+	if err != nil {
+		return 0, f.close(err)
+	}
+	count := r.uint32()
+	data := r.next(int(count))
+	if r.err != nil {
+		return 0, f.close(r.err)
+	}
+	if len(data) > len(p) {
+		return 0, f.close(fmt.Errorf("9P read returned %d bytes, asked for %d", len(data), len(p)))
+	}
+	if len(data) == 0 {
+		return 0, f.close(io.EOF)
+	}
+	n := copy(p, data)
+	f.off += uint64(n)
+	return n, nil
+}
+
+func (f *ninepFile) close(err error) error {
+	if err == io.EOF {
+		var w ninepWriter
+		w.uint32(f.fid)
+		f.c.rpc(p9Tclunk, w.Bytes())
+	}
+	f.err = err
+	f.c.conn.Close()
+	return err
+}
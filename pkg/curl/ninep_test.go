@@ -0,0 +1,206 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// fakeNinePServer serves files over 9P, speaking only the given version.
+type fakeNinePServer struct {
+	l       net.Listener
+	version string
+	aname   string
+	files   map[string]string
+}
+
+func newFakeNinePServer(t *testing.T, version, aname string, files map[string]string) *fakeNinePServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNinePServer{l: l, version: version, aname: aname, files: files}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNinePServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fids := make(map[uint32]string)
+	for {
+		var hdr [7]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		b := make([]byte, binary.LittleEndian.Uint32(hdr[:])-7)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		r := &ninepReader{b: b}
+		var w ninepWriter
+		rtype := hdr[4] + 1
+		if err := s.handle(hdr[4], r, &w, fids); err != nil {
+			w.Reset()
+			if s.version == "9P2000.L" {
+				rtype = p9Rlerror
+				w.uint32(uint32(err.(syscall.Errno)))
+			} else {
+				rtype = p9Rerror
+				w.string(err.Error())
+			}
+		}
+		var reply ninepWriter
+		reply.uint32(uint32(7 + w.Len()))
+		reply.WriteByte(rtype)
+		reply.Write(hdr[5:7])
+		reply.Write(w.Bytes())
+		if _, err := conn.Write(reply.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeNinePServer) exists(name string) bool {
+	if _, ok := s.files[name]; ok || name == "" {
+		return true
+	}
+	for f := range s.files {
+		if strings.HasPrefix(f, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeNinePServer) handle(t uint8, r *ninepReader, w *ninepWriter, fids map[uint32]string) error {
+	qid := make([]byte, 13)
+	switch t {
+	case p9Tversion:
+		w.uint32(r.uint32())
+		w.string(s.version)
+
+	case p9Tattach:
+		fid := r.uint32()
+		r.uint32() // afid
+		r.string() // uname
+		if r.string() != s.aname {
+			return syscall.EACCES
+		}
+		fids[fid] = ""
+		w.Write(qid)
+
+	case p9Twalk:
+		name, ok := fids[r.uint32()]
+		newfid := r.uint32()
+		if !ok {
+			return syscall.EBADF
+		}
+		n := int(r.uint16())
+		var walked []byte
+		for i := 0; i < n; i++ {
+			name += "/" + r.string()
+			if !s.exists(name) {
+				break
+			}
+			walked = append(walked, qid...)
+		}
+		if n > 0 && len(walked) == 0 {
+			return syscall.ENOENT
+		}
+		if len(walked) == n*len(qid) {
+			fids[newfid] = name
+		}
+		w.uint16(uint16(len(walked) / len(qid)))
+		w.Write(walked)
+
+	case p9Tlopen, p9Topen:
+		if _, ok := fids[r.uint32()]; !ok {
+			return syscall.EBADF
+		}
+		w.Write(qid)
+		w.uint32(0)
+
+	case p9Tread:
+		content, ok := s.files[fids[r.uint32()]]
+		if !ok {
+			return syscall.EISDIR
+		}
+		off := int(binary.LittleEndian.Uint64(r.next(8)))
+		count := int(r.uint32())
+		data := content[off:]
+		if len(data) > count {
+			data = data[:count]
+		}
+		w.uint32(uint32(len(data)))
+		w.WriteString(data)
+
+	case p9Tclunk:
+		delete(fids, r.uint32())
+	}
+	return nil
+}
+
+func TestNinePClient(t *testing.T) {
+	kernel := strings.Repeat("0123456789", 20000)
+	files := map[string]string{
+		"/boot/kernel":                         kernel,
+		"/a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r": "deep",
+	}
+	for _, version := range []string{"9P2000.L", "9P2000"} {
+		s := newFakeNinePServer(t, version, "/srv", files)
+		defer s.l.Close()
+
+		for _, tt := range []struct {
+			path  string
+			aname string
+			want  string
+			err   bool
+		}{
+			{path: "/boot/kernel", aname: "/srv", want: kernel},
+			{path: "/a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r", aname: "/srv", want: "deep"},
+			{path: "/boot/initrd", aname: "/srv", err: true},
+			{path: "/boot", aname: "/srv", err: true},
+			{path: "/boot/kernel", err: true},
+		} {
+			u := &url.URL{
+				Scheme:   "ninep",
+				Host:     s.l.Addr().String(),
+				Path:     tt.path,
+				RawQuery: url.Values{"aname": {tt.aname}}.Encode(),
+			}
+			t.Run(version+tt.path, func(t *testing.T) {
+				r, err := NinePClient{}.Fetch(u)
+				if err == nil {
+					var got []byte
+					got, err = ioutil.ReadAll(uio.Reader(r))
+					if err == nil && !bytes.Equal(got, []byte(tt.want)) {
+						t.Errorf("Fetch(%s) got %d bytes, want %d", u, len(got), len(tt.want))
+					}
+				}
+				if (err != nil) != tt.err {
+					t.Errorf("Fetch(%s) = %v, want error %t", u, err, tt.err)
+				}
+			})
+		}
+	}
+}
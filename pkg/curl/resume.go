@@ -0,0 +1,145 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// errFileChanged is returned when a file changed on the server while it was
+// read.
+var errFileChanged = errors.New("file changed on the HTTP server during the transfer")
+
+// resumableBody is the body of an HTTP response that is fetched again
+// from where it broke off if reading it fails.
+//
+// Servers that support Range requests send the rest of the file; the
+// If-Range header makes sure it is still the same file, and reading fails
+// if it is not. Others send all of it again, and the part that was already
+// read is skipped if there was no ETag or Last-Modified date to check.
+type resumableBody struct {
+	h   HTTPClientWithRetries
+	url *url.URL
+
+	body io.ReadCloser
+	off  int64
+
+	// validator is the ETag or Last-Modified date of the first response.
+	validator string
+}
+
+// Read implements io.Reader.
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		if b.body == nil {
+			if err := b.resume(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := b.body.Read(p)
+		b.off += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		log.Printf("Error: reading %v at offset %d: %v", b.url, b.off, err)
+		b.body.Close()
+		b.body = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (b *resumableBody) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// resume requests the file from the current offset on, with retries.
+func (b *resumableBody) resume() error {
+	var err error
+	b.h.BackOff.Reset()
+	for d := time.Duration(0); d != backoff.Stop; d = b.h.BackOff.NextBackOff() {
+		if d > 0 {
+			time.Sleep(d)
+		}
+		// Note: err uses the scope outside the for loop.
+		if err = b.get(); err == errFileChanged {
+			return err
+		} else if err != nil {
+			log.Printf("Error: HTTP client: %v", err)
+			continue
+		}
+		return nil
+	}
+	log.Printf("Error: Too many retries to download %v", b.url)
+	return fmt.Errorf("too many HTTP retries: %v", err)
+}
+
+func (b *resumableBody) get() error {
+	req, err := http.NewRequest("GET", b.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	if b.off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.off))
+		if len(b.validator) > 0 {
+			req.Header.Set("If-Range", b.validator)
+		}
+	}
+	resp, err := b.h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && b.off > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != b.off {
+			resp.Body.Close()
+			return fmt.Errorf("HTTP server sent range %q, want offset %d", resp.Header.Get("Content-Range"), b.off)
+		}
+
+	case resp.StatusCode == http.StatusOK:
+		if b.off == 0 {
+			b.validator = resp.Header.Get("ETag")
+			if len(b.validator) == 0 {
+				b.validator = resp.Header.Get("Last-Modified")
+			}
+			break
+		}
+		// With If-Range, a full reply means the file changed, and
+		// what was read is part of the old one.
+		if len(b.validator) > 0 {
+			resp.Body.Close()
+			return errFileChanged
+		}
+		// Without it, the server ignored the range. Skip what was
+		// read.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, b.off); err != nil {
+			resp.Body.Close()
+			return err
+		}
+
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("HTTP server responded with code %d, want 200: response %v", resp.StatusCode, resp)
+	}
+	b.body = resp.Body
+	return nil
+}
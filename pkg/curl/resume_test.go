@@ -0,0 +1,106 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestHTTPClientWithRetriesResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, tt := range []struct {
+		name string
+		// ranges is whether the server supports Range requests and
+		// sends ETags.
+		ranges bool
+		// changed is whether the file changes after the transfer
+		// breaks off.
+		changed bool
+	}{
+		{name: "range", ranges: true},
+		{name: "no range", ranges: false},
+		{name: "changed", ranges: true, changed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests, ranged int
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= 2 {
+					// Break off the transfer after a part of the file.
+					var start int
+					if tt.ranges {
+						w.Header().Set("ETag", `"v1"`)
+						fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+					}
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+					if start > 0 {
+						w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+						w.WriteHeader(http.StatusPartialContent)
+					}
+					w.Write(content[start : requests*len(content)/4])
+					panic(http.ErrAbortHandler)
+				}
+				if !tt.ranges {
+					w.Write(content)
+					return
+				}
+				if r.Header.Get("Range") != "" {
+					ranged++
+				}
+				if tt.changed {
+					w.Header().Set("ETag", `"v2"`)
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(bytes.ToUpper(content)))
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			}))
+			defer s.Close()
+
+			u, err := url.Parse(s.URL + "/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := HTTPClientWithRetries{
+				Client:  s.Client(),
+				BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+			}
+			r, err := h.Fetch(u)
+			if err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			got, err := ioutil.ReadAll(uio.Reader(r))
+			if tt.changed {
+				if err == nil {
+					t.Errorf("reading a changed file: got nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("Fetch() got %d bytes, want %d", len(got), len(content))
+			}
+			if requests != 3 {
+				t.Errorf("server got %d requests, want 3", requests)
+			}
+			if tt.ranges && ranged != 1 {
+				t.Errorf("server got %d range requests, want 1", ranged)
+			}
+		})
+	}
+}
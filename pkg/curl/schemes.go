@@ -4,13 +4,16 @@
 
 // Package curl implements routines to fetch files given a URL.
 //
-// curl currently supports HTTP, TFTP, local files, and a retrying HTTP client.
+// curl currently supports HTTP, TFTP, NFSv3, 9P, local files, and a retrying
+// HTTP client that resumes interrupted transfers. FetchVerified checks digests
+// and signatures of files and caches them by digest.
 package curl
 
 import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -43,6 +46,16 @@ type FileScheme interface {
 	Fetch(u *url.URL) (io.ReaderAt, error)
 }
 
+// FileStreamer is a FileScheme that can also give the contents of a file as
+// a stream, without keeping them in memory.
+type FileStreamer interface {
+	FileScheme
+
+	// Stream returns a reader that gives the contents of `u` once. It
+	// must be closed when done.
+	Stream(u *url.URL) (io.ReadCloser, error)
+}
+
 var (
 	// DefaultHTTPClient is the default HTTP FileScheme.
 	//
@@ -50,14 +63,21 @@ var (
 	// http.Client that accepts only a private pool of certificates.
 	DefaultHTTPClient = NewHTTPClient(http.DefaultClient)
 
+	// DefaultHTTPSClient is the default HTTPS FileScheme. It is
+	// configured by the kernel command line, see TLSConfigFromCmdline.
+	DefaultHTTPSClient FileScheme = &cmdlineHTTPSClient{}
+
 	// DefaultTFTPClient is the default TFTP FileScheme.
 	DefaultTFTPClient = NewTFTPClient(tftp.ClientMode(tftp.ModeOctet), tftp.ClientBlocksize(1450), tftp.ClientWindowsize(65535))
 
 	// DefaultSchemes are the schemes supported by default.
 	DefaultSchemes = Schemes{
-		"tftp": DefaultTFTPClient,
-		"http": DefaultHTTPClient,
-		"file": &LocalFileClient{},
+		"tftp":  DefaultTFTPClient,
+		"http":  DefaultHTTPClient,
+		"https": DefaultHTTPSClient,
+		"file":  &LocalFileClient{},
+		"nfs":   &NFSClient{},
+		"ninep": &NinePClient{},
 	}
 )
 
@@ -126,6 +146,28 @@ func (s Schemes) Fetch(u *url.URL) (io.ReaderAt, error) {
 	return &file{ReaderAt: r, url: u}, nil
 }
 
+// stream returns the contents of the file with the given `u` as a stream,
+// see FileStreamer. Files of other FileSchemes are fetched and read once.
+func (s Schemes) stream(u *url.URL) (io.ReadCloser, error) {
+	fg, ok := s[u.Scheme]
+	if !ok {
+		return nil, &URLError{URL: u, Err: ErrNoSuchScheme}
+	}
+	fs, ok := fg.(FileStreamer)
+	if !ok {
+		r, err := s.Fetch(u)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(uio.Reader(r)), nil
+	}
+	rc, err := fs.Stream(u)
+	if err != nil {
+		return nil, &URLError{URL: u, Err: err}
+	}
+	return rc, nil
+}
+
 // LazyFetch calls LazyFetch on DefaultSchemes.
 func LazyFetch(u *url.URL) (io.ReaderAt, error) {
 	return DefaultSchemes.LazyFetch(u)
@@ -169,6 +211,15 @@ func (t *TFTPClient) Fetch(u *url.URL) (io.ReaderAt, error) {
 	// TODO(hugelgupf): These clients are basically stateless, except for
 	// the options. Figure out whether you actually have to re-establish
 	// this connection every time. Audit the TFTP library.
+	r, err := t.Stream(u)
+	if err != nil {
+		return nil, err
+	}
+	return uio.NewCachingReader(r), nil
+}
+
+// Stream implements FileStreamer.Stream.
+func (t *TFTPClient) Stream(u *url.URL) (io.ReadCloser, error) {
 	c, err := tftp.NewClient(t.opts...)
 	if err != nil {
 		return nil, err
@@ -178,7 +229,7 @@ func (t *TFTPClient) Fetch(u *url.URL) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, err
 	}
-	return uio.NewCachingReader(r), nil
+	return ioutil.NopCloser(r), nil
 }
 
 // SchemeWithRetries wraps a FileScheme and automatically retries (with
@@ -224,19 +275,32 @@ func NewHTTPClient(c *http.Client) *HTTPClient {
 
 // Fetch implements FileScheme.Fetch.
 func (h HTTPClient) Fetch(u *url.URL) (io.ReaderAt, error) {
+	r, err := h.Stream(u)
+	if err != nil {
+		return nil, err
+	}
+	return uio.NewCachingReader(r), nil
+}
+
+// Stream implements FileStreamer.Stream.
+func (h HTTPClient) Stream(u *url.URL) (io.ReadCloser, error) {
 	resp, err := h.c.Get(u.String())
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("HTTP server responded with code %d, want 200: response %v", resp.StatusCode, resp)
 	}
-	return uio.NewCachingReader(resp.Body), nil
+	return resp.Body, nil
 }
 
 // HTTPClientWithRetries implements FileScheme for HTTP files and automatically
 // retries (with backoff) upon an error.
+//
+// Transfers that fail midway are resumed where they stopped with Range
+// requests, see resumableBody.
 type HTTPClientWithRetries struct {
 	Client  *http.Client
 	BackOff backoff.BackOff
@@ -244,32 +308,20 @@ type HTTPClientWithRetries struct {
 
 // Fetch implements FileScheme.Fetch.
 func (h HTTPClientWithRetries) Fetch(u *url.URL) (io.ReaderAt, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+	r, err := h.Stream(u)
 	if err != nil {
 		return nil, err
 	}
+	return uio.NewCachingReader(r), nil
+}
 
-	h.BackOff.Reset()
-	for d := time.Duration(0); d != backoff.Stop; d = h.BackOff.NextBackOff() {
-		if d > 0 {
-			time.Sleep(d)
-		}
-
-		var resp *http.Response
-		// Note: err uses the scope outside the for loop.
-		resp, err = h.Client.Do(req)
-		if err != nil {
-			log.Printf("Error: HTTP client: %v", err)
-			continue
-		}
-		if resp.StatusCode != 200 {
-			log.Printf("Error: HTTP server responded with code %d, want 200: response %v", resp.StatusCode, resp)
-			continue
-		}
-		return uio.NewCachingReader(resp.Body), nil
+// Stream implements FileStreamer.Stream.
+func (h HTTPClientWithRetries) Stream(u *url.URL) (io.ReadCloser, error) {
+	b := &resumableBody{h: h, url: u}
+	if err := b.resume(); err != nil {
+		return nil, err
 	}
-	log.Printf("Error: Too many retries to download %v", u)
-	return nil, fmt.Errorf("too many HTTP retries: %v", err)
+	return b, nil
 }
 
 // LocalFileClient implements FileScheme for files on disk.
@@ -0,0 +1,309 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ONC RPC constants, RFC 5531.
+const (
+	rpcVersion = 2
+
+	rpcCall  = 0
+	rpcReply = 1
+
+	rpcMsgAccepted = 0
+
+	rpcSuccess = 0
+
+	authNone = 0
+	authUnix = 1
+
+	// lastFragment marks the last fragment of a record, RFC 5531
+	// section 11.
+	lastFragment = 1 << 31
+
+	// maxRecord is the largest reply record accepted.
+	maxRecord = 4 * 1024 * 1024
+)
+
+// Portmapper version 2, RFC 1833.
+const (
+	pmapProgram    = 100000
+	pmapVersion    = 2
+	pmapGetPort    = 3
+	ipProtoTCP     = 6
+	defaultPmapTCP = 111
+)
+
+var (
+	// pmapPort is the port of the portmapper. It is a variable for tests.
+	pmapPort = defaultPmapTCP
+
+	// rpcTimeout is how long an RPC connection may be idle.
+	rpcTimeout = 30 * time.Second
+)
+
+// xdrWriter encodes XDR data, RFC 4506.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+// opaque writes variable-length opaque data padded to 4 bytes.
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+	w.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// xdrReader decodes XDR data. The first error sticks and makes all further
+// reads return zero values.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+var errShortXDR = errors.New("XDR data too short")
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errShortXDR
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *xdrReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	if r.err != nil || n > len(r.b) {
+		r.err = errShortXDR
+		return nil
+	}
+	b := r.next(n)
+	r.next((4 - n%4) % 4)
+	return b
+}
+
+// skip skips n bytes of fixed-size data.
+func (r *xdrReader) skip(n int) {
+	r.next(n)
+}
+
+// rpcClient makes ONC RPC calls over TCP.
+type rpcClient struct {
+	conn net.Conn
+	xid  uint32
+	cred []byte
+}
+
+// dialRPC connects to addr.
+//
+// Like the kernel's NFS client, it binds to a reserved port if it can,
+// since servers commonly refuse requests from unprivileged ports.
+func dialRPC(addr string) (*rpcClient, error) {
+	conn, err := dialReserved(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// AUTH_UNIX credentials of root.
+	hostname, _ := os.Hostname()
+	var cred xdrWriter
+	cred.uint32(uint32(time.Now().Unix()))
+	cred.string(hostname)
+	cred.uint32(0) // uid
+	cred.uint32(0) // gid
+	cred.uint32(0) // gids
+	return &rpcClient{
+		conn: conn,
+		xid:  uint32(time.Now().UnixNano()),
+		cred: cred.Bytes(),
+	}, nil
+}
+
+func dialReserved(addr string) (net.Conn, error) {
+	for port := 1023; port >= 512; port-- {
+		d := net.Dialer{
+			Timeout:   rpcTimeout,
+			LocalAddr: &net.TCPAddr{Port: port},
+		}
+		conn, err := d.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		switch errno(err) {
+		case syscall.EADDRINUSE, syscall.EADDRNOTAVAIL:
+			continue
+		case syscall.EACCES, syscall.EPERM:
+			// Only root may bind reserved ports.
+			return net.DialTimeout("tcp", addr, rpcTimeout)
+		}
+		return nil, err
+	}
+	return net.DialTimeout("tcp", addr, rpcTimeout)
+}
+
+// errno returns the system call error of a failed dial, or 0.
+func errno(err error) syscall.Errno {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sc, ok := err.(*os.SyscallError); ok {
+		err = sc.Err
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		return e
+	}
+	return 0
+}
+
+// Close closes the connection.
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// call calls procedure proc of program prog and returns its results.
+func (c *rpcClient) call(prog, vers, proc uint32, args []byte) (*xdrReader, error) {
+	c.xid++
+	var w xdrWriter
+	w.uint32(0) // record mark
+	w.uint32(c.xid)
+	w.uint32(rpcCall)
+	w.uint32(rpcVersion)
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(proc)
+	w.uint32(authUnix)
+	w.opaque(c.cred)
+	w.uint32(authNone)
+	w.opaque(nil)
+	w.Write(args)
+	b := w.Bytes()
+	binary.BigEndian.PutUint32(b, lastFragment|uint32(len(b)-4))
+
+	c.conn.SetDeadline(time.Now().Add(rpcTimeout))
+	if _, err := c.conn.Write(b); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		r := &xdrReader{b: reply}
+		if xid := r.uint32(); r.err != nil {
+			return nil, r.err
+		} else if xid != c.xid {
+			// A reply to an earlier call that we gave up on.
+			continue
+		}
+		if t := r.uint32(); r.err == nil && t != rpcReply {
+			return nil, fmt.Errorf("RPC message type %d, want reply", t)
+		}
+		if s := r.uint32(); r.err == nil && s != rpcMsgAccepted {
+			return nil, fmt.Errorf("RPC call to program %d denied", prog)
+		}
+		r.uint32() // verifier flavor
+		r.opaque()
+		if s := r.uint32(); r.err == nil && s != rpcSuccess {
+			return nil, fmt.Errorf("RPC call to program %d version %d procedure %d failed with status %d", prog, vers, proc, s)
+		}
+		return r, r.err
+	}
+}
+
+// readRecord reads all fragments of a record.
+func (c *rpcClient) readRecord() ([]byte, error) {
+	var record []byte
+	for {
+		var mark [4]byte
+		if _, err := io.ReadFull(c.conn, mark[:]); err != nil {
+			return nil, err
+		}
+		m := binary.BigEndian.Uint32(mark[:])
+		n := int(m &^ lastFragment)
+		if len(record)+n > maxRecord {
+			return nil, fmt.Errorf("RPC record larger than %d bytes", maxRecord)
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(c.conn, frag); err != nil {
+			return nil, err
+		}
+		record = append(record, frag...)
+		if m&lastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+// getPort asks the portmapper on host for the TCP port of a program.
+func getPort(host string, prog, vers uint32) (int, error) {
+	c, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(pmapPort)))
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var args xdrWriter
+	args.uint32(prog)
+	args.uint32(vers)
+	args.uint32(ipProtoTCP)
+	args.uint32(0)
+	r, err := c.call(pmapProgram, pmapVersion, pmapGetPort, args.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	port := r.uint32()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if port == 0 || port > 0xffff {
+		return 0, fmt.Errorf("program %d version %d is not registered with the portmapper", prog, vers)
+	}
+	return int(port), nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+// ErrPinMismatch is returned when no key of a server's verified certificate
+// chain matches the pinned keys of a TLSConfig.
+var ErrPinMismatch = errors.New("no pinned public key in server certificate chain")
+
+// DefaultTPMPath is the TPM device used for TPM-backed client keys.
+const DefaultTPMPath = "/dev/tpmrm0"
+
+// TLSConfig is how HTTPS schemes authenticate servers and themselves.
+//
+// The zero value trusts the system's CAs, like http.DefaultClient.
+type TLSConfig struct {
+	// CACerts are PEM files of CA certificates to trust in addition to
+	// the system's, or instead of them if NoSystemCAs is set.
+	CACerts     []string
+	NoSystemCAs bool
+
+	// ClientCert is a PEM file with the certificate chain to present to
+	// servers asking for one.
+	//
+	// Its key is read from the PEM file ClientKey or, if TPMKey is set,
+	// kept in the persistent TPM 2.0 object with that handle.
+	ClientCert string
+	ClientKey  string
+	TPMKey     uint32
+
+	// TPMPath is the TPM device. It defaults to DefaultTPMPath.
+	TPMPath string
+
+	// Pins are SHA-256 digests of the SubjectPublicKeyInfo of certificates,
+	// in the "sha256//<base64>" form of curl's --pinnedpubkey. If set,
+	// one of the keys must be in the verified chain of the server's
+	// certificate or, with InsecureSkipVerify, be the key of the server's
+	// certificate.
+	Pins []string
+
+	// InsecureSkipVerify accepts any server certificate, except for pins.
+	InsecureSkipVerify bool
+}
+
+// Command line flags of TLSConfigFromCmdline.
+const (
+	cmdlineCACerts    = "uroot.tls.cacerts"
+	cmdlineNoSysCAs   = "uroot.tls.nosystemcas"
+	cmdlineClientCert = "uroot.tls.cert"
+	cmdlineClientKey  = "uroot.tls.key"
+	cmdlineTPMKey     = "uroot.tls.tpmkey"
+	cmdlineTPMPath    = "uroot.tls.tpm"
+	cmdlinePins       = "uroot.tls.pin"
+	cmdlineInsecure   = "uroot.tls.insecure"
+)
+
+// TLSConfigFromCmdline returns the TLS configuration given by the kernel
+// command line flags in flags, as in cmdline.CmdLine.AsMap:
+//
+//   uroot.tls.cacerts=/etc/ca.pem,/etc/other-ca.pem
+//   uroot.tls.nosystemcas
+//   uroot.tls.cert=/etc/client.pem
+//   uroot.tls.key=/etc/client-key.pem
+//   uroot.tls.tpmkey=0x81000001
+//   uroot.tls.tpm=/dev/tpm0
+//   uroot.tls.pin=sha256//<base64>,sha256//<base64>
+//   uroot.tls.insecure
+func TLSConfigFromCmdline(flags map[string]string) (*TLSConfig, error) {
+	list := func(s string) []string {
+		if len(s) == 0 {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	_, noSysCAs := flags[cmdlineNoSysCAs]
+	_, insecure := flags[cmdlineInsecure]
+	c := &TLSConfig{
+		CACerts:            list(flags[cmdlineCACerts]),
+		NoSystemCAs:        noSysCAs,
+		ClientCert:         flags[cmdlineClientCert],
+		ClientKey:          flags[cmdlineClientKey],
+		TPMPath:            flags[cmdlineTPMPath],
+		Pins:               list(flags[cmdlinePins]),
+		InsecureSkipVerify: insecure,
+	}
+	if h, ok := flags[cmdlineTPMKey]; ok {
+		v, err := strconv.ParseUint(h, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s=%s: %v", cmdlineTPMKey, h, err)
+		}
+		c.TPMKey = uint32(v)
+	}
+	return c, nil
+}
+
+// Config returns the crypto/tls configuration.
+func (c *TLSConfig) Config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if len(c.CACerts) > 0 {
+		pool := x509.NewCertPool()
+		if !c.NoSystemCAs {
+			if sys, err := x509.SystemCertPool(); err == nil && sys != nil {
+				pool = sys
+			}
+		}
+		for _, f := range c.CACerts {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA certificates: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no CA certificates in %s", f)
+			}
+		}
+		config.RootCAs = pool
+	} else if c.NoSystemCAs {
+		config.RootCAs = x509.NewCertPool()
+	}
+
+	if len(c.ClientCert) > 0 {
+		cert, err := c.clientCertificate()
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	if len(c.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, p := range c.Pins {
+			d := strings.TrimPrefix(p, "sha256//")
+			if b, err := base64.StdEncoding.DecodeString(d); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", p)
+			}
+			pins[d] = true
+		}
+		config.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			// Without verification, the handshake only proves that
+			// the server has the key of its own certificate. Other
+			// certificates it sends may be anyone's.
+			if c.InsecureSkipVerify {
+				if len(raw) == 0 {
+					return ErrPinMismatch
+				}
+				cert, err := x509.ParseCertificate(raw[0])
+				if err != nil {
+					return err
+				}
+				return checkPins(pins, []*x509.Certificate{cert})
+			}
+			for _, chain := range chains {
+				if err := checkPins(pins, chain); err == nil {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return config, nil
+}
+
+// checkPins returns nil if the key of one of the certificates matches a pin.
+func checkPins(pins map[string]bool, certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+// clientCertificate loads the client certificate with its private key.
+func (c *TLSConfig) clientCertificate() (*tls.Certificate, error) {
+	if c.TPMKey == 0 {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		return &cert, nil
+	}
+
+	data, err := ioutil.ReadFile(c.ClientCert)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %v", err)
+	}
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", c.ClientCert)
+	}
+	path := c.TPMPath
+	if len(path) == 0 {
+		path = DefaultTPMPath
+	}
+	signer, err := openTPMKey(path, c.TPMKey)
+	if err != nil {
+		return nil, fmt.Errorf("TPM key %#x: %v", c.TPMKey, err)
+	}
+	cert.PrivateKey = signer
+	return &cert, nil
+}
+
+// HTTPClient returns an HTTP client using this configuration.
+func (c *TLSConfig) HTTPClient() (*http.Client, error) {
+	config, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	// Like http.DefaultTransport.
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       config,
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// Schemes returns DefaultSchemes with HTTP and HTTPS using this
+// configuration.
+func (c *TLSConfig) Schemes() (Schemes, error) {
+	client, err := c.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	s := make(Schemes)
+	for name, fs := range DefaultSchemes {
+		s[name] = fs
+	}
+	s["http"] = NewHTTPClient(client)
+	s["https"] = NewHTTPClient(client)
+	return s, nil
+}
+
+// cmdlineHTTPSClient is an HTTP FileScheme configured from the kernel
+// command line, see TLSConfigFromCmdline.
+//
+// The command line is only read when the first file is fetched.
+type cmdlineHTTPSClient struct {
+	once   sync.Once
+	client *HTTPClient
+	err    error
+}
+
+// Fetch implements FileScheme.Fetch.
+func (h *cmdlineHTTPSClient) Fetch(u *url.URL) (io.ReaderAt, error) {
+	if err := h.init(); err != nil {
+		return nil, err
+	}
+	return h.client.Fetch(u)
+}
+
+// Stream implements FileStreamer.Stream.
+func (h *cmdlineHTTPSClient) Stream(u *url.URL) (io.ReadCloser, error) {
+	if err := h.init(); err != nil {
+		return nil, err
+	}
+	return h.client.Stream(u)
+}
+
+// init configures the client from the kernel command line once.
+func (h *cmdlineHTTPSClient) init() error {
+	h.once.Do(func() {
+		var c *TLSConfig
+		c, h.err = TLSConfigFromCmdline(cmdline.NewCmdLine().AsMap)
+		if h.err != nil {
+			return
+		}
+		var client *http.Client
+		if client, h.err = c.HTTPClient(); h.err == nil {
+			h.client = NewHTTPClient(client)
+		}
+	})
+	if h.err != nil {
+		log.Printf("Error: TLS configuration from the kernel command line: %v", h.err)
+	}
+	return h.err
+}
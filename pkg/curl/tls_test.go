@@ -0,0 +1,215 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert makes a certificate signed by parent, or a self-signed CA.
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// write writes the certificate and key to PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newCert(t, "ca", nil)
+	server := newCert(t, "server", ca)
+	client := newCert(t, "client", ca)
+	caFile, _ := ca.write(t, dir, "ca")
+	clientCert, clientKey := client.write(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	// The server also sends the client's certificate, like a man in the
+	// middle appending a public certificate with a pinned key would.
+	serverChain := server.tls()
+	serverChain.Certificate = append(serverChain.Certificate, client.cert.Raw)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverChain},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	s.StartTLS()
+	defer s.Close()
+	u, err := url.Parse(s.URL + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		config TLSConfig
+		ok     bool
+	}{
+		{
+			name:   "mutual TLS",
+			config: TLSConfig{CACerts: []string{caFile}, ClientCert: clientCert, ClientKey: clientKey},
+			ok:     true,
+		},
+		{
+			name:   "no client certificate",
+			config: TLSConfig{CACerts: []string{caFile}},
+		},
+		{
+			name:   "unknown CA",
+			config: TLSConfig{NoSystemCAs: true, ClientCert: clientCert, ClientKey: clientKey},
+		},
+		{
+			name:   "pinned server key",
+			config: TLSConfig{CACerts: []string{caFile}, ClientCert: clientCert, ClientKey: clientKey, Pins: []string{server.pin()}},
+			ok:     true,
+		},
+		{
+			name:   "pinned key without CA",
+			config: TLSConfig{InsecureSkipVerify: true, ClientCert: clientCert, ClientKey: clientKey, Pins: []string{server.pin()}},
+			ok:     true,
+		},
+		{
+			name:   "pinned CA key",
+			config: TLSConfig{CACerts: []string{caFile}, ClientCert: clientCert, ClientKey: clientKey, Pins: []string{ca.pin()}},
+			ok:     true,
+		},
+		{
+			name:   "wrong pin",
+			config: TLSConfig{CACerts: []string{caFile}, ClientCert: clientCert, ClientKey: clientKey, Pins: []string{client.pin()}},
+		},
+		{
+			name:   "wrong pin without CA",
+			config: TLSConfig{InsecureSkipVerify: true, ClientCert: clientCert, ClientKey: clientKey, Pins: []string{client.pin()}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			schemes, err := tt.config.Schemes()
+			if err != nil {
+				t.Fatalf("Schemes() = %v", err)
+			}
+			r, err := schemes.Fetch(u)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Fetch() = %v, want success %t", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			if got, err := ioutil.ReadAll(uio.Reader(r)); err != nil || string(got) != "hello client" {
+				t.Errorf("Fetch() = %q, %v, want %q", got, err, "hello client")
+			}
+		})
+	}
+}
+
+func TestTLSConfigFromCmdline(t *testing.T) {
+	got, err := TLSConfigFromCmdline(map[string]string{
+		"uroot.tls.cacerts":  "/a.pem,/b.pem",
+		"uroot.tls.cert":     "/client.pem",
+		"uroot.tls.tpmkey":   "0x81000001",
+		"uroot.tls.pin":      "sha256//AAAA",
+		"uroot.tls.insecure": "",
+		"console":            "ttyS0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &TLSConfig{
+		CACerts:            []string{"/a.pem", "/b.pem"},
+		ClientCert:         "/client.pem",
+		TPMKey:             0x81000001,
+		Pins:               []string{"sha256//AAAA"},
+		InsecureSkipVerify: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TLSConfigFromCmdline() = %+v, want %+v", got, want)
+	}
+
+	if _, err := TLSConfigFromCmdline(map[string]string{"uroot.tls.tpmkey": "key"}); err == nil {
+		t.Errorf("TLSConfigFromCmdline() with bad TPM handle = nil, want error")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// tpmKey is a crypto.Signer backed by a persistent TPM 2.0 key, so that
+// the private key of client certificates never leaves the TPM.
+type tpmKey struct {
+	mu     sync.Mutex
+	rw     io.ReadWriter
+	handle tpmutil.Handle
+	pub    crypto.PublicKey
+}
+
+// openTPMKey opens the TPM at path and the key with the given persistent
+// handle.
+func openTPMKey(path string, handle uint32) (crypto.Signer, error) {
+	rw, err := tpm2.OpenTPM(path)
+	if err != nil {
+		return nil, err
+	}
+	public, _, _, err := tpm2.ReadPublic(rw, tpmutil.Handle(handle))
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	pub, err := public.Key()
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	return &tpmKey{rw: rw, handle: tpmutil.Handle(handle), pub: pub}, nil
+}
+
+// Public implements crypto.Signer.Public.
+func (k *tpmKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+var tpmHashes = map[crypto.Hash]tpm2.Algorithm{
+	crypto.SHA1:   tpm2.AlgSHA1,
+	crypto.SHA256: tpm2.AlgSHA256,
+	crypto.SHA384: tpm2.AlgSHA384,
+	crypto.SHA512: tpm2.AlgSHA512,
+}
+
+// Sign implements crypto.Signer.Sign.
+func (k *tpmKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	h, ok := tpmHashes[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+	scheme := &tpm2.SigScheme{Hash: h}
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		scheme.Alg = tpm2.AlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	case *ecdsa.PublicKey:
+		scheme.Alg = tpm2.AlgECDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k.pub)
+	}
+
+	k.mu.Lock()
+	sig, err := tpm2.Sign(k.rw, k.handle, "", digest, scheme)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sig.RSA != nil:
+		return sig.RSA.Signature, nil
+	case sig.ECC != nil:
+		return asn1.Marshal(struct{ R, S *big.Int }{sig.ECC.R, sig.ECC.S})
+	}
+	return nil, fmt.Errorf("TPM returned unsupported signature algorithm %v", sig.Alg)
+}
@@ -0,0 +1,16 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package curl
+
+import (
+	"crypto"
+	"errors"
+)
+
+func openTPMKey(path string, handle uint32) (crypto.Signer, error) {
+	return nil, errors.New("TPM keys are only supported on Linux")
+}
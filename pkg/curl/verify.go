@@ -0,0 +1,273 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha256" // Register SHA-256 for Digest.
+	_ "crypto/sha512" // Register SHA-512 for Digest.
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	// ErrDigestMismatch is the VerifyError.Err of files that do not
+	// have the expected digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+
+	// ErrBadSignature is returned by verifiers, possibly as the
+	// VerifyError.Err, if a signature does not match the file.
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// VerifyError is a file that failed a check of Schemes.FetchVerified or a
+// Verifier.
+type VerifyError struct {
+	// Err is ErrDigestMismatch or ErrBadSignature.
+	Err error
+
+	// Reason tells why the check failed.
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Reason)
+}
+
+// digestNames are the hashes supported for digests.
+var digestNames = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// Digest is the expected cryptographic hash of a file.
+type Digest struct {
+	Hash crypto.Hash
+	Sum  []byte
+}
+
+// ParseDigest parses a digest of the form "sha256:<hex>" or
+// "sha512:<hex>". Without a prefix, the hash is inferred from the length.
+func ParseDigest(s string) (*Digest, error) {
+	name, sum := "", s
+	if i := strings.IndexAny(s, ":-"); i >= 0 {
+		name, sum = strings.ToLower(s[:i]), s[i+1:]
+	}
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return nil, fmt.Errorf("digest %q: %v", s, err)
+	}
+
+	var h crypto.Hash
+	if len(name) > 0 {
+		var ok bool
+		if h, ok = digestNames[name]; !ok {
+			return nil, fmt.Errorf("digest %q: unsupported hash %q", s, name)
+		}
+	} else {
+		for _, dh := range digestNames {
+			if dh.Size() == len(b) {
+				h = dh
+			}
+		}
+	}
+	if h == 0 || h.Size() != len(b) {
+		return nil, fmt.Errorf("digest %q: wrong length %d", s, len(b))
+	}
+	return &Digest{Hash: h, Sum: b}, nil
+}
+
+// String returns the digest as "<hash>:<hex>".
+func (d *Digest) String() string {
+	for name, h := range digestNames {
+		if h == d.Hash {
+			return fmt.Sprintf("%s:%x", name, d.Sum)
+		}
+	}
+	return fmt.Sprintf("%v:%x", d.Hash, d.Sum)
+}
+
+// Verifier checks detached signatures.
+type Verifier interface {
+	// Verify returns nil if sig is a valid signature of the contents of r.
+	Verify(r io.Reader, sig []byte) error
+}
+
+// ED25519Verifier verifies raw ED25519 signatures, such as those made
+// with keys from crypto.GeneratED25519Key.
+type ED25519Verifier struct {
+	PublicKey ed25519.PublicKey
+}
+
+// Verify implements Verifier.Verify.
+func (v ED25519Verifier) Verify(r io.Reader, sig []byte) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(v.PublicKey, b, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// PGPVerifier verifies binary or ASCII armored OpenPGP signatures, such
+// as those made by gpg --detach-sign.
+type PGPVerifier struct {
+	KeyRing openpgp.KeyRing
+}
+
+// Verify implements Verifier.Verify.
+func (v PGPVerifier) Verify(r io.Reader, sig []byte) error {
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	if _, err := check(v.KeyRing, r, bytes.NewReader(sig)); err != nil {
+		return &VerifyError{Err: ErrBadSignature, Reason: err.Error()}
+	}
+	return nil
+}
+
+// FetchOptions are the checks and features of Schemes.FetchVerified.
+type FetchOptions struct {
+	// Digest is the expected digest of the file.
+	Digest *Digest
+
+	// Signature is the URL of a detached signature of the file, which is
+	// checked with Verifier.
+	Signature *url.URL
+	Verifier  Verifier
+
+	// Cache keeps verified files by digest. It is only used for files
+	// with a Digest.
+	Cache *Cache
+
+	// Progress, if set, gets a dot for every ProgressInterval bytes
+	// downloaded. ProgressInterval defaults to 5 MiB.
+	Progress         io.Writer
+	ProgressInterval int
+}
+
+// FetchVerified calls FetchVerified on DefaultSchemes.
+func FetchVerified(u *url.URL, opts FetchOptions) (io.ReaderAt, error) {
+	return DefaultSchemes.FetchVerified(u, opts)
+}
+
+// FetchVerified fetches the file given by `u` like Fetch, and checks it
+// has the digest and signature given by opts before returning it.
+//
+// Unlike Fetch, the whole file is read before FetchVerified returns. With a
+// Digest and a Cache, it is streamed to a file in the cache rather than kept
+// in memory, see FileStreamer. Files already in opts.Cache are trusted by
+// their digest and neither fetched nor verified again.
+func (s Schemes) FetchVerified(u *url.URL, opts FetchOptions) (io.ReaderAt, error) {
+	if opts.Cache != nil && opts.Digest != nil {
+		if f, err := opts.Cache.Open(opts.Digest); err == nil {
+			return &file{ReaderAt: f, url: u}, nil
+		}
+	}
+	if opts.Signature != nil && opts.Verifier == nil {
+		return nil, &URLError{URL: u, Err: errors.New("signature URL given without a verifier")}
+	}
+
+	var r io.ReaderAt
+	if opts.Cache != nil && opts.Digest != nil {
+		// Stream the file from the network straight into the cache,
+		// hashing it on the way, so it is never all in memory.
+		body, err := s.stream(u)
+		if err != nil {
+			return nil, err
+		}
+		f, err := opts.Cache.store(opts.Digest, opts.progress(body))
+		body.Close()
+		if err != nil {
+			return nil, &URLError{URL: u, Err: err}
+		}
+		r = f
+	} else {
+		// Without a cache, the file is kept in memory for the caller.
+		var err error
+		if r, err = s.Fetch(u); err != nil {
+			return nil, err
+		}
+		src := opts.progress(uio.Reader(r))
+		if opts.Digest != nil {
+			err = opts.Digest.check(src)
+		} else {
+			_, err = io.Copy(ioutil.Discard, src)
+		}
+		if err != nil {
+			return nil, &URLError{URL: u, Err: err}
+		}
+	}
+
+	if opts.Verifier != nil {
+		if err := s.verifySignature(r, opts); err != nil {
+			if f, ok := r.(*os.File); ok {
+				f.Close()
+				os.Remove(f.Name())
+			}
+			return nil, &URLError{URL: u, Err: err}
+		}
+	}
+	return &file{ReaderAt: r, url: u}, nil
+}
+
+// progress wraps r to print progress to opts.Progress, if set.
+func (opts FetchOptions) progress(r io.Reader) io.Reader {
+	if opts.Progress == nil {
+		return r
+	}
+	interval := opts.ProgressInterval
+	if interval == 0 {
+		interval = 5 * 1024 * 1024
+	}
+	return &uio.ProgressReader{R: r, Symbol: ".", Interval: interval, W: opts.Progress}
+}
+
+// verifySignature checks the contents of r against the detached signature
+// at opts.Signature.
+func (s Schemes) verifySignature(r io.ReaderAt, opts FetchOptions) error {
+	if opts.Signature == nil {
+		return errors.New("verifier given without a signature URL")
+	}
+	sr, err := s.Fetch(opts.Signature)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadAll(uio.Reader(sr))
+	if err != nil {
+		return err
+	}
+	return opts.Verifier.Verify(uio.Reader(r), sig)
+}
+
+// check reads r to the end and compares its digest.
+func (d *Digest) check(r io.Reader) error {
+	if !d.Hash.Available() {
+		return fmt.Errorf("hash %v is not available", d.Hash)
+	}
+	h := d.Hash.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, d.Sum) {
+		return &VerifyError{Err: ErrDigestMismatch, Reason: fmt.Sprintf("got %x, want %s", got, d)}
+	}
+	return nil
+}
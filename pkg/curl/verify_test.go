@@ -0,0 +1,224 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParseDigest(t *testing.T) {
+	sum256 := sha256.Sum256([]byte("foo"))
+	sum512 := sha512.Sum512([]byte("foo"))
+	for _, tt := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: fmt.Sprintf("sha256:%x", sum256), want: fmt.Sprintf("sha256:%x", sum256)},
+		{in: fmt.Sprintf("SHA512-%x", sum512), want: fmt.Sprintf("sha512:%x", sum512)},
+		{in: fmt.Sprintf("%x", sum512), want: fmt.Sprintf("sha512:%x", sum512)},
+		{in: fmt.Sprintf("sha512:%x", sum256), err: true},
+		{in: fmt.Sprintf("md5:%x", sum256), err: true},
+		{in: "sha256:xyz", err: true},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			d, err := ParseDigest(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseDigest(%q) = %v, want error %v", tt.in, err, tt.err)
+			}
+			if err == nil && d.String() != tt.want {
+				t.Errorf("ParseDigest(%q) = %s, want %s", tt.in, d, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseDigest(t *testing.T, content string) *Digest {
+	d, err := ParseDigest(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestFetchVerified(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const content = "kernel contents"
+
+	fs := NewMockScheme("fooftp")
+	fs.Add("host", "/kernel", content)
+	fs.Add("host", "/kernel.sig", string(ed25519.Sign(priv, []byte(content))))
+	fs.Add("host", "/other.sig", string(ed25519.Sign(priv, []byte("other"))))
+	s := make(Schemes)
+	s.Register(fs.Scheme, fs)
+
+	kernel := &url.URL{Scheme: "fooftp", Host: "host", Path: "/kernel"}
+	for _, tt := range []struct {
+		name string
+		opts FetchOptions
+		err  error
+	}{
+		{
+			name: "digest",
+			opts: FetchOptions{Digest: mustParseDigest(t, content)},
+		},
+		{
+			name: "wrong digest",
+			opts: FetchOptions{Digest: mustParseDigest(t, "other")},
+			err:  ErrDigestMismatch,
+		},
+		{
+			name: "signature",
+			opts: FetchOptions{
+				Signature: &url.URL{Scheme: "fooftp", Host: "host", Path: "/kernel.sig"},
+				Verifier:  ED25519Verifier{PublicKey: pub},
+			},
+		},
+		{
+			name: "wrong signature",
+			opts: FetchOptions{
+				Signature: &url.URL{Scheme: "fooftp", Host: "host", Path: "/other.sig"},
+				Verifier:  ED25519Verifier{PublicKey: pub},
+			},
+			err: ErrBadSignature,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var progress bytes.Buffer
+			tt.opts.Progress, tt.opts.ProgressInterval = &progress, 5
+
+			r, err := s.FetchVerified(kernel, tt.opts)
+			if errUnwrap(err) != tt.err {
+				t.Fatalf("FetchVerified() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			got, err := ioutil.ReadAll(uio.Reader(r))
+			if err != nil || string(got) != content {
+				t.Errorf("FetchVerified() = %q, %v, want %q", got, err, content)
+			}
+			if progress.String() != "..." {
+				t.Errorf("progress = %q, want %q", progress.String(), "...")
+			}
+		})
+	}
+}
+
+// errUnwrap returns the error inside URLErrors and VerifyErrors.
+func errUnwrap(err error) error {
+	if u, ok := err.(*URLError); ok {
+		err = u.Err
+	}
+	if v, ok := err.(*VerifyError); ok {
+		err = v.Err
+	}
+	return err
+}
+
+func TestFetchVerifiedCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &Cache{Dir: dir}
+
+	fs := NewMockScheme("fooftp")
+	fs.Add("host", "/kernel", "good")
+	fs.Add("host", "/bad", "bad")
+	s := make(Schemes)
+	s.Register(fs.Scheme, fs)
+
+	d := mustParseDigest(t, "good")
+	kernel := &url.URL{Scheme: "fooftp", Host: "host", Path: "/kernel"}
+	for i := 0; i < 2; i++ {
+		r, err := s.FetchVerified(kernel, FetchOptions{Digest: d, Cache: cache})
+		if err != nil {
+			t.Fatalf("FetchVerified() = %v", err)
+		}
+		if got, _ := ioutil.ReadAll(uio.Reader(r)); string(got) != "good" {
+			t.Errorf("FetchVerified() = %q, want good", got)
+		}
+	}
+	if n := fs.NumCalled(kernel); n != 1 {
+		t.Errorf("fetched %d times, want once", n)
+	}
+
+	// Corrupt files are not cached.
+	bad := &url.URL{Scheme: "fooftp", Host: "host", Path: "/bad"}
+	d = mustParseDigest(t, "other")
+	if _, err := s.FetchVerified(bad, FetchOptions{Digest: d, Cache: cache}); errUnwrap(err) != ErrDigestMismatch {
+		t.Errorf("FetchVerified() = %v, want %v", err, ErrDigestMismatch)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("cache has %d files, want 1", len(files))
+	}
+}
+
+// streamScheme is a FileStreamer whose files can only be streamed.
+type streamScheme struct {
+	content string
+	closed  bool
+}
+
+func (s *streamScheme) Fetch(u *url.URL) (io.ReaderAt, error) {
+	return nil, errors.New("file fetched into memory")
+}
+
+func (s *streamScheme) Stream(u *url.URL) (io.ReadCloser, error) {
+	return s, nil
+}
+
+func (s *streamScheme) Read(p []byte) (int, error) {
+	if len(s.content) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.content)
+	s.content = s.content[n:]
+	return n, nil
+}
+
+func (s *streamScheme) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFetchVerifiedCacheStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &streamScheme{content: "good"}
+	s := Schemes{"fooftp": fs}
+	kernel := &url.URL{Scheme: "fooftp", Host: "host", Path: "/kernel"}
+	r, err := s.FetchVerified(kernel, FetchOptions{Digest: mustParseDigest(t, "good"), Cache: &Cache{Dir: dir}})
+	if err != nil {
+		t.Fatalf("FetchVerified() = %v, want nil", err)
+	}
+	if got, _ := ioutil.ReadAll(uio.Reader(r)); string(got) != "good" {
+		t.Errorf("FetchVerified() = %q, want good", got)
+	}
+	if !fs.closed {
+		t.Errorf("stream closed: got false, want true")
+	}
+}
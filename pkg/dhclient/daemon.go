@@ -0,0 +1,379 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// EventType is what happened to a lease kept by RunDaemon.
+type EventType int
+
+// Lease events.
+const (
+	// LeaseBound is a new lease, which was configured on the interface.
+	LeaseBound EventType = iota + 1
+
+	// LeaseRenewed is a lease that was renewed or rebound without
+	// changes to the network configuration.
+	LeaseRenewed
+
+	// LeaseChanged is a lease that was renewed or rebound with a
+	// different network configuration, which was reconfigured.
+	LeaseChanged
+
+	// LeaseLost is a lease that expired or that the server took back. Its
+	// address was removed from the interface.
+	LeaseLost
+
+	// LeaseFailed is a failed attempt to get, renew or rebind a lease.
+	LeaseFailed
+)
+
+func (e EventType) String() string {
+	switch e {
+	case LeaseBound:
+		return "bound"
+	case LeaseRenewed:
+		return "renewed"
+	case LeaseChanged:
+		return "changed"
+	case LeaseLost:
+		return "lost"
+	case LeaseFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown lease event (%d)", int(e))
+}
+
+// Event is a change to a lease kept by RunDaemon.
+type Event struct {
+	Type EventType
+
+	// Protocol is the IP protocol of the lease.
+	Protocol NetworkProtocol
+
+	// Interface is the network interface of the lease.
+	Interface netlink.Link
+
+	// Lease is the current lease. For LeaseLost it is the lease that was
+	// lost, and for LeaseFailed it is the lease being renewed, if any.
+	Lease Lease
+
+	// Err is why a LeaseFailed attempt failed, why a LeaseLost lease
+	// was lost if the server refused it, or why the interface could not
+	// be configured.
+	Err error
+}
+
+func (e *Event) String() string {
+	s := fmt.Sprintf("%s %s lease on %s", e.Protocol, e.Type, e.Interface.Attrs().Name)
+	if e.Lease != nil {
+		s += ": " + e.Lease.String()
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(" (%v)", e.Err)
+	}
+	return s
+}
+
+// DaemonConfig is the configuration of RunDaemon.
+type DaemonConfig struct {
+	// Config is used for every DHCP exchange.
+	Config Config
+
+	// IPv4 and IPv6 determine whether to keep DHCPv4 and DHCPv6 leases.
+	IPv4 bool
+	IPv6 bool
+
+	// PrefixDelegation asks DHCPv6 servers to delegate a prefix, see
+	// Packet6.DelegatedPrefixes.
+	PrefixDelegation bool
+
+	// LeaseDir, if set, is a directory where leases are saved, and from
+	// where unexpired leases are picked up again when the daemon starts.
+	LeaseDir string
+
+	// RetryInterval is how long to wait after failing to get a lease.
+	// It defaults to 10 seconds.
+	RetryInterval time.Duration
+}
+
+// minRenewRetry is the shortest interval between renew and rebind
+// attempts, RFC 2131 Section 4.4.5.
+const minRenewRetry = 60 * time.Second
+
+// The daemon's clock and network configuration are replaceable for
+// testing.
+var (
+	now   = time.Now
+	after = time.After
+
+	configureLease    = Lease.Configure
+	unconfigureLease  = unconfigure
+	unconfigureRoutes = removeRoutes
+
+	dial4 = func(iface netlink.Link, c Config) (client4, error) {
+		return newClient4(iface, c)
+	}
+	dial6 = func(iface netlink.Link, c Config) (client6, error) {
+		return newClient6(iface, c)
+	}
+)
+
+// RunDaemon keeps DHCP leases on ifs until ctx is done.
+//
+// Leases are configured on their interface when they are bound, renewed
+// and rebound before they expire, reconfigured when a renewal changes them,
+// and removed when they are lost, after which a new lease is requested.
+//
+// Every change is sent on the returned channel, which is closed when all
+// interfaces are done. Events must be received for the daemon to make
+// progress.
+func RunDaemon(ctx context.Context, ifs []netlink.Link, c DaemonConfig) <-chan *Event {
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 10 * time.Second
+	}
+	events := make(chan *Event)
+
+	var wg sync.WaitGroup
+	for _, iface := range ifs {
+		log.Printf("Bringing up interface %s...", iface.Attrs().Name)
+		if _, err := IfUp(iface.Attrs().Name); err != nil {
+			log.Printf("Could not bring up interface %s: %v", iface.Attrs().Name, err)
+			continue
+		}
+
+		if c.IPv4 {
+			wg.Add(1)
+			go func(iface netlink.Link) {
+				defer wg.Done()
+				d := &daemon{iface: iface, config: c, protocol: NetIPv4, events: events}
+				client, err := dial4(iface, c.Config)
+				if err != nil {
+					d.send(ctx, &Event{Type: LeaseFailed, Err: err})
+					return
+				}
+				defer client.Close()
+				d.run4(ctx, client)
+			}(iface)
+		}
+
+		if c.IPv6 {
+			wg.Add(1)
+			go func(iface netlink.Link) {
+				defer wg.Done()
+				d := &daemon{iface: iface, config: c, protocol: NetIPv6, events: events}
+				if err := waitIPv6LinkReady(ctx, iface); err != nil {
+					d.send(ctx, &Event{Type: LeaseFailed, Err: err})
+					return
+				}
+				client, err := dial6(iface, c.Config)
+				if err != nil {
+					d.send(ctx, &Event{Type: LeaseFailed, Err: err})
+					return
+				}
+				defer client.Close()
+				d.run6(ctx, client)
+			}(iface)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	return events
+}
+
+// daemon keeps the lease of one protocol on one interface.
+type daemon struct {
+	iface    netlink.Link
+	config   DaemonConfig
+	protocol NetworkProtocol
+	events   chan<- *Event
+}
+
+// send sends e unless ctx is done first.
+func (d *daemon) send(ctx context.Context, e *Event) {
+	e.Protocol, e.Interface = d.protocol, d.iface
+	select {
+	case d.events <- e:
+	case <-ctx.Done():
+	}
+}
+
+// sleep waits for duration t or until ctx is done, whichever is first, and
+// returns whether ctx is still running.
+func sleep(ctx context.Context, t time.Duration) bool {
+	select {
+	case <-after(t):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryDelay returns how long to wait before retrying to renew or rebind,
+// given that the next stage begins at deadline: half the remaining time,
+// but at least minRenewRetry.
+func retryDelay(deadline time.Time) time.Duration {
+	rem := deadline.Sub(now())
+	if rem/2 > minRenewRetry {
+		return rem / 2
+	}
+	if rem > minRenewRetry {
+		return minRenewRetry
+	}
+	return rem
+}
+
+// savedLease is the on-disk format of leases.
+type savedLease struct {
+	// Acquired is when the lease was bound or last renewed.
+	Acquired time.Time
+
+	// Packet is the server's DHCPACK or Reply.
+	Packet []byte
+}
+
+func (d *daemon) leaseFile() string {
+	ext := ".lease4"
+	if d.protocol == NetIPv6 {
+		ext = ".lease6"
+	}
+	return filepath.Join(d.config.LeaseDir, d.iface.Attrs().Name+ext)
+}
+
+// save writes the lease packet acquired at t to the lease directory.
+func (d *daemon) save(packet []byte, t time.Time) {
+	if len(d.config.LeaseDir) == 0 {
+		return
+	}
+	b, err := json.Marshal(&savedLease{Acquired: t, Packet: packet})
+	if err == nil {
+		err = ioutil.WriteFile(d.leaseFile(), b, 0600)
+	}
+	if err != nil {
+		log.Printf("Could not save %s lease of %s: %v", d.protocol, d.iface.Attrs().Name, err)
+	}
+}
+
+// restore reads the saved lease from the lease directory.
+func (d *daemon) restore() *savedLease {
+	if len(d.config.LeaseDir) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(d.leaseFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read saved lease: %v", err)
+		}
+		return nil
+	}
+	var l savedLease
+	if err := json.Unmarshal(b, &l); err != nil {
+		log.Printf("Could not parse saved lease %s: %v", d.leaseFile(), err)
+		return nil
+	}
+	return &l
+}
+
+// forget removes the saved lease.
+func (d *daemon) forget() {
+	if len(d.config.LeaseDir) > 0 {
+		os.Remove(d.leaseFile())
+	}
+}
+
+// bind configures the interface for lease l, which replaces old, and
+// reports it. The old address is removed if l moved to another one.
+func (d *daemon) bind(ctx context.Context, old, l Lease, changed bool) {
+	typ := LeaseRenewed
+	switch {
+	case old == nil:
+		typ = LeaseBound
+	case changed:
+		typ = LeaseChanged
+		// The new lease may not have the old one's routers.
+		if err := unconfigureRoutes(old); err != nil {
+			log.Printf("Could not remove the routes of %s: %v", old, err)
+		}
+		if o, n := leaseAddr(old), leaseAddr(l); o != nil && (n == nil || o.String() != n.String()) {
+			if err := unconfigureLease(old); err != nil {
+				log.Printf("Could not remove %s from %s: %v", o, d.iface.Attrs().Name, err)
+			}
+		}
+	}
+
+	var err error
+	// IPv6 addresses carry their lifetimes, which are refreshed.
+	if typ != LeaseRenewed || d.protocol == NetIPv6 {
+		err = configureLease(l)
+	}
+	d.send(ctx, &Event{Type: typ, Lease: l, Err: err})
+}
+
+// lose removes lease l from the interface and from the lease directory,
+// and reports it.
+func (d *daemon) lose(ctx context.Context, l Lease, reason error) {
+	if err := unconfigureLease(l); err != nil {
+		log.Printf("Could not unconfigure %s: %v", l, err)
+	}
+	d.forget()
+	d.send(ctx, &Event{Type: LeaseLost, Lease: l, Err: reason})
+}
+
+// leaseAddr returns the address lease l configures.
+func leaseAddr(l Lease) *net.IPNet {
+	switch p := l.(type) {
+	case *Packet4:
+		return p.Lease()
+	case *Packet6:
+		if ia := p.Lease(); ia != nil {
+			return &net.IPNet{
+				IP:   ia.IPv6Addr,
+				Mask: net.IPMask(net.ParseIP("ffff:ffff:ffff:ffff::")),
+			}
+		}
+	}
+	return nil
+}
+
+// unconfigure removes the address of lease l from its interface.
+func unconfigure(l Lease) error {
+	addr := leaseAddr(l)
+	if addr == nil {
+		return nil
+	}
+	return netlink.AddrDel(l.Link(), &netlink.Addr{IPNet: addr})
+}
+
+// removeRoutes removes the routes lease l configures. Routes that are
+// already gone are ignored.
+func removeRoutes(l Lease) error {
+	p, ok := l.(*Packet4)
+	if !ok {
+		return nil
+	}
+	for _, r := range p.routes() {
+		if err := netlink.RouteDel(r); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("remove %s: %v", r, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+)
+
+// client4 is the part of nclient4.Client used by the daemon.
+type client4 interface {
+	Request(ctx context.Context, modifiers ...dhcpv4.Modifier) (offer, ack *dhcpv4.DHCPv4, err error)
+	SendAndRead(ctx context.Context, dest *net.UDPAddr, p *dhcpv4.DHCPv4, match nclient4.Matcher) (*dhcpv4.DHCPv4, error)
+	Close() error
+}
+
+// defaultLeaseTime4 is the lease time of DHCPACKs without one.
+const defaultLeaseTime4 = time.Hour
+
+// errNAK means a DHCPv4 server refused a lease.
+var errNAK = errors.New("server sent DHCPNAK")
+
+// isAckOrNak matches DHCPv4 server responses to a DHCPREQUEST.
+func isAckOrNak(p *dhcpv4.DHCPv4) bool {
+	t := p.MessageType()
+	return t == dhcpv4.MessageTypeAck || t == dhcpv4.MessageTypeNak
+}
+
+// leaseTimes4 returns when the DHCPv4 lease acquired at t must be renewed
+// (T1), rebound (T2) and when it expires, RFC 2131 Section 4.4.5.
+func leaseTimes4(p *dhcpv4.DHCPv4, t time.Time) (t1, t2, expiry time.Time) {
+	lease := p.IPAddressLeaseTime(defaultLeaseTime4)
+	d1, d2 := lease/2, lease*7/8
+	if v, ok := duration4(p, dhcpv4.OptionRenewTimeValue); ok && v < lease {
+		d1 = v
+	}
+	if v, ok := duration4(p, dhcpv4.OptionRebindingTimeValue); ok && v < lease {
+		d2 = v
+	}
+	if d1 > d2 {
+		d1 = d2
+	}
+	return t.Add(d1), t.Add(d2), t.Add(lease)
+}
+
+func duration4(p *dhcpv4.DHCPv4, code dhcpv4.OptionCode) (time.Duration, bool) {
+	v := p.Options.Get(code)
+	if v == nil {
+		return 0, false
+	}
+	var d dhcpv4.Duration
+	if err := d.FromBytes(v); err != nil {
+		return 0, false
+	}
+	return time.Duration(d), true
+}
+
+// changed4 returns whether the network configuration of two leases differs.
+func changed4(old, l *Packet4) bool {
+	return old.Lease().String() != l.Lease().String() ||
+		fmt.Sprint(old.P.Router()) != fmt.Sprint(l.P.Router()) ||
+		fmt.Sprint(old.P.ClasslessStaticRoute()) != fmt.Sprint(l.P.ClasslessStaticRoute())
+}
+
+func (d *daemon) serverAddr4() *net.UDPAddr {
+	if d.config.Config.V4ServerAddr != nil {
+		return d.config.Config.V4ServerAddr
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ServerPort}
+}
+
+// request4 sends a DHCPREQUEST to dest.
+func (d *daemon) request4(ctx context.Context, c client4, dest *net.UDPAddr, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, error) {
+	mods := append([]dhcpv4.Modifier{
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(d.iface.Attrs().HardwareAddr),
+	}, modifiers...)
+	req, err := dhcpv4.New(append(mods, d.config.Config.modifiers4()...)...)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendAndRead(ctx, dest, req, isAckOrNak)
+}
+
+// run4 keeps a DHCPv4 lease until ctx is done.
+func (d *daemon) run4(ctx context.Context, c client4) {
+	p, t := d.reboot4(ctx, c)
+	for ctx.Err() == nil {
+		if p == nil {
+			p, t = d.init4(ctx, c)
+		} else {
+			p, t = d.renew4(ctx, c, p, t)
+		}
+	}
+}
+
+// reboot4 verifies the saved lease with the server, RFC 2131 Section 3.2.
+// If no server answers, the saved lease is used until it expires.
+func (d *daemon) reboot4(ctx context.Context, c client4) (*Packet4, time.Time) {
+	s := d.restore()
+	if s == nil {
+		return nil, time.Time{}
+	}
+	saved, err := dhcpv4.FromBytes(s.Packet)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	if _, _, expiry := leaseTimes4(saved, s.Acquired); !now().Before(expiry) {
+		d.forget()
+		return nil, time.Time{}
+	}
+
+	ack, err := d.request4(ctx, c, d.serverAddr4(), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(saved.YourIPAddr)))
+	switch {
+	case ctx.Err() != nil:
+		return nil, time.Time{}
+	case err != nil:
+		p := NewPacket4(d.iface, saved)
+		d.bind(ctx, nil, p, false)
+		return p, s.Acquired
+	case ack.MessageType() == dhcpv4.MessageTypeNak:
+		d.forget()
+		return nil, time.Time{}
+	}
+	return d.bound4(ctx, nil, ack)
+}
+
+// init4 gets a new lease, retrying until it succeeds or ctx is done.
+func (d *daemon) init4(ctx context.Context, c client4) (*Packet4, time.Time) {
+	for {
+		_, ack, err := c.Request(ctx, d.config.Config.modifiers4()...)
+		if ctx.Err() != nil {
+			return nil, time.Time{}
+		}
+		if err == nil && ack.MessageType() != dhcpv4.MessageTypeAck {
+			err = errNAK
+		}
+		if err == nil {
+			return d.bound4(ctx, nil, ack)
+		}
+		d.send(ctx, &Event{Type: LeaseFailed, Err: err})
+		if !sleep(ctx, d.config.RetryInterval) {
+			return nil, time.Time{}
+		}
+	}
+}
+
+// bound4 makes ack the current lease, replacing old.
+func (d *daemon) bound4(ctx context.Context, old *Packet4, ack *dhcpv4.DHCPv4) (*Packet4, time.Time) {
+	t := now()
+	p := NewPacket4(d.iface, ack)
+	d.save(ack.ToBytes(), t)
+	if old == nil {
+		d.bind(ctx, nil, p, false)
+	} else {
+		d.bind(ctx, old, p, changed4(old, p))
+	}
+	return p, t
+}
+
+// renew4 renews lease p acquired at t once T1 is reached, falling back to
+// rebinding at T2. It returns the new lease, or nil if the lease was lost.
+func (d *daemon) renew4(ctx context.Context, c client4, p *Packet4, t time.Time) (*Packet4, time.Time) {
+	t1, t2, expiry := leaseTimes4(p.P, t)
+	for {
+		n := now()
+		if !n.Before(expiry) {
+			d.lose(ctx, p, nil)
+			return nil, time.Time{}
+		}
+		if n.Before(t1) {
+			if !sleep(ctx, t1.Sub(n)) {
+				return p, t
+			}
+			continue
+		}
+
+		// Renewals are unicast to the server that granted the lease,
+		// rebinding requests are broadcast to all.
+		dest, next := d.serverAddr4(), t2
+		if n.Before(t2) {
+			if sid := p.P.ServerIdentifier(); sid != nil {
+				dest = &net.UDPAddr{IP: sid, Port: dhcpv4.ServerPort}
+			}
+		} else {
+			next = expiry
+		}
+		ack, err := d.request4(ctx, c, dest, dhcpv4.WithClientIP(p.P.YourIPAddr))
+		switch {
+		case ctx.Err() != nil:
+			return p, t
+		case err != nil:
+			d.send(ctx, &Event{Type: LeaseFailed, Lease: p, Err: err})
+			if !sleep(ctx, retryDelay(next)) {
+				return p, t
+			}
+		case ack.MessageType() == dhcpv4.MessageTypeNak:
+			d.lose(ctx, p, errNAK)
+			return nil, time.Time{}
+		default:
+			return d.bound4(ctx, p, ack)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// client6 is the part of nclient6.Client used by the daemon.
+type client6 interface {
+	RapidSolicit(ctx context.Context, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error)
+	SendAndRead(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6.Message, match nclient6.Matcher) (*dhcpv6.Message, error)
+	Close() error
+}
+
+// errNoAddress means a DHCPv6 reply has no IA_NA address.
+var errNoAddress = errors.New("DHCPv6 reply has no address")
+
+// StatusError is a DHCPv6 status code other than Success.
+type StatusError struct {
+	Code    iana.StatusCode
+	Message string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("DHCPv6 status %s: %s", s.Code, s.Message)
+}
+
+// WithPrefixDelegation asks DHCPv6 servers to delegate a prefix with an
+// IA_PD option, RFC 3633. It uses the IAID of the IA_NA option, if any.
+func WithPrefixDelegation(d dhcpv6.DHCPv6) {
+	var iaid [4]byte
+	if ia, ok := d.GetOneOption(dhcpv6.OptionIANA).(*dhcpv6.OptIANA); ok {
+		iaid = ia.IaId
+	}
+	d.UpdateOption(&dhcpv6.OptIAForPrefixDelegation{IaId: iaid})
+}
+
+// status6 returns the status of a reply, which is the first failure of
+// the message itself or of one of its IAs.
+func status6(m *dhcpv6.Message) error {
+	opts := []dhcpv6.Option{m.GetOneOption(dhcpv6.OptionStatusCode)}
+	for _, o := range m.GetOption(dhcpv6.OptionIANA) {
+		opts = append(opts, o.(*dhcpv6.OptIANA).Options.GetOne(dhcpv6.OptionStatusCode))
+	}
+	for _, o := range m.GetOption(dhcpv6.OptionIAPD) {
+		opts = append(opts, o.(*dhcpv6.OptIAForPrefixDelegation).Options.GetOne(dhcpv6.OptionStatusCode))
+	}
+	for _, o := range opts {
+		if s, ok := o.(*dhcpv6.OptStatusCode); ok && s.StatusCode != iana.StatusSuccess {
+			return &StatusError{Code: s.StatusCode, Message: string(s.StatusMessage)}
+		}
+	}
+	return nil
+}
+
+// leaseTimes6 returns when the DHCPv6 lease acquired at t must be renewed
+// (T1), rebound (T2) and when it expires, RFC 8415 Section 21.4.
+//
+// Leases with several addresses and prefixes are renewed as soon as the
+// first of them needs to be, and expire with the first of them.
+func leaseTimes6(m *dhcpv6.Message, t time.Time) (t1, t2, expiry time.Time) {
+	var d1, d2, preferred, valid time.Duration
+	min := func(d *time.Duration, v time.Duration) {
+		if v > 0 && (*d == 0 || v < *d) {
+			*d = v
+		}
+	}
+	for _, o := range m.GetOption(dhcpv6.OptionIANA) {
+		ia := o.(*dhcpv6.OptIANA)
+		min(&d1, ia.T1)
+		min(&d2, ia.T2)
+		for _, a := range ia.Options.Get(dhcpv6.OptionIAAddr) {
+			min(&preferred, a.(*dhcpv6.OptIAAddress).PreferredLifetime)
+			min(&valid, a.(*dhcpv6.OptIAAddress).ValidLifetime)
+		}
+	}
+	for _, o := range m.GetOption(dhcpv6.OptionIAPD) {
+		ia := o.(*dhcpv6.OptIAForPrefixDelegation)
+		min(&d1, ia.T1)
+		min(&d2, ia.T2)
+		for _, p := range ia.Options.Get(dhcpv6.OptionIAPrefix) {
+			min(&preferred, p.(*dhcpv6.OptIAPrefix).PreferredLifetime)
+			min(&valid, p.(*dhcpv6.OptIAPrefix).ValidLifetime)
+		}
+	}
+	if preferred == 0 {
+		preferred = valid
+	}
+	// Servers leaving T1 and T2 to the client get the recommended 0.5
+	// and 0.8 times the preferred lifetime.
+	if d1 == 0 {
+		d1 = preferred / 2
+	}
+	if d2 == 0 {
+		d2 = preferred * 4 / 5
+	}
+	if d1 > d2 {
+		d1 = d2
+	}
+	return t.Add(d1), t.Add(d2), t.Add(valid)
+}
+
+// changed6 returns whether the network configuration of two leases differs.
+func changed6(old, l *Packet6) bool {
+	return leaseAddr(old).String() != leaseAddr(l).String() ||
+		fmt.Sprint(old.DelegatedPrefixes()) != fmt.Sprint(l.DelegatedPrefixes())
+}
+
+func (d *daemon) serverAddr6() *net.UDPAddr {
+	if d.config.Config.V6ServerAddr != nil {
+		return d.config.Config.V6ServerAddr
+	}
+	return &net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort}
+}
+
+func (d *daemon) modifiers6() []dhcpv6.Modifier {
+	mods := d.config.Config.modifiers6()
+	if d.config.PrefixDelegation {
+		mods = append(mods, WithPrefixDelegation)
+	}
+	return mods
+}
+
+// extend6 sends a Renew or Rebind message for the IAs of reply, RFC 8415
+// Section 18.2.4 and 18.2.5.
+func (d *daemon) extend6(ctx context.Context, c client6, typ dhcpv6.MessageType, reply *dhcpv6.Message) (*dhcpv6.Message, error) {
+	m, err := dhcpv6.NewMessage(d.config.Config.modifiers6()...)
+	if err != nil {
+		return nil, err
+	}
+	m.MessageType = typ
+	ids := []dhcpv6.OptionCode{dhcpv6.OptionClientID}
+	if typ == dhcpv6.MessageTypeRenew {
+		ids = append(ids, dhcpv6.OptionServerID)
+	}
+	for _, code := range ids {
+		if o := reply.GetOneOption(code); o != nil {
+			m.AddOption(o)
+		}
+	}
+	// Ask for the same addresses and prefixes, leaving out the status
+	// of the last reply.
+	for _, o := range reply.GetOption(dhcpv6.OptionIANA) {
+		ia := o.(*dhcpv6.OptIANA)
+		m.AddOption(&dhcpv6.OptIANA{IaId: ia.IaId, Options: ia.Options.Get(dhcpv6.OptionIAAddr)})
+	}
+	for _, o := range reply.GetOption(dhcpv6.OptionIAPD) {
+		ia := o.(*dhcpv6.OptIAForPrefixDelegation)
+		m.AddOption(&dhcpv6.OptIAForPrefixDelegation{IaId: ia.IaId, Options: ia.Options.Get(dhcpv6.OptionIAPrefix)})
+	}
+	m.AddOption(&dhcpv6.OptElapsedTime{})
+
+	r, err := c.SendAndRead(ctx, d.serverAddr6(), m, nclient6.IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		return nil, err
+	}
+	return r, status6(r)
+}
+
+// run6 keeps a DHCPv6 lease until ctx is done.
+func (d *daemon) run6(ctx context.Context, c client6) {
+	p, t := d.reboot6(ctx, c)
+	for ctx.Err() == nil {
+		if p == nil {
+			p, t = d.init6(ctx, c)
+		} else {
+			p, t = d.renew6(ctx, c, p, t)
+		}
+	}
+}
+
+// reboot6 rebinds the saved lease, RFC 8415 Section 18.2.12. If no server
+// answers, the saved lease is used until it expires.
+func (d *daemon) reboot6(ctx context.Context, c client6) (*Packet6, time.Time) {
+	s := d.restore()
+	if s == nil {
+		return nil, time.Time{}
+	}
+	saved, err := dhcpv6.MessageFromBytes(s.Packet)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	if _, _, expiry := leaseTimes6(saved, s.Acquired); !now().Before(expiry) {
+		d.forget()
+		return nil, time.Time{}
+	}
+
+	reply, err := d.extend6(ctx, c, dhcpv6.MessageTypeRebind, saved)
+	if ctx.Err() != nil {
+		return nil, time.Time{}
+	}
+	if _, ok := err.(*StatusError); ok {
+		d.forget()
+		return nil, time.Time{}
+	}
+	if err != nil || NewPacket6(d.iface, reply).Lease() == nil {
+		p := NewPacket6(d.iface, saved)
+		d.bind(ctx, nil, p, false)
+		return p, s.Acquired
+	}
+	return d.bound6(ctx, nil, reply)
+}
+
+// init6 gets a new lease, retrying until it succeeds or ctx is done.
+func (d *daemon) init6(ctx context.Context, c client6) (*Packet6, time.Time) {
+	for {
+		reply, err := c.RapidSolicit(ctx, d.modifiers6()...)
+		if ctx.Err() != nil {
+			return nil, time.Time{}
+		}
+		if err == nil {
+			err = status6(reply)
+		}
+		if err == nil && NewPacket6(d.iface, reply).Lease() == nil {
+			err = errNoAddress
+		}
+		if err == nil {
+			return d.bound6(ctx, nil, reply)
+		}
+		d.send(ctx, &Event{Type: LeaseFailed, Err: err})
+		if !sleep(ctx, d.config.RetryInterval) {
+			return nil, time.Time{}
+		}
+	}
+}
+
+// bound6 makes reply the current lease, replacing old.
+func (d *daemon) bound6(ctx context.Context, old *Packet6, reply *dhcpv6.Message) (*Packet6, time.Time) {
+	t := now()
+	p := NewPacket6(d.iface, reply)
+	d.save(reply.ToBytes(), t)
+	if old == nil {
+		d.bind(ctx, nil, p, false)
+	} else {
+		d.bind(ctx, old, p, changed6(old, p))
+	}
+	return p, t
+}
+
+// renew6 renews lease p acquired at t once T1 is reached, falling back to
+// rebinding at T2. It returns the new lease, or nil if the lease was lost.
+func (d *daemon) renew6(ctx context.Context, c client6, p *Packet6, t time.Time) (*Packet6, time.Time) {
+	t1, t2, expiry := leaseTimes6(p.p, t)
+	for {
+		n := now()
+		if !n.Before(expiry) {
+			d.lose(ctx, p, nil)
+			return nil, time.Time{}
+		}
+		if n.Before(t1) {
+			if !sleep(ctx, t1.Sub(n)) {
+				return p, t
+			}
+			continue
+		}
+
+		typ, next := dhcpv6.MessageTypeRenew, t2
+		if !n.Before(t2) {
+			typ, next = dhcpv6.MessageTypeRebind, expiry
+		}
+		reply, err := d.extend6(ctx, c, typ, p.p)
+		if ctx.Err() != nil {
+			return p, t
+		}
+		if s, ok := err.(*StatusError); ok && s.Code == iana.StatusNoBinding {
+			d.lose(ctx, p, err)
+			return nil, time.Time{}
+		}
+		if err == nil && NewPacket6(d.iface, reply).Lease() == nil {
+			err = errNoAddress
+		}
+		if err == nil {
+			return d.bound6(ctx, p, reply)
+		}
+		d.send(ctx, &Event{Type: LeaseFailed, Lease: p, Err: err})
+		if !sleep(ctx, retryDelay(next)) {
+			return p, t
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeClock makes every sleep of the daemon return at once, moving time
+// forward.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func (c *fakeClock) since(start time.Time) time.Duration {
+	return c.now().Sub(start)
+}
+
+// setupDaemon replaces the daemon's clock and network configuration and
+// records addresses and routes removed from the interface. The returned
+// func undoes it.
+func setupDaemon() (*fakeClock, *[]string, func()) {
+	clock := &fakeClock{t: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var removed []string
+	oldNow, oldAfter, oldConf, oldUnconf, oldRoutes := now, after, configureLease, unconfigureLease, unconfigureRoutes
+	now, after = clock.now, clock.after
+	configureLease = func(Lease) error { return nil }
+	unconfigureLease = func(l Lease) error {
+		removed = append(removed, leaseAddr(l).String())
+		return nil
+	}
+	unconfigureRoutes = func(l Lease) error {
+		removed = append(removed, "routes of "+leaseAddr(l).String())
+		return nil
+	}
+	return clock, &removed, func() {
+		now, after, configureLease, unconfigureLease, unconfigureRoutes = oldNow, oldAfter, oldConf, oldUnconf, oldRoutes
+	}
+}
+
+var testIface = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+	Name:         "eth0",
+	HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+}}
+
+type fakeClient4 struct {
+	// serve answers requests to dest.
+	serve func(req *dhcpv4.DHCPv4, dest *net.UDPAddr) (*dhcpv4.DHCPv4, error)
+}
+
+func (f *fakeClient4) Request(ctx context.Context, modifiers ...dhcpv4.Modifier) (offer, ack *dhcpv4.DHCPv4, err error) {
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}, modifiers...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ack, err = f.serve(req, nil)
+	return nil, ack, err
+}
+
+func (f *fakeClient4) SendAndRead(ctx context.Context, dest *net.UDPAddr, p *dhcpv4.DHCPv4, match nclient4.Matcher) (*dhcpv4.DHCPv4, error) {
+	return f.serve(p, dest)
+}
+
+func (f *fakeClient4) Close() error { return nil }
+
+func ack4(t *testing.T, ip net.IP, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	return mustNew(t, append([]dhcpv4.Modifier{
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(ip),
+		dhcpv4.WithNetmask(net.CIDRMask(24, 32)),
+		dhcpv4.WithRouter(net.IP{10, 0, 0, 1}),
+		dhcpv4.WithLeaseTime(100),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IP{10, 0, 0, 1})),
+	}, mods...)...)
+}
+
+// expectEvents receives events until it got len(want) of them.
+func expectEvents(t *testing.T, events <-chan *Event, want ...EventType) []*Event {
+	var got []*Event
+	for range want {
+		e, ok := <-events
+		if !ok {
+			break
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events %v, want %v", len(got), got, want)
+	}
+	for i, e := range got {
+		if e.Type != want[i] {
+			t.Errorf("event %d = %v, want %v", i, e, want[i])
+		}
+	}
+	return got
+}
+
+func runDaemon4(ctx context.Context, c DaemonConfig, client client4) <-chan *Event {
+	events := make(chan *Event)
+	d := &daemon{iface: testIface, config: c, protocol: NetIPv4, events: events}
+	go func() {
+		d.run4(ctx, client)
+		close(events)
+	}()
+	return events
+}
+
+func TestDaemon4(t *testing.T) {
+	clock, removed, restore := setupDaemon()
+	defer restore()
+	start := clock.now()
+
+	var reqs []*dhcpv4.DHCPv4
+	var dests []*net.UDPAddr
+	answers := []func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error){
+		// Bound.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) { return ack4(t, net.IP{10, 0, 0, 10}), nil },
+		// Renewed at T1 without changes.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) { return ack4(t, net.IP{10, 0, 0, 10}), nil },
+		// Renewed with a new address.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) { return ack4(t, net.IP{10, 0, 0, 11}), nil },
+		// The server is gone.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) { return nil, nclient4.ErrNoResponse },
+		// Another server refuses to rebind.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+			return mustNew(t, dhcpv4.WithMessageType(dhcpv4.MessageTypeNak)), nil
+		},
+		// A new lease.
+		func(*dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) { return ack4(t, net.IP{10, 0, 0, 12}), nil },
+	}
+	client := &fakeClient4{serve: func(req *dhcpv4.DHCPv4, dest *net.UDPAddr) (*dhcpv4.DHCPv4, error) {
+		reqs, dests = append(reqs, req), append(dests, dest)
+		a := answers[0]
+		if len(answers) > 1 {
+			answers = answers[1:]
+		}
+		return a(req)
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := runDaemon4(ctx, DaemonConfig{RetryInterval: time.Second}, client)
+	got := expectEvents(t, events, LeaseBound, LeaseRenewed, LeaseChanged, LeaseFailed, LeaseLost, LeaseBound)
+	cancel()
+	for range events {
+	}
+
+	if l := got[2].Lease.(*Packet4).Lease().String(); l != "10.0.0.11/24" {
+		t.Errorf("changed lease = %s, want 10.0.0.11/24", l)
+	}
+	if got[4].Err != errNAK {
+		t.Errorf("lost lease error = %v, want %v", got[4].Err, errNAK)
+	}
+	if want := []string{"routes of 10.0.0.10/24", "10.0.0.10/24", "10.0.0.11/24"}; fmt.Sprint(*removed) != fmt.Sprint(want) {
+		t.Errorf("removed %v, want %v", *removed, want)
+	}
+
+	// Renewals at T1 are unicast, from the leased address.
+	if dests[1].String() != "10.0.0.1:67" || !reqs[1].ClientIPAddr.Equal(net.IP{10, 0, 0, 10}) {
+		t.Errorf("renewal sent to %v from %v, want 10.0.0.1:67 from 10.0.0.10", dests[1], reqs[1].ClientIPAddr)
+	}
+	// The renewal at 150s fails and is retried at T2, 187.5s, by
+	// broadcast.
+	if !dests[4].IP.Equal(net.IPv4bcast) {
+		t.Errorf("rebinding request sent to %v, want broadcast", dests[4])
+	}
+	if want := 187500 * time.Millisecond; clock.since(start) < want {
+		t.Errorf("lease lost after %v, want at least %v", clock.since(start), want)
+	}
+}
+
+func TestDaemon4Restore(t *testing.T) {
+	_, _, restore := setupDaemon()
+	defer restore()
+	dir, err := ioutil.TempDir("", "dhclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := DaemonConfig{LeaseDir: dir, RetryInterval: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := runDaemon4(ctx, c, &fakeClient4{serve: func(*dhcpv4.DHCPv4, *net.UDPAddr) (*dhcpv4.DHCPv4, error) {
+		return ack4(t, net.IP{10, 0, 0, 10}), nil
+	}})
+	expectEvents(t, events, LeaseBound)
+	cancel()
+	for range events {
+	}
+	if _, err := os.Stat(filepath.Join(dir, "eth0.lease4")); err != nil {
+		t.Fatalf("lease not saved: %v", err)
+	}
+
+	// Without a server, the saved lease is used after asking for it.
+	var requested net.IP
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events = runDaemon4(ctx, c, &fakeClient4{serve: func(req *dhcpv4.DHCPv4, _ *net.UDPAddr) (*dhcpv4.DHCPv4, error) {
+		if requested == nil {
+			requested = req.RequestedIPAddress()
+		}
+		return nil, nclient4.ErrNoResponse
+	}})
+	got := expectEvents(t, events, LeaseBound)
+	cancel()
+	for range events {
+	}
+	if l := got[0].Lease.(*Packet4).Lease().String(); l != "10.0.0.10/24" {
+		t.Errorf("restored lease = %s, want 10.0.0.10/24", l)
+	}
+	if !requested.Equal(net.IP{10, 0, 0, 10}) {
+		t.Errorf("requested address %v, want 10.0.0.10", requested)
+	}
+}
+
+type fakeClient6 struct {
+	serve func(msg *dhcpv6.Message) (*dhcpv6.Message, error)
+}
+
+func (f *fakeClient6) RapidSolicit(ctx context.Context, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	msg, err := dhcpv6.NewSolicit(testIface.HardwareAddr, modifiers...)
+	if err != nil {
+		return nil, err
+	}
+	return f.serve(msg)
+}
+
+func (f *fakeClient6) SendAndRead(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6.Message, match nclient6.Matcher) (*dhcpv6.Message, error) {
+	return f.serve(msg)
+}
+
+func (f *fakeClient6) Close() error { return nil }
+
+func reply6(t *testing.T, ip string, status iana.StatusCode) *dhcpv6.Message {
+	m, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MessageType = dhcpv6.MessageTypeReply
+	m.AddOption(&dhcpv6.OptClientId{Cid: dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: testIface.HardwareAddr}})
+	m.AddOption(&dhcpv6.OptServerId{Sid: dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{1, 1, 1, 1, 1, 1}}})
+	ia := &dhcpv6.OptIANA{T1: 50 * time.Second, T2: 80 * time.Second}
+	ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(ip), PreferredLifetime: 100 * time.Second, ValidLifetime: 200 * time.Second})
+	if status != iana.StatusSuccess {
+		ia.Options.Add(&dhcpv6.OptStatusCode{StatusCode: status})
+	}
+	m.AddOption(ia)
+
+	prefix := &dhcpv6.OptIAPrefix{PreferredLifetime: 100 * time.Second, ValidLifetime: 200 * time.Second}
+	prefix.SetIPv6Prefix(net.ParseIP("2001:db8:1::"))
+	prefix.SetPrefixLength(48)
+	pd := &dhcpv6.OptIAForPrefixDelegation{T1: 50 * time.Second, T2: 80 * time.Second}
+	pd.Options.Add(prefix)
+	m.AddOption(pd)
+	return m
+}
+
+func TestDaemon6(t *testing.T) {
+	_, _, restore := setupDaemon()
+	defer restore()
+
+	var msgs []*dhcpv6.Message
+	answers := []func() (*dhcpv6.Message, error){
+		func() (*dhcpv6.Message, error) { return reply6(t, "2001:db8::10", iana.StatusSuccess), nil },
+		func() (*dhcpv6.Message, error) { return reply6(t, "2001:db8::10", iana.StatusSuccess), nil },
+		func() (*dhcpv6.Message, error) { return nil, nclient6.ErrNoResponse },
+		func() (*dhcpv6.Message, error) { return reply6(t, "2001:db8::10", iana.StatusNoBinding), nil },
+		func() (*dhcpv6.Message, error) { return reply6(t, "2001:db8::11", iana.StatusSuccess), nil },
+	}
+	client := &fakeClient6{serve: func(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+		msgs = append(msgs, msg)
+		a := answers[0]
+		if len(answers) > 1 {
+			answers = answers[1:]
+		}
+		return a()
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *Event)
+	d := &daemon{iface: testIface, config: DaemonConfig{PrefixDelegation: true, RetryInterval: time.Second}, protocol: NetIPv6, events: events}
+	go func() {
+		d.run6(ctx, client)
+		close(events)
+	}()
+	got := expectEvents(t, events, LeaseBound, LeaseRenewed, LeaseFailed, LeaseLost, LeaseBound)
+	cancel()
+	for range events {
+	}
+
+	if msgs[0].GetOneOption(dhcpv6.OptionIAPD) == nil {
+		t.Errorf("solicit does not ask for a prefix: %v", msgs[0])
+	}
+	if pds := got[0].Lease.(*Packet6).DelegatedPrefixes(); len(pds) != 1 || pds[0].String() != "2001:db8:1::/48" {
+		t.Errorf("delegated prefixes = %v, want [2001:db8:1::/48]", pds)
+	}
+	for i, want := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeSolicit} {
+		if msgs[i].MessageType != want {
+			t.Errorf("message %d is %s, want %s", i, msgs[i].MessageType, want)
+		}
+	}
+	renew, rebind := msgs[1], msgs[3]
+	if renew.GetOneOption(dhcpv6.OptionServerID) == nil || renew.GetOneOption(dhcpv6.OptionIAPD) == nil || renew.GetOneOption(dhcpv6.OptionIANA) == nil {
+		t.Errorf("renew lacks server ID or IAs: %v", renew)
+	}
+	if rebind.GetOneOption(dhcpv6.OptionServerID) != nil {
+		t.Errorf("rebind has a server ID: %v", rebind)
+	}
+	if serr, ok := got[3].Err.(*StatusError); !ok || serr.Code != iana.StatusNoBinding {
+		t.Errorf("lost lease error = %v, want NoBinding", got[3].Err)
+	}
+	if got[4].Lease.(*Packet6).Lease().IPv6Addr.String() != "2001:db8::11" {
+		t.Errorf("new lease = %v, want 2001:db8::11", got[4].Lease)
+	}
+}
@@ -101,9 +101,9 @@ type Lease interface {
 	// the network config.
 	Boot() (*url.URL, error)
 
-	// ISCSIBoot returns the target address and volume name to boot from if
-	// they were part of the DHCP message.
-	ISCSIBoot() (*net.TCPAddr, string, error)
+	// ISCSIBoot returns the target address, LUN and volume name to boot
+	// from if they were part of the DHCP message.
+	ISCSIBoot() (*net.TCPAddr, uint64, string, error)
 
 	// Link is the interface the configuration is for.
 	Link() netlink.Link
@@ -136,6 +136,10 @@ type Config struct {
 	// and received.
 	LogLevel LogLevel
 
+	// HTTPBoot makes requests UEFI HTTP Boot requests, which servers
+	// answer with an HTTP or HTTPS boot file URL.
+	HTTPBoot bool
+
 	// Modifiers4 allows modifications to the IPv4 DHCP request.
 	Modifiers4 []dhcpv4.Modifier
 
@@ -157,7 +161,7 @@ type Config struct {
 	V4ServerAddr *net.UDPAddr
 }
 
-func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+func newClient4(iface netlink.Link, c Config) (*nclient4.Client, error) {
 	mods := []nclient4.ClientOpt{
 		nclient4.WithTimeout(c.Timeout),
 		nclient4.WithRetry(c.Retries),
@@ -171,22 +175,31 @@ func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	if c.V4ServerAddr != nil {
 		mods = append(mods, nclient4.WithServerAddr(c.V4ServerAddr))
 	}
-	client, err := nclient4.New(iface.Attrs().Name, mods...)
+	return nclient4.New(iface.Attrs().Name, mods...)
+}
+
+// modifiers4 returns the modifiers of DHCPv4 requests.
+func (c Config) modifiers4() []dhcpv4.Modifier {
+	// Prepend modifiers with default options, so they can be overriden.
+	reqmods := []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXE UROOT")),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask),
+		dhcpv4.WithNetboot,
+	}
+	if c.HTTPBoot {
+		reqmods = append(reqmods, WithHTTPBoot4)
+	}
+	return append(reqmods, c.Modifiers4...)
+}
+
+func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+	client, err := newClient4(iface, c)
 	if err != nil {
 		return nil, err
 	}
 
-	// Prepend modifiers with default options, so they can be overriden.
-	reqmods := append(
-		[]dhcpv4.Modifier{
-			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXE UROOT")),
-			dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask),
-			dhcpv4.WithNetboot,
-		},
-		c.Modifiers4...)
-
 	log.Printf("Attempting to get DHCPv4 lease on %s", iface.Attrs().Name)
-	_, p, err := client.Request(ctx, reqmods...)
+	_, p, err := client.Request(ctx, c.modifiers4()...)
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +209,9 @@ func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	return packet, nil
 }
 
-func lease6(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+// waitIPv6LinkReady waits for iface to have a non-tentative link-local
+// address.
+func waitIPv6LinkReady(ctx context.Context, iface netlink.Link) error {
 	// For ipv6, we cannot bind to the port until Duplicate Address
 	// Detection (DAD) is complete which is indicated by the link being no
 	// longer marked as "tentative". This usually takes about a second.
@@ -208,20 +223,22 @@ func lease6(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	linkTimeout := time.After(linkUpAttempt)
 	for {
 		if ready, err := isIpv6LinkReady(iface); err != nil {
-			return nil, err
+			return err
 		} else if ready {
-			break
+			return nil
 		}
 		select {
 		case <-time.After(100 * time.Millisecond):
 			continue
 		case <-linkTimeout:
-			return nil, errors.New("timeout after waiting for a non-tentative IPv6 address")
+			return errors.New("timeout after waiting for a non-tentative IPv6 address")
 		case <-ctx.Done():
-			return nil, errors.New("timeout after waiting for a non-tentative IPv6 address")
+			return errors.New("timeout after waiting for a non-tentative IPv6 address")
 		}
 	}
+}
 
+func newClient6(iface netlink.Link, c Config) (*nclient6.Client, error) {
 	mods := []nclient6.ClientOpt{
 		nclient6.WithTimeout(c.Timeout),
 		nclient6.WithRetry(c.Retries),
@@ -235,20 +252,32 @@ func lease6(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	if c.V6ServerAddr != nil {
 		mods = append(mods, nclient6.WithBroadcastAddr(c.V6ServerAddr))
 	}
-	client, err := nclient6.New(iface.Attrs().Name, mods...)
+	return nclient6.New(iface.Attrs().Name, mods...)
+}
+
+// modifiers6 returns the modifiers of DHCPv6 requests.
+func (c Config) modifiers6() []dhcpv6.Modifier {
+	// Prepend modifiers with default options, so they can be overriden.
+	reqmods := []dhcpv6.Modifier{
+		dhcpv6.WithNetboot,
+	}
+	if c.HTTPBoot {
+		reqmods = append(reqmods, WithHTTPBoot6)
+	}
+	return append(reqmods, c.Modifiers6...)
+}
+
+func lease6(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+	if err := waitIPv6LinkReady(ctx, iface); err != nil {
+		return nil, err
+	}
+	client, err := newClient6(iface, c)
 	if err != nil {
 		return nil, err
 	}
 
-	// Prepend modifiers with default options, so they can be overriden.
-	reqmods := append(
-		[]dhcpv6.Modifier{
-			dhcpv6.WithNetboot,
-		},
-		c.Modifiers6...)
-
 	log.Printf("Attempting to get DHCPv6 lease on %s", iface.Attrs().Name)
-	p, err := client.RapidSolicit(ctx, reqmods...)
+	p, err := client.RapidSolicit(ctx, c.modifiers6()...)
 	if err != nil {
 		return nil, err
 	}
@@ -277,7 +306,7 @@ func (n NetworkProtocol) String() string {
 	case NetBoth:
 		return "IPv4+IPv6"
 	}
-	return fmt.Sprintf("unknown network protocol (%#x)", n)
+	return fmt.Sprintf("unknown network protocol (%#x)", int(n))
 }
 
 // Result is the result of a particular DHCP attempt.
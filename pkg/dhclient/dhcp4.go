@@ -78,9 +78,27 @@ func (p *Packet4) Configure() error {
 		return fmt.Errorf("add/replace %s to %v: %v", dst, p.iface, err)
 	}
 
+	for _, r := range p.routes() {
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("%s: add %s: %v", p.iface.Attrs().Name, r, err)
+		}
+	}
+
+	nameServers, searchList, domain := p.GatherDNSSettings()
+	if err := WriteDNSSettings(nameServers, searchList, domain); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// routes returns the routes of the lease: its classless static routes, or
+// a default route through its first router.
+func (p *Packet4) routes() []*netlink.Route {
 	// RFC 3442 notes that if classless static routes are available, they
 	// have priority. You have to ignore the Route Option.
 	if routes := p.P.ClasslessStaticRoute(); routes != nil {
+		var rs []*netlink.Route
 		for _, route := range routes {
 			r := &netlink.Route{
 				LinkIndex: p.iface.Attrs().Index,
@@ -91,27 +109,16 @@ func (p *Packet4) Configure() error {
 			if r.Gw == nil || r.Gw.Equal(net.IPv4zero) {
 				r.Scope = netlink.SCOPE_LINK
 			}
-
-			if err := netlink.RouteReplace(r); err != nil {
-				return fmt.Errorf("%s: add %s: %v", p.iface.Attrs().Name, r, err)
-			}
+			rs = append(rs, r)
 		}
-	} else if gw := p.P.Router(); len(gw) > 0 {
-		r := &netlink.Route{
+		return rs
+	}
+	if gw := p.P.Router(); len(gw) > 0 {
+		return []*netlink.Route{{
 			LinkIndex: p.iface.Attrs().Index,
 			Gw:        gw[0],
-		}
-
-		if err := netlink.RouteReplace(r); err != nil {
-			return fmt.Errorf("%s: add %s: %v", p.iface.Attrs().Name, r, err)
-		}
-	}
-
-	nameServers, searchList, domain := p.GatherDNSSettings()
-	if err := WriteDNSSettings(nameServers, searchList, domain); err != nil {
-		return err
+		}}
 	}
-
 	return nil
 }
 
@@ -143,6 +150,8 @@ var (
 )
 
 // Boot returns the boot file assigned.
+//
+// The boot file of an HTTP Boot lease must be an HTTP or HTTPS URL.
 func (p *Packet4) Boot() (*url.URL, error) {
 	// Look for dhcp option presence first, then legacy BootFileName in header.
 	bootFileName := p.P.BootFileNameOption()
@@ -159,6 +168,9 @@ func (p *Packet4) Boot() (*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
+	if p.HTTPBoot() {
+		return checkHTTPBootURL(u)
+	}
 
 	if len(u.Scheme) == 0 {
 		// Defaults to tftp is not specified.
@@ -180,15 +192,15 @@ func (p *Packet4) Boot() (*url.URL, error) {
 	return u, nil
 }
 
-// ISCSIBoot returns the target address and volume name to boot from if
+// ISCSIBoot returns the target address, LUN and volume name to boot from if
 // they were part of the DHCP message.
 //
 // Parses the IPv4 DHCP Root Path for iSCSI target and volume as specified by
 // RFC 4173.
-func (p *Packet4) ISCSIBoot() (*net.TCPAddr, string, error) {
+func (p *Packet4) ISCSIBoot() (*net.TCPAddr, uint64, string, error) {
 	rp := p.P.RootPath()
 	if len(rp) == 0 {
-		return nil, "", fmt.Errorf("no root path in DHCP message")
+		return nil, 0, "", fmt.Errorf("no root path in DHCP message")
 	}
 	return parseISCSIURI(rp)
 }
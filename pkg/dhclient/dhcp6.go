@@ -102,6 +102,26 @@ func (p *Packet6) Lease() *dhcpv6.OptIAAddress {
 	return iaAddr
 }
 
+// DelegatedPrefixes returns the prefixes delegated to the client, RFC 3633.
+func (p *Packet6) DelegatedPrefixes() []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, o := range p.p.GetOption(dhcpv6.OptionIAPD) {
+		pd, ok := o.(*dhcpv6.OptIAForPrefixDelegation)
+		if !ok {
+			continue
+		}
+		for _, po := range pd.Options.Get(dhcpv6.OptionIAPrefix) {
+			if prefix, ok := po.(*dhcpv6.OptIAPrefix); ok {
+				prefixes = append(prefixes, &net.IPNet{
+					IP:   prefix.IPv6Prefix(),
+					Mask: net.CIDRMask(int(prefix.PrefixLength()), 128),
+				})
+			}
+		}
+	}
+	return prefixes
+}
+
 // DNS returns DNS servers assigned.
 func (p *Packet6) DNS() []net.IP {
 	// TODO: Would the IANA contain this, or the packet?
@@ -125,19 +145,26 @@ func (p *Packet6) Boot() (*url.URL, error) {
 		return nil, fmt.Errorf("packet does not contain boot file URL")
 	}
 	// Srsly, a []byte?
-	return url.Parse(string(uri.ToBytes()))
+	u, err := url.Parse(string(uri.ToBytes()))
+	if err != nil {
+		return nil, err
+	}
+	if p.HTTPBoot() {
+		return checkHTTPBootURL(u)
+	}
+	return u, nil
 }
 
-// ISCSIBoot returns the target address and volume name to boot from if
+// ISCSIBoot returns the target address, LUN and volume name to boot from if
 // they were part of the DHCP message.
 //
 // Parses the DHCPv6 Boot File for iSCSI target and volume as specified by RFC
 // 4173 and RFC 5970.
-func (p *Packet6) ISCSIBoot() (*net.TCPAddr, string, error) {
+func (p *Packet6) ISCSIBoot() (*net.TCPAddr, uint64, string, error) {
 	uriOpt := p.p.GetOneOption(dhcpv6.OptionBootfileURL)
 	uri, ok := uriOpt.(dhcpv6.OptBootFileURL)
 	if !ok {
-		return nil, "", fmt.Errorf("packet does not contain boot file URL")
+		return nil, 0, "", fmt.Errorf("packet does not contain boot file URL")
 	}
 	return parseISCSIURI(string(uri.ToBytes()))
 }
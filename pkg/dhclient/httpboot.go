@@ -0,0 +1,101 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// httpClientClass is the vendor class of UEFI HTTP Boot clients and of the
+// DHCP servers answering them, see UEFI 2.8 Section 24.7.
+const httpClientClass = "HTTPClient"
+
+// httpClientEnterprise is the enterprise number of the DHCPv6 vendor class
+// of HTTP Boot clients.
+const httpClientEnterprise = 343
+
+// httpBootArch maps GOARCH to the HTTP Boot client system architecture
+// types registered with IANA.
+var httpBootArch = map[string]iana.Arch{
+	"386":   0x0f,
+	"amd64": 0x10,
+	"arm":   0x12,
+	"arm64": 0x13,
+}
+
+// ErrNoHTTPBootURL means an HTTP Boot server answered with a boot file that
+// is not an HTTP(S) URL.
+var ErrNoHTTPBootURL = errors.New("HTTP Boot response has no HTTP or HTTPS boot file URL")
+
+// httpBootArchType returns the HTTP Boot architecture type of this machine.
+func httpBootArchType() iana.Arch {
+	if a, ok := httpBootArch[runtime.GOARCH]; ok {
+		return a
+	}
+	return httpBootArch["amd64"]
+}
+
+// httpClientID is the vendor class identifier of HTTP Boot requests,
+// "HTTPClient:Arch:xxxxx:UNDI:yyyzzz".
+func httpClientID() string {
+	// UNDI version 3.16.
+	return fmt.Sprintf("%s:Arch:%05d:UNDI:003016", httpClientClass, httpBootArchType())
+}
+
+// WithHTTPBoot4 makes a DHCPv4 request a UEFI HTTP Boot request.
+func WithHTTPBoot4(d *dhcpv4.DHCPv4) {
+	d.UpdateOption(dhcpv4.OptClassIdentifier(httpClientID()))
+	d.UpdateOption(dhcpv4.OptClientArch(httpBootArchType()))
+}
+
+// WithHTTPBoot6 makes a DHCPv6 request a UEFI HTTP Boot request.
+func WithHTTPBoot6(d dhcpv6.DHCPv6) {
+	d.UpdateOption(&dhcpv6.OptVendorClass{
+		EnterpriseNumber: httpClientEnterprise,
+		Data:             [][]byte{[]byte(httpClientID())},
+	})
+	d.UpdateOption(&dhcpv6.OptClientArchType{ArchTypes: []iana.Arch{httpBootArchType()}})
+}
+
+// HTTPBoot returns whether the lease answers an HTTP Boot request, i.e.
+// whether the server identified itself with the HTTPClient vendor class.
+func (p *Packet4) HTTPBoot() bool {
+	return strings.HasPrefix(p.P.ClassIdentifier(), httpClientClass)
+}
+
+// HTTPBoot returns whether the lease answers an HTTP Boot request, i.e.
+// whether the server identified itself with the HTTPClient vendor class.
+func (p *Packet6) HTTPBoot() bool {
+	vc, ok := p.p.GetOneOption(dhcpv6.OptionVendorClass).(*dhcpv6.OptVendorClass)
+	if !ok {
+		return false
+	}
+	for _, d := range vc.Data {
+		if strings.HasPrefix(string(d), httpClientClass) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHTTPBootURL returns u if it is an absolute HTTP(S) URL, as HTTP Boot
+// requires.
+func checkHTTPBootURL(u *url.URL) (*url.URL, error) {
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if len(u.Host) > 0 {
+			return u, nil
+		}
+	}
+	return nil, ErrNoHTTPBootURL
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestHTTPBootRequest(t *testing.T) {
+	m4 := mustNew(t, WithHTTPBoot4)
+	if got := m4.ClassIdentifier(); !strings.HasPrefix(got, "HTTPClient:Arch:000") || !strings.HasSuffix(got, ":UNDI:003016") {
+		t.Errorf("DHCPv4 class identifier = %q", got)
+	}
+	if got := m4.ClientArch(); len(got) != 1 || got[0] != httpBootArchType() {
+		t.Errorf("DHCPv4 client arch = %v, want %v", got, httpBootArchType())
+	}
+
+	m6, err := dhcpv6.NewMessage(WithHTTPBoot6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc, ok := m6.GetOneOption(dhcpv6.OptionVendorClass).(*dhcpv6.OptVendorClass)
+	if !ok || vc.EnterpriseNumber != httpClientEnterprise || len(vc.Data) != 1 || string(vc.Data[0]) != httpClientID() {
+		t.Errorf("DHCPv6 vendor class = %v", m6.GetOneOption(dhcpv6.OptionVendorClass))
+	}
+	if m6.GetOneOption(dhcpv6.OptionClientArchType) == nil {
+		t.Errorf("DHCPv6 request has no client architecture")
+	}
+}
+
+func TestHTTPBoot4(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mods     []dhcpv4.Modifier
+		httpBoot bool
+		want     string
+		err      error
+	}{
+		{
+			name:     "iso",
+			mods:     []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClassIdentifier("HTTPClient")), withNetbootInfo("http://10.0.0.1/boot.iso", "")},
+			httpBoot: true,
+			want:     "http://10.0.0.1/boot.iso",
+		},
+		{
+			name:     "relative",
+			mods:     []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClassIdentifier("HTTPClient")), withNetbootInfo("boot.iso", "10.0.0.1")},
+			httpBoot: true,
+			err:      ErrNoHTTPBootURL,
+		},
+		{
+			name: "pxe",
+			mods: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")), withNetbootInfo("pxelinux.0", "10.0.0.1")},
+			want: "tftp://10.0.0.1/pxelinux.0",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPacket4(nil, mustNew(t, tt.mods...))
+			if got := p.HTTPBoot(); got != tt.httpBoot {
+				t.Errorf("HTTPBoot() = %v, want %v", got, tt.httpBoot)
+			}
+			u, err := p.Boot()
+			if err != tt.err {
+				t.Fatalf("Boot() = %v, want %v", err, tt.err)
+			}
+			if err == nil && u.String() != tt.want {
+				t.Errorf("Boot() = %s, want %s", u, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPBoot6(t *testing.T) {
+	m, err := dhcpv6.NewMessage(func(d dhcpv6.DHCPv6) {
+		d.AddOption(&dhcpv6.OptVendorClass{EnterpriseNumber: httpClientEnterprise, Data: [][]byte{[]byte("HTTPClient")}})
+		d.AddOption(dhcpv6.OptBootFileURL("http://[fe80::1]/boot.iso"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPacket6(nil, m)
+	if !p.HTTPBoot() {
+		t.Errorf("HTTPBoot() = false, want true")
+	}
+	if u, err := p.Boot(); err != nil || u.String() != "http://[fe80::1]/boot.iso" {
+		t.Errorf("Boot() = %v, %v, want http://[fe80::1]/boot.iso", u, err)
+	}
+}
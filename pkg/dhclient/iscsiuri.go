@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 type iscsiURIParser struct {
@@ -61,13 +62,17 @@ const (
 // "<servername>" may contain an IPv6 address enclosed with [] with an
 // arbitrary but bounded number of colons.
 //
+// "<LUN>" is a hexadecimal number, optionally split into groups by dashes,
+// and 0 if empty.
+//
 // "<targetname>" may contain an arbitrary string with an arbitrary number of
 // colons.
-func parseISCSIURI(s string) (*net.TCPAddr, string, error) {
+func parseISCSIURI(s string) (*net.TCPAddr, uint64, string, error) {
 	var (
 		// port has a default value according to RFC 4173.
 		port   = 3260
 		ip     net.IP
+		lun    uint64
 		volume string
 		magic  string
 	)
@@ -83,34 +88,42 @@ func parseISCSIURI(s string) (*net.TCPAddr, string, error) {
 			magic = tok
 		case serverField:
 			ip = net.ParseIP(tok)
-		case protField, lunField:
+		case protField:
 			// yeah whatever
 			continue
 		case portField:
 			if len(tok) > 0 {
 				pv, err := strconv.Atoi(tok)
 				if err != nil {
-					return nil, "", fmt.Errorf("iSCSI URI %q has invalid port: %v", s, err)
+					return nil, 0, "", fmt.Errorf("iSCSI URI %q has invalid port: %v", s, err)
 				}
 				port = pv
 			}
+		case lunField:
+			if len(tok) > 0 {
+				lv, err := strconv.ParseUint(strings.Replace(tok, "-", "", -1), 16, 64)
+				if err != nil {
+					return nil, 0, "", fmt.Errorf("iSCSI URI %q has invalid LUN: %v", s, err)
+				}
+				lun = lv
+			}
 		case volumeField:
 			volume = tok
 		}
 	}
 	if i.err != nil {
-		return nil, "", fmt.Errorf("iSCSI URI %q failed to parse: %v", s, i.err)
+		return nil, 0, "", fmt.Errorf("iSCSI URI %q failed to parse: %v", s, i.err)
 	}
 	if magic != "iscsi" {
-		return nil, "", fmt.Errorf("iSCSI URI %q is missing iscsi scheme prefix, have %s", s, magic)
+		return nil, 0, "", fmt.Errorf("iSCSI URI %q is missing iscsi scheme prefix, have %s", s, magic)
 	}
 	if len(volume) == 0 {
-		return nil, "", fmt.Errorf("iSCSI URI %q is missing a volume name", s)
+		return nil, 0, "", fmt.Errorf("iSCSI URI %q is missing a volume name", s)
 	}
 	return &net.TCPAddr{
 		IP:   ip,
 		Port: port,
-	}, volume, nil
+	}, lun, volume, nil
 }
 
 func (i *iscsiURIParser) next() (iscsiField, string) {
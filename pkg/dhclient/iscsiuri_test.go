@@ -14,6 +14,7 @@ func TestParseURI(t *testing.T) {
 	for _, tt := range []struct {
 		uri    string
 		target *net.TCPAddr
+		lun    uint64
 		volume string
 		want   string
 	}{
@@ -57,6 +58,18 @@ func TestParseURI(t *testing.T) {
 			target: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 3260},
 			volume: "iqn.com.google::::",
 		},
+		{
+			uri:    "iscsi:192.168.1.1::3260:1:iqn.com.google:esxi-boot-image",
+			target: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 3260},
+			lun:    1,
+			volume: "iqn.com.google:esxi-boot-image",
+		},
+		{
+			uri:    "iscsi:192.168.1.1:::4752-3A4F-6b7e-2F99:iqn.com.google:esxi-boot-image",
+			target: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 3260},
+			lun:    0x47523a4f6b7e2f99,
+			volume: "iqn.com.google:esxi-boot-image",
+		},
 		{
 			uri:  "iscsi:192.168.1.1::::",
 			want: "iSCSI URI \"iscsi:192.168.1.1::::\" is missing a volume name",
@@ -77,15 +90,22 @@ func TestParseURI(t *testing.T) {
 			uri:  "iscsi:192.168.1.1::foobar::volume",
 			want: "iSCSI URI \"iscsi:192.168.1.1::foobar::volume\" has invalid port: strconv.Atoi: parsing \"foobar\": invalid syntax",
 		},
+		{
+			uri:  "iscsi:192.168.1.1:::lun:volume",
+			want: "iSCSI URI \"iscsi:192.168.1.1:::lun:volume\" has invalid LUN: strconv.ParseUint: parsing \"lun\": invalid syntax",
+		},
 		{
 			uri:  "iscsi:[fe80::1::::",
 			want: "iSCSI URI \"iscsi:[fe80::1::::\" failed to parse: invalid IPv6 address",
 		},
 	} {
-		gtarget, gvolume, got := parseISCSIURI(tt.uri)
+		gtarget, glun, gvolume, got := parseISCSIURI(tt.uri)
 		if (got != nil && got.Error() != tt.want) || (got == nil && len(tt.want) > 0) {
 			t.Errorf("parseISCSIURI(%s) = %v, want %v", tt.uri, got, tt.want)
 		}
+		if glun != tt.lun {
+			t.Errorf("parseISCSIURI(%s) = LUN %d, want %d", tt.uri, glun, tt.lun)
+		}
 		if gvolume != tt.volume {
 			t.Errorf("parseISCSIURI(%s) = volume %s, want %s", tt.uri, gvolume, tt.volume)
 		}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 	"unicode"
 )
 
@@ -67,6 +68,93 @@ func (n *Node) Walk(f func(*Node) error) error {
 	return nil
 }
 
+// Child returns the child node with the given name. If name has no unit
+// address, it also matches a child whose name without unit address is name.
+func (n *Node) Child(name string) (*Node, bool) {
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child, true
+		}
+	}
+	if strings.Contains(name, "@") {
+		return nil, false
+	}
+	for _, child := range n.Children {
+		if i := strings.IndexByte(child.Name, '@'); i >= 0 && child.Name[:i] == name {
+			return child, true
+		}
+	}
+	return nil, false
+}
+
+// Lookup returns the descendant of n at the slash-separated path, e.g.
+// "/images/kernel@1". Paths are relative to n, a leading slash is ignored.
+func (n *Node) Lookup(path string) (*Node, bool) {
+	node := n
+	for _, name := range strings.Split(path, "/") {
+		if len(name) == 0 {
+			continue
+		}
+		child, ok := node.Child(name)
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
+}
+
+// LookProperty returns the property with the given name.
+func (n *Node) LookProperty(name string) (*Property, bool) {
+	for i := range n.Properties {
+		if n.Properties[i].Name == name {
+			return &n.Properties[i], true
+		}
+	}
+	return nil, false
+}
+
+// UpdateProperty replaces the property with the same name as p, or adds p if
+// there is none.
+func (n *Node) UpdateProperty(p Property) {
+	if old, ok := n.LookProperty(p.Name); ok {
+		old.Value = p.Value
+		return
+	}
+	n.Properties = append(n.Properties, p)
+}
+
+// RemoveProperty removes the property with the given name. It returns false
+// if there was none.
+func (n *Node) RemoveProperty(name string) bool {
+	for i, p := range n.Properties {
+		if p.Name == name {
+			n.Properties = append(n.Properties[:i], n.Properties[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// PropertyString returns a <string> property.
+func PropertyString(name, value string) Property {
+	return Property{Name: name, Value: append([]byte(value), 0)}
+}
+
+// PropertyU32 returns a <u32> property.
+func PropertyU32(name string, value uint32) Property {
+	p := Property{Name: name, Value: make([]byte, 4)}
+	binary.BigEndian.PutUint32(p.Value, value)
+	return p
+}
+
+// PropertyU64 returns a <u64> property.
+func PropertyU64(name string, value uint64) Property {
+	p := Property{Name: name, Value: make([]byte, 8)}
+	binary.BigEndian.PutUint64(p.Value, value)
+	return p
+}
+
 // Property is a name-value pair. Note the PropertyType of Value is not
 // encoded.
 type Property struct {
@@ -194,7 +282,7 @@ func (p *Property) AsStringList() ([]string, error) {
 	}
 	value := p.Value
 	strs := []string{}
-	for len(p.Value) > 0 {
+	for len(value) > 0 {
 		nextNull := bytes.IndexByte(value, 0) // cannot be -1
 		var str []byte
 		str, value = value[:nextNull], value[nextNull+1:]
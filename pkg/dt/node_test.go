@@ -0,0 +1,128 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dt
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	f, err := os.Open("testdata/fdt.dtb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fdt, err := ReadFDT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/", ""},
+		{"/chosen", "chosen"},
+		{"chosen", "chosen"},
+		{"/cpus/cpu@0", "cpu@0"},
+		{"/cpus/cpu", "cpu@0"},
+		{"/intc/v2m@8020000", "v2m@8020000"},
+		{"/cpus/cpu@1", ""},
+		{"/nonexistent", ""},
+		{"/pl011@9000001", ""},
+	} {
+		n, ok := fdt.RootNode.Lookup(tt.path)
+		if len(tt.want) == 0 && tt.path != "/" {
+			if ok {
+				t.Errorf("Lookup(%q) = %q, want none", tt.path, n.Name)
+			}
+			continue
+		}
+		if !ok || n.Name != tt.want {
+			t.Errorf("Lookup(%q) = %v, %v, want %q", tt.path, n, ok, tt.want)
+		}
+	}
+}
+
+func TestUpdateProperty(t *testing.T) {
+	n := &Node{
+		Name: "chosen",
+		Properties: []Property{
+			PropertyU32("linux,initrd-start", 0x44000000),
+			PropertyU32("linux,initrd-end", 0x44cb8fc4),
+		},
+	}
+	n.UpdateProperty(PropertyString("bootargs", "console=ttyAMA0"))
+	n.UpdateProperty(PropertyU64("linux,initrd-start", 0x48000000))
+	if !n.RemoveProperty("linux,initrd-end") {
+		t.Errorf("RemoveProperty(linux,initrd-end) = false, want true")
+	}
+	if n.RemoveProperty("linux,initrd-end") {
+		t.Errorf("RemoveProperty(linux,initrd-end) = true after removing it")
+	}
+
+	want := []Property{
+		{Name: "linux,initrd-start", Value: []byte{0, 0, 0, 0, 0x48, 0, 0, 0}},
+		{Name: "bootargs", Value: []byte("console=ttyAMA0\x00")},
+	}
+	if !reflect.DeepEqual(n.Properties, want) {
+		t.Errorf("properties = %v, want %v", n.Properties, want)
+	}
+
+	p, ok := n.LookProperty("bootargs")
+	if !ok {
+		t.Fatalf("LookProperty(bootargs) not found")
+	}
+	if s, err := p.AsString(); err != nil || s != "console=ttyAMA0" {
+		t.Errorf("AsString() = %q, %v, want console=ttyAMA0", s, err)
+	}
+	if v, err := n.Properties[0].AsU64(); err != nil || v != 0x48000000 {
+		t.Errorf("AsU64() = %#x, %v, want 0x48000000", v, err)
+	}
+}
+
+func TestAsStringList(t *testing.T) {
+	p := Property{Name: "compatible", Value: []byte("arm,pl011\x00arm,primecell\x00")}
+	got, err := p.AsStringList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"arm,pl011", "arm,primecell"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AsStringList() = %q, want %q", got, want)
+	}
+}
+
+func TestWriteModified(t *testing.T) {
+	f, err := os.Open("testdata/fdt.dtb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fdt, err := ReadFDT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chosen, _ := fdt.RootNode.Lookup("/chosen")
+	chosen.UpdateProperty(PropertyString("bootargs", "earlycon"))
+
+	var b bytes.Buffer
+	if _, err := fdt.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	fdt2, err := ReadFDT(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chosen2, ok := fdt2.RootNode.Lookup("/chosen")
+	if !ok {
+		t.Fatal("no /chosen after writing")
+	}
+	if !reflect.DeepEqual(chosen, chosen2) {
+		t.Errorf("/chosen = %v, want %v", chosen2, chosen)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// dirent is a directory entry.
+type dirent struct {
+	ino  uint32
+	name string
+}
+
+// parseDirents appends the entries of the linear directory block b to
+// entries. Entries with inode 0 are unused, or hold the htree index or the
+// checksum of the block.
+func (fs *FS) parseDirents(entries []dirent, b []byte) ([]dirent, error) {
+	for off := 0; off < len(b); {
+		if off+8 > len(b) {
+			return nil, fmt.Errorf("directory entry at %d of %d byte block", off, len(b))
+		}
+		ino := binary.LittleEndian.Uint32(b[off:])
+		recLen := int(binary.LittleEndian.Uint16(b[off+4:]))
+		// Blocks of 64KiB encode their size as 0 or 65535.
+		if fs.blockSize == 1<<16 && (recLen == 0 || recLen == 1<<16-1) {
+			recLen = 1 << 16
+		}
+		nameLen := int(b[off+6])
+		if fs.sb.featureIncompat&incompatFiletype == 0 {
+			nameLen = int(binary.LittleEndian.Uint16(b[off+6:]))
+		}
+		if recLen < 8 || off+recLen > len(b) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("invalid directory entry at %d: length %d, name length %d", off, recLen, nameLen)
+		}
+		if ino != 0 {
+			entries = append(entries, dirent{ino: ino, name: string(b[off+8 : off+8+nameLen])})
+		}
+		off += recLen
+	}
+	return entries, nil
+}
+
+// readDir returns the entries of directory i.
+func (fs *FS) readDir(i *inode) ([]dirent, error) {
+	if i.flags&inodeFlagInlineData != 0 {
+		// Inline directories start with the inode of the parent, and
+		// have entries in i_block and in system.data.
+		a, b, err := i.inlineData()
+		if err != nil {
+			return nil, err
+		}
+		entries := []dirent{{ino: i.num, name: "."}, {ino: binary.LittleEndian.Uint32(a), name: ".."}}
+		if entries, err = fs.parseDirents(entries, a[4:]); err != nil {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+		if entries, err = fs.parseDirents(entries, b); err != nil {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+		return entries, nil
+	}
+
+	m, err := fs.mapping(i)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirent
+	b := make([]byte, fs.blockSize)
+	for off := int64(0); off < i.size; off += fs.blockSize {
+		n, err := fs.readData(m, i.size, b, off)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+		if entries, err = fs.parseDirents(entries, b[:n]); err != nil {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+	}
+	return entries, nil
+}
+
+// find returns the inode number of name in directory dir.
+func (fs *FS) find(dir *inode, name string) (uint32, error) {
+	entries, err := fs.readDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.name == name || (dir.flags&inodeFlagCasefold != 0 && strings.EqualFold(e.name, name)) {
+			return e.ino, nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
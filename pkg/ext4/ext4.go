@@ -0,0 +1,418 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ext4 reads ext2, ext3 and ext4 file systems in userspace.
+//
+// It is for kernels built without ext4, which still need to read boot
+// configurations and kernels from ext4 disks. Files are read-only and the
+// journal is not replayed, so a file system that was not cleanly unmounted
+// may look older than it is.
+//
+// Extents, block maps, hashed (htree) directories, inline data, fast and
+// slow symlinks and the 64bit feature are supported. Hashed directories are
+// read through their leaf blocks, which hold every entry; index blocks look
+// like empty entries to a linear scan.
+//
+// Names are slash separated paths from the root of the file system, like
+// boot/grub/grub.cfg. A leading slash is allowed.
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+const (
+	superblockOff  = 1024
+	superblockSize = 1024
+	magic          = 0xef53
+	rootIno        = 2
+
+	// maxSymlinks is the number of symlinks a path lookup follows, as
+	// in Linux.
+	maxSymlinks = 40
+)
+
+// Incompatible features. Without support for all of them, a file system
+// cannot be read.
+const (
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatRecover     = 0x4
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompatExtents     = 0x40
+	incompat64bit       = 0x80
+	incompatMMP         = 0x100
+	incompatFlexBG      = 0x200
+	incompatEAInode     = 0x400
+	incompatDirData     = 0x1000
+	incompatCsumSeed    = 0x2000
+	incompatLargeDir    = 0x4000
+	incompatInlineData  = 0x8000
+	incompatEncrypt     = 0x10000
+	incompatCasefold    = 0x20000
+
+	incompatSupported = incompatFiletype | incompatRecover | incompatMetaBG | incompatExtents |
+		incompat64bit | incompatMMP | incompatFlexBG | incompatEAInode | incompatCsumSeed |
+		incompatLargeDir | incompatInlineData | incompatEncrypt | incompatCasefold
+
+	roCompatSparseSuper = 0x1
+)
+
+var (
+	// ErrNotExt4 is returned by Open for anything but ext2, ext3 and
+	// ext4 file systems.
+	ErrNotExt4 = errors.New("not an ext2, ext3 or ext4 file system")
+)
+
+type superblock struct {
+	inodesCount     uint32
+	blocksCount     uint64
+	firstDataBlock  uint32
+	logBlockSize    uint32
+	blocksPerGroup  uint32
+	inodesPerGroup  uint32
+	revLevel        uint32
+	inodeSize       uint16
+	featureCompat   uint32
+	featureIncompat uint32
+	featureROCompat uint32
+	uuid            [16]byte
+	volumeName      [16]byte
+	descSize        uint16
+	firstMetaBG     uint32
+}
+
+// FS is a read-only ext2, ext3 or ext4 file system.
+type FS struct {
+	r         io.ReaderAt
+	sb        superblock
+	blockSize int64
+	descSize  int64
+	groups    uint64
+}
+
+// Open reads the superblock of the file system in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	b := make([]byte, superblockSize)
+	if _, err := r.ReadAt(b, superblockOff); err != nil {
+		return nil, fmt.Errorf("reading superblock: %v", err)
+	}
+	if binary.LittleEndian.Uint16(b[0x38:]) != magic {
+		return nil, ErrNotExt4
+	}
+	le16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+	le32 := func(off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+	sb := superblock{
+		inodesCount:     le32(0x0),
+		blocksCount:     uint64(le32(0x4)),
+		firstDataBlock:  le32(0x14),
+		logBlockSize:    le32(0x18),
+		blocksPerGroup:  le32(0x20),
+		inodesPerGroup:  le32(0x28),
+		revLevel:        le32(0x4c),
+		inodeSize:       128,
+		featureCompat:   le32(0x5c),
+		featureIncompat: le32(0x60),
+		featureROCompat: le32(0x64),
+		descSize:        32,
+		firstMetaBG:     le32(0x104),
+	}
+	copy(sb.uuid[:], b[0x68:])
+	copy(sb.volumeName[:], b[0x78:])
+	if sb.revLevel > 0 {
+		sb.inodeSize = le16(0x58)
+	}
+	if sb.featureIncompat&incompat64bit != 0 {
+		sb.blocksCount |= uint64(le32(0x150)) << 32
+		if d := le16(0xfe); d != 0 {
+			sb.descSize = d
+		}
+	}
+
+	if unsupported := sb.featureIncompat &^ incompatSupported; unsupported != 0 {
+		return nil, fmt.Errorf("unsupported incompatible features %#x", unsupported)
+	}
+	switch {
+	case sb.logBlockSize > 6:
+		return nil, fmt.Errorf("invalid block size 2^(10+%d)", sb.logBlockSize)
+	case sb.blocksPerGroup == 0 || sb.inodesPerGroup == 0:
+		return nil, fmt.Errorf("invalid blocks (%d) or inodes (%d) per group", sb.blocksPerGroup, sb.inodesPerGroup)
+	case sb.inodeSize < 128 || sb.inodeSize&(sb.inodeSize-1) != 0:
+		return nil, fmt.Errorf("invalid inode size %d", sb.inodeSize)
+	case sb.descSize < 32 || sb.descSize&(sb.descSize-1) != 0:
+		return nil, fmt.Errorf("invalid group descriptor size %d", sb.descSize)
+	case sb.blocksCount <= uint64(sb.firstDataBlock) || sb.blocksCount > math.MaxInt64>>(10+sb.logBlockSize):
+		return nil, fmt.Errorf("invalid block count %d", sb.blocksCount)
+	}
+
+	fs := &FS{
+		r:         r,
+		sb:        sb,
+		blockSize: 1024 << sb.logBlockSize,
+		descSize:  int64(sb.descSize),
+	}
+	fs.groups = (sb.blocksCount - uint64(sb.firstDataBlock) + uint64(sb.blocksPerGroup) - 1) / uint64(sb.blocksPerGroup)
+	// Sizes read from disk are bounded by the size of the file system,
+	// so it must fit on the device.
+	if err := fs.readAt(make([]byte, 1), fs.size()-1); err != nil {
+		return nil, fmt.Errorf("file system of %d bytes does not fit on the device: %v", fs.size(), err)
+	}
+	return fs, nil
+}
+
+// size returns the size of the file system in bytes.
+func (fs *FS) size() int64 {
+	return int64(fs.sb.blocksCount) * fs.blockSize
+}
+
+// Label returns the volume label.
+func (fs *FS) Label() string {
+	return strings.TrimRight(string(fs.sb.volumeName[:]), "\x00")
+}
+
+// UUID returns the file system UUID.
+func (fs *FS) UUID() string {
+	u := fs.sb.uuid
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// readAt reads exactly len(b) bytes at off.
+func (fs *FS) readAt(b []byte, off int64) error {
+	n, err := fs.r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readBlock reads block n.
+func (fs *FS) readBlock(n uint64) ([]byte, error) {
+	if n >= fs.sb.blocksCount {
+		return nil, fmt.Errorf("block %d beyond the end of the file system", n)
+	}
+	b := make([]byte, fs.blockSize)
+	return b, fs.readAt(b, int64(n)*fs.blockSize)
+}
+
+// hasSuper returns true if group g has a backup of the superblock and group
+// descriptors.
+func (fs *FS) hasSuper(g uint64) bool {
+	if g <= 1 || fs.sb.featureROCompat&roCompatSparseSuper == 0 {
+		return true
+	}
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// descriptorOff returns the offset of the descriptor of group g.
+func (fs *FS) descriptorOff(g uint64) int64 {
+	perBlock := uint64(fs.blockSize / fs.descSize)
+	first := uint64(fs.sb.firstDataBlock)
+	metaGroup := g / perBlock
+	block := first + 1 + metaGroup
+	// With meta_bg, descriptors from the first meta group on are in the
+	// first group of their meta group instead of after the superblock.
+	if fs.sb.featureIncompat&incompatMetaBG != 0 && metaGroup >= uint64(fs.sb.firstMetaBG) {
+		mg := metaGroup * perBlock
+		block = first + mg*uint64(fs.sb.blocksPerGroup)
+		if fs.hasSuper(mg) {
+			block++
+		}
+	}
+	return int64(block)*fs.blockSize + int64(g%perBlock)*fs.descSize
+}
+
+// inodeOff returns the offset of inode ino.
+func (fs *FS) inodeOff(ino uint32) (int64, error) {
+	if ino == 0 || ino > fs.sb.inodesCount {
+		return 0, fmt.Errorf("invalid inode number %d", ino)
+	}
+	g := uint64(ino-1) / uint64(fs.sb.inodesPerGroup)
+	if g >= fs.groups {
+		return 0, fmt.Errorf("inode %d in group %d beyond %d groups", ino, g, fs.groups)
+	}
+	d := make([]byte, fs.descSize)
+	if err := fs.readAt(d, fs.descriptorOff(g)); err != nil {
+		return 0, fmt.Errorf("reading descriptor of group %d: %v", g, err)
+	}
+	table := uint64(binary.LittleEndian.Uint32(d[0x8:]))
+	if fs.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(d[0x28:])) << 32
+	}
+	index := int64(uint64(ino-1) % uint64(fs.sb.inodesPerGroup))
+	return int64(table)*fs.blockSize + index*int64(fs.sb.inodeSize), nil
+}
+
+// lookup returns the inode of name. It follows symlinks in all but the last
+// component, and in the last one if follow is true.
+func (fs *FS) lookup(name string, follow bool) (*inode, error) {
+	root, err := fs.inode(rootIno)
+	if err != nil {
+		return nil, err
+	}
+	// dirs are the directories from the root to the current one, so ".."
+	// goes back physically even after symlinks.
+	dirs := []*inode{root}
+	rest := strings.Split(name, "/")
+	for links := 0; len(rest) > 0; {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+
+		dir := dirs[len(dirs)-1]
+		if !dir.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		ino, err := fs.find(dir, c)
+		if err != nil {
+			return nil, err
+		}
+		i, err := fs.inode(ino)
+		if err != nil {
+			return nil, err
+		}
+		if i.isSymlink() && (len(rest) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			target, err := fs.readlink(i)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(target, "/") {
+				dirs = dirs[:1]
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+			continue
+		}
+		dirs = append(dirs, i)
+	}
+	return dirs[len(dirs)-1], nil
+}
+
+// Open opens the file name for reading, following symlinks.
+func (fs *FS) Open(name string) (*File, error) {
+	i, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	m, err := fs.mapping(i)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &File{fs: fs, name: name, ino: i, m: m}, nil
+}
+
+// ReadFile returns the contents of the file name.
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.ino.isDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	// The size is not checked against the blocks of the file, as sparse
+	// files have holes.
+	if f.ino.size > fs.size() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EFBIG}
+	}
+	b := make([]byte, f.ino.size)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+// Stat returns a FileInfo describing the file name, following symlinks.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	i, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{name: path.Base(path.Clean("/" + name)), ino: i}, nil
+}
+
+// Lstat returns a FileInfo describing the file name. If it is a symlink, it
+// describes the symlink.
+func (fs *FS) Lstat(name string) (os.FileInfo, error) {
+	i, err := fs.lookup(name, false)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return &fileInfo{name: path.Base(path.Clean("/" + name)), ino: i}, nil
+}
+
+// Readlink returns the target of the symlink name.
+func (fs *FS) Readlink(name string) (string, error) {
+	i, err := fs.lookup(name, false)
+	if err == nil && !i.isSymlink() {
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	target, err := fs.readlink(i)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// ReadDir returns the entries of the directory name, without . and .., in
+// the order they are stored.
+func (fs *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	i, err := fs.lookup(name, true)
+	if err == nil && !i.isDir() {
+		err = syscall.ENOTDIR
+	}
+	var entries []dirent
+	if err == nil {
+		entries, err = fs.readDir(i)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var fis []os.FileInfo
+	for _, e := range entries {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		i, err := fs.inode(e.ino)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: path.Join(name, e.name), Err: err}
+		}
+		fis = append(fis, &fileInfo{name: e.name, ino: i})
+	}
+	return fis, nil
+}
@@ -0,0 +1,328 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ext4
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// The images are made by testdata/mkimages.sh. ext4.img has the 64bit and
+// inline_data features, 4KiB blocks and an indexed directory. ext2.img has
+// 1KiB blocks and block maps.
+var images = []string{"ext4.img", "ext2.img"}
+
+func readImage(t *testing.T, name string) []byte {
+	f, err := os.Open(filepath.Join("testdata", name+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func openImage(t *testing.T, name string) *FS {
+	fs, err := Open(bytes.NewReader(readImage(t, name)))
+	if err != nil {
+		t.Fatalf("Open(%s): got %v, want nil", name, err)
+	}
+	return fs
+}
+
+// pattern returns the contents of boot/vmlinuz.
+func pattern() []byte {
+	b := make([]byte, 300*1024)
+	for i := range b {
+		b[i] = byte(i%251 + 1)
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+	for _, tt := range []struct {
+		image, label, uuid string
+	}{
+		{"ext4.img", "ext4test", "6d1e0b9a-6f37-4f3c-9d4e-0d8a3c9e2a11"},
+		{"ext2.img", "ext2test", ""},
+	} {
+		fs := openImage(t, tt.image)
+		if got := fs.Label(); got != tt.label {
+			t.Errorf("%s: Label() = %q, want %q", tt.image, got, tt.label)
+		}
+		if got := fs.UUID(); tt.uuid != "" && got != tt.uuid {
+			t.Errorf("%s: UUID() = %q, want %q", tt.image, got, tt.uuid)
+		}
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 4096))); err != ErrNotExt4 {
+		t.Errorf("Open(zeros): got %v, want %v", err, ErrNotExt4)
+	}
+	if _, err := Open(bytes.NewReader(nil)); err == nil {
+		t.Errorf("Open(empty): got nil, want error")
+	}
+	b := readImage(t, "ext4.img")
+	if _, err := Open(bytes.NewReader(b[:len(b)/2])); err == nil {
+		t.Errorf("Open(truncated): got nil, want error")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	grub := "menuentry \"Linux\" {\n\tlinux /boot/vmlinuz root=/dev/sda1\n}\n"
+	sparse := make([]byte, 1048580)
+	copy(sparse, "head")
+	copy(sparse[1048576:], "tail")
+	for _, tt := range []struct {
+		name string
+		want []byte
+	}{
+		{"small", []byte("hello\n")},
+		{"/medium", []byte(strings.Repeat("0", 100))},
+		{"boot/grub/grub.cfg", []byte(grub)},
+		{"boot/vmlinuz", pattern()},
+		{"sparse", sparse},
+		{"many/file-with-a-long-name-123", []byte("123\n")},
+		{"inline/x", []byte("in\n")},
+		{"fast", []byte(grub)},
+		{"slow", []byte("deep\n")},
+		{"abs/grub/grub.cfg", []byte(grub)},
+		{"deep/a/up/deep/a/b/c", []byte("deep\n")},
+		{"deep/a/up/../boot/../small", []byte("hello\n")},
+		{"/../small", []byte("hello\n")},
+	} {
+		for _, image := range images {
+			fs := openImage(t, image)
+			got, err := fs.ReadFile(tt.name)
+			if err != nil {
+				t.Errorf("%s: ReadFile(%q): got %v, want nil", image, tt.name, err)
+				continue
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%s: ReadFile(%q): got %d bytes, want %d bytes %q", image, tt.name, len(got), len(tt.want), tt.want[:4])
+			}
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	fs := openImage(t, "ext4.img")
+	f, err := fs.Open("boot/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := pattern()
+
+	// Across the end of the first extent.
+	b := make([]byte, 100)
+	if n, err := f.ReadAt(b, 11*4096-50); n != len(b) || err != nil || !bytes.Equal(b, want[11*4096-50:11*4096+50]) {
+		t.Errorf("ReadAt(100, %d): got %d, %v, want 100, nil", 11*4096-50, n, err)
+	}
+	if n, err := f.ReadAt(b, int64(len(want)-10)); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at the end: got %d, %v, want 10, EOF", n, err)
+	}
+	if off, err := f.Seek(-20, io.SeekEnd); off != int64(len(want)-20) || err != nil {
+		t.Errorf("Seek(-20, SeekEnd): got %d, %v, want %d, nil", off, err, len(want)-20)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, want[len(want)-20:]) {
+		t.Errorf("ReadAll after Seek: got %v, %v, want %v, nil", rest, err, want[len(want)-20:])
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != int64(len(want)) || fi.Mode() != 0644 {
+		t.Errorf("Stat: got %v, %v, want size %d, mode 0644", fi, err, len(want))
+	}
+
+	d, err := fs.Open("boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read(b); err == nil {
+		t.Errorf("Read of directory: got nil, want error")
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	for _, image := range images {
+		fs := openImage(t, image)
+
+		fis, err := fs.ReadDir("many")
+		if err != nil {
+			t.Fatalf("%s: ReadDir(many): got %v, want nil", image, err)
+		}
+		var got []string
+		for _, fi := range fis {
+			got = append(got, fi.Name())
+		}
+		sort.Strings(got)
+		var want []string
+		for i := 1; i <= 400; i++ {
+			want = append(want, fmt.Sprintf("file-with-a-long-name-%d", i))
+		}
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: ReadDir(many): got %d entries, want %d", image, len(got), len(want))
+		}
+
+		fis, err = fs.ReadDir("/")
+		if err != nil {
+			t.Fatalf("%s: ReadDir(/): got %v, want nil", image, err)
+		}
+		modes := map[string]os.FileMode{}
+		for _, fi := range fis {
+			modes[fi.Name()] = fi.Mode()
+		}
+		for name, want := range map[string]os.FileMode{
+			"boot":   os.ModeDir | 0755,
+			"inline": os.ModeDir | 0755,
+			"small":  0644,
+			"fast":   os.ModeSymlink | 0777,
+			"slow":   os.ModeSymlink | 0777,
+		} {
+			if got, ok := modes[name]; !ok || got != want {
+				t.Errorf("%s: ReadDir(/): mode of %s is %v, want %v", image, name, got, want)
+			}
+		}
+
+		fis, err = fs.ReadDir("inline")
+		if err != nil || len(fis) != 1 || fis[0].Name() != "x" {
+			t.Errorf("%s: ReadDir(inline): got %v, %v, want [x], nil", image, fis, err)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	for _, image := range images {
+		fs := openImage(t, image)
+		for name, want := range map[string]string{
+			"fast":      "boot/grub/grub.cfg",
+			"slow":      "deep/a/b/../../../deep/a/b/../../../deep/a/b/../../../deep/a/b/c",
+			"abs":       "/boot",
+			"deep/a/up": "../..",
+		} {
+			if got, err := fs.Readlink(name); got != want || err != nil {
+				t.Errorf("%s: Readlink(%q): got %q, %v, want %q, nil", image, name, got, err, want)
+			}
+		}
+		if _, err := fs.Readlink("small"); err == nil {
+			t.Errorf("%s: Readlink(small): got nil, want error", image)
+		}
+
+		fi, err := fs.Stat("abs")
+		if err != nil || !fi.IsDir() {
+			t.Errorf("%s: Stat(abs): got %v, %v, want a directory", image, fi, err)
+		}
+		fi, err = fs.Lstat("abs")
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 || fi.Name() != "abs" {
+			t.Errorf("%s: Lstat(abs): got %v, %v, want a symlink", image, fi, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fs := openImage(t, "ext4.img")
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"nothing", os.ErrNotExist},
+		{"boot/nothing", os.ErrNotExist},
+		{"dangling", os.ErrNotExist},
+		{"small/x", syscall.ENOTDIR},
+		{"loop1", syscall.ELOOP},
+		{"loop1/x", syscall.ELOOP},
+	} {
+		_, err := fs.Open(tt.name)
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != tt.err {
+			t.Errorf("Open(%q): got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := fs.Lstat("dangling"); err != nil {
+		t.Errorf("Lstat(dangling): got %v, want nil", err)
+	}
+	if _, err := fs.ReadDir("small"); err == nil {
+		t.Errorf("ReadDir(small): got nil, want error")
+	}
+}
+
+func TestReadFileSize(t *testing.T) {
+	b := readImage(t, "ext4.img")
+	fs, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := fs.lookup("small", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := fs.inodeOff(i.num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim a size of 1 PiB.
+	binary.LittleEndian.PutUint32(b[off+0x6c:], 1<<18)
+	_, err = fs.ReadFile("small")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EFBIG {
+		t.Errorf("ReadFile(small): got %v, want %v", err, syscall.EFBIG)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	fs := openImage(t, "ext4.img")
+	dir, err := ioutil.TempDir("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := fs.Extract(dir, "boot", 1024); err != nil {
+		t.Fatalf("Extract(boot): got %v, want nil", err)
+	}
+	if err := fs.Extract(dir, "deep/a", 0); err != nil {
+		t.Fatalf("Extract(deep/a): got %v, want nil", err)
+	}
+	if err := fs.Extract(dir, "fast", 0); err != nil {
+		t.Fatalf("Extract(fast): got %v, want nil", err)
+	}
+	if err := fs.Extract(dir, "nothing", 0); !os.IsNotExist(err) {
+		t.Errorf("Extract(nothing): got %v, want a not exist error", err)
+	}
+
+	for name, want := range map[string]string{
+		"boot/grub/grub.cfg": "menuentry \"Linux\" {\n\tlinux /boot/vmlinuz root=/dev/sda1\n}\n",
+		"deep/a/b/c":         "deep\n",
+		"fast":               "menuentry \"Linux\" {\n\tlinux /boot/vmlinuz root=/dev/sda1\n}\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("Extracted %s: got %q, %v, want %q, nil", name, got, err, want)
+		}
+	}
+	// boot/vmlinuz is larger than 1024 bytes, and deep/a/up is a symlink
+	// to a directory.
+	for _, name := range []string{"boot/vmlinuz", "deep/a/up"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Extracted %s: got %v, want not to exist", name, err)
+		}
+	}
+}
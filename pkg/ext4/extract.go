@@ -0,0 +1,87 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ext4
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Extract copies the file or directory tree name to the same path under
+// dir, so that programs reading files can use it as if it was mounted
+// there. Symlinks are followed; those to directories inside a tree are
+// skipped, so that loops do not copy forever. Files larger than maxSize are
+// skipped, unless maxSize is 0.
+//
+// It returns an error for which os.IsNotExist is true if name does not
+// exist.
+func (fs *FS) Extract(dir, name string, maxSize int64) error {
+	name = path.Clean("/" + name)
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	// Create the parents of name.
+	if err := os.MkdirAll(filepath.Join(dir, path.Dir(name)), 0755); err != nil {
+		return err
+	}
+	return fs.extract(dir, name, fi, maxSize)
+}
+
+func (fs *FS) extract(dir, name string, fi os.FileInfo, maxSize int64) error {
+	dst := filepath.Join(dir, name)
+	switch {
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		fis, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			n := path.Join(name, fi.Name())
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = fs.Stat(n); err != nil || fi.IsDir() {
+					// Dangling symlinks may point to
+					// another file system.
+					continue
+				}
+			}
+			if err := fs.extract(dir, n, fi, maxSize); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		if maxSize > 0 && fi.Size() > maxSize {
+			return nil
+		}
+		return fs.copyFile(dst, name, fi.Mode().Perm())
+	default:
+		// Devices, pipes and sockets mean nothing without the
+		// system they belong to.
+		return nil
+	}
+}
+
+func (fs *FS) copyFile(dst, name string, perm os.FileMode) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,515 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	inodeFlagEncrypt    = 0x800
+	inodeFlagHugeFile   = 0x40000
+	inodeFlagExtents    = 0x80000
+	inodeFlagInlineData = 0x10000000
+	inodeFlagCasefold   = 0x40000000
+
+	modeTypeMask = 0xf000
+	modeFIFO     = 0x1000
+	modeChar     = 0x2000
+	modeDir      = 0x4000
+	modeBlock    = 0x6000
+	modeRegular  = 0x8000
+	modeSymlink  = 0xa000
+	modeSocket   = 0xc000
+
+	// iBlockSize is the size of i_block, which holds the block map, the
+	// extent tree root, a fast symlink or the start of inline data.
+	iBlockSize = 60
+
+	extentMagic = 0xf30a
+	// maxExtentDepth is the limit of extent trees in Linux.
+	maxExtentDepth = 5
+	// initMaxLen is the longest initialized extent. Longer extents are
+	// uninitialized, and read as zeros, with len-initMaxLen blocks.
+	initMaxLen = 32768
+
+	xattrMagic     = 0xea020000
+	xattrIndexData = 7
+)
+
+type inode struct {
+	num     uint32
+	mode    uint16
+	size    int64
+	mtime   int64
+	blocks  uint64
+	flags   uint32
+	fileACL uint64
+	iblock  [iBlockSize]byte
+	// extra is the part of the inode after the first 128 bytes, with
+	// extended attributes after i_extra_isize.
+	extra []byte
+}
+
+func (i *inode) isDir() bool {
+	return i.mode&modeTypeMask == modeDir
+}
+
+func (i *inode) isSymlink() bool {
+	return i.mode&modeTypeMask == modeSymlink
+}
+
+// inode reads inode ino.
+func (fs *FS) inode(ino uint32) (*inode, error) {
+	off, err := fs.inodeOff(ino)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fs.sb.inodeSize)
+	if err := fs.readAt(b, off); err != nil {
+		return nil, fmt.Errorf("reading inode %d: %v", ino, err)
+	}
+	le16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+	le32 := func(off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+	i := &inode{
+		num:     ino,
+		mode:    le16(0x0),
+		size:    int64(uint64(le32(0x4)) | uint64(le32(0x6c))<<32),
+		mtime:   int64(int32(le32(0x10))),
+		blocks:  uint64(le32(0x1c)) | uint64(le16(0x74))<<32,
+		flags:   le32(0x20),
+		fileACL: uint64(le32(0x68)) | uint64(le16(0x76))<<32,
+		extra:   b[128:],
+	}
+	copy(i.iblock[:], b[0x28:])
+	if i.size < 0 {
+		return nil, fmt.Errorf("inode %d: invalid size %d", ino, uint64(i.size))
+	}
+	// i_blocks counts 512 byte sectors, or blocks for huge files.
+	if i.flags&inodeFlagHugeFile != 0 {
+		i.blocks *= uint64(fs.blockSize / 512)
+	}
+	return i, nil
+}
+
+// xattr returns the value of the extended attribute in the inode with the
+// given name index and name. It does not look at the attribute block.
+func (i *inode) xattr(index uint8, name string) ([]byte, bool) {
+	if len(i.extra) < 2 {
+		return nil, false
+	}
+	isize := int(binary.LittleEndian.Uint16(i.extra))
+	if isize+4 > len(i.extra) || binary.LittleEndian.Uint32(i.extra[isize:]) != xattrMagic {
+		return nil, false
+	}
+	// Value offsets are relative to the first entry.
+	ea := i.extra[isize+4:]
+	for off := 0; off+16 <= len(ea) && binary.LittleEndian.Uint32(ea[off:]) != 0; {
+		nameLen := int(ea[off])
+		voff := int(binary.LittleEndian.Uint16(ea[off+2:]))
+		vsize := int(binary.LittleEndian.Uint32(ea[off+8:]))
+		if off+16+nameLen > len(ea) {
+			return nil, false
+		}
+		if ea[off+1] == index && string(ea[off+16:off+16+nameLen]) == name {
+			if voff+vsize > len(ea) {
+				return nil, false
+			}
+			return ea[voff : voff+vsize], true
+		}
+		off += (16 + nameLen + 3) &^ 3
+	}
+	return nil, false
+}
+
+// inlineData returns the two parts of inline data: the one in i_block and
+// the one in the system.data extended attribute.
+func (i *inode) inlineData() ([]byte, []byte, error) {
+	ea, ok := i.xattr(xattrIndexData, "data")
+	if !ok {
+		return nil, nil, fmt.Errorf("inode %d: inline data without system.data attribute", i.num)
+	}
+	return i.iblock[:], ea, nil
+}
+
+// extent maps length logical blocks of a file to physical blocks.
+type extent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	// zero is set for uninitialized extents.
+	zero bool
+}
+
+// mapping describes where the data of a file is.
+type mapping struct {
+	// extents are sorted by logical block, and do not overlap. Blocks
+	// not in an extent are holes.
+	extents []extent
+	// inline is the data of files with inline data.
+	inline []byte
+}
+
+// mapping returns the mapping of the data of i.
+func (fs *FS) mapping(i *inode) (*mapping, error) {
+	switch {
+	case i.flags&inodeFlagEncrypt != 0:
+		return nil, fmt.Errorf("inode %d is encrypted", i.num)
+	case i.flags&inodeFlagInlineData != 0:
+		a, b, err := i.inlineData()
+		if err != nil {
+			return nil, err
+		}
+		data := append(append([]byte{}, a...), b...)
+		if int64(len(data)) > i.size {
+			data = data[:i.size]
+		}
+		return &mapping{inline: data}, nil
+	case i.isSymlink() && fs.fastSymlink(i):
+		return &mapping{inline: i.iblock[:i.size]}, nil
+	case i.flags&inodeFlagExtents != 0:
+		m := &mapping{}
+		if err := fs.walkExtents(m, i.iblock[:], maxExtentDepth); err != nil {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+		sort.Slice(m.extents, func(a, b int) bool { return m.extents[a].logical < m.extents[b].logical })
+		for n := 1; n < len(m.extents); n++ {
+			if p := m.extents[n-1]; p.logical+p.length > m.extents[n].logical {
+				return nil, fmt.Errorf("inode %d: overlapping extents at block %d", i.num, m.extents[n].logical)
+			}
+		}
+		return m, nil
+	default:
+		m := &mapping{}
+		if err := fs.walkBlockMap(m, i); err != nil {
+			return nil, fmt.Errorf("inode %d: %v", i.num, err)
+		}
+		return m, nil
+	}
+}
+
+// fastSymlink returns true if the target of symlink i is in i_block.
+func (fs *FS) fastSymlink(i *inode) bool {
+	blocks := i.blocks
+	if i.fileACL != 0 {
+		blocks -= uint64(fs.blockSize / 512)
+	}
+	return i.size < iBlockSize && blocks == 0
+}
+
+// walkExtents adds the extents of the extent tree node b to m.
+func (fs *FS) walkExtents(m *mapping, b []byte, depth int) error {
+	if len(b) < 12 || binary.LittleEndian.Uint16(b) != extentMagic {
+		return errors.New("invalid extent header")
+	}
+	entries := int(binary.LittleEndian.Uint16(b[2:]))
+	d := int(binary.LittleEndian.Uint16(b[6:]))
+	if d >= depth {
+		return fmt.Errorf("extent tree depth %d too large", d)
+	}
+	if 12+12*entries > len(b) {
+		return fmt.Errorf("%d extents do not fit in %d bytes", entries, len(b))
+	}
+	for n := 0; n < entries; n++ {
+		e := b[12+12*n:]
+		if d > 0 {
+			leaf := uint64(binary.LittleEndian.Uint32(e[4:])) | uint64(binary.LittleEndian.Uint16(e[8:]))<<32
+			child, err := fs.readBlock(leaf)
+			if err != nil {
+				return err
+			}
+			if err := fs.walkExtents(m, child, d); err != nil {
+				return err
+			}
+			continue
+		}
+		x := extent{
+			logical:  uint64(binary.LittleEndian.Uint32(e)),
+			length:   uint64(binary.LittleEndian.Uint16(e[4:])),
+			physical: uint64(binary.LittleEndian.Uint16(e[6:]))<<32 | uint64(binary.LittleEndian.Uint32(e[8:])),
+		}
+		if x.length > initMaxLen {
+			x.length -= initMaxLen
+			x.zero = true
+		}
+		if x.physical+x.length > fs.sb.blocksCount {
+			return fmt.Errorf("extent at block %d beyond the end of the file system", x.physical)
+		}
+		m.extents = append(m.extents, x)
+	}
+	return nil
+}
+
+// walkBlockMap adds the blocks of the direct and indirect block map of i to
+// m.
+func (fs *FS) walkBlockMap(m *mapping, i *inode) error {
+	blocks := uint64((i.size + fs.blockSize - 1) / fs.blockSize)
+	var logical uint64
+	// add adds a block, merging it with the last extent if it follows it.
+	add := func(p uint64) error {
+		if p == 0 {
+			logical++
+			return nil
+		}
+		if p >= fs.sb.blocksCount {
+			return fmt.Errorf("block %d beyond the end of the file system", p)
+		}
+		if n := len(m.extents); n > 0 {
+			last := &m.extents[n-1]
+			if last.logical+last.length == logical && last.physical+last.length == p {
+				last.length++
+				logical++
+				return nil
+			}
+		}
+		m.extents = append(m.extents, extent{logical: logical, physical: p, length: 1})
+		logical++
+		return nil
+	}
+	perBlock := uint64(fs.blockSize / 4)
+	// walk adds the blocks of the indirect block p with the given level
+	// of indirection, which maps span blocks.
+	var walk func(p uint64, level int, span uint64) error
+	walk = func(p uint64, level int, span uint64) error {
+		if level == 0 {
+			return add(p)
+		}
+		if p == 0 {
+			logical += span
+			return nil
+		}
+		b, err := fs.readBlock(p)
+		if err != nil {
+			return err
+		}
+		for n := uint64(0); n < perBlock && logical < blocks; n++ {
+			if err := walk(uint64(binary.LittleEndian.Uint32(b[4*n:])), level-1, span/perBlock); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	span := uint64(1)
+	for n := 0; n < iBlockSize/4 && logical < blocks; n++ {
+		level := 0
+		if n >= 12 {
+			level = n - 11
+			span *= perBlock
+		}
+		if err := walk(uint64(binary.LittleEndian.Uint32(i.iblock[4*n:])), level, span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readData reads the data of a file of the given size mapped by m at off.
+func (fs *FS) readData(m *mapping, size int64, b []byte, off int64) (int, error) {
+	if off >= size {
+		return 0, io.EOF
+	}
+	if m.inline != nil {
+		if off >= int64(len(m.inline)) {
+			return 0, io.EOF
+		}
+		n := copy(b, m.inline[off:])
+		if n < len(b) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	var n int
+	for n < len(b) && off < size {
+		logical := uint64(off / fs.blockSize)
+		inBlock := off % fs.blockSize
+		// The number of bytes to read from this extent or hole.
+		want := int64(len(b) - n)
+		if r := size - off; r < want {
+			want = r
+		}
+
+		x := sort.Search(len(m.extents), func(x int) bool {
+			e := m.extents[x]
+			return e.logical+e.length > logical
+		})
+		if x == len(m.extents) || m.extents[x].logical > logical {
+			// A hole up to the next extent.
+			end := size
+			if x < len(m.extents) {
+				end = int64(m.extents[x].logical) * fs.blockSize
+			}
+			if r := end - off; r < want {
+				want = r
+			}
+			for k := range b[n : n+int(want)] {
+				b[n+k] = 0
+			}
+		} else {
+			e := m.extents[x]
+			if r := int64(e.logical+e.length-logical)*fs.blockSize - inBlock; r < want {
+				want = r
+			}
+			if e.zero {
+				for k := range b[n : n+int(want)] {
+					b[n+k] = 0
+				}
+			} else {
+				p := int64(e.physical+logical-e.logical)*fs.blockSize + inBlock
+				if err := fs.readAt(b[n:n+int(want)], p); err != nil {
+					return n, err
+				}
+			}
+		}
+		n += int(want)
+		off += want
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readlink returns the target of symlink i.
+func (fs *FS) readlink(i *inode) (string, error) {
+	m, err := fs.mapping(i)
+	if err != nil {
+		return "", err
+	}
+	if i.size > fs.blockSize {
+		return "", fmt.Errorf("inode %d: symlink of %d bytes", i.num, i.size)
+	}
+	b := make([]byte, i.size)
+	if _, err := fs.readData(m, i.size, b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// File is an open file of an FS. It implements io.Reader, io.ReaderAt and
+// io.Seeker.
+type File struct {
+	fs   *FS
+	name string
+	ino  *inode
+	m    *mapping
+	off  int64
+}
+
+// Read reads up to len(b) bytes from the file.
+func (f *File) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(b) bytes from the file at off.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.ino.isDir() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	n, err := f.fs.readData(f.m, f.ino.size, b, off)
+	if err != nil && err != io.EOF {
+		err = &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.ino.size
+	case io.SeekStart:
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Stat returns a FileInfo describing the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: f.name, ino: f.ino}, nil
+}
+
+// Close does nothing, as an FS does not keep state for open files.
+func (f *File) Close() error {
+	return nil
+}
+
+// fileInfo implements os.FileInfo for inodes.
+type fileInfo struct {
+	name string
+	ino  *inode
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.ino.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.ino.mode & 0777)
+	if fi.ino.mode&0x800 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.ino.mode&0x400 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.ino.mode&0x200 != 0 {
+		mode |= os.ModeSticky
+	}
+	switch fi.ino.mode & modeTypeMask {
+	case modeDir:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeFIFO:
+		mode |= os.ModeNamedPipe
+	case modeChar:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case modeBlock:
+		mode |= os.ModeDevice
+	case modeSocket:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(fi.ino.mtime, 0)
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.ino.isDir()
+}
+
+// Sys returns the inode number.
+func (fi *fileInfo) Sys() interface{} {
+	return fi.ino.num
+}
@@ -0,0 +1,44 @@
+#!/bin/sh
+# Generates the test images with e2fsprogs. The images are checked in, so
+# this only needs to run to change them.
+set -e
+export LC_ALL=C
+cd "$(dirname "$0")"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+root="$tmp/root"
+mkdir -p "$root/boot/grub" "$root/many" "$root/inline" "$root/deep/a/b"
+printf 'menuentry "Linux" {\n\tlinux /boot/vmlinuz root=/dev/sda1\n}\n' > "$root/boot/grub/grub.cfg"
+echo hello > "$root/small"
+# 100 bytes, so inline data is in i_block and in system.data.
+printf '%0100d' 0 > "$root/medium"
+# 300KiB of the pattern from TestRead; with 1KiB blocks, a block map
+# needs double indirect blocks for it.
+awk 'BEGIN { for (i = 0; i < 300 * 1024; i++) printf "%c", i % 251 + 1 }' > "$root/boot/vmlinuz"
+# A hole between two blocks of data.
+printf 'head' > "$root/sparse"
+printf 'tail' | dd of="$root/sparse" bs=1 seek=1048576 conv=notrunc 2>/dev/null
+for i in $(seq 1 400); do
+	echo "$i" > "$root/many/file-with-a-long-name-$i"
+done
+echo in > "$root/inline/x"
+echo deep > "$root/deep/a/b/c"
+ln -s boot/grub/grub.cfg "$root/fast"
+ln -s deep/a/b/../../../deep/a/b/../../../deep/a/b/../../../deep/a/b/c "$root/slow"
+ln -s /boot "$root/abs"
+ln -s ../.. "$root/deep/a/up"
+ln -s loop2 "$root/loop1"
+ln -s loop1 "$root/loop2"
+ln -s missing "$root/dangling"
+
+mke2fs -q -F -t ext4 -O 64bit,inline_data,^has_journal -b 4096 -I 256 -N 512 \
+	-L ext4test -U 6d1e0b9a-6f37-4f3c-9d4e-0d8a3c9e2a11 -E root_owner=0:0 \
+	-d "$root" "$tmp/ext4.img" 4M
+# Index the large directory.
+e2fsck -fyD "$tmp/ext4.img" >/dev/null || [ $? -le 1 ]
+mke2fs -q -F -t ext2 -b 1024 -I 128 -N 512 -L ext2test -E root_owner=0:0 \
+	-d "$root" "$tmp/ext2.img" 4M
+
+gzip -9n < "$tmp/ext4.img" > ext4.img.gz
+gzip -9n < "$tmp/ext2.img" > ext2.img.gz
@@ -0,0 +1,238 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fileserver implements an HTTP file server with authentication,
+// JSON directory listings and uploads.
+//
+// Files are served with ETags and Range support, so that interrupted
+// downloads of curl.HTTPClientWithRetries resume where they stopped.
+package fileserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server serves the files of a directory over HTTP.
+//
+// GET and HEAD requests fetch files. Directories are listed as JSON if the
+// request accepts application/json or has the query "format=json". PUT
+// requests create or replace files if Upload is set.
+type Server struct {
+	// Dir is the served directory.
+	Dir string
+
+	// Upload allows PUT requests. Uploads larger than MaxUploadSize, if
+	// set, are refused.
+	Upload        bool
+	MaxUploadSize int64
+
+	// Users maps user names to passwords for basic authentication, and
+	// Tokens are accepted bearer tokens. If both are empty, all requests
+	// are allowed.
+	Users  map[string]string
+	Tokens []string
+}
+
+// Entry is a directory entry in JSON listings.
+type Entry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// cacheHeaders are request headers that would let clients revalidate
+// cached copies of files. They are ignored so that clients always get
+// the files as they are now.
+var cacheHeaders = []string{
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Unmodified-Since",
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := filepath.Join(s.Dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		for _, h := range cacheHeaders {
+			r.Header.Del(h)
+		}
+		s.serve(w, r, name)
+
+	case http.MethodPut:
+		if !s.Upload {
+			http.Error(w, "uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		s.upload(w, r, name)
+
+	default:
+		allow := "GET, HEAD"
+		if s.Upload {
+			allow += ", PUT"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized checks the credentials of r in constant time.
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.Users) == 0 && len(s.Tokens) == 0 {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		want, ok := s.Users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+	}
+	const bearer = "Bearer "
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, bearer) {
+		for _, t := range s.Tokens {
+			if subtle.ConstantTimeCompare([]byte(h[len(bearer):]), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// etag identifies a version of a file by its modification time and size.
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if !fi.IsDir() {
+		// ServeContent handles Range and If-Range requests.
+		w.Header().Set("ETag", etag(fi))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.FileServer(http.Dir(s.Dir)).ServeHTTP(w, r)
+		return
+	}
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	entries := make([]Entry, 0, len(fis))
+	for _, fi := range fis {
+		entries = append(entries, Entry{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode().String(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("Could not write listing of %s: %v", name, err)
+	}
+}
+
+// upload writes the request body to a temporary file and renames it to
+// name, so that readers never see partial uploads.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, name string) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "cannot upload a directory", http.StatusBadRequest)
+		return
+	}
+	if s.MaxUploadSize > 0 && r.ContentLength > s.MaxUploadSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		httpError(w, err)
+		return
+	}
+	_, err := os.Stat(name)
+	exists := err == nil
+
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	var body io.Reader = r.Body
+	if s.MaxUploadSize > 0 {
+		body = io.LimitReader(r.Body, s.MaxUploadSize+1)
+	}
+	n, err := io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if s.MaxUploadSize > 0 && n > s.MaxUploadSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		httpError(w, err)
+		return
+	}
+	log.Printf("Received %s from %s", name, r.RemoteAddr)
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
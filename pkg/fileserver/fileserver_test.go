@@ -0,0 +1,200 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setup(t *testing.T, s *Server) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kernel"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Dir = dir
+	ts := httptest.NewServer(s)
+	return ts, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, method, url string, body string, header http.Header) (int, string, http.Header) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), resp.Header
+}
+
+func TestRange(t *testing.T) {
+	ts, cleanup := setup(t, &Server{})
+	defer cleanup()
+
+	code, body, h := do(t, "GET", ts.URL+"/kernel", "", nil)
+	if code != http.StatusOK || body != "0123456789" {
+		t.Fatalf("GET = %d %q, want 200 0123456789", code, body)
+	}
+	etag := h.Get("ETag")
+	if len(etag) == 0 {
+		t.Fatalf("no ETag")
+	}
+
+	for _, tt := range []struct {
+		ifRange string
+		code    int
+		body    string
+	}{
+		{ifRange: etag, code: http.StatusPartialContent, body: "456789"},
+		{ifRange: `"other"`, code: http.StatusOK, body: "0123456789"},
+	} {
+		code, body, _ := do(t, "GET", ts.URL+"/kernel", "", http.Header{
+			"Range":    {"bytes=4-"},
+			"If-Range": {tt.ifRange},
+			// Revalidation is ignored.
+			"If-None-Match": {etag},
+		})
+		if code != tt.code || body != tt.body {
+			t.Errorf("GET with If-Range %s = %d %q, want %d %q", tt.ifRange, code, body, tt.code, tt.body)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	ts, cleanup := setup(t, &Server{})
+	defer cleanup()
+
+	code, body, h := do(t, "GET", ts.URL+"/?format=json", "", nil)
+	if code != http.StatusOK || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET = %d %s, want 200 application/json", code, h.Get("Content-Type"))
+	}
+	var entries []Entry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "kernel" || entries[0].Size != 10 || entries[1].Name != "sub" || !entries[1].IsDir {
+		t.Errorf("listing = %+v, want kernel and sub", entries)
+	}
+
+	if code, body, _ := do(t, "GET", ts.URL+"/", "", nil); code != http.StatusOK || !strings.Contains(body, `href="kernel"`) {
+		t.Errorf("GET = %d %q, want HTML listing", code, body)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	s := &Server{MaxUploadSize: 10}
+	ts, cleanup := setup(t, s)
+	defer cleanup()
+
+	if code, _, _ := do(t, "PUT", ts.URL+"/log", "boot log", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT without uploads = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+
+	s.Upload = true
+	for _, tt := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{path: "/logs/node1", body: "boot log", code: http.StatusCreated},
+		{path: "/logs/node1", body: "new log", code: http.StatusNoContent},
+		{path: "/../../escape", body: "escape", code: http.StatusCreated},
+		{path: "/big", body: "more than ten bytes", code: http.StatusRequestEntityTooLarge},
+		{path: "/sub/", body: "dir", code: http.StatusBadRequest},
+	} {
+		if code, _, _ := do(t, "PUT", ts.URL+tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("PUT %s = %d, want %d", tt.path, code, tt.code)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(s.Dir, "logs", "node1")); err != nil || string(b) != "new log" {
+		t.Errorf("uploaded file = %q, %v, want %q", b, err, "new log")
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "escape")); err != nil {
+		t.Errorf("upload of /../../escape is not in the served directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "big")); !os.IsNotExist(err) {
+		t.Errorf("too large upload was stored: %v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ts, cleanup := setup(t, &Server{
+		Users:  map[string]string{"user": "secret"},
+		Tokens: []string{"token"},
+	})
+	defer cleanup()
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{name: "none", code: http.StatusUnauthorized},
+		{name: "basic", header: http.Header{"Authorization": {"Basic dXNlcjpzZWNyZXQ="}}, code: http.StatusOK},
+		{name: "wrong password", header: http.Header{"Authorization": {"Basic dXNlcjp3cm9uZw=="}}, code: http.StatusUnauthorized},
+		{name: "token", header: http.Header{"Authorization": {"Bearer token"}}, code: http.StatusOK},
+		{name: "wrong token", header: http.Header{"Authorization": {"Bearer other"}}, code: http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _, _ := do(t, "GET", ts.URL+"/kernel", "", tt.header); code != tt.code {
+				t.Errorf("GET = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	config, err := TLSConfig("", "", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(&Server{Dir: "."})
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(config.Certificates[0].Leaf)
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := c.Get(ts.URL + "/fileserver.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET = %d, want 200", resp.StatusCode)
+	}
+	if pin := Pin(resp.TLS.PeerCertificates[0]); pin != Pin(config.Certificates[0].Leaf) || !strings.HasPrefix(pin, "sha256//") {
+		t.Errorf("Pin() = %s", pin)
+	}
+}
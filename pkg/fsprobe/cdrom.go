@@ -0,0 +1,147 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Volume descriptors of both iso9660 and UDF start at sector 16.
+const (
+	cdSectorSize     = 2048
+	cdDescriptorsOff = 16 * cdSectorSize
+	cdMaxDescriptors = 64
+)
+
+// iso9660 volume descriptor types.
+const (
+	isoPrimary    = 1
+	isoSupplement = 2
+	isoTerminator = 255
+)
+
+// probeISO9660 finds iso9660 primary volume descriptors. As blkid does, the
+// label is taken from a Joliet descriptor if there is one, and the UUID is
+// the creation time.
+func probeISO9660(r *reader) *Info {
+	var i *Info
+	for n := int64(0); n < cdMaxDescriptors; n++ {
+		b := r.read(cdDescriptorsOff+n*cdSectorSize, cdSectorSize)
+		if b == nil || string(b[1:6]) != "CD001" || b[0] == isoTerminator {
+			break
+		}
+		switch {
+		case b[0] == isoPrimary && i == nil:
+			i = &Info{Type: "iso9660", Usage: UsageFilesystem, Label: cstring(b[40:72])}
+			if t := b[813:829]; strings.Trim(string(t), "0\x00") != "" {
+				i.UUID = fmt.Sprintf("%s-%s-%s-%s-%s-%s-%s", t[0:4], t[4:6], t[6:8], t[8:10], t[10:12], t[12:14], t[14:16])
+			}
+		case b[0] == isoSupplement && i != nil && isJoliet(b[88:91]):
+			if l := utf16String(b[40:72], binary.BigEndian); len(l) > 0 {
+				i.Label = l
+			}
+		}
+	}
+	return i
+}
+
+// isJoliet returns true for the escape sequences of UCS-2 levels 1 to 3.
+func isJoliet(esc []byte) bool {
+	return esc[0] == '%' && esc[1] == '/' && (esc[2] == '@' || esc[2] == 'C' || esc[2] == 'E')
+}
+
+// UDF descriptor tag identifiers.
+const (
+	udfPrimary     = 1
+	udfAnchor      = 2
+	udfLogical     = 6
+	udfTerminating = 8
+
+	udfAnchorSector = 256
+)
+
+// probeUDF finds UDF file systems by their volume recognition sequence and
+// reads the label and UUID from the main volume descriptor sequence.
+func probeUDF(r *reader) *Info {
+	if !udfRecognized(r) {
+		return nil
+	}
+	i := &Info{Type: "udf", Usage: UsageFilesystem}
+	for _, bs := range []int64{2048, 512, 4096, 1024} {
+		b := r.read(udfAnchorSector*bs, 24)
+		if b == nil || le16(b, 0) != udfAnchor || le32(b, 12) != udfAnchorSector {
+			continue
+		}
+		length, loc := int64(le32(b, 16)), int64(le32(b, 20))
+		for n := int64(0); n < length/bs && n < cdMaxDescriptors; n++ {
+			d := r.read((loc+n)*bs, 512)
+			if d == nil {
+				break
+			}
+			switch le16(d, 0) {
+			case udfPrimary:
+				i.UUID = udfUUID(dstring(d[72:200]))
+			case udfLogical:
+				i.Label = dstring(d[84:212])
+			}
+			if le16(d, 0) == udfTerminating {
+				break
+			}
+		}
+		break
+	}
+	return i
+}
+
+// udfRecognized returns true if the extended area of the volume recognition
+// sequence has an NSR descriptor.
+func udfRecognized(r *reader) bool {
+	extended := false
+	for n := int64(0); n < cdMaxDescriptors; n++ {
+		b := r.read(cdDescriptorsOff+n*cdSectorSize, 6)
+		if b == nil {
+			return false
+		}
+		switch id := string(b[1:6]); {
+		case id == "BEA01":
+			extended = true
+		case id == "NSR02" || id == "NSR03":
+			return extended
+		case id == "TEA01" || (id != "CD001" && id != "BOOT2" && id != "CDW02"):
+			return false
+		}
+	}
+	return false
+}
+
+// dstring decodes a UDF dstring: a compression ID of 8 or 16 bits per
+// character, the characters, and their length in bytes in the last byte.
+func dstring(d []byte) string {
+	n := int(d[len(d)-1])
+	if n == 0 || n > len(d)-1 {
+		return ""
+	}
+	switch d[0] {
+	case 8:
+		return cstring(d[1:n])
+	case 16:
+		return utf16String(d[1:n], binary.BigEndian)
+	}
+	return ""
+}
+
+// udfUUID derives the UUID from the volume set identifier as blkid does: its
+// first 16 characters if they are hex digits, else the hex of the first 8.
+func udfUUID(volset string) string {
+	if len(volset) < 8 {
+		return ""
+	}
+	if len(volset) >= 16 && strings.Trim(strings.ToLower(volset[:16]), "0123456789abcdef") == "" {
+		return strings.ToLower(volset[:16])
+	}
+	return fmt.Sprintf("%x", volset[:8])
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// serial formats a 32 bit volume serial number as Windows and blkid do.
+func serial(s uint32) string {
+	return fmt.Sprintf("%04X-%04X", s>>16, s&0xffff)
+}
+
+// probeVFAT finds FAT12, FAT16 and FAT32 boot sectors.
+func probeVFAT(r *reader) *Info {
+	b := r.read(0, 512)
+	if b == nil {
+		return nil
+	}
+	// The bytes per sector are a power of two from 512 to 4096.
+	if bps := le16(b, 11); bps < 512 || bps > 4096 || bps&(bps-1) != 0 {
+		return nil
+	}
+
+	// FAT32 has a longer BIOS parameter block, so the extended boot
+	// record is further in.
+	var ebr []byte
+	switch {
+	case string(b[82:90]) == "FAT32   ":
+		ebr = b[64:90]
+	case string(b[54:62]) == "FAT12   " || string(b[54:62]) == "FAT16   " || string(b[54:62]) == "FAT     ":
+		ebr = b[36:62]
+	default:
+		return nil
+	}
+	i := &Info{Type: "vfat", Usage: UsageFilesystem, UUID: serial(le32(ebr, 3))}
+	if l := cstring(ebr[7:18]); l != "NO NAME" {
+		i.Label = l
+	}
+	return i
+}
+
+const exfatLabelEntry = 0x83
+
+// probeExFAT finds exFAT boot sectors. The label is an entry in the root
+// directory.
+func probeExFAT(r *reader) *Info {
+	b := r.read(0, 512)
+	if b == nil || string(b[3:11]) != "EXFAT   " {
+		return nil
+	}
+	i := &Info{Type: "exfat", Usage: UsageFilesystem, UUID: serial(le32(b, 100))}
+
+	sectorShift, clusterShift := uint(b[108]), uint(b[109])
+	if sectorShift < 9 || sectorShift > 12 || clusterShift > 25-sectorShift {
+		return i
+	}
+	heap, root := int64(le32(b, 88)), int64(le32(b, 96))
+	if root < 2 {
+		return i
+	}
+	// The label is among the first entries, so the start of the first
+	// cluster is enough.
+	n := 1 << (sectorShift + clusterShift)
+	if n > 64<<10 {
+		n = 64 << 10
+	}
+	dir := r.read((heap+(root-2)<<clusterShift)<<sectorShift, n)
+	for off := 0; off+32 <= len(dir) && dir[off] != 0; off += 32 {
+		if dir[off] == exfatLabelEntry {
+			n := int(dir[off+1])
+			if n > 11 {
+				n = 11
+			}
+			i.Label = utf16String(dir[off+2:off+2+2*n], binary.LittleEndian)
+			break
+		}
+	}
+	return i
+}
+
+const (
+	ntfsVolumeRecord = 3
+	ntfsVolumeName   = 0x60
+	ntfsAttrEnd      = 0xffffffff
+)
+
+// probeNTFS finds NTFS boot sectors. The label is an attribute of the
+// $Volume file in the master file table.
+func probeNTFS(r *reader) *Info {
+	b := r.read(0, 512)
+	if b == nil || string(b[3:11]) != "NTFS    " {
+		return nil
+	}
+	i := &Info{Type: "ntfs", Usage: UsageFilesystem, UUID: fmt.Sprintf("%016X", le64(b, 0x48))}
+
+	bytesPerSector, sectorsPerCluster := int64(le16(b, 0x0b)), int64(b[0x0d])
+	if sectorsPerCluster > 0x80 {
+		sectorsPerCluster = 1 << (256 - sectorsPerCluster)
+	}
+	clusterSize := bytesPerSector * sectorsPerCluster
+	recordSize := int64(int8(b[0x40]))
+	if recordSize > 0 {
+		recordSize *= clusterSize
+	} else {
+		recordSize = 1 << uint(-recordSize)
+	}
+	if clusterSize == 0 || recordSize < 512 || recordSize > 64<<10 {
+		return i
+	}
+
+	rec := r.read(int64(le64(b, 0x30))*clusterSize+ntfsVolumeRecord*recordSize, int(recordSize))
+	if rec == nil || string(rec[:4]) != "FILE" {
+		return i
+	}
+	// Undo the update sequence fixups that protect the end of each
+	// 512 byte stride of the record.
+	usa, usaCount := int(le16(rec, 4)), int(le16(rec, 6))
+	for s := 1; s < usaCount; s++ {
+		end := s*512 - 2
+		if end+2 > len(rec) || usa+2*s+2 > len(rec) {
+			return i
+		}
+		copy(rec[end:end+2], rec[usa+2*s:usa+2*s+2])
+	}
+
+	for off := int(le16(rec, 0x14)); off+24 <= len(rec); {
+		typ, length := le32(rec, off), int(le32(rec, off+4))
+		if typ == ntfsAttrEnd || length == 0 {
+			break
+		}
+		if typ == ntfsVolumeName && rec[off+8] == 0 {
+			vlen, voff := int(le32(rec, off+0x10)), int(le16(rec, off+0x14))
+			if off+voff+vlen <= len(rec) {
+				i.Label = utf16String(rec[off+voff:off+voff+vlen], binary.LittleEndian)
+			}
+			break
+		}
+		off += length
+	}
+	return i
+}
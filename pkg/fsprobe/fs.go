@@ -0,0 +1,83 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsprobe
+
+// See https://www.nongnu.org/ext2-doc/ext2.html#superblock.
+const (
+	extSuperblockOff = 1024
+	extMagic         = 0xef53
+
+	extCompatHasJournal = 0x4
+	extIncompatJournal  = 0x8
+
+	// Features that ext3 supports. Any others make it ext4.
+	ext3IncompatSupported = 0x2 | 0x4 | 0x10
+	ext3ROCompatSupported = 0x1 | 0x2 | 0x4
+)
+
+// probeExt finds ext2, ext3, ext4 and external journal superblocks.
+func probeExt(r *reader) *Info {
+	b := r.read(extSuperblockOff, 136)
+	if b == nil || le16(b, 56) != extMagic {
+		return nil
+	}
+	compat, incompat, roCompat := le32(b, 92), le32(b, 96), le32(b, 100)
+
+	i := &Info{Type: "ext2", Usage: UsageFilesystem, UUID: uuid(b[104:120]), Label: cstring(b[120:136])}
+	switch {
+	case incompat&extIncompatJournal != 0:
+		i.Type, i.Usage = "jbd", UsageOther
+	case incompat&^ext3IncompatSupported != 0 || roCompat&^ext3ROCompatSupported != 0:
+		i.Type = "ext4"
+	case compat&extCompatHasJournal != 0:
+		i.Type = "ext3"
+	}
+	return i
+}
+
+// probeXFS finds XFS superblocks.
+func probeXFS(r *reader) *Info {
+	b := r.read(0, 120)
+	if b == nil || string(b[:4]) != "XFSB" {
+		return nil
+	}
+	return &Info{Type: "xfs", Usage: UsageFilesystem, UUID: uuid(b[32:48]), Label: cstring(b[108:120])}
+}
+
+// probeBtrfs finds the primary btrfs superblock at 64K.
+func probeBtrfs(r *reader) *Info {
+	b := r.read(64<<10, 0x22b)
+	if b == nil || string(b[0x40:0x48]) != "_BHRfS_M" {
+		return nil
+	}
+	return &Info{Type: "btrfs", Usage: UsageFilesystem, UUID: uuid(b[0x20:0x30]), Label: cstring(b[0x12b:0x22b])}
+}
+
+// probeSquashfs finds squashfs superblocks in either byte order. Squashfs
+// has neither label nor UUID.
+func probeSquashfs(r *reader) *Info {
+	if !r.magic(0, "hsqs") && !r.magic(0, "sqsh") {
+		return nil
+	}
+	return &Info{Type: "squashfs", Usage: UsageFilesystem}
+}
+
+// probeSwap finds swap signatures at the end of the first page, for any
+// page size.
+func probeSwap(r *reader) *Info {
+	for pageSize := int64(4096); pageSize <= 64<<10; pageSize <<= 1 {
+		switch {
+		case r.magic(pageSize-10, "SWAPSPACE2"):
+			i := &Info{Type: "swap", Usage: UsageOther}
+			if b := r.read(1024, 44); b != nil {
+				i.UUID, i.Label = uuid(b[12:28]), cstring(b[28:44])
+			}
+			return i
+		case r.magic(pageSize-10, "SWAP-SPACE"):
+			return &Info{Type: "swap", Usage: UsageOther}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fsprobe identifies file systems and volumes by their superblocks.
+//
+// It recognizes ext2/3/4, xfs, btrfs, vfat, exfat, ntfs, iso9660, udf,
+// squashfs, swap, LVM physical volumes, LUKS and md-raid members. Types
+// are named as by blkid, so that they can be passed to mount(2).
+package fsprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Usage is what a probed volume is used for.
+type Usage string
+
+// Usages, as reported by blkid.
+const (
+	UsageFilesystem Usage = "filesystem"
+	UsageRAID       Usage = "raid"
+	UsageCrypto     Usage = "crypto"
+	UsageOther      Usage = "other"
+)
+
+// Info is what a superblock tells about a volume.
+type Info struct {
+	// Type is the blkid type name, e.g. "ext4" or "crypto_LUKS".
+	Type  string
+	Usage Usage
+
+	// Label and UUID are empty if the volume has none.
+	Label string
+	UUID  string
+}
+
+// String implements fmt.Stringer.
+func (i *Info) String() string {
+	return fmt.Sprintf("%s(label=%q, uuid=%s)", i.Type, i.Label, i.UUID)
+}
+
+// Mountable returns true if the volume has a file system.
+func (i *Info) Mountable() bool {
+	return i.Usage == UsageFilesystem
+}
+
+// ErrUnknown is returned for volumes without a known superblock.
+var ErrUnknown = errors.New("unknown file system")
+
+// prober returns the volume information of r, or nil if r does not have the
+// prober's superblock.
+type prober func(r *reader) *Info
+
+// probers are tried in order. RAID and volume manager members come first,
+// as they can contain file systems that would be found otherwise, and UDF
+// before the iso9660 bridge that UDF discs usually have.
+var probers = []prober{
+	probeRAID,
+	probeLUKS,
+	probeLVM,
+	probeXFS,
+	probeExt,
+	probeBtrfs,
+	probeSquashfs,
+	probeSwap,
+	probeExFAT,
+	probeNTFS,
+	probeVFAT,
+	probeUDF,
+	probeISO9660,
+}
+
+// Probe identifies the volume in r.
+//
+// Some superblocks are at the end of the volume, so Probe needs its size.
+// It uses the Size method of r if there is one, as for bytes.Reader and
+// io.SectionReader, or else seeks to the end if r is an io.Seeker, as
+// os.File is. Otherwise, those superblocks are not found.
+func Probe(r io.ReaderAt) (*Info, error) {
+	rd := &reader{r: r, size: size(r)}
+	for _, p := range probers {
+		if i := p(rd); i != nil {
+			return i, nil
+		}
+	}
+	return nil, ErrUnknown
+}
+
+func size(r io.ReaderAt) int64 {
+	switch s := r.(type) {
+	case interface{ Size() int64 }:
+		return s.Size()
+	case io.Seeker:
+		cur, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0
+		}
+		if _, err := s.Seek(cur, io.SeekStart); err != nil {
+			return 0
+		}
+		return end
+	}
+	return 0
+}
+
+// reader reads superblocks. Short reads are treated as a missing
+// superblock.
+type reader struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// read returns n bytes at off, or nil.
+func (r *reader) read(off int64, n int) []byte {
+	if off < 0 || (r.size > 0 && off+int64(n) > r.size) {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := r.r.ReadAt(b, off); err != nil {
+		return nil
+	}
+	return b
+}
+
+// magic returns true if the bytes at off are m.
+func (r *reader) magic(off int64, m string) bool {
+	b := r.read(off, len(m))
+	return b != nil && string(b) == m
+}
+
+func le16(b []byte, off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+func le32(b []byte, off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+func le64(b []byte, off int) uint64 { return binary.LittleEndian.Uint64(b[off:]) }
+
+// formatUUID formats a 16 byte UUID.
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// isZero returns true if b is all zeroes, as unset UUIDs are.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// uuid formats b unless it is unset.
+func uuid(b []byte) string {
+	if isZero(b) {
+		return ""
+	}
+	return formatUUID(b)
+}
+
+// cstring returns the NUL-terminated or -padded string in b, without
+// trailing spaces.
+func cstring(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+// utf16String decodes the UTF-16 string in b up to the first NUL.
+func utf16String(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := order.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), " ")
+}
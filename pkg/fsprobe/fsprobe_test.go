@@ -0,0 +1,362 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+// at is data to put at an offset of a test image.
+type at struct {
+	off  int
+	data []byte
+}
+
+func image(size int, writes ...at) []byte {
+	b := make([]byte, size)
+	for _, w := range writes {
+		copy(b[w.off:], w.data)
+	}
+	return b
+}
+
+func le16b(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32b(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le64b(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func utf16b(s string, order binary.ByteOrder) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		order.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+var testUUID = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+const testUUIDString = "12345678-9abc-def0-0123-456789abcdef"
+
+func ext(compat, incompat, roCompat uint32) []byte {
+	return image(4096,
+		at{1024 + 56, le16b(extMagic)},
+		at{1024 + 92, le32b(compat)},
+		at{1024 + 96, le32b(incompat)},
+		at{1024 + 100, le32b(roCompat)},
+		at{1024 + 104, testUUID},
+		at{1024 + 120, []byte("rootfs")},
+	)
+}
+
+func ntfs() []byte {
+	const (
+		cluster = 4096
+		mft     = 4
+		record  = 1024
+	)
+	rec := image(record,
+		at{0, []byte("FILE")},
+		at{4, le16b(48)},
+		at{6, le16b(3)},
+		at{48, []byte{1, 0, 0xaa, 0xbb, 0xcc, 0xdd}},
+		at{0x14, le16b(56)},
+		// A standard information attribute to skip.
+		at{56, le32b(0x10)},
+		at{56 + 4, le32b(24)},
+		// The volume name, resident.
+		at{80, le32b(ntfsVolumeName)},
+		at{80 + 4, le32b(24 + 14)},
+		at{80 + 0x10, le32b(14)},
+		at{80 + 0x14, le16b(24)},
+		at{80 + 24, utf16b("Windows", binary.LittleEndian)},
+		at{120, le32b(ntfsAttrEnd)},
+		// The update sequence numbers that fixups replace.
+		at{510, []byte{1, 0}},
+		at{1022, []byte{1, 0}},
+	)
+	return image(mft*cluster+4*record,
+		at{3, []byte("NTFS    ")},
+		at{0x0b, le16b(512)},
+		at{0x0d, []byte{8}},
+		at{0x30, le64b(mft)},
+		at{0x40, []byte{0xf6}}, // 2^10 byte records.
+		at{0x48, le64b(0x0123456789abcdef)},
+		at{mft*cluster + 3*record, rec},
+	)
+}
+
+func exfat() []byte {
+	return image(64<<10,
+		at{3, []byte("EXFAT   ")},
+		at{88, le32b(32)},
+		at{96, le32b(4)},
+		at{100, le32b(0xdeadbeef)},
+		at{108, []byte{9, 3}},
+		// The root directory is in cluster 4: sector 32 + 2*8.
+		at{48*512 + 0, []byte{0x81}},
+		at{48*512 + 32, []byte{exfatLabelEntry, 4}},
+		at{48*512 + 34, utf16b("DATA", binary.LittleEndian)},
+	)
+}
+
+func iso9660(joliet bool) []byte {
+	w := []at{
+		{cdDescriptorsOff, []byte{isoPrimary}},
+		{cdDescriptorsOff + 40, []byte("LIVE_CD                         ")},
+		{cdDescriptorsOff + 813, []byte("2019053112000000")},
+	}
+	next := cdDescriptorsOff + cdSectorSize
+	if joliet {
+		w = append(w,
+			at{next, []byte{isoSupplement}},
+			at{next + 40, utf16b("Live CD", binary.BigEndian)},
+			at{next + 88, []byte("%/E")},
+		)
+		next += cdSectorSize
+	}
+	w = append(w, at{next, []byte{isoTerminator}})
+	for off := cdDescriptorsOff; off <= next; off += cdSectorSize {
+		w = append(w, at{off + 1, []byte("CD001")})
+	}
+	return image(64<<10, w...)
+}
+
+func udf() []byte {
+	const vds = 300 * cdSectorSize
+	dstr := func(s string, n int) []byte {
+		d := make([]byte, n)
+		d[0] = 8
+		copy(d[1:], s)
+		d[n-1] = byte(len(s) + 1)
+		return d
+	}
+	b := iso9660(false)
+	return image(320*cdSectorSize,
+		at{0, b[:cdDescriptorsOff+2*cdSectorSize]},
+		at{cdDescriptorsOff + 2*cdSectorSize + 1, []byte("BEA01")},
+		at{cdDescriptorsOff + 3*cdSectorSize + 1, []byte("NSR02")},
+		at{cdDescriptorsOff + 4*cdSectorSize + 1, []byte("TEA01")},
+		at{udfAnchorSector * cdSectorSize, le16b(udfAnchor)},
+		at{udfAnchorSector*cdSectorSize + 12, le32b(udfAnchorSector)},
+		at{udfAnchorSector*cdSectorSize + 16, le32b(4 * cdSectorSize)},
+		at{udfAnchorSector*cdSectorSize + 20, le32b(300)},
+		at{vds, le16b(udfPrimary)},
+		at{vds + 72, dstr("4c0ffee0deadbeefLinuxUDF", 128)},
+		at{vds + cdSectorSize, le16b(udfLogical)},
+		at{vds + cdSectorSize + 84, dstr("Movies", 128)},
+		at{vds + 2*cdSectorSize, le16b(udfTerminating)},
+	)
+}
+
+func TestProbe(t *testing.T) {
+	const mdSize = 1 << 20
+	for _, tt := range []struct {
+		name string
+		img  []byte
+		want *Info
+	}{
+		{
+			name: "ext2",
+			img:  ext(0, 0x2, 0x1),
+			want: &Info{Type: "ext2", Usage: UsageFilesystem, Label: "rootfs", UUID: testUUIDString},
+		},
+		{
+			name: "ext3",
+			img:  ext(extCompatHasJournal, 0x2|0x4, 0x1|0x2),
+			want: &Info{Type: "ext3", Usage: UsageFilesystem, Label: "rootfs", UUID: testUUIDString},
+		},
+		{
+			name: "ext4",
+			img:  ext(extCompatHasJournal, 0x2|0x40|0x80|0x200, 0x1|0x2|0x400),
+			want: &Info{Type: "ext4", Usage: UsageFilesystem, Label: "rootfs", UUID: testUUIDString},
+		},
+		{
+			name: "jbd",
+			img:  ext(0, extIncompatJournal, 0),
+			want: &Info{Type: "jbd", Usage: UsageOther, Label: "rootfs", UUID: testUUIDString},
+		},
+		{
+			name: "xfs",
+			img:  image(4096, at{0, []byte("XFSB")}, at{32, testUUID}, at{108, []byte("data")}),
+			want: &Info{Type: "xfs", Usage: UsageFilesystem, Label: "data", UUID: testUUIDString},
+		},
+		{
+			name: "btrfs",
+			img:  image(128<<10, at{64<<10 + 0x20, testUUID}, at{64<<10 + 0x40, []byte("_BHRfS_M")}, at{64<<10 + 0x12b, []byte("pool")}),
+			want: &Info{Type: "btrfs", Usage: UsageFilesystem, Label: "pool", UUID: testUUIDString},
+		},
+		{
+			name: "squashfs",
+			img:  image(4096, at{0, []byte("hsqs")}),
+			want: &Info{Type: "squashfs", Usage: UsageFilesystem},
+		},
+		{
+			name: "swap",
+			img:  image(8192, at{1024 + 12, testUUID}, at{1024 + 28, []byte("swap0")}, at{4096 - 10, []byte("SWAPSPACE2")}),
+			want: &Info{Type: "swap", Usage: UsageOther, Label: "swap0", UUID: testUUIDString},
+		},
+		{
+			name: "swap with 64K pages",
+			img:  image(64<<10, at{64<<10 - 10, []byte("SWAPSPACE2")}),
+			want: &Info{Type: "swap", Usage: UsageOther},
+		},
+		{
+			name: "fat32",
+			img:  image(4096, at{11, le16b(512)}, at{67, le32b(0x1234abcd)}, at{71, []byte("EFI        ")}, at{82, []byte("FAT32   ")}),
+			want: &Info{Type: "vfat", Usage: UsageFilesystem, Label: "EFI", UUID: "1234-ABCD"},
+		},
+		{
+			name: "fat16 without label",
+			img:  image(4096, at{11, le16b(512)}, at{39, le32b(0x00c0ffee)}, at{43, []byte("NO NAME    ")}, at{54, []byte("FAT16   ")}),
+			want: &Info{Type: "vfat", Usage: UsageFilesystem, UUID: "00C0-FFEE"},
+		},
+		{
+			name: "exfat",
+			img:  exfat(),
+			want: &Info{Type: "exfat", Usage: UsageFilesystem, Label: "DATA", UUID: "DEAD-BEEF"},
+		},
+		{
+			name: "ntfs",
+			img:  ntfs(),
+			want: &Info{Type: "ntfs", Usage: UsageFilesystem, Label: "Windows", UUID: "0123456789ABCDEF"},
+		},
+		{
+			name: "iso9660",
+			img:  iso9660(false),
+			want: &Info{Type: "iso9660", Usage: UsageFilesystem, Label: "LIVE_CD", UUID: "2019-05-31-12-00-00-00"},
+		},
+		{
+			name: "iso9660 with joliet",
+			img:  iso9660(true),
+			want: &Info{Type: "iso9660", Usage: UsageFilesystem, Label: "Live CD", UUID: "2019-05-31-12-00-00-00"},
+		},
+		{
+			name: "udf bridge",
+			img:  udf(),
+			want: &Info{Type: "udf", Usage: UsageFilesystem, Label: "Movies", UUID: "4c0ffee0deadbeef"},
+		},
+		{
+			name: "lvm",
+			img: image(4096,
+				at{512, []byte("LABELONE")},
+				at{512 + 20, le32b(32)},
+				at{512 + 24, []byte("LVM2 001")},
+				at{512 + 32, []byte("AbCdEf0123456789AbCdEf0123456789")},
+			),
+			want: &Info{Type: "LVM2_member", Usage: UsageRAID, UUID: "AbCdEf-0123-4567-89Ab-CdEf-0123-456789"},
+		},
+		{
+			name: "luks1",
+			img:  image(4096, at{0, []byte("LUKS\xba\xbe\x00\x01")}, at{168, []byte(testUUIDString)}),
+			want: &Info{Type: "crypto_LUKS", Usage: UsageCrypto, UUID: testUUIDString},
+		},
+		{
+			name: "luks2",
+			img:  image(4096, at{0, []byte("LUKS\xba\xbe\x00\x02")}, at{24, []byte("secret")}, at{168, []byte(testUUIDString)}),
+			want: &Info{Type: "crypto_LUKS", Usage: UsageCrypto, Label: "secret", UUID: testUUIDString},
+		},
+		{
+			name: "md 1.2 over ext4",
+			img:  image(8192, at{0, ext(0, 0x40, 0)[:4096]}, at{4096, le32b(mdMagic)}, at{4096 + 4, le32b(1)}, at{4096 + 16, testUUID}, at{4096 + 32, []byte("host:0")}),
+			want: &Info{Type: "linux_raid_member", Usage: UsageRAID, Label: "host:0", UUID: testUUIDString},
+		},
+		{
+			name: "md 1.0",
+			img:  image(mdSize, at{mdSize - 8192, le32b(mdMagic)}, at{mdSize - 8192 + 4, le32b(1)}, at{mdSize - 8192 + 16, testUUID}),
+			want: &Info{Type: "linux_raid_member", Usage: UsageRAID, UUID: testUUIDString},
+		},
+		{
+			name: "md 0.90",
+			img:  image(mdSize, at{mdSize - 65536, le32b(mdMagic)}, at{mdSize - 65536 + 20, testUUID[:4]}, at{mdSize - 65536 + 52, testUUID[4:]}),
+			want: &Info{Type: "linux_raid_member", Usage: UsageRAID, UUID: testUUIDString},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Probe(bytes.NewReader(tt.img))
+			if err != nil {
+				t.Fatalf("Probe() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Probe() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeUnknown(t *testing.T) {
+	for _, img := range [][]byte{
+		nil,
+		make([]byte, 1<<20),
+		image(4096, at{82, []byte("FAT32   ")}), // No bytes per sector.
+	} {
+		if got, err := Probe(bytes.NewReader(img)); err != ErrUnknown {
+			t.Errorf("Probe() = %v, %v, want %v", got, err, ErrUnknown)
+		}
+	}
+}
+
+func TestProbeFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Without the size of the file, the md 1.0 superblock at its end
+	// would not be found.
+	const size = 1 << 20
+	if _, err := f.Write(image(size, at{size - 8192, le32b(mdMagic)}, at{size - 8192 + 4, le32b(1)})); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Probe(f)
+	if err != nil || got.Type != "linux_raid_member" {
+		t.Errorf("Probe() = %v, %v, want linux_raid_member", got, err)
+	}
+}
+
+// TestProbeMkfs probes the partitions of an image made by mkfs.ext4 and
+// mkfs.vfat, as blkid reports them.
+func TestProbeMkfs(t *testing.T) {
+	f, err := os.Open("../mount/testdata/1MB.ext4_vfat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, tt := range []struct {
+		start, sectors int64
+		want           *Info
+	}{
+		{start: 1, sectors: 1024, want: &Info{Type: "ext4", Usage: UsageFilesystem, UUID: "2183ead8-a510-4b3d-9777-19c7090f66d9"}},
+		{start: 1025, sectors: 1023, want: &Info{Type: "vfat", Usage: UsageFilesystem, UUID: "ACE5-5144"}},
+	} {
+		got, err := Probe(io.NewSectionReader(f, tt.start*512, tt.sectors*512))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Probe(partition at %d) = %v, %v, want %v", tt.start, got, err, tt.want)
+		}
+	}
+}
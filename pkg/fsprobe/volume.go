@@ -0,0 +1,70 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const mdMagic = 0xa92b4efc
+
+// probeRAID finds md-raid superblocks: version 0.90 in the last 64K aligned
+// block, 1.0 8K from the end, 1.1 at the start and 1.2 4K from the start.
+func probeRAID(r *reader) *Info {
+	offs := []int64{0, 4096}
+	if r.size > 0 {
+		offs = append(offs, ((r.size>>9)-16)&^7<<9, r.size&^(64<<10-1)-64<<10)
+	}
+	for _, off := range offs {
+		b := r.read(off, 128)
+		if b == nil || le32(b, 0) != mdMagic {
+			continue
+		}
+		switch le32(b, 4) {
+		case 0:
+			// The 0.90 UUID is spread over four words.
+			id := append(append([]byte{}, b[20:24]...), b[52:64]...)
+			return &Info{Type: "linux_raid_member", Usage: UsageRAID, UUID: uuid(id)}
+		case 1:
+			return &Info{Type: "linux_raid_member", Usage: UsageRAID, UUID: uuid(b[16:32]), Label: cstring(b[32:64])}
+		}
+	}
+	return nil
+}
+
+// probeLUKS finds LUKS1 and LUKS2 headers.
+func probeLUKS(r *reader) *Info {
+	b := r.read(0, 208)
+	if b == nil || string(b[:6]) != "LUKS\xba\xbe" {
+		return nil
+	}
+	i := &Info{Type: "crypto_LUKS", Usage: UsageCrypto, UUID: cstring(b[168:208])}
+	if binary.BigEndian.Uint16(b[6:]) == 2 {
+		i.Label = cstring(b[24:72])
+	}
+	return i
+}
+
+// probeLVM finds LVM2 physical volume labels, which can be in any of the
+// first four sectors.
+func probeLVM(r *reader) *Info {
+	for sector := int64(0); sector < 4; sector++ {
+		b := r.read(sector*512, 32)
+		if b == nil || string(b[:8]) != "LABELONE" || string(b[24:32]) != "LVM2 001" {
+			continue
+		}
+		id := r.read(sector*512+int64(le32(b, 20)), 32)
+		if id == nil {
+			return nil
+		}
+		return &Info{
+			Type:  "LVM2_member",
+			Usage: UsageRAID,
+			UUID:  fmt.Sprintf("%s-%s-%s-%s-%s-%s-%s", id[0:6], id[6:10], id[10:14], id[14:18], id[18:22], id[22:26], id[26:32]),
+		}
+	}
+	return nil
+}
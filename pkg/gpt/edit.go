@@ -0,0 +1,450 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gpt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// DefaultAlign is the alignment of partitions in blocks, 1 MiB, as fdisk
+// and sgdisk use.
+const DefaultAlign = 2048
+
+// PartTypes maps the sgdisk codes of common partition types to their type
+// GUIDs.
+var PartTypes = map[string]string{
+	"0700": "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7", // Microsoft basic data
+	"8200": "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f", // Linux swap
+	"8300": "0fc63daf-8483-4772-8e79-3d69d8477de4", // Linux filesystem
+	"8302": "933ac7e1-2eb4-4f13-b844-0e14e2aef915", // Linux /home
+	"8304": "4f68bce3-e8cd-4db1-96e7-fbcaf984b709", // Linux x86-64 root
+	"8e00": "e6d6d379-f507-44c2-a23c-238f2a3df928", // Linux LVM
+	"ef00": "c12a7328-f81f-11d2-ba4b-00a0c93ec93b", // EFI system
+	"ef02": "21686148-6449-6e6f-744e-656564454649", // BIOS boot
+	"fd00": "a19d880f-05fc-4d3b-a006-743f0f84911e", // Linux RAID
+}
+
+// ParseGUID parses a GUID in its usual text form, like
+// c12a7328-f81f-11d2-ba4b-00a0c93ec93b.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	f := strings.Split(s, "-")
+	if len(f) != 5 || len(f[0]) != 8 || len(f[1]) != 4 || len(f[2]) != 4 || len(f[3]) != 4 || len(f[4]) != 12 {
+		return g, fmt.Errorf("%q is not a GUID", s)
+	}
+	b, err := hex.DecodeString(strings.Join(f, ""))
+	if err != nil {
+		return g, fmt.Errorf("%q is not a GUID: %v", s, err)
+	}
+	g.L = binary.BigEndian.Uint32(b[0:4])
+	g.W1 = binary.BigEndian.Uint16(b[4:6])
+	g.W2 = binary.BigEndian.Uint16(b[6:8])
+	copy(g.B[:], b[8:])
+	return g, nil
+}
+
+// ParseType parses a partition type GUID, or one of the codes in PartTypes.
+func ParseType(s string) (GUID, error) {
+	if g, ok := PartTypes[strings.ToLower(s)]; ok {
+		s = g
+	}
+	return ParseGUID(s)
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() (GUID, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return GUID{}, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return ParseGUID(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+// NewPartName encodes s as a partition name.
+func NewPartName(s string) (PartName, error) {
+	var n PartName
+	u := utf16.Encode([]rune(s))
+	if 2*len(u) > len(n) {
+		return n, fmt.Errorf("partition name %q is longer than %d UTF-16 code units", s, len(n)/2)
+	}
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(n[2*i:], c)
+	}
+	return n, nil
+}
+
+// Decode returns the partition name as a string.
+func (n PartName) Decode() string {
+	var u []uint16
+	for i := 0; i < len(n); i += 2 {
+		c := binary.LittleEndian.Uint16(n[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// IsEmpty returns true if the partition entry is unused.
+func (p *Part) IsEmpty() bool {
+	return p.PartGUID == GUID{}
+}
+
+// partBlocks is the number of blocks of a partition entry array.
+func (g *GPT) partBlocks() uint64 {
+	return (uint64(g.NPart)*uint64(g.PartSize) + BlockSize - 1) / BlockSize
+}
+
+// partBytes returns the partition entry array, with entry i at
+// i*PartSize.
+func (g *GPT) partBytes() ([]byte, error) {
+	// The maximum extent is NPart * PartSize
+	h := make([]byte, uint64(g.NPart)*uint64(g.PartSize))
+	s := uint64(g.PartSize)
+	for i := range g.Parts {
+		if uint64(i) >= uint64(g.NPart) {
+			break
+		}
+		var b bytes.Buffer
+		if err := binary.Write(&b, binary.LittleEndian, &g.Parts[i]); err != nil {
+			return nil, err
+		}
+		copy(h[uint64(i)*s:], b.Bytes())
+	}
+	return h, nil
+}
+
+func (g *GPT) headerBytes() ([]byte, error) {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, &g.Header); err != nil {
+		return nil, err
+	}
+	h := make([]byte, g.HeaderSize)
+	copy(h, b.Bytes())
+	return h, nil
+}
+
+// UpdateCRC recomputes the partition array and header CRCs of g.
+func (g *GPT) UpdateCRC() error {
+	p, err := g.partBytes()
+	if err != nil {
+		return err
+	}
+	g.PartCRC = crc32.ChecksumIEEE(p)
+	g.CRC = 0
+	h, err := g.headerBytes()
+	if err != nil {
+		return err
+	}
+	g.CRC = crc32.ChecksumIEEE(h)
+	return nil
+}
+
+// mirror returns the other copy of g: the backup of a primary GPT, or the
+// primary of a backup.
+func (g *GPT) mirror() *GPT {
+	m := &GPT{Header: g.Header, Parts: append([]Part(nil), g.Parts...)}
+	m.CurrentLBA, m.BackupLBA = g.BackupLBA, g.CurrentLBA
+	if m.CurrentLBA == 1 {
+		m.PartStart = 2
+	} else {
+		m.PartStart = g.LastLBA + 1
+	}
+	return m
+}
+
+// ProtectiveMBR returns an MBR with a single partition of type 0xee covering
+// the disk, which keeps MBR-only tools away from a GPT disk of blocks blocks.
+func ProtectiveMBR(blocks uint64) *MBR {
+	var m MBR
+	p := m[446:462]
+	copy(p[1:4], []byte{0x00, 0x02, 0x00})
+	p[4] = 0xee
+	copy(p[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(p[8:], 1)
+	size := blocks - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(p[12:], uint32(size))
+	m[510], m[511] = 0x55, 0xaa
+	return &m
+}
+
+// Create returns a new, empty partition table for a disk of blocks blocks,
+// with a protective MBR and a random disk GUID.
+func Create(blocks uint64) (*PartitionTable, error) {
+	g := &GPT{
+		Header: Header{
+			Signature:  Signature,
+			Revision:   Revision,
+			HeaderSize: HeaderSize,
+			CurrentLBA: 1,
+			BackupLBA:  blocks - 1,
+			PartStart:  2,
+			NPart:      MaxNPart,
+			PartSize:   0x80,
+		},
+		Parts: make([]Part, MaxNPart),
+	}
+	pb := g.partBlocks()
+	// Two headers, two partition arrays and at least one usable block.
+	if blocks < 2*(1+pb)+2 {
+		return nil, fmt.Errorf("disk of %d blocks is too small for a GPT", blocks)
+	}
+	g.FirstLBA = 2 + pb
+	g.LastLBA = blocks - 2 - pb
+	var err error
+	if g.DiskGUID, err = NewGUID(); err != nil {
+		return nil, err
+	}
+	p := &PartitionTable{MasterBootRecord: ProtectiveMBR(blocks), Primary: g}
+	return p, p.sync()
+}
+
+// Repair reads the partition table of a disk of blocks blocks like New, but
+// rebuilds a corrupt primary GPT from the backup or a corrupt backup from the
+// primary. A missing MBR is replaced by a protective one. The result is only
+// in memory until it is written with Write.
+func Repair(r io.ReaderAt, blocks uint64) (*PartitionTable, error) {
+	var mbr = &MBR{}
+	if n, err := r.ReadAt(mbr[:], 0); n != BlockSize || err != nil {
+		return nil, fmt.Errorf("reading MBR: %v", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		mbr = ProtectiveMBR(blocks)
+	}
+	p := &PartitionTable{MasterBootRecord: mbr}
+
+	primary, perr := Table(r, HeaderOff)
+	backupLBA := blocks - 1
+	if perr == nil {
+		backupLBA = primary.BackupLBA
+	}
+	backup, berr := Table(r, int64(backupLBA*BlockSize))
+	switch {
+	case perr == nil && berr == nil:
+		p.Primary, p.Backup = primary, backup
+		return p, nil
+	case perr == nil:
+		p.Primary = primary
+	case berr == nil:
+		p.Primary = backup.mirror()
+	default:
+		return nil, fmt.Errorf("no valid GPT: %v; %v", perr, berr)
+	}
+	return p, p.sync()
+}
+
+// sync copies the primary GPT to the backup and updates the CRCs of both.
+func (p *PartitionTable) sync() error {
+	p.Backup = p.Primary.mirror()
+	if err := p.Primary.UpdateCRC(); err != nil {
+		return err
+	}
+	return p.Backup.UpdateCRC()
+}
+
+// part returns partition n, numbered from 1 as the kernel does.
+func (p *PartitionTable) part(n int) (*Part, error) {
+	if n < 1 || n > len(p.Primary.Parts) {
+		return nil, fmt.Errorf("partition %d out of range 1-%d", n, len(p.Primary.Parts))
+	}
+	return &p.Primary.Parts[n-1], nil
+}
+
+// usedPart returns partition n if it is in use.
+func (p *PartitionTable) usedPart(n int) (*Part, error) {
+	part, err := p.part(n)
+	if err != nil {
+		return nil, err
+	}
+	if part.IsEmpty() {
+		return nil, fmt.Errorf("partition %d does not exist", n)
+	}
+	return part, nil
+}
+
+type extent struct {
+	first, last uint64
+}
+
+// free returns the unpartitioned extents of the usable blocks, ignoring
+// partition skip, numbered from 1.
+func (p *PartitionTable) free(skip int) []extent {
+	var used []extent
+	for i, part := range p.Primary.Parts {
+		if !part.IsEmpty() && i+1 != skip {
+			used = append(used, extent{part.FirstLBA, part.LastLBA})
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].first < used[j].first })
+
+	var free []extent
+	next := p.Primary.FirstLBA
+	for _, u := range used {
+		if u.first > next {
+			free = append(free, extent{next, u.first - 1})
+		}
+		if u.last+1 > next {
+			next = u.last + 1
+		}
+	}
+	if next <= p.Primary.LastLBA {
+		free = append(free, extent{next, p.Primary.LastLBA})
+	}
+	return free
+}
+
+// FirstFree returns the first block aligned to align blocks that is not
+// part of a partition.
+func (p *PartitionTable) FirstFree(align uint64) (uint64, error) {
+	if align == 0 {
+		align = 1
+	}
+	for _, e := range p.free(0) {
+		if first := (e.first + align - 1) / align * align; first <= e.last {
+			return first, nil
+		}
+	}
+	return 0, fmt.Errorf("no free space")
+}
+
+// AddPart adds partition n, numbered from 1, from block first to block last
+// inclusive, with the Linux filesystem type and a random unique GUID. A zero
+// n uses the first unused entry, a zero first the first free block aligned to
+// align blocks, and a zero last the end of the free space at first. It
+// returns the number of the new partition.
+func (p *PartitionTable) AddPart(n int, first, last, align uint64) (int, error) {
+	if n == 0 {
+		for i := range p.Primary.Parts {
+			if p.Primary.Parts[i].IsEmpty() {
+				n = i + 1
+				break
+			}
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("all %d partition entries are used", len(p.Primary.Parts))
+		}
+	}
+	part, err := p.part(n)
+	if err != nil {
+		return 0, err
+	}
+	if !part.IsEmpty() {
+		return 0, fmt.Errorf("partition %d already exists", n)
+	}
+	if first == 0 {
+		if first, err = p.FirstFree(align); err != nil {
+			return 0, err
+		}
+	}
+	var space *extent
+	for _, e := range p.free(0) {
+		if e.first <= first && first <= e.last {
+			space = &e
+			break
+		}
+	}
+	if space == nil {
+		return 0, fmt.Errorf("block %d is not free", first)
+	}
+	if last == 0 {
+		last = space.last
+	}
+	if last < first || last > space.last {
+		return 0, fmt.Errorf("blocks %d-%d are not free", first, last)
+	}
+
+	typ, err := ParseGUID(PartTypes["8300"])
+	if err != nil {
+		return 0, err
+	}
+	id, err := NewGUID()
+	if err != nil {
+		return 0, err
+	}
+	*part = Part{PartGUID: typ, UniqueGUID: id, FirstLBA: first, LastLBA: last}
+	return n, p.sync()
+}
+
+// DeletePart deletes partition n.
+func (p *PartitionTable) DeletePart(n int) error {
+	part, err := p.usedPart(n)
+	if err != nil {
+		return err
+	}
+	*part = Part{}
+	return p.sync()
+}
+
+// ResizePart moves the last block of partition n to last, or as far as the
+// free space after it goes if last is zero.
+func (p *PartitionTable) ResizePart(n int, last uint64) error {
+	part, err := p.usedPart(n)
+	if err != nil {
+		return err
+	}
+	for _, e := range p.free(n) {
+		if e.first <= part.FirstLBA && part.FirstLBA <= e.last {
+			if last == 0 {
+				last = e.last
+			}
+			if last < part.FirstLBA || last > e.last {
+				return fmt.Errorf("partition %d cannot end at block %d, the free space is %d-%d", n, last, part.FirstLBA, e.last)
+			}
+			part.LastLBA = last
+			return p.sync()
+		}
+	}
+	return fmt.Errorf("partition %d overlaps another partition", n)
+}
+
+// SetType sets the type GUID of partition n.
+func (p *PartitionTable) SetType(n int, typ GUID) error {
+	part, err := p.usedPart(n)
+	if err != nil {
+		return err
+	}
+	if typ == (GUID{}) {
+		return fmt.Errorf("the zero type GUID marks unused entries")
+	}
+	part.PartGUID = typ
+	return p.sync()
+}
+
+// SetName sets the name of partition n.
+func (p *PartitionTable) SetName(n int, name string) error {
+	part, err := p.usedPart(n)
+	if err != nil {
+		return err
+	}
+	if part.Name, err = NewPartName(name); err != nil {
+		return err
+	}
+	return p.sync()
+}
+
+// SetAttr sets the attributes of partition n.
+func (p *PartitionTable) SetAttr(n int, attr PartAttr) error {
+	part, err := p.usedPart(n)
+	if err != nil {
+		return err
+	}
+	part.Attribute = attr
+	return p.sync()
+}
@@ -0,0 +1,250 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gpt
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testBlocks = 8192
+
+type memdisk []byte
+
+func (d memdisk) WriteAt(b []byte, off int64) (int, error) {
+	return copy(d[off:], b), nil
+}
+
+func (d memdisk) ReadAt(b []byte, off int64) (int, error) {
+	return bytes.NewReader(d).ReadAt(b, off)
+}
+
+func TestParseGUID(t *testing.T) {
+	for _, s := range []string{"c12a7328-f81f-11d2-ba4b-00a0c93ec93b", "0fc63daf-8483-4772-8e79-3d69d8477de4"} {
+		g, err := ParseGUID(s)
+		if err != nil {
+			t.Errorf("ParseGUID(%q): got %v, want nil", s, err)
+			continue
+		}
+		if g.String() != s {
+			t.Errorf("ParseGUID(%q).String(): got %q, want %q", s, g.String(), s)
+		}
+	}
+	for _, s := range []string{"", "c12a7328f81f11d2ba4b00a0c93ec93b", "c12a7328-f81f-11d2-ba4b-00a0c93ec93", "x12a7328-f81f-11d2-ba4b-00a0c93ec93b"} {
+		if _, err := ParseGUID(s); err == nil {
+			t.Errorf("ParseGUID(%q): got nil, want error", s)
+		}
+	}
+
+	g, err := ParseType("EF00")
+	if err != nil || g.String() != "c12a7328-f81f-11d2-ba4b-00a0c93ec93b" {
+		t.Errorf("ParseType(EF00): got %v, %v, want the EFI system GUID", g.String(), err)
+	}
+
+	g, err = NewGUID()
+	if err != nil {
+		t.Fatalf("NewGUID: got %v, want nil", err)
+	}
+	if s := g.String(); s[14] != '4' {
+		t.Errorf("NewGUID: got %s, want a version 4 GUID", s)
+	}
+}
+
+func TestPartName(t *testing.T) {
+	for _, s := range []string{"", "EFI System", "räksmörgås", "123456789012345678901234567890123456"} {
+		n, err := NewPartName(s)
+		if err != nil {
+			t.Errorf("NewPartName(%q): got %v, want nil", s, err)
+			continue
+		}
+		if n.Decode() != s {
+			t.Errorf("NewPartName(%q).Decode(): got %q", s, n.Decode())
+		}
+	}
+	if _, err := NewPartName("1234567890123456789012345678901234567"); err == nil {
+		t.Errorf("NewPartName of 37 characters: got nil, want error")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	p, err := Create(testBlocks)
+	if err != nil {
+		t.Fatalf("Create: got %v, want nil", err)
+	}
+	if p.Primary.FirstLBA != 34 || p.Primary.LastLBA != testBlocks-34 {
+		t.Errorf("Create: usable blocks %d-%d, want 34-%d", p.Primary.FirstLBA, p.Primary.LastLBA, testBlocks-34)
+	}
+	d := make(memdisk, testBlocks*BlockSize)
+	if err := Write(d, p); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	if _, err := New(d); err != nil {
+		t.Fatalf("Reading back new GPT: got %v, want nil", err)
+	}
+
+	if _, err := Create(67); err == nil {
+		t.Errorf("Create(67): got nil, want error")
+	}
+}
+
+func TestWritePartSize(t *testing.T) {
+	p, err := Create(testBlocks)
+	if err != nil {
+		t.Fatalf("Create: got %v, want nil", err)
+	}
+	// Entries may be larger than a Part.
+	for _, g := range []*GPT{p.Primary, p.Backup} {
+		g.NPart, g.PartSize = 64, 256
+		g.Parts = g.Parts[:64]
+	}
+	if _, err := p.AddPart(2, 0, 0, DefaultAlign); err != nil {
+		t.Fatalf("AddPart: got %v, want nil", err)
+	}
+	d := make(memdisk, testBlocks*BlockSize)
+	if err := Write(d, p); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	got, err := New(d)
+	if err != nil {
+		t.Fatalf("Reading back GPT: got %v, want nil", err)
+	}
+	if got.Primary.Parts[1] != p.Primary.Parts[1] {
+		t.Errorf("Partition 2: got %v, want %v", got.Primary.Parts[1], p.Primary.Parts[1])
+	}
+}
+
+func TestEdit(t *testing.T) {
+	p, err := Create(testBlocks)
+	if err != nil {
+		t.Fatalf("Create: got %v, want nil", err)
+	}
+	for _, tt := range []struct {
+		n                   int
+		first, last         uint64
+		wantN               int
+		wantFirst, wantLast uint64
+		err                 bool
+	}{
+		{n: 0, last: 4095, wantN: 1, wantFirst: 2048, wantLast: 4095},
+		{n: 0, wantN: 2, wantFirst: 4096, wantLast: testBlocks - 34},
+		{n: 0, err: true},
+		{n: 1, first: 34, err: true},
+		{n: 129, err: true},
+		{n: 5, first: 34, last: 2047, wantN: 5, wantFirst: 34, wantLast: 2047},
+	} {
+		n, err := p.AddPart(tt.n, tt.first, tt.last, DefaultAlign)
+		if tt.err {
+			if err == nil {
+				t.Errorf("AddPart(%d, %d, %d): got nil, want error", tt.n, tt.first, tt.last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("AddPart(%d, %d, %d): got %v, want nil", tt.n, tt.first, tt.last, err)
+			continue
+		}
+		part := p.Primary.Parts[n-1]
+		if n != tt.wantN || part.FirstLBA != tt.wantFirst || part.LastLBA != tt.wantLast {
+			t.Errorf("AddPart(%d, %d, %d): got partition %d at %d-%d, want %d at %d-%d", tt.n, tt.first, tt.last, n, part.FirstLBA, part.LastLBA, tt.wantN, tt.wantFirst, tt.wantLast)
+		}
+	}
+
+	if err := p.DeletePart(2); err != nil {
+		t.Fatalf("DeletePart(2): got %v, want nil", err)
+	}
+	if err := p.DeletePart(2); err == nil {
+		t.Errorf("DeletePart(2) twice: got nil, want error")
+	}
+	if err := p.ResizePart(5, 2048); err == nil {
+		t.Errorf("ResizePart(5, 2048) into partition 1: got nil, want error")
+	}
+	if err := p.ResizePart(1, 0); err != nil || p.Primary.Parts[0].LastLBA != testBlocks-34 {
+		t.Errorf("ResizePart(1, 0): got %v and last block %d, want nil and %d", err, p.Primary.Parts[0].LastLBA, testBlocks-34)
+	}
+	if err := p.ResizePart(1, 3000); err != nil || p.Primary.Parts[0].LastLBA != 3000 {
+		t.Errorf("ResizePart(1, 3000): got %v and last block %d, want nil and 3000", err, p.Primary.Parts[0].LastLBA)
+	}
+
+	esp, err := ParseType("ef00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetType(1, esp); err != nil {
+		t.Errorf("SetType: got %v, want nil", err)
+	}
+	if err := p.SetName(1, "EFI System"); err != nil {
+		t.Errorf("SetName: got %v, want nil", err)
+	}
+	if err := p.SetAttr(1, 1); err != nil {
+		t.Errorf("SetAttr: got %v, want nil", err)
+	}
+	if err := p.SetName(3, "none"); err == nil {
+		t.Errorf("SetName of unused partition: got nil, want error")
+	}
+
+	d := make(memdisk, testBlocks*BlockSize)
+	if err := Write(d, p); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	n, err := New(d)
+	if err != nil {
+		t.Fatalf("Reading back edited GPT: got %v, want nil", err)
+	}
+	part := n.Primary.Parts[0]
+	if part.PartGUID != esp || part.Name.Decode() != "EFI System" || part.Attribute != 1 {
+		t.Errorf("Partition 1: got %v, %q, %#x, want %v, %q, 0x1", part.PartGUID.String(), part.Name.Decode(), part.Attribute, esp.String(), "EFI System")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	p, err := Create(testBlocks)
+	if err != nil {
+		t.Fatalf("Create: got %v, want nil", err)
+	}
+	if _, err := p.AddPart(0, 0, 0, DefaultAlign); err != nil {
+		t.Fatalf("AddPart: got %v, want nil", err)
+	}
+	for _, tt := range []struct {
+		name  string
+		off   []int64
+		fails bool
+	}{
+		{name: "intact"},
+		{name: "primary", off: []int64{HeaderOff + 16}},
+		{name: "primary partitions", off: []int64{2 * BlockSize}},
+		{name: "backup", off: []int64{(testBlocks-1)*BlockSize + 16}},
+		{name: "both", off: []int64{HeaderOff + 16, (testBlocks-1)*BlockSize + 16}, fails: true},
+	} {
+		d := make(memdisk, testBlocks*BlockSize)
+		if err := Write(d, p); err != nil {
+			t.Fatalf("%s: Write: got %v, want nil", tt.name, err)
+		}
+		for _, off := range tt.off {
+			d[off]++
+		}
+		r, err := Repair(d, testBlocks)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: Repair: got nil, want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Repair: got %v, want nil", tt.name, err)
+			continue
+		}
+		if err := Write(d, r); err != nil {
+			t.Fatalf("%s: Write: got %v, want nil", tt.name, err)
+		}
+		n, err := New(d)
+		if err != nil {
+			t.Errorf("%s: reading back repaired GPT: got %v, want nil", tt.name, err)
+			continue
+		}
+		if err := EqualParts(n.Primary, p.Primary); err != nil {
+			t.Errorf("%s: repaired partitions differ: %v", tt.name, err)
+		}
+	}
+}
@@ -12,7 +12,6 @@
 package gpt
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -281,38 +280,22 @@ func Write(w io.WriterAt, p *PartitionTable) error {
 
 // Write writes the GPT to w. It generates the partition and header CRC before writing.
 func writeGPT(w io.WriterAt, g *GPT) error {
-	// The maximum extent is NPart * PartSize
-	var h = make([]byte, uint64(g.NPart*g.PartSize))
-	s := int64(g.PartSize)
-	for i := int64(0); i < int64(g.NPart); i++ {
-		var b bytes.Buffer
-		if err := binary.Write(&b, binary.LittleEndian, &g.Parts[i]); err != nil {
-			return err
-		}
-		copy(h[i*s:], b.Bytes())
+	if err := g.UpdateCRC(); err != nil {
+		return err
+	}
+	h, err := g.partBytes()
+	if err != nil {
+		return err
 	}
-
 	ps := int64(g.PartStart * BlockSize)
 	if _, err := w.WriteAt(h, ps); err != nil {
 		return fmt.Errorf("writing %d bytes of partition table at %v: %v", len(h), ps, err)
 	}
 
-	g.PartCRC = crc32.ChecksumIEEE(h[:])
-	g.CRC = 0
-	var b bytes.Buffer
-	if err := binary.Write(&b, binary.LittleEndian, &g.Header); err != nil {
+	if h, err = g.headerBytes(); err != nil {
 		return err
 	}
-	h = make([]byte, g.HeaderSize)
-	copy(h, b.Bytes())
-	g.CRC = crc32.ChecksumIEEE(h[:])
-	b.Reset()
-	if err := binary.Write(&b, binary.LittleEndian, g.CRC); err != nil {
-		return err
-	}
-	copy(h[16:], b.Bytes())
-
-	_, err := w.WriteAt(h, int64(g.CurrentLBA*BlockSize))
+	_, err = w.WriteAt(h, int64(g.CurrentLBA*BlockSize))
 	return err
 }
 
@@ -0,0 +1,17 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gpt
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reread asks the kernel to reread the partition table of the block device
+// f, so that partitions written with Write show up.
+func Reread(f *os.File) error {
+	return unix.IoctlSetInt(int(f.Fd()), unix.BLKRRPART, 0)
+}
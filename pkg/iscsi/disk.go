@@ -0,0 +1,268 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/u-root/u-root/pkg/boot/ibft"
+)
+
+// SCSI operation codes, SBC-3.
+const (
+	opReadCapacity10   = 0x25
+	opRead10           = 0x28
+	opWrite10          = 0x2a
+	opSynchronizeCache = 0x35
+	opRead16           = 0x88
+	opWrite16          = 0x8a
+	opServiceAction16  = 0x9e
+
+	// saReadCapacity16 is the READ CAPACITY (16) service action.
+	saReadCapacity16 = 0x10
+)
+
+// maxTransfer is the most bytes read or written by one SCSI command.
+const maxTransfer = 1024 * 1024
+
+// Disk is a logical unit of an iSCSI target.
+//
+// Disk implements io.ReaderAt and io.WriterAt. Unaligned writes read the
+// blocks they partially overwrite first.
+type Disk struct {
+	s         *Session
+	lun       uint16
+	blockSize int64
+	blocks    int64
+}
+
+var (
+	_ io.ReaderAt = &Disk{}
+	_ io.WriterAt = &Disk{}
+)
+
+// Disk returns the logical unit lun of the session's target.
+func (s *Session) Disk(lun uint16) (*Disk, error) {
+	d := &Disk{s: s, lun: lun}
+	if err := d.readCapacity(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Disk) readCapacity() error {
+	b := make([]byte, 8)
+	if _, err := d.s.do(&command{lun: d.lun, cdb: make10(opReadCapacity10), read: b}); err != nil {
+		return fmt.Errorf("iscsi: READ CAPACITY(10) of LUN %d: %v", d.lun, err)
+	}
+	last := int64(binary.BigEndian.Uint32(b))
+	d.blockSize = int64(binary.BigEndian.Uint32(b[4:]))
+
+	// Disks of 2^32 blocks or more need READ CAPACITY (16).
+	if last == 0xffffffff {
+		b = make([]byte, 32)
+		cdb := make([]byte, 16)
+		cdb[0], cdb[1] = opServiceAction16, saReadCapacity16
+		binary.BigEndian.PutUint32(cdb[10:], uint32(len(b)))
+		if _, err := d.s.do(&command{lun: d.lun, cdb: cdb, read: b}); err != nil {
+			return fmt.Errorf("iscsi: READ CAPACITY(16) of LUN %d: %v", d.lun, err)
+		}
+		last = int64(binary.BigEndian.Uint64(b))
+		d.blockSize = int64(binary.BigEndian.Uint32(b[8:]))
+	}
+	if d.blockSize == 0 || d.blockSize > maxTransfer {
+		return fmt.Errorf("iscsi: LUN %d has invalid block size %d", d.lun, d.blockSize)
+	}
+	d.blocks = last + 1
+	return nil
+}
+
+// LUN returns the logical unit number.
+func (d *Disk) LUN() uint16 {
+	return d.lun
+}
+
+// BlockSize returns the logical block size in bytes.
+func (d *Disk) BlockSize() int64 {
+	return d.blockSize
+}
+
+// Size returns the disk's size in bytes.
+func (d *Disk) Size() int64 {
+	return d.blocks * d.blockSize
+}
+
+// rw returns the READ or WRITE command for count blocks at lba.
+func (d *Disk) rw(write bool, lba int64, buf []byte) *command {
+	count := int64(len(buf)) / d.blockSize
+	c := &command{lun: d.lun}
+	if lba+count <= 1<<32 && count <= 0xffff {
+		c.cdb = make([]byte, 10)
+		c.cdb[0] = opRead10
+		if write {
+			c.cdb[0] = opWrite10
+		}
+		binary.BigEndian.PutUint32(c.cdb[2:], uint32(lba))
+		binary.BigEndian.PutUint16(c.cdb[7:], uint16(count))
+	} else {
+		c.cdb = make([]byte, 16)
+		c.cdb[0] = opRead16
+		if write {
+			c.cdb[0] = opWrite16
+		}
+		binary.BigEndian.PutUint64(c.cdb[2:], uint64(lba))
+		binary.BigEndian.PutUint32(c.cdb[10:], uint32(count))
+	}
+	if write {
+		c.write = buf
+	} else {
+		c.read = buf
+	}
+	return c
+}
+
+// blocksAt reads or writes whole blocks starting at lba.
+func (d *Disk) blocksAt(write bool, lba int64, buf []byte) error {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > maxTransfer {
+			n = maxTransfer - maxTransfer%int(d.blockSize)
+		}
+		got, err := d.s.do(d.rw(write, lba, buf[:n]))
+		if err != nil {
+			return err
+		}
+		if !write && got < n {
+			return fmt.Errorf("iscsi: short read of %d bytes at block %d, want %d", got, lba, n)
+		}
+		buf = buf[n:]
+		lba += int64(n) / d.blockSize
+	}
+	return nil
+}
+
+// clamp limits a transfer of n bytes at off to the disk's size.
+func (d *Disk) clamp(n int, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("iscsi: negative offset %d", off)
+	}
+	if off >= d.Size() {
+		return 0, io.EOF
+	}
+	if rem := d.Size() - off; int64(n) > rem {
+		return int(rem), io.EOF
+	}
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	n, eof := d.clamp(len(p), off)
+	if n == 0 {
+		return 0, eof
+	}
+
+	start := off / d.blockSize
+	end := (off + int64(n) + d.blockSize - 1) / d.blockSize
+	buf := p[:n]
+	aligned := off%d.blockSize == 0 && int64(n)%d.blockSize == 0
+	if !aligned {
+		buf = make([]byte, (end-start)*d.blockSize)
+	}
+	if err := d.blocksAt(false, start, buf); err != nil {
+		return 0, err
+	}
+	if !aligned {
+		copy(p, buf[off-start*d.blockSize:])
+	}
+	return n, eof
+}
+
+// WriteAt implements io.WriterAt.
+func (d *Disk) WriteAt(p []byte, off int64) (int, error) {
+	n, eof := d.clamp(len(p), off)
+	if n == 0 {
+		return 0, eof
+	}
+	if eof != nil {
+		eof = io.ErrShortWrite
+	}
+
+	start := off / d.blockSize
+	end := (off + int64(n) + d.blockSize - 1) / d.blockSize
+	buf := p[:n]
+	if off%d.blockSize != 0 || int64(n)%d.blockSize != 0 {
+		buf = make([]byte, (end-start)*d.blockSize)
+		// Only the first and last block are partially overwritten.
+		if err := d.blocksAt(false, start, buf[:d.blockSize]); err != nil {
+			return 0, err
+		}
+		if end-start > 1 {
+			if err := d.blocksAt(false, end-1, buf[len(buf)-int(d.blockSize):]); err != nil {
+				return 0, err
+			}
+		}
+		copy(buf[off-start*d.blockSize:], p[:n])
+	}
+	if err := d.blocksAt(true, start, buf); err != nil {
+		return 0, err
+	}
+	return n, eof
+}
+
+// Sync flushes the target's write cache.
+func (d *Disk) Sync() error {
+	_, err := d.s.do(&command{lun: d.lun, cdb: make10(opSynchronizeCache)})
+	return err
+}
+
+func make10(op uint8) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = op
+	return cdb
+}
+
+// IBFT returns an iBFT that tells the booted OS to use this disk as its
+// boot disk, reached through nic.
+func (d *Disk) IBFT(nic ibft.NIC) *ibft.IBFT {
+	c := d.s.config
+	t := ibft.Target{
+		Valid:             true,
+		Boot:              true,
+		BootLUN:           uint64(d.lun),
+		TargetName:        c.TargetName,
+		CHAPName:          c.CHAPName,
+		CHAPSecret:        c.CHAPSecret,
+		ReverseCHAPName:   c.ReverseCHAPName,
+		ReverseCHAPSecret: c.ReverseCHAPSecret,
+	}
+	if addr, ok := d.s.Addr().(*net.TCPAddr); ok {
+		t.Target = addr
+	}
+	if len(c.CHAPSecret) > 0 {
+		t.CHAP = true
+		if len(t.CHAPName) == 0 {
+			t.CHAPName = c.InitiatorName
+		}
+		// iBFT CHAP types: 1 is CHAP, 2 is mutual CHAP.
+		t.CHAPType = 1
+		if len(c.ReverseCHAPSecret) > 0 {
+			t.RCHAP = true
+			t.CHAPType = 2
+		}
+	}
+	return &ibft.IBFT{
+		Initiator: ibft.Initiator{
+			Name:  c.InitiatorName,
+			Valid: true,
+			Boot:  true,
+		},
+		NIC0:    nic,
+		Target0: t,
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot/ibft"
+)
+
+const (
+	testInitiator = "iqn.2019-10.org.u-root:test"
+	testTarget    = "iqn.2019-10.org.u-root:disk"
+	blockSize     = 512
+)
+
+// target is a minimal in-process iSCSI target serving one LUN from disk.
+type target struct {
+	name   string
+	disk   []byte
+	secret string
+
+	// reverseSecret, if set, is what the target answers mutual CHAP
+	// challenges with.
+	reverseSecret string
+
+	// maxRecv is the target's MaxRecvDataSegmentLength.
+	maxRecv int
+
+	// unitAttention makes the first SCSI command fail with UNIT
+	// ATTENTION.
+	unitAttention bool
+
+	statSN uint32
+	cmdSN  uint32
+	err    error
+}
+
+func (t *target) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := t.login(conn); err != nil {
+		t.err = err
+		return
+	}
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			if err != io.EOF {
+				t.err = err
+			}
+			return
+		}
+		switch p.opcode() {
+		case opSCSICommand:
+			t.cmdSN++
+			err = t.command(conn, p)
+		case opLogoutReq:
+			r := t.response(opLogoutResp, p)
+			err = r.writeTo(conn)
+		default:
+			err = fmt.Errorf("unexpected %#x PDU", p.opcode())
+		}
+		if err != nil {
+			t.err = err
+			return
+		}
+	}
+}
+
+// response returns a response to p carrying the next StatSN.
+func (t *target) response(op opcode, p *pdu) *pdu {
+	r := &pdu{}
+	r.setOpcode(op, false)
+	r.bhs[1] = finalBit
+	r.putUint32(16, p.itt())
+	r.putUint32(24, t.statSN)
+	r.putUint32(28, t.cmdSN)
+	r.putUint32(32, t.cmdSN+8)
+	t.statSN++
+	return r
+}
+
+func (t *target) login(conn net.Conn) error {
+	var challenge []byte
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return err
+		}
+		if p.opcode() != opLoginReq {
+			return fmt.Errorf("got %#x PDU during login", p.opcode())
+		}
+		kv := decodeText(p.data)
+		csg, nsg, transit := p.flags()>>2&3, p.flags()&3, p.flags()&loginTransit != 0
+
+		resp := map[string]string{}
+		var class, detail uint8
+		switch {
+		case len(kv["TargetName"]) > 0 && kv["TargetName"] != t.name:
+			class, detail = 2, 3
+		case csg == stageSecurity && len(t.secret) == 0:
+			resp["AuthMethod"] = "None"
+		case csg == stageSecurity && len(kv["AuthMethod"]) > 0:
+			if !strings.Contains(kv["AuthMethod"], "CHAP") {
+				class, detail = 2, 1
+			}
+			resp["AuthMethod"] = "CHAP"
+		case csg == stageSecurity && kv["CHAP_A"] == chapMD5:
+			challenge = []byte("0123456789abcdef")
+			resp["CHAP_A"] = chapMD5
+			resp["CHAP_I"] = "7"
+			resp["CHAP_C"] = encodeCHAPValue(challenge)
+		case csg == stageSecurity && len(kv["CHAP_R"]) > 0:
+			got, err := decodeCHAPValue(kv["CHAP_R"])
+			if err != nil || !bytes.Equal(got, chapResponse(7, t.secret, challenge)) {
+				class, detail = 2, 1
+				break
+			}
+			if c := kv["CHAP_C"]; len(c) > 0 {
+				rc, _ := decodeCHAPValue(c)
+				id, _ := strconv.Atoi(kv["CHAP_I"])
+				resp["CHAP_N"] = t.name
+				resp["CHAP_R"] = encodeCHAPValue(chapResponse(uint8(id), t.reverseSecret, rc))
+			}
+		case csg == stageOperational:
+			resp["HeaderDigest"] = "None"
+			resp["DataDigest"] = "None"
+			if t.maxRecv > 0 {
+				resp["MaxRecvDataSegmentLength"] = strconv.Itoa(t.maxRecv)
+			}
+		}
+
+		r := t.response(opLoginResp, p)
+		r.bhs[1] = csg<<2 | nsg
+		if transit {
+			r.bhs[1] |= loginTransit
+		}
+		r.bhs[36], r.bhs[37] = class, detail
+		r.data = encodeText(resp)
+		if err := r.writeTo(conn); err != nil {
+			return err
+		}
+		if class != 0 {
+			return nil
+		}
+		if transit && nsg == stageFullFeature {
+			return nil
+		}
+	}
+}
+
+func (t *target) command(conn net.Conn, p *pdu) error {
+	cdb := p.bhs[32:]
+	if t.unitAttention {
+		t.unitAttention = false
+		sense := make([]byte, 18)
+		sense[0], sense[2], sense[12] = 0x70, senseUnitAttention, 0x29
+		return t.status(conn, p, statusCheckCondition, sense)
+	}
+
+	var lba, count int
+	switch cdb[0] {
+	case opReadCapacity10:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, uint32(len(t.disk)/blockSize-1))
+		binary.BigEndian.PutUint32(b[4:], blockSize)
+		return t.dataIn(conn, p, b)
+	case opRead10, opWrite10:
+		lba = int(binary.BigEndian.Uint32(cdb[2:]))
+		count = int(binary.BigEndian.Uint16(cdb[7:]))
+	case opRead16, opWrite16:
+		lba = int(binary.BigEndian.Uint64(cdb[2:]))
+		count = int(binary.BigEndian.Uint32(cdb[10:]))
+	case opSynchronizeCache:
+		return t.status(conn, p, statusGood, nil)
+	default:
+		// ILLEGAL REQUEST, INVALID COMMAND OPERATION CODE.
+		return t.status(conn, p, statusCheckCondition, []byte{0x72, 0x5, 0x20, 0x00})
+	}
+
+	data := t.disk[lba*blockSize : (lba+count)*blockSize]
+	if cdb[0] == opRead10 || cdb[0] == opRead16 {
+		return t.dataIn(conn, p, data)
+	}
+
+	// Ask for the data in two bursts to exercise R2T handling.
+	var offsets []int
+	for off := 0; off < len(data); off += len(data)/2 + 1 {
+		offsets = append(offsets, off)
+	}
+	for i, off := range offsets {
+		end := len(data)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		r := &pdu{}
+		r.setOpcode(opR2T, false)
+		r.bhs[1] = finalBit
+		r.putUint32(16, p.itt())
+		r.putUint32(20, uint32(100+i))
+		r.putUint32(24, t.statSN)
+		r.putUint32(36, uint32(i))
+		r.putUint32(40, uint32(off))
+		r.putUint32(44, uint32(end-off))
+		if err := r.writeTo(conn); err != nil {
+			return err
+		}
+		for got := off; got < end; {
+			d, err := readPDU(conn)
+			if err != nil {
+				return err
+			}
+			if d.opcode() != opDataOut || d.uint32(20) != uint32(100+i) || int(d.uint32(40)) != got {
+				return fmt.Errorf("bad Data-Out %#x for TTT %d at %d", d.opcode(), d.uint32(20), d.uint32(40))
+			}
+			if t.maxRecv > 0 && len(d.data) > t.maxRecv {
+				return fmt.Errorf("Data-Out of %d bytes exceeds %d", len(d.data), t.maxRecv)
+			}
+			copy(data[got:], d.data)
+			got += len(d.data)
+			if got == end && d.flags()&finalBit == 0 {
+				return fmt.Errorf("last Data-Out is not final")
+			}
+		}
+	}
+	return t.status(conn, p, statusGood, nil)
+}
+
+// dataIn sends data in 4 KiB Data-In PDUs, the last with status.
+func (t *target) dataIn(conn net.Conn, p *pdu, data []byte) error {
+	for off := 0; ; off += 4096 {
+		end := off + 4096
+		if end >= len(data) {
+			end = len(data)
+		}
+		r := &pdu{}
+		r.setOpcode(opDataIn, false)
+		r.putUint32(16, p.itt())
+		r.putUint32(40, uint32(off))
+		r.data = data[off:end]
+		if end == len(data) {
+			r.bhs[1] = finalBit | dataInStatus
+			r.putUint32(24, t.statSN)
+			t.statSN++
+		}
+		if err := r.writeTo(conn); err != nil {
+			return err
+		}
+		if end == len(data) {
+			return nil
+		}
+	}
+}
+
+func (t *target) status(conn net.Conn, p *pdu, status uint8, sense []byte) error {
+	r := t.response(opSCSIResponse, p)
+	r.bhs[3] = status
+	if sense != nil {
+		r.data = make([]byte, 2+len(sense))
+		binary.BigEndian.PutUint16(r.data, uint16(len(sense)))
+		copy(r.data[2:], sense)
+	}
+	return r.writeTo(conn)
+}
+
+func newTarget(blocks int) *target {
+	t := &target{name: testTarget, disk: make([]byte, blocks*blockSize)}
+	for i := range t.disk {
+		t.disk[i] = byte(i / blockSize)
+	}
+	return t
+}
+
+// dial logs into t over an in-memory connection.
+func dial(t *target, c *Config) (*Session, error) {
+	client, server := net.Pipe()
+	go t.serve(server)
+	return NewSession(client, c)
+}
+
+func TestDisk(t *testing.T) {
+	tgt := newTarget(64)
+	tgt.unitAttention = true
+	tgt.maxRecv = 1024
+
+	s, err := dial(tgt, &Config{InitiatorName: testInitiator, TargetName: testTarget})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.Disk(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Size(), int64(len(tgt.disk)); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+	if got := d.BlockSize(); got != blockSize {
+		t.Errorf("BlockSize() = %d, want %d", got, blockSize)
+	}
+
+	for _, tt := range []struct {
+		off int64
+		n   int
+	}{
+		{off: 0, n: blockSize},
+		{off: 3 * blockSize, n: 20 * blockSize},
+		{off: 100, n: 10},
+		{off: 1000, n: 3000},
+	} {
+		got := make([]byte, tt.n)
+		if _, err := d.ReadAt(got, tt.off); err != nil {
+			t.Fatalf("ReadAt(%d, %d) = %v", tt.n, tt.off, err)
+		}
+		if want := tgt.disk[tt.off : tt.off+int64(tt.n)]; !bytes.Equal(got, want) {
+			t.Errorf("ReadAt(%d, %d) returned wrong data", tt.n, tt.off)
+		}
+	}
+
+	// Reads past the end are short.
+	b := make([]byte, 2*blockSize)
+	if n, err := d.ReadAt(b, d.Size()-blockSize); n != blockSize || err != io.EOF {
+		t.Errorf("ReadAt(end) = %d, %v, want %d, EOF", n, err, blockSize)
+	}
+
+	// Aligned, unaligned and multi-burst writes.
+	want := append([]byte(nil), tgt.disk...)
+	for _, tt := range []struct {
+		off int64
+		n   int
+	}{
+		{off: 2 * blockSize, n: blockSize},
+		{off: 700, n: 5},
+		{off: 1500, n: 4000},
+	} {
+		w := bytes.Repeat([]byte{0xee - byte(tt.n)}, tt.n)
+		copy(want[tt.off:], w)
+		if _, err := d.WriteAt(w, tt.off); err != nil {
+			t.Fatalf("WriteAt(%d, %d) = %v", tt.n, tt.off, err)
+		}
+	}
+	if err := d.Sync(); err != nil {
+		t.Errorf("Sync() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if tgt.err != nil {
+		t.Fatalf("target: %v", tgt.err)
+	}
+	if !bytes.Equal(tgt.disk, want) {
+		t.Errorf("disk contents differ after writes")
+	}
+}
+
+func TestCHAP(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  Config
+		target  string
+		reverse string
+		wantErr string
+	}{
+		{
+			name:   "chap",
+			config: Config{CHAPName: "user", CHAPSecret: "secretsecret"},
+			target: "secretsecret",
+		},
+		{
+			name:    "mutual",
+			config:  Config{CHAPSecret: "secretsecret", ReverseCHAPName: testTarget, ReverseCHAPSecret: "targetsecret"},
+			target:  "secretsecret",
+			reverse: "targetsecret",
+		},
+		{
+			name:    "wrong secret",
+			config:  Config{CHAPSecret: "wrong"},
+			target:  "secretsecret",
+			wantErr: "authentication failed",
+		},
+		{
+			name:    "target fails mutual",
+			config:  Config{CHAPSecret: "secretsecret", ReverseCHAPSecret: "targetsecret"},
+			target:  "secretsecret",
+			reverse: "impostor",
+			wantErr: "target failed mutual CHAP authentication",
+		},
+		{
+			name:    "target requires chap",
+			target:  "secretsecret",
+			wantErr: "authentication failed",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tgt := newTarget(8)
+			tgt.secret = tt.target
+			tgt.reverseSecret = tt.reverse
+			c := tt.config
+			c.InitiatorName, c.TargetName = testInitiator, testTarget
+
+			s, err := dial(tgt, &c)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewSession() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := s.Disk(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tgt0 := d.IBFT(ibft.NIC{Valid: true}).Target0
+			if !tgt0.CHAP || tgt0.RCHAP != (len(tt.reverse) > 0) || tgt0.TargetName != testTarget {
+				t.Errorf("IBFT() target = %+v", tgt0)
+			}
+			s.Close()
+		})
+	}
+}
+
+func TestTargetNotFound(t *testing.T) {
+	_, err := dial(newTarget(8), &Config{InitiatorName: testInitiator, TargetName: "iqn.2019-10.org.u-root:other"})
+	if err == nil || !strings.Contains(err.Error(), "target not found") {
+		t.Errorf("NewSession() = %v, want target not found", err)
+	}
+}
+
+func TestSense(t *testing.T) {
+	for _, tt := range []struct {
+		status uint8
+		data   []byte
+		want   error
+	}{
+		{status: statusGood},
+		{status: 0x08, want: StatusError(0x08)},
+		{
+			status: statusCheckCondition,
+			data:   []byte{0, 18, 0x70, 0, 0x3, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0x11, 0x01, 0, 0, 0, 0},
+			want:   &SenseError{Key: 0x3, ASC: 0x11, ASCQ: 0x01},
+		},
+		{
+			status: statusCheckCondition,
+			data:   []byte{0, 4, 0x72, 0x5, 0x24, 0x00},
+			want:   &SenseError{Key: 0x5, ASC: 0x24},
+		},
+	} {
+		got := checkStatus(tt.status, tt.data)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("checkStatus(%#x, %v) = %v, want %v", tt.status, tt.data, got, tt.want)
+		}
+	}
+}
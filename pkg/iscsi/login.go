@@ -0,0 +1,283 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Login stages, RFC 7143 Section 11.12.3.
+const (
+	stageSecurity    = 0
+	stageOperational = 1
+	stageFullFeature = 3
+)
+
+// Login request and response flags.
+const (
+	loginTransit  = 0x80
+	loginContinue = 0x40
+)
+
+// chapMD5 is the CHAP_A algorithm number of MD5.
+const chapMD5 = "5"
+
+// loginStep sends one login request with the keys and returns the
+// response's keys, and whether the target moved to the next stage.
+func (s *Session) loginStep(csg, nsg uint8, transit bool, keys map[string]string) (map[string]string, bool, error) {
+	s.deadline()
+	p := &pdu{}
+	p.setOpcode(opLoginReq, true)
+	p.bhs[1] = csg<<2 | nsg
+	if transit {
+		p.bhs[1] |= loginTransit
+	}
+	copy(p.bhs[8:14], s.isid[:])
+	binary.BigEndian.PutUint16(p.bhs[14:], s.tsih)
+	p.putUint32(16, s.itt)
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	p.data = encodeText(keys, "InitiatorName", "SessionType", "TargetName", "AuthMethod")
+	Debug("iscsi: login stage %d->%d: %q", csg, nsg, p.data)
+	if err := s.send(p); err != nil {
+		return nil, false, err
+	}
+
+	r, err := s.recv()
+	if err != nil {
+		return nil, false, err
+	}
+	switch r.opcode() {
+	case opLoginResp:
+	case opReject:
+		return nil, false, fmt.Errorf("login request rejected with reason %#x", r.bhs[2])
+	default:
+		return nil, false, fmt.Errorf("unexpected %#x PDU during login", r.opcode())
+	}
+	kv := decodeText(r.data)
+	Debug("iscsi: login response: %v", kv)
+	if class, detail := r.bhs[36], r.bhs[37]; class != 0 {
+		return nil, false, loginStatusError(class, detail, kv)
+	}
+	if r.flags()&loginContinue != 0 {
+		return nil, false, errors.New("continued login responses are not supported")
+	}
+	s.tsih = binary.BigEndian.Uint16(r.bhs[14:])
+	s.cmdSN = r.expCmdSN()
+
+	transited := r.flags()&loginTransit != 0
+	if transited && r.flags()&3 != nsg {
+		return nil, false, fmt.Errorf("target moved to login stage %d, want %d", r.flags()&3, nsg)
+	}
+	return kv, transited, nil
+}
+
+func loginStatusError(class, detail uint8, kv map[string]string) error {
+	switch class {
+	case 1:
+		return fmt.Errorf("target moved to %s", kv["TargetAddress"])
+	case 2:
+		switch detail {
+		case 1:
+			return errors.New("authentication failed")
+		case 2:
+			return errors.New("authorization failed")
+		case 3:
+			return errors.New("target not found")
+		}
+		return fmt.Errorf("initiator error %#x", detail)
+	default:
+		return fmt.Errorf("target error class %d, detail %#x", class, detail)
+	}
+}
+
+// login runs the security and operational negotiation stages.
+func (s *Session) login() error {
+	keys := map[string]string{
+		"InitiatorName": s.config.InitiatorName,
+		"TargetName":    s.config.TargetName,
+		"SessionType":   "Normal",
+		"AuthMethod":    "None",
+	}
+	if len(s.config.CHAPSecret) > 0 {
+		keys["AuthMethod"] = "CHAP"
+		if err := s.chap(keys); err != nil {
+			return err
+		}
+	} else if err := s.negotiate(stageSecurity, stageOperational, keys); err != nil {
+		return err
+	}
+
+	return s.negotiate(stageOperational, stageFullFeature, map[string]string{
+		"HeaderDigest":             "None",
+		"DataDigest":               "None",
+		"MaxRecvDataSegmentLength": strconv.Itoa(maxRecvDataSegmentLength),
+		"InitialR2T":               "Yes",
+		"ImmediateData":            "No",
+		"MaxConnections":           "1",
+		"MaxOutstandingR2T":        "1",
+		"DataPDUInOrder":           "Yes",
+		"DataSequenceInOrder":      "Yes",
+		"ErrorRecoveryLevel":       "0",
+		"DefaultTime2Wait":         "0",
+		"DefaultTime2Retain":       "0",
+	})
+}
+
+// negotiate offers keys in stage csg until the target moves to stage nsg.
+func (s *Session) negotiate(csg, nsg uint8, keys map[string]string) error {
+	for i := 0; i < 8; i++ {
+		kv, transited, err := s.loginStep(csg, nsg, true, keys)
+		if err != nil {
+			return err
+		}
+		if err := s.accept(kv); err != nil {
+			return err
+		}
+		if transited {
+			return nil
+		}
+		keys = nil
+	}
+	return fmt.Errorf("target did not leave login stage %d", csg)
+}
+
+// accept checks the target's answers to the initiator's keys and records
+// its declarations.
+func (s *Session) accept(kv map[string]string) error {
+	for k, v := range kv {
+		switch k {
+		case "AuthMethod":
+			if v != "None" {
+				return fmt.Errorf("target requires authentication method %s", v)
+			}
+		case "HeaderDigest", "DataDigest":
+			if v != "None" {
+				return fmt.Errorf("target requires %s %s", k, v)
+			}
+		case "MaxRecvDataSegmentLength":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 512 {
+				return fmt.Errorf("invalid %s=%s", k, v)
+			}
+			s.maxSendDataSegmentLength = n
+		}
+	}
+	return nil
+}
+
+// chap authenticates with CHAP during the security stage, RFC 1994 and
+// RFC 7143 Section 12.1.3.
+func (s *Session) chap(keys map[string]string) error {
+	kv, _, err := s.loginStep(stageSecurity, stageOperational, false, keys)
+	if err != nil {
+		return err
+	}
+	if kv["AuthMethod"] != "CHAP" {
+		return fmt.Errorf("target refused CHAP, offered %q", kv["AuthMethod"])
+	}
+
+	kv, _, err = s.loginStep(stageSecurity, stageOperational, false, map[string]string{"CHAP_A": chapMD5})
+	if err != nil {
+		return err
+	}
+	if kv["CHAP_A"] != chapMD5 {
+		return fmt.Errorf("target refused CHAP MD5, offered %q", kv["CHAP_A"])
+	}
+	id, err := strconv.ParseUint(kv["CHAP_I"], 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_I=%s", kv["CHAP_I"])
+	}
+	challenge, err := decodeCHAPValue(kv["CHAP_C"])
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_C: %v", err)
+	}
+
+	name := s.config.CHAPName
+	if len(name) == 0 {
+		name = s.config.InitiatorName
+	}
+	resp := map[string]string{
+		"CHAP_N": name,
+		"CHAP_R": encodeCHAPValue(chapResponse(uint8(id), s.config.CHAPSecret, challenge)),
+	}
+
+	// For mutual CHAP, challenge the target in return.
+	var rid uint8
+	var rchallenge []byte
+	if len(s.config.ReverseCHAPSecret) > 0 {
+		rchallenge = make([]byte, 16)
+		b := make([]byte, 1)
+		if _, err := rand.Read(rchallenge); err != nil {
+			return err
+		}
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		// The target must not be able to replay our own response.
+		rid = b[0]
+		if rid == uint8(id) {
+			rid++
+		}
+		resp["CHAP_I"] = strconv.Itoa(int(rid))
+		resp["CHAP_C"] = encodeCHAPValue(rchallenge)
+	}
+
+	kv, transited, err := s.loginStep(stageSecurity, stageOperational, true, resp)
+	if err != nil {
+		return err
+	}
+	if rchallenge != nil {
+		if rn := s.config.ReverseCHAPName; len(rn) > 0 && kv["CHAP_N"] != rn {
+			return fmt.Errorf("target authenticated as %q, want %q", kv["CHAP_N"], rn)
+		}
+		got, err := decodeCHAPValue(kv["CHAP_R"])
+		if err != nil {
+			return fmt.Errorf("invalid target CHAP_R: %v", err)
+		}
+		want := chapResponse(rid, s.config.ReverseCHAPSecret, rchallenge)
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			return errors.New("target failed mutual CHAP authentication")
+		}
+	}
+	if !transited {
+		return s.negotiate(stageSecurity, stageOperational, nil)
+	}
+	return nil
+}
+
+// chapResponse is MD5(id || secret || challenge).
+func chapResponse(id uint8, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+func encodeCHAPValue(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
+
+// decodeCHAPValue decodes a hexadecimal binary value, RFC 7143 Section
+// 6.1. Base64 values are not supported.
+func decodeCHAPValue(v string) ([]byte, error) {
+	if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+		return nil, fmt.Errorf("%q is not a hexadecimal value", v)
+	}
+	v = v[2:]
+	if len(v)%2 == 1 {
+		v = "0" + v
+	}
+	return hex.DecodeString(v)
+}
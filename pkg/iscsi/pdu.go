@@ -0,0 +1,183 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// opcode is an iSCSI PDU opcode, RFC 7143 Section 11.2.1.2.
+type opcode uint8
+
+const (
+	opNOPOut      opcode = 0x00
+	opSCSICommand opcode = 0x01
+	opLoginReq    opcode = 0x03
+	opTextReq     opcode = 0x04
+	opDataOut     opcode = 0x05
+	opLogoutReq   opcode = 0x06
+
+	opNOPIn        opcode = 0x20
+	opSCSIResponse opcode = 0x21
+	opLoginResp    opcode = 0x23
+	opTextResp     opcode = 0x24
+	opDataIn       opcode = 0x25
+	opLogoutResp   opcode = 0x26
+	opR2T          opcode = 0x31
+	opAsync        opcode = 0x32
+	opReject       opcode = 0x3f
+)
+
+const (
+	// immediateBit marks a request for immediate delivery.
+	immediateBit = 0x40
+
+	// finalBit marks the last PDU of a sequence.
+	finalBit = 0x80
+
+	// bhsLen is the length of the basic header segment.
+	bhsLen = 48
+
+	// reservedTag is the reserved initiator and target task tag.
+	reservedTag = 0xffffffff
+)
+
+// pdu is an iSCSI protocol data unit.
+//
+// Only the basic header segment and data segment are kept; additional
+// header segments are skipped and digests are never negotiated.
+type pdu struct {
+	bhs  [bhsLen]byte
+	data []byte
+}
+
+func (p *pdu) opcode() opcode {
+	return opcode(p.bhs[0] & 0x3f)
+}
+
+func (p *pdu) setOpcode(op opcode, immediate bool) {
+	p.bhs[0] = uint8(op)
+	if immediate {
+		p.bhs[0] |= immediateBit
+	}
+}
+
+func (p *pdu) flags() uint8 {
+	return p.bhs[1]
+}
+
+func (p *pdu) uint32(off int) uint32 {
+	return binary.BigEndian.Uint32(p.bhs[off:])
+}
+
+func (p *pdu) putUint32(off int, v uint32) {
+	binary.BigEndian.PutUint32(p.bhs[off:], v)
+}
+
+// itt returns the initiator task tag.
+func (p *pdu) itt() uint32 {
+	return p.uint32(16)
+}
+
+// statSN returns the status sequence number of target PDUs.
+func (p *pdu) statSN() uint32 {
+	return p.uint32(24)
+}
+
+// expCmdSN returns the next command sequence number the target expects.
+func (p *pdu) expCmdSN() uint32 {
+	return p.uint32(28)
+}
+
+// setLUN sets the logical unit number of SCSI PDUs, using the peripheral
+// device addressing method for small LUNs and flat addressing otherwise.
+func (p *pdu) setLUN(lun uint16) {
+	if lun < 256 {
+		p.bhs[8], p.bhs[9] = 0, uint8(lun)
+	} else {
+		p.bhs[8], p.bhs[9] = 0x40|uint8(lun>>8&0x3f), uint8(lun)
+	}
+}
+
+// writeTo writes the PDU to w, padding the data segment to a multiple of
+// four bytes.
+func (p *pdu) writeTo(w io.Writer) error {
+	n := len(p.data)
+	p.bhs[4] = 0
+	p.bhs[5], p.bhs[6], p.bhs[7] = uint8(n>>16), uint8(n>>8), uint8(n)
+
+	b := make([]byte, bhsLen+pad(n))
+	copy(b, p.bhs[:])
+	copy(b[bhsLen:], p.data)
+	_, err := w.Write(b)
+	return err
+}
+
+// readPDU reads a PDU from r.
+func readPDU(r io.Reader) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	ahs := int(p.bhs[4]) * 4
+	n := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+
+	b := make([]byte, ahs+pad(n))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("reading %#x PDU: %v", p.opcode(), err)
+	}
+	p.data = b[ahs : ahs+n]
+	return p, nil
+}
+
+// pad rounds n up to a multiple of four.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// encodeText encodes key=value pairs as a text data segment. Keys are
+// sorted, except that those in first come first and in that order.
+func encodeText(kv map[string]string, first ...string) []byte {
+	var keys []string
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	order := func(k string) int {
+		for i, f := range first {
+			if f == k {
+				return i
+			}
+		}
+		return len(first)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return order(keys[i]) < order(keys[j])
+	})
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(kv[k])
+		b.WriteByte(0)
+	}
+	return []byte(b.String())
+}
+
+// decodeText decodes a text data segment of NUL-terminated key=value pairs.
+func decodeText(data []byte) map[string]string {
+	kv := make(map[string]string)
+	for _, pair := range strings.Split(string(data), "\x00") {
+		if i := strings.Index(pair, "="); i > 0 {
+			kv[pair[:i]] = pair[i+1:]
+		}
+	}
+	return kv
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SCSI command flags.
+const (
+	cmdRead       = 0x40
+	cmdWrite      = 0x20
+	cmdAttrSimple = 0x01
+)
+
+// Data-In flags.
+const (
+	dataInStatus = 0x01
+)
+
+// SCSI status codes, SAM-5 Section 5.3.
+const (
+	statusGood           = 0x00
+	statusCheckCondition = 0x02
+)
+
+// Sense keys, SPC-4 Section 4.5.6.
+const (
+	senseUnitAttention = 0x6
+)
+
+// SenseError is a SCSI command that failed with CHECK CONDITION.
+type SenseError struct {
+	// Key is the sense key.
+	Key uint8
+
+	// ASC and ASCQ are the additional sense code and qualifier.
+	ASC  uint8
+	ASCQ uint8
+}
+
+func (e *SenseError) Error() string {
+	return fmt.Sprintf("iscsi: check condition, sense key %#x, asc/ascq %#02x/%#02x", e.Key, e.ASC, e.ASCQ)
+}
+
+// StatusError is a SCSI command that failed with a status other than
+// CHECK CONDITION.
+type StatusError uint8
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("iscsi: SCSI status %#02x", uint8(e))
+}
+
+// command is a SCSI command. At most one of read and write is set; read
+// receives the command's data and write is sent as its data.
+type command struct {
+	lun   uint16
+	cdb   []byte
+	read  []byte
+	write []byte
+}
+
+// do runs the SCSI command with the cdb on logical unit lun, sending write
+// or receiving into read. It returns the number of bytes read.
+//
+// Commands interrupted by a unit attention, as reported by the first
+// command after login, are retried.
+func (s *Session) do(c *command) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for retries := 0; ; retries++ {
+		n, err := s.run(c)
+		if se, ok := err.(*SenseError); ok && se.Key == senseUnitAttention && retries < 3 {
+			Debug("iscsi: retrying after %v", err)
+			continue
+		}
+		return n, err
+	}
+}
+
+func (s *Session) run(c *command) (int, error) {
+	s.deadline()
+	itt := s.nextITT()
+
+	p := &pdu{}
+	p.setOpcode(opSCSICommand, false)
+	p.bhs[1] = finalBit | cmdAttrSimple
+	length := len(c.write)
+	if c.read != nil {
+		p.bhs[1] |= cmdRead
+		length = len(c.read)
+	} else if c.write != nil {
+		p.bhs[1] |= cmdWrite
+	}
+	p.setLUN(c.lun)
+	p.putUint32(16, itt)
+	p.putUint32(20, uint32(length))
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	copy(p.bhs[32:], c.cdb)
+	s.cmdSN++
+	if err := s.send(p); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for {
+		r, err := s.recv()
+		if err != nil {
+			return n, err
+		}
+		if r.opcode() == opReject {
+			return n, fmt.Errorf("iscsi: command rejected with reason %#x", r.bhs[2])
+		}
+		if r.itt() != itt {
+			return n, fmt.Errorf("iscsi: unexpected %#x PDU for task %#x, want %#x", r.opcode(), r.itt(), itt)
+		}
+
+		switch r.opcode() {
+		case opDataIn:
+			off := int(r.uint32(40))
+			if off+len(r.data) > len(c.read) {
+				return n, fmt.Errorf("iscsi: Data-In at %d+%d overflows %d byte buffer", off, len(r.data), len(c.read))
+			}
+			copy(c.read[off:], r.data)
+			if end := off + len(r.data); end > n {
+				n = end
+			}
+			if r.flags()&dataInStatus != 0 {
+				return n, checkStatus(r.bhs[3], nil)
+			}
+
+		case opR2T:
+			if err := s.dataOut(c, r); err != nil {
+				return n, err
+			}
+
+		case opSCSIResponse:
+			if resp := r.bhs[2]; resp != 0 {
+				return n, fmt.Errorf("iscsi: target failure, response %#x", resp)
+			}
+			return n, checkStatus(r.bhs[3], r.data)
+
+		default:
+			return n, fmt.Errorf("iscsi: unexpected %#x PDU for SCSI command", r.opcode())
+		}
+	}
+}
+
+// dataOut sends the write data that the target asked for with R2T r.
+func (s *Session) dataOut(c *command, r *pdu) error {
+	ttt := r.uint32(20)
+	off := int(r.uint32(40))
+	length := int(r.uint32(44))
+	if off+length > len(c.write) {
+		return fmt.Errorf("iscsi: R2T for %d+%d exceeds %d bytes of data", off, length, len(c.write))
+	}
+
+	for sn := uint32(0); length > 0; sn++ {
+		n := length
+		if n > s.maxSendDataSegmentLength {
+			n = s.maxSendDataSegmentLength
+		}
+		p := &pdu{}
+		p.setOpcode(opDataOut, false)
+		if n == length {
+			p.bhs[1] = finalBit
+		}
+		p.setLUN(c.lun)
+		p.putUint32(16, r.itt())
+		p.putUint32(20, ttt)
+		p.putUint32(28, s.expStatSN)
+		p.putUint32(36, sn)
+		p.putUint32(40, uint32(off))
+		p.data = c.write[off : off+n]
+		if err := s.send(p); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// checkStatus turns a SCSI status and the sense data of a SCSI Response
+// into an error.
+func checkStatus(status uint8, data []byte) error {
+	switch status {
+	case statusGood:
+		return nil
+	case statusCheckCondition:
+		// The data segment is a 2-byte length and the sense data.
+		if len(data) < 2 {
+			return &SenseError{}
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if n > len(data)-2 {
+			n = len(data) - 2
+		}
+		return parseSense(data[2 : 2+n])
+	default:
+		return StatusError(status)
+	}
+}
+
+// parseSense parses fixed and descriptor format sense data, SPC-4 Section
+// 4.5.
+func parseSense(b []byte) *SenseError {
+	if len(b) < 1 {
+		return &SenseError{}
+	}
+	switch b[0] & 0x7f {
+	case 0x70, 0x71:
+		e := &SenseError{}
+		if len(b) > 2 {
+			e.Key = b[2] & 0xf
+		}
+		if len(b) > 13 {
+			e.ASC, e.ASCQ = b[12], b[13]
+		}
+		return e
+	case 0x72, 0x73:
+		if len(b) < 4 {
+			return &SenseError{}
+		}
+		return &SenseError{Key: b[1] & 0xf, ASC: b[2], ASCQ: b[3]}
+	}
+	return &SenseError{}
+}
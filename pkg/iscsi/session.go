@@ -0,0 +1,218 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iscsi implements an iSCSI initiator over TCP.
+//
+// A Session logs into a target, optionally authenticating with CHAP, and
+// issues SCSI commands to its logical units. Disk exposes a logical unit as
+// an io.ReaderAt and io.WriterAt, which can be mounted through NBD.
+package iscsi
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Debug can be set to log PDUs and login negotiation.
+var Debug = func(string, ...interface{}) {}
+
+// DefaultPort is the well-known iSCSI target port.
+const DefaultPort = 3260
+
+// maxRecvDataSegmentLength is the largest data segment the initiator
+// accepts.
+const maxRecvDataSegmentLength = 256 * 1024
+
+// Config describes an iSCSI target and how to log into it.
+type Config struct {
+	// InitiatorName is the iSCSI qualified name of this initiator.
+	InitiatorName string
+
+	// TargetName is the iSCSI qualified name of the target.
+	TargetName string
+
+	// CHAPName and CHAPSecret authenticate the initiator to the target.
+	// If CHAPSecret is empty, no authentication is used.
+	CHAPName   string
+	CHAPSecret string
+
+	// ReverseCHAPName and ReverseCHAPSecret authenticate the target to
+	// the initiator (mutual CHAP). They require CHAPSecret.
+	ReverseCHAPName   string
+	ReverseCHAPSecret string
+
+	// Timeout bounds connecting and each request. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Session is a logged in iSCSI session with a single connection.
+//
+// Commands are issued one at a time; Session is safe for concurrent use.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	mu        sync.Mutex
+	isid      [6]byte
+	tsih      uint16
+	itt       uint32
+	cmdSN     uint32
+	expStatSN uint32
+
+	// maxSendDataSegmentLength is the largest data segment the target
+	// accepts.
+	maxSendDataSegmentLength int
+}
+
+// Dial connects to the target at addr and logs in.
+func Dial(addr string, c *Config) (*Session, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+	conn, err := net.DialTimeout("tcp", addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSession(conn, c)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSession logs into the target on conn.
+func NewSession(conn net.Conn, c *Config) (*Session, error) {
+	if len(c.InitiatorName) == 0 || len(c.TargetName) == 0 {
+		return nil, errors.New("iscsi: initiator and target names are required")
+	}
+	if len(c.ReverseCHAPSecret) > 0 && len(c.CHAPSecret) == 0 {
+		return nil, errors.New("iscsi: mutual CHAP requires a CHAP secret")
+	}
+	s := &Session{
+		conn:                     conn,
+		config:                   *c,
+		maxSendDataSegmentLength: 8192,
+	}
+	// A random ISID qualifier, RFC 7143 Section 10.12.5.
+	s.isid[0] = 0x80
+	if _, err := rand.Read(s.isid[1:]); err != nil {
+		return nil, err
+	}
+	if err := s.login(); err != nil {
+		return nil, fmt.Errorf("iscsi: login to %s: %v", c.TargetName, err)
+	}
+	return s, nil
+}
+
+// Addr returns the address of the target.
+func (s *Session) Addr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// nextITT returns a fresh initiator task tag.
+func (s *Session) nextITT() uint32 {
+	s.itt++
+	if s.itt == reservedTag {
+		s.itt = 0
+	}
+	return s.itt
+}
+
+func (s *Session) deadline() {
+	if s.config.Timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.config.Timeout))
+	}
+}
+
+func (s *Session) send(p *pdu) error {
+	Debug("iscsi: send %#x itt %#x, %d bytes", p.opcode(), p.itt(), len(p.data))
+	return p.writeTo(s.conn)
+}
+
+// recv returns the next PDU from the target, answering its pings and
+// tracking its status sequence number.
+func (s *Session) recv() (*pdu, error) {
+	for {
+		p, err := readPDU(s.conn)
+		if err != nil {
+			return nil, err
+		}
+		Debug("iscsi: recv %#x itt %#x, %d bytes", p.opcode(), p.itt(), len(p.data))
+
+		switch p.opcode() {
+		case opNOPIn:
+			if ttt := p.uint32(20); ttt != reservedTag {
+				if err := s.nopOut(ttt); err != nil {
+					return nil, err
+				}
+			}
+			continue
+
+		case opAsync:
+			// Asynchronous events are informational here; a
+			// logout request will show up as a closed connection.
+			Debug("iscsi: async event %d", p.bhs[36])
+			continue
+
+		case opSCSIResponse, opLoginResp, opLogoutResp, opTextResp:
+			s.expStatSN = p.statSN() + 1
+
+		case opDataIn:
+			if p.flags()&dataInStatus != 0 {
+				s.expStatSN = p.statSN() + 1
+			}
+		}
+		return p, nil
+	}
+}
+
+// nopOut answers a target's NOP-In ping.
+func (s *Session) nopOut(ttt uint32) error {
+	p := &pdu{}
+	p.setOpcode(opNOPOut, true)
+	p.bhs[1] = finalBit
+	p.putUint32(16, reservedTag)
+	p.putUint32(20, ttt)
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	return s.send(p)
+}
+
+// Close logs out and closes the connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.conn.Close()
+	s.deadline()
+
+	p := &pdu{}
+	p.setOpcode(opLogoutReq, true)
+	// Reason code 0 closes the session.
+	p.bhs[1] = finalBit
+	p.putUint32(16, s.nextITT())
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	if err := s.send(p); err != nil {
+		return err
+	}
+	for {
+		r, err := s.recv()
+		if err != nil {
+			return err
+		}
+		if r.opcode() != opLogoutResp {
+			continue
+		}
+		if r.bhs[2] != 0 {
+			return fmt.Errorf("iscsi: logout failed with response %d", r.bhs[2])
+		}
+		return nil
+	}
+}
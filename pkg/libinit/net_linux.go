@@ -5,17 +5,50 @@
 package libinit
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/netconfig"
 	"github.com/u-root/u-root/pkg/ulog"
 	"github.com/vishvananda/netlink"
 )
 
+const (
+	dhcpTimeout = 15 * time.Second
+	dhcpTries   = 3
+)
+
 // NetInit is u-root network initialization.
+//
+// Besides loopback, it sets up the interfaces configured by dracut-style
+// ip=, bond=, vlan=, bridge= and nameserver= kernel command line arguments.
 func NetInit() {
 	if err := loopbackUp(); err != nil {
 		ulog.KernelLog.Printf("Failed to initialize loopback: %v", err)
 	}
+
+	c, err := netconfig.FromCmdline()
+	if err != nil {
+		ulog.KernelLog.Printf("Invalid network configuration: %v", err)
+		return
+	}
+	for _, ip := range c.Unsupported {
+		ulog.KernelLog.Printf("Ignoring %s: unsupported method", ip)
+	}
+	if c.Empty() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dhcpTries*dhcpTimeout)
+	defer cancel()
+	leases, err := c.Apply(ctx, dhclient.Config{Timeout: dhcpTimeout, Retries: dhcpTries})
+	if err != nil {
+		ulog.KernelLog.Printf("Failed to configure network: %v", err)
+	}
+	for _, l := range leases {
+		ulog.KernelLog.Printf("Configured %s with %s", l.Link().Attrs().Name, l)
+	}
 }
 
 func loopbackUp() error {
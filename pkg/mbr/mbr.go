@@ -0,0 +1,359 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mbr reads and writes MBR (DOS) partition tables, including the
+// logical partitions in an extended partition.
+//
+// The four primary entries of the MBR are partitions 1 to 4. An extended
+// partition holds a chain of extended boot records (EBRs), each describing
+// one logical partition, numbered from 5 as Linux does.
+package mbr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// BlockSize is the size of a sector.
+	BlockSize = 512
+
+	bootCodeSize = 440
+	entriesOff   = 446
+	entrySize    = 16
+	sigOff       = 510
+)
+
+// Partition types with a meaning to this package.
+const (
+	TypeEmpty         = 0x00
+	TypeExtended      = 0x05
+	TypeExtendedLBA   = 0x0f
+	TypeLinux         = 0x83
+	TypeLinuxExtended = 0x85
+	TypeGPT           = 0xee
+)
+
+// Partition is a primary or logical partition. Sectors are 512 bytes and
+// counted from the start of the disk.
+type Partition struct {
+	// Number is 1 to 4 for primary and 5 and up for logical partitions.
+	Number   int
+	Bootable bool
+	Type     byte
+	FirstLBA uint64
+	Sectors  uint64
+
+	// EBR is the sector of the extended boot record of a logical
+	// partition.
+	EBR uint64
+}
+
+// LastLBA returns the last sector of p.
+func (p Partition) LastLBA() uint64 {
+	return p.FirstLBA + p.Sectors - 1
+}
+
+// Extended returns true if p is an extended partition.
+func (p Partition) Extended() bool {
+	return p.Type == TypeExtended || p.Type == TypeExtendedLBA || p.Type == TypeLinuxExtended
+}
+
+// Logical returns true if p is a logical partition.
+func (p Partition) Logical() bool {
+	return p.Number > 4
+}
+
+func (p Partition) String() string {
+	return fmt.Sprintf("Partition(number=%d, type=%#02x, bootable=%t, first=%d, sectors=%d)", p.Number, p.Type, p.Bootable, p.FirstLBA, p.Sectors)
+}
+
+// Table is an MBR partition table.
+type Table struct {
+	BootCode      [bootCodeSize]byte
+	DiskSignature uint32
+	// Partitions are ordered by number.
+	Partitions []Partition
+}
+
+// entry is a partition table entry as it is on disk. Start is relative to
+// the MBR or EBR, or for links to the next EBR, to the extended partition.
+type entry struct {
+	Status   byte
+	FirstCHS [3]byte
+	Type     byte
+	LastCHS  [3]byte
+	Start    uint32
+	Sectors  uint32
+}
+
+func readSector(r io.ReaderAt, lba uint64) ([]byte, error) {
+	b := make([]byte, BlockSize)
+	if _, err := r.ReadAt(b, int64(lba*BlockSize)); err != nil {
+		return nil, fmt.Errorf("reading sector %d: %v", lba, err)
+	}
+	if b[sigOff] != 0x55 || b[sigOff+1] != 0xaa {
+		return nil, fmt.Errorf("no MBR signature in sector %d", lba)
+	}
+	return b, nil
+}
+
+func entries(b []byte) [4]entry {
+	var e [4]entry
+	for i := range e {
+		o := b[entriesOff+i*entrySize:]
+		e[i] = entry{
+			Status:  o[0],
+			Type:    o[4],
+			Start:   binary.LittleEndian.Uint32(o[8:]),
+			Sectors: binary.LittleEndian.Uint32(o[12:]),
+		}
+		copy(e[i].FirstCHS[:], o[1:4])
+		copy(e[i].LastCHS[:], o[5:8])
+	}
+	return e
+}
+
+// Read reads the MBR partition table of the disk in r, following the EBR
+// chain of an extended partition.
+func Read(r io.ReaderAt) (*Table, error) {
+	b, err := readSector(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{DiskSignature: binary.LittleEndian.Uint32(b[bootCodeSize:])}
+	copy(t.BootCode[:], b)
+
+	for i, e := range entries(b) {
+		// Boot sectors of file systems like FAT also end in the MBR
+		// signature, but rarely have valid status bytes.
+		if e.Status != 0 && e.Status != 0x80 {
+			return nil, fmt.Errorf("invalid status %#x of partition %d", e.Status, i+1)
+		}
+		if e.Type == TypeEmpty || e.Sectors == 0 {
+			continue
+		}
+		p := Partition{Number: i + 1, Bootable: e.Status&0x80 != 0, Type: e.Type, FirstLBA: uint64(e.Start), Sectors: uint64(e.Sectors)}
+		t.Partitions = append(t.Partitions, p)
+	}
+	ext := t.Extended()
+	if ext == nil {
+		return t, nil
+	}
+
+	extFirst, extLast := ext.FirstLBA, ext.LastLBA()
+	seen := map[uint64]bool{}
+	for ebr, n := extFirst, 5; ; {
+		if seen[ebr] {
+			return nil, fmt.Errorf("EBR chain loops at sector %d", ebr)
+		}
+		seen[ebr] = true
+		b, err := readSector(r, ebr)
+		if err != nil {
+			return nil, err
+		}
+		e := entries(b)
+		if e[0].Type != TypeEmpty && e[0].Sectors != 0 {
+			p := Partition{Number: n, Bootable: e[0].Status&0x80 != 0, Type: e[0].Type, FirstLBA: ebr + uint64(e[0].Start), Sectors: uint64(e[0].Sectors), EBR: ebr}
+			if p.LastLBA() > extLast {
+				return nil, fmt.Errorf("logical partition %d ends at sector %d, after the extended partition", n, p.LastLBA())
+			}
+			t.Partitions = append(t.Partitions, p)
+			n++
+		}
+		next := e[1]
+		if !(Partition{Type: next.Type}).Extended() || next.Sectors == 0 {
+			break
+		}
+		if ebr = extFirst + uint64(next.Start); ebr > extLast {
+			return nil, fmt.Errorf("EBR at sector %d is outside the extended partition", ebr)
+		}
+	}
+	return t, nil
+}
+
+// Extended returns the extended partition of t, or nil.
+func (t *Table) Extended() *Partition {
+	for i := range t.Partitions {
+		if !t.Partitions[i].Logical() && t.Partitions[i].Extended() {
+			return &t.Partitions[i]
+		}
+	}
+	return nil
+}
+
+func (t *Table) primaries() []Partition {
+	var p []Partition
+	for _, part := range t.Partitions {
+		if !part.Logical() {
+			p = append(p, part)
+		}
+	}
+	return p
+}
+
+// Protective returns true if t is the protective MBR of a GPT disk: a single
+// partition of type 0xee.
+func (t *Table) Protective() bool {
+	p := t.primaries()
+	return len(p) == 1 && p[0].Type == TypeGPT
+}
+
+// Hybrid returns true if t is a hybrid MBR, which mirrors some GPT partitions
+// next to a partition of type 0xee for firmware that does not know GPTs.
+func (t *Table) Hybrid() bool {
+	p := t.primaries()
+	for _, part := range p {
+		if part.Type == TypeGPT {
+			return len(p) > 1
+		}
+	}
+	return false
+}
+
+// Validate checks that partition numbers are consistent and that partitions
+// do not overlap.
+func (t *Table) Validate() error {
+	var extended int
+	var data []Partition
+	logical := 5
+	numbers := map[int]bool{}
+	for _, p := range t.Partitions {
+		switch {
+		case p.Number < 1:
+			return fmt.Errorf("invalid partition number %d", p.Number)
+		case numbers[p.Number]:
+			return fmt.Errorf("partition %d exists twice", p.Number)
+		case p.Sectors == 0 || p.Type == TypeEmpty:
+			return fmt.Errorf("partition %d is empty", p.Number)
+		case p.FirstLBA == 0 || p.LastLBA() > 0xffffffff:
+			return fmt.Errorf("partition %d at sectors %d-%d is out of range", p.Number, p.FirstLBA, p.LastLBA())
+		}
+		numbers[p.Number] = true
+		switch {
+		case p.Logical():
+			if p.Number != logical {
+				return fmt.Errorf("logical partition %d should be %d", p.Number, logical)
+			}
+			logical++
+			data = append(data, p)
+		case p.Extended():
+			extended++
+		default:
+			data = append(data, p)
+		}
+	}
+	ext := t.Extended()
+	switch {
+	case extended > 1:
+		return fmt.Errorf("%d extended partitions, want at most 1", extended)
+	case ext == nil && logical > 5:
+		return fmt.Errorf("logical partitions without an extended partition")
+	}
+
+	sort.Slice(data, func(i, j int) bool { return data[i].FirstLBA < data[j].FirstLBA })
+	for i, p := range data {
+		if i > 0 && p.FirstLBA <= data[i-1].LastLBA() {
+			return fmt.Errorf("partitions %d and %d overlap", data[i-1].Number, p.Number)
+		}
+		inExt := ext != nil && p.FirstLBA >= ext.FirstLBA && p.LastLBA() <= ext.LastLBA()
+		overlapsExt := ext != nil && p.FirstLBA <= ext.LastLBA() && p.LastLBA() >= ext.FirstLBA
+		if p.Logical() && !inExt {
+			return fmt.Errorf("logical partition %d is not in the extended partition", p.Number)
+		}
+		if !p.Logical() && overlapsExt {
+			return fmt.Errorf("primary partition %d overlaps the extended partition", p.Number)
+		}
+	}
+	return nil
+}
+
+// chs returns the cylinder, head and sector address of lba for the usual
+// geometry of 255 heads and 63 sectors, or the maximum if lba is beyond it.
+func chs(lba uint64) [3]byte {
+	const heads, sectors = 255, 63
+	if lba >= 1024*heads*sectors {
+		return [3]byte{0xfe, 0xff, 0xff}
+	}
+	c, h, s := lba/(heads*sectors), lba/sectors%heads, lba%sectors+1
+	return [3]byte{byte(h), byte(s) | byte(c>>8)<<6, byte(c)}
+}
+
+// putEntry writes the entry of p into sector b at slot i. The start of p is
+// stored relative to base.
+func putEntry(b []byte, i int, p Partition, base uint64) {
+	o := b[entriesOff+i*entrySize:]
+	if p.Bootable {
+		o[0] = 0x80
+	}
+	first, last := chs(p.FirstLBA), chs(p.LastLBA())
+	copy(o[1:4], first[:])
+	o[4] = p.Type
+	copy(o[5:8], last[:])
+	binary.LittleEndian.PutUint32(o[8:], uint32(p.FirstLBA-base))
+	binary.LittleEndian.PutUint32(o[12:], uint32(p.Sectors))
+}
+
+// Write validates t and writes its MBR and EBRs to w. The EBR of the first
+// logical partition is the first sector of the extended partition; the
+// others default to the sector before their partition.
+func Write(w io.WriterAt, t *Table) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	var logical []Partition
+	mbr := make([]byte, BlockSize)
+	copy(mbr, t.BootCode[:])
+	binary.LittleEndian.PutUint32(mbr[bootCodeSize:], t.DiskSignature)
+	for _, p := range t.Partitions {
+		if p.Logical() {
+			logical = append(logical, p)
+			continue
+		}
+		putEntry(mbr, p.Number-1, p, 0)
+	}
+	mbr[sigOff], mbr[sigOff+1] = 0x55, 0xaa
+
+	ext := t.Extended()
+	if ext != nil {
+		sort.Slice(logical, func(i, j int) bool { return logical[i].Number < logical[j].Number })
+		for i := range logical {
+			switch {
+			case i == 0:
+				logical[i].EBR = ext.FirstLBA
+			case logical[i].EBR == 0:
+				logical[i].EBR = logical[i].FirstLBA - 1
+			}
+			if ebr := logical[i].EBR; ebr < ext.FirstLBA || ebr >= logical[i].FirstLBA || (i > 0 && ebr <= logical[i-1].LastLBA()) {
+				return fmt.Errorf("EBR of logical partition %d at sector %d is not free", logical[i].Number, ebr)
+			}
+		}
+		// An extended partition without logical partitions still
+		// needs an EBR, to end the chain.
+		if len(logical) == 0 {
+			ebr := make([]byte, BlockSize)
+			ebr[sigOff], ebr[sigOff+1] = 0x55, 0xaa
+			if _, err := w.WriteAt(ebr, int64(ext.FirstLBA*BlockSize)); err != nil {
+				return err
+			}
+		}
+		for i, p := range logical {
+			ebr := make([]byte, BlockSize)
+			putEntry(ebr, 0, p, p.EBR)
+			if i+1 < len(logical) {
+				next := logical[i+1]
+				link := Partition{Type: TypeExtended, FirstLBA: next.EBR, Sectors: next.LastLBA() + 1 - next.EBR}
+				putEntry(ebr, 1, link, ext.FirstLBA)
+			}
+			ebr[sigOff], ebr[sigOff+1] = 0x55, 0xaa
+			if _, err := w.WriteAt(ebr, int64(p.EBR*BlockSize)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.WriteAt(mbr, 0)
+	return err
+}
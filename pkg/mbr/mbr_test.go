@@ -0,0 +1,128 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mbr
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const testSectors = 16384
+
+type memdisk []byte
+
+func (d memdisk) WriteAt(b []byte, off int64) (int, error) {
+	return copy(d[off:], b), nil
+}
+
+func (d memdisk) ReadAt(b []byte, off int64) (int, error) {
+	return bytes.NewReader(d).ReadAt(b, off)
+}
+
+func testTable() *Table {
+	t := &Table{
+		DiskSignature: 0xdeadbeef,
+		Partitions: []Partition{
+			{Number: 1, Bootable: true, Type: 0x0c, FirstLBA: 2048, Sectors: 2048},
+			{Number: 2, Type: TypeExtended, FirstLBA: 4096, Sectors: 8192},
+			{Number: 4, Type: TypeLinux, FirstLBA: 12288, Sectors: 4096},
+			{Number: 5, Type: TypeLinux, FirstLBA: 4097, Sectors: 2047, EBR: 4096},
+			{Number: 6, Type: 0x82, FirstLBA: 8192, Sectors: 2048, EBR: 6144},
+			{Number: 7, Type: TypeLinux, FirstLBA: 10241, Sectors: 2047, EBR: 10240},
+		},
+	}
+	copy(t.BootCode[:], "boot code")
+	return t
+}
+
+func TestReadWrite(t *testing.T) {
+	want := testTable()
+	d := make(memdisk, testSectors*BlockSize)
+	if err := Write(d, want); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	got, err := Read(d)
+	if err != nil {
+		t.Fatalf("Read: got %v, want nil", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read: got\n%v, want\n%v", got.Partitions, want.Partitions)
+	}
+	if got.Protective() || got.Hybrid() {
+		t.Errorf("Read: got a GPT MBR, want a DOS MBR")
+	}
+
+	// The EBR of logical partitions other than the first defaults to the
+	// sector before them.
+	want.Partitions[4].EBR = 0
+	if err := Write(d, want); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	if got, err = Read(d); err != nil {
+		t.Fatalf("Read: got %v, want nil", err)
+	}
+	if ebr := got.Partitions[4].EBR; ebr != 8191 {
+		t.Errorf("Default EBR of partition 6: got %d, want 8191", ebr)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	d := make(memdisk, testSectors*BlockSize)
+	if _, err := Read(d); err == nil {
+		t.Errorf("Read of blank disk: got nil, want error")
+	}
+
+	if err := Write(d, testTable()); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	// Point the link in the second EBR back at the first.
+	copy(d[6144*BlockSize+entriesOff+entrySize+8:], []byte{0, 0, 0, 0})
+	if _, err := Read(d); err == nil {
+		t.Errorf("Read of looping EBR chain: got nil, want error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mangle func(*Table)
+	}{
+		{"overlap", func(t *Table) { t.Partitions[0].Sectors = 3000 }},
+		{"primary in extended", func(t *Table) { t.Partitions[2].FirstLBA = 12000 }},
+		{"logical outside extended", func(t *Table) { t.Partitions[5].Sectors = 3000 }},
+		{"logical numbering", func(t *Table) { t.Partitions[5].Number = 8 }},
+		{"duplicate", func(t *Table) { t.Partitions[2].Number = 1 }},
+		{"empty", func(t *Table) { t.Partitions[0].Type = TypeEmpty }},
+		{"no extended", func(t *Table) { t.Partitions[1].Type = TypeLinux; t.Partitions[1].Sectors = 1 }},
+		{"two extended", func(t *Table) { t.Partitions[2].Type = TypeExtendedLBA }},
+		{"beyond 2TiB", func(t *Table) { t.Partitions[2].Sectors = 1 << 32 }},
+	} {
+		tab := testTable()
+		if err := tab.Validate(); err != nil {
+			t.Fatalf("Validate: got %v, want nil", err)
+		}
+		tt.mangle(tab)
+		if err := tab.Validate(); err == nil {
+			t.Errorf("%s: Validate: got nil, want error", tt.name)
+		}
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	for _, tt := range []struct {
+		parts              []Partition
+		protective, hybrid bool
+	}{
+		{parts: []Partition{{Number: 1, Type: TypeGPT, FirstLBA: 1, Sectors: 0xffffffff}}, protective: true},
+		{parts: []Partition{{Number: 1, Type: 0x0c, FirstLBA: 2048, Sectors: 2048}, {Number: 2, Type: TypeGPT, FirstLBA: 1, Sectors: 2047}}, hybrid: true},
+		{parts: testTable().Partitions},
+	} {
+		tab := &Table{Partitions: tt.parts}
+		if tab.Protective() != tt.protective || tab.Hybrid() != tt.hybrid {
+			t.Errorf("%v: got protective %t, hybrid %t, want %t, %t", tt.parts, tab.Protective(), tab.Hybrid(), tt.protective, tt.hybrid)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/u-root/u-root/pkg/fsprobe"
 	"golang.org/x/sys/unix"
 )
 
@@ -93,14 +94,29 @@ func Mount(dev, path, fsType, data string, flags uintptr) (*MountPoint, error) {
 	}, nil
 }
 
-// TryMount tries to mount a device on the given mountpoint, trying in order
-// the supported block device file systems on the system.
+// TryMount tries to mount a device on the given mountpoint with the file
+// system type found in its superblock or, if there is no known superblock,
+// trying in order the supported block device file systems on the system.
 func TryMount(device, path string, flags uintptr) (*MountPoint, error) {
 	// TryMount only works on existing block devices. No weirdo devices
 	// like 9P.
-	if _, err := os.Stat(device); err != nil {
+	f, err := os.Open(device)
+	if err != nil {
 		return nil, err
 	}
+	info, err := fsprobe.Probe(f)
+	f.Close()
+	switch {
+	case err != nil:
+	case !info.Mountable():
+		return nil, fmt.Errorf("failed to mount %s on %s: %s is not a file system", device, path, info.Type)
+	default:
+		// Kernels may lack the detected driver, e.g. when ext4 mounts
+		// ext3, so failures fall through to trying them all.
+		if mp, err := Mount(device, path, info.Type, "", flags); err == nil {
+			return mp, nil
+		}
+	}
 
 	fs, err := GetBlockFilesystems()
 	if err != nil {
@@ -0,0 +1,131 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd serves block devices to the Linux network block device
+// driver.
+//
+// The kernel speaks the transmission phase of the NBD protocol over a
+// socket handed to it with ioctls; Attach sets that up for /dev/nbdN and
+// answers requests from a Backend such as an iSCSI disk.
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Protocol magic numbers.
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+)
+
+// Request types.
+const (
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+)
+
+// Backend is the storage behind a network block device.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Syncer is implemented by backends that can flush their writes.
+type Syncer interface {
+	Sync() error
+}
+
+type request struct {
+	typ    uint32
+	handle [8]byte
+	from   uint64
+	length uint32
+}
+
+// Serve answers NBD requests on rw from b until the client disconnects.
+//
+// Requests are answered in order. Backend errors are reported to the
+// client as EIO.
+func Serve(rw io.ReadWriter, b Backend) error {
+	hdr := make([]byte, 28)
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(rw, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if m := binary.BigEndian.Uint32(hdr); m != requestMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", m)
+		}
+		var r request
+		// The upper 16 bits are command flags.
+		r.typ = binary.BigEndian.Uint32(hdr[4:]) & 0xffff
+		copy(r.handle[:], hdr[8:16])
+		r.from = binary.BigEndian.Uint64(hdr[16:])
+		r.length = binary.BigEndian.Uint32(hdr[24:])
+
+		if int(r.length) > cap(buf) {
+			buf = make([]byte, r.length)
+		}
+		data := buf[:r.length]
+
+		var err error
+		switch r.typ {
+		case cmdRead:
+			var n int
+			n, err = b.ReadAt(data, int64(r.from))
+			if err == io.EOF {
+				// Reads past the end see zeroes.
+				for i := range data[n:] {
+					data[n+i] = 0
+				}
+				err = nil
+			}
+		case cmdWrite:
+			if _, err := io.ReadFull(rw, data); err != nil {
+				return err
+			}
+			_, err = b.WriteAt(data, int64(r.from))
+			data = nil
+		case cmdFlush:
+			if s, ok := b.(Syncer); ok {
+				err = s.Sync()
+			}
+			data = nil
+		case cmdDisc:
+			return nil
+		default:
+			if err := reply(rw, r.handle, syscall.EINVAL, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var errno syscall.Errno
+		if err != nil {
+			errno, data = syscall.EIO, nil
+		}
+		if err := reply(rw, r.handle, errno, data); err != nil {
+			return err
+		}
+	}
+}
+
+func reply(w io.Writer, handle [8]byte, errno syscall.Errno, data []byte) error {
+	b := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint32(b, replyMagic)
+	binary.BigEndian.PutUint32(b[4:], uint32(errno))
+	copy(b[8:], handle[:])
+	copy(b[16:], data)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls of the nbd driver, from linux/nbd.h.
+const (
+	nbdSetSock       = 0xab00
+	nbdSetBlksize    = 0xab01
+	nbdDoIt          = 0xab03
+	nbdClearSock     = 0xab04
+	nbdClearQue      = 0xab05
+	nbdSetSizeBlocks = 0xab07
+	nbdDisconnect    = 0xab08
+	nbdSetFlags      = 0xab0a
+
+	flagHasFlags  = 1 << 0
+	flagReadOnly  = 1 << 1
+	flagSendFlush = 1 << 2
+)
+
+// Device is a network block device served from a Backend.
+type Device struct {
+	// Path is the device node, e.g. /dev/nbd0.
+	Path string
+
+	f    *os.File
+	done chan error
+}
+
+// Attach serves b as the network block device at path, which has size
+// bytes in blocks of blockSize.
+//
+// The device is usable once Attach returns, until Detach is called.
+func Attach(path string, b Backend, size, blockSize int64, readOnly bool) (*Device, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	kernel, server := fds[0], os.NewFile(uintptr(fds[1]), "nbd")
+
+	flags := flagHasFlags
+	if readOnly {
+		flags |= flagReadOnly
+	}
+	if _, ok := b.(Syncer); ok {
+		flags |= flagSendFlush
+	}
+	fd := int(f.Fd())
+	for _, c := range []struct {
+		req uint
+		arg int
+	}{
+		{nbdSetBlksize, int(blockSize)},
+		{nbdSetSizeBlocks, int(size / blockSize)},
+		{nbdSetFlags, flags},
+		{nbdClearSock, 0},
+		{nbdSetSock, kernel},
+	} {
+		if err := unix.IoctlSetInt(fd, c.req, c.arg); err != nil {
+			f.Close()
+			unix.Close(kernel)
+			server.Close()
+			return nil, fmt.Errorf("nbd: ioctl %#x on %s: %v", c.req, path, err)
+		}
+	}
+
+	d := &Device{Path: path, f: f, done: make(chan error, 1)}
+	go func() {
+		if err := Serve(server, b); err != nil {
+			log.Printf("nbd: serving %s: %v", path, err)
+		}
+		server.Close()
+	}()
+	go func() {
+		// NBD_DO_IT runs the device until it is disconnected.
+		err := unix.IoctlSetInt(fd, nbdDoIt, 0)
+		unix.IoctlSetInt(fd, nbdClearQue, 0)
+		unix.IoctlSetInt(fd, nbdClearSock, 0)
+		unix.Close(kernel)
+		d.done <- err
+	}()
+	return d, nil
+}
+
+// Detach disconnects the device and waits for the kernel to let go of it.
+func (d *Device) Detach() error {
+	defer d.f.Close()
+	if err := unix.IoctlSetInt(int(d.f.Fd()), nbdDisconnect, 0); err != nil {
+		return fmt.Errorf("nbd: disconnecting %s: %v", d.Path, err)
+	}
+	// NBD_DO_IT returns EPIPE or nil depending on kernel version when
+	// disconnected on request.
+	if err := <-d.done; err != nil && err != unix.EPIPE {
+		return fmt.Errorf("nbd: %s: %v", d.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+type memBackend struct {
+	b      []byte
+	synced bool
+}
+
+func (m *memBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	return copy(p, m.b[off:]), nil
+}
+
+func (m *memBackend) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m.b)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m.b[off:], p), nil
+}
+
+func (m *memBackend) Sync() error {
+	m.synced = true
+	return nil
+}
+
+func sendRequest(t *testing.T, w io.Writer, typ uint32, handle byte, from uint64, length uint32, data []byte) {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint32(b, requestMagic)
+	binary.BigEndian.PutUint32(b[4:], typ)
+	b[15] = handle
+	binary.BigEndian.PutUint64(b[16:], from)
+	binary.BigEndian.PutUint32(b[24:], length)
+	if _, err := w.Write(append(b, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readReply(t *testing.T, r io.Reader, handle byte, n int) (syscall.Errno, []byte) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	if m := binary.BigEndian.Uint32(b); m != replyMagic {
+		t.Fatalf("reply magic = %#x, want %#x", m, replyMagic)
+	}
+	if b[15] != handle {
+		t.Fatalf("reply handle = %d, want %d", b[15], handle)
+	}
+	errno := syscall.Errno(binary.BigEndian.Uint32(b[4:]))
+	if errno != 0 {
+		return errno, nil
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return errno, data
+}
+
+func TestServe(t *testing.T) {
+	m := &memBackend{b: make([]byte, 4096)}
+	client, server := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- Serve(server, m)
+	}()
+
+	sendRequest(t, client, cmdWrite, 1, 512, 4, []byte("abcd"))
+	if errno, _ := readReply(t, client, 1, 0); errno != 0 {
+		t.Errorf("write: errno %v", errno)
+	}
+
+	// Command flags in the upper 16 bits are ignored.
+	sendRequest(t, client, 1<<16|cmdRead, 2, 510, 8, nil)
+	if errno, data := readReply(t, client, 2, 8); errno != 0 || !bytes.Equal(data, []byte("\x00\x00abcd\x00\x00")) {
+		t.Errorf("read = %v, %q", errno, data)
+	}
+
+	sendRequest(t, client, cmdWrite, 3, 4094, 4, []byte("wxyz"))
+	if errno, _ := readReply(t, client, 3, 0); errno != syscall.EIO {
+		t.Errorf("write past end: errno %v, want EIO", errno)
+	}
+
+	sendRequest(t, client, cmdFlush, 4, 0, 0, nil)
+	if errno, _ := readReply(t, client, 4, 0); errno != 0 || !m.synced {
+		t.Errorf("flush: errno %v, synced %v", errno, m.synced)
+	}
+
+	sendRequest(t, client, 42, 5, 0, 0, nil)
+	if errno, _ := readReply(t, client, 5, 0); errno != syscall.EINVAL {
+		t.Errorf("unknown command: errno %v, want EINVAL", errno)
+	}
+
+	sendRequest(t, client, cmdDisc, 6, 0, 0, nil)
+	if err := <-done; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netconfig configures network interfaces from dracut-style kernel
+// command line arguments.
+//
+// The supported arguments are
+//
+//	ip={dhcp|on|any|dhcp6|auto6|either6|link6}
+//	ip=<interface>:<method>[:[<mtu>][:<macaddr>]]
+//	ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<hostname>:<interface>:<method>[:[<mtu>][:<macaddr>]]
+//	ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<hostname>:<interface>:<method>[:[<dns1>][:<dns2>]]
+//	bond=<bondname>[:<bondslaves>[:<options>[:<mtu>]]]
+//	vlan=<vlanname>:<phydevice>
+//	bridge=<bridgename>:<ethnames>
+//	nameserver=<IP>
+//
+// as documented in dracut.cmdline(7). IPv6 addresses are written in
+// brackets, e.g. ip=[fd00::2]::[fd00::1]:64::eth0:none. ip= arguments with
+// other methods, such as the kernel's bootp and rarp, are skipped.
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+	"github.com/vishvananda/netlink"
+)
+
+// Methods of getting an address for an interface.
+const (
+	// MethodNone uses the static address, if any.
+	MethodNone = "none"
+	// MethodDHCP gets a DHCPv4 lease.
+	MethodDHCP = "dhcp"
+	// MethodDHCP6 gets a DHCPv6 lease.
+	MethodDHCP6 = "dhcp6"
+	// MethodAuto6 brings the interface up for IPv6 autoconfiguration.
+	MethodAuto6 = "auto6"
+)
+
+// methods maps dracut's method names to the ones implemented here.
+var methods = map[string]string{
+	"":        MethodNone,
+	"none":    MethodNone,
+	"off":     MethodNone,
+	"dhcp":    MethodDHCP,
+	"on":      MethodDHCP,
+	"any":     MethodDHCP,
+	"dhcp6":   MethodDHCP6,
+	"either6": MethodDHCP6,
+	"auto6":   MethodAuto6,
+	"link6":   MethodAuto6,
+}
+
+// IP is the address configuration of an interface from an ip= argument.
+type IP struct {
+	// Interface is the interface name. If it is empty, all interfaces
+	// are configured.
+	Interface string
+
+	// Method is how to get an address, one of the Method constants.
+	Method string
+
+	// Address, Peer, Gateway and Hostname are the static configuration.
+	Address  *net.IPNet
+	Peer     net.IP
+	Gateway  net.IP
+	Hostname string
+
+	// MTU and MAC are set on the interface if not zero.
+	MTU int
+	MAC net.HardwareAddr
+
+	// DNS are name servers.
+	DNS []net.IP
+}
+
+// Bond is a bonding interface from a bond= argument.
+type Bond struct {
+	Name   string
+	Slaves []string
+	MTU    int
+
+	// Options are the bonding driver options, such as mode=802.3ad or
+	// miimon=100.
+	Options map[string]string
+}
+
+// VLAN is a tagged VLAN interface from a vlan= argument.
+type VLAN struct {
+	Name   string
+	Parent string
+	ID     int
+}
+
+// Bridge is a bridge from a bridge= argument.
+type Bridge struct {
+	Name  string
+	Ports []string
+}
+
+// Config is the network configuration from the kernel command line.
+type Config struct {
+	IPs         []IP
+	Bonds       []Bond
+	VLANs       []VLAN
+	Bridges     []Bridge
+	Nameservers []net.IP
+
+	// Unsupported are the ip= arguments that were skipped because of an
+	// unsupported method.
+	Unsupported []string
+}
+
+// Empty returns true if c configures nothing.
+func (c *Config) Empty() bool {
+	return len(c.IPs) == 0 && len(c.Bonds) == 0 && len(c.VLANs) == 0 && len(c.Bridges) == 0 && len(c.Nameservers) == 0
+}
+
+// FromCmdline parses the network configuration of the kernel command line.
+func FromCmdline() (*Config, error) {
+	return ParseCmdline(cmdline.NewCmdLine())
+}
+
+// ParseCmdline parses the network configuration of c.
+func ParseCmdline(c cmdline.CmdLine) (*Config, error) {
+	config := &Config{}
+	for _, v := range c.Values("ip") {
+		ip, err := parseIP(v)
+		if _, ok := err.(methodError); ok {
+			config.Unsupported = append(config.Unsupported, "ip="+v)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ip=%s: %v", v, err)
+		}
+		config.IPs = append(config.IPs, *ip)
+	}
+	for _, v := range c.Values("bond") {
+		b, err := parseBond(v)
+		if err != nil {
+			return nil, fmt.Errorf("bond=%s: %v", v, err)
+		}
+		config.Bonds = append(config.Bonds, *b)
+	}
+	for _, v := range c.Values("vlan") {
+		vlan, err := parseVLAN(v)
+		if err != nil {
+			return nil, fmt.Errorf("vlan=%s: %v", v, err)
+		}
+		config.VLANs = append(config.VLANs, *vlan)
+	}
+	for _, v := range c.Values("bridge") {
+		config.Bridges = append(config.Bridges, parseBridge(v))
+	}
+	for _, v := range c.Values("nameserver") {
+		ip := parseAddr(v)
+		if ip == nil {
+			return nil, fmt.Errorf("nameserver=%s: invalid address", v)
+		}
+		config.Nameservers = append(config.Nameservers, ip)
+	}
+	return config, nil
+}
+
+// splitFields splits s at colons that are not in brackets.
+func splitFields(s string) []string {
+	var (
+		fields   []string
+		start    int
+		brackets bool
+	)
+	for i, c := range s {
+		switch c {
+		case '[':
+			brackets = true
+		case ']':
+			brackets = false
+		case ':':
+			if !brackets {
+				fields = append(fields, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// parseAddr parses an IP address that may be in brackets.
+func parseAddr(s string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// methodError is an unsupported ip= method.
+type methodError string
+
+func (m methodError) Error() string {
+	return fmt.Sprintf("unsupported method %q", string(m))
+}
+
+func parseMethod(s string) (string, error) {
+	m, ok := methods[s]
+	if !ok {
+		return "", methodError(s)
+	}
+	return m, nil
+}
+
+// parseMTUAndMAC parses the optional [<mtu>][:<macaddr>] fields. The MAC
+// address has colons itself.
+func parseMTUAndMAC(ip *IP, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields[0]) > 0 {
+		mtu, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid MTU %q", fields[0])
+		}
+		ip.MTU = mtu
+	}
+	if mac := strings.Join(fields[1:], ":"); len(mac) > 0 {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return err
+		}
+		ip.MAC = hw
+	}
+	return nil
+}
+
+func parseIP(s string) (*IP, error) {
+	fields := splitFields(s)
+
+	// ip=<method>
+	if len(fields) == 1 && parseAddr(fields[0]) == nil {
+		m, err := parseMethod(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return &IP{Method: m}, nil
+	}
+
+	// ip=<interface>:<method>[:[<mtu>][:<macaddr>]]
+	if len(fields[0]) > 0 && parseAddr(fields[0]) == nil {
+		m, err := parseMethod(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		ip := &IP{Interface: fields[0], Method: m}
+		if err := parseMTUAndMAC(ip, fields[2:]); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+
+	// ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<hostname>:<interface>:<method>[...]
+	for len(fields) < 7 {
+		fields = append(fields, "")
+	}
+	ip := &IP{
+		Peer:      parseAddr(fields[1]),
+		Gateway:   parseAddr(fields[2]),
+		Hostname:  fields[4],
+		Interface: fields[5],
+	}
+	if addr := parseAddr(fields[0]); addr != nil {
+		mask, err := parseMask(fields[3], addr)
+		if err != nil {
+			return nil, err
+		}
+		ip.Address = &net.IPNet{IP: addr, Mask: mask}
+	}
+	var err error
+	if ip.Method, err = parseMethod(fields[6]); err != nil {
+		return nil, err
+	}
+
+	rest := fields[7:]
+	if !isDNS(rest) {
+		if err := parseMTUAndMAC(ip, rest); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+	for _, f := range rest {
+		if dns := parseAddr(f); dns != nil {
+			ip.DNS = append(ip.DNS, dns)
+		}
+	}
+	return ip, nil
+}
+
+// isDNS returns true if the fields after the method are [<dns1>][:<dns2>]
+// rather than [<mtu>][:<macaddr>].
+func isDNS(fields []string) bool {
+	if len(fields) == 0 || len(fields) > 2 {
+		return false
+	}
+	for i, f := range fields {
+		if parseAddr(f) == nil && (i > 0 || len(f) > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMask parses a dotted netmask or a prefix length for addr. Without
+// one, IPv4 addresses get their class mask and IPv6 addresses a /64.
+func parseMask(s string, addr net.IP) (net.IPMask, error) {
+	bits := 128
+	if addr.To4() != nil {
+		bits = 32
+	}
+	if len(s) == 0 {
+		if bits == 32 {
+			return addr.DefaultMask(), nil
+		}
+		return net.CIDRMask(64, bits), nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= bits {
+		return net.CIDRMask(n, bits), nil
+	}
+	if m := net.IPMask(parseAddr(s).To4()); m != nil && bits == 32 {
+		if _, b := m.Size(); b == 0 {
+			return nil, fmt.Errorf("non-contiguous netmask %q", s)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("invalid netmask %q", s)
+}
+
+func parseBond(s string) (*Bond, error) {
+	// A bare "bond" argument reads as "1" and means all defaults.
+	if s == "1" {
+		s = ""
+	}
+	fields := splitFields(s)
+	b := &Bond{
+		Name:    "bond0",
+		Slaves:  []string{"eth0", "eth1"},
+		Options: map[string]string{"mode": "balance-rr"},
+	}
+	if len(fields[0]) > 0 {
+		b.Name = fields[0]
+	}
+	if len(fields) > 1 && len(fields[1]) > 0 {
+		b.Slaves = strings.Split(fields[1], ",")
+	}
+	if len(fields) > 2 && len(fields[2]) > 0 {
+		b.Options = make(map[string]string)
+		for _, o := range strings.Split(fields[2], ",") {
+			kv := strings.SplitN(o, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid option %q, want key=value", o)
+			}
+			b.Options[kv[0]] = kv[1]
+		}
+	}
+	if len(fields) > 3 && len(fields[3]) > 0 {
+		mtu, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MTU %q", fields[3])
+		}
+		b.MTU = mtu
+	}
+	if _, err := b.link(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// link returns the netlink bond for b. The primary option is left to the
+// caller, as it needs the slave's interface index.
+func (b *Bond) link() (*netlink.Bond, error) {
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: b.Name, MTU: b.MTU})
+	for k, v := range b.Options {
+		var err error
+		switch k {
+		case "mode":
+			bond.Mode = netlink.StringToBondMode(v)
+			if n, nerr := strconv.Atoi(v); nerr == nil {
+				bond.Mode = netlink.BondMode(n)
+			}
+			if bond.Mode < 0 || bond.Mode >= netlink.BOND_MODE_UNKNOWN {
+				err = fmt.Errorf("unknown mode")
+			}
+		case "xmit_hash_policy":
+			bond.XmitHashPolicy = netlink.StringToBondXmitHashPolicy(v)
+			if bond.XmitHashPolicy == netlink.BOND_XMIT_HASH_POLICY_UNKNOWN {
+				err = fmt.Errorf("unknown policy")
+			}
+		case "lacp_rate":
+			bond.LacpRate = netlink.StringToBondLacpRate(v)
+			if n, nerr := strconv.Atoi(v); nerr == nil {
+				bond.LacpRate = netlink.BondLacpRate(n)
+			}
+			if bond.LacpRate < 0 || bond.LacpRate >= netlink.BOND_LACP_RATE_UNKNOWN {
+				err = fmt.Errorf("unknown rate")
+			}
+		case "miimon":
+			bond.Miimon, err = strconv.Atoi(v)
+		case "updelay":
+			bond.UpDelay, err = strconv.Atoi(v)
+		case "downdelay":
+			bond.DownDelay, err = strconv.Atoi(v)
+		case "min_links":
+			bond.MinLinks, err = strconv.Atoi(v)
+		case "arp_interval":
+			bond.ArpInterval, err = strconv.Atoi(v)
+		case "arp_ip_target":
+			// Several targets are separated by semicolons, as commas
+			// separate options.
+			for _, t := range strings.Split(v, ";") {
+				ip := net.ParseIP(t)
+				if ip == nil {
+					err = fmt.Errorf("invalid address %q", t)
+					break
+				}
+				bond.ArpIpTargets = append(bond.ArpIpTargets, ip)
+			}
+		case "primary":
+		default:
+			err = fmt.Errorf("unsupported option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bond option %s=%s: %v", k, v, err)
+		}
+	}
+	return bond, nil
+}
+
+func parseVLAN(s string) (*VLAN, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+		return nil, fmt.Errorf("want <vlanname>:<phydevice>")
+	}
+	// The VLAN ID is the number at the end of names like vlan0005,
+	// vlan5, eth0.0005 or eth0.5.
+	id := strings.TrimPrefix(fields[0], "vlan")
+	if i := strings.LastIndex(fields[0], "."); i >= 0 {
+		id = fields[0][i+1:]
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 || n > 4094 {
+		return nil, fmt.Errorf("no VLAN ID in name %q", fields[0])
+	}
+	return &VLAN{Name: fields[0], Parent: fields[1], ID: n}, nil
+}
+
+func parseBridge(s string) Bridge {
+	b := Bridge{Name: "br0", Ports: []string{"eth0"}}
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields[0]) > 0 && s != "1" {
+		b.Name = fields[0]
+	}
+	if len(fields) > 1 && len(fields[1]) > 0 {
+		b.Ports = strings.Split(fields[1], ",")
+	}
+	return b
+}
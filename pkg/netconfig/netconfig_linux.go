@@ -0,0 +1,278 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconfig
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Apply creates the bonds, VLANs and bridges of c, in that order so that
+// VLANs can be on bonds and bridges can have either as ports. It then
+// configures the addresses, getting DHCP leases with dc where asked to,
+// and writes the name servers to resolv.conf.
+//
+// Interfaces that already have a global IPv4 address, e.g. from the kernel's
+// own ip=dhcp autoconfiguration, get no DHCPv4 lease.
+//
+// Apply returns the configured DHCP leases.
+func (c *Config) Apply(ctx context.Context, dc dhclient.Config) ([]dhclient.Lease, error) {
+	for _, b := range c.Bonds {
+		if err := b.create(); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range c.VLANs {
+		if err := v.create(); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range c.Bridges {
+		if err := b.create(); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		dhcp4, dhcp6 []netlink.Link
+		nameservers  = c.Nameservers
+	)
+	for _, ip := range c.IPs {
+		links, err := ip.links()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			if err := ip.configure(l); err != nil {
+				return nil, err
+			}
+			switch ip.Method {
+			case MethodDHCP:
+				if hasGlobalAddr(l, netlink.FAMILY_V4) {
+					log.Printf("%s already has an IPv4 address, skipping DHCP", l.Attrs().Name)
+					continue
+				}
+				dhcp4 = append(dhcp4, l)
+			case MethodDHCP6:
+				dhcp6 = append(dhcp6, l)
+			}
+		}
+		nameservers = append(nameservers, ip.DNS...)
+	}
+
+	var leases []dhclient.Lease
+	for _, r := range []chan *dhclient.Result{
+		dhclient.SendRequests(ctx, dhcp4, true, false, dc),
+		dhclient.SendRequests(ctx, dhcp6, false, true, dc),
+	} {
+		for result := range r {
+			if result.Err != nil {
+				log.Printf("Could not get %s lease on %s: %v", result.Protocol, result.Interface.Attrs().Name, result.Err)
+				continue
+			}
+			if err := result.Lease.Configure(); err != nil {
+				log.Printf("Could not configure %s lease on %s: %v", result.Protocol, result.Interface.Attrs().Name, err)
+				continue
+			}
+			leases = append(leases, result.Lease)
+		}
+	}
+	if len(leases) == 0 && len(dhcp4)+len(dhcp6) > 0 {
+		return nil, fmt.Errorf("no DHCP leases")
+	}
+
+	// Explicit name servers take precedence over the DHCP ones, which
+	// Configure wrote.
+	if len(nameservers) > 0 {
+		if err := dhclient.WriteDNSSettings(nameservers, nil, ""); err != nil {
+			return leases, err
+		}
+	}
+	return leases, nil
+}
+
+// hasGlobalAddr returns true if l has a global address of the family.
+func hasGlobalAddr(l netlink.Link, family int) bool {
+	addrs, err := netlink.AddrList(l, family)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// linkUp returns the link called name after bringing it up.
+func linkUp(name string) (netlink.Link, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return nil, fmt.Errorf("cannot bring up %s: %v", name, err)
+	}
+	return l, nil
+}
+
+// addLink adds l unless an interface of its name already exists, and
+// returns the link as the kernel sees it.
+func addLink(l netlink.Link) (netlink.Link, error) {
+	name := l.Attrs().Name
+	if _, err := netlink.LinkByName(name); err != nil {
+		if err := netlink.LinkAdd(l); err != nil {
+			return nil, fmt.Errorf("cannot add %s %s: %v", l.Type(), name, err)
+		}
+	}
+	return netlink.LinkByName(name)
+}
+
+// enslave adds the port called name to master. Bonds only take slaves that
+// are down, and bring them up themselves.
+func enslave(name string, master netlink.Link) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("interface %s: %v", name, err)
+	}
+	if l.Attrs().MasterIndex == master.Attrs().Index {
+		return nil
+	}
+	if err := netlink.LinkSetDown(l); err != nil {
+		return fmt.Errorf("cannot bring down %s: %v", name, err)
+	}
+	if err := netlink.LinkSetMaster(l, master); err != nil {
+		return fmt.Errorf("cannot add %s to %s: %v", name, master.Attrs().Name, err)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return fmt.Errorf("cannot bring up %s: %v", name, err)
+	}
+	return nil
+}
+
+func (b *Bond) create() error {
+	bond, err := b.link()
+	if err != nil {
+		return err
+	}
+	l, err := addLink(bond)
+	if err != nil {
+		return err
+	}
+	for _, s := range b.Slaves {
+		if err := enslave(s, l); err != nil {
+			return err
+		}
+	}
+	if primary, ok := b.Options["primary"]; ok {
+		// netlink only sets the primary on new bonds, which have no
+		// slaves yet, so it goes through sysfs.
+		if err := ioutil.WriteFile(filepath.Join("/sys/class/net", b.Name, "bonding/primary"), []byte(primary), 0); err != nil {
+			return fmt.Errorf("cannot set primary %s of bond %s: %v", primary, b.Name, err)
+		}
+	}
+	_, err = linkUp(b.Name)
+	return err
+}
+
+func (v *VLAN) create() error {
+	parent, err := linkUp(v.Parent)
+	if err != nil {
+		return err
+	}
+	if _, err := addLink(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: v.Name, ParentIndex: parent.Attrs().Index},
+		VlanId:    v.ID,
+	}); err != nil {
+		return err
+	}
+	_, err = linkUp(v.Name)
+	return err
+}
+
+func (b *Bridge) create() error {
+	l, err := addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: b.Name}})
+	if err != nil {
+		return err
+	}
+	for _, p := range b.Ports {
+		if err := enslave(p, l); err != nil {
+			return err
+		}
+	}
+	_, err = linkUp(b.Name)
+	return err
+}
+
+// links returns the interfaces ip configures: the named one, or all but
+// loopback and ports of bonds and bridges.
+func (ip *IP) links() ([]netlink.Link, error) {
+	if len(ip.Interface) > 0 {
+		l, err := netlink.LinkByName(ip.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %v", ip.Interface, err)
+		}
+		return []netlink.Link{l}, nil
+	}
+	all, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var links []netlink.Link
+	for _, l := range all {
+		if l.Attrs().Flags&net.FlagLoopback == 0 && l.Attrs().MasterIndex == 0 {
+			links = append(links, l)
+		}
+	}
+	return links, nil
+}
+
+// configure sets the MTU, MAC and static configuration of ip on l and
+// brings it up.
+func (ip *IP) configure(l netlink.Link) error {
+	name := l.Attrs().Name
+	if ip.MTU > 0 {
+		if err := netlink.LinkSetMTU(l, ip.MTU); err != nil {
+			return fmt.Errorf("cannot set MTU of %s: %v", name, err)
+		}
+	}
+	if ip.MAC != nil {
+		if err := netlink.LinkSetHardwareAddr(l, ip.MAC); err != nil {
+			return fmt.Errorf("cannot set MAC address of %s: %v", name, err)
+		}
+	}
+	if _, err := dhclient.IfUp(name); err != nil {
+		return err
+	}
+	if ip.Address != nil {
+		addr := &netlink.Addr{IPNet: ip.Address}
+		if ip.Peer != nil {
+			addr.Peer = &net.IPNet{IP: ip.Peer, Mask: ip.Address.Mask}
+		}
+		if err := netlink.AddrReplace(l, addr); err != nil {
+			return fmt.Errorf("cannot add %v to %s: %v", ip.Address, name, err)
+		}
+	}
+	if ip.Gateway != nil {
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: l.Attrs().Index, Gw: ip.Gateway}); err != nil {
+			return fmt.Errorf("cannot add default route via %v on %s: %v", ip.Gateway, name, err)
+		}
+	}
+	if len(ip.Hostname) > 0 {
+		if err := unix.Sethostname([]byte(ip.Hostname)); err != nil {
+			return fmt.Errorf("cannot set hostname %q: %v", ip.Hostname, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconfig
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+	"github.com/vishvananda/netlink"
+)
+
+func mustMAC(s string) net.HardwareAddr {
+	hw, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return hw
+}
+
+func TestParseCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		cmdline string
+		want    *Config
+	}{
+		{
+			cmdline: "console=ttyS0 root=/dev/sda1",
+			want:    &Config{},
+		},
+		{
+			cmdline: "ip=dhcp ip=eth1:dhcp6 ip=eth2:auto6:9000 ip=eth3:on::52:54:00:12:34:56",
+			want: &Config{IPs: []IP{
+				{Method: MethodDHCP},
+				{Interface: "eth1", Method: MethodDHCP6},
+				{Interface: "eth2", Method: MethodAuto6, MTU: 9000},
+				{Interface: "eth3", Method: MethodDHCP, MAC: mustMAC("52:54:00:12:34:56")},
+			}},
+		},
+		{
+			cmdline: "ip=eth0:bootp ip=eth1:dhcp ip=eth2:ibft vlan=eth1.5:eth1",
+			want: &Config{
+				IPs:         []IP{{Interface: "eth1", Method: MethodDHCP}},
+				VLANs:       []VLAN{{Name: "eth1.5", Parent: "eth1", ID: 5}},
+				Unsupported: []string{"ip=eth0:bootp", "ip=eth2:ibft"},
+			},
+		},
+		{
+			cmdline: "ip=192.168.1.2::192.168.1.1:255.255.255.0:node1:eth0:none:10.0.0.1:10.0.0.2 nameserver=10.0.0.3",
+			want: &Config{
+				IPs: []IP{{
+					Interface: "eth0",
+					Method:    MethodNone,
+					Address:   &net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)},
+					Gateway:   net.ParseIP("192.168.1.1"),
+					Hostname:  "node1",
+					DNS:       []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+				}},
+				Nameservers: []net.IP{net.ParseIP("10.0.0.3")},
+			},
+		},
+		{
+			cmdline: "ip=[fd00::2]::[fd00::1]:48::bond0.100:off:1500",
+			want: &Config{IPs: []IP{{
+				Interface: "bond0.100",
+				Method:    MethodNone,
+				Address:   &net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(48, 128)},
+				Gateway:   net.ParseIP("fd00::1"),
+				MTU:       1500,
+			}}},
+		},
+		{
+			cmdline: "ip=10.1.2.3:::::eth0:dhcp nameserver=[fd00::53]",
+			want: &Config{
+				IPs: []IP{{
+					Interface: "eth0",
+					Method:    MethodDHCP,
+					Address:   &net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)},
+				}},
+				Nameservers: []net.IP{net.ParseIP("fd00::53")},
+			},
+		},
+		{
+			cmdline: "bond=bond0:eth0,eth1:mode=802.3ad,miimon=100,xmit_hash_policy=layer3+4:9000 vlan=bond0.100:bond0 vlan=vlan0200:eth2 bridge=br0:bond0.100,eth3 ip=br0:dhcp",
+			want: &Config{
+				IPs: []IP{{Interface: "br0", Method: MethodDHCP}},
+				Bonds: []Bond{{
+					Name:    "bond0",
+					Slaves:  []string{"eth0", "eth1"},
+					MTU:     9000,
+					Options: map[string]string{"mode": "802.3ad", "miimon": "100", "xmit_hash_policy": "layer3+4"},
+				}},
+				VLANs: []VLAN{
+					{Name: "bond0.100", Parent: "bond0", ID: 100},
+					{Name: "vlan0200", Parent: "eth2", ID: 200},
+				},
+				Bridges: []Bridge{{Name: "br0", Ports: []string{"bond0.100", "eth3"}}},
+			},
+		},
+		{
+			cmdline: "bond bridge",
+			want: &Config{
+				Bonds: []Bond{{
+					Name:    "bond0",
+					Slaves:  []string{"eth0", "eth1"},
+					Options: map[string]string{"mode": "balance-rr"},
+				}},
+				Bridges: []Bridge{{Name: "br0", Ports: []string{"eth0"}}},
+			},
+		},
+	} {
+		t.Run(tt.cmdline, func(t *testing.T) {
+			got, err := ParseCmdline(cmdline.CmdLine{Raw: tt.cmdline})
+			if err != nil {
+				t.Fatalf("ParseCmdline() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCmdline() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCmdlineErrors(t *testing.T) {
+	for _, tt := range []string{
+		"ip=eth0:dhcp:jumbo",
+		"ip=eth0:dhcp:1500:zz:zz",
+		"ip=10.0.0.2::10.0.0.1:255.0.255.0::eth0:none",
+		"ip=10.0.0.2::10.0.0.1:33::eth0:none",
+		"bond=bond0:eth0:mode=fast",
+		"bond=bond0:eth0:miimon",
+		"bond=bond0:eth0:colour=blue",
+		"bond=bond0:eth0:mode=4:big",
+		"vlan=eth0",
+		"vlan=vlan:eth0",
+		"vlan=eth0.5000:eth0",
+		"nameserver=dns.example.com",
+	} {
+		if got, err := ParseCmdline(cmdline.CmdLine{Raw: tt}); err == nil {
+			t.Errorf("ParseCmdline(%q) = %+v, want error", tt, got)
+		}
+	}
+}
+
+func TestBondLink(t *testing.T) {
+	b := &Bond{Name: "bond1", Options: map[string]string{
+		"mode":          "4",
+		"lacp_rate":     "fast",
+		"arp_ip_target": "10.0.0.1;10.0.0.2",
+		"primary":       "eth0",
+	}}
+	bond, err := b.link()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bond.Mode != netlink.BOND_MODE_802_3AD || bond.LacpRate != netlink.BOND_LACP_RATE_FAST || len(bond.ArpIpTargets) != 2 {
+		t.Errorf("link() = %+v, want 802.3ad with fast LACP and two ARP targets", bond)
+	}
+	if bond.Miimon != -1 {
+		t.Errorf("Miimon = %d, want -1 (unset)", bond.Miimon)
+	}
+}
@@ -6,7 +6,6 @@ package storage
 
 import (
 	"bufio"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +18,7 @@ import (
 	"strings"
 
 	"github.com/rekby/gpt"
+	"github.com/u-root/u-root/pkg/fsprobe"
 	"github.com/u-root/u-root/pkg/mount"
 )
 
@@ -33,16 +33,23 @@ type BlockDev struct {
 	FSType string
 	Stat   BlockStat
 	FsUUID string
+
+	// FsLabel is the file system label. PartUUID is the unique ID of
+	// the partition in its GPT or MBR partition table, if any, and
+	// PartLabel its GPT partition name.
+	FsLabel   string
+	PartUUID  string
+	PartLabel string
 }
 
 // String implements fmt.Stringer.
 func (b BlockDev) String() string {
-	return fmt.Sprintf("BlockDevice(name=%s, fs_uuid=%s)", b.Name, b.FsUUID)
+	return fmt.Sprintf("BlockDevice(name=%s, fs_type=%s, fs_uuid=%s, fs_label=%s, part_uuid=%s, part_label=%s)", b.Name, b.FSType, b.FsUUID, b.FsLabel, b.PartUUID, b.PartLabel)
 }
 
 // Mount implements mount.Mounter.
 func (b BlockDev) Mount(path string, flags uintptr) (*mount.MountPoint, error) {
-	devpath := filepath.Join("/dev", b.Name)
+	devpath := b.DevicePath()
 	if len(b.FSType) > 0 {
 		return mount.Mount(devpath, path, b.FSType, "", flags)
 	}
@@ -185,136 +192,75 @@ func GetBlockStats() ([]BlockDev, error) {
 		if err != nil {
 			return nil, err
 		}
-		devpath := path.Join("/dev/", devname)
-		if uuid, err := getUUID(devpath); err != nil {
-			blockdevs = append(blockdevs, BlockDev{Name: devname, Stat: *bstat})
-		} else {
-			blockdevs = append(blockdevs, BlockDev{Name: devname, Stat: *bstat, FsUUID: uuid})
+		dev := BlockDev{Name: devname, Stat: *bstat}
+		dev.PartUUID, dev.PartLabel = partInfo(devname)
+		if info, err := probe(path.Join("/dev/", devname)); err == nil {
+			dev.FsUUID = info.UUID
+			dev.FsLabel = info.Label
+			// Only file systems are mounted with their type. Others,
+			// like swap or LUKS, are still identified by their UUID.
+			if info.Mountable() {
+				dev.FSType = info.Type
+			}
 		}
+		blockdevs = append(blockdevs, dev)
 	}
 	return blockdevs, nil
 }
 
-func getUUID(devpath string) (string, error) {
+func probe(devpath string) (*fsprobe.Info, error) {
 	file, err := os.Open(devpath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
-
-	fsuuid, err := tryVFAT(file)
-	if err == nil {
-		return fsuuid, nil
-	}
-	fsuuid, err = tryEXT4(file)
-	if err == nil {
-		return fsuuid, nil
-	}
-	fsuuid, err = tryXFS(file)
-	if err == nil {
-		return fsuuid, nil
-	}
-	return "", fmt.Errorf("unknown UUID (not vfat, ext4, nor xfs)")
+	return fsprobe.Probe(file)
 }
 
-// See https://www.nongnu.org/ext2-doc/ext2.html#DISK-ORGANISATION.
-const (
-	// Offset of superblock in partition.
-	ext2SprblkOff = 1024
-
-	// Offset of magic number in suberblock.
-	ext2SprblkMagicOff  = 56
-	ext2SprblkMagicSize = 2
-
-	ext2SprblkMagic = 0xEF53
-
-	// Offset of UUID in superblock.
-	ext2SprblkUUIDOff  = 104
-	ext2SprblkUUIDSize = 16
-)
-
-func tryEXT4(file io.ReaderAt) (string, error) {
-	var off int64
-
-	// Read magic number.
-	b := make([]byte, ext2SprblkMagicSize)
-	off = ext2SprblkOff + ext2SprblkMagicOff
-	if _, err := file.ReadAt(b, off); err != nil {
-		return "", err
-	}
-	magic := binary.LittleEndian.Uint16(b[:2])
-	if magic != ext2SprblkMagic {
-		return "", fmt.Errorf("ext4 magic not found")
+// partInfo returns the PARTUUID and PARTLABEL of devname if it is a
+// partition.
+func partInfo(devname string) (string, string) {
+	sys := filepath.Join("/sys/class/block", devname)
+	b, err := ioutil.ReadFile(filepath.Join(sys, "partition"))
+	if err != nil {
+		return "", ""
 	}
-
-	// Filesystem UUID.
-	b = make([]byte, ext2SprblkUUIDSize)
-	off = ext2SprblkOff + ext2SprblkUUIDOff
-	if _, err := file.ReadAt(b, off); err != nil {
-		return "", err
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return "", ""
 	}
-
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
-}
-
-// See https://de.wikipedia.org/wiki/File_Allocation_Table#Aufbau.
-const (
-	fat32Magic = "FAT32   "
-
-	// Offset of magic number.
-	fat32MagicOff  = 82
-	fat32MagicSize = 8
-
-	// Offset of filesystem ID / serial number. Treated as short filesystem UUID.
-	fat32IDOff  = 67
-	fat32IDSize = 4
-)
-
-func tryVFAT(file io.ReaderAt) (string, error) {
-	// Read magic number.
-	b := make([]byte, fat32MagicSize)
-	if _, err := file.ReadAt(b, fat32MagicOff); err != nil {
-		return "", err
+	// Partitions are subdirectories of their disk in sysfs.
+	real, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return "", ""
 	}
-	magic := string(b)
-	if magic != fat32Magic {
-		return "", fmt.Errorf("fat32 magic not found")
+	disk, err := os.Open(filepath.Join("/dev", filepath.Base(filepath.Dir(real))))
+	if err != nil {
+		return "", ""
 	}
-
-	// Filesystem UUID.
-	b = make([]byte, fat32IDSize)
-	if _, err := file.ReadAt(b, fat32IDOff); err != nil {
-		return "", err
+	defer disk.Close()
+	uuid, label, err := partInfoFromTable(disk, n)
+	if err != nil {
+		return "", ""
 	}
-
-	return fmt.Sprintf("%02x%02x-%02x%02x", b[3], b[2], b[1], b[0]), nil
+	return uuid, label
 }
 
-const (
-	xfsMagic     = "XFSB"
-	xfsMagicSize = 4
-	xfsUUIDOff   = 32
-	xfsUUIDSize  = 16
-)
-
-func tryXFS(file io.ReaderAt) (string, error) {
-	// Read magic number.
-	b := make([]byte, xfsMagicSize)
-	if _, err := file.ReadAt(b, 0); err != nil {
-		return "", err
-	}
-	magic := string(b)
-	if magic != xfsMagic {
-		return "", fmt.Errorf("xfs magic not found")
+// partInfoFromTable returns the PARTUUID and PARTLABEL of partition n of the
+// disk in r. In a GPT they are the unique GUID and name of the partition. MBR
+// partitions have no label, and their PARTUUID is the disk signature and
+// partition number.
+func partInfoFromTable(r io.ReaderAt, n int) (string, string, error) {
+	table, err := ReadPartitionTable(r)
+	if err != nil {
+		return "", "", err
 	}
-
-	// Filesystem UUID.
-	b = make([]byte, xfsUUIDSize)
-	if _, err := file.ReadAt(b, xfsUUIDOff); err != nil {
-		return "", err
+	for _, p := range table.Partitions() {
+		if p.Number == n {
+			return p.UUID, p.Label, nil
+		}
 	}
-
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	return "", "", fmt.Errorf("no %s partition %d", table.Type(), n)
 }
 
 // GetGPTTable tries to read a GPT table from the block device described by the
@@ -342,20 +288,18 @@ func FilterEFISystemPartitions(devices []BlockDev) ([]BlockDev, error) {
 }
 
 // PartitionsByGUID returns a list of BlockDev objects whose underlying
-// block device has the given GUID
+// block device has a partition of the given type: a GPT type GUID, compared
+// case-insensitively, or an MBR type like 0x83.
 func PartitionsByGUID(devices []BlockDev, guid string) ([]BlockDev, error) {
 	partitions := make([]BlockDev, 0)
 	for _, device := range devices {
-		table, err := GetGPTTable(device)
+		table, err := GetPartitionTable(device)
 		if err != nil {
 			log.Printf("Skipping %s: %v", device.Name, err)
 			continue
 		}
-		for _, part := range table.Partitions {
-			if part.IsEmpty() {
-				continue
-			}
-			if part.Type.String() == guid {
+		for _, part := range table.Partitions() {
+			if strings.EqualFold(part.Type, guid) {
 				partitions = append(partitions, device)
 			}
 		}
@@ -364,11 +308,12 @@ func PartitionsByGUID(devices []BlockDev, guid string) ([]BlockDev, error) {
 }
 
 // PartitionsByFsUUID returns a list of BlockDev objects whose underlying
-// block device has a filesystem with the given UUID
+// block device has a filesystem with the given UUID. UUIDs are compared
+// case-insensitively, as FAT and NTFS serial numbers are upper case.
 func PartitionsByFsUUID(devices []BlockDev, fsuuid string) []BlockDev {
 	partitions := make([]BlockDev, 0)
 	for _, device := range devices {
-		if device.FsUUID == fsuuid {
+		if strings.EqualFold(device.FsUUID, fsuuid) {
 			partitions = append(partitions, device)
 		}
 	}
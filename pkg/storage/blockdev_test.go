@@ -5,8 +5,12 @@
 package storage
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"testing"
 
+	"github.com/rekby/gpt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +55,67 @@ func TestBlockStatFromBytesNotEnoughFields(t *testing.T) {
 	_, err := BlockStatFromBytes(input)
 	require.Error(t, err)
 }
+
+func TestPartInfoFromMBR(t *testing.T) {
+	mbr := make([]byte, 512)
+	copy(mbr[440:], []byte{0xef, 0xbe, 0xad, 0xde})
+	// Partition 2 is of type 0x83 at sector 2048.
+	copy(mbr[446+16:], []byte{0, 0, 0, 0, 0x83, 0, 0, 0, 0, 0x08, 0, 0, 0, 0x08, 0, 0})
+	mbr[510], mbr[511] = 0x55, 0xaa
+	uuid, label, err := partInfoFromTable(bytes.NewReader(mbr), 2)
+	require.NoError(t, err)
+	require.Equal(t, "deadbeef-02", uuid)
+	require.Empty(t, label)
+
+	_, _, err = partInfoFromTable(bytes.NewReader(mbr), 1)
+	require.Error(t, err)
+
+	_, _, err = partInfoFromTable(bytes.NewReader(make([]byte, 4096)), 1)
+	require.Error(t, err)
+}
+
+func TestPartInfoFromGPT(t *testing.T) {
+	f, err := ioutil.TempFile("", "gpt")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	id, err := gpt.StringToGuid("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	require.NoError(t, err)
+	table := gpt.Table{
+		SectorSize: 512,
+		Header: gpt.Header{
+			Revision:                0x10000,
+			Size:                    92,
+			HeaderStartLBA:          1,
+			PartitionsTableStartLBA: 2,
+			PartitionsArrLen:        4,
+			PartitionEntrySize:      128,
+			TrailingBytes:           make([]byte, 512-92),
+		},
+		Partitions: make([]gpt.Partition, 4),
+	}
+	copy(table.Header.Signature[:], "EFI PART")
+	table.Partitions[1].Type = gpt.PartType(id)
+	table.Partitions[1].Id = id
+	copy(table.Partitions[1].PartNameUTF16[:], []byte{'r', 0, 'o', 0, 'o', 0, 't', 0})
+	require.NoError(t, table.Write(f))
+
+	uuid, label, err := partInfoFromTable(f, 2)
+	require.NoError(t, err)
+	require.Equal(t, "0fc63daf-8483-4772-8e79-3d69d8477de4", uuid)
+	require.Equal(t, "root", label)
+
+	_, _, err = partInfoFromTable(f, 5)
+	require.Error(t, err)
+}
+
+func TestPartitionsByFsUUID(t *testing.T) {
+	devices := []BlockDev{
+		{Name: "sda1", FsUUID: "ABCD-1234"},
+		{Name: "sda2", FsUUID: "12345678-9abc-def0-0123-456789abcdef"},
+	}
+	require.Equal(t, devices[:1], PartitionsByFsUUID(devices, "abcd-1234"))
+	require.Equal(t, devices[1:], PartitionsByFsUUID(devices, "12345678-9ABC-DEF0-0123-456789ABCDEF"))
+	require.Empty(t, PartitionsByFsUUID(devices, "0000-0000"))
+}
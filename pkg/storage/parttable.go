@@ -0,0 +1,127 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/rekby/gpt"
+	"github.com/u-root/u-root/pkg/mbr"
+)
+
+// PartitionTable is a GPT or MBR partition table.
+type PartitionTable interface {
+	// Type returns "gpt" or "dos", as blkid names them.
+	Type() string
+	// UUID returns the disk GUID of a GPT or the disk signature of an MBR.
+	UUID() string
+	// Partitions returns the partitions in use.
+	Partitions() []Partition
+}
+
+// Partition is an entry of a PartitionTable, as the kernel numbers it.
+// Sectors are 512 bytes.
+type Partition struct {
+	Number   int
+	FirstLBA uint64
+	Sectors  uint64
+	// Type is the type GUID of GPT partitions and the type byte, like
+	// 0x83, of MBR partitions.
+	Type string
+	// UUID and Label are the PARTUUID and PARTLABEL of the partition.
+	UUID  string
+	Label string
+}
+
+// ReadPartitionTable reads the partition table of the disk in r. A GPT is
+// preferred over a protective or hybrid MBR, as the kernel does.
+func ReadPartitionTable(r io.ReaderAt) (PartitionTable, error) {
+	m, merr := mbr.Read(r)
+	if merr == nil && !m.Protective() && !m.Hybrid() {
+		return dosTable{m}, nil
+	}
+	sr := io.NewSectionReader(r, 0, math.MaxInt64)
+	if _, err := sr.Seek(512, io.SeekStart); err != nil {
+		return nil, err
+	}
+	table, err := gpt.ReadTable(sr, 512)
+	if err != nil {
+		if merr != nil {
+			return nil, fmt.Errorf("no GPT or MBR partition table")
+		}
+		return nil, fmt.Errorf("MBR has a GPT partition, but the GPT is invalid: %v", err)
+	}
+	return gptTable{table}, nil
+}
+
+// GetPartitionTable reads the GPT or MBR partition table of device.
+func GetPartitionTable(device BlockDev) (PartitionTable, error) {
+	f, err := os.Open(device.DevicePath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPartitionTable(f)
+}
+
+type gptTable struct {
+	gpt.Table
+}
+
+func (t gptTable) Type() string {
+	return "gpt"
+}
+
+func (t gptTable) UUID() string {
+	return strings.ToLower(t.Header.DiskGUID.String())
+}
+
+func (t gptTable) Partitions() []Partition {
+	var parts []Partition
+	for i, p := range t.Table.Partitions {
+		if p.IsEmpty() {
+			continue
+		}
+		parts = append(parts, Partition{
+			Number:   i + 1,
+			FirstLBA: p.FirstLBA,
+			Sectors:  p.LastLBA - p.FirstLBA + 1,
+			Type:     strings.ToLower(p.Type.String()),
+			UUID:     strings.ToLower(p.Id.String()),
+			Label:    p.Name(),
+		})
+	}
+	return parts
+}
+
+type dosTable struct {
+	*mbr.Table
+}
+
+func (t dosTable) Type() string {
+	return "dos"
+}
+
+func (t dosTable) UUID() string {
+	return fmt.Sprintf("%08x", t.DiskSignature)
+}
+
+func (t dosTable) Partitions() []Partition {
+	var parts []Partition
+	for _, p := range t.Table.Partitions {
+		parts = append(parts, Partition{
+			Number:   p.Number,
+			FirstLBA: p.FirstLBA,
+			Sectors:  p.Sectors,
+			Type:     fmt.Sprintf("0x%x", p.Type),
+			UUID:     fmt.Sprintf("%08x-%02x", t.DiskSignature, p.Number),
+		})
+	}
+	return parts
+}
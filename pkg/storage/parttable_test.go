@@ -0,0 +1,82 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/u-root/u-root/pkg/gpt"
+	"github.com/u-root/u-root/pkg/mbr"
+)
+
+type memdisk []byte
+
+func (d memdisk) WriteAt(b []byte, off int64) (int, error) {
+	return copy(d[off:], b), nil
+}
+
+func (d memdisk) ReadAt(b []byte, off int64) (int, error) {
+	return bytes.NewReader(d).ReadAt(b, off)
+}
+
+func TestReadPartitionTableDOS(t *testing.T) {
+	d := make(memdisk, 8192*512)
+	require.NoError(t, mbr.Write(d, &mbr.Table{
+		DiskSignature: 0x1234abcd,
+		Partitions: []mbr.Partition{
+			{Number: 1, Type: mbr.TypeLinux, FirstLBA: 2048, Sectors: 2048},
+			{Number: 2, Type: mbr.TypeExtendedLBA, FirstLBA: 4096, Sectors: 4096},
+			{Number: 5, Type: 0x82, FirstLBA: 6144, Sectors: 2048},
+		},
+	}))
+
+	table, err := ReadPartitionTable(d)
+	require.NoError(t, err)
+	require.Equal(t, "dos", table.Type())
+	require.Equal(t, "1234abcd", table.UUID())
+	require.Equal(t, []Partition{
+		{Number: 1, FirstLBA: 2048, Sectors: 2048, Type: "0x83", UUID: "1234abcd-01"},
+		{Number: 2, FirstLBA: 4096, Sectors: 4096, Type: "0xf", UUID: "1234abcd-02"},
+		{Number: 5, FirstLBA: 6144, Sectors: 2048, Type: "0x82", UUID: "1234abcd-05"},
+	}, table.Partitions())
+
+	_, err = ReadPartitionTable(make(memdisk, 8192*512))
+	require.Error(t, err)
+}
+
+func TestReadPartitionTableHybrid(t *testing.T) {
+	d := make(memdisk, 8192*512)
+	g, err := gpt.Create(8192)
+	require.NoError(t, err)
+	_, err = g.AddPart(0, 0, 4095, gpt.DefaultAlign)
+	require.NoError(t, err)
+	require.NoError(t, g.SetName(1, "boot"))
+	require.NoError(t, gpt.Write(d, g))
+
+	// A hybrid MBR mirrors the GPT partition for legacy firmware.
+	require.NoError(t, mbr.Write(d, &mbr.Table{
+		Partitions: []mbr.Partition{
+			{Number: 1, Type: mbr.TypeGPT, FirstLBA: 1, Sectors: 2047},
+			{Number: 2, Type: 0x0c, FirstLBA: 2048, Sectors: 2048},
+		},
+	}))
+
+	table, err := ReadPartitionTable(d)
+	require.NoError(t, err)
+	require.Equal(t, "gpt", table.Type())
+	require.Equal(t, g.Primary.DiskGUID.String(), table.UUID())
+	parts := table.Partitions()
+	require.Len(t, parts, 1)
+	require.Equal(t, Partition{
+		Number:   1,
+		FirstLBA: 2048,
+		Sectors:  2048,
+		Type:     "0fc63daf-8483-4772-8e79-3d69d8477de4",
+		UUID:     g.Primary.Parts[0].UniqueGUID.String(),
+		Label:    "boot",
+	}, parts[0])
+}
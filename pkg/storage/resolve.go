@@ -0,0 +1,112 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ParseDeviceSpec splits a device specifier as found on kernel command lines
+// and in fstab into its key and value. Keys are LABEL, UUID, PARTUUID and
+// PARTLABEL; anything else must be a device name or path like /dev/sda1, and
+// is returned with an empty key and its device name as value.
+func ParseDeviceSpec(spec string) (string, string, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		name := strings.TrimPrefix(spec, "/dev/")
+		if len(name) == 0 || strings.Contains(name, "/") {
+			return "", "", fmt.Errorf("%q is not a block device", spec)
+		}
+		return "", name, nil
+	}
+	key, value := strings.ToUpper(spec[:i]), spec[i+1:]
+	// fstab allows quoting values that contain spaces.
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	switch key {
+	case "LABEL", "UUID", "PARTUUID", "PARTLABEL":
+	default:
+		return "", "", fmt.Errorf("unknown device specifier %q in %q", key, spec)
+	}
+	if len(value) == 0 {
+		return "", "", fmt.Errorf("empty %s in device specifier", key)
+	}
+	return key, value, nil
+}
+
+// PartitionsByFsLabel returns a list of BlockDev objects whose underlying
+// block device has a filesystem with the given label.
+func PartitionsByFsLabel(devices []BlockDev, label string) []BlockDev {
+	partitions := make([]BlockDev, 0)
+	for _, device := range devices {
+		if device.FsLabel == label {
+			partitions = append(partitions, device)
+		}
+	}
+	return partitions
+}
+
+// PartitionsByPartUUID returns a list of BlockDev objects whose underlying
+// block device is a partition with the given PARTUUID, compared
+// case-insensitively.
+func PartitionsByPartUUID(devices []BlockDev, uuid string) []BlockDev {
+	partitions := make([]BlockDev, 0)
+	for _, device := range devices {
+		if strings.EqualFold(device.PartUUID, uuid) {
+			partitions = append(partitions, device)
+		}
+	}
+	return partitions
+}
+
+// PartitionsByPartLabel returns a list of BlockDev objects whose underlying
+// block device is a GPT partition with the given name.
+func PartitionsByPartLabel(devices []BlockDev, label string) []BlockDev {
+	partitions := make([]BlockDev, 0)
+	for _, device := range devices {
+		if device.PartLabel == label {
+			partitions = append(partitions, device)
+		}
+	}
+	return partitions
+}
+
+// ResolveDevice returns the first of devices that matches spec, which is a
+// LABEL=, UUID=, PARTUUID= or PARTLABEL= specifier or a device path.
+func ResolveDevice(devices []BlockDev, spec string) (*BlockDev, error) {
+	key, value, err := ParseDeviceSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	var matches []BlockDev
+	switch key {
+	case "LABEL":
+		matches = PartitionsByFsLabel(devices, value)
+	case "UUID":
+		matches = PartitionsByFsUUID(devices, value)
+	case "PARTUUID":
+		matches = PartitionsByPartUUID(devices, value)
+	case "PARTLABEL":
+		matches = PartitionsByPartLabel(devices, value)
+	default:
+		for _, device := range devices {
+			if device.Name == value {
+				matches = append(matches, device)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no block device matches %q", spec)
+	}
+	return &matches[0], nil
+}
+
+// DevicePath returns the path of the device node of b.
+func (b BlockDev) DevicePath() string {
+	return filepath.Join("/dev", b.Name)
+}
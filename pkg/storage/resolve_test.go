@@ -0,0 +1,73 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeviceSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec       string
+		key, value string
+		err        bool
+	}{
+		{spec: "/dev/sda1", value: "sda1"},
+		{spec: "nvme0n1p2", value: "nvme0n1p2"},
+		{spec: "UUID=ACE5-5144", key: "UUID", value: "ACE5-5144"},
+		{spec: "uuid=ace5-5144", key: "UUID", value: "ace5-5144"},
+		{spec: `LABEL="EFI System"`, key: "LABEL", value: "EFI System"},
+		{spec: "PARTUUID=deadbeef-02", key: "PARTUUID", value: "deadbeef-02"},
+		{spec: "PARTLABEL=root=a", key: "PARTLABEL", value: "root=a"},
+		{spec: "ID=foo", err: true},
+		{spec: "LABEL=", err: true},
+		{spec: "/dev/mapper/root", err: true},
+		{spec: "", err: true},
+	} {
+		key, value, err := ParseDeviceSpec(tt.spec)
+		if tt.err {
+			require.Error(t, err, tt.spec)
+			continue
+		}
+		require.NoError(t, err, tt.spec)
+		require.Equal(t, tt.key, key, tt.spec)
+		require.Equal(t, tt.value, value, tt.spec)
+	}
+}
+
+func TestResolveDevice(t *testing.T) {
+	devices := []BlockDev{
+		{Name: "sda"},
+		{Name: "sda1", FsUUID: "ACE5-5144", FsLabel: "EFI", PartUUID: "5ba0c5e8-1b4e-4f3c-9d2a-3f1e6c1a0b01", PartLabel: "esp"},
+		{Name: "sda2", FsUUID: "2183ead8-a510-4b3d-9777-19c7090f66d9", FsLabel: "root", PartUUID: "5ba0c5e8-1b4e-4f3c-9d2a-3f1e6c1a0b02", PartLabel: "root"},
+		{Name: "sdb1", FsLabel: "root", PartUUID: "deadbeef-01"},
+	}
+	for _, tt := range []struct {
+		spec string
+		want string
+	}{
+		{"/dev/sda", "sda"},
+		{"sda2", "sda2"},
+		{"UUID=ace5-5144", "sda1"},
+		{"LABEL=EFI", "sda1"},
+		{"LABEL=root", "sda2"},
+		{"PARTUUID=5BA0C5E8-1B4E-4F3C-9D2A-3F1E6C1A0B02", "sda2"},
+		{"PARTUUID=deadbeef-01", "sdb1"},
+		{"PARTLABEL=esp", "sda1"},
+		{"LABEL=efi", ""},
+		{"PARTLABEL=swap", ""},
+		{"/dev/sdc", ""},
+	} {
+		dev, err := ResolveDevice(devices, tt.spec)
+		if tt.want == "" {
+			require.Error(t, err, tt.spec)
+			continue
+		}
+		require.NoError(t, err, tt.spec)
+		require.Equal(t, tt.want, dev.Name, tt.spec)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rescanInterval bounds the wait for a uevent, so devices are found even if
+// their events are missed or no uevent socket can be opened.
+var rescanInterval = time.Second
+
+// WaitForDevice resolves spec like ResolveDevice, waiting up to timeout for
+// the device to appear. Block devices are rescanned whenever the kernel
+// reports a new one. A zero timeout scans the devices once.
+func WaitForDevice(spec string, timeout time.Duration) (*BlockDev, error) {
+	if _, _, err := ParseDeviceSpec(spec); err != nil {
+		return nil, err
+	}
+	// Subscribe before the first scan, so no device slips in between.
+	fd, err := ueventSocket()
+	if err == nil {
+		defer unix.Close(fd)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := GetBlockStats()
+		if err != nil {
+			return nil, err
+		}
+		if dev, err := ResolveDevice(devices, spec); err == nil {
+			return dev, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("no block device matches %q after %v", spec, timeout)
+		}
+		if remaining > rescanInterval {
+			remaining = rescanInterval
+		}
+		if fd < 0 {
+			time.Sleep(remaining)
+			continue
+		}
+		waitBlockUevent(fd, remaining)
+	}
+}
+
+// ueventSocket opens a netlink socket that receives the kernel's uevents.
+func ueventSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// waitBlockUevent returns when a block device is added or changed, or after
+// timeout.
+func waitBlockUevent(fd int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 8192)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			time.Sleep(remaining)
+			return
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || isBlockUevent(buf[:n]) {
+			return
+		}
+	}
+}
+
+// isBlockUevent returns true for add and change uevents of block devices.
+// Uevents are a header like "add@/devices/..." followed by NUL separated
+// KEY=value pairs.
+func isBlockUevent(msg []byte) bool {
+	fields := bytes.Split(msg, []byte{0})
+	if !bytes.HasPrefix(fields[0], []byte("add@")) && !bytes.HasPrefix(fields[0], []byte("change@")) {
+		return false
+	}
+	for _, f := range fields[1:] {
+		if string(f) == "SUBSYSTEM=block" {
+			return true
+		}
+	}
+	return false
+}
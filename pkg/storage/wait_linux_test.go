@@ -0,0 +1,27 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBlockUevent(t *testing.T) {
+	for _, tt := range []struct {
+		msg  string
+		want bool
+	}{
+		{"add@/devices/virtual/block/loop0\x00ACTION=add\x00SUBSYSTEM=block\x00DEVNAME=loop0\x00", true},
+		{"change@/devices/virtual/block/loop0\x00ACTION=change\x00SUBSYSTEM=block\x00", true},
+		{"remove@/devices/virtual/block/loop0\x00ACTION=remove\x00SUBSYSTEM=block\x00", false},
+		{"add@/devices/virtual/net/lo\x00ACTION=add\x00SUBSYSTEM=net\x00", false},
+		{"libudev\x00\xfe\xed\xca\xfe", false},
+		{"", false},
+	} {
+		require.Equal(t, tt.want, isBlockUevent([]byte(tt.msg)), tt.msg)
+	}
+}